@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	applyDryRun bool
+	applyReport string
+)
+
+func newApplyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apply <FILE>",
+		Short: "Plan and run every extraction declared in a YAML file, then report on all of them",
+		Example: `  starget apply extraction.yaml
+  starget apply --dry-run extraction.yaml`,
+		Args: cobra.ExactArgs(1),
+		Run:  runApply,
+	}
+	cmd.Flags().BoolVar(&applyDryRun, "dry-run", false, "Only plan the extractions and print what would be downloaded")
+	cmd.Flags().StringVar(&applyReport, "report", "", "Also write the report as JSON to this file")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of concurrent workers for extractions that do not set their own")
+	return cmd
+}
+
+// extractionFile is the YAML document read by 'starget apply'.
+type extractionFile struct {
+	Version     int              `yaml:"version"`
+	Defaults    extractionSpec   `yaml:"defaults"`
+	Extractions []extractionSpec `yaml:"extractions"`
+}
+
+// extractionSpec declares one extraction. In the defaults section only
+// image, verify, ownership, on-conflict and concurrency are used.
+type extractionSpec struct {
+	Name        string         `yaml:"name"`
+	Image       string         `yaml:"image"`
+	Blob        string         `yaml:"blob"`
+	Paths       []string       `yaml:"paths"`
+	Dest        string         `yaml:"dest"`
+	Verify      string         `yaml:"verify"` // none, digest or diffid
+	Ownership   *ownershipSpec `yaml:"ownership"`
+	OnConflict  string         `yaml:"on-conflict"`
+	Concurrency int            `yaml:"concurrency"`
+	blobDigest  digest.Digest  // Parsed Blob
+	ownership   *stargzget.OwnershipOptions
+	policy      stargzget.ConflictPolicy
+}
+
+type ownershipSpec struct {
+	UIDMap        []string `yaml:"uid-map"`
+	GIDMap        []string `yaml:"gid-map"`
+	OwnershipFile string   `yaml:"ownership-file"` // Defaults to .starget-ownership.jsonl in dest
+}
+
+const (
+	verifyPolicyNone   = "none"
+	verifyPolicyDigest = "digest" // Check every file against its TOC entry's digest
+	verifyPolicyDiffID = "diffid" // Check a whole extracted layer against the image config
+)
+
+// readExtractionFile parses and checks an extraction file, filling each
+// extraction's unset fields from the defaults.
+func readExtractionFile(path string) ([]*extractionSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file extractionFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Version != 1 {
+		return nil, fmt.Errorf("%s: unsupported version %d (want 1)", path, file.Version)
+	}
+	if len(file.Extractions) == 0 {
+		return nil, fmt.Errorf("%s: no extractions", path)
+	}
+
+	specs := make([]*extractionSpec, 0, len(file.Extractions))
+	names := make(map[string]bool)
+	for i := range file.Extractions {
+		spec := &file.Extractions[i]
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("extraction-%d", i+1)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("%s: duplicate extraction name %q", path, spec.Name)
+		}
+		names[spec.Name] = true
+		if err := spec.complete(&file.Defaults); err != nil {
+			return nil, fmt.Errorf("%s: extraction %q: %w", path, spec.Name, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// complete applies defaults and checks the extraction.
+func (s *extractionSpec) complete(defaults *extractionSpec) error {
+	if s.Image == "" {
+		s.Image = defaults.Image
+	}
+	if s.Verify == "" {
+		s.Verify = defaults.Verify
+	}
+	if s.Verify == "" {
+		s.Verify = verifyPolicyNone
+	}
+	if s.Ownership == nil {
+		s.Ownership = defaults.Ownership
+	}
+	if s.OnConflict == "" {
+		s.OnConflict = defaults.OnConflict
+	}
+	if s.OnConflict == "" {
+		s.OnConflict = string(stargzget.ConflictError)
+	}
+	if s.Concurrency == 0 {
+		s.Concurrency = defaults.Concurrency
+	}
+
+	switch {
+	case s.Image == "":
+		return fmt.Errorf("no image")
+	case len(s.Paths) == 0:
+		return fmt.Errorf("no paths")
+	case s.Dest == "":
+		return fmt.Errorf("no dest")
+	case s.Concurrency < 0:
+		return fmt.Errorf("invalid concurrency %d", s.Concurrency)
+	}
+	if s.Blob != "" {
+		dgst, err := digest.Parse(s.Blob)
+		if err != nil {
+			return fmt.Errorf("invalid blob: %w", err)
+		}
+		s.blobDigest = dgst
+	}
+	switch s.Verify {
+	case verifyPolicyNone, verifyPolicyDigest:
+	case verifyPolicyDiffID:
+		if s.Blob == "" || len(s.Paths) != 1 || !isWholeLayerPattern(s.Paths[0]) {
+			return fmt.Errorf("verify: diffid requires a blob and paths: [\".\"]")
+		}
+	default:
+		return fmt.Errorf("unknown verify policy %q (want none, digest or diffid)", s.Verify)
+	}
+	policy, err := stargzget.ParseConflictPolicy(s.OnConflict)
+	if err != nil {
+		return err
+	}
+	s.policy = policy
+
+	if s.Ownership != nil {
+		s.ownership = &stargzget.OwnershipOptions{RecordPath: s.Ownership.OwnershipFile}
+		for _, m := range s.Ownership.UIDMap {
+			mapping, err := stargzget.ParseIDMapping(m)
+			if err != nil {
+				return err
+			}
+			s.ownership.UIDMap = append(s.ownership.UIDMap, mapping)
+		}
+		for _, m := range s.Ownership.GIDMap {
+			mapping, err := stargzget.ParseIDMapping(m)
+			if err != nil {
+				return err
+			}
+			s.ownership.GIDMap = append(s.ownership.GIDMap, mapping)
+		}
+		if s.ownership.RecordPath == "" {
+			s.ownership.RecordPath = filepath.Join(s.Dest, ".starget-ownership.jsonl")
+		}
+	}
+	return nil
+}
+
+// openedImage is an image shared by the extractions that name it, so its
+// manifest and TOCs are fetched once.
+type openedImage struct {
+	manifest *stor.Manifest
+	storage  stor.Storage
+	index    *stargzget.ImageIndex
+	resolver stargzget.BlobResolver
+}
+
+// extractionPlan is an extraction with the files it will download.
+type extractionPlan struct {
+	spec  *extractionSpec
+	image *openedImage
+	jobs  []*stargzget.DownloadJob
+	bytes int64
+}
+
+// extractionResult is one entry of the report.
+type extractionResult struct {
+	Name       string  `json:"name"`
+	Image      string  `json:"image"`
+	Manifest   string  `json:"manifest,omitempty"`
+	Dest       string  `json:"dest"`
+	Files      int     `json:"files"`
+	Downloaded int     `json:"downloaded"`
+	Failed     int     `json:"failed"`
+	Bytes      int64   `json:"bytes"`
+	Verify     string  `json:"verify"`
+	Verified   int     `json:"verified,omitempty"` // Files checked against their TOC digest
+	Mismatched int     `json:"mismatched,omitempty"`
+	Seconds    float64 `json:"seconds"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func runApply(cmd *cobra.Command, args []string) {
+	specs, err := readExtractionFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Plan everything before downloading anything, so a typo in the last
+	// extraction does not leave the first ones half done.
+	images := make(map[string]*openedImage)
+	var plans []*extractionPlan
+	var planErrs []string
+	for _, spec := range specs {
+		plan, err := planExtraction(spec, images)
+		if err != nil {
+			planErrs = append(planErrs, fmt.Sprintf("%s: %v", spec.Name, err))
+			continue
+		}
+		plans = append(plans, plan)
+		fmt.Printf("Plan %s: %d file(s), %d bytes from %s into %s\n", spec.Name, len(plan.jobs), plan.bytes, spec.Image, spec.Dest)
+	}
+	if len(planErrs) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d extraction(s) could not be planned:\n", len(planErrs))
+		for _, msg := range planErrs {
+			fmt.Fprintf(os.Stderr, "  %s\n", msg)
+		}
+		os.Exit(1)
+	}
+	if applyDryRun {
+		return
+	}
+
+	results := make([]extractionResult, 0, len(plans))
+	failed := 0
+	for _, plan := range plans {
+		result := runExtraction(cmd, plan)
+		if result.Error != "" || result.Failed > 0 || result.Mismatched > 0 {
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	fmt.Println()
+	printApplyReport(results)
+	if applyReport != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err == nil {
+			err = os.WriteFile(applyReport, append(data, '\n'), 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d of %d extraction(s) failed\n", failed, len(results))
+		os.Exit(1)
+	}
+}
+
+// planExtraction matches the extraction's paths in its image and builds
+// its download jobs. Files are laid out under dest by their image path.
+func planExtraction(spec *extractionSpec, images map[string]*openedImage) (*extractionPlan, error) {
+	ctx := commandContext()
+	image, ok := images[spec.Image]
+	if !ok {
+		manifest, storage, err := openImage(ctx, spec.Image)
+		if err != nil {
+			return nil, err
+		}
+		index, resolver, _, err := openIndex(ctx, spec.Image, manifest, storage)
+		if err != nil {
+			return nil, err
+		}
+		image = &openedImage{manifest: manifest, storage: storage, index: index, resolver: resolver}
+		images[spec.Image] = image
+	}
+
+	plan := &extractionPlan{spec: spec, image: image}
+	seen := make(map[string]bool)
+	extracted := make(map[string]string) // blob and image path of regular files -> output path
+	hardlinks := make(map[*stargzget.DownloadJob]string)
+	for _, pattern := range spec.Paths {
+		if pattern == "*" {
+			pattern = "."
+		}
+		matched := image.index.FilterFiles(pattern, spec.blobDigest)
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("no files matched pattern: %s", pattern)
+		}
+		for _, fileInfo := range matched {
+			key := fileInfo.BlobDigest.String() + ":" + fileInfo.Path
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			source, err := image.index.ResolveFile(fileInfo, spec.blobDigest)
+			if err != nil {
+				if strict {
+					return nil, err
+				}
+				fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", fileInfo.Path, err)
+				continue
+			}
+			job := &stargzget.DownloadJob{
+				Path:       source.Path,
+				BlobDigest: source.BlobDigest,
+				Size:       source.Size,
+				OutputPath: filepath.Join(spec.Dest, filepath.Clean(fileInfo.Path)),
+				Mode:       source.Mode,
+				UID:        source.UID,
+				GID:        source.GID,
+				ModTime:    source.ModTime,
+			}
+			plan.jobs = append(plan.jobs, job)
+			plan.bytes += source.Size
+
+			sourceKey := source.BlobDigest.String() + ":" + source.Path
+			if fileInfo.IsRegular() {
+				extracted[sourceKey] = job.OutputPath
+			} else if fileInfo.IsHardlink() {
+				hardlinks[job] = sourceKey
+			}
+		}
+	}
+	for job, sourceKey := range hardlinks {
+		if target, ok := extracted[sourceKey]; ok {
+			job.LinkTo = target
+		}
+	}
+	if len(plan.jobs) == 0 {
+		return nil, fmt.Errorf("no regular files to download")
+	}
+	return plan, nil
+}
+
+// runExtraction downloads one planned extraction and applies its
+// verification policy. Failures are reported in the result rather than
+// stopping the other extractions.
+func runExtraction(cmd *cobra.Command, plan *extractionPlan) extractionResult {
+	spec := plan.spec
+	started := time.Now()
+	result := extractionResult{
+		Name:     spec.Name,
+		Image:    spec.Image,
+		Manifest: plan.image.manifest.Digest.String(),
+		Dest:     spec.Dest,
+		Files:    len(plan.jobs),
+		Verify:   spec.Verify,
+	}
+	fmt.Printf("Extracting %s (%d file(s))\n", spec.Name, len(plan.jobs))
+
+	ctx := commandContext()
+	opts := tuningOptions(cmd)
+	if spec.Concurrency > 0 {
+		opts.Concurrency = spec.Concurrency
+	}
+	opts.Ownership = spec.ownership
+	opts.Portability = stargzget.HostPortability(spec.policy)
+	if portable {
+		opts.Portability = stargzget.StrictPortability(spec.policy)
+	} else if !opts.Portability.CaseInsensitive && stargzget.CaseInsensitiveDir(spec.Dest) {
+		opts.Portability.CaseInsensitive = true
+	}
+	var provenance bytes.Buffer
+	if spec.Verify == verifyPolicyDigest {
+		// Provenance records carry the result of checking each file
+		// against its TOC digest.
+		opts.Provenance = &stargzget.ProvenanceOptions{Writer: &provenance, Image: spec.Image, ImageDigest: plan.image.manifest.Digest}
+	}
+
+	downloader := stargzget.NewDownloader(plan.image.resolver, plan.image.storage)
+	stats, err := downloader.StartDownload(ctx, plan.jobs, nil, &opts)
+	result.Seconds = time.Since(started).Seconds()
+	if stats != nil {
+		printPathIssues(stats)
+		result.Downloaded = stats.DownloadedFiles
+		result.Failed = stats.FailedFiles + stats.BlockedFiles
+		result.Bytes = stats.DownloadedBytes
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	switch spec.Verify {
+	case verifyPolicyDigest:
+		dec := json.NewDecoder(&provenance)
+		for dec.More() {
+			var record stargzget.ProvenanceRecord
+			if err := dec.Decode(&record); err != nil {
+				result.Error = fmt.Sprintf("reading verification results: %v", err)
+				return result
+			}
+			switch record.Verification {
+			case stargzget.VerificationVerified:
+				result.Verified++
+			case stargzget.VerificationMismatch:
+				result.Mismatched++
+				fmt.Fprintf(os.Stderr, "Warning: %s: %s does not match its TOC digest\n", spec.Name, record.Path)
+			}
+		}
+	case verifyPolicyDiffID:
+		if result.Failed > 0 {
+			result.Error = fmt.Sprintf("not verifying diff ID, %d file(s) failed to download", result.Failed)
+			return result
+		}
+		if _, err := verifyLayerDiffID(ctx, plan.image.storage, plan.image.manifest, spec.blobDigest); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
+
+// printApplyReport prints one line per extraction.
+func printApplyReport(results []extractionResult) {
+	fmt.Println("Report:")
+	for _, r := range results {
+		status := "ok"
+		switch {
+		case r.Error != "":
+			status = "error: " + r.Error
+		case r.Failed > 0:
+			status = fmt.Sprintf("%d file(s) failed", r.Failed)
+		case r.Mismatched > 0:
+			status = fmt.Sprintf("%d file(s) do not match their TOC digest", r.Mismatched)
+		}
+		var verified string
+		switch r.Verify {
+		case verifyPolicyDigest:
+			verified = fmt.Sprintf(", %d verified", r.Verified)
+		case verifyPolicyDiffID:
+			if r.Error == "" {
+				verified = ", diff ID verified"
+			}
+		}
+		fmt.Printf("  %s: %d/%d files, %d bytes%s in %.1fs -> %s: %s\n",
+			r.Name, r.Downloaded, r.Files, r.Bytes, verified, r.Seconds, r.Dest, strings.TrimSpace(status))
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/opencontainers/go-digest"
+)
+
+const testBlob = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// writeExtractionFile writes content to a file in a temporary directory and
+// returns its path.
+func writeExtractionFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "extract.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write extraction file: %v", err)
+	}
+	return path
+}
+
+func TestReadExtractionFile_Valid(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		check func(t *testing.T, specs []*extractionSpec)
+	}{
+		{
+			name: "defaults fill unset fields",
+			yaml: `
+version: 1
+defaults:
+  image: ghcr.io/org/app:v1
+  verify: digest
+  on-conflict: rename
+  concurrency: 8
+extractions:
+  - name: config
+    paths: ["/etc/app"]
+    dest: ./out/config
+  - image: ghcr.io/org/tools:v2
+    paths: ["usr/bin/tool"]
+    dest: ./out/tools
+    verify: none
+    concurrency: 2
+`,
+			check: func(t *testing.T, specs []*extractionSpec) {
+				if len(specs) != 2 {
+					t.Fatalf("got %d extractions, want 2", len(specs))
+				}
+				config, tools := specs[0], specs[1]
+				if config.Name != "config" || config.Image != "ghcr.io/org/app:v1" || config.Verify != verifyPolicyDigest ||
+					config.policy != stargzget.ConflictRename || config.Concurrency != 8 {
+					t.Errorf("config = %+v, want the defaults applied", config)
+				}
+				if tools.Name != "extraction-2" || tools.Image != "ghcr.io/org/tools:v2" || tools.Verify != verifyPolicyNone || tools.Concurrency != 2 {
+					t.Errorf("tools = %+v, want its own fields kept and a generated name", tools)
+				}
+			},
+		},
+		{
+			name: "built-in defaults",
+			yaml: `
+version: 1
+extractions:
+  - image: app:v1
+    paths: ["."]
+    dest: out
+`,
+			check: func(t *testing.T, specs []*extractionSpec) {
+				spec := specs[0]
+				if spec.Verify != verifyPolicyNone || spec.policy != stargzget.ConflictError || spec.ownership != nil {
+					t.Errorf("spec = %+v, want verify none, on-conflict error and no ownership", spec)
+				}
+			},
+		},
+		{
+			name: "diffid with a whole layer",
+			yaml: `
+version: 1
+extractions:
+  - image: app:v1
+    blob: ` + testBlob + `
+    paths: ["."]
+    dest: rootfs
+    verify: diffid
+`,
+			check: func(t *testing.T, specs []*extractionSpec) {
+				if specs[0].blobDigest != digest.Digest(testBlob) {
+					t.Errorf("blobDigest = %q, want %q", specs[0].blobDigest, testBlob)
+				}
+			},
+		},
+		{
+			name: "ownership from the defaults",
+			yaml: `
+version: 1
+defaults:
+  ownership:
+    uid-map: ["0:100000:65536"]
+    gid-map: ["0:200000:65536"]
+extractions:
+  - image: app:v1
+    paths: ["var/lib"]
+    dest: volume
+`,
+			check: func(t *testing.T, specs []*extractionSpec) {
+				own := specs[0].ownership
+				if own == nil || len(own.UIDMap) != 1 || own.UIDMap[0].HostID != 100000 || len(own.GIDMap) != 1 ||
+					own.RecordPath != filepath.Join("volume", ".starget-ownership.jsonl") {
+					t.Errorf("ownership = %+v, want the maps and a record file in dest", own)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			specs, err := readExtractionFile(writeExtractionFile(t, tt.yaml))
+			if err != nil {
+				t.Fatalf("readExtractionFile() error = %v", err)
+			}
+			tt.check(t, specs)
+		})
+	}
+}
+
+// testInvalidExtractionFiles checks that each case is rejected with an
+// error mentioning wantErr.
+func testInvalidExtractionFiles(t *testing.T, tests []struct{ name, yaml, wantErr string }) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readExtractionFile(writeExtractionFile(t, tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("readExtractionFile() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadExtractionFile_UnknownKeys(t *testing.T) {
+	testInvalidExtractionFiles(t, []struct{ name, yaml, wantErr string }{
+		{
+			name:    "top level",
+			yaml:    "version: 1\nextraction: []\n",
+			wantErr: "field extraction not found",
+		},
+		{
+			name:    "misspelled extraction field",
+			yaml:    "version: 1\nextractions:\n  - image: app:v1\n    path: [\".\"]\n    dest: out\n",
+			wantErr: "field path not found",
+		},
+		{
+			name:    "ownership",
+			yaml:    "version: 1\nextractions:\n  - image: app:v1\n    paths: [\".\"]\n    dest: out\n    ownership:\n      uidmap: [\"0:1:1\"]\n",
+			wantErr: "field uidmap not found",
+		},
+		{
+			name:    "unsupported version",
+			yaml:    "version: 2\nextractions:\n  - image: app:v1\n    paths: [\".\"]\n    dest: out\n",
+			wantErr: "unsupported version 2",
+		},
+		{
+			name:    "unknown verify policy",
+			yaml:    "version: 1\nextractions:\n  - image: app:v1\n    paths: [\".\"]\n    dest: out\n    verify: sha\n",
+			wantErr: `unknown verify policy "sha"`,
+		},
+	})
+}
+
+func TestReadExtractionFile_MissingFields(t *testing.T) {
+	testInvalidExtractionFiles(t, []struct{ name, yaml, wantErr string }{
+		{
+			name:    "no extractions",
+			yaml:    "version: 1\n",
+			wantErr: "no extractions",
+		},
+		{
+			name:    "image",
+			yaml:    "version: 1\nextractions:\n  - name: etc\n    paths: [etc]\n    dest: out\n",
+			wantErr: `extraction "etc": no image`,
+		},
+		{
+			name:    "dest",
+			yaml:    "version: 1\nextractions:\n  - name: etc\n    image: app:v1\n    paths: [etc]\n",
+			wantErr: `extraction "etc": no dest`,
+		},
+		{
+			name:    "paths",
+			yaml:    "version: 1\nextractions:\n  - image: app:v1\n    dest: out\n",
+			wantErr: `extraction "extraction-1": no paths`,
+		},
+		{
+			name:    "blob for diffid",
+			yaml:    "version: 1\nextractions:\n  - image: app:v1\n    paths: [\".\"]\n    dest: out\n    verify: diffid\n",
+			wantErr: "diffid requires a blob",
+		},
+	})
+}
+
+func TestReadExtractionFile_DuplicateTargets(t *testing.T) {
+	testInvalidExtractionFiles(t, []struct{ name, yaml, wantErr string }{
+		{
+			name: "explicit names",
+			yaml: `
+version: 1
+defaults:
+  image: app:v1
+extractions:
+  - name: config
+    paths: [etc]
+    dest: a
+  - name: config
+    paths: [usr]
+    dest: b
+`,
+			wantErr: `duplicate extraction name "config"`,
+		},
+		{
+			name: "name taken by a generated one",
+			yaml: `
+version: 1
+defaults:
+  image: app:v1
+extractions:
+  - paths: [etc]
+    dest: a
+  - name: extraction-1
+    paths: [usr]
+    dest: b
+`,
+			wantErr: `duplicate extraction name "extraction-1"`,
+		},
+	})
+}
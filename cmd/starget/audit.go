@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/spf13/cobra"
+)
+
+var auditStrict bool
+
+func newAuditCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit <REGISTRY>/<IMAGE>:<TAG>",
+		Short: "Report which layers can be verified from their eStargz TOC and chunk digests",
+		Args:  cobra.ExactArgs(1),
+		Run:   runAudit,
+	}
+	cmd.Flags().BoolVar(&auditStrict, "strict", false, "Exit with status 1 unless every layer is fully verifiable")
+	return cmd
+}
+
+func runAudit(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+	ctx := commandContext()
+
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	audits, err := stargzget.AuditImage(ctx, storage, manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	counts := make(map[stargzget.AuditStatus]int)
+	for i, audit := range audits {
+		counts[audit.Status]++
+		fmt.Printf("Layer %d: %s\n", i, audit.BlobDigest)
+		fmt.Printf("  Status:     %s\n", audit.Status)
+		if audit.TOCDigest != "" {
+			verified := "does not match"
+			if audit.TOCDigestVerified {
+				verified = "verified"
+			}
+			fmt.Printf("  TOC digest: %s (%s)\n", audit.TOCDigest, verified)
+		} else {
+			fmt.Printf("  TOC digest: not annotated\n")
+		}
+		fmt.Printf("  Chunks:     %d of %d with chunk digests\n", audit.DigestedChunks, audit.Chunks)
+		if audit.Reason != "" {
+			fmt.Printf("  Reason:     %s\n", audit.Reason)
+		}
+	}
+	fmt.Printf("\n%d verifiable, %d partial, %d unverifiable\n",
+		counts[stargzget.AuditVerifiable], counts[stargzget.AuditPartial], counts[stargzget.AuditUnverifiable])
+
+	if auditStrict && counts[stargzget.AuditVerifiable] != len(audits) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+var blobOutput string
+
+func newBlobCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "blob <REGISTRY>/<IMAGE>:<TAG> [DIGEST]",
+		Short: "List the blobs of an image or OCI artifact, or download one by digest",
+		Long: `Without DIGEST, list every blob the manifest references (config, layers and
+artifact blobs) with its media type. With DIGEST, download that blob as is,
+whatever its media type, verifying its digest. The blob is written to stdout
+unless -o is given.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run:  runBlob,
+	}
+	cmd.Flags().StringVarP(&blobOutput, "output", "o", "", "Write the blob to this file instead of stdout")
+	return cmd
+}
+
+func runBlob(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+	ctx := commandContext()
+
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(args) == 1 {
+		printBlobs(manifest)
+		return
+	}
+
+	dgst, err := digest.Parse(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing digest: %v\n", err)
+		os.Exit(1)
+	}
+	// Blobs the manifest does not list can still be fetched by digest from
+	// the same repository, just without a size to check.
+	desc := stor.Descriptor{Digest: dgst.String()}
+	for _, d := range manifest.AllDescriptors() {
+		if d.Digest == dgst.String() {
+			desc = d
+			break
+		}
+	}
+
+	if blobOutput == "" {
+		if _, err := stor.CopyBlob(ctx, storage, desc, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	n, err := writeBlobFile(ctx, storage, desc, blobOutput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s (%d bytes) to %s\n", dgst, n, blobOutput)
+}
+
+// printBlobs lists the blobs of manifest, one per line.
+func printBlobs(manifest *stor.Manifest) {
+	if manifest.ArtifactType != "" {
+		fmt.Printf("Artifact type: %s\n", manifest.ArtifactType)
+	}
+	if manifest.Subject != nil {
+		fmt.Printf("Subject: %s\n", manifest.Subject.Digest)
+	}
+	role := func(i int) string {
+		if manifest.Config.Digest != "" {
+			if i == 0 {
+				return "config"
+			}
+			i--
+		}
+		if i < len(manifest.Layers) {
+			return fmt.Sprintf("layer %d", i)
+		}
+		return fmt.Sprintf("blob %d", i-len(manifest.Layers))
+	}
+	for i, desc := range manifest.AllDescriptors() {
+		fmt.Printf("%-8s %s (size: %d bytes, type: %s)\n", role(i), desc.Digest, desc.Size, desc.MediaType)
+	}
+}
+
+// writeBlobFile copies the blob to a temporary file next to path and renames
+// it into place once the digest has been verified.
+func writeBlobFile(ctx context.Context, storage stor.Storage, desc stor.Descriptor, path string) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.partial")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	// CreateTemp makes the file private; give it the usual mode instead.
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+
+	n, err := stor.CopyBlob(ctx, storage, desc, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	chaosSeed         int64
+	chaosRuns         int
+	chaosErrorRate    float64
+	chaosTruncateRate float64
+	chaosCorruptRate  float64
+	chaosSlowRate     float64
+	chaosSlowDelay    time.Duration
+	chaosRetries      int
+	chaosConcurrency  int
+	chaosKeep         bool
+)
+
+func newChaosTestCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "chaos-test <REGISTRY>/<IMAGE>:<TAG> [PATTERN...]",
+		Short: "Download files through injected storage faults and check the output",
+		Long: `Download the files matching PATTERN (default: all) once cleanly and then
+through a storage layer that injects 503 errors, slow reads, truncated
+bodies and corrupt gzip data, and compare every file with the clean copy.
+Faults are derived from --seed, so a failing run can be repeated exactly.
+The command fails if any file fails or differs.
+
+Requires a starget built with the faultinject build tag:
+
+  go build -tags faultinject ./cmd/starget`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runChaosTest,
+	}
+	cmd.Flags().Int64Var(&chaosSeed, "seed", 1, "Seed choosing which requests fail; run N uses seed+N-1")
+	cmd.Flags().IntVar(&chaosRuns, "runs", 1, "Number of faulty downloads, each with its own seed")
+	cmd.Flags().Float64Var(&chaosErrorRate, "error-rate", 0.1, "Fraction of blob reads failing with 503")
+	cmd.Flags().Float64Var(&chaosTruncateRate, "truncate-rate", 0.05, "Fraction of blob reads whose body ends early")
+	cmd.Flags().Float64Var(&chaosCorruptRate, "corrupt-rate", 0.05, "Fraction of blob reads whose gzip header is corrupted")
+	cmd.Flags().Float64Var(&chaosSlowRate, "slow-rate", 0, "Fraction of blob reads delayed by --slow-delay")
+	cmd.Flags().DurationVar(&chaosSlowDelay, "slow-delay", 200*time.Millisecond, "Delay of slow reads")
+	cmd.Flags().IntVar(&chaosRetries, "retries", 10, "Maximum retries per file")
+	cmd.Flags().IntVar(&chaosConcurrency, "concurrency", 4, "Number of concurrent workers")
+	cmd.Flags().BoolVar(&chaosKeep, "keep", false, "Keep the downloaded files and print where they are")
+	return cmd
+}
+
+func runChaosTest(cmd *cobra.Command, args []string) {
+	patterns := args[1:]
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	if err := chaosTest(args[0], patterns); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
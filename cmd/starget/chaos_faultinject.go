@@ -0,0 +1,119 @@
+//go:build faultinject
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/internal/faultinject"
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+// chaosTest downloads the files matching patterns cleanly, then chaosRuns
+// times through injected faults, and compares the results.
+func chaosTest(imageRef string, patterns []string) error {
+	ctx := commandContext()
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		return err
+	}
+	index, _, _, err := openIndex(ctx, imageRef, manifest, storage)
+	if err != nil {
+		return err
+	}
+
+	var files []*stargzget.FileInfo
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		for _, info := range index.FilterFiles(pattern, "") {
+			if info.IsRegular() && !seen[info.Path] {
+				seen[info.Path] = true
+				files = append(files, info)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no regular files matched")
+	}
+
+	dir, err := os.MkdirTemp("", "starget-chaos-*")
+	if err != nil {
+		return err
+	}
+	if chaosKeep {
+		fmt.Printf("Keeping downloads in %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	// The TOCs come from the clean index, so faults hit file reads only.
+	resolverOpts := append(resolverOptions(), index.ResolverOptions()...)
+	download := func(storage stor.Storage, out string) (*stargzget.DownloadStats, []*stargzget.DownloadJob, error) {
+		jobs := make([]*stargzget.DownloadJob, len(files))
+		for i, info := range files {
+			jobs[i] = &stargzget.DownloadJob{Path: info.Path, BlobDigest: info.BlobDigest, Size: info.Size, OutputPath: filepath.Join(out, info.Path)}
+		}
+		opts := &stargzget.DownloadOptions{MaxRetries: chaosRetries, RetryBackoff: 10 * time.Millisecond, Concurrency: chaosConcurrency}
+		downloader := stargzget.NewDownloader(stargzget.NewBlobResolver(storage, resolverOpts...), storage)
+		stats, err := downloader.StartDownload(ctx, jobs, nil, opts)
+		return stats, jobs, err
+	}
+
+	stats, reference, err := download(storage, filepath.Join(dir, "clean"))
+	if err != nil {
+		return fmt.Errorf("clean download: %w", err)
+	}
+	if stats.FailedFiles > 0 {
+		return fmt.Errorf("clean download: %d of %d file(s) failed", stats.FailedFiles, len(files))
+	}
+	fmt.Printf("Downloaded %d file(s) cleanly\n", len(files))
+
+	failedRuns := 0
+	for run := 1; run <= chaosRuns; run++ {
+		seed := chaosSeed + int64(run-1)
+		faulty, err := faultinject.Wrap(storage, faultinject.Config{
+			Seed:         seed,
+			ErrorRate:    chaosErrorRate,
+			TruncateRate: chaosTruncateRate,
+			CorruptRate:  chaosCorruptRate,
+			SlowRate:     chaosSlowRate,
+			SlowDelay:    chaosSlowDelay,
+		})
+		if err != nil {
+			return err
+		}
+		stats, jobs, err := download(faulty, filepath.Join(dir, fmt.Sprintf("run-%d", run)))
+		if err != nil {
+			return fmt.Errorf("run %d: %w", run, err)
+		}
+		differ := 0
+		for i, job := range jobs {
+			want, _ := os.ReadFile(reference[i].OutputPath)
+			got, err := os.ReadFile(job.OutputPath)
+			if err == nil && !bytes.Equal(got, want) {
+				differ++
+				fmt.Fprintf(os.Stderr, "  run %d: %s differs from the clean download\n", run, job.Path)
+			}
+		}
+		retries := 0
+		for _, n := range stats.RetryReasons {
+			retries += n
+		}
+		c := faulty.Counts()
+		result := "ok"
+		if stats.FailedFiles > 0 || differ > 0 {
+			result = "FAILED"
+			failedRuns++
+		}
+		fmt.Printf("Run %d (seed %d): %d reads, %d errors, %d truncated, %d corrupted, %d slow; %d retries; %d failed, %d differ: %s\n",
+			run, seed, c.Reads, c.Errors, c.Truncated, c.Corrupted, c.Slow, retries, stats.FailedFiles, differ, result)
+	}
+	if failedRuns > 0 {
+		return fmt.Errorf("%d of %d run(s) failed", failedRuns, chaosRuns)
+	}
+	return nil
+}
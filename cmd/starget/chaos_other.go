@@ -0,0 +1,10 @@
+//go:build !faultinject
+
+package main
+
+import "fmt"
+
+// chaosTest is unavailable without the faultinject build tag.
+func chaosTest(imageRef string, patterns []string) error {
+	return fmt.Errorf("this starget was built without fault injection; rebuild with -tags faultinject")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/spf13/cobra"
+)
+
+// envDefaults lists flags whose default can come from the environment. A flag
+// given on the command line always wins; an unset or empty variable leaves
+// the built-in default in place. Keeping secrets such as STARGET_CREDENTIAL
+// out of argv also keeps them out of process listings.
+var envDefaults = []struct {
+	flag string
+	env  string
+}{
+	{flag: "concurrency", env: "STARGET_CONCURRENCY"},
+	{flag: "credential", env: "STARGET_CREDENTIAL"},
+	{flag: "auth-file", env: "STARGET_AUTH_FILE"},
+	{flag: "insecure", env: "STARGET_INSECURE"},
+	{flag: "cache-dir", env: "STARGET_CACHE_DIR"},
+	{flag: "chunk-cache", env: "STARGET_CHUNK_CACHE"},
+	{flag: "connect-timeout", env: "STARGET_CONNECT_TIMEOUT"},
+	{flag: "ipv4", env: "STARGET_IPV4"},
+	{flag: "max-requests-per-host", env: "STARGET_MAX_REQUESTS_PER_HOST"},
+	{flag: "toc-memory", env: "STARGET_TOC_MEMORY"},
+	{flag: "operation-header", env: "STARGET_OPERATION_HEADER"},
+	{flag: "strict-toc", env: "STARGET_STRICT_TOC"},
+	{flag: "tar-fallback", env: "STARGET_TAR_FALLBACK"},
+	{flag: "preset", env: "STARGET_PRESET"},
+	{flag: "timeout", env: "STARGET_TIMEOUT"},
+	{flag: "non-interactive", env: "STARGET_NON_INTERACTIVE"},
+}
+
+// applyEnvDefaults fills flags of cmd that were not set explicitly from their
+// environment variables.
+func applyEnvDefaults(cmd *cobra.Command) error {
+	for _, d := range envDefaults {
+		flag := cmd.Flags().Lookup(d.flag)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		value := os.Getenv(d.env)
+		if value == "" {
+			continue
+		}
+		// Set the value without marking the flag as changed, so code that
+		// distinguishes explicit flags keeps treating it as a default.
+		if err := flag.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid %s=%q: %v", d.env, value, err)
+		}
+	}
+	return nil
+}
+
+// flagExplicit reports whether the flag called name was set on the command
+// line or through its environment variable.
+func flagExplicit(cmd *cobra.Command, name string) bool {
+	if flag := cmd.Flags().Lookup(name); flag != nil && flag.Changed {
+		return true
+	}
+	for _, d := range envDefaults {
+		if d.flag == name {
+			return os.Getenv(d.env) != ""
+		}
+	}
+	return false
+}
+
+// timeoutGrace is how long a command may keep running after --timeout
+// cancelled its context before it is stopped outright.
+const timeoutGrace = 5 * time.Second
+
+var (
+	commandCtx                       = context.Background()
+	cancelCommand context.CancelFunc = func() {}
+)
+
+// commandContext returns the context commands run under; it ends when
+// --timeout elapses.
+func commandContext() context.Context {
+	return commandCtx
+}
+
+// tagCommand tags the registry requests of cmd with its name, e.g.
+// "index save", in the debug log and the --operation-header header.
+func tagCommand(cmd *cobra.Command) {
+	name := strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+	commandCtx = stor.WithOperation(commandCtx, stor.Operation{Command: name})
+}
+
+// startCommandTimeout applies --timeout. Registry requests and downloads
+// stop when the context ends; if the command still has not exited after a
+// grace period, e.g. because it is blocked outside any request, the process
+// exits with an error so automation never hangs.
+func startCommandTimeout() {
+	if commandTimeout <= 0 {
+		return
+	}
+	err := fmt.Errorf("command timed out after %s (--timeout)", commandTimeout)
+	commandCtx, cancelCommand = context.WithTimeoutCause(context.Background(), commandTimeout, err)
+	time.AfterFunc(commandTimeout+timeoutGrace, func() {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	})
+}
+
+// resolverOptions returns the BlobResolver options shared by all commands.
+func resolverOptions() []stargzget.BlobResolverOption {
+	var opts []stargzget.BlobResolverOption
+	if cacheDir != "" {
+		opts = append(opts, stargzget.WithTOCCacheDir(cacheDir))
+	}
+	if tarFallback {
+		opts = append(opts, stargzget.WithTarFallback())
+	}
+	return opts
+}
+
+// sourceDateEpoch returns the time in SOURCE_DATE_EPOCH, the convention of
+// reproducible builds for the latest timestamp an output may carry, or the
+// zero time if it is unset.
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH=%q: %v", value, err)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// loaderOptions returns the index loader options from the global flags.
+func loaderOptions() []stargzget.BlobIndexLoaderOption {
+	if !strictTOC {
+		return nil
+	}
+	return []stargzget.BlobIndexLoaderOption{stargzget.WithStrictTOC()}
+}
+
+// dialOptions returns the registry connection settings from the global flags.
+func dialOptions() stor.DialOptions {
+	return stor.DialOptions{
+		ConnectTimeout: connectTimeout,
+		FallbackDelay:  fallbackDelay,
+		ForceIPv4:      forceIPv4,
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// newEnvTestCmd returns a command with flags shaped like the real ones, so
+// applyEnvDefaults can be exercised without touching the global flag
+// variables.
+func newEnvTestCmd() *cobra.Command {
+	cmd := &cobra.Command{Use: "test"}
+	cmd.PersistentFlags().StringArray("credential", nil, "")
+	cmd.PersistentFlags().BoolP("insecure", "k", false, "")
+	cmd.PersistentFlags().String("cache-dir", "", "")
+	cmd.Flags().Int("concurrency", 4, "")
+	return cmd
+}
+
+func TestApplyEnvDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		want    map[string]string
+		changed []string
+		wantErr string
+	}{
+		{
+			name: "built-in defaults without environment",
+			want: map[string]string{"concurrency": "4", "insecure": "false", "cache-dir": "", "credential": "[]"},
+		},
+		{
+			name: "environment fills unset flags",
+			env: map[string]string{
+				"STARGET_CONCURRENCY": "16",
+				"STARGET_INSECURE":    "true",
+				"STARGET_CACHE_DIR":   "/var/cache/starget",
+				"STARGET_CREDENTIAL":  "ghcr.io=me:fakeToken",
+			},
+			want: map[string]string{
+				"concurrency": "16",
+				"insecure":    "true",
+				"cache-dir":   "/var/cache/starget",
+				"credential":  "[ghcr.io=me:fakeToken]",
+			},
+		},
+		{
+			name:    "flag on the command line wins",
+			env:     map[string]string{"STARGET_CONCURRENCY": "16", "STARGET_INSECURE": "true"},
+			args:    []string{"--concurrency", "2", "--insecure=false"},
+			want:    map[string]string{"concurrency": "2", "insecure": "false"},
+			changed: []string{"concurrency", "insecure"},
+		},
+		{
+			name: "empty variable keeps the default",
+			env:  map[string]string{"STARGET_CONCURRENCY": "", "STARGET_CACHE_DIR": ""},
+			want: map[string]string{"concurrency": "4", "cache-dir": ""},
+		},
+		{
+			name: "variable for a flag the command lacks is ignored",
+			env:  map[string]string{"STARGET_TOC_MEMORY": "1GiB"},
+			want: map[string]string{"concurrency": "4"},
+		},
+		{
+			name:    "invalid value",
+			env:     map[string]string{"STARGET_CONCURRENCY": "many"},
+			wantErr: `invalid STARGET_CONCURRENCY="many"`,
+		},
+		{
+			name:    "invalid boolean",
+			env:     map[string]string{"STARGET_INSECURE": "sometimes"},
+			wantErr: `invalid STARGET_INSECURE="sometimes"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, d := range envDefaults {
+				t.Setenv(d.env, "")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cmd := newEnvTestCmd()
+			if err := cmd.ParseFlags(tt.args); err != nil {
+				t.Fatalf("ParseFlags(%v) error = %v", tt.args, err)
+			}
+
+			err := applyEnvDefaults(cmd)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("applyEnvDefaults() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyEnvDefaults() error = %v", err)
+			}
+
+			for name, want := range tt.want {
+				if got := cmd.Flags().Lookup(name).Value.String(); got != want {
+					t.Errorf("--%s = %q, want %q", name, got, want)
+				}
+			}
+			// Values from the environment must not look explicit.
+			explicit := make(map[string]bool)
+			for _, name := range tt.changed {
+				explicit[name] = true
+			}
+			for name := range tt.want {
+				if got := cmd.Flags().Lookup(name).Changed; got != explicit[name] {
+					t.Errorf("--%s Changed = %v, want %v", name, got, explicit[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/spf13/cobra"
+)
+
+var cpRecursive bool
+
+// cpLayout is set by 'starget cp' to lay out get's output the way cp does:
+// a file goes to DEST, or into DEST when it is a directory, and a directory
+// tree keeps its paths relative to SRC rather than to the image root.
+var cpLayout *cpOptions
+
+type cpOptions struct {
+	source     string // Image path being copied, without a leading slash; "" for the root
+	recursive  bool
+	dest       string
+	destIsDir  bool // DEST exists as a directory or ends with a separator
+	destExists bool
+}
+
+func newCpCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cp [-r] <REGISTRY>/<IMAGE>:<TAG>:<PATH> <DEST>",
+		Short: "Copy a file, or with -r a directory, out of an image like docker cp and kubectl cp",
+		Example: `  starget cp nginx:1.25:/etc/nginx/nginx.conf ./nginx.conf
+  starget cp -r nginx:1.25:/usr/share/nginx ./nginx/`,
+		Args: cobra.ExactArgs(2),
+		Run:  runCp,
+	}
+	cmd.Flags().BoolVarP(&cpRecursive, "recursive", "r", false, "Copy directories recursively")
+	cmd.Flags().BoolVar(&noProgress, "no-progress", false, "Disable progress bar (progress is enabled by default)")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of concurrent workers (default: 4, set to 1 for sequential)")
+	cmd.Flags().BoolVar(&followSymlinks, "follow-symlinks", false, "Resolve symlinks anywhere in PATH, including links to directories")
+	return cmd
+}
+
+func runCp(cmd *cobra.Command, args []string) {
+	imageRef, source, err := parseCpSource(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	dest := args[1]
+
+	layout := &cpOptions{source: source, recursive: cpRecursive, dest: dest}
+	if info, err := os.Stat(dest); err == nil {
+		layout.destExists = true
+		layout.destIsDir = info.IsDir()
+	}
+	if strings.HasSuffix(dest, "/") || strings.HasSuffix(dest, string(filepath.Separator)) {
+		layout.destIsDir = true
+	}
+	cpLayout = layout
+
+	// Recursive copies select the directory's tree; plain copies select
+	// the path alone and fail in runGet if it turns out to be a directory.
+	pattern := source
+	if cpRecursive && source != "" {
+		pattern += "/"
+	}
+	if source == "" {
+		pattern = "."
+	}
+	runGet(cmd, []string{imageRef, pattern, dest})
+}
+
+// parseCpSource splits IMAGE:PATH at the colon that starts the absolute
+// PATH, so tags, digests and registry ports in IMAGE are left alone, e.g.
+// localhost:5000/app:v1:/etc/hosts, oci:/tmp/layout:/etc/hosts or
+// docker-archive:app.tar#app:v1:/etc/hosts.
+func parseCpSource(arg string) (imageRef, source string, err error) {
+	prefix, rest := "", arg
+	for _, p := range []string{ociRefPrefix, archiveRefPrefix} {
+		if strings.HasPrefix(arg, p) {
+			prefix, rest = p, strings.TrimPrefix(arg, p)
+		}
+	}
+	i := strings.Index(rest, ":/")
+	if i <= 0 {
+		return "", "", fmt.Errorf("source %q must be IMAGE:/PATH with an absolute PATH; copying into an image is not supported", arg)
+	}
+	source = strings.TrimPrefix(path.Clean(rest[i+1:]), "/")
+	return prefix + rest[:i], source, nil
+}
+
+// check rejects a plain copy whose source is a directory.
+func (o *cpOptions) check(matched []*stargzget.FileInfo) error {
+	if o.recursive {
+		return nil
+	}
+	for _, info := range matched {
+		if info.Path != o.source {
+			return fmt.Errorf("/%s is a directory; use cp -r to copy it", o.source)
+		}
+	}
+	return nil
+}
+
+// outputPath returns where the file at imagePath is copied to.
+func (o *cpOptions) outputPath(imagePath string) string {
+	imagePath = path.Clean(imagePath)
+	if imagePath == o.source {
+		if o.destIsDir {
+			return filepath.Join(o.dest, path.Base(imagePath))
+		}
+		return o.dest
+	}
+	rel := strings.TrimPrefix(imagePath, o.source+"/")
+	if o.source == "" {
+		rel = imagePath
+	}
+	// Like cp -r, copying into an existing directory creates SRC's base
+	// name inside it, while a new DEST becomes the copy itself.
+	if o.destExists && o.source != "" {
+		return filepath.Join(o.dest, path.Base(o.source), filepath.FromSlash(rel))
+	}
+	return filepath.Join(o.dest, filepath.FromSlash(rel))
+}
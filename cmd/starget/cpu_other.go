@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+// cpuSeconds is not measured on this platform.
+func cpuSeconds() float64 {
+	return 0
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+func newFileCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "file <REGISTRY>/<IMAGE>:<TAG> [BLOB] <PATH>",
+		Short: "Detect a file's type from its first bytes without downloading it",
+		Args:  cobra.RangeArgs(2, 3),
+		Run:   runFile,
+	}
+	cmd.Flags().StringVar(&indexDB, "index-db", "", "Look the file up in this database, filled by 'starget index add', and read only its layer's TOC from there; fails if the image's manifest has changed")
+	return cmd
+}
+
+func runFile(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+	var blobDigest string
+	path := args[1]
+	if len(args) == 3 {
+		blobDigest = args[1]
+		path = args[2]
+	}
+	path = strings.TrimPrefix(path, "/")
+
+	ctx := commandContext()
+
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var dgst digest.Digest
+	if blobDigest != "" {
+		dgst, err = digest.Parse(blobDigest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing digest: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if indexDB != "" {
+		index, layer, err := fileIndexDB(ctx, imageRef, manifest, path, dgst)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		resolver := stargzget.NewBlobResolver(storage, append(resolverOptions(), index.ResolverOptions()...)...)
+		if err := describeFile(ctx, index, resolver, storage, path, layer); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	resolver := stargzget.NewBlobResolver(storage, resolverOptions()...)
+	loader := stargzget.NewBlobIndexLoader(storage, resolver, loaderOptions()...)
+	index, err := loader.Load(ctx)
+	if err != nil {
+		printIndexError(err)
+		os.Exit(1)
+	}
+
+	if err := describeFile(ctx, index, resolver, storage, path, dgst); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// describeFile prints what starget file reports about path: where it lives,
+// its metadata, and its type sniffed from its first bytes.
+func describeFile(ctx context.Context, index *stargzget.ImageIndex, resolver stargzget.BlobResolver, storage stor.Storage, path string, dgst digest.Digest) error {
+	link, err := index.FindFile(path, dgst)
+	if err != nil {
+		return err
+	}
+	if link.IsSymlink() {
+		fmt.Printf("Link:  %s -> %s\n", link.Path, link.LinkName)
+	} else if link.IsHardlink() {
+		fmt.Printf("Link:  %s => %s\n", link.Path, link.HardlinkTarget())
+	}
+
+	info, err := index.ResolveFile(link, dgst)
+	if err != nil {
+		return err
+	}
+
+	head, err := stargzget.ReadFileHead(ctx, resolver, storage, info.BlobDigest, info.Path, stargzget.FileTypeSniffLen)
+	if err != nil {
+		return fmt.Errorf("reading file: %w", err)
+	}
+
+	entry := tocEntry(ctx, resolver, info)
+
+	fmt.Printf("Path:  %s\n", info.Path)
+	fmt.Printf("Blob:  %s\n", info.BlobDigest)
+	fmt.Printf("Size:  %d bytes\n", info.Size)
+	fmt.Printf("Mode:  %s\n", info.Mode)
+	fmt.Printf("Owner: %s\n", formatOwner(info, entry))
+	if entry != nil && entry.ModTime3339 != "" {
+		fmt.Printf("MTime: %s\n", entry.ModTime3339)
+	}
+	fmt.Printf("Type:  %s\n", stargzget.DetectFileType(head))
+	return nil
+}
+
+// tocEntry returns the TOC entry for info, or nil if it cannot be found. The
+// TOC is already cached by the resolver after loading the index.
+func tocEntry(ctx context.Context, resolver stargzget.BlobResolver, info *stargzget.FileInfo) *estargzutil.TOCEntry {
+	toc, err := resolver.TOC(ctx, info.BlobDigest)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range toc.Entries {
+		if entry.Name == info.Path && entry.Type == "reg" {
+			return entry
+		}
+	}
+	return nil
+}
+
+func formatOwner(info *stargzget.FileInfo, entry *estargzutil.TOCEntry) string {
+	owner := fmt.Sprintf("%d:%d", info.UID, info.GID)
+	if entry != nil && (entry.Uname != "" || entry.Gname != "") {
+		owner += fmt.Sprintf(" (%s:%s)", entry.Uname, entry.Gname)
+	}
+	return owner
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/spf13/cobra"
+)
+
+// Metadata filter flags shared by ls and get.
+var (
+	newerThan string
+	olderThan string
+	minSize   string
+	maxSize   string
+	filterArg string
+)
+
+// addFilterFlags registers the TOC metadata filters on cmd.
+func addFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&newerThan, "newer-than", "", "Only files modified after this time (RFC 3339, YYYY-MM-DD, or a duration such as 72h meaning that long ago)")
+	cmd.Flags().StringVar(&olderThan, "older-than", "", "Only files modified before this time (same formats as --newer-than)")
+	cmd.Flags().StringVar(&minSize, "min-size", "", "Only files of at least this size (bytes, or with a K, M or G suffix)")
+	cmd.Flags().StringVar(&maxSize, "max-size", "", "Only files of at most this size (bytes, or with a K, M or G suffix)")
+	cmd.Flags().StringVar(&filterArg, "filter", "", `Only files matching this expression, e.g. 'size > 1MB && path =~ "^usr/lib" && !(path contains ".debug")'`)
+}
+
+// fileFilter builds the metadata filter from the filter flags.
+func fileFilter(now time.Time) (stargzget.FileFilter, error) {
+	var f stargzget.FileFilter
+	var err error
+	if f.NewerThan, err = parseTimeFlag("--newer-than", newerThan, now); err != nil {
+		return f, err
+	}
+	if f.OlderThan, err = parseTimeFlag("--older-than", olderThan, now); err != nil {
+		return f, err
+	}
+	if f.MinSize, err = parseSizeFlag("--min-size", minSize); err != nil {
+		return f, err
+	}
+	if f.MaxSize, err = parseSizeFlag("--max-size", maxSize); err != nil {
+		return f, err
+	}
+	if f.MinSize > 0 && f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return f, fmt.Errorf("--min-size %s is larger than --max-size %s", minSize, maxSize)
+	}
+	if filterArg != "" {
+		if f.Expr, err = stargzget.ParseFilterExpr(filterArg); err != nil {
+			return f, fmt.Errorf("invalid --filter: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// parseTimeFlag accepts an RFC 3339 timestamp, a date, or a duration counted
+// back from now.
+func parseTimeFlag(name, value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q: expected RFC 3339 time, YYYY-MM-DD or a duration", name, value)
+}
+
+// parseSizeFlag parses a byte count with an optional binary K, M or G suffix.
+func parseSizeFlag(name, value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	s := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(value, "B"), "b"))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier, s = 1<<10, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		multiplier, s = 1<<20, strings.TrimSuffix(s, "M")
+	case strings.HasSuffix(s, "G"):
+		multiplier, s = 1<<30, strings.TrimSuffix(s, "G")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a byte count such as 512, 64K or 10M", name, value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+// ociRefPrefix marks image references naming an OCI image layout on disk:
+// oci:DIR names the only (or first) manifest in DIR/index.json, and
+// oci:DIR#REF the one annotated with org.opencontainers.image.ref.name REF.
+const ociRefPrefix = "oci:"
+
+// archiveRefPrefix marks image references naming an image archive:
+// docker-archive:FILE names the first image in a `docker save` tarball or
+// an exported OCI layout, and docker-archive:FILE#NAME the one tagged NAME.
+const archiveRefPrefix = "docker-archive:"
+
+// parseOCIRef splits an oci: reference into the layout directory and the
+// manifest name. ok is false for registry references.
+func parseOCIRef(imageRef string) (dir, ref string, ok bool) {
+	rest, ok := strings.CutPrefix(imageRef, ociRefPrefix)
+	if !ok {
+		return "", "", false
+	}
+	dir, ref, _ = strings.Cut(rest, "#")
+	if dir == "" {
+		dir = "."
+	}
+	return dir, ref, true
+}
+
+// parseArchiveRef splits a docker-archive: reference into the archive path
+// and the image name. ok is false for other references.
+func parseArchiveRef(imageRef string) (file, ref string, ok bool) {
+	rest, ok := strings.CutPrefix(imageRef, archiveRefPrefix)
+	if !ok {
+		return "", "", false
+	}
+	file, ref, _ = strings.Cut(rest, "#")
+	return file, ref, true
+}
+
+// openImage resolves imageRef to its manifest and the storage serving its
+// blobs, from --blob-dir when set, from an OCI layout for oci: references,
+// from an archive for docker-archive: references and from the registry
+// otherwise.
+func openImage(ctx context.Context, imageRef string) (*stor.Manifest, stor.Storage, error) {
+	if blobDir != "" {
+		blobs, err := openBlobDir(imageRef)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkBuildCache(imageRef, blobs.Manifest()); err != nil {
+			return nil, nil, err
+		}
+		return blobs.Manifest(), blobs, nil
+	}
+	if dir, ref, ok := parseOCIRef(imageRef); ok {
+		if keepBlobs != "" {
+			return nil, nil, fmt.Errorf("--keep-blobs only applies to registry images")
+		}
+		local, err := openLayout(dir, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkBuildCache(imageRef, local.Manifest()); err != nil {
+			return nil, nil, err
+		}
+		return local.Manifest(), local, nil
+	}
+	if file, ref, ok := parseArchiveRef(imageRef); ok {
+		if keepBlobs != "" {
+			return nil, nil, fmt.Errorf("--keep-blobs only applies to registry images")
+		}
+		archive, err := openArchive(file, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkBuildCache(imageRef, archive.Manifest()); err != nil {
+			return nil, nil, err
+		}
+		return archive.Manifest(), archive, nil
+	}
+
+	ref, err := refs.Parse(imageRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := newRegistryClient()
+	manifest, err := getManifest(ctx, client, imageRef)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	if err := checkBuildCache(imageRef, manifest); err != nil {
+		return nil, nil, err
+	}
+	return manifest, newImageStorage(ctx, client, imageRef, ref.Registry, ref.Repository, manifest), nil
+}
+
+// checkBuildCache rejects BuildKit cache exports unless --build-cache is
+// set. Their layers are build steps rather than an image's filesystem, so
+// listing them as one image would mislead.
+func checkBuildCache(imageRef string, manifest *stor.Manifest) error {
+	if buildCache || !manifest.IsBuildCache() {
+		return nil
+	}
+	return fmt.Errorf("%s is a BuildKit cache export, not an image: its %d layer(s) are the results of separate build steps. "+
+		"Pass --build-cache to read files from its eStargz layers anyway", imageRef, len(manifest.Layers))
+}
+
+// loadManifest returns the manifest of imageRef without preparing blob
+// storage.
+func loadManifest(ctx context.Context, imageRef string) (*stor.Manifest, error) {
+	if blobDir != "" {
+		blobs, err := openBlobDir(imageRef)
+		if err != nil {
+			return nil, err
+		}
+		return blobs.Manifest(), nil
+	}
+	if dir, ref, ok := parseOCIRef(imageRef); ok {
+		local, err := openLayout(dir, ref)
+		if err != nil {
+			return nil, err
+		}
+		return local.Manifest(), nil
+	}
+	if file, ref, ok := parseArchiveRef(imageRef); ok {
+		archive, err := openArchive(file, ref)
+		if err != nil {
+			return nil, err
+		}
+		defer archive.Close()
+		return archive.Manifest(), nil
+	}
+	return getManifest(ctx, newRegistryClient(), imageRef)
+}
+
+func openLayout(dir, ref string) (*stor.LocalStorage, error) {
+	if platformDigest != "" || platform != "" {
+		return nil, fmt.Errorf("--platform and --platform-digest do not apply to OCI layouts; name the manifest with oci:DIR#REF")
+	}
+	if manifestFile != "" {
+		return nil, fmt.Errorf("--manifest-file does not apply to OCI layouts, which hold their own manifests")
+	}
+	return stor.NewLocalStorage(dir, ref)
+}
+
+func openArchive(file, ref string) (*stor.ArchiveStorage, error) {
+	if platformDigest != "" || platform != "" {
+		return nil, fmt.Errorf("--platform and --platform-digest do not apply to image archives; name the image with docker-archive:FILE#NAME")
+	}
+	if manifestFile != "" {
+		return nil, fmt.Errorf("--manifest-file does not apply to image archives, which hold their own manifests")
+	}
+	return stor.NewArchiveStorage(file, ref)
+}
+
+// openBlobDir opens --blob-dir for imageRef, which then only names the
+// image: nothing is fetched from its registry.
+func openBlobDir(imageRef string) (*stor.BlobDirStorage, error) {
+	if _, _, ok := parseOCIRef(imageRef); ok {
+		return nil, fmt.Errorf("--blob-dir does not apply to OCI layouts, which hold their own blobs")
+	}
+	if _, _, ok := parseArchiveRef(imageRef); ok {
+		return nil, fmt.Errorf("--blob-dir does not apply to image archives, which hold their own blobs")
+	}
+	if keepBlobs != "" {
+		return nil, fmt.Errorf("--keep-blobs cannot be combined with --blob-dir, which fetches nothing")
+	}
+	if platformDigest != "" || platform != "" {
+		return nil, fmt.Errorf("--platform and --platform-digest cannot be combined with --blob-dir; supply the platform's manifest with --manifest-file")
+	}
+	var manifest *stor.Manifest
+	if manifestFile != "" {
+		data, err := os.ReadFile(manifestFile)
+		if err != nil {
+			return nil, err
+		}
+		if manifest, err = stor.ParseManifest(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", manifestFile, err)
+		}
+	}
+	return stor.NewBlobDirStorage(blobDir, manifest)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	indexSaveOutput   string
+	indexDBPath       string
+	indexSearchDigest string
+)
+
+func newIndexCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "index",
+		Short: "Save image indexes to a file or a database, so later steps can skip the TOC fetches with --index or --index-db",
+	}
+	saveCmd := &cobra.Command{
+		Use:   "save <REGISTRY>/<IMAGE>:<TAG>",
+		Short: "Fetch the image's TOCs and save its index as JSON",
+		Args:  cobra.ExactArgs(1),
+		Run:   runIndexSave,
+	}
+	saveCmd.Flags().StringVarP(&indexSaveOutput, "output", "o", "", "Write the index to this file instead of stdout")
+	loadCmd := &cobra.Command{
+		Use:   "load <REGISTRY>/<IMAGE>:<TAG> <FILE>",
+		Short: "Check that a saved index still matches the image's manifest and summarize it",
+		Args:  cobra.ExactArgs(2),
+		Run:   runIndexLoad,
+	}
+	addCmd := &cobra.Command{
+		Use:   "add --db FILE <REGISTRY>/<IMAGE>:<TAG>...",
+		Short: "Fetch the images' TOCs and store their indexes in an SQLite database, replacing earlier ones",
+		Long: `Fetch the images' TOCs and store their indexes in an SQLite database,
+replacing earlier ones.
+
+Requires a starget built with the sqlite build tag:
+
+  go build -tags sqlite ./cmd/starget`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  runIndexAdd,
+	}
+	addCmd.Flags().StringVar(&indexDBPath, "db", "", "Index database to add the images to; created if missing")
+	addCmd.MarkFlagRequired("db")
+	searchCmd := &cobra.Command{
+		Use:   "search --db FILE [PATTERN]",
+		Short: "List the files matching PATTERN (a glob such as /usr/bin/log4j*) in every image in the database",
+		Long: `List the files matching PATTERN (a glob such as /usr/bin/log4j*) in every
+image in the database.
+
+Requires a starget built with the sqlite build tag:
+
+  go build -tags sqlite ./cmd/starget`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runIndexSearch,
+	}
+	searchCmd.Flags().StringVar(&indexDBPath, "db", "", "Index database to search")
+	searchCmd.Flags().StringVar(&indexSearchDigest, "digest", "", "Only list files with this content digest")
+	searchCmd.MarkFlagRequired("db")
+	cmd.AddCommand(saveCmd, loadCmd, addCmd, searchCmd)
+	return cmd
+}
+
+func runIndexSave(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+	ctx := commandContext()
+
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	loader := stargzget.NewBlobIndexLoader(storage, stargzget.NewBlobResolver(storage, resolverOptions()...), loaderOptions()...)
+	index, err := loader.Load(ctx)
+	if err != nil {
+		printIndexError(err)
+		os.Exit(1)
+	}
+	index.ManifestDigest = manifest.Digest
+	printTOCWarnings(loader.Warnings())
+	if skipped := skippedLayers(loader.Warnings()); len(skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d layer(s) could not be read and are not in the saved index:\n", len(skipped))
+		printSkippedLayers(skipped)
+	}
+
+	data, err := json.Marshal(index)
+	if err == nil {
+		data = append(data, '\n')
+		if indexSaveOutput == "" {
+			_, err = os.Stdout.Write(data)
+		} else {
+			err = os.WriteFile(indexSaveOutput, data, 0o644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runIndexLoad(cmd *cobra.Command, args []string) {
+	imageRef, path := args[0], args[1]
+
+	manifest, err := loadManifest(commandContext(), imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to get manifest: %v\n", err)
+		os.Exit(1)
+	}
+	index, err := readIndexFile(path, manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Index %s matches %s\n", path, imageRef)
+	fmt.Printf("Manifest: %s\n", manifest.Digest)
+	fmt.Printf("Layers: %d, files: %d\n", len(index.Layers), len(index.AllFiles()))
+}
+
+func runIndexAdd(cmd *cobra.Command, args []string) {
+	if err := addToIndexDB(commandContext(), indexDBPath, args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runIndexSearch(cmd *cobra.Command, args []string) {
+	pattern := ""
+	if len(args) > 0 {
+		pattern = args[0]
+	}
+	if err := searchIndexDB(commandContext(), indexDBPath, pattern, indexSearchDigest); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// readIndexFile loads an index saved by 'starget index save' and checks it
+// against the image's current manifest.
+func readIndexFile(path string, manifest *stor.Manifest) (*stargzget.ImageIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var index stargzget.ImageIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid index file %s: %w", path, err)
+	}
+	if err := index.CheckManifest(manifest); err != nil {
+		return nil, fmt.Errorf("index file %s is out of date, save it again: %w", path, err)
+	}
+	return &index, nil
+}
+
+// openIndex returns the image's index and a resolver for its blobs. With
+// --index or --index-db the index comes from that file or database and its
+// TOCs seed the resolver; otherwise the TOCs are fetched and the warnings
+// are those of the load.
+func openIndex(ctx context.Context, imageRef string, manifest *stor.Manifest, storage stor.Storage) (*stargzget.ImageIndex, stargzget.BlobResolver, []stargzget.Warning, error) {
+	if indexFile != "" && indexDB != "" {
+		return nil, nil, nil, fmt.Errorf("--index and --index-db cannot be used together")
+	}
+	if indexDB != "" {
+		index, err := readIndexDB(ctx, indexDB, imageRef, manifest)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		opts := append(resolverOptions(), index.ResolverOptions()...)
+		return index, stargzget.NewBlobResolver(storage, opts...), nil, nil
+	}
+	if indexFile == "" {
+		resolver := stargzget.NewBlobResolver(storage, resolverOptions()...)
+		loader := stargzget.NewBlobIndexLoader(storage, resolver, loaderOptions()...)
+		index, err := loader.Load(ctx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		index.ManifestDigest = manifest.Digest
+		return index, resolver, loader.Warnings(), nil
+	}
+
+	index, err := readIndexFile(indexFile, manifest)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	opts := append(resolverOptions(), index.ResolverOptions()...)
+	return index, stargzget.NewBlobResolver(storage, opts...), nil, nil
+}
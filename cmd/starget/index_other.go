@@ -0,0 +1,36 @@
+//go:build !sqlite
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// errNoSQLite is returned by the index database commands and flags without
+// the sqlite build tag.
+var errNoSQLite = errors.New("this starget was built without index database support; rebuild with -tags sqlite")
+
+func addToIndexDB(ctx context.Context, path string, args []string) error {
+	return errNoSQLite
+}
+
+func searchIndexDB(ctx context.Context, path, pattern, dgst string) error {
+	return errNoSQLite
+}
+
+func readIndexDB(ctx context.Context, path, imageRef string, manifest *stor.Manifest) (*stargzget.ImageIndex, error) {
+	return nil, errNoSQLite
+}
+
+func lsIndexDB(ctx context.Context, imageRef string, manifest *stor.Manifest, blobDigest digest.Digest, filter stargzget.FileFilter) error {
+	return errNoSQLite
+}
+
+func fileIndexDB(ctx context.Context, imageRef string, manifest *stor.Manifest, path string, blobDigest digest.Digest) (*stargzget.ImageIndex, digest.Digest, error) {
+	return nil, "", errNoSQLite
+}
@@ -0,0 +1,173 @@
+//go:build sqlite
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/sqlindex"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// addToIndexDB indexes each image of args into the database at path. An
+// image that fails is reported and skipped, and the others are still added.
+func addToIndexDB(ctx context.Context, path string, args []string) error {
+	db, err := sqlindex.Open(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	failed := 0
+	for _, imageRef := range args {
+		manifest, storage, err := openImage(ctx, imageRef)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", imageRef, err)
+			failed++
+			continue
+		}
+		loader := stargzget.NewBlobIndexLoader(storage, stargzget.NewBlobResolver(storage, resolverOptions()...), loaderOptions()...)
+		index, err := loader.Load(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", imageRef, err)
+			failed++
+			continue
+		}
+		index.ManifestDigest = manifest.Digest
+		printTOCWarnings(loader.Warnings())
+		if skipped := skippedLayers(loader.Warnings()); len(skipped) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %d layer(s) could not be read and are not in the database:\n", imageRef, len(skipped))
+			printSkippedLayers(skipped)
+		}
+		if err := db.Add(ctx, imageRef, index); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", imageRef, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Added %s (%s, %d files)\n", imageRef, manifest.Digest, len(index.AllFiles()))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d image(s) could not be added", failed, len(args))
+	}
+	return nil
+}
+
+// searchIndexDB prints the files of every image in the database at path
+// that match pattern and digest.
+func searchIndexDB(ctx context.Context, path, pattern, dgst string) error {
+	db, err := sqlindex.OpenReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	matches, err := db.Search(ctx, sqlindex.Query{Pattern: pattern, Digest: dgst})
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		fmt.Printf("%s\t/%s\t%d\t%s\n", m.Image, m.Path, m.Size, m.BlobDigest)
+	}
+	return nil
+}
+
+// readIndexDB loads the index of imageRef from an index database and
+// checks it against the image's current manifest.
+func readIndexDB(ctx context.Context, path, imageRef string, manifest *stor.Manifest) (*stargzget.ImageIndex, error) {
+	db, err := sqlindex.OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	index, err := db.Index(ctx, imageRef, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("index database %s: %w", path, err)
+	}
+	return index, nil
+}
+
+// openIndexDB opens the --index-db database read-only for the commands
+// that query its tables instead of rebuilding the whole index.
+func openIndexDB() (*sqlindex.DB, error) {
+	if indexFile != "" {
+		return nil, fmt.Errorf("--index and --index-db cannot be used together")
+	}
+	return sqlindex.OpenReadOnly(indexDB)
+}
+
+// lsIndexDB is 'starget ls' with --index-db. The image's files come from
+// the database's files table; with a blob digest only that layer's TOC is
+// decoded, since its listing includes files later layers override.
+func lsIndexDB(ctx context.Context, imageRef string, manifest *stor.Manifest, blobDigest digest.Digest, filter stargzget.FileFilter) error {
+	db, err := openIndexDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if blobDigest != "" {
+		index, err := db.LayerIndex(ctx, imageRef, manifest, blobDigest)
+		if stargzerrors.GetErrorCode(err) == stargzerrors.ErrBlobNotFound.Code {
+			return fmt.Errorf("blob not found: %s", blobDigest)
+		}
+		if err != nil {
+			return fmt.Errorf("index database %s: %w", indexDB, err)
+		}
+		fmt.Printf("Files in blob %s:\n", blobDigest)
+		for _, file := range index.Layers[0].Files {
+			if matchesFilter(index, filter, file, blobDigest) {
+				fmt.Println(file)
+			}
+		}
+		return nil
+	}
+
+	files, err := db.Files(ctx, imageRef, manifest, sqlindex.Query{})
+	if err != nil {
+		return fmt.Errorf("index database %s: %w", indexDB, err)
+	}
+	fmt.Printf("All files in %s:\n", imageRef)
+	for _, info := range files {
+		if filter.Match(info) {
+			fmt.Println(info.Path)
+		}
+	}
+	return nil
+}
+
+// fileIndexDB returns the index 'starget file' describes path from with
+// --index-db: the files table says which layer path comes from (or the
+// given blob digest does), and only that layer's TOC is decoded. A symlink
+// may point into any layer, so it gets the whole index.
+func fileIndexDB(ctx context.Context, imageRef string, manifest *stor.Manifest, path string, blobDigest digest.Digest) (*stargzget.ImageIndex, digest.Digest, error) {
+	db, err := openIndexDB()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	if blobDigest == "" {
+		info, err := db.Stat(ctx, imageRef, manifest, path)
+		if err != nil {
+			return nil, "", fmt.Errorf("index database %s: %w", indexDB, err)
+		}
+		if info.IsSymlink() {
+			index, err := db.Index(ctx, imageRef, manifest)
+			if err != nil {
+				return nil, "", fmt.Errorf("index database %s: %w", indexDB, err)
+			}
+			return index, "", nil
+		}
+		blobDigest = info.BlobDigest
+	}
+	index, err := db.LayerIndex(ctx, imageRef, manifest, blobDigest)
+	if err != nil {
+		return nil, "", fmt.Errorf("index database %s: %w", indexDB, err)
+	}
+	return index, blobDigest, nil
+}
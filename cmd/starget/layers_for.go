@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var layersForQuiet bool
+
+func newLayersForCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "layers-for <REGISTRY>/<IMAGE>:<TAG> <PATTERN>",
+		Short: "List the layers holding the files matching PATTERN, with their compressed sizes",
+		Long: `List the layers an image's files matching PATTERN come from, in image
+order, with each layer's compressed size and how many of the files it holds.
+Links also need the layer of their target. Only these blobs have to be
+mirrored or pulled to get the files; layers whose files are all replaced or
+deleted by later layers are left out.`,
+		Args: cobra.ExactArgs(2),
+		Run:  runLayersFor,
+	}
+	cmd.Flags().BoolVarP(&layersForQuiet, "quiet", "q", false, "Print only the layer digests, one per line")
+	return cmd
+}
+
+func runLayersFor(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+	pattern := args[1]
+	if pattern == "*" {
+		pattern = "."
+	}
+
+	ctx := commandContext()
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	index, _, warnings, err := openIndex(ctx, imageRef, manifest, storage)
+	if err != nil {
+		printIndexError(err)
+		os.Exit(1)
+	}
+	printTOCWarnings(warnings)
+
+	files := index.FilterFiles(pattern, "")
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "No files matched pattern: %s\n", pattern)
+		os.Exit(1)
+	}
+	if skipped := skippedLayers(warnings); len(skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d layer(s) could not be read; files they hold are not accounted for:\n", len(skipped))
+		printSkippedLayers(skipped)
+	}
+
+	sizes := make(map[string]int64)
+	for _, layer := range manifest.Layers {
+		sizes[layer.Digest] = layer.Size
+	}
+	layers := index.LayersFor(files)
+	var total int64
+	for _, layer := range layers {
+		if layersForQuiet {
+			fmt.Println(layer.BlobDigest)
+			continue
+		}
+		size := sizes[layer.BlobDigest.String()]
+		total += size
+		fmt.Printf("%s  %10s  %d file(s), %s uncompressed\n", layer.BlobDigest, formatBytes(size), layer.Files, formatBytes(layer.Bytes))
+	}
+	if !layersForQuiet {
+		fmt.Printf("\n%d of %d layer(s), %s (%d bytes) compressed\n", len(layers), len(index.Layers), formatBytes(total), total)
+	}
+}
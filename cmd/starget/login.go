@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var (
+	loginUsername      string
+	loginPasswordStdin bool
+	loginCredsStore    string
+	loginStorePlain    bool
+)
+
+func newLoginCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "login <REGISTRY>",
+		Short: "Verify and store credentials for a registry",
+		Args:  cobra.ExactArgs(1),
+		Run:   runLogin,
+	}
+	cmd.Flags().StringVarP(&loginUsername, "username", "u", "", "Registry username")
+	cmd.Flags().BoolVar(&loginPasswordStdin, "password-stdin", false, "Read the password from stdin")
+	cmd.Flags().StringVar(&loginCredsStore, "creds-store", "", "Store secrets in docker-credential-<NAME> (e.g. osxkeychain, secretservice, pass) instead of the config file")
+	cmd.Flags().BoolVar(&loginStorePlain, "insecure-store-password", false, "Allow writing the password unencrypted into the config file when no credential helper is configured")
+	return cmd
+}
+
+func newLogoutCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "logout <REGISTRY>",
+		Short: "Remove stored credentials for a registry",
+		Args:  cobra.ExactArgs(1),
+		Run:   runLogout,
+	}
+}
+
+func runLogin(cmd *cobra.Command, args []string) {
+	registry := args[0]
+	ctx := commandContext()
+
+	username := loginUsername
+	if username == "" {
+		username = os.Getenv(stor.EnvUsername)
+	}
+	if username == "" {
+		fmt.Fprintln(os.Stderr, "Error: --username is required")
+		os.Exit(1)
+	}
+
+	password, err := readLoginPassword()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading password: %v\n", err)
+		os.Exit(1)
+	}
+
+	client := stor.NewRemoteRegistryStorage(insecure).WithDialOptions(dialOptions()).WithCredential(username, password)
+	if err := client.CheckAuth(ctx, registry); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	store, err := defaultCredentialStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if loginStorePlain {
+		store.AllowPlaintext()
+	}
+	cred := stor.Credential{Username: username, Password: password}
+	if err := store.Store(ctx, registry, cred, loginCredsStore); errors.Is(err, stor.ErrPlaintextCredential) {
+		fmt.Fprintf(os.Stderr, "Error: %v; pass --creds-store NAME to keep it in a credential helper, or --insecure-store-password to write it to %s\n", err, store.Path())
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error storing credentials: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Login succeeded for %s (credentials saved in %s)\n", registry, store.Path())
+}
+
+func runLogout(cmd *cobra.Command, args []string) {
+	registry := args[0]
+
+	store, err := defaultCredentialStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	removed, err := store.Erase(commandContext(), registry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error removing credentials: %v\n", err)
+		os.Exit(1)
+	}
+	if !removed {
+		fmt.Printf("Not logged in to %s\n", registry)
+		return
+	}
+	fmt.Printf("Removed credentials for %s\n", registry)
+}
+
+func defaultCredentialStore() (*stor.FileCredentialStore, error) {
+	path, err := stor.DefaultConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	return stor.NewFileCredentialStore(path), nil
+}
+
+// readLoginPassword reads the password from stdin (--password-stdin), the
+// STARGET_PASSWORD environment variable, or an interactive prompt.
+func readLoginPassword() (string, error) {
+	if loginPasswordStdin {
+		data, err := io.ReadAll(bufio.NewReader(os.Stdin))
+		if err != nil {
+			return "", err
+		}
+		password := strings.TrimRight(string(data), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("empty password on stdin")
+		}
+		return password, nil
+	}
+
+	if password := os.Getenv(stor.EnvPassword); password != "" {
+		return password, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if nonInteractive {
+		return "", fmt.Errorf("no password given and --non-interactive forbids prompting; use --password-stdin or %s", stor.EnvPassword)
+	}
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("stdin is not a terminal; use --password-stdin")
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	data, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
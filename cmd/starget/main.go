@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/flaneur2020/stargz-get/stargzget"
 	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
 	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
 	"github.com/opencontainers/go-digest"
 	"github.com/schollz/progressbar/v3"
@@ -16,19 +20,92 @@ import (
 )
 
 var (
-	credential  string
+	infoProbe   bool
+	credentials []string
+	authFile    string
 	noProgress  bool
 	concurrency int
 	verbose     bool
 	debug       bool
 	insecure    bool
+	cacheDir    string
+
+	connectTimeout     time.Duration
+	fallbackDelay      time.Duration
+	forceIPv4          bool
+	platformDigest     string
+	platform           string
+	manifestFile       string
+	keepBlobs          string
+	blobDir            string
+	maxRequestsPerHost int
+	tocMemory          string
+	presetName         string
+	tokenScopes        []string
+	commandTimeout     time.Duration
+	nonInteractive     bool
+	operationHeader    bool
+	strictTOC          bool
+	tarFallback        bool
+	buildCache         bool
+
+	noChunkedSingleFile bool
+	auditFetches        bool
+	onConflict          string
+	renameSuffix        string
+	portable            bool
+	strict              bool
+	followSymlinks      bool
+	recreateSymlinks    bool
+	stripComponents     int
+	pathPrefix          string
+	blockSecrets        bool
+	statsOut            string
+	verifyDiffID        bool
+	getOutput           string
+	priorityFile        string
+	requireAllLayers    bool
+	indexFile           string
+	indexDB             string
+	chunkCacheDir       string
+	stallTimeout        time.Duration
+	abortOnStall        bool
+	maxChunkSize        string
+	provenanceLog       string
+	archiveFormat       string
+	pushRef             string
+	reproducible        bool
+	transactional       bool
+
+	uidMaps       []string
+	gidMaps       []string
+	ownershipFile string
 )
 
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "starget",
 		Short: "A CLI tool for working with stargz container images",
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyEnvDefaults(cmd); err != nil {
+				return err
+			}
+			if err := loadPreset(cmd); err != nil {
+				return err
+			}
+			stor.SetMaxRequestsPerHost(maxRequestsPerHost)
+			budget, err := parseSizeFlag("--toc-memory", tocMemory)
+			if err != nil {
+				return err
+			}
+			stargzget.SetTOCMemoryBudget(budget)
+			stor.SetOperationHeader(operationHeader)
+			startCommandTimeout()
+			tagCommand(cmd)
+			if nonInteractive {
+				noProgress = true
+			}
+
 			// Set log level based on flags
 			if debug {
 				logger.SetLogLevel(logger.LogLevelDebug)
@@ -37,13 +114,34 @@ func main() {
 			} else {
 				logger.SetLogLevel(logger.LogLevelError)
 			}
+			return nil
 		},
 	}
 
-	rootCmd.PersistentFlags().StringVar(&credential, "credential", "", "Registry credential in format USER:PASSWORD")
+	rootCmd.PersistentFlags().StringArrayVar(&credentials, "credential", nil, "Registry credential as USER:PASSWORD for every registry, or REGISTRY=USER:PASSWORD for one registry; repeatable")
+	rootCmd.PersistentFlags().StringVar(&authFile, "auth-file", "", "Read per-registry credentials from this Docker-style config.json (auths, credsStore, credHelpers), consulted after --credential")
 	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "Enable verbose logging (INFO level)")
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging (DEBUG level)")
 	rootCmd.PersistentFlags().BoolVarP(&insecure, "insecure", "k", false, "Skip TLS certificate verification (insecure)")
+	rootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", "", "Cache parsed TOCs and manifests (revalidated by ETag) in this directory across runs")
+	rootCmd.PersistentFlags().DurationVar(&connectTimeout, "connect-timeout", stor.DefaultConnectTimeout, "Timeout for DNS lookup plus TCP connect to a registry")
+	rootCmd.PersistentFlags().DurationVar(&fallbackDelay, "fallback-delay", 0, "Wait this long on IPv6 before racing IPv4 (0 uses the Go default of 300ms, negative disables the fallback)")
+	rootCmd.PersistentFlags().StringVar(&platform, "platform", "", "When the image is an index, use the manifest for this platform, as OS/ARCH[/VARIANT] (default: the host's)")
+	rootCmd.PersistentFlags().StringVar(&platformDigest, "platform-digest", "", "When the image is an index, use the child manifest with this digest instead of the one for --platform")
+	rootCmd.PersistentFlags().StringVar(&manifestFile, "manifest-file", "", "Read the image manifest from this JSON file instead of the registry; blobs are still fetched from the registry unless --blob-dir is set")
+	rootCmd.PersistentFlags().StringVar(&blobDir, "blob-dir", "", "Read blobs from the files in this directory instead of the registry, such as layers downloaded earlier; the manifest comes from --manifest-file or is made up of the directory's layers in file name order")
+	rootCmd.PersistentFlags().StringVar(&keepBlobs, "keep-blobs", "", "Also spool every blob byte fetched into an OCI image layout in this directory, for later offline use")
+	rootCmd.PersistentFlags().BoolVarP(&forceIPv4, "ipv4", "4", false, "Connect to registries over IPv4 only")
+	rootCmd.PersistentFlags().IntVar(&maxRequestsPerHost, "max-requests-per-host", stor.DefaultMaxRequestsPerHost, "Maximum concurrent requests to one registry host (0 for no limit)")
+	rootCmd.PersistentFlags().StringVar(&tocMemory, "toc-memory", "256M", "Bound on the memory of TOCs being parsed at once, across all layers and images, e.g. 64M (0 for no limit)")
+	rootCmd.PersistentFlags().BoolVar(&strictTOC, "strict-toc", false, "Fail when a layer's TOC has entries of unknown types instead of ignoring them with a warning")
+	rootCmd.PersistentFlags().BoolVar(&tarFallback, "tar-fallback", false, "Read layers that are plain tar.gz or tar, without an eStargz TOC, by downloading them in full")
+	rootCmd.PersistentFlags().BoolVar(&buildCache, "build-cache", false, "Allow BuildKit cache exports, whose layers are build steps rather than an image, and read files from their eStargz layers")
+	rootCmd.PersistentFlags().BoolVar(&operationHeader, "operation-header", false, "Send an X-Starget-Operation header naming the command, image and file on every registry request, for matching registry logs to runs")
+	rootCmd.PersistentFlags().StringVar(&presetName, "preset", "", presetUsage())
+	rootCmd.PersistentFlags().DurationVar(&commandTimeout, "timeout", 0, "Fail the whole command if it has not finished after this long (0 for no limit)")
+	rootCmd.PersistentFlags().BoolVar(&nonInteractive, "non-interactive", false, "Never prompt or render progress, for cron jobs and CI; implies --no-progress")
+	rootCmd.PersistentFlags().StringArrayVar(&tokenScopes, "token-scope", nil, "Request tokens from a registry with extra actions, as REGISTRY=ACTION[,ACTION] (e.g. artifactory.example.com=push); repeatable")
 
 	// info command
 	infoCmd := &cobra.Command{
@@ -52,6 +150,7 @@ func main() {
 		Args:  cobra.ExactArgs(1),
 		Run:   runInfo,
 	}
+	infoCmd.Flags().BoolVar(&infoProbe, "probe", false, "Also fetch each layer's footer, in parallel, to check that it is eStargz and lazy access will work")
 
 	// ls command
 	lsCmd := &cobra.Command{
@@ -63,74 +162,283 @@ func main() {
 
 	// get command
 	getCmd := &cobra.Command{
-		Use:   "get <REGISTRY>/<IMAGE>:<TAG> [BLOB] <PATH> [OUTPUT_DIR]",
-		Short: "Download file or directory. BLOB is optional (uses top layer if not specified). Use '.' or '/' for all files",
-		Args:  cobra.RangeArgs(2, 4),
+		Use:   "get <REGISTRY>/<IMAGE>:<TAG> [BLOB] <PATH> [OUTPUT_DIR] | get <REGISTRY>/<IMAGE>:<TAG> [BLOB] <PATH>... -o <OUTPUT_DIR>",
+		Short: "Download files or directories. BLOB is optional (uses top layer if not specified). Use '.' or '/' for all files",
+		Args:  cobra.MinimumNArgs(1),
 		Run:   runGet,
 	}
+	addFilterFlags(lsCmd)
+	lsCmd.Flags().BoolVar(&requireAllLayers, "require-all-layers", false, "Fail if any layer cannot be read (e.g. access denied) instead of listing the files of the others")
+	lsCmd.Flags().StringVar(&indexFile, "index", "", "Use the index saved in this file by 'starget index save' instead of fetching the TOCs; fails if the image's manifest has changed")
+	lsCmd.Flags().StringVar(&indexDB, "index-db", "", "Use the image's index from this database, filled by 'starget index add', instead of fetching the TOCs; fails if the image's manifest has changed")
+	addFilterFlags(getCmd)
+	getCmd.Flags().StringVarP(&getOutput, "output", "o", "", "Output directory; with -o, every argument after the image (and BLOB) is a PATH")
+	getCmd.Flags().StringVar(&indexFile, "index", "", "Use the index saved in this file by 'starget index save' instead of fetching the TOCs; fails if the image's manifest has changed")
+	getCmd.Flags().StringVar(&chunkCacheDir, "chunk-cache", "", "Keep decompressed chunks in this directory by their TOC chunkDigest and reuse them, verified, for any image")
+	getCmd.Flags().StringVar(&indexDB, "index-db", "", "Use the image's index from this database, filled by 'starget index add', instead of fetching the TOCs; fails if the image's manifest has changed")
+	getCmd.Flags().StringVar(&priorityFile, "priority-file", "", "Download exactly the paths listed in this file (as written by 'starget priorities') instead of PATH arguments")
 	getCmd.Flags().BoolVar(&noProgress, "no-progress", false, "Disable progress bar (progress is enabled by default)")
 	getCmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of concurrent workers (default: 4, set to 1 for sequential)")
+	getCmd.Flags().DurationVar(&stallTimeout, "stall-timeout", 0, "Warn, with pipeline state at --debug, when the download makes no progress for this long (0 disables)")
+	getCmd.Flags().BoolVar(&abortOnStall, "abort-on-stall", false, "Fail instead of waiting when --stall-timeout detects a stall")
+	getCmd.Flags().StringVar(&maxChunkSize, "max-chunk-size", "1G", "Refuse files whose TOC claims a chunk decompresses to more than this (K, M and G suffixes accepted)")
+	getCmd.Flags().BoolVar(&reproducible, "reproducible", false, "Make archive output byte-identical across runs: entries in name order, timestamps in UTC and clamped to SOURCE_DATE_EPOCH if set")
+	getCmd.Flags().BoolVar(&transactional, "transactional", false, "Stage the files next to the output directory and move them into place, followed by a "+stargzget.TransactionMarker+" marker, only once every file succeeded")
+	getCmd.Flags().StringVar(&archiveFormat, "archive-format", "", "Write the files into a tar or zip archive at the output path instead of a directory (default: from a .tar or .zip output extension)")
+	getCmd.Flags().StringVar(&pushRef, "push", "", "Publish the tar archive output as a one-layer image with this reference, keeping the source image's config")
+	getCmd.Flags().StringVar(&provenanceLog, "provenance-log", "", "Append a JSON line per downloaded file to this file: image, layer, TOC entry digest, byte ranges and digest verification")
+	getCmd.Flags().BoolVar(&noChunkedSingleFile, "no-chunked-single-file", false, "Fetch each file's chunks sequentially instead of with parallel range requests (for registries that mishandle them)")
+	getCmd.Flags().BoolVar(&auditFetches, "audit-fetches", false, "Record the byte ranges requested from each layer and report those beyond what the files needed, such as open-ended ranges read to the end of the blob")
+	getCmd.Flags().StringVar(&onConflict, "on-conflict", "error", "What to do with paths the target filesystem cannot hold (case collisions, reserved names, over-long paths): error, rename or skip")
+	getCmd.Flags().StringVar(&renameSuffix, "rename-suffix", stargzget.DefaultRenameSuffix, "Suffix --on-conflict=rename inserts before the extension of a colliding name, with %d numbering it")
+	getCmd.Flags().BoolVar(&strict, "strict", false, "Fail instead of skipping when a path is a special file or a symlink that is dangling, loops, or points outside the image")
+	getCmd.Flags().BoolVar(&followSymlinks, "follow-symlinks", false, "Resolve symlinks anywhere in each PATH, including links to directories, and download what they lead to under the PATH as given")
+	getCmd.Flags().BoolVar(&recreateSymlinks, "recreate-symlinks", false, "With --follow-symlinks, write files under the paths the links lead to and recreate the links followed")
+	getCmd.Flags().IntVar(&stripComponents, "strip-components", 0, "Remove this many leading directories from each path, as tar does; files with no more are skipped")
+	getCmd.Flags().StringVar(&pathPrefix, "prefix", "", "Place every file under this directory inside the output, after --strip-components")
+	getCmd.Flags().BoolVar(&blockSecrets, "block-secrets", false, "Do not write files that look like secrets: SSH and other private keys, .env and credential files, and files starting with a private key or access token")
+	getCmd.Flags().StringVar(&statsOut, "stats-out", "", "Write a summary of the run to this file when it ends: requests by status, bytes by blob, cache hits, retry reasons and wall/CPU time, as JSON (Prometheus text for a .prom file)")
+	getCmd.Flags().BoolVar(&portable, "portable", false, "Apply macOS and Windows path checks regardless of the host OS")
+	getCmd.Flags().BoolVar(&verifyDiffID, "verify-diffid", false, "After downloading a whole layer (BLOB with PATH '.'), check its uncompressed digest against the image config's diff_ids")
+	getCmd.Flags().StringArrayVar(&uidMaps, "uid-map", nil, "Remap file owners, CONTAINER:HOST:SIZE (repeatable)")
+	getCmd.Flags().StringArrayVar(&gidMaps, "gid-map", nil, "Remap file groups, CONTAINER:HOST:SIZE (repeatable)")
+	getCmd.Flags().StringVar(&ownershipFile, "ownership-file", "", "When not running as root, record mapped ownership as JSON lines in this file (default: <OUTPUT_DIR>/.starget-ownership.jsonl)")
 
-	rootCmd.AddCommand(infoCmd, lsCmd, getCmd)
+	rootCmd.AddCommand(infoCmd, lsCmd, getCmd, newFileCmd(), newSizeofCmd(), newLayersForCmd(), newAuditCmd(), newPrioritiesCmd(), newIndexCmd(), newApplyCmd(), newPopulateCmd(), newChaosTestCmd(), newCpCmd(), newBlobCmd(), newPingCmd(), newLoginCmd(), newLogoutCmd(), newSyncCmd(), newShellCmd())
 
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	cancelCommand()
+	if err != nil {
 		os.Exit(1)
 	}
 }
 
-func parseImageRef(imageRef string) (string, string, error) {
-	parts := strings.SplitN(imageRef, "/", 2)
-	if len(parts) < 2 {
-		return "", "", fmt.Errorf("invalid image ref: %s", imageRef)
+func parseCredential(cred string) (string, string, error) {
+	parts := strings.SplitN(cred, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid credential format, expected USER:PASSWORD")
 	}
+	return parts[0], parts[1], nil
+}
 
-	registry := parts[0]
-	rest := parts[1]
+// parseCredentialSpec parses a --credential value, returning the registry
+// for REGISTRY=USER:PASSWORD and "" for a plain USER:PASSWORD. The text
+// before the first '=' names a registry unless it holds a ':' followed by
+// something other than a port, which makes it a username and the start of a
+// password containing '='.
+func parseCredentialSpec(spec string) (registry string, cred stor.Credential, err error) {
+	if host, rest, ok := strings.Cut(spec, "="); ok && isRegistryHost(host) {
+		registry, spec = host, rest
+	}
+	username, password, err := parseCredential(spec)
+	if err != nil {
+		return "", stor.Credential{}, err
+	}
+	return registry, stor.Credential{Username: username, Password: password}, nil
+}
 
-	repoParts := strings.Split(rest, ":")
-	if len(repoParts) < 2 {
-		return "", "", fmt.Errorf("missing tag in image ref: %s", imageRef)
+func isRegistryHost(s string) bool {
+	if s == "" {
+		return false
 	}
+	_, port, hasPort := strings.Cut(s, ":")
+	if !hasPort {
+		return true
+	}
+	if port == "" {
+		return false
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
 
-	repository := strings.Join(repoParts[:len(repoParts)-1], ":")
+// explicitCredentials combines the --credential values and --auth-file:
+// per-registry credentials first, then the auth file, then a credential
+// given without a registry, which applies to every other registry.
+func explicitCredentials() (stor.CredentialProvider, error) {
+	if len(credentials) == 0 && authFile == "" {
+		return nil, nil
+	}
+	byRegistry := make(map[string]stor.Credential)
+	var fallback stor.CredentialProvider
+	for _, spec := range credentials {
+		registry, cred, err := parseCredentialSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if registry != "" {
+			byRegistry[registry] = cred
+			continue
+		}
+		if fallback != nil {
+			return nil, fmt.Errorf("only one --credential may omit the registry; give the others as REGISTRY=USER:PASSWORD")
+		}
+		fallback = stor.StaticCredentials(cred.Username, cred.Password)
+	}
 
-	return registry, repository, nil
+	chain := stor.CredentialChain{stor.RegistryCredentials(byRegistry)}
+	if authFile != "" {
+		if _, err := os.Stat(authFile); err != nil {
+			return nil, fmt.Errorf("--auth-file: %w", err)
+		}
+		chain = append(chain, stor.NewDockerConfigCredentials(authFile))
+	}
+	return append(chain, fallback), nil
 }
 
-func parseCredential(cred string) (string, string, error) {
-	parts := strings.SplitN(cred, ":", 2)
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("invalid credential format, expected USER:PASSWORD")
+// newRegistryClient builds a registry client whose credentials are resolved
+// per registry in order: --credential and --auth-file,
+// STARGET_USERNAME/STARGET_PASSWORD, the starget config file (see `starget
+// login`), then the Docker config.
+func newRegistryClient() *stor.RemoteRegistryStorage {
+	explicit, err := explicitCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing credential: %v\n", err)
+		os.Exit(1)
 	}
-	return parts[0], parts[1], nil
-}
 
-func runInfo(cmd *cobra.Command, args []string) {
-	imageRef := args[0]
+	client := stor.NewRemoteRegistryStorage(insecure).WithDialOptions(dialOptions()).WithManifestCacheDir(cacheDir)
+	for _, spec := range tokenScopes {
+		registry, actions, ok := strings.Cut(spec, "=")
+		if !ok || registry == "" || actions == "" {
+			fmt.Fprintf(os.Stderr, "Error: invalid --token-scope %q, want REGISTRY=ACTION[,ACTION]\n", spec)
+			os.Exit(1)
+		}
+		client = client.WithTokenScope(registry, strings.Split(actions, ",")...)
+	}
+	return client.WithCredentialProvider(stor.DefaultCredentialChain(explicit))
+}
 
-	client := stor.NewRemoteRegistryStorage(insecure)
+// getManifest fetches the manifest of imageRef, honoring --platform,
+// --platform-digest and --manifest-file.
+func getManifest(ctx context.Context, client *stor.RemoteRegistryStorage, imageRef string) (*stor.Manifest, error) {
+	if manifestFile != "" {
+		if platformDigest != "" || platform != "" {
+			return nil, fmt.Errorf("--platform and --platform-digest cannot be combined with --manifest-file; supply the platform's manifest instead")
+		}
+		data, err := os.ReadFile(manifestFile)
+		if err != nil {
+			return nil, err
+		}
+		client, err = client.WithManifestBytes(imageRef, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", manifestFile, err)
+		}
+	}
 
-	// Apply credentials if provided
-	if credential != "" {
-		username, password, err := parseCredential(credential)
+	opts := &stor.ManifestOptions{Platform: stor.HostPlatform()}
+	if platform != "" {
+		p, err := stor.ParsePlatform(platform)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing credential: %v\n", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("invalid --platform: %v", err)
+		}
+		opts.Platform = p
+	}
+	if platformDigest != "" {
+		dgst, err := digest.Parse(platformDigest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --platform-digest: %v", err)
 		}
-		client = client.WithCredential(username, password)
+		opts.ChildDigest = dgst
 	}
+	return client.GetManifestWithOptions(ctx, imageRef, opts)
+}
 
-	manifest, err := client.GetManifest(context.Background(), imageRef)
+// newImageStorage returns the blob storage for an image, mirroring every
+// fetched byte into an OCI layout when --keep-blobs is set.
+func newImageStorage(ctx context.Context, client *stor.RemoteRegistryStorage, imageRef, registry, repository string, manifest *stor.Manifest) stor.Storage {
+	storage := client.NewStorage(registry, repository, manifest)
+	if keepBlobs == "" {
+		return storage
+	}
+	ref, err := refs.Parse(imageRef)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	mirror, err := stor.NewMirrorStorage(ctx, storage, keepBlobs, manifest, ref.Tag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error preparing --keep-blobs directory: %v\n", err)
+		os.Exit(1)
+	}
+	return mirror
+}
 
+func runInfo(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+
+	if infoProbe {
+		runInfoProbe(imageRef)
+		return
+	}
+	manifest, err := loadManifest(commandContext(), imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(manifest.Index) > 0 {
+		printIndexEntries(manifest)
+	}
+	if manifest.Selected != nil {
+		fmt.Printf("Index entry: %s (%s)\n", manifest.Selected.Digest, manifest.Selected.Platform)
+	}
+	if manifest.ArtifactType != "" {
+		fmt.Printf("Artifact type: %s\n", manifest.ArtifactType)
+	}
+	if manifest.IsBuildCache() {
+		fmt.Println("BuildKit cache export: layers are build steps, not one image (read them with --build-cache)")
+	}
 	fmt.Printf("Layers for %s:\n", imageRef)
 	for i, layer := range manifest.Layers {
 		fmt.Printf("%d: %s (size: %d bytes, type: %s)\n",
 			i, layer.Digest, layer.Size, layer.MediaType)
 	}
+	for i, blob := range manifest.Blobs {
+		fmt.Printf("blob %d: %s (size: %d bytes, type: %s)\n",
+			i, blob.Digest, blob.Size, blob.MediaType)
+	}
+}
+
+// pathRewriter builds the rewriter for --strip-components and --prefix, or
+// nil when neither is given.
+func pathRewriter() (stargzget.PathRewriter, error) {
+	var rewriters []stargzget.PathRewriter
+	if stripComponents < 0 {
+		return nil, fmt.Errorf("--strip-components must not be negative")
+	}
+	if stripComponents > 0 {
+		rewriters = append(rewriters, stargzget.StripComponents(stripComponents))
+	}
+	if pathPrefix != "" {
+		if prefix := filepath.Clean(pathPrefix); !filepath.IsLocal(prefix) {
+			return nil, fmt.Errorf("--prefix %s must be a relative path inside the output", pathPrefix)
+		}
+		rewriters = append(rewriters, stargzget.PrefixPath(filepath.ToSlash(pathPrefix)))
+	}
+	return stargzget.ChainPathRewriters(rewriters...), nil
+}
+
+// printIndexEntries lists every manifest of the index the image was
+// selected from, marking the selected one, so it shows which platforms are
+// published.
+func printIndexEntries(manifest *stor.Manifest) {
+	fmt.Printf("Index manifests (%d):\n", len(manifest.Index))
+	for i, entry := range manifest.Index {
+		kind := entry.Platform.String()
+		if entry.IsAttestation() {
+			kind = "attestation"
+		}
+		mark := ""
+		if manifest.Selected != nil && entry.Digest == manifest.Selected.Digest {
+			mark = " [selected]"
+		}
+		fmt.Printf("%d: %s (%s, size: %d bytes, type: %s)%s\n", i, entry.Digest, kind, entry.Size, entry.MediaType, mark)
+	}
 }
 
 func runLs(cmd *cobra.Command, args []string) {
@@ -140,38 +448,41 @@ func runLs(cmd *cobra.Command, args []string) {
 		blobDigest = args[1]
 	}
 
-	registry, repository, err := parseImageRef(imageRef)
+	filter, err := fileFilter(time.Now())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Get manifest first
-	registryClient := stor.NewRemoteRegistryStorage(insecure)
-
-	// Apply credentials if provided
-	if credential != "" {
-		username, password, err := parseCredential(credential)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing credential: %v\n", err)
+	manifest, storage, err := openImage(commandContext(), imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if indexDB != "" {
+		var dgst digest.Digest
+		if blobDigest != "" {
+			if dgst, err = digest.Parse(blobDigest); err != nil {
+				fmt.Fprintf(os.Stderr, "Error parsing digest: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err := lsIndexDB(commandContext(), imageRef, manifest, dgst, filter); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		registryClient = registryClient.WithCredential(username, password)
+		return
 	}
-
-	manifest, err := registryClient.GetManifest(context.Background(), imageRef)
+	index, _, warnings, err := openIndex(commandContext(), imageRef, manifest, storage)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting manifest: %v\n", err)
+		printIndexError(err)
 		os.Exit(1)
 	}
-
-	storage := registryClient.NewStorage(registry, repository, manifest)
-	resolver := stargzget.NewBlobResolver(storage)
-	loader := stargzget.NewBlobIndexLoader(storage, resolver)
-
-	index, err := loader.Load(context.Background())
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting image index: %v\n", err)
+	printTOCWarnings(warnings)
+	skipped := skippedLayers(warnings)
+	if requireAllLayers && len(skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d layer(s) could not be read:\n", len(skipped))
+		printSkippedLayers(skipped)
 		os.Exit(1)
 	}
 
@@ -182,6 +493,13 @@ func runLs(cmd *cobra.Command, args []string) {
 			fmt.Fprintf(os.Stderr, "Error parsing digest: %v\n", err)
 			os.Exit(1)
 		}
+		for _, w := range skipped {
+			if w.BlobDigest == dgst {
+				fmt.Fprintf(os.Stderr, "Error: blob %s could not be read:\n", blobDigest)
+				printSkippedLayers([]stargzget.Warning{w})
+				os.Exit(1)
+			}
+		}
 
 		// Find the layer with the specified blob digest
 		var files []string
@@ -199,74 +517,211 @@ func runLs(cmd *cobra.Command, args []string) {
 
 		fmt.Printf("Files in blob %s:\n", blobDigest)
 		for _, file := range files {
-			fmt.Println(file)
+			if matchesFilter(index, filter, file, dgst) {
+				fmt.Println(file)
+			}
 		}
 	} else {
 		// No blob digest provided - list all files from all layers (later layers override earlier ones)
 		fmt.Printf("All files in %s:\n", imageRef)
 		for _, path := range index.AllFiles() {
-			fmt.Println(path)
+			if matchesFilter(index, filter, path, "") {
+				fmt.Println(path)
+			}
+		}
+		if len(skipped) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d layer(s) could not be read and their files are not listed:\n", len(skipped))
+			printSkippedLayers(skipped)
 		}
 	}
 }
 
-func runGet(cmd *cobra.Command, args []string) {
-	imageRef := args[0]
-
-	// Parse arguments based on count and whether second arg looks like a digest
-	var blobDigest string
-	var pathPattern string
-	var outputDir string = "."
+// skippedLayers returns the warnings for layers left out of the index.
+func skippedLayers(warnings []stargzget.Warning) []stargzget.Warning {
+	var skipped []stargzget.Warning
+	for _, w := range warnings {
+		if w.Kind == stargzget.WarningLayerSkipped || w.Kind == stargzget.WarningLayerUnauthorized {
+			skipped = append(skipped, w)
+		}
+	}
+	return skipped
+}
 
-	// Determine if second argument is a blob digest (starts with sha256: or sha512:)
-	hasBlob := len(args) >= 3 && strings.HasPrefix(args[1], "sha")
+// printSkippedLayers writes one line per skipped layer to stderr, calling
+// out those the registry denied access to, which usually means the blob
+// lives in a repository the credentials do not cover.
+func printSkippedLayers(skipped []stargzget.Warning) {
+	for _, w := range skipped {
+		reason := "unreadable"
+		if w.Kind == stargzget.WarningLayerUnauthorized {
+			reason = "access denied"
+		}
+		fmt.Fprintf(os.Stderr, "  %s (%s): %v\n", w.BlobDigest, reason, w.Err)
+	}
+	for _, w := range skipped {
+		if stargzget.CanTarFallback(w.Err) {
+			fmt.Fprintln(os.Stderr, "Pass --tar-fallback to read plain tar.gz and tar layers by downloading them in full.")
+			break
+		}
+	}
+}
 
-	if hasBlob {
-		// args: imageRef, blob, path, [outputDir]
-		blobDigest = args[1]
-		pathPattern = args[2]
-		if len(args) > 3 {
-			outputDir = args[3]
+// printTOCWarnings warns about TOC entries left out of the index because
+// their type is unknown, which --strict-toc turns into an error instead, and
+// about TOCs that do not fit the layer's uncompressed size.
+func printTOCWarnings(warnings []stargzget.Warning) {
+	for _, w := range warnings {
+		if w.Kind == stargzget.WarningUnknownTOCEntries || w.Kind == stargzget.WarningTOCSizeMismatch {
+			fmt.Fprintf(os.Stderr, "Warning: blob %s: %v\n", w.BlobDigest, w.Err)
 		}
-	} else {
-		// args: imageRef, path, [outputDir]
-		pathPattern = args[1]
-		if len(args) > 2 {
-			outputDir = args[2]
+	}
+}
+
+// printIndexError reports a failure to load the image index. For an image
+// without eStargz layers it lists what each layer turned out to be and how
+// to get an image starget can read.
+func printIndexError(err error) {
+	probes := stargzget.LayerProbes(err)
+	if probes == nil {
+		fmt.Fprintf(os.Stderr, "Error getting image index: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Error: none of the image's %d layer(s) is in eStargz format:\n", len(probes))
+	for _, p := range probes {
+		fmt.Fprintf(os.Stderr, "  %s: %s (%s)\n", p.BlobDigest, p.Format, p.MediaType)
+	}
+	fmt.Fprintln(os.Stderr, "starget reads files lazily through the table of contents that eStargz layers carry; other formats have none. Convert the image first, e.g.:")
+	fmt.Fprintln(os.Stderr, "  nerdctl image convert --estargz --oci IMAGE IMAGE-esgz")
+	fmt.Fprintln(os.Stderr, "  ctr-remote image optimize --oci IMAGE IMAGE-esgz")
+	for _, p := range probes {
+		if p.Format == stargzget.LayerFormatGzip || p.Format == stargzget.LayerFormatTar {
+			fmt.Fprintln(os.Stderr, "Or pass --tar-fallback to read plain tar.gz and tar layers by downloading them in full.")
+			break
 		}
 	}
+}
+
+// matchesFilter reports whether the entry for path passes the metadata
+// filter.
+func matchesFilter(index *stargzget.ImageIndex, filter stargzget.FileFilter, path string, dgst digest.Digest) bool {
+	if filter.IsZero() {
+		return true
+	}
+	info, err := index.FindFile(path, dgst)
+	return err == nil && filter.Match(info)
+}
 
-	ctx := context.Background()
+func runGet(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
 
-	registry, repository, err := parseImageRef(imageRef)
+	blobDigest, pathPatterns, outputDir, err := parseGetArgs(args[1:], getOutput, cmd.Flags().Changed("output"), priorityFile != "")
+	if err == nil && priorityFile != "" {
+		pathPatterns, err = readPriorityFile(priorityFile)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	// pathPattern names all patterns in messages.
+	pathPattern := strings.Join(pathPatterns, " ")
 
-	// Get manifest first
-	registryClient := stor.NewRemoteRegistryStorage(insecure)
+	// An output with placeholders names each file's path instead of a
+	// directory; its fixed prefix stands in for the directory elsewhere.
+	var outputTemplate *stargzget.OutputTemplate
+	if cpLayout == nil && stargzget.IsOutputTemplate(outputDir) {
+		outputTemplate, err = stargzget.ParseOutputTemplate(outputDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		outputDir = outputTemplate.Root()
+	}
 
-	// Apply credentials if provided
-	if credential != "" {
-		username, password, err := parseCredential(credential)
+	// An output ending in .tar or .zip, or --archive-format, names an
+	// archive that receives the files instead of a directory.
+	format, archiving := stargzget.ArchiveFormatForPath(outputDir)
+	if cpLayout != nil {
+		// cp copies a .tar file as a file.
+		archiving = false
+	}
+	if archiveFormat != "" {
+		format, err = stargzget.ParseArchiveFormat(archiveFormat)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing credential: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
-		registryClient = registryClient.WithCredential(username, password)
+		archiving = true
+	}
+	if reproducible && !archiving {
+		fmt.Fprintf(os.Stderr, "Error: --reproducible only applies to archive output\n")
+		os.Exit(1)
+	}
+	if pushRef != "" && (!archiving || format != stargzget.ArchiveTar) {
+		fmt.Fprintf(os.Stderr, "Error: --push needs tar archive output, e.g. an output path ending in .tar\n")
+		os.Exit(1)
+	}
+	if transactional && archiving {
+		fmt.Fprintf(os.Stderr, "Error: --transactional does not apply to archive output\n")
+		os.Exit(1)
+	}
+	if archiving && outputTemplate != nil {
+		fmt.Fprintf(os.Stderr, "Error: archive output cannot be combined with an output template\n")
+		os.Exit(1)
+	}
+	if recreateSymlinks && (!followSymlinks || archiving || outputTemplate != nil) {
+		fmt.Fprintf(os.Stderr, "Error: --recreate-symlinks requires --follow-symlinks and a directory output\n")
+		os.Exit(1)
+	}
+	rewriter, err := pathRewriter()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if rewriter != nil && recreateSymlinks {
+		fmt.Fprintf(os.Stderr, "Error: --recreate-symlinks cannot be combined with --strip-components or --prefix\n")
+		os.Exit(1)
+	}
+	if archiving && (len(uidMaps) > 0 || len(gidMaps) > 0 || cmd.Flags().Changed("ownership-file")) {
+		fmt.Fprintf(os.Stderr, "Error: --uid-map, --gid-map and --ownership-file do not apply to archive output, whose entries record the TOC ownership\n")
+		os.Exit(1)
+	}
+
+	chunkLimit, err := parseSizeFlag("--max-chunk-size", maxChunkSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	tuning := tuningOptions(cmd)
+	if tuning.AbortOnStall && tuning.StallTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --abort-on-stall requires --stall-timeout\n")
+		os.Exit(1)
+	}
+
+	// Diff IDs describe whole layers, so they can only be checked when the
+	// whole layer is extracted.
+	if verifyDiffID && (blobDigest == "" || len(pathPatterns) != 1 || !isWholeLayerPattern(pathPatterns[0])) {
+		fmt.Fprintf(os.Stderr, "Error: --verify-diffid requires a BLOB and a PATH of '.' (full-layer mode)\n")
+		os.Exit(1)
 	}
 
-	manifest, err := registryClient.GetManifest(ctx, imageRef)
+	filter, err := fileFilter(time.Now())
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting manifest: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	storage := registryClient.NewStorage(registry, repository, manifest)
-	resolver := stargzget.NewBlobResolver(storage)
-	loader := stargzget.NewBlobIndexLoader(storage, resolver)
-	downloader := stargzget.NewDownloader(resolver, storage)
+	ctx := commandContext()
+
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if pushRef != "" && manifest.Config.Digest == "" {
+		fmt.Fprintf(os.Stderr, "Error: --push needs a source image with a config to base the pushed image on\n")
+		os.Exit(1)
+	}
 
 	// Parse blob digest if provided
 	var dgst digest.Digest
@@ -281,44 +736,183 @@ func runGet(cmd *cobra.Command, args []string) {
 	// If blobDigest is empty, dgst will be zero value and FilterFiles will use all layers
 
 	// Get image index
-	index, err := loader.Load(ctx)
+	index, resolver, warnings, err := openIndex(ctx, imageRef, manifest, storage)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting image index: %v\n", err)
+		printIndexError(err)
 		os.Exit(1)
 	}
+	printTOCWarnings(warnings)
+	downloader := stargzget.NewDownloader(resolver, storage)
 
-	// Normalize path pattern
-	if pathPattern == "*" {
-		pathPattern = "."
+	// Filter files based on each pattern and blob digest (empty digest means
+	// search all layers). Files matched by several patterns are kept once.
+	var matchedFiles []*stargzget.FileInfo
+	var followedLinks []*stargzget.FileInfo
+	seen := make(map[string]bool)
+	requestedPaths := make(map[string]string) // files reached through a symlink -> path under the PATH as given
+	for _, pattern := range pathPatterns {
+		// Normalize path pattern
+		if pattern == "*" {
+			pattern = "."
+		}
+		matchPattern, resolved, requested := pattern, "", ""
+		if followSymlinks && !isWholeLayerPattern(pattern) {
+			var links []*stargzget.FileInfo
+			resolved, links, err = index.FollowPath(pattern, dgst)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			if len(links) > 0 {
+				matchPattern = resolved
+				if strings.HasSuffix(pattern, "/") {
+					matchPattern += "/"
+				}
+				requested = path.Clean(strings.TrimPrefix(pattern, "/"))
+				followedLinks = append(followedLinks, links...)
+			}
+		}
+		matched := index.FilterFiles(matchPattern, dgst)
+		if len(matched) == 0 {
+			fmt.Fprintf(os.Stderr, "No files matched pattern: %s\n", pattern)
+			os.Exit(1)
+		}
+		for _, fileInfo := range matched {
+			key := fileInfo.BlobDigest.String() + ":" + fileInfo.Path
+			if !seen[key] {
+				seen[key] = true
+				matchedFiles = append(matchedFiles, fileInfo)
+			}
+			if requested != "" && !recreateSymlinks {
+				requestedPaths[key] = requested + strings.TrimPrefix(fileInfo.Path, resolved)
+			}
+		}
 	}
-
-	// Filter files based on pattern and blob digest (empty digest means search all layers)
-	matchedFiles := index.FilterFiles(pathPattern, dgst)
+	if cpLayout != nil {
+		if err := cpLayout.check(matchedFiles); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	matchedFiles = filter.Filter(matchedFiles)
 	if len(matchedFiles) == 0 {
-		fmt.Fprintf(os.Stderr, "No files matched pattern: %s\n", pathPattern)
+		fmt.Fprintf(os.Stderr, "No files matched the metadata filters for pattern: %s\n", pathPattern)
 		os.Exit(1)
 	}
 
 	// Create download jobs
 	var jobs []*stargzget.DownloadJob
+	extracted := make(map[string]string) // blob and image path of regular files -> output path
+	hardlinks := make(map[*stargzget.DownloadJob]string)
 	for _, fileInfo := range matchedFiles {
-		// Determine output path
+		// Symlinks are downloaded as their target's content; special files
+		// and unresolvable links are skipped, or fatal with --strict.
+		source, err := index.ResolveFile(fileInfo, dgst)
+		if err != nil {
+			if strict {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", fileInfo.Path, err)
+			continue
+		}
+
+		// Determine output path. Files found by following a symlink keep
+		// the path that was asked for.
+		imagePath := fileInfo.Path
+		if requested, ok := requestedPaths[fileInfo.BlobDigest.String()+":"+fileInfo.Path]; ok {
+			imagePath = requested
+		}
+		if rewriter != nil {
+			rewritten, skip, err := rewriter.Rewrite(imagePath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			if skip {
+				logger.Info("Skipping %s: no path left after --strip-components", imagePath)
+				continue
+			}
+			imagePath = rewritten
+		}
 		var outputPath string
-		if len(matchedFiles) == 1 && !strings.HasSuffix(pathPattern, "/") && pathPattern != "." && pathPattern != "/" {
+		if archiving {
+			// Archive entries are named by their path in the image.
+			outputPath = filepath.Clean(imagePath)
+		} else if outputTemplate != nil {
+			outputPath = outputTemplate.Expand(imagePath, source.BlobDigest)
+		} else if cpLayout != nil {
+			outputPath = cpLayout.outputPath(imagePath)
+		} else if priorityFile == "" && !recreateSymlinks && rewriter == nil && len(pathPatterns) == 1 && len(matchedFiles) == 1 && !strings.HasSuffix(pathPatterns[0], "/") && !isWholeLayerPattern(pathPatterns[0]) {
 			// Single file download - use outputDir as the file path directly
 			outputPath = outputDir
 		} else {
 			// Multiple files or directory download - maintain directory structure
-			cleanPath := filepath.Clean(fileInfo.Path)
+			cleanPath := filepath.Clean(imagePath)
 			outputPath = filepath.Join(outputDir, cleanPath)
 		}
 
-		jobs = append(jobs, &stargzget.DownloadJob{
-			Path:       fileInfo.Path,
-			BlobDigest: fileInfo.BlobDigest,
-			Size:       fileInfo.Size,
+		job := &stargzget.DownloadJob{
+			Path:       source.Path,
+			BlobDigest: source.BlobDigest,
+			Size:       source.Size,
 			OutputPath: outputPath,
-		})
+			Mode:       source.Mode,
+			UID:        source.UID,
+			GID:        source.GID,
+			ModTime:    source.ModTime,
+		}
+		jobs = append(jobs, job)
+
+		sourceKey := source.BlobDigest.String() + ":" + source.Path
+		if fileInfo.IsRegular() {
+			extracted[sourceKey] = outputPath
+		} else if fileInfo.IsHardlink() {
+			hardlinks[job] = sourceKey
+		}
+	}
+
+	// Hard links whose target is extracted too become links to it; the
+	// others get a copy of the target's content.
+	for job, sourceKey := range hardlinks {
+		if target, ok := extracted[sourceKey]; ok {
+			job.LinkTo = target
+		}
+	}
+	if len(jobs) == 0 {
+		fmt.Fprintf(os.Stderr, "No regular files to download for pattern: %s\n", pathPattern)
+		os.Exit(1)
+	}
+
+	ownership, err := ownershipOptions(cmd, outputDir, len(jobs) == 1 && jobs[0].OutputPath == outputDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	policy, err := stargzget.ParseConflictPolicy(onConflict)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := stargzget.CheckRenameSuffix(renameSuffix); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	portability := stargzget.HostPortability(policy)
+	if portable {
+		portability = stargzget.StrictPortability(policy)
+	} else if archiving {
+		// The host filesystem never sees archive entries.
+		portability = nil
+	} else if !portability.CaseInsensitive && stargzget.CaseInsensitiveDir(outputDir) {
+		// Case-insensitive mounts and casefold directories exist on
+		// any OS; the output directory itself says how it behaves.
+		logger.Info("%s is on a case-insensitive filesystem; checking for case collisions", outputDir)
+		portability.CaseInsensitive = true
+	}
+	if portability != nil {
+		portability.RenameSuffix = renameSuffix
 	}
 
 	// Progress bar is enabled by default
@@ -380,12 +974,91 @@ func runGet(cmd *cobra.Command, args []string) {
 	}
 
 	// Start download with custom options
-	opts := &stargzget.DownloadOptions{
-		MaxRetries:  3,
-		Concurrency: concurrency,
-		OnStatus:    statusCallback,
+	opts := &tuning
+	opts.OnStatus = statusCallback
+	opts.Ownership = ownership
+	opts.Portability = portability
+	opts.MaxChunkSize = chunkLimit
+	opts.AuditFetches = auditFetches
+	if blockSecrets {
+		opts.ContentFilter = stargzget.NewSecretFilter(stargzget.FilterBlock)
+	}
+	if chunkCacheDir != "" {
+		cache, err := stargzget.NewDirChunkCache(chunkCacheDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening chunk cache: %v\n", err)
+			os.Exit(1)
+		}
+		opts.ChunkCache = cache
+	}
+	opts.OnWarning = func(w stargzget.Warning) {
+		switch {
+		case w.Kind == stargzget.WarningStalled && !opts.AbortOnStall:
+		case w.Kind == stargzget.WarningDigestMismatch:
+		default:
+			return
+		}
+		if showProgress {
+			fmt.Fprintln(os.Stderr)
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", w.Err)
+	}
+	if provenanceLog != "" {
+		opts.Provenance = &stargzget.ProvenanceOptions{Image: imageRef, ImageDigest: manifest.Digest}
+		// A transactional download holds the records back until it
+		// commits; see stageLogs.
+		if !transactional {
+			f, err := os.OpenFile(provenanceLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening provenance log: %v\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			opts.Provenance.Writer = f
+		}
+	}
+	var archiveFile *os.File
+	if archiving {
+		err := os.MkdirAll(filepath.Dir(outputDir), 0o755)
+		if err == nil {
+			archiveFile, err = os.Create(outputDir)
+		}
+		if err == nil {
+			// Spool next to the archive, where there is room for it.
+			opts.Archive, err = stargzget.NewArchiveWriter(archiveFile, format, filepath.Dir(outputDir))
+		}
+		if err == nil && reproducible {
+			var clamp time.Time
+			clamp, err = sourceDateEpoch()
+			opts.Archive.SetReproducible(clamp)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating archive: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var stats *stargzget.DownloadStats
+	if transactional {
+		stats, err = downloadTransaction(ctx, downloader, jobs, outputDir, progressCallback, opts, provenanceLog)
+	} else {
+		stats, err = downloader.StartDownload(ctx, jobs, progressCallback, opts)
+	}
+	printPathIssues(stats)
+	if statsOut != "" {
+		if err := writeStatsOut(statsOut, newRunSummary(imageRef, stats, err)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing stats: %v\n", err)
+		}
+	}
+	if archiveFile != nil {
+		closeErr := opts.Archive.Close()
+		if err := archiveFile.Close(); closeErr == nil {
+			closeErr = err
+		}
+		if closeErr != nil {
+			fmt.Fprintf(os.Stderr, "Error writing archive: %v\n", closeErr)
+			os.Exit(1)
+		}
 	}
-	stats, err := downloader.StartDownload(ctx, jobs, progressCallback, opts)
 	if err != nil {
 		if showProgress {
 			fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
@@ -402,6 +1075,9 @@ func runGet(cmd *cobra.Command, args []string) {
 		if stats.FailedFiles > 0 {
 			fmt.Printf(" (%d failed)", stats.FailedFiles)
 		}
+		if stats.BlockedFiles > 0 {
+			fmt.Printf(" (%d blocked)", stats.BlockedFiles)
+		}
 		if stats.Retries > 0 {
 			fmt.Printf(" (%d retries)", stats.Retries)
 		}
@@ -412,9 +1088,393 @@ func runGet(cmd *cobra.Command, args []string) {
 		if stats.FailedFiles > 0 {
 			fmt.Printf(" (%d failed)", stats.FailedFiles)
 		}
+		if stats.BlockedFiles > 0 {
+			fmt.Printf(" (%d blocked)", stats.BlockedFiles)
+		}
 		if stats.Retries > 0 {
 			fmt.Printf(" (%d retries)", stats.Retries)
 		}
 		fmt.Println()
 	}
+	printBlobStats(stats)
+	printFetchAudit(stats)
+
+	if recreateSymlinks {
+		for _, err := range recreateLinks(outputDir, followedLinks) {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+
+	if verifyDiffID {
+		if stats.FailedFiles > 0 {
+			fmt.Fprintf(os.Stderr, "Error: not verifying diff ID, %d file(s) failed to download\n", stats.FailedFiles)
+			os.Exit(1)
+		}
+		diffID, err := verifyLayerDiffID(ctx, storage, manifest, dgst)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Verified diff ID %s\n", diffID)
+	}
+
+	if pushRef != "" {
+		if stats.FailedFiles > 0 {
+			fmt.Fprintf(os.Stderr, "Error: not pushing %s, %d file(s) failed to download\n", pushRef, stats.FailedFiles)
+			os.Exit(1)
+		}
+		pushed, err := pushArchive(ctx, outputDir, manifest, storage, pushRef)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Pushed %s (%s)\n", pushRef, pushed)
+	}
+}
+
+// downloadTransaction downloads jobs into outputDir as one transaction: the
+// files, and the ownership and provenance logs, appear only once every file
+// succeeded.
+func downloadTransaction(ctx context.Context, downloader stargzget.Downloader, jobs []*stargzget.DownloadJob, outputDir string, progress stargzget.ProgressCallback, opts *stargzget.DownloadOptions, provenanceLog string) (*stargzget.DownloadStats, error) {
+	tx, err := stageJobs(jobs, outputDir)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := stageLogs(tx, opts, provenanceLog)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := downloader.StartDownload(ctx, jobs, progress, opts)
+	if err == nil && stats.FailedFiles > 0 {
+		err = fmt.Errorf("%d file(s) failed to download", stats.FailedFiles)
+	}
+	if err != nil {
+		logs.abort()
+		return stats, fmt.Errorf("%w; nothing was moved into %s", err, tx.Root())
+	}
+	return stats, logs.commit()
+}
+
+// stageJobs begins a transaction for the download into outputDir, which
+// names the file itself for a single file download, and points the jobs at
+// their staged paths.
+func stageJobs(jobs []*stargzget.DownloadJob, outputDir string) (*stargzget.Transaction, error) {
+	root := outputDir
+	if len(jobs) == 1 && jobs[0].OutputPath == outputDir {
+		root = filepath.Dir(outputDir)
+	}
+	tx, err := stargzget.BeginTransaction(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.OutputPath, err = tx.Path(job.OutputPath); err == nil && job.LinkTo != "" {
+			job.LinkTo, err = tx.Path(job.LinkTo)
+		}
+		if err != nil {
+			tx.Abort()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// transactionLogs holds back the ownership and provenance logs of a
+// transactional download until its transaction commits, so an aborted
+// download leaves neither behind.
+type transactionLogs struct {
+	tx *stargzget.Transaction
+
+	// ownership is the ownership file outside the transaction's root,
+	// which is written to ownershipTemp next to it meanwhile, if at all.
+	// One under the root is staged with the files instead.
+	ownership     string
+	ownershipTemp string
+
+	provenanceLog string
+	provenance    bytes.Buffer
+}
+
+// stageLogs points opts at the transaction and its logs at staged copies.
+// On error the transaction is aborted.
+func stageLogs(tx *stargzget.Transaction, opts *stargzget.DownloadOptions, provenanceLog string) (*transactionLogs, error) {
+	logs := &transactionLogs{tx: tx}
+	opts.Transaction = tx
+	if opts.Provenance != nil {
+		logs.provenanceLog = provenanceLog
+		opts.Provenance.Writer = &logs.provenance
+	}
+	if opts.Ownership == nil || opts.Ownership.RecordPath == "" {
+		return logs, nil
+	}
+
+	record := opts.Ownership.RecordPath
+	staged, err := tx.Path(record)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(staged), 0o755)
+	} else {
+		// Only reserve the name: running as root, no file is written.
+		var f *os.File
+		f, err = os.CreateTemp(filepath.Dir(record), "."+filepath.Base(record)+".starget-*")
+		if err == nil {
+			logs.ownership, logs.ownershipTemp, staged = record, f.Name(), f.Name()
+			f.Close()
+			err = os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		logs.abort()
+		return nil, fmt.Errorf("failed to stage ownership file: %w", err)
+	}
+	opts.Ownership.RecordPath = staged
+	return logs, nil
+}
+
+// commit commits the transaction, then moves the ownership file into place
+// and appends the provenance records to their log.
+func (l *transactionLogs) commit() error {
+	if _, err := l.tx.Commit(); err != nil {
+		l.removeOwnershipTemp()
+		return err
+	}
+	if l.ownershipTemp != "" {
+		if err := os.Rename(l.ownershipTemp, l.ownership); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if l.provenanceLog == "" {
+		return nil
+	}
+	f, err := os.OpenFile(l.provenanceLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open provenance log: %w", err)
+	}
+	if _, err := l.provenance.WriteTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write provenance log: %w", err)
+	}
+	return f.Close()
+}
+
+// abort aborts the transaction and drops the logs.
+func (l *transactionLogs) abort() {
+	l.tx.Abort()
+	l.removeOwnershipTemp()
+}
+
+func (l *transactionLogs) removeOwnershipTemp() {
+	if l.ownershipTemp != "" {
+		os.Remove(l.ownershipTemp)
+	}
+}
+
+// parseGetArgs splits the arguments after the image reference into an
+// optional blob digest, the path patterns and the output directory. Without
+// -o the historical form applies: one PATH and an optional OUTPUT_DIR. With
+// -o every remaining argument is a PATH. When the paths come from a priority
+// file, no PATH arguments are taken and only [BLOB] [OUTPUT_DIR] remain.
+func parseGetArgs(rest []string, output string, outputSet bool, pathsFromFile bool) (string, []string, string, error) {
+	var blobDigest string
+	// A blob digest (sha256:... or sha512:...) comes before at least one
+	// PATH, unless the paths come from a file.
+	minAfterBlob := 1
+	if pathsFromFile {
+		minAfterBlob = 0
+	}
+	if len(rest) >= 1+minAfterBlob && strings.HasPrefix(rest[0], "sha") {
+		blobDigest, rest = rest[0], rest[1:]
+	}
+
+	if outputSet && output == "" {
+		return "", nil, "", fmt.Errorf("-o requires a directory")
+	}
+
+	if pathsFromFile {
+		switch {
+		case outputSet && len(rest) == 0:
+			return blobDigest, nil, output, nil
+		case !outputSet && len(rest) == 0:
+			return blobDigest, nil, ".", nil
+		case !outputSet && len(rest) == 1:
+			return blobDigest, nil, rest[0], nil
+		default:
+			return "", nil, "", fmt.Errorf("PATH arguments cannot be combined with --priority-file")
+		}
+	}
+
+	if len(rest) == 0 {
+		return "", nil, "", fmt.Errorf("missing PATH")
+	}
+	if outputSet {
+		return blobDigest, rest, output, nil
+	}
+
+	switch len(rest) {
+	case 1:
+		return blobDigest, rest, ".", nil
+	case 2:
+		return blobDigest, rest[:1], rest[1], nil
+	default:
+		return "", nil, "", fmt.Errorf("several PATHs need the output directory given with -o, e.g. -o %s", rest[len(rest)-1])
+	}
+}
+
+// isWholeLayerPattern reports whether pattern selects every file.
+// recreateLinks creates the symlinks followed to reach the downloaded files
+// under outputDir, each once. Absolute targets are made relative so that
+// they point into outputDir rather than the host's root. Links whose path is
+// already taken are left alone.
+func recreateLinks(outputDir string, links []*stargzget.FileInfo) []error {
+	var errs []error
+	created := make(map[string]bool)
+	for _, link := range links {
+		if created[link.Path] {
+			continue
+		}
+		created[link.Path] = true
+
+		target := link.LinkName
+		if path.IsAbs(target) {
+			rel, err := filepath.Rel(path.Dir("/"+link.Path), path.Clean(target))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("symlink %s: %w", link.Path, err))
+				continue
+			}
+			target = rel
+		}
+		linkPath := filepath.Join(outputDir, filepath.FromSlash(link.Path))
+		if _, err := os.Lstat(linkPath); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(linkPath), 0o755); err != nil {
+			errs = append(errs, fmt.Errorf("symlink %s: %w", link.Path, err))
+			continue
+		}
+		if err := os.Symlink(filepath.FromSlash(target), linkPath); err != nil {
+			errs = append(errs, fmt.Errorf("symlink %s: %w", link.Path, err))
+		}
+	}
+	return errs
+}
+
+func isWholeLayerPattern(pattern string) bool {
+	return pattern == "." || pattern == "/" || pattern == "*"
+}
+
+// verifyLayerDiffID checks the layer blobDigest against the diff ID recorded
+// in the image config and returns that diff ID.
+func verifyLayerDiffID(ctx context.Context, storage stor.Storage, manifest *stor.Manifest, blobDigest digest.Digest) (digest.Digest, error) {
+	config, err := stor.ReadImageConfig(ctx, storage, manifest.Config)
+	if err != nil {
+		return "", err
+	}
+	diffID, err := stargzget.LayerDiffID(manifest, config, blobDigest)
+	if err != nil {
+		return "", err
+	}
+	return diffID, stargzget.VerifyDiffID(ctx, storage, blobDigest, diffID)
+}
+
+// printBlobStats reports per-layer transfer metrics and, when several layers
+// were read, which one was slowest.
+func printBlobStats(stats *stargzget.DownloadStats) {
+	if len(stats.Blobs) < 2 {
+		return
+	}
+	fmt.Println("Per-layer transfer:")
+	for _, b := range stats.Blobs {
+		fmt.Printf("  %s  %d files, %s fetched in %d requests, avg latency %s, %s/s",
+			b.BlobDigest, b.Files, formatBytes(b.TransferredBytes), b.Requests,
+			b.AverageLatency().Round(time.Millisecond), formatBytes(int64(b.Throughput())))
+		if b.Retries > 0 {
+			fmt.Printf(", %d retries", b.Retries)
+		}
+		fmt.Println()
+	}
+	if slowest := stats.SlowestBlob(); slowest != nil {
+		fmt.Printf("Slowest layer: %s (%s/s, avg latency %s)\n",
+			slowest.BlobDigest, formatBytes(int64(slowest.Throughput())), slowest.AverageLatency().Round(time.Millisecond))
+	}
+}
+
+// printFetchAudit reports, with --audit-fetches, the ranges requested from
+// each layer against those the downloaded files needed, and warns about
+// over-fetch.
+func printFetchAudit(stats *stargzget.DownloadStats) {
+	if len(stats.Fetches) == 0 {
+		return
+	}
+	var over int64
+	var layers int
+	fmt.Println("Fetch audit:")
+	for _, a := range stats.Fetches {
+		fmt.Printf("  %s  %d requests", a.BlobDigest, a.Requests)
+		if a.OpenEnded > 0 {
+			fmt.Printf(" (%d open-ended)", a.OpenEnded)
+		}
+		fmt.Printf(", planned %s, requested %s, read %s", formatBytes(a.PlannedBytes), formatBytes(a.RequestedBytes), formatBytes(a.ReadBytes))
+		if n := a.OverFetchedBytes(); n > 0 {
+			over += n
+			layers++
+			fmt.Printf(", %s beyond the plan:", formatBytes(n))
+			for i, r := range a.OverFetch {
+				if i == 3 {
+					fmt.Printf(" and %d more", len(a.OverFetch)-i)
+					break
+				}
+				fmt.Printf(" %d-%d", r.Offset, r.End()-1)
+			}
+		}
+		fmt.Println()
+	}
+	if over > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: requested %s beyond what the files needed from %d layer(s)\n", formatBytes(over), layers)
+	}
+}
+
+// printPathIssues reports files renamed, skipped or rejected by the
+// portability checks.
+func printPathIssues(stats *stargzget.DownloadStats) {
+	if stats == nil {
+		return
+	}
+	for _, issue := range stats.PathIssues {
+		fmt.Fprintf(os.Stderr, "Path issue: %s\n", issue)
+	}
+	for _, hit := range stats.Filtered {
+		fmt.Fprintf(os.Stderr, "Content filter: %s\n", hit)
+	}
+}
+
+// ownershipOptions builds ownership handling from --uid-map, --gid-map and
+// --ownership-file. It returns nil when none of them is set.
+func ownershipOptions(cmd *cobra.Command, outputDir string, singleFile bool) (*stargzget.OwnershipOptions, error) {
+	if len(uidMaps) == 0 && len(gidMaps) == 0 && !cmd.Flags().Changed("ownership-file") {
+		return nil, nil
+	}
+
+	opts := &stargzget.OwnershipOptions{RecordPath: ownershipFile}
+	for _, m := range uidMaps {
+		mapping, err := stargzget.ParseIDMapping(m)
+		if err != nil {
+			return nil, err
+		}
+		opts.UIDMap = append(opts.UIDMap, mapping)
+	}
+	for _, m := range gidMaps {
+		mapping, err := stargzget.ParseIDMapping(m)
+		if err != nil {
+			return nil, err
+		}
+		opts.GIDMap = append(opts.GIDMap, mapping)
+	}
+
+	if opts.RecordPath == "" {
+		dir := outputDir
+		if singleFile {
+			dir = filepath.Dir(outputDir)
+		}
+		opts.RecordPath = filepath.Join(dir, ".starget-ownership.jsonl")
+	}
+	return opts, nil
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+// wholeFileResolver serves blobs that each hold one file in a single gzip
+// member.
+type wholeFileResolver map[digest.Digest]*stargzget.FileMetadata
+
+func (r wholeFileResolver) FileMetadata(ctx context.Context, blobDigest digest.Digest, path string) (*stargzget.FileMetadata, error) {
+	meta, ok := r[blobDigest]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return meta, nil
+}
+
+func (r wholeFileResolver) TOC(ctx context.Context, blobDigest digest.Digest) (*estargzutil.JTOC, error) {
+	return &estargzutil.JTOC{}, nil
+}
+
+func (r wholeFileResolver) FileChunks(ctx context.Context, blobDigest digest.Digest, path string) ([]stargzget.ChunkSpan, error) {
+	return nil, os.ErrNotExist
+}
+
+func (r wholeFileResolver) add(t *testing.T, store *storage.MockStorage, content string) digest.Digest {
+	t.Helper()
+	var blob bytes.Buffer
+	zw := gzip.NewWriter(&blob)
+	zw.Write([]byte(content))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dgst := store.AddBlob("application/vnd.test.gzip", blob.Bytes())
+	size := int64(len(content))
+	r[dgst] = &stargzget.FileMetadata{
+		Size:   size,
+		Chunks: []stargzget.Chunk{{Size: size}},
+		Digest: digest.FromString(content).String(),
+	}
+	return dgst
+}
+
+func readJSONLines[T any](t *testing.T, path string) []T {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []T
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var rec T
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid line %q in %s: %v", scanner.Text(), path, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestDownloadTransaction(t *testing.T) {
+	store := storage.NewMockStorage()
+	resolver := wholeFileResolver{}
+	tool := resolver.add(t, store, "tool")
+	conf := resolver.add(t, store, "debug = false\n")
+
+	origUIDMaps, origOwnershipFile := uidMaps, ownershipFile
+	defer func() { uidMaps, ownershipFile = origUIDMaps, origOwnershipFile }()
+	uidMaps = []string{"0:1000:1"}
+
+	// download runs a transactional download of the two files, plus one
+	// that fails when fail is set, into parent/out with --uid-map and
+	// --provenance-log parent/provenance.jsonl.
+	download := func(t *testing.T, parent string, fail bool) error {
+		out := filepath.Join(parent, "out")
+		jobs := []*stargzget.DownloadJob{
+			{Path: "usr/bin/tool", BlobDigest: tool, Size: 4, OutputPath: filepath.Join(out, "usr", "bin", "tool")},
+			{Path: "etc/app.conf", BlobDigest: conf, Size: 14, OutputPath: filepath.Join(out, "etc", "app.conf")},
+		}
+		if fail {
+			jobs = append(jobs, &stargzget.DownloadJob{Path: "missing", BlobDigest: digest.FromString("missing"), Size: 1, OutputPath: filepath.Join(out, "missing")})
+		}
+		ownership, err := ownershipOptions(&cobra.Command{}, out, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &stargzget.DownloadOptions{
+			MaxRetries: 1,
+			Ownership:  ownership,
+			Provenance: &stargzget.ProvenanceOptions{Image: "registry.example/app:v1"},
+		}
+		downloader := stargzget.NewDownloader(resolver, store)
+		_, err = downloadTransaction(context.Background(), downloader, jobs, out, nil, opts, filepath.Join(parent, "provenance.jsonl"))
+		return err
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		parent := t.TempDir()
+		out := filepath.Join(parent, "out")
+		ownershipFile = ""
+		if err := download(t, parent, false); err != nil {
+			t.Fatalf("downloadTransaction() error = %v", err)
+		}
+
+		want := []string{filepath.Join(out, "etc", "app.conf"), filepath.Join(out, "usr", "bin", "tool")}
+		provenance := readJSONLines[stargzget.ProvenanceRecord](t, filepath.Join(parent, "provenance.jsonl"))
+		var got []string
+		for _, rec := range provenance {
+			got = append(got, rec.OutputPath)
+		}
+		sort.Strings(got)
+		if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("provenance output paths = %v, want %v", got, want)
+		}
+
+		// Running as root, ownership is applied instead of recorded.
+		if os.Geteuid() != 0 {
+			ownership := readJSONLines[stargzget.OwnershipRecord](t, filepath.Join(out, ".starget-ownership.jsonl"))
+			if len(ownership) != 2 || ownership[0].Path != want[0] || ownership[1].Path != want[1] || ownership[0].UID != 1000 {
+				t.Errorf("ownership records = %+v, want %v owned by 1000", ownership, want)
+			}
+		}
+
+		entries, _ := os.ReadDir(parent)
+		if len(entries) != 2 {
+			t.Errorf("parent holds %v, want only out and provenance.jsonl", entries)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		parent := t.TempDir()
+		ownershipFile = filepath.Join(parent, "ownership.jsonl")
+		if err := download(t, parent, true); err == nil {
+			t.Fatalf("downloadTransaction() succeeded with a missing file")
+		}
+		entries, _ := os.ReadDir(parent)
+		if len(entries) != 0 {
+			t.Errorf("parent holds %v after the aborted download, want nothing", entries)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newPingCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ping <REGISTRY>[/<IMAGE>:<TAG>]",
+		Short: "Time the registry's ping, token, manifest and blob range requests",
+		Long: `Probe a registry step by step and report the latency of each request, to
+tell a slow registry from a slow network. With only REGISTRY, ping /v2/ and
+acquire a token. With an image, also fetch its manifest and read a few bytes
+from the end of its first layer, reporting whether range requests, HTTP/2
+and a CDN redirect are in use.`,
+		Args: cobra.ExactArgs(1),
+		Run:  runPing,
+	}
+}
+
+func runPing(cmd *cobra.Command, args []string) {
+	report, err := newRegistryClient().Ping(commandContext(), args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Registry: %s\n", report.Registry)
+	for _, step := range report.Steps {
+		status := "-"
+		if step.Status != 0 {
+			status = fmt.Sprint(step.Status)
+		}
+		detail := step.Detail
+		if step.Err != nil {
+			detail = fmt.Sprintf("FAILED: %v", step.Err)
+		}
+		fmt.Printf("  %-10s  %8s  %3s  %s\n", step.Name, step.Latency.Round(time.Millisecond), status, detail)
+	}
+
+	fmt.Println("Features:")
+	auth := report.AuthScheme
+	if auth == "" {
+		auth = "anonymous"
+	}
+	fmt.Printf("  Auth:           %s\n", auth)
+	fmt.Printf("  HTTP/2:         %s\n", yesNo(report.HTTP2(), report.Protocol))
+	if report.RangeRequests != "" {
+		fmt.Printf("  Range requests: %s\n", report.RangeRequests)
+		redirect := "none"
+		if report.BlobRedirect != "" {
+			redirect = fmt.Sprintf("%s (%s)", report.BlobRedirect, report.BlobProtocol)
+		}
+		fmt.Printf("  Blob redirect:  %s\n", redirect)
+	}
+
+	if failed := report.Failed(); failed != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s step failed: %v\n", failed.Name, failed.Err)
+		os.Exit(1)
+	}
+}
+
+// yesNo renders a feature flag with the evidence for it.
+func yesNo(ok bool, evidence string) string {
+	answer := "no"
+	if ok {
+		answer = "yes"
+	}
+	if evidence == "" {
+		return answer
+	}
+	return fmt.Sprintf("%s (%s)", answer, evidence)
+}
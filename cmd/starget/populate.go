@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
+	"github.com/spf13/cobra"
+)
+
+var (
+	populateAddress     string
+	populateNamespace   string
+	populateName        string
+	populateConcurrency int
+)
+
+func newPopulateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "populate <REGISTRY>/<IMAGE>:<TAG>",
+		Short: "Write an image into a local containerd content store",
+		Long: `Write the config, layers and manifest of an image into the content store of
+a containerd daemon and name the image there, so the runtime can start it
+without pulling. Blobs the store already holds are skipped, and an ingest
+left by an interrupted run is resumed.
+
+Requires a starget built with the containerd build tag:
+
+  go build -tags containerd ./cmd/starget`,
+		Args: cobra.ExactArgs(1),
+		Run:  runPopulate,
+	}
+	cmd.Flags().StringVar(&populateAddress, "containerd", "/run/containerd/containerd.sock", "Address of the containerd socket")
+	cmd.Flags().StringVar(&populateNamespace, "namespace", "default", "containerd namespace to write into (k8s.io for Kubernetes)")
+	cmd.Flags().StringVar(&populateName, "name", "", "Name of the image in containerd (default: the image reference; required for oci: layouts and docker-archive: files)")
+	cmd.Flags().IntVar(&populateConcurrency, "concurrency", 4, "Number of blobs written at once")
+	return cmd
+}
+
+func runPopulate(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+	name := populateName
+	if name == "" {
+		ref, err := refs.Parse(imageRef)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --name is required for %s\n", imageRef)
+			os.Exit(1)
+		}
+		name = ref.String()
+	}
+
+	ctx := commandContext()
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := populateContainerd(ctx, storage, manifest, name); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
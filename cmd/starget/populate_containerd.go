@@ -0,0 +1,29 @@
+//go:build containerd
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/flaneur2020/stargz-get/stargzget/contentstore"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+// populateContainerd writes the image into the containerd content store
+// named by the populate flags.
+func populateContainerd(ctx context.Context, storage stor.Storage, manifest *stor.Manifest, name string) error {
+	store, err := contentstore.DialContainerd(populateAddress, populateNamespace)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	result, err := store.Populate(ctx, storage, manifest, name, populateConcurrency)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Populated %s in containerd namespace %s: %d blob(s) written (%s), %d already present; manifest %s\n",
+		name, populateNamespace, result.Written, formatBytes(result.Bytes), result.Skipped, result.Manifest.Digest)
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !containerd
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+// populateContainerd is unavailable without the containerd build tag.
+func populateContainerd(ctx context.Context, storage stor.Storage, manifest *stor.Manifest, name string) error {
+	return fmt.Errorf("this starget was built without containerd support; rebuild with -tags containerd")
+}
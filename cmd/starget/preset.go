@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/spf13/cobra"
+)
+
+// preset is the tuning bundle selected with --preset, or nil.
+var preset *stargzget.Preset
+
+// presetUsage names the bundled presets for the --preset flag.
+func presetUsage() string {
+	var names []string
+	for _, p := range stargzget.Presets() {
+		names = append(names, p.Name)
+	}
+	return fmt.Sprintf("Tuning preset for concurrency, retries, backoff and per-host requests: %s (explicit flags still win)", strings.Join(names, ", "))
+}
+
+// loadPreset resolves --preset and applies its per-host request budget
+// unless --max-requests-per-host was set explicitly.
+func loadPreset(cmd *cobra.Command) error {
+	if presetName == "" {
+		return nil
+	}
+	p, err := stargzget.LookupPreset(presetName)
+	if err != nil {
+		return err
+	}
+	preset = &p
+	if !flagExplicit(cmd, "max-requests-per-host") {
+		maxRequestsPerHost = p.MaxRequestsPerHost
+	}
+	return nil
+}
+
+// tuningOptions returns the download tuning from the preset and the get
+// flags. Flags set on the command line or through their environment
+// variables override the preset.
+func tuningOptions(cmd *cobra.Command) stargzget.DownloadOptions {
+	opts := stargzget.DownloadOptions{
+		MaxRetries:               3,
+		Concurrency:              concurrency,
+		DisableChunkedSingleFile: noChunkedSingleFile,
+		StallTimeout:             stallTimeout,
+		AbortOnStall:             abortOnStall,
+	}
+	if preset == nil {
+		return opts
+	}
+	flags := opts
+	preset.Apply(&opts)
+	if flagExplicit(cmd, "concurrency") {
+		opts.Concurrency = flags.Concurrency
+	}
+	if flagExplicit(cmd, "no-chunked-single-file") {
+		opts.DisableChunkedSingleFile = flags.DisableChunkedSingleFile
+	}
+	if flagExplicit(cmd, "stall-timeout") {
+		opts.StallTimeout = flags.StallTimeout
+	}
+	if flagExplicit(cmd, "abort-on-stall") {
+		opts.AbortOnStall = flags.AbortOnStall
+	}
+	return opts
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+var prioritiesOutput string
+
+func newPrioritiesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "priorities <REGISTRY>/<IMAGE>:<TAG> [BLOB]",
+		Short: "Export the prefetch-prioritized files of each layer as a list usable with get --priority-file",
+		Args:  cobra.RangeArgs(1, 2),
+		Run:   runPriorities,
+	}
+	cmd.Flags().StringVarP(&prioritiesOutput, "output", "o", "", "Write the list to this file instead of stdout")
+	return cmd
+}
+
+func runPriorities(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+
+	ctx := commandContext()
+
+	var dgst digest.Digest
+	if len(args) == 2 {
+		var err error
+		dgst, err = digest.Parse(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing digest: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	_, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	resolver := stargzget.NewBlobResolver(storage, resolverOptions()...)
+	index, err := stargzget.NewBlobIndexLoader(storage, resolver, loaderOptions()...).Load(ctx)
+	if err != nil {
+		printIndexError(err)
+		os.Exit(1)
+	}
+
+	layers := index.Layers
+	if dgst != "" {
+		layers = nil
+		for _, layer := range index.Layers {
+			if layer.BlobDigest == dgst {
+				layers = append(layers, layer)
+			}
+		}
+		if len(layers) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: blob %s is not a layer of %s\n", dgst, imageRef)
+			os.Exit(1)
+		}
+	}
+
+	total := 0
+	for _, layer := range layers {
+		total += len(layer.Prioritized)
+	}
+	if total == 0 {
+		fmt.Fprintf(os.Stderr, "No prioritized files: no layer has a %s entry\n", estargzutil.PrefetchLandmark)
+	}
+
+	if prioritiesOutput == "" {
+		err = stargzget.WritePriorityList(os.Stdout, layers)
+	} else {
+		err = writePriorityFile(prioritiesOutput, layers)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func writePriorityFile(path string, layers []*stargzget.LayerInfo) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := stargzget.WritePriorityList(f, layers); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readPriorityFile loads the paths of a priority list for get --priority-file.
+func readPriorityFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	paths, err := stargzget.ReadPriorityList(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read priority file %s: %w", path, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("priority file %s lists no paths", path)
+	}
+	return paths, nil
+}
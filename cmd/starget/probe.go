@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+)
+
+// runInfoProbe is 'starget info --probe': it lists the layers along with
+// what their footers say, so users learn whether lazy access will work
+// before running ls or get.
+func runInfoProbe(imageRef string) {
+	ctx := commandContext()
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(manifest.Index) > 0 {
+		printIndexEntries(manifest)
+	}
+	started := time.Now()
+	probes := stargzget.ProbeLayers(ctx, storage, manifest)
+	elapsed := time.Since(started)
+
+	fmt.Printf("Layers for %s:\n", imageRef)
+	readable := 0
+	for i, probe := range probes {
+		switch {
+		case probe.Err != nil:
+			fmt.Printf("%d: %s (size: %d bytes) error: %v\n", i, probe.BlobDigest, probe.Size, probe.Err)
+		case probe.Format == stargzget.LayerFormatEstargz:
+			readable++
+			fmt.Printf("%d: %s (size: %d bytes, format: %s, TOC offset: %d, %s)\n",
+				i, probe.BlobDigest, probe.Size, probe.Format, probe.TOCOffset, probe.Latency.Round(time.Millisecond))
+		default:
+			fmt.Printf("%d: %s (size: %d bytes, format: %s, %s)\n",
+				i, probe.BlobDigest, probe.Size, probe.Format, probe.Latency.Round(time.Millisecond))
+		}
+	}
+
+	fmt.Printf("%d of %d layers are eStargz (probed in %s)\n", readable, len(probes), elapsed.Round(time.Millisecond))
+	switch {
+	case len(probes) > 0 && readable == len(probes):
+		fmt.Println("Lazy access will work for every layer.")
+	case readable > 0:
+		fmt.Println("Lazy access will work for the eStargz layers only; ls and get skip the others.")
+	default:
+		fmt.Println("Lazy access will not work: no layer is eStargz.")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	pushConfigMediaType = "application/vnd.oci.image.config.v1+json"
+	pushLayerMediaType  = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// pushArchive publishes the tar archive at archivePath as a one-layer image
+// named newRef. The image keeps the config of the source image, with its
+// rootfs replaced by the new layer and its history, which described the
+// source layers, dropped. It returns the pushed manifest's digest.
+func pushArchive(ctx context.Context, archivePath string, source *stor.Manifest, sourceStorage stor.Storage, newRef string) (digest.Digest, error) {
+	ref, err := refs.Parse(newRef)
+	if err != nil {
+		return "", err
+	}
+	layer, layerDigest, diffID, err := compressLayer(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to compress layer: %w", err)
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+	info, err := layer.Stat()
+	if err != nil {
+		return "", err
+	}
+	layerDesc := stor.Descriptor{MediaType: pushLayerMediaType, Digest: layerDigest.String(), Size: info.Size()}
+
+	config, err := pushConfig(ctx, source, sourceStorage, diffID)
+	if err != nil {
+		return "", err
+	}
+	configDesc := stor.Descriptor{MediaType: pushConfigMediaType, Digest: digest.FromBytes(config).String(), Size: int64(len(config))}
+
+	manifest := &stor.Manifest{
+		SchemaVersion: 2,
+		Config:        configDesc,
+		Layers:        []stor.Layer{{MediaType: layerDesc.MediaType, Digest: layerDesc.Digest, Size: layerDesc.Size}},
+	}
+	data, mediaType, err := manifest.Encode()
+	if err != nil {
+		return "", err
+	}
+
+	pusher, ok := newRegistryClient().NewStorage(ref.Registry, ref.Repository, nil).(stor.Pusher)
+	if !ok {
+		return "", fmt.Errorf("registry storage cannot push")
+	}
+	if err := pusher.PushBlob(ctx, layerDesc, layer); err != nil {
+		return "", fmt.Errorf("failed to push layer: %w", err)
+	}
+	if err := pusher.PushBlob(ctx, configDesc, bytes.NewReader(config)); err != nil {
+		return "", fmt.Errorf("failed to push config: %w", err)
+	}
+	pushed, err := pusher.PushManifest(ctx, ref.Identifier(), mediaType, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to push manifest: %w", err)
+	}
+	return pushed, nil
+}
+
+// compressLayer gzips the tar at path into a temporary file beside it and
+// returns the file with its digest and the digest of the uncompressed tar,
+// the layer's diff ID.
+func compressLayer(path string) (*os.File, digest.Digest, digest.Digest, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(path), ".starget-push-*.tar.gz")
+	if err != nil {
+		return nil, "", "", err
+	}
+	compressed, diffID := digest.Canonical.Digester(), digest.Canonical.Digester()
+	gz := gzip.NewWriter(io.MultiWriter(out, compressed.Hash()))
+	_, err = io.Copy(gz, io.TeeReader(in, diffID.Hash()))
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return nil, "", "", err
+	}
+	return out, compressed.Digest(), diffID.Digest(), nil
+}
+
+// pushConfig returns the source image's config rewritten for a single layer
+// with diffID. Fields this tool does not know are kept as they are.
+func pushConfig(ctx context.Context, source *stor.Manifest, sourceStorage stor.Storage, diffID digest.Digest) ([]byte, error) {
+	dgst, err := digest.Parse(source.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config digest %q: %w", source.Config.Digest, err)
+	}
+	body, err := sourceStorage.ReadBlob(ctx, dgst, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	if got := dgst.Algorithm().FromBytes(data); got != dgst {
+		return nil, fmt.Errorf("image config digest mismatch: got %s, want %s", got, dgst)
+	}
+
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	rootfs, err := json.Marshal(stor.RootFS{Type: "layers", DiffIDs: []string{diffID.String()}})
+	if err != nil {
+		return nil, err
+	}
+	config["rootfs"] = rootfs
+	delete(config, "history")
+	return json.Marshal(config)
+}
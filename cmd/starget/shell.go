@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+const shellHelp = `Commands:
+  ls [PATH]            List the files of the image, or those under PATH
+  stat PATH            Show where a file lives, its metadata and its type
+  cat PATH...          Write files to stdout
+  get PATH [DEST]      Download a file or directory (default: into the current directory)
+  help                 Show this help
+  exit, quit           Leave the shell (or press Ctrl-D)
+Arguments are split on spaces; quote them with ' or " or escape with \.`
+
+// imageShell is an image opened once for 'starget shell': its index,
+// resolver (with the TOCs it fetched) and downloader serve every command.
+type imageShell struct {
+	cmd        *cobra.Command
+	imageRef   string
+	storage    stor.Storage
+	index      *stargzget.ImageIndex
+	resolver   stargzget.BlobResolver
+	downloader stargzget.Downloader
+}
+
+func newShellCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "shell <REGISTRY>/<IMAGE>:<TAG>",
+		Short: "Explore an image interactively, loading its manifest and TOCs only once",
+		Long: `Open an image and read ls, stat, cat and get commands from stdin, one per
+line, all served from the index loaded at start. Type 'help' for the commands.`,
+		Example: `  starget shell ghcr.io/org/app:v1
+  printf 'stat /etc/os-release\ncat /etc/os-release\n' | starget shell ghcr.io/org/app:v1`,
+		Args: cobra.ExactArgs(1),
+		Run:  runShell,
+	}
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of concurrent workers for get (default: 4, set to 1 for sequential)")
+	return cmd
+}
+
+func runShell(cmd *cobra.Command, args []string) {
+	ctx := commandContext()
+	imageRef := args[0]
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	index, resolver, warnings, err := openIndex(ctx, imageRef, manifest, storage)
+	if err != nil {
+		printIndexError(err)
+		os.Exit(1)
+	}
+	printTOCWarnings(warnings)
+	if skipped := skippedLayers(warnings); len(skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d layer(s) could not be read and their files are missing:\n", len(skipped))
+		printSkippedLayers(skipped)
+	}
+
+	sh := &imageShell{
+		cmd:        cmd,
+		imageRef:   imageRef,
+		storage:    storage,
+		index:      index,
+		resolver:   resolver,
+		downloader: stargzget.NewDownloader(resolver, storage),
+	}
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	if interactive {
+		fmt.Printf("%s (%s): %d files in %d layers. Type 'help' for commands.\n",
+			imageRef, manifest.Digest, len(index.AllFiles()), len(index.Layers))
+	}
+
+	// Commands read from a pipe stop at the first failure, like sh -e;
+	// interactive ones report it and wait for the next line.
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		if interactive {
+			fmt.Print("starget> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		words, err := splitShellWords(scanner.Text())
+		if err == nil && len(words) > 0 {
+			if words[0] == "exit" || words[0] == "quit" {
+				return
+			}
+			err = sh.run(ctx, words)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if !interactive || ctx.Err() != nil {
+				os.Exit(1)
+			}
+		}
+	}
+	if interactive {
+		fmt.Println()
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: reading commands: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run executes one command line, already split into words.
+func (sh *imageShell) run(ctx context.Context, words []string) error {
+	name, args := words[0], words[1:]
+	switch name {
+	case "help":
+		fmt.Println(shellHelp)
+		return nil
+	case "ls":
+		if len(args) > 1 {
+			return errors.New("usage: ls [PATH]")
+		}
+		pattern := "."
+		if len(args) == 1 {
+			pattern = args[0]
+		}
+		return sh.ls(pattern)
+	case "stat":
+		if len(args) != 1 {
+			return errors.New("usage: stat PATH")
+		}
+		return describeFile(ctx, sh.index, sh.resolver, sh.storage, strings.TrimPrefix(args[0], "/"), "")
+	case "cat":
+		if len(args) == 0 {
+			return errors.New("usage: cat PATH...")
+		}
+		for _, p := range args {
+			if err := sh.cat(ctx, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "get":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("usage: get PATH [DEST]")
+		}
+		dest := ""
+		if len(args) == 2 {
+			dest = args[1]
+		}
+		return sh.get(ctx, args[0], dest)
+	default:
+		return fmt.Errorf("unknown command %q; type 'help' for the commands", name)
+	}
+}
+
+func (sh *imageShell) ls(pattern string) error {
+	matched := sh.index.FilterFiles(pattern, "")
+	if len(matched) == 0 {
+		return fmt.Errorf("no files matched %s", pattern)
+	}
+	for _, info := range matched {
+		fmt.Println(info.Path)
+	}
+	return nil
+}
+
+// cat downloads the file at p into a temporary directory, so it is verified
+// like any other download, and copies it to stdout.
+func (sh *imageShell) cat(ctx context.Context, p string) error {
+	link, err := sh.index.FindFile(strings.TrimPrefix(p, "/"), "")
+	if err != nil {
+		return err
+	}
+	source, err := sh.index.ResolveFile(link, "")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp("", "starget-shell-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	job := sh.job(source, filepath.Join(tmp, "file"))
+	if err := sh.download(ctx, []*stargzget.DownloadJob{job}); err != nil {
+		return err
+	}
+	f, err := os.Open(job.OutputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+// get downloads the file or tree at p. A single file goes to dest, or into
+// it when it is a directory; a tree keeps its image paths under dest.
+func (sh *imageShell) get(ctx context.Context, p, dest string) error {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	matched := sh.index.FilterFiles(p, "")
+	if len(matched) == 0 {
+		return fmt.Errorf("no files matched %s", p)
+	}
+	single := len(matched) == 1 && matched[0].Path == p
+	if dest == "" {
+		dest = "."
+	}
+
+	var jobs []*stargzget.DownloadJob
+	for _, info := range matched {
+		source, err := sh.index.ResolveFile(info, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", info.Path, err)
+			continue
+		}
+		rel, _, err := stargzget.PathRewriter(nil).Rewrite(info.Path)
+		if err != nil {
+			return err
+		}
+		output := filepath.Join(dest, rel)
+		if single {
+			output = dest
+			if st, err := os.Stat(dest); err == nil && st.IsDir() {
+				output = filepath.Join(dest, path.Base(info.Path))
+			}
+		}
+		jobs = append(jobs, sh.job(source, output))
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("no regular files to download under %s", p)
+	}
+
+	started := time.Now()
+	if err := sh.download(ctx, jobs); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Downloaded %d file(s) in %s\n", len(jobs), time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+func (sh *imageShell) job(source *stargzget.FileInfo, output string) *stargzget.DownloadJob {
+	return &stargzget.DownloadJob{
+		Path:       source.Path,
+		BlobDigest: source.BlobDigest,
+		Size:       source.Size,
+		OutputPath: output,
+		Mode:       source.Mode,
+		UID:        source.UID,
+		GID:        source.GID,
+		ModTime:    source.ModTime,
+	}
+}
+
+// download runs jobs with the shared downloader and fails if any file did.
+func (sh *imageShell) download(ctx context.Context, jobs []*stargzget.DownloadJob) error {
+	opts := tuningOptions(sh.cmd)
+	stats, err := sh.downloader.StartDownload(ctx, jobs, nil, &opts)
+	if err != nil {
+		return err
+	}
+	printPathIssues(stats)
+	if stats.FailedFiles > 0 {
+		return fmt.Errorf("%d file(s) failed to download", stats.FailedFiles)
+	}
+	return nil
+}
+
+// splitShellWords splits line into words at unquoted whitespace. Single
+// quotes keep everything literally, double quotes keep everything but
+// backslash escapes, and a backslash outside quotes escapes the next
+// character.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
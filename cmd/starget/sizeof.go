@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+func newSizeofCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "sizeof <REGISTRY>/<IMAGE>:<TAG> [BLOB] <PATTERN>",
+		Short: "Show file count and total size of matching files using only the TOCs",
+		Args:  cobra.RangeArgs(2, 3),
+		Run:   runSizeof,
+	}
+}
+
+func runSizeof(cmd *cobra.Command, args []string) {
+	imageRef := args[0]
+	var blobDigest string
+	pattern := args[1]
+	if len(args) == 3 {
+		blobDigest = args[1]
+		pattern = args[2]
+	}
+	if pattern == "*" {
+		pattern = "."
+	}
+
+	ctx := commandContext()
+
+	_, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	resolver := stargzget.NewBlobResolver(storage, resolverOptions()...)
+	loader := stargzget.NewBlobIndexLoader(storage, resolver, loaderOptions()...)
+
+	var dgst digest.Digest
+	if blobDigest != "" {
+		dgst, err = digest.Parse(blobDigest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing digest: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	index, err := loader.Load(ctx)
+	if err != nil {
+		printIndexError(err)
+		os.Exit(1)
+	}
+
+	files := index.FilterFiles(pattern, dgst)
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "No files matched pattern: %s\n", pattern)
+		os.Exit(1)
+	}
+
+	estimate, err := stargzget.EstimateSize(ctx, resolver, files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Files:        %d\n", estimate.Files)
+	fmt.Printf("Uncompressed: %s (%d bytes)\n", formatBytes(estimate.UncompressedBytes), estimate.UncompressedBytes)
+	fmt.Printf("Compressed:   ~%s (%d bytes, estimated)\n", formatBytes(estimate.CompressedBytes), estimate.CompressedBytes)
+}
+
+// formatBytes renders n with a binary unit suffix.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
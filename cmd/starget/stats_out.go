@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+// processStart is when the run began, for the summary's wall time.
+var processStart = time.Now()
+
+// runSummary is what --stats-out writes when a download ends, for
+// harvesting into dashboards from CI runs.
+type runSummary struct {
+	Image          string         `json:"image"`
+	Error          string         `json:"error,omitempty"`
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	CPUSeconds     float64        `json:"cpu_seconds"`
+	Files          fileSummary    `json:"files"`
+	Bytes          byteSummary    `json:"bytes"`
+	Requests       map[string]int `json:"requests_by_status"` // "error" counts requests that got no response
+	Retries        int            `json:"retries"`
+	RetryReasons   map[string]int `json:"retry_reasons"`
+	Cache          cacheSummary   `json:"cache"`
+	Blobs          []blobSummary  `json:"blobs"`
+}
+
+type fileSummary struct {
+	Total      int `json:"total"`
+	Downloaded int `json:"downloaded"`
+	Failed     int `json:"failed"`
+	Blocked    int `json:"blocked"`
+}
+
+type byteSummary struct {
+	Total       int64 `json:"total"`
+	Downloaded  int64 `json:"downloaded"`
+	Transferred int64 `json:"transferred"` // Compressed bytes read from storage
+}
+
+type cacheSummary struct {
+	Chunks          int     `json:"chunks"`
+	MemberCacheHits int     `json:"member_cache_hits"`
+	MemberHitRatio  float64 `json:"member_cache_hit_ratio"`
+	ResumedChunks   int     `json:"resumed_chunks"`   // Chunks retries kept instead of fetching again
+	ChunkCacheHits  int     `json:"chunk_cache_hits"` // Chunks served from --chunk-cache
+}
+
+type blobSummary struct {
+	Digest          string  `json:"digest"`
+	Files           int     `json:"files"`
+	Bytes           int64   `json:"bytes"`
+	Transferred     int64   `json:"transferred_bytes"`
+	Requests        int     `json:"requests"`
+	Retries         int     `json:"retries"`
+	LatencySeconds  float64 `json:"latency_seconds"`
+	TransferSeconds float64 `json:"transfer_seconds"`
+}
+
+// newRunSummary gathers stats, the process's registry requests and its
+// resource usage. stats may be nil when the download did not start.
+func newRunSummary(image string, stats *stargzget.DownloadStats, err error) *runSummary {
+	summary := &runSummary{
+		Image:          image,
+		ElapsedSeconds: time.Since(processStart).Seconds(),
+		CPUSeconds:     cpuSeconds(),
+		Requests:       make(map[string]int),
+		RetryReasons:   make(map[string]int),
+		Blobs:          []blobSummary{},
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	for status, n := range stor.RequestCounts() {
+		key := strconv.Itoa(status)
+		if status == 0 {
+			key = "error"
+		}
+		summary.Requests[key] = n
+	}
+	if stats == nil {
+		return summary
+	}
+
+	summary.Files = fileSummary{Total: stats.TotalFiles, Downloaded: stats.DownloadedFiles, Failed: stats.FailedFiles, Blocked: stats.BlockedFiles}
+	summary.Bytes = byteSummary{Total: stats.TotalBytes, Downloaded: stats.DownloadedBytes}
+	summary.Retries = stats.Retries
+	for reason, n := range stats.RetryReasons {
+		summary.RetryReasons[reason] = n
+	}
+	summary.Cache = cacheSummary{Chunks: stats.Chunks, MemberCacheHits: stats.MemberCacheHits, ResumedChunks: stats.ResumedChunks, ChunkCacheHits: stats.ChunkCacheHits}
+	if stats.Chunks > 0 {
+		summary.Cache.MemberHitRatio = float64(stats.MemberCacheHits) / float64(stats.Chunks)
+	}
+	for _, b := range stats.Blobs {
+		summary.Bytes.Transferred += b.TransferredBytes
+		summary.Blobs = append(summary.Blobs, blobSummary{
+			Digest:          b.BlobDigest.String(),
+			Files:           b.Files,
+			Bytes:           b.Bytes,
+			Transferred:     b.TransferredBytes,
+			Requests:        b.Requests,
+			Retries:         b.Retries,
+			LatencySeconds:  b.Latency.Seconds(),
+			TransferSeconds: b.TransferTime.Seconds(),
+		})
+	}
+	return summary
+}
+
+// writeStatsOut writes the run summary to path: Prometheus text format
+// when path ends in .prom, JSON otherwise.
+func writeStatsOut(path string, summary *runSummary) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(path) == ".prom" {
+		err = summary.writePrometheus(f)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(summary)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writePrometheus writes the summary in the Prometheus text exposition
+// format, e.g. for node_exporter's textfile collector.
+func (s *runSummary) writePrometheus(w io.Writer) error {
+	var b strings.Builder
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP starget_%s %s\n# TYPE starget_%s %s\n", name, help, name, typ)
+	}
+	sample := func(name, labels string, value any) {
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(&b, "starget_%s%s %v\n", name, labels, value)
+	}
+
+	metric("elapsed_seconds", "gauge", "Wall time of the run.")
+	sample("elapsed_seconds", "", s.ElapsedSeconds)
+	metric("cpu_seconds", "gauge", "CPU time used by the run.")
+	sample("cpu_seconds", "", s.CPUSeconds)
+	metric("success", "gauge", "1 if the download finished without error.")
+	sample("success", "", boolValue(s.Error == ""))
+
+	metric("files", "gauge", "Files by outcome.")
+	sample("files", `state="total"`, s.Files.Total)
+	sample("files", `state="downloaded"`, s.Files.Downloaded)
+	sample("files", `state="failed"`, s.Files.Failed)
+	sample("files", `state="blocked"`, s.Files.Blocked)
+	metric("bytes", "gauge", "Uncompressed bytes planned and downloaded, and compressed bytes transferred.")
+	sample("bytes", `kind="total"`, s.Bytes.Total)
+	sample("bytes", `kind="downloaded"`, s.Bytes.Downloaded)
+	sample("bytes", `kind="transferred"`, s.Bytes.Transferred)
+
+	metric("requests_total", "counter", "Registry requests by HTTP status code.")
+	for _, code := range sortedKeys(s.Requests) {
+		sample("requests_total", fmt.Sprintf("code=%q", code), s.Requests[code])
+	}
+	metric("retries_total", "counter", "File retries by reason.")
+	for _, reason := range sortedKeys(s.RetryReasons) {
+		sample("retries_total", fmt.Sprintf("reason=%q", reason), s.RetryReasons[reason])
+	}
+
+	metric("chunks_total", "counter", "Chunks decoded and written.")
+	sample("chunks_total", "", s.Cache.Chunks)
+	metric("member_cache_hits_total", "counter", "Chunks served from a gzip member already decoded.")
+	sample("member_cache_hits_total", "", s.Cache.MemberCacheHits)
+	metric("resumed_chunks_total", "counter", "Chunks a retry kept from an earlier attempt instead of fetching again.")
+	sample("resumed_chunks_total", "", s.Cache.ResumedChunks)
+	metric("chunk_cache_hits_total", "counter", "Chunks served from the chunk cache instead of the registry.")
+	sample("chunk_cache_hits_total", "", s.Cache.ChunkCacheHits)
+
+	metric("blob_transferred_bytes", "gauge", "Compressed bytes read per blob.")
+	for _, blob := range s.Blobs {
+		sample("blob_transferred_bytes", fmt.Sprintf("blob=%q", blob.Digest), blob.Transferred)
+	}
+	metric("blob_requests_total", "counter", "Range requests per blob.")
+	for _, blob := range s.Blobs {
+		sample("blob_requests_total", fmt.Sprintf("blob=%q", blob.Digest), blob.Requests)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func boolValue(ok bool) int {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
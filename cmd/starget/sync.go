@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+var (
+	syncWatch    bool
+	syncInterval time.Duration
+)
+
+// syncRepairDelay is how long --watch waits after a local change before
+// repairing, so a burst of edits costs one sync.
+const syncRepairDelay = 2 * time.Second
+
+func newSyncCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync <REGISTRY>/<IMAGE>:<TAG> <DIR>",
+		Short: "Keep a directory in step with an image, downloading only changed files",
+		Example: `  starget sync ghcr.io/org/config:prod /etc/app
+  starget sync ghcr.io/org/config:prod /etc/app --watch --interval 5m`,
+		Args: cobra.ExactArgs(2),
+		Run:  runSync,
+	}
+	cmd.Flags().BoolVar(&syncWatch, "watch", false, "Keep running: re-resolve the tag every --interval and repair local changes to synced files as they happen")
+	cmd.Flags().DurationVar(&syncInterval, "interval", 5*time.Minute, "How often --watch re-resolves the tag")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "Number of concurrent workers (default: 4, set to 1 for sequential)")
+	return cmd
+}
+
+func runSync(cmd *cobra.Command, args []string) {
+	imageRef, dir := args[0], args[1]
+	if syncWatch && syncInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --interval must be positive\n")
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := syncOnce(cmd, imageRef, dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if !syncWatch {
+			os.Exit(1)
+		}
+	}
+	if syncWatch {
+		if err := watchSync(cmd, imageRef, dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// syncOnce brings dir up to date with imageRef. When the tag still points at
+// the manifest of the last sync and no synced file changed locally, only
+// the manifest is fetched.
+func syncOnce(cmd *cobra.Command, imageRef, dir string) error {
+	ctx := commandContext()
+	previous, err := stargzget.ReadSyncState(dir)
+	if err != nil {
+		return err
+	}
+	manifest, storage, err := openImage(ctx, imageRef)
+	if err != nil {
+		return err
+	}
+	drifted := previous.Drifted(dir)
+	if previous.Image == imageRef && previous.ManifestDigest == manifest.Digest && len(drifted) == 0 {
+		if !syncWatch {
+			fmt.Printf("%s is up to date with %s (%s)\n", dir, imageRef, manifest.Digest)
+		}
+		return nil
+	}
+
+	index, resolver, warnings, err := openIndex(ctx, imageRef, manifest, storage)
+	if err != nil {
+		return err
+	}
+	printTOCWarnings(warnings)
+	// A layer missing from the index would look like its files were
+	// deleted from the image.
+	if skipped := skippedLayers(warnings); len(skipped) > 0 {
+		printSkippedLayers(skipped)
+		return fmt.Errorf("%d layer(s) could not be read; not syncing, so their files are not removed", len(skipped))
+	}
+
+	plan, err := stargzget.PlanSync(ctx, index, resolver, dir, previous)
+	if err != nil {
+		return err
+	}
+	if len(plan.Download)+len(plan.Symlinks)+len(plan.Remove) == 0 && previous.ManifestDigest == manifest.Digest {
+		return nil
+	}
+
+	opts := tuningOptions(cmd)
+	started := time.Now()
+	state, stats, applyErr := plan.Apply(ctx, stargzget.NewDownloader(resolver, storage), imageRef, &opts)
+	if err := state.Write(dir); err != nil {
+		return fmt.Errorf("saving sync state: %w", err)
+	}
+	var bytes int64
+	if stats != nil {
+		printPathIssues(stats)
+		bytes = stats.DownloadedBytes
+	}
+	reason := "updated to"
+	if previous.ManifestDigest == manifest.Digest {
+		reason = fmt.Sprintf("repaired %d local change(s) against", len(drifted))
+	}
+	fmt.Printf("%s %s %s (%s): %d file(s) written (%d bytes), %d symlink(s), %d deleted, %d unchanged in %s\n",
+		time.Now().Format(time.RFC3339), reason, imageRef, manifest.Digest,
+		len(plan.Download), bytes, len(plan.Symlinks), plan.Deleted, plan.Unchanged, time.Since(started).Round(time.Millisecond))
+	return applyErr
+}
+
+// watchSync re-syncs dir every --interval, and soon after a synced file is
+// changed or deleted locally. Errors are reported and the next round tries
+// again.
+func watchSync(cmd *cobra.Command, imageRef, dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	watchDirs(watcher, dir)
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	var repair <-chan time.Time
+	run := func() {
+		if err := syncOnce(cmd, imageRef, dir); err != nil {
+			fmt.Fprintf(os.Stderr, "%s Error: %v\n", time.Now().Format(time.RFC3339), err)
+		}
+		watchDirs(watcher, dir) // Directories the sync created
+	}
+	for {
+		select {
+		case <-commandContext().Done():
+			return context.Cause(commandContext())
+		case <-ticker.C:
+			run()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if strings.HasPrefix(filepath.Base(event.Name), stargzget.SyncStateFile) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					watchDirs(watcher, event.Name)
+				}
+			}
+			repair = time.After(syncRepairDelay)
+		case <-repair:
+			repair = nil
+			// Events from the sync's own writes end up here too; they
+			// leave nothing drifted, so nothing is fetched for them.
+			state, err := stargzget.ReadSyncState(dir)
+			if err != nil || len(state.Drifted(dir)) > 0 {
+				run()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "Warning: watching %s: %v\n", dir, err)
+		}
+	}
+}
+
+// watchDirs adds root and every directory below it to watcher, which does
+// not watch recursively by itself.
+func watchDirs(watcher *fsnotify.Watcher, root string) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: watching %s: %v\n", path, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,11 @@
+// Package faultinject wraps a storage.Storage with injected faults (5xx
+// responses, slow reads, truncated bodies and corrupt gzip data) for
+// testing the retry, backoff and verification paths without an unreliable
+// network. Faults are chosen by hashing each request with a seed, so a run
+// injects the same faults however its requests are scheduled.
+//
+// It is only built with the faultinject build tag, so release binaries
+// carry none of it:
+//
+//	go build -tags faultinject ./cmd/starget
+package faultinject
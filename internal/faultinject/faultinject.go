@@ -0,0 +1,192 @@
+//go:build faultinject
+
+package faultinject
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// Config sets how often each fault is injected into ReadBlob calls. At most
+// one of ErrorRate, TruncateRate and CorruptRate applies to a request, so
+// they must not add up to more than 1; SlowRate applies independently.
+type Config struct {
+	Seed         int64         // Chooses which requests fail; the same seed injects the same faults
+	ErrorRate    float64       // Fraction of reads failing with 503 Service Unavailable
+	TruncateRate float64       // Fraction of bodies ending early with io.ErrUnexpectedEOF
+	CorruptRate  float64       // Fraction of bodies whose first byte is flipped, breaking the gzip header
+	SlowRate     float64       // Fraction of reads delayed by SlowDelay before the body is returned
+	SlowDelay    time.Duration // Delay of slow reads (default 200ms)
+}
+
+// Validate checks that the rates are usable.
+func (c Config) Validate() error {
+	for _, rate := range []float64{c.ErrorRate, c.TruncateRate, c.CorruptRate, c.SlowRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("fault rate %v is outside [0, 1]", rate)
+		}
+	}
+	if c.ErrorRate+c.TruncateRate+c.CorruptRate > 1 {
+		return fmt.Errorf("error, truncate and corrupt rates add up to more than 1")
+	}
+	return nil
+}
+
+// Counts tallies the faults a Storage injected.
+type Counts struct {
+	Reads     int // ReadBlob calls
+	Errors    int
+	Truncated int
+	Corrupted int
+	Slow      int
+}
+
+// Storage is a stor.Storage that injects faults into reads of another.
+type Storage struct {
+	inner stor.Storage
+	cfg   Config
+
+	mu       sync.Mutex
+	attempts map[string]uint64 // Times each request has been made, so retries draw anew
+	counts   Counts
+}
+
+// Wrap returns inner with faults injected as cfg describes.
+func Wrap(inner stor.Storage, cfg Config) (*Storage, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.SlowDelay <= 0 {
+		cfg.SlowDelay = 200 * time.Millisecond
+	}
+	return &Storage{inner: inner, cfg: cfg, attempts: make(map[string]uint64)}, nil
+}
+
+// Counts returns the faults injected so far.
+func (s *Storage) Counts() Counts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts
+}
+
+// ListBlobs lists the blobs of the wrapped storage, without faults.
+func (s *Storage) ListBlobs(ctx context.Context) ([]stor.BlobDescriptor, error) {
+	return s.inner.ListBlobs(ctx)
+}
+
+// BlobSize passes through to the wrapped storage when it can look sizes
+// up.
+func (s *Storage) BlobSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	sizer, ok := s.inner.(stor.BlobSizer)
+	if !ok {
+		return 0, fmt.Errorf("storage cannot look up blob sizes")
+	}
+	return sizer.BlobSize(ctx, dgst)
+}
+
+// ReadBlob reads from the wrapped storage, injecting the fault drawn for
+// this request.
+func (s *Storage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	key := fmt.Sprintf("%s@%d+%d", dgst, offset, length)
+	s.mu.Lock()
+	attempt := s.attempts[key]
+	s.attempts[key]++
+	s.counts.Reads++
+	s.mu.Unlock()
+
+	if s.draw(key, attempt, "slow") < s.cfg.SlowRate {
+		s.count(func(c *Counts) { c.Slow++ })
+		select {
+		case <-time.After(s.cfg.SlowDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	fault := s.draw(key, attempt, "fault")
+	if fault < s.cfg.ErrorRate {
+		s.count(func(c *Counts) { c.Errors++ })
+		return nil, &stargzerrors.HTTPStatusError{Op: "injected fault", StatusCode: http.StatusServiceUnavailable}
+	}
+	body, err := s.inner.ReadBlob(ctx, dgst, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	switch fault -= s.cfg.ErrorRate; {
+	case fault < s.cfg.TruncateRate:
+		s.count(func(c *Counts) { c.Truncated++ })
+		limit := int64(4096)
+		if length > 0 {
+			limit = length / 2
+		}
+		return &truncatedBody{ReadCloser: body, remaining: limit}, nil
+	case fault < s.cfg.TruncateRate+s.cfg.CorruptRate:
+		s.count(func(c *Counts) { c.Corrupted++ })
+		return &corruptBody{ReadCloser: body}, nil
+	}
+	return body, nil
+}
+
+func (s *Storage) count(update func(*Counts)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&s.counts)
+}
+
+// draw returns a number in [0, 1) determined by the seed, the request, how
+// often it was made before and what the draw is for.
+func (s *Storage) draw(key string, attempt uint64, purpose string) float64 {
+	h := fnv.New64a()
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(s.cfg.Seed))
+	binary.LittleEndian.PutUint64(buf[8:], attempt)
+	h.Write(buf[:])
+	io.WriteString(h, key)
+	io.WriteString(h, purpose)
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// truncatedBody ends with io.ErrUnexpectedEOF after remaining bytes, like a
+// connection dropped mid-response.
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// corruptBody flips the bits of the first byte, which for a read at a gzip
+// member start breaks the magic number.
+type corruptBody struct {
+	io.ReadCloser
+	done bool
+}
+
+func (b *corruptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.done {
+		p[0] ^= 0xff
+		b.done = true
+	}
+	return n, err
+}
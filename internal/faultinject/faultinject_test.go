@@ -0,0 +1,74 @@
+//go:build faultinject
+
+package faultinject
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"testing"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestStorage_InjectsFaultsDeterministically(t *testing.T) {
+	store := storage.NewMockStorage()
+	data := bytes.Repeat([]byte("blob"), 1024)
+	dgst := store.AddBlob("application/octet-stream", data)
+	cfg := Config{Seed: 7, ErrorRate: 0.2, TruncateRate: 0.2, CorruptRate: 0.2}
+
+	run := func() (Counts, []string) {
+		faulty, err := Wrap(store, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outcomes []string
+		for i := 0; i < 200; i++ {
+			offset := int64(i % 8 * 100)
+			body, err := faulty.ReadBlob(context.Background(), dgst, offset, 100)
+			if err != nil {
+				if stargzerrors.Classify(err) != stargzerrors.ClassTransient {
+					t.Fatalf("injected error %v is not transient", err)
+				}
+				outcomes = append(outcomes, "error")
+				continue
+			}
+			got, err := io.ReadAll(body)
+			body.Close()
+			switch {
+			case err == io.ErrUnexpectedEOF && len(got) == 50:
+				outcomes = append(outcomes, "truncated")
+			case err == nil && len(got) == 100 && got[0] != data[offset]:
+				outcomes = append(outcomes, "corrupt")
+			case err == nil && bytes.Equal(got, data[offset:offset+100]):
+				outcomes = append(outcomes, "ok")
+			default:
+				t.Fatalf("read %d: %d bytes, err %v", i, len(got), err)
+			}
+		}
+		return faulty.Counts(), outcomes
+	}
+
+	counts, outcomes := run()
+	if counts.Reads != 200 || counts.Errors == 0 || counts.Truncated == 0 || counts.Corrupted == 0 {
+		t.Fatalf("Counts() = %+v, want every fault injected", counts)
+	}
+	if counts.Errors+counts.Truncated+counts.Corrupted > 160 {
+		t.Errorf("Counts() = %+v, want about 60%% of reads faulty", counts)
+	}
+	again, outcomesAgain := run()
+	if again != counts || !slices.Equal(outcomes, outcomesAgain) {
+		t.Errorf("second run injected %+v, first %+v; want the same faults", again, counts)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	if err := (Config{ErrorRate: 0.6, CorruptRate: 0.6}).Validate(); err == nil {
+		t.Error("Validate() accepted exclusive rates adding up to more than 1")
+	}
+	if err := (Config{SlowRate: 1.5}).Validate(); err == nil {
+		t.Error("Validate() accepted a rate above 1")
+	}
+}
@@ -0,0 +1,327 @@
+package stargzget
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveFormat names the container an ArchiveWriter produces.
+type ArchiveFormat string
+
+const (
+	ArchiveTar ArchiveFormat = "tar"
+	ArchiveZip ArchiveFormat = "zip"
+)
+
+// ParseArchiveFormat parses an --archive-format value.
+func ParseArchiveFormat(s string) (ArchiveFormat, error) {
+	switch f := ArchiveFormat(strings.ToLower(s)); f {
+	case ArchiveTar, ArchiveZip:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown archive format %q (want tar or zip)", s)
+}
+
+// ArchiveFormatForPath returns the archive format implied by the extension
+// of name, if any.
+func ArchiveFormatForPath(name string) (ArchiveFormat, bool) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tar":
+		return ArchiveTar, true
+	case ".zip":
+		return ArchiveZip, true
+	}
+	return "", false
+}
+
+// ArchiveWriter collects downloaded files into one tar or zip stream instead
+// of one file each, which spares the target filesystem hundreds of thousands
+// of inodes for trees of small files. With DownloadOptions.Archive set, each
+// job's OutputPath is its entry name. Files are downloaded into a temporary
+// spool file, appended to the archive once complete and verified, and the
+// spool is removed, so only one spool per worker exists at a time. Entries
+// carry the mode, owner and modification time recorded in the job; tar
+// archives store hard links as link entries, zip archives as copies.
+//
+// Entries are appended in completion order unless SetReproducible was
+// called. The writer is safe for concurrent use; call Close after the
+// download to finish the archive.
+type ArchiveWriter struct {
+	format   ArchiveFormat
+	spoolDir string
+
+	mu           sync.Mutex
+	tw           *tar.Writer
+	zw           *zip.Writer
+	entries      map[string]bool // Names of the files written so far
+	reproducible bool
+	clamp        time.Time      // Latest timestamp stored in reproducible mode; zero for none
+	pending      []pendingEntry // Entries held back until Close in reproducible mode
+}
+
+// pendingEntry is a file, with its spool, or a hard link waiting to be
+// written in reproducible mode.
+type pendingEntry struct {
+	job   *DownloadJob
+	spool string // "" for a hard link
+}
+
+// NewArchiveWriter returns a writer that streams an archive in format to w.
+// spoolDir holds the per-file spools ("" for the system temp directory).
+func NewArchiveWriter(w io.Writer, format ArchiveFormat, spoolDir string) (*ArchiveWriter, error) {
+	a := &ArchiveWriter{format: format, spoolDir: spoolDir, entries: make(map[string]bool)}
+	switch format {
+	case ArchiveTar:
+		a.tw = tar.NewWriter(w)
+	case ArchiveZip:
+		a.zw = zip.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown archive format %q", format)
+	}
+	return a, nil
+}
+
+// Format returns the archive format.
+func (a *ArchiveWriter) Format() ArchiveFormat {
+	return a.format
+}
+
+// SetReproducible makes the archive byte-identical across runs over the
+// same image, for caching and signing. Entries are written by Close in
+// name order, files before hard links, instead of in completion order.
+// Timestamps are stored in UTC whole seconds and, if clamp is not zero
+// (e.g. from SOURCE_DATE_EPOCH), no later than clamp. Completed files stay
+// in their spools until Close, so the spool directory needs room for the
+// whole archive. Call it before the download starts.
+func (a *ArchiveWriter) SetReproducible(clamp time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reproducible = true
+	a.clamp = clamp
+}
+
+// Close writes the entries held back in reproducible mode and the archive
+// trailer. It does not close the underlying writer.
+func (a *ArchiveWriter) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.writePending(); err != nil {
+		return err
+	}
+	if a.tw != nil {
+		return a.tw.Close()
+	}
+	return a.zw.Close()
+}
+
+// writePending writes the held back entries in order and removes their
+// spools.
+func (a *ArchiveWriter) writePending() error {
+	pending := a.pending
+	a.pending = nil
+	defer func() {
+		for _, p := range pending {
+			if p.spool != "" {
+				os.Remove(p.spool)
+			}
+		}
+	}()
+	sort.Slice(pending, func(i, j int) bool {
+		if (pending[i].spool == "") != (pending[j].spool == "") {
+			return pending[i].spool != ""
+		}
+		return archiveEntryName(pending[i].job.OutputPath) < archiveEntryName(pending[j].job.OutputPath)
+	})
+	for _, p := range pending {
+		var err error
+		if p.spool == "" {
+			err = a.writeLink(p.job)
+		} else {
+			err = a.writeSpool(p.job, p.spool)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supportsLinks reports whether hard links can be stored as links.
+func (a *ArchiveWriter) supportsLinks() bool {
+	return a.format == ArchiveTar
+}
+
+// spool creates the temporary file a job is downloaded into.
+func (a *ArchiveWriter) spool() (*os.File, error) {
+	return os.CreateTemp(a.spoolDir, "starget-spool-*")
+}
+
+// archiveEntryName turns an output path into a relative, slash-separated
+// entry name that cannot escape the extraction directory.
+func archiveEntryName(outputPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(outputPath)), "/")
+}
+
+// archiveModTime is the modification time stored for job; the epoch when
+// the TOC recorded none.
+func archiveModTime(job *DownloadJob) time.Time {
+	if job.ModTime.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return job.ModTime
+}
+
+// modTime is the modification time written for job, normalized in
+// reproducible mode.
+func (a *ArchiveWriter) modTime(job *DownloadJob) time.Time {
+	t := archiveModTime(job)
+	if !a.reproducible {
+		return t
+	}
+	if !a.clamp.IsZero() && t.After(a.clamp) {
+		t = a.clamp
+	}
+	return t.UTC().Truncate(time.Second)
+}
+
+// archiveMode is the file mode stored for job; 0644 when the TOC recorded
+// none.
+func archiveMode(job *DownloadJob) os.FileMode {
+	if job.Mode == 0 {
+		return 0o644
+	}
+	return job.Mode
+}
+
+// addFile appends the content spooled at spoolPath as the entry for job. In
+// reproducible mode the entry is held back and the writer takes over the
+// spool, which it reports by returning true; the caller must not remove it.
+func (a *ArchiveWriter) addFile(job *DownloadJob, spoolPath string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries[archiveEntryName(job.OutputPath)] = true
+	if a.reproducible {
+		a.pending = append(a.pending, pendingEntry{job: job, spool: spoolPath})
+		return true, nil
+	}
+	return false, a.writeSpool(job, spoolPath)
+}
+
+// writeSpool writes the entry for job with the content spooled at
+// spoolPath.
+func (a *ArchiveWriter) writeSpool(job *DownloadJob, spoolPath string) error {
+	f, err := os.Open(spoolPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	name := archiveEntryName(job.OutputPath)
+	if a.tw != nil {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     info.Size(),
+			Mode:     unixModeFromFileMode(archiveMode(job)),
+			Uid:      job.UID,
+			Gid:      job.GID,
+			ModTime:  a.modTime(job),
+			Format:   tar.FormatPAX,
+		}
+		if err := a.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.Copy(a.tw, f)
+		return err
+	}
+
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: a.modTime(job)}
+	hdr.SetMode(archiveMode(job))
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// addLink appends a hard link entry from job's output path to job.LinkTo,
+// which must already be in the archive.
+func (a *ArchiveWriter) addLink(job *DownloadJob) error {
+	if !a.supportsLinks() {
+		return fmt.Errorf("%s archives cannot store hard links", a.format)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	target := archiveEntryName(job.LinkTo)
+	if !a.entries[target] {
+		return fmt.Errorf("link target was not extracted: %s", target)
+	}
+	if a.reproducible {
+		a.pending = append(a.pending, pendingEntry{job: job})
+		return nil
+	}
+	return a.writeLink(job)
+}
+
+func (a *ArchiveWriter) writeLink(job *DownloadJob) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeLink,
+		Name:     archiveEntryName(job.OutputPath),
+		Linkname: archiveEntryName(job.LinkTo),
+		Mode:     unixModeFromFileMode(archiveMode(job)),
+		Uid:      job.UID,
+		Gid:      job.GID,
+		ModTime:  a.modTime(job),
+		Format:   tar.FormatPAX,
+	})
+}
+
+// archiveFile appends a downloaded job to the session's archive, if any.
+func (s *downloadSession) archiveFile(jwo *jobWithOffset) error {
+	if s.opts.Archive == nil {
+		return nil
+	}
+	kept, err := s.opts.Archive.addFile(jwo.job, jwo.spoolPath)
+	if kept {
+		jwo.spoolPath = ""
+	}
+	return err
+}
+
+// removeSpool deletes the job's spool file, if any.
+func removeSpool(jwo *jobWithOffset) {
+	if jwo.spoolPath == "" {
+		return
+	}
+	os.Remove(jwo.spoolPath)
+	jwo.spoolPath = ""
+}
+
+// withoutLinks turns hard link jobs into downloads of their own, for
+// archives that cannot store links.
+func withoutLinks(jobs []*DownloadJob) []*DownloadJob {
+	out := make([]*DownloadJob, len(jobs))
+	for i, job := range jobs {
+		if job.LinkTo != "" {
+			copied := *job
+			copied.LinkTo = ""
+			job = &copied
+		}
+		out[i] = job
+	}
+	return out
+}
@@ -0,0 +1,211 @@
+package stargzget
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+// archiveEntry is what a test reads back from an archive.
+type archiveEntry struct {
+	content  string
+	mode     os.FileMode
+	uid      int
+	modTime  time.Time
+	linkname string
+}
+
+func readArchive(t *testing.T, format ArchiveFormat, data []byte) map[string]archiveEntry {
+	t.Helper()
+	entries := map[string]archiveEntry{}
+	if format == ArchiveTar {
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("reading tar: %v", err)
+			}
+			content, _ := io.ReadAll(tr)
+			entries[hdr.Name] = archiveEntry{string(content), hdr.FileInfo().Mode(), hdr.Uid, hdr.ModTime, hdr.Linkname}
+		}
+		return entries
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		entries[f.Name] = archiveEntry{content: string(content), mode: f.Mode(), modTime: f.Modified}
+	}
+	return entries
+}
+
+func TestDownloader_Archive(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(4096)).
+		File("usr/bin/tool", big).
+		File("etc/motd", []byte("hello\n")).
+		MustBuild()
+	store := storage.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, format := range []ArchiveFormat{ArchiveTar, ArchiveZip} {
+		t.Run(string(format), func(t *testing.T) {
+			spool := t.TempDir()
+			var buf bytes.Buffer
+			archive, err := NewArchiveWriter(&buf, format, spool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs := []*DownloadJob{
+				{Path: "usr/bin/tool", BlobDigest: layer.Digest, Size: int64(len(big)), OutputPath: "usr/bin/tool", Mode: 0o755 | os.ModeSetuid, UID: 1000, ModTime: mtime},
+				{Path: "etc/motd", BlobDigest: layer.Digest, Size: 6, OutputPath: "/etc/motd", Mode: 0o644, ModTime: mtime},
+				{Path: "usr/bin/tool", BlobDigest: layer.Digest, Size: int64(len(big)), OutputPath: "usr/bin/alias", Mode: 0o755 | os.ModeSetuid, UID: 1000, LinkTo: "usr/bin/tool"},
+			}
+			opts := &DownloadOptions{Archive: archive, SingleFileChunkThreshold: 1, Ownership: &OwnershipOptions{RecordPath: "unused"}}
+			stats, err := NewDownloader(NewBlobResolver(store), store).StartDownload(context.Background(), jobs, nil, opts)
+			if err != nil {
+				t.Fatalf("StartDownload() error = %v", err)
+			}
+			if err := archive.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if stats.DownloadedFiles != 3 || stats.FailedFiles != 0 {
+				t.Fatalf("stats = %+v, want 3 files downloaded", stats)
+			}
+			if left, _ := os.ReadDir(spool); len(left) != 0 {
+				t.Errorf("spool directory holds %d files after the download, want none", len(left))
+			}
+
+			entries := readArchive(t, format, buf.Bytes())
+			if len(entries) != 3 {
+				t.Fatalf("archive entries = %v, want 3", entries)
+			}
+			tool := entries["usr/bin/tool"]
+			if tool.content != string(big) || tool.mode.Perm() != 0o755 || tool.mode&os.ModeSetuid == 0 || !tool.modTime.Equal(mtime) {
+				t.Errorf("usr/bin/tool = mode %v, mtime %v, %d bytes; want setuid 0755 at %v", tool.mode, tool.modTime, len(tool.content), mtime)
+			}
+			if entries["etc/motd"].content != "hello\n" {
+				t.Errorf("etc/motd = %q, want the file content under a relative name", entries["etc/motd"].content)
+			}
+			alias := entries["usr/bin/alias"]
+			switch format {
+			case ArchiveTar:
+				if alias.linkname != "usr/bin/tool" || tool.uid != 1000 {
+					t.Errorf("tar alias = %+v, tool uid %d; want a hard link to usr/bin/tool and uid 1000", alias, tool.uid)
+				}
+			case ArchiveZip:
+				if alias.content != string(big) {
+					t.Errorf("zip alias has %d bytes, want a copy of usr/bin/tool", len(alias.content))
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveWriter_Reproducible(t *testing.T) {
+	builder := estargztest.NewBuilder(estargztest.WithChunkSize(512))
+	var names []string
+	for _, name := range []string{"z", "m", "a", "q", "c", "x", "b", "k"} {
+		builder.File("files/"+name, bytes.Repeat([]byte(name), 2000))
+		names = append(names, "files/"+name)
+	}
+	layer := builder.MustBuild()
+	store := storage.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	clamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	later := time.Date(2025, 6, 1, 12, 30, 0, 123, time.FixedZone("CEST", 2*3600))
+
+	for _, format := range []ArchiveFormat{ArchiveTar, ArchiveZip} {
+		t.Run(string(format), func(t *testing.T) {
+			run := func() []byte {
+				var buf bytes.Buffer
+				archive, err := NewArchiveWriter(&buf, format, t.TempDir())
+				if err != nil {
+					t.Fatal(err)
+				}
+				archive.SetReproducible(clamp)
+				var jobs []*DownloadJob
+				for _, name := range names {
+					jobs = append(jobs, &DownloadJob{Path: name, BlobDigest: layer.Digest, Size: 2000, OutputPath: name, ModTime: later})
+				}
+				if format == ArchiveTar {
+					jobs = append(jobs, &DownloadJob{Path: "files/a", BlobDigest: layer.Digest, Size: 2000, OutputPath: "files/0-link", LinkTo: "files/a"})
+				}
+				opts := &DownloadOptions{Archive: archive, Concurrency: 8, SingleFileChunkThreshold: 1}
+				if _, err := NewDownloader(NewBlobResolver(store), store).StartDownload(context.Background(), jobs, nil, opts); err != nil {
+					t.Fatalf("StartDownload() error = %v", err)
+				}
+				if err := archive.Close(); err != nil {
+					t.Fatal(err)
+				}
+				return buf.Bytes()
+			}
+
+			first := run()
+			for i := 0; i < 3; i++ {
+				if !bytes.Equal(run(), first) {
+					t.Fatal("archives of the same download differ")
+				}
+			}
+			entries := readArchive(t, format, first)
+			if got := entries["files/m"]; got.content != strings.Repeat("m", 2000) || !got.modTime.Equal(clamp) {
+				t.Errorf("files/m = %d bytes at %v, want its content at the clamp time", len(got.content), got.modTime)
+			}
+			if format == ArchiveTar {
+				tr := tar.NewReader(bytes.NewReader(first))
+				var order []string
+				for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+					order = append(order, hdr.Name)
+				}
+				want := append(append([]string(nil), names...), "files/0-link")
+				sort.Strings(want[:len(names)])
+				if strings.Join(order, ",") != strings.Join(want, ",") {
+					t.Errorf("entry order = %v, want files by name, then links", order)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveFormatForPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   ArchiveFormat
+		wantOK bool
+	}{
+		{name: "out.tar", want: ArchiveTar, wantOK: true},
+		{name: "dist/OUT.ZIP", want: ArchiveZip, wantOK: true},
+		{name: "out.tar.gz"},
+		{name: "out"},
+	}
+	for _, tt := range tests {
+		got, ok := ArchiveFormatForPath(tt.name)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("ArchiveFormatForPath(%q) = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	if _, err := ParseArchiveFormat("rar"); err == nil {
+		t.Error("ParseArchiveFormat(rar) succeeded")
+	}
+}
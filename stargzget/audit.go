@@ -0,0 +1,118 @@
+package stargzget
+
+import (
+	"context"
+	"fmt"
+
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// AuditStatus says how much of a layer's content can be verified.
+type AuditStatus string
+
+const (
+	// AuditVerifiable layers have a TOC matching the manifest's TOC digest
+	// annotation and a chunk digest for every chunk.
+	AuditVerifiable AuditStatus = "verifiable"
+	// AuditPartial layers carry some verification data, but not enough to
+	// check every byte against the manifest.
+	AuditPartial AuditStatus = "partial"
+	// AuditUnverifiable layers carry no usable verification data, or data
+	// that does not match.
+	AuditUnverifiable AuditStatus = "unverifiable"
+)
+
+// LayerAudit reports the eStargz verification data found for one layer.
+type LayerAudit struct {
+	BlobDigest        digest.Digest
+	Status            AuditStatus
+	Reason            string        // Why the layer is not fully verifiable; empty if it is
+	TOCDigest         digest.Digest // From the layer's TOC digest annotation; empty if absent
+	TOCDigestVerified bool          // The fetched TOC matches TOCDigest
+	Chunks            int           // Content chunks listed in the TOC
+	DigestedChunks    int           // Chunks that carry a chunkDigest
+}
+
+// AuditImage inspects the verification data of every layer in manifest:
+// the TOC digest annotation, checked against the TOC actually stored in the
+// blob, and the per-chunk digests in the TOC. Only footers and TOCs are
+// fetched. Layers whose TOC cannot be read are reported as unverifiable
+// rather than failing the audit.
+func AuditImage(ctx context.Context, storage stor.Storage, manifest *stor.Manifest) ([]*LayerAudit, error) {
+	audits := make([]*LayerAudit, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		dgst, err := digest.Parse(layer.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer digest %q: %w", layer.Digest, err)
+		}
+		audits = append(audits, auditLayer(ctx, storage, dgst, layer))
+	}
+	return audits, nil
+}
+
+func auditLayer(ctx context.Context, storage stor.Storage, dgst digest.Digest, layer stor.Layer) *LayerAudit {
+	audit := &LayerAudit{BlobDigest: dgst, Status: AuditUnverifiable}
+
+	var annotationErr error
+	if v := layer.Annotations[stor.TOCDigestAnnotation]; v != "" {
+		audit.TOCDigest, annotationErr = digest.Parse(v)
+	}
+
+	size := layer.Size
+	if size <= 0 {
+		sizer, ok := storage.(stor.BlobSizer)
+		if !ok {
+			audit.Reason = "blob size unknown"
+			return audit
+		}
+		var err error
+		if size, err = sizer.BlobSize(ctx, dgst); err != nil {
+			audit.Reason = fmt.Sprintf("cannot determine blob size: %v", err)
+			return audit
+		}
+	}
+
+	desc := stor.BlobDescriptor{Digest: dgst, Size: size, MediaType: layer.MediaType, Annotations: layer.Annotations}
+	toc, tocDigest, _, err := readTOC(ctx, storage, desc, nil)
+	if err != nil {
+		audit.Reason = fmt.Sprintf("no readable eStargz TOC: %v", err)
+		return audit
+	}
+
+	for _, entry := range toc.Entries {
+		isChunk := entry.Type == "chunk" || (entry.Type == "reg" && entry.Size > 0)
+		if !isChunk {
+			continue
+		}
+		audit.Chunks++
+		if entry.ChunkDigest != "" {
+			audit.DigestedChunks++
+		}
+	}
+
+	switch {
+	case annotationErr != nil:
+		audit.Reason = fmt.Sprintf("invalid TOC digest annotation: %v", annotationErr)
+		return audit
+	case audit.TOCDigest != "" && audit.TOCDigest != tocDigest:
+		audit.Reason = fmt.Sprintf("TOC digest %s does not match annotation", tocDigest)
+		return audit
+	}
+	audit.TOCDigestVerified = audit.TOCDigest != ""
+
+	allChunks := audit.DigestedChunks == audit.Chunks
+	switch {
+	case audit.TOCDigestVerified && allChunks:
+		audit.Status = AuditVerifiable
+	case !audit.TOCDigestVerified && audit.DigestedChunks == 0:
+		audit.Reason = "no TOC digest annotation and no chunk digests"
+	case !audit.TOCDigestVerified:
+		audit.Status = AuditPartial
+		audit.Reason = "no TOC digest annotation, so the chunk digests cannot be trusted"
+	default:
+		audit.Status = AuditPartial
+		audit.Reason = fmt.Sprintf("%d of %d chunks have no chunk digest", audit.Chunks-audit.DigestedChunks, audit.Chunks)
+	}
+	return audit
+}
@@ -0,0 +1,112 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestAuditImage(t *testing.T) {
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(64)).
+		File("etc/hosts", []byte("127.0.0.1 localhost\n")).
+		File("usr/lib/big", bytes.Repeat([]byte("x"), 300)).
+		Dir("var/empty").
+		MustBuild()
+
+	store := stor.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	plain := gzipCompress(t, []byte("not an estargz blob"))
+	plainDigest := store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", plain)
+
+	tests := []struct {
+		name       string
+		layer      stor.Layer
+		wantStatus AuditStatus
+		wantTOC    bool
+	}{
+		{
+			name:       "annotated",
+			layer:      stor.Layer{Digest: layer.Digest.String(), Size: int64(len(layer.Blob)), Annotations: map[string]string{stor.TOCDigestAnnotation: layer.TOCDigest.String()}},
+			wantStatus: AuditVerifiable,
+			wantTOC:    true,
+		},
+		{
+			name:       "no annotation",
+			layer:      stor.Layer{Digest: layer.Digest.String(), Size: int64(len(layer.Blob))},
+			wantStatus: AuditPartial,
+		},
+		{
+			name:       "wrong annotation",
+			layer:      stor.Layer{Digest: layer.Digest.String(), Size: int64(len(layer.Blob)), Annotations: map[string]string{stor.TOCDigestAnnotation: digest.FromString("other").String()}},
+			wantStatus: AuditUnverifiable,
+		},
+		{
+			name:       "not estargz",
+			layer:      stor.Layer{Digest: plainDigest.String(), Size: int64(len(plain))},
+			wantStatus: AuditUnverifiable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audits, err := AuditImage(context.Background(), store, &stor.Manifest{Layers: []stor.Layer{tt.layer}})
+			if err != nil {
+				t.Fatalf("AuditImage() error = %v", err)
+			}
+			audit := audits[0]
+			if audit.Status != tt.wantStatus {
+				t.Fatalf("Status = %s (%s), want %s", audit.Status, audit.Reason, tt.wantStatus)
+			}
+			if audit.TOCDigestVerified != tt.wantTOC {
+				t.Fatalf("TOCDigestVerified = %v, want %v", audit.TOCDigestVerified, tt.wantTOC)
+			}
+			if (audit.Reason == "") != (tt.wantStatus == AuditVerifiable) {
+				t.Fatalf("Reason = %q for status %s", audit.Reason, audit.Status)
+			}
+			if tt.name != "not estargz" && (audit.Chunks != 6 || audit.DigestedChunks != 6) {
+				t.Fatalf("chunks = %d/%d, want 6/6", audit.DigestedChunks, audit.Chunks)
+			}
+		})
+	}
+}
+
+func TestSHA512Layer(t *testing.T) {
+	content := bytes.Repeat([]byte("sha512"), 100)
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(256), estargztest.WithDigestAlgorithm(digest.SHA512)).
+		File("etc/hosts", []byte("127.0.0.1 localhost\n")).
+		File("usr/lib/big", content).
+		MustBuild()
+	store := stor.NewMockStorage()
+	if got := store.AddBlobWithAlgorithm("application/vnd.oci.image.layer.v1.tar+gzip", digest.SHA512, layer.Blob); got != layer.Digest {
+		t.Fatalf("blob digest = %s, want %s", got, layer.Digest)
+	}
+
+	manifest := &stor.Manifest{Layers: []stor.Layer{{
+		Digest:      layer.Digest.String(),
+		Size:        int64(len(layer.Blob)),
+		Annotations: map[string]string{stor.TOCDigestAnnotation: layer.TOCDigest.String()},
+	}}}
+	audits, err := AuditImage(context.Background(), store, manifest)
+	if err != nil {
+		t.Fatalf("AuditImage() error = %v", err)
+	}
+	if audit := audits[0]; audit.Status != AuditVerifiable || !audit.TOCDigestVerified {
+		t.Fatalf("audit = %s (%s), want a verified sha512 TOC digest", audit.Status, audit.Reason)
+	}
+
+	var log bytes.Buffer
+	jobs := []*DownloadJob{{Path: "usr/lib/big", BlobDigest: layer.Digest, Size: int64(len(content)), OutputPath: filepath.Join(t.TempDir(), "big")}}
+	opts := &DownloadOptions{Provenance: &ProvenanceOptions{Writer: &log}}
+	if _, err := NewDownloader(NewBlobResolver(store), store).StartDownload(context.Background(), jobs, nil, opts); err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	rec := readProvenance(t, log.Bytes())[0]
+	if want := digest.SHA512.FromBytes(content).String(); rec.ContentDigest != want || rec.Verification != VerificationVerified {
+		t.Errorf("provenance = content %s, %s; want %s verified", rec.ContentDigest, rec.Verification, want)
+	}
+}
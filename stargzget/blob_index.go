@@ -3,9 +3,15 @@ package stargzget
 import (
 	"context"
 	"fmt"
+	"os"
+	pathpkg "path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
 	"github.com/flaneur2020/stargz-get/stargzget/logger"
 	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
 	"github.com/opencontainers/go-digest"
@@ -14,13 +20,42 @@ import (
 type BlobIndexLoader struct {
 	storage  stor.Storage
 	resolver BlobResolver
+	strict   bool
+
+	mu       sync.Mutex
+	warnings []Warning
+}
+
+// BlobIndexLoaderOption configures a BlobIndexLoader.
+type BlobIndexLoaderOption func(*BlobIndexLoader)
+
+// WithStrictTOC makes Load fail with ErrUnknownTOCEntryType when a TOC has
+// entries of types this version does not know, so CI can catch a change of
+// format early. By default such entries are left out of the index and
+// reported as a WarningUnknownTOCEntries.
+func WithStrictTOC() BlobIndexLoaderOption {
+	return func(l *BlobIndexLoader) {
+		l.strict = true
+	}
 }
 
-func NewBlobIndexLoader(storage stor.Storage, resolver BlobResolver) *BlobIndexLoader {
-	return &BlobIndexLoader{
+func NewBlobIndexLoader(storage stor.Storage, resolver BlobResolver, opts ...BlobIndexLoaderOption) *BlobIndexLoader {
+	l := &BlobIndexLoader{
 		storage:  storage,
 		resolver: resolver,
 	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Warnings returns the non-fatal problems met by the most recent Load, such
+// as layers skipped because their TOC could not be read.
+func (l *BlobIndexLoader) Warnings() []Warning {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Warning(nil), l.warnings...)
 }
 
 func (l *BlobIndexLoader) Load(ctx context.Context) (*ImageIndex, error) {
@@ -33,69 +68,372 @@ func (l *BlobIndexLoader) Load(ctx context.Context) (*ImageIndex, error) {
 		return nil, err
 	}
 
-	index := &ImageIndex{
-		Layers: make([]*LayerInfo, 0, len(blobs)),
-		files:  make(map[string]*FileInfo),
-	}
+	index := newImageIndex(len(blobs))
+
+	var warnings []Warning
+	defer func() {
+		l.mu.Lock()
+		l.warnings = warnings
+		l.mu.Unlock()
+	}()
 
+	var probes []LayerProbe
 	for _, blob := range blobs {
 		toc, err := l.resolver.TOC(ctx, blob.Digest)
 		if err != nil {
+			if probe, ok := layerProbeFor(blob, err); ok {
+				probes = append(probes, probe)
+			}
+			kind := WarningLayerSkipped
+			if stargzerrors.IsAuthFailure(err) {
+				kind = WarningLayerUnauthorized
+			}
 			logger.Warn("Skipping blob %s: %v", blob.Digest.String(), err)
+			warnings = append(warnings, Warning{Kind: kind, BlobDigest: blob.Digest, Err: err})
 			continue
 		}
+		if unknown := unknownEntryTypes(toc); unknown != "" {
+			if l.strict {
+				return nil, stargzerrors.ErrUnknownTOCEntryType.WithDetail("blobDigest", blob.Digest.String()).WithDetail("types", unknown)
+			}
+			logger.Warn("Ignoring TOC entries of unknown types in blob %s: %s", blob.Digest, unknown)
+			warnings = append(warnings, Warning{Kind: WarningUnknownTOCEntries, BlobDigest: blob.Digest, Err: fmt.Errorf("ignored TOC entries of unknown types: %s", unknown)})
+		}
+		if err := checkTOCSize(toc, blob.UncompressedSize); err != nil {
+			logger.Warn("Blob %s: %v", blob.Digest, err)
+			warnings = append(warnings, Warning{Kind: WarningTOCSizeMismatch, BlobDigest: blob.Digest, Err: err})
+		}
+
+		index.addLayer(blob.Digest, toc)
+	}
+
+	// Only fail outright when every layer was probed and none is eStargz;
+	// layers skipped for other reasons (e.g. access denied) could still be.
+	if len(probes) == len(blobs) {
+		return nil, notStargzImageError(probes)
+	}
+
+	return index, nil
+}
+
+func newImageIndex(layers int) *ImageIndex {
+	return &ImageIndex{
+		Layers: make([]*LayerInfo, 0, layers),
+		files:  make(map[string]*FileInfo),
+	}
+}
+
+// LayerTOC is the TOC of one layer blob, for building an index from TOCs
+// stored elsewhere.
+type LayerTOC struct {
+	BlobDigest digest.Digest
+	TOC        *estargzutil.JTOC
+}
+
+// NewImageIndexFromTOCs builds the index of the image manifestDigest from
+// its layers' TOCs, bottom layer first, just as BlobIndexLoader would.
+func NewImageIndexFromTOCs(manifestDigest digest.Digest, layers []LayerTOC) *ImageIndex {
+	idx := newImageIndex(len(layers))
+	idx.ManifestDigest = manifestDigest
+	for _, layer := range layers {
+		idx.addLayer(layer.BlobDigest, layer.TOC)
+	}
+	return idx
+}
 
-		layerInfo := &LayerInfo{
-			BlobDigest: blob.Digest,
-			Files:      make([]string, 0, len(toc.Entries)),
-			FileSizes:  make(map[string]int64),
+// addLayer adds the layer blobDigest with the given TOC on top of the
+// layers already in the index.
+func (idx *ImageIndex) addLayer(blobDigest digest.Digest, toc *estargzutil.JTOC) {
+	layerInfo := &LayerInfo{
+		BlobDigest:  blobDigest,
+		Files:       make([]string, 0, len(toc.Entries)),
+		FileSizes:   make(map[string]int64),
+		Prioritized: toc.PrioritizedFiles(),
+		entries:     make(map[string]*FileInfo),
+		toc:         toc,
+	}
+
+	// A layer's whiteouts hide what the layers below it put there, not its
+	// own entries, so they are applied before those are added.
+	hidden, opaque := layerWhiteouts(toc.Entries)
+	hideWhitedOut(idx.files, hidden, opaque)
+
+	for _, entry := range toc.Entries {
+		if entry == nil || !indexedEntryTypes[entry.Type] {
+			continue
 		}
 
-		for _, entry := range toc.Entries {
-			if entry.Type != "reg" {
-				continue
-			}
+		info := &FileInfo{
+			Path:       entry.Name,
+			BlobDigest: blobDigest,
+			Size:       entry.Size,
+			Mode:       fileModeFromTOC(entry.Mode),
+			UID:        entry.UID,
+			GID:        entry.GID,
+			Type:       entry.Type,
+			LinkName:   entry.LinkName,
+			ModTime:    modTimeFromTOC(entry.ModTime3339),
+		}
+		layerInfo.Files = append(layerInfo.Files, entry.Name)
+		layerInfo.FileSizes[entry.Name] = entry.Size
+		layerInfo.entries[entry.Name] = info
+		if _, _, ok := parseWhiteout(entry.Name); !ok {
+			idx.files[entry.Name] = info
+		}
+	}
 
-			layerInfo.Files = append(layerInfo.Files, entry.Name)
-			layerInfo.FileSizes[entry.Name] = entry.Size
-			index.files[entry.Name] = &FileInfo{
-				Path:       entry.Name,
-				BlobDigest: blob.Digest,
-				Size:       entry.Size,
-			}
+	idx.Layers = append(idx.Layers, layerInfo)
+}
+
+// indexedEntryTypes are the TOC entry types kept in the index. Directories
+// are implied by file paths; links and special files are kept so that
+// requests for them can be resolved or rejected with a clear error.
+var indexedEntryTypes = map[string]bool{
+	"reg":      true,
+	"symlink":  true,
+	"hardlink": true,
+	"char":     true,
+	"block":    true,
+	"fifo":     true,
+}
+
+// knownEntryTypes are the TOC entry types of the eStargz format.
+var knownEntryTypes = map[string]bool{
+	"dir":      true,
+	"reg":      true,
+	"chunk":    true,
+	"symlink":  true,
+	"hardlink": true,
+	"char":     true,
+	"block":    true,
+	"fifo":     true,
+}
+
+// unknownEntryTypes describes the entries of toc whose type is not in
+// knownEntryTypes, e.g. `"sparse" (2), "xattr" (1)`, or returns "" if
+// there are none.
+func unknownEntryTypes(toc *estargzutil.JTOC) string {
+	counts := make(map[string]int)
+	for _, entry := range toc.Entries {
+		if entry != nil && !knownEntryTypes[entry.Type] {
+			counts[entry.Type]++
 		}
+	}
+	types := make([]string, 0, len(counts))
+	for typ := range counts {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for i, typ := range types {
+		types[i] = fmt.Sprintf("%q (%d)", typ, counts[typ])
+	}
+	return strings.Join(types, ", ")
+}
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = ".wh..wh..opq"
+)
 
-		index.Layers = append(index.Layers, layerInfo)
+// parseWhiteout reports whether name is an OCI whiteout marker. For
+// "dir/.wh.name" it returns "dir/name", the path hidden along with anything
+// below it; for "dir/.wh..wh..opq" it returns "dir" with opaque set, meaning
+// everything lower layers put in dir is hidden.
+func parseWhiteout(name string) (target string, opaque bool, ok bool) {
+	dir, base := pathpkg.Split(strings.TrimSuffix(name, "/"))
+	if !strings.HasPrefix(base, whiteoutPrefix) {
+		return "", false, false
 	}
+	if base == whiteoutOpaqueDir {
+		return strings.TrimSuffix(dir, "/"), true, true
+	}
+	return dir + strings.TrimPrefix(base, whiteoutPrefix), false, true
+}
 
-	return index, nil
+// layerWhiteouts collects the paths a layer's whiteout markers hide and the
+// directories it makes opaque.
+func layerWhiteouts(entries []*estargzutil.TOCEntry) (hidden, opaque map[string]bool) {
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		target, isOpaque, ok := parseWhiteout(entry.Name)
+		if !ok {
+			continue
+		}
+		if hidden == nil {
+			hidden, opaque = make(map[string]bool), make(map[string]bool)
+		}
+		if isOpaque {
+			opaque[target] = true
+		} else {
+			hidden[target] = true
+		}
+	}
+	return hidden, opaque
 }
 
+// hideWhitedOut removes from the merged view the files that hidden or
+// opaque cover: a hidden path and its subtree, and everything below an
+// opaque directory (but not the directory itself).
+func hideWhitedOut(files map[string]*FileInfo, hidden, opaque map[string]bool) {
+	if len(hidden) == 0 && len(opaque) == 0 {
+		return
+	}
+	for path := range files {
+		if whitedOut(path, hidden, opaque) {
+			delete(files, path)
+		}
+	}
+}
+
+// whitedOut reports whether path is hidden, or lies below a hidden path or
+// an opaque directory ("" for the root).
+func whitedOut(path string, hidden, opaque map[string]bool) bool {
+	if hidden[path] {
+		return true
+	}
+	for dir := path; dir != ""; {
+		dir = pathpkg.Dir(dir)
+		if dir == "." || dir == "/" {
+			dir = ""
+		}
+		if opaque[dir] || dir != "" && hidden[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSymlinkDepth bounds symlink resolution, matching Linux's MAXSYMLINKS.
+const maxSymlinkDepth = 40
+
 type FileInfo struct {
 	Path       string
 	BlobDigest digest.Digest
 	Size       int64
+	Mode       os.FileMode // Permission and special bits from the TOC
+	UID        int
+	GID        int
+	Type       string    // TOC entry type: reg, symlink, hardlink, char, block or fifo
+	LinkName   string    // Symlink or hard link target as recorded in the TOC
+	ModTime    time.Time // Modification time from the TOC; zero if not recorded
+}
+
+// IsRegular reports whether the entry is a regular file. Entries built
+// without a type are regular files.
+func (f *FileInfo) IsRegular() bool {
+	return f.Type == "" || f.Type == "reg"
+}
+
+// IsSymlink reports whether the entry is a symbolic link.
+func (f *FileInfo) IsSymlink() bool {
+	return f.Type == "symlink"
+}
+
+// IsHardlink reports whether the entry is a hard link to an earlier entry of
+// the same layer.
+func (f *FileInfo) IsHardlink() bool {
+	return f.Type == "hardlink"
+}
+
+// HardlinkTarget returns the image path of the entry a hard link refers to.
+// Unlike symlink targets, hard link names are always relative to the root.
+func (f *FileInfo) HardlinkTarget() string {
+	return strings.TrimPrefix(pathpkg.Clean("/"+f.LinkName), "/")
 }
 
 type LayerInfo struct {
-	BlobDigest digest.Digest
-	Files      []string
-	FileSizes  map[string]int64
+	BlobDigest  digest.Digest
+	Files       []string
+	FileSizes   map[string]int64
+	Prioritized []string // Files the builder placed before the prefetch landmark, in TOC order
+	entries     map[string]*FileInfo
+	toc         *estargzutil.JTOC // TOC the layer was indexed from; nil for hand-built layers
 }
 
+// TOC returns the TOC the layer was indexed from, or nil for layers built
+// by hand.
+func (l *LayerInfo) TOC() *estargzutil.JTOC {
+	return l.toc
+}
+
+// entry returns the file metadata recorded for path in this layer.
+func (l *LayerInfo) entry(path string) (*FileInfo, bool) {
+	if info, ok := l.entries[path]; ok {
+		return info, true
+	}
+	size, ok := l.FileSizes[path]
+	if !ok {
+		return nil, false
+	}
+	return &FileInfo{Path: path, BlobDigest: l.BlobDigest, Size: size}, true
+}
+
+// ImageIndex is the merged file view of an image's layers. Lookups may run
+// from many goroutines at once; SetFileOrder must not run alongside them.
 type ImageIndex struct {
-	Layers []*LayerInfo
-	files  map[string]*FileInfo
+	Layers         []*LayerInfo
+	ManifestDigest digest.Digest // Digest of the manifest the index was built for; empty if unknown
+	files          map[string]*FileInfo
+	order          FileOrder
+}
+
+// FileOrder is the order in which AllFiles and FilterFiles return files.
+type FileOrder int
+
+const (
+	// OrderByPath sorts files by path, so listings, progress logs and job
+	// lists come out the same from run to run. It is the default.
+	OrderByPath FileOrder = iota
+	// OrderByLayer lists files layer by layer, bottom first, each in TOC
+	// order, which is the order of their offsets in the blob.
+	OrderByLayer
+	// Unordered skips sorting for callers that do not need an order. The
+	// merged view then comes out in map order, which changes between runs.
+	Unordered
+)
+
+// SetFileOrder sets the order of the files AllFiles and FilterFiles return.
+func (idx *ImageIndex) SetFileOrder(order FileOrder) {
+	idx.order = order
 }
 
 func (idx *ImageIndex) AllFiles() []string {
+	if idx.order == OrderByLayer {
+		var paths []string
+		idx.eachFileByLayer(func(info *FileInfo) {
+			paths = append(paths, info.Path)
+		})
+		return paths
+	}
+
 	paths := make([]string, 0, len(idx.files))
 	for path := range idx.files {
 		paths = append(paths, path)
 	}
+	if idx.order == OrderByPath {
+		sort.Strings(paths)
+	}
 	return paths
 }
 
+// eachFileByLayer calls fn for each file of the merged view, layer by layer
+// from the bottom and in TOC order within a layer.
+func (idx *ImageIndex) eachFileByLayer(fn func(*FileInfo)) {
+	seen := make(map[string]bool, len(idx.files))
+	for _, layer := range idx.Layers {
+		for _, path := range layer.Files {
+			info, ok := idx.files[path]
+			if !ok || info.BlobDigest != layer.BlobDigest || seen[path] {
+				continue
+			}
+			seen[path] = true
+			fn(info)
+		}
+	}
+}
+
 func (idx *ImageIndex) FindFile(path string, blobDigest digest.Digest) (*FileInfo, error) {
 	if blobDigest.String() == "" {
 		info, ok := idx.files[path]
@@ -107,12 +445,8 @@ func (idx *ImageIndex) FindFile(path string, blobDigest digest.Digest) (*FileInf
 
 	for _, layer := range idx.Layers {
 		if layer.BlobDigest == blobDigest {
-			if size, ok := layer.FileSizes[path]; ok {
-				return &FileInfo{
-					Path:       path,
-					BlobDigest: blobDigest,
-					Size:       size,
-				}, nil
+			if info, ok := layer.entry(path); ok {
+				return info, nil
 			}
 			return nil, stargzerrors.ErrFileNotFound.WithDetail("path", path).WithDetail("blobDigest", blobDigest.String())
 		}
@@ -120,16 +454,156 @@ func (idx *ImageIndex) FindFile(path string, blobDigest digest.Digest) (*FileInf
 	return nil, stargzerrors.ErrBlobNotFound.WithDetail("blobDigest", blobDigest.String())
 }
 
+// ResolvePath looks up path like FindFile and follows symlinks until it
+// reaches a regular file. Relative link targets are resolved against the
+// link's directory and absolute ones against the image root. It fails with
+// ErrUnresolvedSymlink when a link is dangling, loops, or climbs above the
+// image root, and with ErrNotRegularFile when the final entry is a device,
+// FIFO or other special file.
+func (idx *ImageIndex) ResolvePath(path string, blobDigest digest.Digest) (*FileInfo, error) {
+	info, err := idx.FindFile(path, blobDigest)
+	if err != nil {
+		return nil, err
+	}
+	return idx.ResolveFile(info, blobDigest)
+}
+
+// ResolveFile follows info to a regular file as ResolvePath does. Symlink
+// targets are looked up in the same scope: one layer, or the merged image
+// when blobDigest is empty. Hard links are followed within their own layer.
+func (idx *ImageIndex) ResolveFile(info *FileInfo, blobDigest digest.Digest) (*FileInfo, error) {
+	origin := info.Path
+	for depth := 0; info.IsSymlink() || info.IsHardlink(); depth++ {
+		if depth >= maxSymlinkDepth {
+			return nil, stargzerrors.ErrUnresolvedSymlink.WithDetail("path", origin).WithDetail("reason", "too many levels of symbolic links")
+		}
+
+		if info.IsHardlink() {
+			// Hard links always refer to an entry of their own layer.
+			layer := info.BlobDigest
+			if layer == "" {
+				layer = blobDigest
+			}
+			next, err := idx.FindFile(info.HardlinkTarget(), layer)
+			if err != nil {
+				return nil, stargzerrors.ErrUnresolvedSymlink.WithDetail("path", origin).WithDetail("target", info.LinkName).WithDetail("reason", "hard link target does not exist")
+			}
+			info = next
+			continue
+		}
+
+		target, ok := symlinkTarget(info.Path, info.LinkName)
+		if !ok {
+			return nil, stargzerrors.ErrUnresolvedSymlink.WithDetail("path", origin).WithDetail("target", info.LinkName).WithDetail("reason", "target is outside the image")
+		}
+		next, err := idx.FindFile(target, blobDigest)
+		if err != nil {
+			return nil, stargzerrors.ErrUnresolvedSymlink.WithDetail("path", origin).WithDetail("target", info.LinkName).WithDetail("reason", "target does not exist")
+		}
+		info = next
+	}
+
+	if !info.IsRegular() {
+		return nil, stargzerrors.ErrNotRegularFile.WithDetail("path", origin).WithDetail("type", info.Type)
+	}
+	return info, nil
+}
+
+// FollowPath resolves the symlinks among the components of path, the way
+// the kernel would inside the image, and returns the path they lead to
+// along with the links followed, in order. Unlike ResolvePath it also
+// follows links to directories, so "usr/lib/python3/os.py" can lead to
+// "usr/lib/python3.11/os.py"; a final hard link is left for ResolveFile.
+// Components missing from the index are kept as they are, since
+// directories are only implied by the files below them. Links are looked
+// up in the same scope as FindFile.
+func (idx *ImageIndex) FollowPath(path string, blobDigest digest.Digest) (string, []*FileInfo, error) {
+	var (
+		links    []*FileInfo
+		resolved string
+		rest     = splitPath(path)
+	)
+	for len(rest) > 0 {
+		candidate := pathpkg.Join(resolved, rest[0])
+		rest = rest[1:]
+		if candidate == "." || candidate == ".." || strings.HasPrefix(candidate, "../") {
+			// ".." at the root stays there.
+			resolved = ""
+			continue
+		}
+
+		info, err := idx.FindFile(candidate, blobDigest)
+		if err != nil && stargzerrors.GetErrorCode(err) != stargzerrors.ErrFileNotFound.Code {
+			return "", nil, err
+		}
+		if err != nil || !info.IsSymlink() {
+			resolved = candidate
+			continue
+		}
+
+		if len(links) >= maxSymlinkDepth {
+			return "", nil, stargzerrors.ErrUnresolvedSymlink.WithDetail("path", path).WithDetail("reason", "too many levels of symbolic links")
+		}
+		target, ok := symlinkTarget(candidate, info.LinkName)
+		if !ok {
+			return "", nil, stargzerrors.ErrUnresolvedSymlink.WithDetail("path", path).WithDetail("target", info.LinkName).WithDetail("reason", "target is outside the image")
+		}
+		links = append(links, info)
+		// The target is a clean path from the root; walk it again so links
+		// within it are followed too.
+		resolved = ""
+		rest = append(splitPath(target), rest...)
+	}
+	return resolved, links, nil
+}
+
+// splitPath splits an image path into its non-empty components.
+func splitPath(path string) []string {
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// symlinkTarget returns the image path a link at linkPath points to. ok is
+// false when a relative target climbs above the image root.
+func symlinkTarget(linkPath, linkName string) (string, bool) {
+	if strings.HasPrefix(linkName, "/") {
+		// Absolute targets are relative to the image root; ".." cannot escape it.
+		return strings.TrimPrefix(pathpkg.Clean(linkName), "/"), true
+	}
+
+	target := pathpkg.Clean(pathpkg.Join(pathpkg.Dir(linkPath), linkName))
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return "", false
+	}
+	return target, true
+}
+
 func (idx *ImageIndex) FilterFiles(pathPattern string, blobDigest digest.Digest) []*FileInfo {
 	matcher := newPathMatcher(pathPattern)
 	var results []*FileInfo
 
 	if blobDigest == "" {
+		if idx.order == OrderByLayer {
+			idx.eachFileByLayer(func(info *FileInfo) {
+				if matcher.matches(info.Path) {
+					results = append(results, info)
+				}
+			})
+			return results
+		}
 		for _, info := range idx.files {
 			if matcher.matches(info.Path) {
 				results = append(results, info)
 			}
 		}
+		if idx.order == OrderByPath {
+			sortFilesByPath(results)
+		}
 		return results
 	}
 
@@ -138,18 +612,25 @@ func (idx *ImageIndex) FilterFiles(pathPattern string, blobDigest digest.Digest)
 			continue
 		}
 		for _, filePath := range layer.Files {
-			if matcher.matches(filePath) {
-				results = append(results, &FileInfo{
-					Path:       filePath,
-					BlobDigest: layer.BlobDigest,
-					Size:       layer.FileSizes[filePath],
-				})
+			if !matcher.matches(filePath) {
+				continue
+			}
+			if info, ok := layer.entry(filePath); ok {
+				results = append(results, info)
 			}
 		}
 	}
+	// A single layer's files are already in TOC order.
+	if idx.order == OrderByPath {
+		sortFilesByPath(results)
+	}
 	return results
 }
 
+func sortFilesByPath(files []*FileInfo) {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+}
+
 type pathMatcher struct {
 	matchAll  bool
 	pattern   string
@@ -194,3 +675,48 @@ func validateBlobDescriptors(blobs []stor.BlobDescriptor) error {
 	}
 	return nil
 }
+
+// fileModeFromTOC converts unix mode bits recorded in a TOC entry into an
+// os.FileMode carrying the permission, setuid, setgid and sticky bits.
+func fileModeFromTOC(mode int64) os.FileMode {
+	fm := os.FileMode(mode) & os.ModePerm
+	if mode&0o4000 != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		fm |= os.ModeSticky
+	}
+	return fm
+}
+
+// unixModeFromFileMode is the inverse of fileModeFromTOC: the permission
+// bits with setuid, setgid and sticky at their octal positions.
+func unixModeFromFileMode(fm os.FileMode) int64 {
+	mode := int64(fm.Perm())
+	if fm&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if fm&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if fm&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return mode
+}
+
+// modTimeFromTOC parses a TOC modtime. Missing or malformed values yield the
+// zero time.
+func modTimeFromTOC(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -2,17 +2,27 @@ package stargzget
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
 	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
 	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
 	"github.com/opencontainers/go-digest"
 )
 
 type stubBlobResolver struct {
-	toc *estargzutil.JTOC
+	toc     *estargzutil.JTOC
+	tocErrs map[digest.Digest]error
 }
 
 func (s *stubBlobResolver) FileMetadata(ctx context.Context, blobDigest digest.Digest, path string) (*FileMetadata, error) {
@@ -23,7 +33,14 @@ func (s *stubBlobResolver) ReadChunk(ctx context.Context, blobDigest digest.Dige
 	return nil, nil
 }
 
+func (s *stubBlobResolver) FileChunks(ctx context.Context, blobDigest digest.Digest, path string) ([]ChunkSpan, error) {
+	return nil, nil
+}
+
 func (s *stubBlobResolver) TOC(ctx context.Context, blobDigest digest.Digest) (*estargzutil.JTOC, error) {
+	if err, ok := s.tocErrs[blobDigest]; ok {
+		return nil, err
+	}
 	return s.toc, nil
 }
 
@@ -76,3 +93,479 @@ func TestBlobIndexLoader_Load(t *testing.T) {
 		t.Fatalf("AllFiles len = %d, want 2", len(all))
 	}
 }
+
+func TestBlobIndexLoader_ModTime(t *testing.T) {
+	dgst := digest.FromString("blob")
+	toc := &estargzutil.JTOC{
+		Entries: []*estargzutil.TOCEntry{
+			{Name: "bin/bash", Type: "reg", Size: 5, ModTime3339: "2024-05-01T12:00:00Z"},
+			{Name: "lib/libc.so", Type: "reg", Size: 3},
+			{Name: "etc/bad", Type: "reg", Size: 1, ModTime3339: "yesterday"},
+		},
+	}
+	storage := &stubIndexStorage{
+		blobs: []stor.BlobDescriptor{{Digest: dgst, Size: 9}},
+	}
+
+	index, err := NewBlobIndexLoader(storage, &stubBlobResolver{toc: toc}).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	for path, want := range map[string]time.Time{
+		"bin/bash":    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		"lib/libc.so": {},
+		"etc/bad":     {},
+	} {
+		info, err := index.FindFile(path, dgst)
+		if err != nil {
+			t.Fatalf("FindFile(%s) error = %v", path, err)
+		}
+		if !info.ModTime.Equal(want) {
+			t.Errorf("%s: ModTime = %v, want %v", path, info.ModTime, want)
+		}
+	}
+}
+
+func TestBlobIndexLoader_WarningsForSkippedLayers(t *testing.T) {
+	good := digest.FromString("good")
+	bad := digest.FromString("bad")
+	toc := &estargzutil.JTOC{
+		Entries: []*estargzutil.TOCEntry{{Name: "bin/bash", Type: "reg", Size: 5}},
+	}
+
+	storage := &stubIndexStorage{
+		blobs: []stor.BlobDescriptor{{Digest: bad, Size: 8}, {Digest: good, Size: 8}},
+	}
+	resolver := &stubBlobResolver{
+		toc:     toc,
+		tocErrs: map[digest.Digest]error{bad: errors.New("not an estargz blob")},
+	}
+
+	loader := NewBlobIndexLoader(storage, resolver)
+	index, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(index.Layers) != 1 {
+		t.Fatalf("Layers len = %d, want 1", len(index.Layers))
+	}
+
+	warnings := loader.Warnings()
+	if len(warnings) != 1 {
+		t.Fatalf("Warnings len = %d, want 1", len(warnings))
+	}
+	if warnings[0].Kind != WarningLayerSkipped || warnings[0].BlobDigest != bad {
+		t.Fatalf("Warnings[0] = %+v, want layer-skipped for %s", warnings[0], bad)
+	}
+}
+
+func TestBlobIndexLoader_UnknownEntryTypes(t *testing.T) {
+	dgst := digest.FromString("blob")
+	toc := &estargzutil.JTOC{
+		Entries: []*estargzutil.TOCEntry{
+			{Name: "bin/bash", Type: "reg", Size: 5},
+			{Name: "bin/sparse", Type: "sparse", Size: 5},
+			{Name: "bin/other", Type: "sparse", Size: 5},
+			{Name: "etc/attrs", Type: "xattr"},
+		},
+	}
+	storage := &stubIndexStorage{blobs: []stor.BlobDescriptor{{Digest: dgst, Size: 8}}}
+	resolver := &stubBlobResolver{toc: toc}
+
+	loader := NewBlobIndexLoader(storage, resolver)
+	index, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if files := index.AllFiles(); len(files) != 1 || files[0] != "bin/bash" {
+		t.Fatalf("AllFiles() = %v, want only bin/bash", files)
+	}
+	warnings := loader.Warnings()
+	if len(warnings) != 1 || warnings[0].Kind != WarningUnknownTOCEntries {
+		t.Fatalf("Warnings() = %v, want one %s", warnings, WarningUnknownTOCEntries)
+	}
+	if want := `"sparse" (2), "xattr" (1)`; !strings.Contains(warnings[0].Err.Error(), want) {
+		t.Errorf("warning = %v, want it to contain %s", warnings[0].Err, want)
+	}
+
+	_, err = NewBlobIndexLoader(storage, resolver, WithStrictTOC()).Load(context.Background())
+	if stargzerrors.GetErrorCode(err) != stargzerrors.ErrUnknownTOCEntryType.Code {
+		t.Fatalf("strict Load() error = %v, want code %s", err, stargzerrors.ErrUnknownTOCEntryType.Code)
+	}
+}
+
+func TestBlobIndexLoader_TOCSizeMismatch(t *testing.T) {
+	layer := estargztest.NewBuilder().File("bin/bash", bytes.Repeat([]byte("a"), 10000)).File("etc/hosts", []byte("localhost\n")).MustBuild()
+	gz, err := gzip.NewReader(bytes.NewReader(layer.Blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := io.Copy(io.Discard, gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		size int64
+		want bool
+	}{
+		{"unknown", 0, false},
+		{"actual", uncompressed, false},
+		{"too small for the TOC", 4096, true},
+		{"far larger than the TOC", 64 << 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := stor.NewMockStorage()
+			mock.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+			storage := &stubIndexStorage{blobs: []stor.BlobDescriptor{{Digest: layer.Digest, Size: int64(len(layer.Blob)), UncompressedSize: tt.size}}}
+			loader := NewBlobIndexLoader(storage, NewBlobResolver(mock))
+			index, err := loader.Load(context.Background())
+			if err != nil || len(index.AllFiles()) != 2 {
+				t.Fatalf("Load() = %v, %v; want the files indexed anyway", index, err)
+			}
+			warnings := loader.Warnings()
+			if got := len(warnings) == 1 && warnings[0].Kind == WarningTOCSizeMismatch; got != tt.want || len(warnings) > 1 {
+				t.Errorf("Warnings() = %v, want a %s: %v", warnings, WarningTOCSizeMismatch, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlobIndexLoader_NotStargzImage(t *testing.T) {
+	const gzipLayer = "application/vnd.oci.image.layer.v1.tar+gzip"
+	storage := stor.NewMockStorage()
+	storage.AddBlob(gzipLayer, gzipCompress(t, bytes.Repeat([]byte("a"), 1024)))
+	storage.AddBlob("application/vnd.docker.image.rootfs.diff.tar.gzip", gzipCompress(t, bytes.Repeat([]byte("b"), 1024)))
+
+	_, err := NewBlobIndexLoader(storage, NewBlobResolver(storage)).Load(context.Background())
+	if stargzerrors.GetErrorCode(err) != stargzerrors.ErrNotStargzImage.Code {
+		t.Fatalf("Load() error = %v, want code %s", err, stargzerrors.ErrNotStargzImage.Code)
+	}
+	probes := LayerProbes(err)
+	if len(probes) != 2 {
+		t.Fatalf("LayerProbes() = %+v, want 2 layers", probes)
+	}
+	for _, p := range probes {
+		if p.Format != LayerFormatGzip || p.Err == nil {
+			t.Errorf("probe = %+v, want gzip with an error", p)
+		}
+	}
+
+	// One eStargz layer is enough to list the image; the others are skipped.
+	storage.AddBlob(gzipLayer, estargztest.NewBuilder().File("bin/sh", []byte("sh")).MustBuild().Blob)
+	loader := NewBlobIndexLoader(storage, NewBlobResolver(storage))
+	index, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() with an eStargz layer error = %v", err)
+	}
+	if len(index.Layers) != 1 || len(loader.Warnings()) != 2 {
+		t.Errorf("Layers = %d, warnings = %v; want 1 layer and 2 skipped", len(index.Layers), loader.Warnings())
+	}
+	if LayerProbes(fmt.Errorf("wrapped: %w", stargzerrors.ErrBlobNotFound)) != nil {
+		t.Errorf("LayerProbes() of another error should be nil")
+	}
+}
+
+func TestBlobIndexLoader_Whiteouts(t *testing.T) {
+	const layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	storage := stor.NewMockStorage()
+	storage.AddBlob(layerType, estargztest.NewBuilder().
+		File("etc/conf", []byte("conf")).
+		File("usr/share/doc/a", []byte("a")).
+		File("usr/share/doc/sub/b", []byte("b")).
+		File("var/cache/x", []byte("x")).
+		File("var/cache/y", []byte("y")).
+		File("opt/app/bin", []byte("bin")).
+		MustBuild().Blob)
+	// Layer 2 empties usr/share/doc and refills it, and deletes a file and
+	// a whole directory.
+	middle := storage.AddBlob(layerType, estargztest.NewBuilder().
+		OpaqueDir("usr/share/doc").
+		File("usr/share/doc/new", []byte("new")).
+		File("usr/share/doc/sub/b", []byte("b again")).
+		Whiteout("var/cache/x").
+		Whiteout("opt/app").
+		File("opt/app2", []byte("app2")).
+		MustBuild().Blob)
+	// Layer 3 re-adds a deleted file and nests an opaque directory inside
+	// the one layer 2 made opaque.
+	storage.AddBlob(layerType, estargztest.NewBuilder().
+		File("var/cache/x", []byte("x again")).
+		OpaqueDir("usr/share/doc/sub").
+		File("usr/share/doc/sub/c", []byte("c")).
+		MustBuild().Blob)
+
+	index, err := NewBlobIndexLoader(storage, NewBlobResolver(storage)).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	got := index.AllFiles()
+	sort.Strings(got)
+	want := []string{"etc/conf", "opt/app2", "usr/share/doc/new", "usr/share/doc/sub/c", "var/cache/x", "var/cache/y"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("AllFiles() = %v, want %v", got, want)
+	}
+	if info, err := index.FindFile("var/cache/x", ""); err != nil || info.Size != int64(len("x again")) {
+		t.Errorf("FindFile(var/cache/x) = %+v, %v; want the re-added file", info, err)
+	}
+	if _, err := index.FindFile("usr/share/doc/sub/b", ""); err == nil {
+		t.Errorf("FindFile(usr/share/doc/sub/b) succeeded, want it hidden by the nested opaque directory")
+	}
+	// The layer itself still lists its markers.
+	if _, err := index.FindFile("var/cache/.wh.x", middle); err != nil {
+		t.Errorf("FindFile(var/cache/.wh.x) in its layer error = %v", err)
+	}
+}
+
+func TestImageIndex_FileOrder(t *testing.T) {
+	const layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	storage := stor.NewMockStorage()
+	bottom := storage.AddBlob(layerType, estargztest.NewBuilder().
+		File("b", []byte("b")).
+		File("a/x", []byte("x")).
+		File("c", []byte("c")).
+		MustBuild().Blob)
+	storage.AddBlob(layerType, estargztest.NewBuilder().
+		File("a/y", []byte("y")).
+		File("b", []byte("b again")).
+		MustBuild().Blob)
+
+	index, err := NewBlobIndexLoader(storage, NewBlobResolver(storage)).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	paths := func(files []*FileInfo) string {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Path)
+		}
+		return strings.Join(names, ",")
+	}
+
+	tests := []struct {
+		order             FileOrder
+		all, layer, under string
+	}{
+		{OrderByPath, "a/x,a/y,b,c", "a/x,b,c", "a/x,a/y"},
+		// b comes from the top layer, so it is listed there.
+		{OrderByLayer, "a/x,c,a/y,b", "b,a/x,c", "a/x,a/y"},
+	}
+	for _, tt := range tests {
+		index.SetFileOrder(tt.order)
+		for i := 0; i < 5; i++ {
+			if got := strings.Join(index.AllFiles(), ","); got != tt.all {
+				t.Fatalf("order %d: AllFiles() = %s, want %s", tt.order, got, tt.all)
+			}
+			if got := paths(index.FilterFiles(".", bottom)); got != tt.layer {
+				t.Fatalf("order %d: FilterFiles(., bottom) = %s, want %s", tt.order, got, tt.layer)
+			}
+			if got := paths(index.FilterFiles("a/", "")); got != tt.under {
+				t.Fatalf("order %d: FilterFiles(a/) = %s, want %s", tt.order, got, tt.under)
+			}
+		}
+	}
+
+	index.SetFileOrder(Unordered)
+	got := index.AllFiles()
+	sort.Strings(got)
+	if strings.Join(got, ",") != "a/x,a/y,b,c" {
+		t.Errorf("Unordered AllFiles() = %v, want the same files", got)
+	}
+}
+
+func TestParseWhiteout(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantTarget string
+		wantOpaque bool
+		wantOK     bool
+	}{
+		{name: "var/cache/.wh.x", wantTarget: "var/cache/x", wantOK: true},
+		{name: ".wh.etc", wantTarget: "etc", wantOK: true},
+		{name: "usr/share/.wh..wh..opq", wantTarget: "usr/share", wantOpaque: true, wantOK: true},
+		{name: ".wh..wh..opq", wantTarget: "", wantOpaque: true, wantOK: true},
+		{name: "etc/.whatever"},
+		{name: "etc/a.wh.b"},
+	}
+	for _, tt := range tests {
+		target, opaque, ok := parseWhiteout(tt.name)
+		if target != tt.wantTarget || opaque != tt.wantOpaque || ok != tt.wantOK {
+			t.Errorf("parseWhiteout(%q) = %q, %v, %v; want %q, %v, %v", tt.name, target, opaque, ok, tt.wantTarget, tt.wantOpaque, tt.wantOK)
+		}
+	}
+}
+
+func TestBlobIndexLoader_WarningsForUnauthorizedLayers(t *testing.T) {
+	good := digest.FromString("good")
+	denied := digest.FromString("denied")
+	broken := digest.FromString("broken")
+	toc := &estargzutil.JTOC{
+		Entries: []*estargzutil.TOCEntry{{Name: "bin/bash", Type: "reg", Size: 5}},
+	}
+
+	storage := &stubIndexStorage{
+		blobs: []stor.BlobDescriptor{{Digest: denied, Size: 8}, {Digest: broken, Size: 8}, {Digest: good, Size: 8}},
+	}
+	resolver := &stubBlobResolver{
+		toc: toc,
+		tocErrs: map[digest.Digest]error{
+			denied: stargzerrors.ErrTOCDownload.WithCause(&stargzerrors.HTTPStatusError{Op: "fetch blob", StatusCode: http.StatusForbidden}),
+			broken: errors.New("not an estargz blob"),
+		},
+	}
+
+	loader := NewBlobIndexLoader(storage, resolver)
+	if _, err := loader.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	kinds := make(map[digest.Digest]WarningKind)
+	for _, w := range loader.Warnings() {
+		kinds[w.BlobDigest] = w.Kind
+	}
+	if kinds[denied] != WarningLayerUnauthorized {
+		t.Errorf("kind for denied layer = %q, want %q", kinds[denied], WarningLayerUnauthorized)
+	}
+	if kinds[broken] != WarningLayerSkipped {
+		t.Errorf("kind for broken layer = %q, want %q", kinds[broken], WarningLayerSkipped)
+	}
+	if len(kinds) != 2 {
+		t.Errorf("warnings = %v, want 2 layers", kinds)
+	}
+}
+
+func TestImageIndex_ResolvePath(t *testing.T) {
+	dgst := digest.FromString("blob")
+	toc := &estargzutil.JTOC{
+		Entries: []*estargzutil.TOCEntry{
+			{Name: "usr/bin/bash", Type: "reg", Size: 5},
+			{Name: "bin/sh", Type: "symlink", LinkName: "/usr/bin/bash"},
+			{Name: "usr/bin/sh", Type: "symlink", LinkName: "bash"},
+			{Name: "usr/local/bin/sh", Type: "symlink", LinkName: "../../bin/sh"},
+			{Name: "usr/bin/rsh", Type: "symlink", LinkName: "/../../usr/bin/sh"},
+			{Name: "etc/escape", Type: "symlink", LinkName: "../../etc/shadow"},
+			{Name: "etc/dangling", Type: "symlink", LinkName: "missing"},
+			{Name: "etc/loop-a", Type: "symlink", LinkName: "loop-b"},
+			{Name: "etc/loop-b", Type: "symlink", LinkName: "loop-a"},
+			{Name: "dev/null", Type: "char"},
+			{Name: "etc/null", Type: "symlink", LinkName: "/dev/null"},
+			{Name: "usr/bin/bash-hl", Type: "hardlink", LinkName: "usr/bin/bash"},
+			{Name: "usr/bin/sh-hl", Type: "hardlink", LinkName: "/usr/bin/sh"},
+			{Name: "etc/gone-hl", Type: "hardlink", LinkName: "etc/gone"},
+		},
+	}
+
+	loader := NewBlobIndexLoader(&stubIndexStorage{blobs: []stor.BlobDescriptor{{Digest: dgst, Size: 8}}}, &stubBlobResolver{toc: toc})
+	index, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		want     string
+		wantCode string
+	}{
+		{path: "usr/bin/bash", want: "usr/bin/bash"},
+		{path: "bin/sh", want: "usr/bin/bash"},
+		{path: "usr/bin/sh", want: "usr/bin/bash"},
+		{path: "usr/local/bin/sh", want: "usr/bin/bash"},
+		{path: "usr/bin/rsh", want: "usr/bin/bash"},
+		{path: "etc/escape", wantCode: "UNRESOLVED_SYMLINK"},
+		{path: "etc/dangling", wantCode: "UNRESOLVED_SYMLINK"},
+		{path: "etc/loop-a", wantCode: "UNRESOLVED_SYMLINK"},
+		{path: "dev/null", wantCode: "NOT_REGULAR_FILE"},
+		{path: "etc/null", wantCode: "NOT_REGULAR_FILE"},
+		{path: "etc/missing", wantCode: "FILE_NOT_FOUND"},
+		{path: "usr/bin/bash-hl", want: "usr/bin/bash"},
+		{path: "usr/bin/sh-hl", want: "usr/bin/bash"},
+		{path: "etc/gone-hl", wantCode: "UNRESOLVED_SYMLINK"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			for _, scope := range []digest.Digest{"", dgst} {
+				info, err := index.ResolvePath(tt.path, scope)
+				if tt.wantCode != "" {
+					if got := stargzerrors.GetErrorCode(err); got != tt.wantCode {
+						t.Fatalf("ResolvePath(%q) error = %v, want code %s", tt.path, err, tt.wantCode)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("ResolvePath(%q) unexpected error: %v", tt.path, err)
+				}
+				if info.Path != tt.want {
+					t.Fatalf("ResolvePath(%q) = %q, want %q", tt.path, info.Path, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestImageIndex_FollowPath(t *testing.T) {
+	dgst := digest.FromString("blob")
+	toc := &estargzutil.JTOC{
+		Entries: []*estargzutil.TOCEntry{
+			{Name: "usr/bin/python3.11", Type: "reg", Size: 5},
+			{Name: "usr/bin/python3", Type: "symlink", LinkName: "python3.11"},
+			{Name: "usr/lib/python3.11/os.py", Type: "reg", Size: 3},
+			{Name: "usr/lib/python3", Type: "symlink", LinkName: "python3.11"},
+			{Name: "lib", Type: "symlink", LinkName: "usr/lib"},
+			{Name: "usr/lib64", Type: "symlink", LinkName: "/lib"},
+			{Name: "etc/escape", Type: "symlink", LinkName: "../../etc"},
+			{Name: "etc/loop-a", Type: "symlink", LinkName: "loop-b"},
+			{Name: "etc/loop-b", Type: "symlink", LinkName: "loop-a"},
+		},
+	}
+
+	loader := NewBlobIndexLoader(&stubIndexStorage{blobs: []stor.BlobDescriptor{{Digest: dgst, Size: 8}}}, &stubBlobResolver{toc: toc})
+	index, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	tests := []struct {
+		path      string
+		want      string
+		wantLinks []string
+		wantCode  string
+	}{
+		{path: "usr/bin/python3.11", want: "usr/bin/python3.11"},
+		{path: "usr/bin/python3", want: "usr/bin/python3.11", wantLinks: []string{"usr/bin/python3"}},
+		{path: "usr/lib/python3/os.py", want: "usr/lib/python3.11/os.py", wantLinks: []string{"usr/lib/python3"}},
+		{path: "/lib/python3/", want: "usr/lib/python3.11", wantLinks: []string{"lib", "usr/lib/python3"}},
+		{path: "usr/lib64/python3", want: "usr/lib/python3.11", wantLinks: []string{"usr/lib64", "lib", "usr/lib/python3"}},
+		{path: "usr/lib/../../../etc/missing", want: "etc/missing"},
+		{path: "etc/escape/passwd", wantCode: "UNRESOLVED_SYMLINK"},
+		{path: "etc/loop-a", wantCode: "UNRESOLVED_SYMLINK"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			for _, scope := range []digest.Digest{"", dgst} {
+				got, links, err := index.FollowPath(tt.path, scope)
+				if tt.wantCode != "" {
+					if code := stargzerrors.GetErrorCode(err); code != tt.wantCode {
+						t.Fatalf("FollowPath(%q) error = %v, want code %s", tt.path, err, tt.wantCode)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("FollowPath(%q) unexpected error: %v", tt.path, err)
+				}
+				var linkPaths []string
+				for _, link := range links {
+					linkPaths = append(linkPaths, link.Path)
+				}
+				if got != tt.want || strings.Join(linkPaths, ",") != strings.Join(tt.wantLinks, ",") {
+					t.Fatalf("FollowPath(%q) = %q via %v, want %q via %v", tt.path, got, linkPaths, tt.want, tt.wantLinks)
+				}
+			}
+		})
+	}
+}
@@ -2,26 +2,41 @@ package stargzget
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 
 	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
 	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
 	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
 	"github.com/opencontainers/go-digest"
 )
 
 // BlobResolver resolves file metadata and chunk contents using Storage.
+// Implementations must be safe for concurrent use; the one NewBlobResolver
+// returns fetches each TOC once however many goroutines ask for it.
 type BlobResolver interface {
 	FileMetadata(ctx context.Context, blobDigest digest.Digest, path string) (*FileMetadata, error)
 	TOC(ctx context.Context, blobDigest digest.Digest) (*estargzutil.JTOC, error)
+	FileChunks(ctx context.Context, blobDigest digest.Digest, path string) ([]ChunkSpan, error)
 }
 
 // FileMetadata describes a file's size and chunk layout.
 type FileMetadata struct {
 	Size   int64
 	Chunks []Chunk
+	Digest string // Content digest the TOC records for the whole file; empty if absent
+
+	// Streamed is set, to the layer's format, for files of layers indexed by
+	// WithTarFallback. They have no chunks and are read by streaming the
+	// whole layer.
+	Streamed LayerFormat
 }
 
 // Chunk represents a logical chunk of file data.
@@ -30,20 +45,134 @@ type Chunk struct {
 	Size             int64
 	CompressedOffset int64
 	InnerOffset      int64
+	Digest           string // chunkDigest of the uncompressed chunk from the TOC; empty if absent
+}
+
+// ChunkSpan locates a chunk of a file in the compressed blob, for consumers
+// such as prefetchers that plan range requests themselves.
+type ChunkSpan struct {
+	Chunk
+
+	// CompressedLength estimates how many compressed bytes from
+	// CompressedOffset hold the chunk: the distance to the next TOC entry's
+	// offset, which spans the whole gzip member even when it is shared with
+	// other chunks. The last member ends where the TOC starts, known when the
+	// TOC was read from the blob; otherwise it is bounded by the footer when
+	// the blob size is known, and 0 if not even that is.
+	CompressedLength int64
+}
+
+// BlobResolverOption configures optional BlobResolver behavior.
+type BlobResolverOption func(*blobResolver)
+
+// WithBlobSizes seeds the resolver with known blob sizes. Blobs with a known
+// size are resolved from their TOC alone, without listing the storage or
+// probing the blob size, which lets embedders that keep their own metadata
+// skip redundant round trips.
+func WithBlobSizes(sizes map[digest.Digest]int64) BlobResolverOption {
+	return func(r *blobResolver) {
+		for dgst, size := range sizes {
+			if size > 0 {
+				r.blobSizes[dgst] = size
+			}
+		}
+	}
+}
+
+// WithTOCCacheDir persists parsed TOCs under dir, keyed by blob digest. A
+// blob's TOC never changes, so later runs against the same layers skip the
+// footer and TOC range requests entirely. Each entry carries a checksum of
+// its contents and the digest the TOC had in its blob; entries that are
+// unreadable, fail the checksum or disagree with the layer's TOC digest
+// annotation are ignored and refetched.
+func WithTOCCacheDir(dir string) BlobResolverOption {
+	return func(r *blobResolver) {
+		r.tocCacheDir = dir
+	}
+}
+
+// WithPrefetchedTOC seeds the resolver with the TOC of blobDigest, so the
+// footer and TOC range requests for that blob are skipped. Embedders that
+// already hold TOCs (e.g. from a metadata service) use it to avoid refetching
+// them; the TOC is trusted as given.
+func WithPrefetchedTOC(blobDigest digest.Digest, toc *estargzutil.JTOC) BlobResolverOption {
+	return func(r *blobResolver) {
+		if toc != nil {
+			r.tocCache[blobDigest] = toc
+		}
+	}
 }
 
-func NewBlobResolver(storage stor.Storage) BlobResolver {
-	return &blobResolver{
-		storage:  storage,
-		tocCache: make(map[digest.Digest]*estargzutil.JTOC),
+// WithTarFallback indexes layers that are plain gzip-compressed or
+// uncompressed tar, which otherwise fail with ErrUnsupportedLayerFormat, so
+// images that mix eStargz and plain layers can be read whole. Such a layer
+// has no TOC to fetch: the whole blob is read once to build one, and the
+// downloader reads it in full again to extract its files. The built TOC is
+// cached like any other, so with WithTOCCacheDir later runs skip the first
+// read.
+func WithTarFallback() BlobResolverOption {
+	return func(r *blobResolver) {
+		r.tarFallback = true
 	}
 }
 
+func NewBlobResolver(storage stor.Storage, opts ...BlobResolverOption) BlobResolver {
+	r := &blobResolver{
+		storage:           storage,
+		blobSizes:         make(map[digest.Digest]int64),
+		uncompressedSizes: make(map[digest.Digest]int64),
+		tocCache:          make(map[digest.Digest]*estargzutil.JTOC),
+		tocOffsets:        make(map[digest.Digest]int64),
+		tocLoads:          make(map[digest.Digest]*tocLoad),
+		entryIndex:        make(map[digest.Digest]map[string][]*estargzutil.TOCEntry),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
 type blobResolver struct {
 	storage   stor.Storage
 	mu        sync.Mutex
+	listed    bool
 	blobSizes map[digest.Digest]int64
 	tocCache  map[digest.Digest]*estargzutil.JTOC
+
+	// tocOffsets holds where the TOCs fetched from their blobs start, which
+	// is where the last file's member ends. TOCs from the cache or given
+	// with WithPrefetchedTOC leave it unknown.
+	tocOffsets map[digest.Digest]int64
+
+	// tocLoads holds the TOC fetches in flight, so goroutines sharing the
+	// resolver wait for one fetch per blob instead of each making their own.
+	tocLoads map[digest.Digest]*tocLoad
+
+	// uncompressedSizes holds the layer sizes recorded in manifest
+	// annotations, which bound the files a TOC may declare.
+	uncompressedSizes map[digest.Digest]int64
+
+	// listedBlobs holds the descriptors from ListBlobs, whose media types
+	// and annotations name the format of blobs without an eStargz footer.
+	listedBlobs map[digest.Digest]stor.BlobDescriptor
+
+	// tocCacheDir, when set, holds TOCs persisted across runs.
+	tocCacheDir string
+
+	// tarFallback indexes plain gzip and tar layers by reading them in full
+	// instead of failing them.
+	tarFallback bool
+
+	// tocProgress, if set, is told how far each TOC fetch has got.
+	tocProgress TOCProgressCallback
+
+	// entryIndex groups TOC entries by name so per-file lookups do not scan
+	// the whole TOC.
+	entryIndex map[digest.Digest]map[string][]*estargzutil.TOCEntry
+
+	// memberOffsets holds the sorted, distinct compressed offsets of each
+	// blob's TOC entries, from which FileChunks estimates member lengths.
+	memberOffsets map[digest.Digest][]int64
 }
 
 func (r *blobResolver) FileMetadata(ctx context.Context, blobDigest digest.Digest, path string) (*FileMetadata, error) {
@@ -52,15 +181,36 @@ func (r *blobResolver) FileMetadata(ctx context.Context, blobDigest digest.Diges
 		return nil, err
 	}
 
-	size, chunks, err := estargzutil.ChunksForFile(toc, path)
+	entries := r.entriesFor(blobDigest, toc, path)
+	size, chunks, err := estargzutil.ChunksForFile(&estargzutil.JTOC{Entries: entries}, path)
 	if err != nil {
 		return nil, err
 	}
 
+	r.mu.Lock()
+	layerSize := r.uncompressedSizes[blobDigest]
+	r.mu.Unlock()
+	if layerSize > 0 && size > layerSize {
+		return nil, stargzerrors.ErrChunkLimit.
+			WithMessage(fmt.Sprintf("TOC declares %s as %d bytes, more than the layer's uncompressed size of %d bytes", path, size, layerSize)).
+			WithDetail("blobDigest", blobDigest.String()).
+			WithDetail("path", path)
+	}
+
 	result := &FileMetadata{
 		Size:   size,
 		Chunks: make([]Chunk, len(chunks)),
 	}
+	for _, entry := range entries {
+		if entry.Type == "reg" {
+			result.Digest = entry.Digest
+		}
+	}
+	if toc.StreamedFormat != "" {
+		result.Streamed = LayerFormat(toc.StreamedFormat)
+		result.Chunks = nil
+		return result, nil
+	}
 
 	for i, ch := range chunks {
 		result.Chunks[i] = Chunk{
@@ -68,82 +218,392 @@ func (r *blobResolver) FileMetadata(ctx context.Context, blobDigest digest.Diges
 			Size:             ch.Size,
 			CompressedOffset: ch.CompressedOffset,
 			InnerOffset:      ch.InnerOffset,
+			Digest:           ch.Digest,
 		}
 	}
 
 	return result, nil
 }
 
-func (r *blobResolver) loadTOC(ctx context.Context, blobDigest digest.Digest) (*estargzutil.JTOC, error) {
+// FileChunks returns the chunks of path with their compressed spans, sorted
+// by uncompressed offset.
+func (r *blobResolver) FileChunks(ctx context.Context, blobDigest digest.Digest, path string) ([]ChunkSpan, error) {
+	meta, err := r.FileMetadata(ctx, blobDigest, path)
+	if err != nil {
+		return nil, err
+	}
+	toc, err := r.loadTOC(ctx, blobDigest)
+	if err != nil {
+		return nil, err
+	}
+	offsets := r.memberOffsetsFor(blobDigest, toc)
+
+	// The last member ends where the TOC starts, or at the latest at the
+	// footer. Only a size already known is used; probing for it is not
+	// worth a request.
+	r.mu.Lock()
+	blobSize := r.blobSizes[blobDigest]
+	tocStart := r.tocOffsets[blobDigest]
+	r.mu.Unlock()
+	if tocStart == 0 && blobSize > int64(estargzutil.FooterSize) {
+		tocStart = blobSize - int64(estargzutil.FooterSize)
+	}
+
+	spans := make([]ChunkSpan, len(meta.Chunks))
+	for i, chunk := range meta.Chunks {
+		spans[i].Chunk = chunk
+		end := tocStart
+		if j := sort.Search(len(offsets), func(j int) bool { return offsets[j] > chunk.CompressedOffset }); j < len(offsets) {
+			end = offsets[j]
+		}
+		if end > chunk.CompressedOffset {
+			spans[i].CompressedLength = end - chunk.CompressedOffset
+		}
+	}
+	return spans, nil
+}
+
+// memberOffsetsFor returns the sorted, distinct offsets of the TOC entries
+// of blobDigest, computing them on first use.
+func (r *blobResolver) memberOffsetsFor(blobDigest digest.Digest, toc *estargzutil.JTOC) []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if offsets, ok := r.memberOffsets[blobDigest]; ok {
+		return offsets
+	}
+	seen := make(map[int64]bool)
+	var offsets []int64
+	for _, entry := range toc.Entries {
+		if entry == nil || entry.Offset <= 0 || seen[entry.Offset] {
+			continue
+		}
+		seen[entry.Offset] = true
+		offsets = append(offsets, entry.Offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	if r.memberOffsets == nil {
+		r.memberOffsets = make(map[digest.Digest][]int64)
+	}
+	r.memberOffsets[blobDigest] = offsets
+	return offsets
+}
+
+// entriesFor returns the TOC entries named path, building the per-blob name
+// index on first use.
+func (r *blobResolver) entriesFor(blobDigest digest.Digest, toc *estargzutil.JTOC, path string) []*estargzutil.TOCEntry {
 	r.mu.Lock()
-	if toc, ok := r.tocCache[blobDigest]; ok {
+	defer r.mu.Unlock()
+
+	if r.entryIndex == nil {
+		r.entryIndex = make(map[digest.Digest]map[string][]*estargzutil.TOCEntry)
+	}
+	byName, ok := r.entryIndex[blobDigest]
+	if !ok {
+		byName = make(map[string][]*estargzutil.TOCEntry)
+		for _, entry := range toc.Entries {
+			if entry == nil {
+				continue
+			}
+			byName[entry.Name] = append(byName[entry.Name], entry)
+		}
+		r.entryIndex[blobDigest] = byName
+	}
+	return byName[path]
+}
+
+// tocLoad is a TOC fetch in flight; err is set when ready is closed.
+type tocLoad struct {
+	ready chan struct{}
+	err   error
+}
+
+// loadTOC returns the TOC of blobDigest, fetching it unless it is cached or
+// another goroutine is fetching it already. A fetch given up because its
+// caller's context ended is made again for waiters whose context has not.
+func (r *blobResolver) loadTOC(ctx context.Context, blobDigest digest.Digest) (*estargzutil.JTOC, error) {
+	for {
+		r.mu.Lock()
+		if toc, ok := r.tocCache[blobDigest]; ok {
+			r.mu.Unlock()
+			return toc, nil
+		}
+		if load, ok := r.tocLoads[blobDigest]; ok {
+			r.mu.Unlock()
+			select {
+			case <-load.ready:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if load.err != nil && !isContextError(load.err) {
+				return nil, load.err
+			}
+			continue
+		}
+		load := &tocLoad{ready: make(chan struct{})}
+		r.tocLoads[blobDigest] = load
+		r.mu.Unlock()
+
+		toc, err := r.fetchTOC(ctx, blobDigest)
+		r.mu.Lock()
+		load.err = err
+		delete(r.tocLoads, blobDigest)
+		r.mu.Unlock()
+		close(load.ready)
+		return toc, err
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// fetchTOC reads the TOC of blobDigest from the TOC cache directory or the
+// blob and caches it in memory.
+func (r *blobResolver) fetchTOC(ctx context.Context, blobDigest digest.Digest) (*estargzutil.JTOC, error) {
+	if toc, ok := r.readCachedTOC(ctx, blobDigest); ok {
+		r.mu.Lock()
+		r.tocCache[blobDigest] = toc
 		r.mu.Unlock()
 		return toc, nil
 	}
-	r.mu.Unlock()
 
-	if err := r.ensureBlobSizes(ctx); err != nil {
+	size, err := r.blobSize(ctx, blobDigest)
+	if err != nil {
 		return nil, err
 	}
 
-	size, ok := r.blobSizes[blobDigest]
-	if !ok {
-		return nil, fmt.Errorf("unknown blob: %s", blobDigest)
+	r.mu.Lock()
+	desc := r.listedBlobs[blobDigest]
+	r.mu.Unlock()
+	desc.Digest, desc.Size = blobDigest, size
+
+	toc, tocDigest, tocOffset, err := readTOC(ctx, r.storage, desc, r.tocProgress)
+	if err != nil {
+		format, ok := streamableFormat(err)
+		if !r.tarFallback || !ok {
+			return nil, err
+		}
+		logger.Info("Layer %s is plain %s; reading it in full to index its files", blobDigest, format)
+		if toc, err = scanLayer(ctx, r.storage, blobDigest, format); err != nil {
+			return nil, err
+		}
 	}
 
+	r.mu.Lock()
+	r.tocCache[blobDigest] = toc
+	if tocOffset > 0 {
+		r.tocOffsets[blobDigest] = tocOffset
+	}
+	r.mu.Unlock()
+
+	r.writeCachedTOC(blobDigest, toc, tocDigest)
+
+	return toc, nil
+}
+
+// readTOC fetches the footer and TOC of the blob desc describes, whose Size
+// must be set, and returns the decoded TOC with the digest of its JSON and
+// the offset the TOC starts at, where the last file's member ends. A
+// blob without an eStargz footer that DetectLayerFormat recognizes fails
+// with ErrUnsupportedLayerFormat. The TOC is fetched in segments; see
+// segmentedReader. progress may be nil.
+func readTOC(ctx context.Context, storage stor.Storage, desc stor.BlobDescriptor, progress TOCProgressCallback) (*estargzutil.JTOC, digest.Digest, int64, error) {
+	blobDigest, size := desc.Digest, desc.Size
 	footerLength := int64(estargzutil.FooterSize)
 	if size < footerLength {
 		footerLength = size
 	}
 
-	footerReader, err := r.storage.ReadBlob(ctx, blobDigest, size-footerLength, footerLength)
+	footerReader, err := storage.ReadBlob(ctx, blobDigest, size-footerLength, footerLength)
 	if err != nil {
-		return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
+		return nil, "", 0, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
 	}
 	footerBytes, err := io.ReadAll(footerReader)
 	footerReader.Close()
 	if err != nil {
-		return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
+		return nil, "", 0, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
 	}
 
 	tocOffset, footerSize, err := estargzutil.ParseFooter(footerBytes)
 	if err != nil {
-		return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
+		if format := DetectLayerFormat(desc, footerBytes); format != LayerFormatUnknown {
+			return nil, "", 0, unsupportedFormatError(desc, format)
+		}
+		return nil, "", 0, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
 	}
 
 	tocStart := tocOffset
-	tocLength := size - tocOffset
+	tocLength := size - footerSize - tocOffset
 	if tocLength <= 0 {
-		return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(fmt.Errorf("invalid TOC length"))
+		return nil, "", 0, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(fmt.Errorf("invalid TOC length"))
 	}
 
-	reader, err := r.storage.ReadBlob(ctx, blobDigest, tocStart, tocLength+footerSize)
+	// Hold the TOC's share of the memory budget until it is decoded.
+	release, err := tocBudget.acquire(ctx, tocLength*tocMemoryFactor)
 	if err != nil {
-		return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
+		return nil, "", 0, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
 	}
+	defer release()
+
+	reader := newSegmentedReader(ctx, storage, blobDigest, tocStart, tocLength, progress)
 	defer reader.Close()
 
-	toc, err := estargzutil.ReadTOC(reader)
+	toc, tocDigest, err := estargzutil.ReadTOCWithDigestAlgorithm(reader, tocDigestAlgorithm(desc))
 	if err != nil {
-		return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
+		return nil, "", 0, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
 	}
 
+	return toc, tocDigest, tocOffset, nil
+}
+
+// tocDigestAlgorithm is the algorithm of desc's TOC digest annotation, so
+// the digest readTOC returns can be compared with it, or sha256 when the
+// annotation is missing or malformed.
+func tocDigestAlgorithm(desc stor.BlobDescriptor) digest.Algorithm {
+	if d, err := digest.Parse(desc.Annotations[stor.TOCDigestAnnotation]); err == nil {
+		return d.Algorithm()
+	}
+	return digest.Canonical
+}
+
+func (r *blobResolver) cachedTOCPath(blobDigest digest.Digest) (string, bool) {
+	if r.tocCacheDir == "" || blobDigest.Validate() != nil {
+		return "", false
+	}
+	return filepath.Join(r.tocCacheDir, "toc", blobDigest.Algorithm().String(), blobDigest.Encoded()+".json"), true
+}
+
+// cachedTOC is the on-disk form of a cached TOC. Sum is the digest of TOC as
+// stored, so a truncated or edited file is detected; TOCDigest is the digest
+// the TOC had in its blob, empty for TOCs built by scanning a plain layer.
+type cachedTOC struct {
+	TOCDigest digest.Digest   `json:"tocDigest,omitempty"`
+	Sum       digest.Digest   `json:"sum"`
+	TOC       json.RawMessage `json:"toc"`
+}
+
+func (r *blobResolver) readCachedTOC(ctx context.Context, blobDigest digest.Digest) (*estargzutil.JTOC, bool) {
+	path, ok := r.cachedTOCPath(blobDigest)
+	if !ok {
+		return nil, false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false
+	}
+	// Cached TOCs are plain JSON; decoding takes about as much again.
+	release, err := tocBudget.acquire(ctx, 2*info.Size())
+	if err != nil {
+		return nil, false
+	}
+	defer release()
+
+	var entry cachedTOC
+	if err := json.NewDecoder(file).Decode(&entry); err != nil {
+		logger.Warn("Ignoring corrupt cached TOC %s: %v", path, err)
+		return nil, false
+	}
+	if entry.Sum.Validate() != nil || entry.Sum.Algorithm().FromBytes(entry.TOC) != entry.Sum {
+		logger.Warn("Ignoring corrupt cached TOC %s: checksum mismatch", path)
+		return nil, false
+	}
 	r.mu.Lock()
-	r.tocCache[blobDigest] = toc
+	want := r.listedBlobs[blobDigest].Annotations[stor.TOCDigestAnnotation]
 	r.mu.Unlock()
+	if want != "" && entry.TOCDigest.String() != want {
+		logger.Warn("Ignoring stale cached TOC %s: TOC digest %s, layer expects %s", path, entry.TOCDigest, want)
+		return nil, false
+	}
 
-	return toc, nil
+	var toc estargzutil.JTOC
+	if err := json.Unmarshal(entry.TOC, &toc); err != nil {
+		logger.Warn("Ignoring corrupt cached TOC %s: %v", path, err)
+		return nil, false
+	}
+	logger.Debug("Loaded TOC for %s from cache", blobDigest)
+	return &toc, true
+}
+
+func (r *blobResolver) writeCachedTOC(blobDigest digest.Digest, toc *estargzutil.JTOC, tocDigest digest.Digest) {
+	path, ok := r.cachedTOCPath(blobDigest)
+	if !ok {
+		return
+	}
+	raw, err := json.Marshal(toc)
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(cachedTOC{TOCDigest: tocDigest, Sum: digest.FromBytes(raw), TOC: raw})
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	if err == nil {
+		// Write then rename so concurrent runs never observe a partial file.
+		tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		logger.Warn("Failed to cache TOC for %s: %v", blobDigest, err)
+	}
 }
 
 func (r *blobResolver) TOC(ctx context.Context, blobDigest digest.Digest) (*estargzutil.JTOC, error) {
 	return r.loadTOC(ctx, blobDigest)
 }
 
+// blobSize returns the size of a blob, preferring seeded sizes, then the
+// storage listing, and finally a size probe for blobs listed without a size.
+func (r *blobResolver) blobSize(ctx context.Context, blobDigest digest.Digest) (int64, error) {
+	r.mu.Lock()
+	size, ok := r.blobSizes[blobDigest]
+	r.mu.Unlock()
+	if ok && size > 0 {
+		return size, nil
+	}
+
+	if err := r.ensureBlobSizes(ctx); err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	size, ok = r.blobSizes[blobDigest]
+	r.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("unknown blob: %s", blobDigest)
+	}
+	if size > 0 {
+		return size, nil
+	}
+
+	sizer, ok := r.storage.(stor.BlobSizer)
+	if !ok {
+		return 0, fmt.Errorf("unknown size for blob: %s", blobDigest)
+	}
+	size, err := sizer.BlobSize(ctx, blobDigest)
+	if err != nil {
+		return 0, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
+	}
+
+	r.mu.Lock()
+	r.blobSizes[blobDigest] = size
+	r.mu.Unlock()
+	return size, nil
+}
+
 func (r *blobResolver) ensureBlobSizes(ctx context.Context) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if r.blobSizes != nil {
+	if r.listed {
 		return nil
 	}
 
@@ -152,9 +612,25 @@ func (r *blobResolver) ensureBlobSizes(ctx context.Context) error {
 		return err
 	}
 
-	r.blobSizes = make(map[digest.Digest]int64, len(blobs))
+	if r.blobSizes == nil {
+		r.blobSizes = make(map[digest.Digest]int64, len(blobs))
+	}
+	if r.uncompressedSizes == nil {
+		r.uncompressedSizes = make(map[digest.Digest]int64)
+	}
+	if r.listedBlobs == nil {
+		r.listedBlobs = make(map[digest.Digest]stor.BlobDescriptor, len(blobs))
+	}
 	for _, blob := range blobs {
+		r.listedBlobs[blob.Digest] = blob
+		if blob.UncompressedSize > 0 {
+			r.uncompressedSizes[blob.Digest] = blob.UncompressedSize
+		}
+		if known := r.blobSizes[blob.Digest]; known > 0 {
+			continue
+		}
 		r.blobSizes[blob.Digest] = blob.Size
 	}
+	r.listed = true
 	return nil
 }
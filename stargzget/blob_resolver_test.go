@@ -2,11 +2,17 @@ package stargzget
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
 	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
 	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
 	"github.com/opencontainers/go-digest"
 )
@@ -85,3 +91,257 @@ func TestBlobResolver_TOC_UsesCache(t *testing.T) {
 		t.Fatalf("TOC() returned different pointer")
 	}
 }
+
+type sizeProbeStorage struct {
+	stubStorage
+	blobs     []stor.BlobDescriptor
+	listErr   error
+	listCalls int
+	probes    int
+}
+
+func (s *sizeProbeStorage) ListBlobs(ctx context.Context) ([]stor.BlobDescriptor, error) {
+	s.listCalls++
+	if s.listErr != nil {
+		return nil, s.listErr
+	}
+	return s.blobs, nil
+}
+
+func (s *sizeProbeStorage) BlobSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	s.probes++
+	return int64(len(s.data)), nil
+}
+
+func loadTestLayer(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("..", "testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read testdata %s: %v", name, err)
+	}
+	return data
+}
+
+func TestBlobResolver_TOC_WithBlobSizes(t *testing.T) {
+	data := loadTestLayer(t, "000002")
+	dgst := digest.FromBytes(data)
+
+	storage := &sizeProbeStorage{
+		stubStorage: stubStorage{data: data},
+		listErr:     errors.New("listing should not be needed"),
+	}
+	resolver := NewBlobResolver(storage, WithBlobSizes(map[digest.Digest]int64{dgst: int64(len(data))}))
+
+	toc, err := resolver.TOC(context.Background(), dgst)
+	if err != nil {
+		t.Fatalf("TOC() error = %v", err)
+	}
+	if len(toc.Entries) == 0 {
+		t.Fatalf("TOC() returned no entries")
+	}
+	if storage.listCalls != 0 {
+		t.Fatalf("ListBlobs calls = %d, want 0", storage.listCalls)
+	}
+	if storage.probes != 0 {
+		t.Fatalf("BlobSize probes = %d, want 0", storage.probes)
+	}
+}
+
+func TestBlobResolver_TOC_ProbesUnknownSize(t *testing.T) {
+	data := loadTestLayer(t, "000002")
+	dgst := digest.FromBytes(data)
+
+	storage := &sizeProbeStorage{
+		stubStorage: stubStorage{data: data},
+		blobs:       []stor.BlobDescriptor{{Digest: dgst}},
+	}
+	resolver := NewBlobResolver(storage)
+
+	if _, err := resolver.TOC(context.Background(), dgst); err != nil {
+		t.Fatalf("TOC() error = %v", err)
+	}
+	if storage.probes != 1 {
+		t.Fatalf("BlobSize probes = %d, want 1", storage.probes)
+	}
+
+	if _, err := resolver.FileMetadata(context.Background(), dgst, "does-not-exist"); err == nil {
+		t.Fatalf("FileMetadata() expected error for missing file")
+	}
+	if storage.probes != 1 || storage.listCalls != 1 {
+		t.Fatalf("probes = %d, listCalls = %d, want 1 and 1", storage.probes, storage.listCalls)
+	}
+}
+
+func TestBlobResolver_TOC_CacheDir(t *testing.T) {
+	data := loadTestLayer(t, "000002")
+	dgst := digest.FromBytes(data)
+	cacheDir := t.TempDir()
+	sizes := map[digest.Digest]int64{dgst: int64(len(data))}
+
+	first, err := NewBlobResolver(&stubStorage{data: data}, WithBlobSizes(sizes), WithTOCCacheDir(cacheDir)).TOC(context.Background(), dgst)
+	if err != nil {
+		t.Fatalf("TOC() error = %v", err)
+	}
+
+	// A fresh resolver over empty storage can only succeed from the disk cache.
+	second, err := NewBlobResolver(&stubStorage{}, WithBlobSizes(sizes), WithTOCCacheDir(cacheDir)).TOC(context.Background(), dgst)
+	if err != nil {
+		t.Fatalf("cached TOC() error = %v", err)
+	}
+	if len(second.Entries) != len(first.Entries) {
+		t.Fatalf("cached TOC entries = %d, want %d", len(second.Entries), len(first.Entries))
+	}
+
+	// An entry disagreeing with the layer's TOC digest is refetched, which
+	// empty storage cannot serve.
+	stale := NewBlobResolver(&stubStorage{}, WithBlobSizes(sizes), WithTOCCacheDir(cacheDir)).(*blobResolver)
+	stale.listedBlobs = map[digest.Digest]stor.BlobDescriptor{dgst: {
+		Digest:      dgst,
+		Annotations: map[string]string{stor.TOCDigestAnnotation: digest.FromString("other toc").String()},
+	}}
+	if _, err := stale.TOC(context.Background(), dgst); err == nil {
+		t.Fatalf("TOC() trusted a cached TOC with the wrong TOC digest")
+	}
+
+	// So is an entry whose contents no longer match their checksum.
+	path, _ := stale.cachedTOCPath(dgst)
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read cached TOC: %v", err)
+	}
+	tampered := bytes.Replace(data, []byte(`"name":"`), []byte(`"name":"x`), 1)
+	if bytes.Equal(tampered, data) {
+		t.Fatalf("cached TOC has no entry names to tamper with")
+	}
+	if err := os.WriteFile(path, tampered, 0o644); err != nil {
+		t.Fatalf("write cached TOC: %v", err)
+	}
+	if _, err := NewBlobResolver(&stubStorage{}, WithBlobSizes(sizes), WithTOCCacheDir(cacheDir)).TOC(context.Background(), dgst); err == nil {
+		t.Fatalf("TOC() trusted a tampered cached TOC")
+	}
+}
+
+// unreadableStorage fails every read, proving a code path made no requests.
+type unreadableStorage struct{}
+
+func (unreadableStorage) ListBlobs(ctx context.Context) ([]stor.BlobDescriptor, error) {
+	return nil, errors.New("unexpected ListBlobs")
+}
+
+func (unreadableStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	return nil, errors.New("unexpected ReadBlob")
+}
+
+func TestBlobResolver_TOC_Prefetched(t *testing.T) {
+	dgst := digest.FromString("blob")
+	toc := &estargzutil.JTOC{Entries: []*estargzutil.TOCEntry{
+		{Name: "etc/hosts", Type: "reg", Size: 5, ChunkSize: 5},
+	}}
+
+	resolver := NewBlobResolver(unreadableStorage{}, WithPrefetchedTOC(dgst, toc))
+
+	got, err := resolver.TOC(context.Background(), dgst)
+	if err != nil {
+		t.Fatalf("TOC() error = %v", err)
+	}
+	if got != toc {
+		t.Fatalf("TOC() did not return the prefetched TOC")
+	}
+	meta, err := resolver.FileMetadata(context.Background(), dgst, "etc/hosts")
+	if err != nil {
+		t.Fatalf("FileMetadata() error = %v", err)
+	}
+	if meta.Size != 5 || len(meta.Chunks) != 1 {
+		t.Fatalf("FileMetadata() = %+v, want one 5-byte chunk", meta)
+	}
+
+	if _, err := resolver.TOC(context.Background(), digest.FromString("other")); err == nil {
+		t.Fatalf("TOC() for a blob without a prefetched TOC should hit storage and fail")
+	}
+}
+
+func TestBlobResolver_FileMetadata_UncompressedSizeBound(t *testing.T) {
+	layer := estargztest.NewBuilder().File("data", bytes.Repeat([]byte("x"), 100)).MustBuild()
+
+	tests := []struct {
+		name             string
+		uncompressedSize int64
+		wantErr          bool
+	}{
+		{name: "no annotation", uncompressedSize: 0},
+		{name: "file fits", uncompressedSize: 4096},
+		{name: "file larger than layer", uncompressedSize: 10, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &sizeProbeStorage{
+				stubStorage: stubStorage{data: layer.Blob},
+				blobs:       []stor.BlobDescriptor{{Digest: layer.Digest, Size: int64(len(layer.Blob)), UncompressedSize: tt.uncompressedSize}},
+			}
+			meta, err := NewBlobResolver(storage).FileMetadata(context.Background(), layer.Digest, "data")
+			if tt.wantErr {
+				if code := stargzerrors.GetErrorCode(err); code != stargzerrors.ErrChunkLimit.Code {
+					t.Fatalf("FileMetadata() error = %v, want code %s", err, stargzerrors.ErrChunkLimit.Code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FileMetadata() error = %v", err)
+			}
+			if meta.Size != 100 {
+				t.Fatalf("Size = %d, want 100", meta.Size)
+			}
+		})
+	}
+}
+
+func TestBlobResolver_FileChunks(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(4096)).
+		File("usr/lib/big", big).
+		File("etc/hosts", []byte("127.0.0.1 localhost\n")).
+		MustBuild()
+	resolver := NewBlobResolver(&stubStorage{data: layer.Blob}, WithBlobSizes(map[digest.Digest]int64{layer.Digest: int64(len(layer.Blob))}))
+
+	for _, tt := range []struct {
+		path    string
+		content []byte
+	}{
+		{path: "usr/lib/big", content: big},
+		{path: "etc/hosts", content: []byte("127.0.0.1 localhost\n")},
+	} {
+		spans, err := resolver.FileChunks(context.Background(), layer.Digest, tt.path)
+		if err != nil {
+			t.Fatalf("FileChunks(%s) error = %v", tt.path, err)
+		}
+		if len(spans) == 0 {
+			t.Fatalf("FileChunks(%s) returned no chunks", tt.path)
+		}
+		// Each span, read alone, must decompress to its chunk.
+		var got []byte
+		for _, span := range spans {
+			if span.CompressedLength <= 0 {
+				t.Fatalf("%s chunk at %d has no compressed length", tt.path, span.Offset)
+			}
+			member := layer.Blob[span.CompressedOffset : span.CompressedOffset+span.CompressedLength]
+			gz, err := gzip.NewReader(bytes.NewReader(member))
+			if err != nil {
+				t.Fatalf("%s chunk at %d: %v", tt.path, span.Offset, err)
+			}
+			gz.Multistream(false)
+			data, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatalf("%s chunk at %d: %v", tt.path, span.Offset, err)
+			}
+			got = append(got, data[span.InnerOffset:span.InnerOffset+span.Size]...)
+		}
+		if !bytes.Equal(got, tt.content) {
+			t.Errorf("%s spans decompress to %d bytes, want %d", tt.path, len(got), len(tt.content))
+		}
+	}
+
+	if _, err := resolver.FileChunks(context.Background(), layer.Digest, "missing"); err == nil {
+		t.Error("FileChunks(missing) succeeded")
+	}
+}
@@ -0,0 +1,165 @@
+package stargzget
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// BlobStats are the transfer metrics of one blob during a download.
+type BlobStats struct {
+	BlobDigest       digest.Digest
+	Files            int           // Files from this blob downloaded successfully
+	Bytes            int64         // Uncompressed bytes of those files
+	TransferredBytes int64         // Compressed bytes read from storage
+	Requests         int           // Range requests made
+	Retries          int           // File retries caused by this blob
+	Latency          time.Duration // Total time until each request returned a response
+	TransferTime     time.Duration // Total time from each request until its body was closed
+}
+
+// AverageLatency is the mean time a request took to return a response.
+func (b BlobStats) AverageLatency() time.Duration {
+	if b.Requests == 0 {
+		return 0
+	}
+	return b.Latency / time.Duration(b.Requests)
+}
+
+// Throughput is the compressed transfer rate in bytes per second, or 0 if
+// nothing was transferred.
+func (b BlobStats) Throughput() float64 {
+	if b.TransferTime <= 0 {
+		return 0
+	}
+	return float64(b.TransferredBytes) / b.TransferTime.Seconds()
+}
+
+// SlowestBlob returns the blob with the lowest throughput among those that
+// transferred data, or nil if there are none.
+func (s *DownloadStats) SlowestBlob() *BlobStats {
+	var slowest *BlobStats
+	for i := range s.Blobs {
+		b := &s.Blobs[i]
+		if b.TransferredBytes == 0 || b.TransferTime <= 0 {
+			continue
+		}
+		if slowest == nil || b.Throughput() < slowest.Throughput() {
+			slowest = b
+		}
+	}
+	return slowest
+}
+
+// blobMeter accumulates BlobStats for a download session.
+type blobMeter struct {
+	mu    sync.Mutex
+	blobs map[digest.Digest]*BlobStats
+	audit *fetchAuditor // Records each request's range when auditing fetches; nil otherwise
+
+	// Read without the lock by the stall watchdog.
+	bytesRead atomic.Int64 // Compressed bytes read from all blobs so far
+	openReads atomic.Int64 // Blob bodies opened and not yet closed
+}
+
+func newBlobMeter() *blobMeter {
+	return &blobMeter{blobs: make(map[digest.Digest]*BlobStats)}
+}
+
+// update applies fn to the stats of dgst under the meter's lock.
+func (m *blobMeter) update(dgst digest.Digest, fn func(*BlobStats)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blobs[dgst]
+	if !ok {
+		b = &BlobStats{BlobDigest: dgst}
+		m.blobs[dgst] = b
+	}
+	fn(b)
+}
+
+// snapshot returns a copy of the stats, ordered by digest.
+func (m *blobMeter) snapshot() []BlobStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blobs := make([]BlobStats, 0, len(m.blobs))
+	for _, b := range m.blobs {
+		blobs = append(blobs, *b)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].BlobDigest < blobs[j].BlobDigest })
+	return blobs
+}
+
+// wrap returns a Storage whose reads are recorded by the meter.
+func (m *blobMeter) wrap(inner storage.Storage) storage.Storage {
+	return &meteredStorage{Storage: inner, meter: m}
+}
+
+type meteredStorage struct {
+	storage.Storage
+	meter *blobMeter
+}
+
+func (s *meteredStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	start := time.Now()
+	body, err := s.Storage.ReadBlob(ctx, dgst, offset, length)
+	latency := time.Since(start)
+	s.meter.update(dgst, func(b *BlobStats) {
+		b.Requests++
+		b.Latency += latency
+		if err != nil {
+			b.TransferTime += latency
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.meter.openReads.Add(1)
+	reader := &meteredReader{ReadCloser: body, meter: s.meter, dgst: dgst, start: start}
+	if s.meter.audit != nil {
+		reader.req = s.meter.audit.request(dgst, offset, length)
+	}
+	return reader, nil
+}
+
+// meteredReader counts the bytes read from a blob and records the transfer
+// time when closed.
+type meteredReader struct {
+	io.ReadCloser
+	meter  *blobMeter
+	dgst   digest.Digest
+	start  time.Time
+	n      int64
+	closed bool
+	req    *fetchRequest // Audit record of the request; nil when not auditing
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	r.meter.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (r *meteredReader) Close() error {
+	err := r.ReadCloser.Close()
+	if !r.closed {
+		r.closed = true
+		r.meter.openReads.Add(-1)
+		elapsed := time.Since(r.start)
+		r.meter.update(r.dgst, func(b *BlobStats) {
+			b.TransferredBytes += r.n
+			b.TransferTime += elapsed
+		})
+		if r.req != nil {
+			r.meter.audit.addRead(r.req, r.n)
+		}
+	}
+	return err
+}
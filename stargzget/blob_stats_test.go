@@ -0,0 +1,76 @@
+package stargzget
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// slowStorage delays every read of the given blobs.
+type slowStorage struct {
+	storage.Storage
+	slow  map[digest.Digest]bool
+	delay time.Duration
+}
+
+func (s *slowStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	if s.slow[dgst] {
+		time.Sleep(s.delay)
+	}
+	return s.Storage.ReadBlob(ctx, dgst, offset, length)
+}
+
+func TestDownloader_BlobStats(t *testing.T) {
+	tempDir := t.TempDir()
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	fast := addFileToStorage(t, base, resolver, "fast.txt", []byte("fast layer content"), 0)
+	slow := addFileToStorage(t, base, resolver, "slow.txt", []byte("slow layer content"), 0)
+
+	// The fast blob fails once, so it also accounts for a retry.
+	store := newFailingStorage(base, map[digest.Digest]int{fast: 1})
+	jobs := []*DownloadJob{
+		{Path: "fast.txt", BlobDigest: fast, Size: 18, OutputPath: filepath.Join(tempDir, "fast.txt")},
+		{Path: "slow.txt", BlobDigest: slow, Size: 18, OutputPath: filepath.Join(tempDir, "slow.txt")},
+	}
+	slowStore := &slowStorage{Storage: store, slow: map[digest.Digest]bool{slow: true}, delay: 50 * time.Millisecond}
+
+	stats, err := NewDownloader(resolver, slowStore).StartDownload(context.Background(), jobs, nil, &DownloadOptions{Concurrency: 2})
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	if len(stats.Blobs) != 2 {
+		t.Fatalf("Blobs = %+v, want 2 entries", stats.Blobs)
+	}
+
+	byDigest := map[digest.Digest]BlobStats{}
+	for _, b := range stats.Blobs {
+		byDigest[b.BlobDigest] = b
+	}
+	for dgst, wantRetries := range map[digest.Digest]int{fast: 1, slow: 0} {
+		b := byDigest[dgst]
+		if b.Files != 1 || b.Bytes != 18 {
+			t.Fatalf("%s: files/bytes = %d/%d, want 1/18", dgst, b.Files, b.Bytes)
+		}
+		if b.Retries != wantRetries {
+			t.Fatalf("%s: Retries = %d, want %d", dgst, b.Retries, wantRetries)
+		}
+		if b.Requests != wantRetries+1 {
+			t.Fatalf("%s: Requests = %d, want %d", dgst, b.Requests, wantRetries+1)
+		}
+		if b.TransferredBytes == 0 {
+			t.Fatalf("%s: no transferred bytes recorded", dgst)
+		}
+	}
+	if got := byDigest[slow].AverageLatency(); got < 50*time.Millisecond {
+		t.Fatalf("slow AverageLatency = %v, want at least the injected delay", got)
+	}
+	if slowest := stats.SlowestBlob(); slowest == nil || slowest.BlobDigest != slow {
+		t.Fatalf("SlowestBlob() = %+v, want %s", slowest, slow)
+	}
+}
@@ -0,0 +1,95 @@
+package stargzget
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+// ChunkCache keeps decompressed chunks by the chunkDigest their TOC entry
+// records, rather than by blob and offset, so a chunk shared by different
+// images (a rebuilt base layer, say) is fetched once. Set it as
+// DownloadOptions.ChunkCache; chunks without a chunkDigest bypass it.
+// Implementations must be safe for concurrent use.
+type ChunkCache interface {
+	// Get returns the chunk with digest dgst. It must only return data
+	// that matches dgst.
+	Get(dgst digest.Digest) ([]byte, bool)
+	// Put stores a chunk the downloader has checked against dgst.
+	Put(dgst digest.Digest, data []byte) error
+}
+
+// DirChunkCache is a ChunkCache keeping one file per chunk in a directory,
+// under ALGORITHM/XX/ENCODED. Chunks are verified on every read and
+// corrupt ones are removed, so a damaged cache costs a fetch, never bad
+// output. Nothing is evicted; remove the directory to reclaim the space.
+type DirChunkCache struct {
+	dir string
+}
+
+// NewDirChunkCache returns a chunk cache in dir, creating it if needed.
+func NewDirChunkCache(dir string) (*DirChunkCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirChunkCache{dir: dir}, nil
+}
+
+func (c *DirChunkCache) path(dgst digest.Digest) (string, bool) {
+	if dgst.Validate() != nil {
+		return "", false
+	}
+	encoded := dgst.Encoded()
+	return filepath.Join(c.dir, dgst.Algorithm().String(), encoded[:2], encoded), true
+}
+
+// Get reads and verifies the chunk dgst.
+func (c *DirChunkCache) Get(dgst digest.Digest) ([]byte, bool) {
+	path, ok := c.path(dgst)
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	if dgst.Algorithm().FromBytes(data) != dgst {
+		logger.Warn("Removing corrupt chunk %s from the chunk cache", dgst)
+		os.Remove(path)
+		return nil, false
+	}
+	return data, true
+}
+
+// Put stores the chunk dgst. The file is written under a temporary name
+// and renamed into place, so concurrent readers never see part of it.
+func (c *DirChunkCache) Put(dgst digest.Digest, data []byte) error {
+	path, ok := c.path(dgst)
+	if !ok {
+		return errors.New("invalid chunk digest " + dgst.String())
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".chunk-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
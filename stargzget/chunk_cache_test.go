@@ -0,0 +1,86 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestDownloader_ChunkCacheSharedAcrossImages(t *testing.T) {
+	const layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	content := bytes.Repeat([]byte("shared base file "), 100) // 1700 bytes, 4 chunks
+	base := storage.NewMockStorage()
+	// Two images built from the same base file, with different blobs.
+	first := base.AddBlob(layerType, estargztest.NewBuilder(estargztest.WithChunkSize(512)).
+		File("usr/lib/libc.so", content).
+		File("etc/hostname", []byte("first")).
+		MustBuild().Blob)
+	second := base.AddBlob(layerType, estargztest.NewBuilder(estargztest.WithChunkSize(512)).
+		File("etc/hostname", []byte("second")).
+		File("usr/lib/libc.so", content).
+		MustBuild().Blob)
+
+	cache, err := NewDirChunkCache(filepath.Join(t.TempDir(), "chunks"))
+	if err != nil {
+		t.Fatalf("NewDirChunkCache() error = %v", err)
+	}
+	resolver := NewBlobResolver(base)
+	store := &countingStorage{Storage: base}
+	downloader := NewDownloader(resolver, store)
+	download := func(blob digest.Digest) *DownloadStats {
+		t.Helper()
+		job := &DownloadJob{Path: "usr/lib/libc.so", BlobDigest: blob, Size: int64(len(content)), OutputPath: filepath.Join(t.TempDir(), "libc.so")}
+		stats, err := downloader.StartDownload(context.Background(), []*DownloadJob{job}, nil, &DownloadOptions{ChunkCache: cache, SingleFileChunkThreshold: 1})
+		if err != nil {
+			t.Fatalf("StartDownload() error = %v", err)
+		}
+		data, err := os.ReadFile(job.OutputPath)
+		if err != nil || !bytes.Equal(data, content) {
+			t.Fatalf("output = %d bytes, err %v; want the original content", len(data), err)
+		}
+		return stats
+	}
+
+	if stats := download(first); stats.ChunkCacheHits != 0 {
+		t.Fatalf("first download ChunkCacheHits = %d, want 0", stats.ChunkCacheHits)
+	}
+	store.reads = 0
+	if stats := download(second); stats.ChunkCacheHits != 4 || store.reads != 0 {
+		t.Fatalf("second image: ChunkCacheHits = %d with %d blob reads, want 4 hits and no reads", stats.ChunkCacheHits, store.reads)
+	}
+}
+
+func TestDirChunkCache_VerifiesOnRead(t *testing.T) {
+	cache, err := NewDirChunkCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDirChunkCache() error = %v", err)
+	}
+	data := []byte("chunk contents")
+	dgst := digest.FromBytes(data)
+	if err := cache.Put(dgst, data); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if got, ok := cache.Get(dgst); !ok || !bytes.Equal(got, data) {
+		t.Fatalf("Get() = %q, %v; want the chunk", got, ok)
+	}
+
+	path, _ := cache.path(dgst)
+	if err := os.WriteFile(path, []byte("bit rot"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(dgst); ok {
+		t.Fatal("Get() returned a corrupt chunk")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupt chunk was not removed: %v", err)
+	}
+	if _, ok := cache.Get("sha256:nope"); ok {
+		t.Error("Get() of an invalid digest succeeded")
+	}
+}
@@ -0,0 +1,152 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/registrytest"
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// TestSharedClient_Concurrent runs ls, stat and get from many goroutines
+// over one registry client, storage, resolver, downloader and chunk cache.
+// Run it with -race; it also checks the caches are shared rather than
+// filled once per goroutine.
+func TestSharedClient_Concurrent(t *testing.T) {
+	registry := registrytest.New()
+	defer registry.Close()
+	registry.RequireToken()
+
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string][]byte)
+	var layers []*estargztest.Layer
+	for l := 0; l < 2; l++ {
+		builder := estargztest.NewBuilder().Dir(fmt.Sprintf("layer%d/", l))
+		for f := 0; f < 4; f++ {
+			data := make([]byte, 32<<10+rng.Intn(32<<10))
+			rng.Read(data)
+			path := fmt.Sprintf("layer%d/file%d", l, f)
+			want[path] = data
+			builder.File(path, data)
+		}
+		layers = append(layers, builder.MustBuild())
+	}
+	imageRef := registry.AddImage("test/app", "v1", layers...)
+
+	ctx := context.Background()
+	client := stor.NewRemoteRegistryStorage(false)
+	ref, err := refs.Parse(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fetch the manifest with a client of its own so the shared one starts
+	// without a token and its goroutines race to get the first.
+	manifest, err := stor.NewRemoteRegistryStorage(false).GetManifest(ctx, imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := client.NewStorage(ref.Registry, ref.Repository, manifest)
+	sizes := make(map[digest.Digest]int64)
+	for _, layer := range layers {
+		sizes[layer.Digest] = int64(len(layer.Blob))
+	}
+	counting := &footerCountingStorage{Storage: storage, sizes: sizes}
+	resolver := NewBlobResolver(counting)
+	downloader := NewDownloader(resolver, counting)
+	cache, err := NewDirChunkCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- func() error {
+				if _, err := client.GetManifest(ctx, imageRef); err != nil {
+					return err
+				}
+				index, err := NewBlobIndexLoader(counting, resolver).Load(ctx)
+				if err != nil {
+					return err
+				}
+				dir := t.TempDir()
+				var jobs []*DownloadJob
+				for _, info := range index.FilterFiles(".", "") {
+					if !info.IsRegular() {
+						continue
+					}
+					meta, err := resolver.FileMetadata(ctx, info.BlobDigest, info.Path)
+					if err != nil {
+						return err
+					}
+					jobs = append(jobs, &DownloadJob{Path: info.Path, BlobDigest: info.BlobDigest, Size: meta.Size, OutputPath: filepath.Join(dir, info.Path)})
+				}
+				stats, err := downloader.StartDownload(ctx, jobs, nil, &DownloadOptions{Concurrency: 4, ChunkCache: cache})
+				if err != nil {
+					return err
+				}
+				if stats.DownloadedFiles != len(want) {
+					return fmt.Errorf("worker %d downloaded %d files, want %d", i, stats.DownloadedFiles, len(want))
+				}
+				for path, data := range want {
+					if got, err := os.ReadFile(filepath.Join(dir, path)); err != nil || !bytes.Equal(got, data) {
+						return fmt.Errorf("worker %d: %s differs (%v)", i, path, err)
+					}
+				}
+				return nil
+			}()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if n := registry.TokensIssued(); n != 2 {
+		t.Errorf("TokensIssued() = %d, want 1 for setup and 1 shared by every goroutine", n)
+	}
+	if n := counting.footerReads(); n != len(layers) {
+		t.Errorf("footer reads = %d, want each layer's TOC fetched once (%d)", n, len(layers))
+	}
+}
+
+// footerCountingStorage counts reads that end at the end of a blob, which
+// only TOC fetches make.
+type footerCountingStorage struct {
+	stor.Storage
+	sizes map[digest.Digest]int64
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *footerCountingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	if size, ok := s.sizes[dgst]; ok && length > 0 && offset+length == size {
+		s.mu.Lock()
+		s.reads++
+		s.mu.Unlock()
+	}
+	return s.Storage.ReadBlob(ctx, dgst, offset, length)
+}
+
+func (s *footerCountingStorage) footerReads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
@@ -0,0 +1,313 @@
+//go:build containerd
+
+package contentstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	leasesapi "github.com/containerd/containerd/api/services/leases/v1"
+	"github.com/containerd/containerd/api/types"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultContainerdAddress is where containerd listens by default.
+	DefaultContainerdAddress = "/run/containerd/containerd.sock"
+
+	// DefaultContainerdNamespace is the namespace ctr and containerd's
+	// CRI plugin use when none is given ("k8s.io" for Kubernetes).
+	DefaultContainerdNamespace = "default"
+
+	// namespaceHeader and leaseHeader are the gRPC metadata keys through
+	// which containerd takes the namespace and lease of a request.
+	namespaceHeader = "containerd-namespace"
+	leaseHeader     = "containerd-lease"
+
+	// writeChunkSize is the data sent per write message, well below
+	// containerd's 16MiB message limit.
+	writeChunkSize = 1 << 20
+
+	// leaseExpiry bounds how long content of an interrupted run is kept
+	// from garbage collection.
+	leaseExpiry = 24 * time.Hour
+)
+
+// Containerd writes blobs and images into a containerd daemon's content
+// and image stores, in one namespace.
+type Containerd struct {
+	conn      *grpc.ClientConn
+	content   contentapi.ContentClient
+	images    imagesapi.ImagesClient
+	leases    leasesapi.LeasesClient
+	namespace string
+}
+
+// DialContainerd connects to the containerd socket at address, a path or a
+// gRPC target such as "unix:///run/containerd/containerd.sock". The
+// connection is made lazily, by the first request.
+func DialContainerd(address, namespace string) (*Containerd, error) {
+	if namespace == "" {
+		namespace = DefaultContainerdNamespace
+	}
+	target := address
+	if !strings.Contains(target, "://") {
+		target = "unix://" + target
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd at %s: %w", address, err)
+	}
+	return &Containerd{
+		conn:      conn,
+		content:   contentapi.NewContentClient(conn),
+		images:    imagesapi.NewImagesClient(conn),
+		leases:    leasesapi.NewLeasesClient(conn),
+		namespace: namespace,
+	}, nil
+}
+
+// Close closes the connection.
+func (c *Containerd) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Containerd) withNamespace(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, namespaceHeader, c.namespace)
+}
+
+// Has reports whether the content store holds the blob dgst.
+func (c *Containerd) Has(ctx context.Context, dgst digest.Digest) (bool, error) {
+	_, err := c.content.Info(c.withNamespace(ctx), &contentapi.InfoRequest{Digest: dgst.String()})
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// WriteBlob streams the blob desc from storage into the content store with
+// labels. An ingest left by an interrupted run is resumed where it stopped,
+// and the content store checks the digest before committing.
+func (c *Containerd) WriteBlob(ctx context.Context, storage stor.Storage, desc stor.Descriptor, labels map[string]string) error {
+	dgst, err := digest.Parse(desc.Digest)
+	if err != nil {
+		return err
+	}
+	return c.write(ctx, dgst, desc.Size, labels, func(offset int64) (io.ReadCloser, error) {
+		return storage.ReadBlob(ctx, dgst, offset, 0)
+	})
+}
+
+// write runs one ingest of the blob dgst through the content service's
+// write stream: a stat to learn how much a previous attempt left, writes
+// of the rest and a commit.
+func (c *Containerd) write(ctx context.Context, dgst digest.Digest, size int64, labels map[string]string, open func(offset int64) (io.ReadCloser, error)) error {
+	if size <= 0 {
+		return fmt.Errorf("blob %s has no size in its descriptor", dgst)
+	}
+	stream, err := c.content.Write(c.withNamespace(ctx))
+	if err != nil {
+		return err
+	}
+	defer stream.CloseSend()
+	send := func(req *contentapi.WriteContentRequest) (*contentapi.WriteContentResponse, error) {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		return stream.Recv()
+	}
+
+	ref := "starget-" + dgst.Encoded()
+	resp, err := send(&contentapi.WriteContentRequest{Action: contentapi.WriteAction_STAT, Ref: ref})
+	if err != nil {
+		return err
+	}
+	offset := resp.Offset
+	if offset > size {
+		// Not this blob's data; containerd restarts an ingest written at 0.
+		offset = 0
+	}
+	if offset < size {
+		body, err := open(offset)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		buf := make([]byte, writeChunkSize)
+		for offset < size {
+			n, err := io.ReadFull(body, buf[:min(int64(len(buf)), size-offset)])
+			if err != nil {
+				return fmt.Errorf("blob %s ended at %d of %d bytes: %w", dgst, offset+int64(n), size, err)
+			}
+			resp, err := send(&contentapi.WriteContentRequest{
+				Action:   contentapi.WriteAction_WRITE,
+				Ref:      ref,
+				Offset:   offset,
+				Data:     buf[:n],
+				Total:    size,
+				Expected: dgst.String(),
+			})
+			if err != nil {
+				return err
+			}
+			offset = resp.Offset
+		}
+	}
+
+	_, err = send(&contentapi.WriteContentRequest{
+		Action:   contentapi.WriteAction_COMMIT,
+		Ref:      ref,
+		Total:    size,
+		Expected: dgst.String(),
+		Labels:   labels,
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+// SetImage names target in the image store as name, replacing the target
+// of an existing image with that name.
+func (c *Containerd) SetImage(ctx context.Context, name string, target stor.Descriptor) error {
+	ctx = c.withNamespace(ctx)
+	image := &imagesapi.Image{
+		Name: name,
+		Target: &types.Descriptor{
+			MediaType: target.MediaType,
+			Digest:    target.Digest,
+			Size:      target.Size,
+		},
+	}
+	_, err := c.images.Create(ctx, &imagesapi.CreateImageRequest{Image: image})
+	if status.Code(err) == codes.AlreadyExists {
+		_, err = c.images.Update(ctx, &imagesapi.UpdateImageRequest{Image: image})
+	}
+	return err
+}
+
+// Result summarizes a Populate run.
+type Result struct {
+	Manifest stor.Descriptor // The manifest as stored, which the image points at
+	Written  int             // Blobs written
+	Skipped  int             // Blobs the content store already held
+	Bytes    int64           // Bytes of the blobs written
+}
+
+// Populate copies the config and layers of manifest from storage into the
+// content store, up to concurrency blobs at a time, then stores the
+// manifest and names it name in the image store. The manifest is stored
+// re-encoded (see stor.Manifest.Encode), so its digest can differ from the
+// registry's. The manifest blob carries the garbage collection labels that
+// keep its config and layers, and a lease protects the blobs until the
+// image is named.
+func (c *Containerd) Populate(ctx context.Context, storage stor.Storage, manifest *stor.Manifest, name string, concurrency int) (*Result, error) {
+	ctx, done, err := c.lease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	descs := manifest.AllDescriptors()
+	result := &Result{}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+		sem  = make(chan struct{}, max(concurrency, 1))
+	)
+	for _, desc := range descs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			dgst, err := digest.Parse(desc.Digest)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			present, err := c.Has(ctx, dgst)
+			if err == nil && !present {
+				err = c.WriteBlob(ctx, storage, desc, nil)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Errorf("blob %s: %w", dgst, err))
+			case present:
+				result.Skipped++
+			default:
+				result.Written++
+				result.Bytes += desc.Size
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	data, mediaType, err := manifest.Encode()
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	if manifest.Config.Digest != "" {
+		labels["containerd.io/gc.ref.content.config"] = manifest.Config.Digest
+	}
+	for i, layer := range append(append([]stor.Layer(nil), manifest.Layers...), manifest.Blobs...) {
+		labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = layer.Digest
+	}
+	dgst := digest.FromBytes(data)
+	err = c.write(ctx, dgst, int64(len(data)), labels, func(offset int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data[offset:])), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	result.Manifest = stor.Descriptor{MediaType: mediaType, Digest: dgst.String(), Size: int64(len(data))}
+	if err := c.SetImage(ctx, name, result.Manifest); err != nil {
+		return nil, fmt.Errorf("image %s: %w", name, err)
+	}
+	return result, nil
+}
+
+// lease creates a lease that keeps content written under the returned
+// context from being garbage collected before something references it,
+// and returns the function that deletes it.
+func (c *Containerd) lease(ctx context.Context) (context.Context, func(), error) {
+	var id [8]byte
+	rand.Read(id[:])
+	name := "starget-" + hex.EncodeToString(id[:])
+	_, err := c.leases.Create(c.withNamespace(ctx), &leasesapi.CreateRequest{
+		ID:     name,
+		Labels: map[string]string{"containerd.io/gc.expire": time.Now().Add(leaseExpiry).UTC().Format(time.RFC3339)},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create containerd lease: %w", err)
+	}
+	done := func() {
+		c.leases.Delete(c.withNamespace(context.WithoutCancel(ctx)), &leasesapi.DeleteRequest{ID: name})
+	}
+	return metadata.AppendToOutgoingContext(ctx, leaseHeader, name), done, nil
+}
@@ -0,0 +1,199 @@
+//go:build containerd
+
+package contentstore
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	leasesapi "github.com/containerd/containerd/api/services/leases/v1"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeContainerd keeps content, ingests and images in memory, per
+// namespace, and checks digests on commit like containerd does.
+type fakeContainerd struct {
+	mu      sync.Mutex
+	blobs   map[string][]byte            // namespace/digest -> data
+	labels  map[string]map[string]string // namespace/digest -> labels
+	ingests map[string][]byte            // ref -> data so far
+	images  map[string]*imagesapi.Image  // namespace/name -> image
+	writes  int                          // write messages received
+}
+
+func namespaceOf(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ns := md.Get(namespaceHeader); len(ns) > 0 {
+		return ns[0]
+	}
+	return ""
+}
+
+type fakeContent struct {
+	contentapi.UnimplementedContentServer
+	*fakeContainerd
+}
+
+type fakeImages struct {
+	imagesapi.UnimplementedImagesServer
+	*fakeContainerd
+}
+
+func (f fakeContent) Info(ctx context.Context, req *contentapi.InfoRequest) (*contentapi.InfoResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.blobs[namespaceOf(ctx)+"/"+req.Digest]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	return &contentapi.InfoResponse{Info: &contentapi.Info{Digest: req.Digest, Size: int64(len(data))}}, nil
+}
+
+func (f fakeContent) Write(stream contentapi.Content_WriteServer) error {
+	ns := namespaceOf(stream.Context())
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f.mu.Lock()
+		data := f.ingests[req.Ref]
+		switch req.Action {
+		case contentapi.WriteAction_WRITE:
+			f.writes++
+			data = append(data[:req.Offset], req.Data...)
+			f.ingests[req.Ref] = data
+		case contentapi.WriteAction_COMMIT:
+			key := ns + "/" + req.Expected
+			if _, ok := f.blobs[key]; ok {
+				f.mu.Unlock()
+				return status.Error(codes.AlreadyExists, "exists")
+			}
+			if digest.FromBytes(data).String() != req.Expected || int64(len(data)) != req.Total {
+				f.mu.Unlock()
+				return status.Error(codes.FailedPrecondition, "unexpected commit digest")
+			}
+			f.blobs[key], f.labels[key] = data, req.Labels
+			delete(f.ingests, req.Ref)
+		}
+		f.mu.Unlock()
+		if err := stream.Send(&contentapi.WriteContentResponse{Action: req.Action, Offset: int64(len(data))}); err != nil {
+			return err
+		}
+	}
+}
+
+func (f fakeImages) Create(ctx context.Context, req *imagesapi.CreateImageRequest) (*imagesapi.CreateImageResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := namespaceOf(ctx) + "/" + req.Image.Name
+	if _, ok := f.images[key]; ok {
+		return nil, status.Error(codes.AlreadyExists, "exists")
+	}
+	f.images[key] = req.Image
+	return &imagesapi.CreateImageResponse{Image: req.Image}, nil
+}
+
+func (f fakeImages) Update(ctx context.Context, req *imagesapi.UpdateImageRequest) (*imagesapi.UpdateImageResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[namespaceOf(ctx)+"/"+req.Image.Name] = req.Image
+	return &imagesapi.UpdateImageResponse{Image: req.Image}, nil
+}
+
+type fakeLeases struct {
+	leasesapi.UnimplementedLeasesServer
+}
+
+func (fakeLeases) Create(ctx context.Context, req *leasesapi.CreateRequest) (*leasesapi.CreateResponse, error) {
+	return &leasesapi.CreateResponse{Lease: &leasesapi.Lease{ID: req.ID}}, nil
+}
+
+func (fakeLeases) Delete(ctx context.Context, req *leasesapi.DeleteRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+func startFakeContainerd(t *testing.T) (*fakeContainerd, string) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "containerd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeContainerd{
+		blobs:   make(map[string][]byte),
+		labels:  make(map[string]map[string]string),
+		ingests: make(map[string][]byte),
+		images:  make(map[string]*imagesapi.Image),
+	}
+	server := grpc.NewServer()
+	contentapi.RegisterContentServer(server, fakeContent{fakeContainerd: fake})
+	imagesapi.RegisterImagesServer(server, fakeImages{fakeContainerd: fake})
+	leasesapi.RegisterLeasesServer(server, fakeLeases{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return fake, socket
+}
+
+func TestContainerd_Populate(t *testing.T) {
+	fake, socket := startFakeContainerd(t)
+	store := storage.NewMockStorage()
+	layer := store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", make([]byte, 3*writeChunkSize+100))
+	config := store.AddBlob("application/vnd.oci.image.config.v1+json", []byte(`{"architecture":"amd64"}`))
+	manifest := &storage.Manifest{
+		SchemaVersion: 2,
+		Config:        storage.Descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: config.String(), Size: 24},
+		Layers:        []storage.Layer{{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layer.String(), Size: 3*writeChunkSize + 100}},
+	}
+
+	c, err := DialContainerd(socket, "k8s.io")
+	if err != nil {
+		t.Fatalf("DialContainerd() error = %v", err)
+	}
+	defer c.Close()
+
+	// An earlier run left part of the layer behind.
+	fake.ingests["starget-"+layer.Encoded()] = make([]byte, 2*writeChunkSize)
+
+	result, err := c.Populate(context.Background(), store, manifest, "r.example/app:v1", 2)
+	if err != nil {
+		t.Fatalf("Populate() error = %v", err)
+	}
+	if result.Written != 2 || result.Skipped != 0 {
+		t.Errorf("Populate() = %+v, want 2 blobs written", result)
+	}
+	if fake.writes != 4 {
+		t.Errorf("write messages = %d, want 4 (2 for the rest of the layer, then the config and manifest)", fake.writes)
+	}
+	image := fake.images["k8s.io/r.example/app:v1"]
+	if image == nil || image.Target.Digest != result.Manifest.Digest {
+		t.Fatalf("image = %v, want it to target %s", image, result.Manifest.Digest)
+	}
+	labels := fake.labels["k8s.io/"+result.Manifest.Digest]
+	if labels["containerd.io/gc.ref.content.config"] != config.String() || labels["containerd.io/gc.ref.content.l.0"] != layer.String() {
+		t.Errorf("manifest labels = %v, want gc references to the config and layer", labels)
+	}
+
+	result, err = c.Populate(context.Background(), store, manifest, "r.example/app:v1", 2)
+	if err != nil {
+		t.Fatalf("second Populate() error = %v", err)
+	}
+	if result.Written != 0 || result.Skipped != 2 {
+		t.Errorf("second Populate() = %+v, want both blobs skipped", result)
+	}
+}
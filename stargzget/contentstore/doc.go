@@ -0,0 +1,10 @@
+// Package contentstore writes images into the content store of a local
+// container runtime, so starget can populate a runtime ahead of a run
+// rather than only writing loose files.
+//
+// The containerd backend talks to the daemon over its socket. It is only
+// built with the containerd build tag, which keeps gRPC out of default
+// builds:
+//
+//	go build -tags containerd ./cmd/starget
+package contentstore
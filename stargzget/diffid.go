@@ -0,0 +1,60 @@
+package stargzget
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// LayerDiffID returns the diff ID that config records for blobDigest. Diff IDs
+// are matched to layers by their position in the manifest.
+func LayerDiffID(manifest *stor.Manifest, config *stor.ImageConfig, blobDigest digest.Digest) (digest.Digest, error) {
+	for i, layer := range manifest.Layers {
+		if layer.Digest != blobDigest.String() {
+			continue
+		}
+		if i >= len(config.RootFS.DiffIDs) {
+			return "", fmt.Errorf("image config has %d diff IDs, none for layer %d (%s)", len(config.RootFS.DiffIDs), i, blobDigest)
+		}
+		diffID, err := digest.Parse(config.RootFS.DiffIDs[i])
+		if err != nil {
+			return "", stargzerrors.ErrInvalidDigest.WithDetail("diffID", config.RootFS.DiffIDs[i]).WithCause(err)
+		}
+		return diffID, nil
+	}
+	return "", stargzerrors.ErrBlobNotFound.WithDetail("digest", blobDigest.String())
+}
+
+// VerifyDiffID checks a layer end to end: it streams the whole blob, rebuilds
+// the uncompressed tar stream by decompressing every gzip member in order,
+// and compares its digest with want. This covers the tar headers and padding
+// that per-chunk digests in the TOC do not.
+func VerifyDiffID(ctx context.Context, storage stor.Storage, blobDigest digest.Digest, want digest.Digest) error {
+	body, err := storage.ReadBlob(ctx, blobDigest, 0, 0)
+	if err != nil {
+		return stargzerrors.ErrDiffIDMismatch.WithMessage("failed to read layer").WithDetail("digest", blobDigest.String()).WithCause(err)
+	}
+	defer body.Close()
+
+	gz, err := getGzipReader(body)
+	if err != nil {
+		return stargzerrors.ErrDiffIDMismatch.WithMessage("failed to decompress layer").WithDetail("digest", blobDigest.String()).WithCause(err)
+	}
+	defer putGzipReader(gz)
+
+	digester := want.Algorithm().Digester()
+	if _, err := io.Copy(digester.Hash(), gz); err != nil {
+		return stargzerrors.ErrDiffIDMismatch.WithMessage("failed to decompress layer").WithDetail("digest", blobDigest.String()).WithCause(err)
+	}
+
+	if got := digester.Digest(); got != want {
+		return stargzerrors.ErrDiffIDMismatch.
+			WithMessage(fmt.Sprintf("layer %s has diff ID %s, image config expects %s", blobDigest, got, want)).
+			WithDetail("digest", blobDigest.String())
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package stargzget
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestVerifyDiffID(t *testing.T) {
+	lower := estargztest.NewBuilder(estargztest.WithChunkSize(16)).
+		File("etc/os-release", []byte("NAME=test\nVERSION=1\n")).
+		MustBuild()
+	upper := estargztest.NewBuilder().
+		Whiteout("etc/os-release").
+		File("etc/motd", []byte("hello\n")).
+		MustBuild()
+
+	store := storage.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", lower.Blob)
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", upper.Blob)
+
+	configJSON, err := json.Marshal(storage.ImageConfig{
+		RootFS: storage.RootFS{Type: "layers", DiffIDs: []string{lower.DiffID.String(), upper.DiffID.String()}},
+	})
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	configDigest := store.AddBlob("application/vnd.oci.image.config.v1+json", configJSON)
+
+	manifest := &storage.Manifest{
+		Config: storage.Descriptor{Digest: configDigest.String(), Size: int64(len(configJSON))},
+		Layers: []storage.Layer{
+			{Digest: lower.Digest.String(), Size: int64(len(lower.Blob))},
+			{Digest: upper.Digest.String(), Size: int64(len(upper.Blob))},
+		},
+	}
+
+	ctx := context.Background()
+	config, err := storage.ReadImageConfig(ctx, store, manifest.Config)
+	if err != nil {
+		t.Fatalf("ReadImageConfig() error = %v", err)
+	}
+
+	for _, layer := range []*estargztest.Layer{lower, upper} {
+		diffID, err := LayerDiffID(manifest, config, layer.Digest)
+		if err != nil {
+			t.Fatalf("LayerDiffID(%s) error = %v", layer.Digest, err)
+		}
+		if diffID != layer.DiffID {
+			t.Fatalf("LayerDiffID(%s) = %s, want %s", layer.Digest, diffID, layer.DiffID)
+		}
+		if err := VerifyDiffID(ctx, store, layer.Digest, diffID); err != nil {
+			t.Fatalf("VerifyDiffID(%s) error = %v", layer.Digest, err)
+		}
+	}
+
+	err = VerifyDiffID(ctx, store, lower.Digest, upper.DiffID)
+	if stargzerrors.GetErrorCode(err) != stargzerrors.ErrDiffIDMismatch.Code {
+		t.Fatalf("VerifyDiffID() with wrong diff ID error = %v, want %s", err, stargzerrors.ErrDiffIDMismatch.Code)
+	}
+
+	if _, err := LayerDiffID(manifest, config, digest.FromString("missing")); stargzerrors.GetErrorCode(err) != stargzerrors.ErrBlobNotFound.Code {
+		t.Fatalf("LayerDiffID() for unknown blob error = %v, want %s", err, stargzerrors.ErrBlobNotFound.Code)
+	}
+}
@@ -0,0 +1,193 @@
+package stargzget
+
+import (
+	"context"
+	"sync"
+)
+
+// DownloadState describes the lifecycle of an asynchronous download.
+type DownloadState int
+
+const (
+	DownloadRunning DownloadState = iota
+	DownloadPaused
+	DownloadCancelled
+	DownloadCompleted
+)
+
+func (s DownloadState) String() string {
+	switch s {
+	case DownloadRunning:
+		return "running"
+	case DownloadPaused:
+		return "paused"
+	case DownloadCancelled:
+		return "cancelled"
+	case DownloadCompleted:
+		return "completed"
+	default:
+		return "unknown"
+	}
+}
+
+// DownloadStatus is a point-in-time snapshot of an asynchronous download.
+type DownloadStatus struct {
+	State       DownloadState
+	Stats       DownloadStats
+	ActiveFiles []string
+	Pipeline    PipelineStats // Queue depths and open reads while running; zero once finished
+}
+
+// DownloadController manages a download started with StartDownloadAsync.
+//
+// Pause stops workers from starting new files or chunks; transfers already
+// in flight finish first. Cancel aborts in-flight transfers and skips the
+// remaining jobs.
+type DownloadController interface {
+	Pause()
+	Resume()
+	Cancel()
+	Status() DownloadStatus
+	// Done is closed once the download has finished or been cancelled.
+	Done() <-chan struct{}
+	// Wait blocks until the download finishes and returns its final result.
+	Wait() (*DownloadStats, error)
+}
+
+type downloadController struct {
+	cancel  context.CancelFunc
+	gate    *pauseGate
+	session *downloadSession
+	done    chan struct{}
+
+	mu        sync.Mutex
+	cancelled bool
+	stats     *DownloadStats
+	err       error
+}
+
+func (c *downloadController) Pause() {
+	c.gate.pause()
+}
+
+func (c *downloadController) Resume() {
+	c.gate.resume()
+}
+
+func (c *downloadController) Cancel() {
+	c.mu.Lock()
+	select {
+	case <-c.done:
+	default:
+		c.cancelled = true
+	}
+	c.mu.Unlock()
+	c.cancel()
+	// Release paused workers so they observe the cancellation.
+	c.gate.resume()
+}
+
+func (c *downloadController) Status() DownloadStatus {
+	var status DownloadStatus
+
+	c.mu.Lock()
+	finished := c.stats != nil
+	cancelled := c.cancelled
+	if finished {
+		status.Stats = c.stats.clone()
+	}
+	c.mu.Unlock()
+
+	if !finished && c.session != nil {
+		c.session.mu.Lock()
+		status.Stats = c.session.stats.clone()
+		status.ActiveFiles = append([]string{}, c.session.activeFiles...)
+		c.session.mu.Unlock()
+		status.Pipeline = c.session.pipeline()
+	}
+
+	switch {
+	case cancelled:
+		status.State = DownloadCancelled
+	case finished:
+		status.State = DownloadCompleted
+	case c.gate.isPaused():
+		status.State = DownloadPaused
+	default:
+		status.State = DownloadRunning
+	}
+	return status
+}
+
+func (c *downloadController) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *downloadController) Wait() (*DownloadStats, error) {
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats, c.err
+}
+
+func (c *downloadController) finish(stats *DownloadStats, err error) {
+	c.mu.Lock()
+	c.stats = stats
+	c.err = err
+	c.mu.Unlock()
+	c.cancel()
+	close(c.done)
+}
+
+// pauseGate blocks workers while a download is paused. A nil gate never blocks.
+type pauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+	}
+}
+
+func (g *pauseGate) isPaused() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait returns once the gate is open, or ctx's error if it is cancelled first.
+func (g *pauseGate) wait(ctx context.Context) error {
+	if g == nil {
+		return ctx.Err()
+	}
+
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+
+	if paused {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err()
+}
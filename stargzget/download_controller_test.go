@@ -0,0 +1,181 @@
+package stargzget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// gatedStorage blocks every read until a token is sent on release.
+type gatedStorage struct {
+	storage.Storage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	g.started <- struct{}{}
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return g.Storage.ReadBlob(ctx, dgst, offset, length)
+}
+
+func newGatedDownload(t *testing.T, files int) (*gatedStorage, *mockBlobResolver, []*DownloadJob) {
+	t.Helper()
+
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	tempDir := t.TempDir()
+
+	var jobs []*DownloadJob
+	for i := 0; i < files; i++ {
+		path := fmt.Sprintf("file%d", i)
+		content := []byte(fmt.Sprintf("content-%d", i))
+		dgst := addFileToStorage(t, base, resolver, path, content, 0)
+		jobs = append(jobs, &DownloadJob{
+			Path:       path,
+			BlobDigest: dgst,
+			Size:       int64(len(content)),
+			OutputPath: filepath.Join(tempDir, path),
+		})
+	}
+
+	gated := &gatedStorage{
+		Storage: base,
+		started: make(chan struct{}, files),
+		release: make(chan struct{}, files),
+	}
+	return gated, resolver, jobs
+}
+
+func TestDownloadController_PauseResume(t *testing.T) {
+	store, resolver, jobs := newGatedDownload(t, 3)
+	ctrl := NewDownloader(resolver, store).StartDownloadAsync(context.Background(), jobs, nil, &DownloadOptions{Concurrency: 1})
+
+	<-store.started
+	ctrl.Pause()
+	store.release <- struct{}{}
+
+	// The in-flight file finishes, but no further file may start while paused.
+	deadline := time.After(2 * time.Second)
+	for ctrl.Status().Stats.DownloadedFiles != 1 {
+		select {
+		case <-deadline:
+			t.Fatalf("first file did not complete while paused")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	select {
+	case <-store.started:
+		t.Fatalf("a new file started while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if state := ctrl.Status().State; state != DownloadPaused {
+		t.Fatalf("State = %v, want paused", state)
+	}
+
+	ctrl.Resume()
+	for i := 0; i < 2; i++ {
+		<-store.started
+		store.release <- struct{}{}
+	}
+
+	stats, err := ctrl.Wait()
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if stats.DownloadedFiles != 3 {
+		t.Fatalf("DownloadedFiles = %d, want 3", stats.DownloadedFiles)
+	}
+	if state := ctrl.Status().State; state != DownloadCompleted {
+		t.Fatalf("State = %v, want completed", state)
+	}
+}
+
+func TestDownloadController_Cancel(t *testing.T) {
+	store, resolver, jobs := newGatedDownload(t, 3)
+	ctrl := NewDownloader(resolver, store).StartDownloadAsync(context.Background(), jobs, nil, &DownloadOptions{Concurrency: 1})
+
+	<-store.started
+	ctrl.Cancel()
+
+	select {
+	case <-ctrl.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("download did not stop after Cancel")
+	}
+
+	stats, err := ctrl.Wait()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Wait() error = %v, want context.Canceled", err)
+	}
+	if stats.DownloadedFiles != 0 {
+		t.Fatalf("DownloadedFiles = %d, want 0", stats.DownloadedFiles)
+	}
+	if state := ctrl.Status().State; state != DownloadCancelled {
+		t.Fatalf("State = %v, want cancelled", state)
+	}
+}
+
+// flakyStorage fails the first read of every blob with a retryable error.
+type flakyStorage struct {
+	storage.Storage
+	mu     sync.Mutex
+	failed map[digest.Digest]bool
+}
+
+func (f *flakyStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	f.mu.Lock()
+	fail := !f.failed[dgst]
+	f.failed[dgst] = true
+	f.mu.Unlock()
+	if fail {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return f.Storage.ReadBlob(ctx, dgst, offset, length)
+}
+
+func TestDownloadController_StatusIsSnapshot(t *testing.T) {
+	base, resolver, jobs := newGatedDownload(t, 8)
+	store := &flakyStorage{Storage: base.Storage, failed: make(map[digest.Digest]bool)}
+	ctrl := NewDownloader(resolver, store).StartDownloadAsync(context.Background(), jobs, nil, &DownloadOptions{Concurrency: 4, MaxRetries: 3})
+
+	// Reading the snapshot while workers record retries must not race
+	// (run with -race), and later retries must not show up in it.
+	for {
+		status := ctrl.Status()
+		total := 0
+		for _, n := range status.Stats.RetryReasons {
+			total += n
+		}
+		if total != status.Stats.Retries {
+			t.Fatalf("RetryReasons sum to %d, want Retries = %d", total, status.Stats.Retries)
+		}
+		if status.State == DownloadCompleted {
+			break
+		}
+		select {
+		case <-ctrl.Done():
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	stats, err := ctrl.Wait()
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if stats.DownloadedFiles != 8 || stats.RetryReasons["unexpected_eof"] != 8 {
+		t.Fatalf("DownloadedFiles = %d, RetryReasons = %v, want 8 files and 8 unexpected_eof retries", stats.DownloadedFiles, stats.RetryReasons)
+	}
+}
@@ -1,13 +1,20 @@
 package stargzget
 
 import (
+	"compress/flate"
 	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
 	"github.com/flaneur2020/stargz-get/stargzget/logger"
@@ -32,6 +39,11 @@ type DownloadJob struct {
 	BlobDigest digest.Digest // Which blob contains this file
 	Size       int64         // File size
 	OutputPath string        // Where to save the file locally
+	Mode       os.FileMode   // File mode from the TOC (applied with Ownership)
+	UID        int           // Owner from the TOC (applied with Ownership)
+	GID        int           // Group from the TOC (applied with Ownership)
+	LinkTo     string        // If set, OutputPath is made a hard link to this output path of another job instead of being downloaded
+	ModTime    time.Time     // Modification time from the TOC (recorded in archive entries)
 }
 
 // DownloadStats contains statistics about a download operation
@@ -40,16 +52,69 @@ type DownloadStats struct {
 	TotalBytes      int64
 	DownloadedFiles int
 	DownloadedBytes int64
-	FailedFiles     int // Number of files that failed after all retries
-	Retries         int // Total number of retries performed
+	FailedFiles     int            // Number of files that failed after all retries
+	Retries         int            // Total number of retries performed
+	RetryReasons    map[string]int // Retries by the cause of the failed attempt (see errors.Reason), e.g. "http_503"
+	Stalls          int            // Times the download went StallTimeout without progress
+	Chunks          int            // Chunks decoded and written
+	MemberCacheHits int            // Chunks served from a gzip member already decoded for another chunk
+	ResumedChunks   int            // Chunks a retry kept from an earlier attempt of its file instead of fetching again
+	ChunkCacheHits  int            // Chunks served from DownloadOptions.ChunkCache instead of the blob
+	BlockedFiles    int            // Files DownloadOptions.ContentFilter blocked by content, and hard links to blocked files
+	PathIssues      []PathIssue    // Files renamed, skipped or rejected by the portability checks, and duplicate jobs dropped
+	Filtered        []FilteredFile // Files DownloadOptions.ContentFilter flagged or blocked, by name or content
+	Blobs           []BlobStats    // Per-blob transfer metrics, ordered by digest; filled in when the download finishes
+	Fetches         []FetchAudit   // Requested ranges against planned ones per blob, ordered by digest, when DownloadOptions.AuditFetches is set
+}
+
+// clone returns a copy of st that shares no map or slice with it, so a
+// snapshot can be read while workers keep updating st under the session lock.
+func (st *DownloadStats) clone() DownloadStats {
+	c := *st
+	c.RetryReasons = maps.Clone(st.RetryReasons)
+	c.PathIssues = slices.Clone(st.PathIssues)
+	c.Filtered = slices.Clone(st.Filtered)
+	c.Blobs = slices.Clone(st.Blobs)
+	c.Fetches = slices.Clone(st.Fetches)
+	return c
+}
+
+// finalPaths makes the output paths in st's reports name where tx moves
+// the files, once the download no longer looks them up by staged path.
+func (st *DownloadStats) finalPaths(tx *Transaction) {
+	if tx == nil {
+		return
+	}
+	for i := range st.PathIssues {
+		st.PathIssues[i].OutputPath = tx.Final(st.PathIssues[i].OutputPath)
+		st.PathIssues[i].Renamed = tx.Final(st.PathIssues[i].Renamed)
+	}
+	for i := range st.Filtered {
+		st.Filtered[i].OutputPath = tx.Final(st.Filtered[i].OutputPath)
+	}
 }
 
 // DownloadOptions configures download behavior
 type DownloadOptions struct {
-	MaxRetries               int            // Maximum number of retries per file (default: 3)
-	Concurrency              int            // Number of concurrent workers (default: 4, set to 1 for sequential)
-	OnStatus                 StatusCallback // Optional callback for status updates (file started/completed)
-	SingleFileChunkThreshold int64          // Files >= this size (bytes) may use chunked download (default: 10MB)
+	MaxRetries               int                 // Maximum number of retries per file (default: 3)
+	RetryBackoff             time.Duration       // Wait before a file's first retry, doubling for each further one up to 30s (0 retries at once)
+	Concurrency              int                 // Number of concurrent workers (default: 4, set to 1 for sequential)
+	OnStatus                 StatusCallback      // Optional callback for status updates (file started/completed)
+	SingleFileChunkThreshold int64               // Files >= this size (bytes) may use chunked download (default: 10MB)
+	Ownership                *OwnershipOptions   // Optional ownership remapping/recording for extracted files
+	DisableChunkedSingleFile bool                // Never fetch chunks of one file concurrently (for registries that reset overlapping ranges)
+	Portability              *PortabilityOptions // Optional checks for case collisions, reserved names and path length on the target filesystem
+	OnWarning                WarningCallback     // Optional callback for retries, fallbacks, failed files and stalls
+	StallTimeout             time.Duration       // Report a stall when nothing progresses for this long (0 disables the watchdog)
+	AbortOnStall             bool                // Cancel the download with ErrDownloadStalled when a stall is detected
+	MaxChunkSize             int64               // Reject chunks that claim to decompress to more than this many bytes (default: 1GiB)
+	Provenance               *ProvenanceOptions  // Optional per-file provenance log (JSON lines)
+	Archive                  *ArchiveWriter      // Write files into this archive, named by OutputPath, instead of the filesystem; Ownership is ignored
+	Stats                    *StatsCollector     // Optional collector that accumulates stats across StartDownload calls
+	ContentFilter            ContentFilter       // Optional hook that flags or blocks files by name or leading content, e.g. NewSecretFilter
+	ChunkCache               ChunkCache          // Optional cache of decompressed chunks by chunkDigest, shared across images, e.g. NewDirChunkCache
+	AuditFetches             bool                // Record the byte ranges requested from each blob and report those the plan did not need in DownloadStats.Fetches
+	Transaction              *Transaction        // Optional transaction the jobs' output is staged in; records and stats name the final paths
 }
 
 // jobWithOffset associates a download job with its base offset in the
@@ -57,25 +122,98 @@ type DownloadOptions struct {
 type jobWithOffset struct {
 	job        *DownloadJob
 	baseOffset int64
+	metadata   *FileMetadata // Resolved during planning; nil if resolution failed
+	spoolPath  string        // Spool file holding the content when writing an archive
+
+	// doneChunks holds the offsets of the chunks earlier attempts wrote, so
+	// a retry reopens the output and fetches only the others.
+	chunksMu   sync.Mutex
+	doneChunks map[int64]bool
+}
+
+func (jwo *jobWithOffset) chunkDone(offset int64) bool {
+	jwo.chunksMu.Lock()
+	defer jwo.chunksMu.Unlock()
+	return jwo.doneChunks[offset]
 }
 
+func (jwo *jobWithOffset) markChunkDone(offset int64) {
+	jwo.chunksMu.Lock()
+	defer jwo.chunksMu.Unlock()
+	if jwo.doneChunks == nil {
+		jwo.doneChunks = make(map[int64]bool)
+	}
+	jwo.doneChunks[offset] = true
+}
+
+// resumable reports whether an earlier attempt left chunks worth keeping.
+func (jwo *jobWithOffset) resumable() bool {
+	jwo.chunksMu.Lock()
+	defer jwo.chunksMu.Unlock()
+	return len(jwo.doneChunks) > 0
+}
+
+func (jwo *jobWithOffset) resetChunks() {
+	jwo.chunksMu.Lock()
+	defer jwo.chunksMu.Unlock()
+	jwo.doneChunks = nil
+}
+
+// contentPath returns where the job's downloaded content is on disk.
+func (jwo *jobWithOffset) contentPath() string {
+	if jwo.spoolPath != "" {
+		return jwo.spoolPath
+	}
+	return jwo.job.OutputPath
+}
+
+// Downloader fetches the files of DownloadJobs. It is safe for concurrent
+// use: StartDownload calls from different goroutines share its resolver's
+// TOCs and, when they set the same ChunkCache, its chunks.
 type Downloader interface {
 	// StartDownload downloads a list of files with progress tracking and retry support
 	// If opts is nil, uses default options (MaxRetries: 3)
 	StartDownload(ctx context.Context, jobs []*DownloadJob, progress ProgressCallback, opts *DownloadOptions) (*DownloadStats, error)
+
+	// StartDownloadAsync starts the same download in the background and
+	// returns a controller to pause, resume, cancel and inspect it.
+	StartDownloadAsync(ctx context.Context, jobs []*DownloadJob, progress ProgressCallback, opts *DownloadOptions) DownloadController
+
+	// Walk streams the regular files of one layer to fn, in the order they
+	// are stored, decoding the blob as it is read.
+	Walk(ctx context.Context, blobDigest digest.Digest, fn WalkFunc) error
 }
 
 type downloader struct {
-	resolver BlobResolver
-	storage  storage.Storage
+	resolver   BlobResolver
+	storage    storage.Storage
+	boundaries *memberBoundaries
+	ends       *memberEnds // Ends of the members a session plans to read; nil outside sessions
 }
 
 const defaultSingleFileChunkThreshold int64 = 10 * 1024 * 1024 // 10MB
 
+// defaultMaxChunkSize caps the decompressed size a TOC may claim for one
+// chunk. eStargz builders split files into chunks of a few MiB, so only a
+// broken or malicious TOC comes near it.
+const defaultMaxChunkSize int64 = 1 << 30 // 1GiB
+
+// chunkStreamThreshold is the chunk size above which chunks are written to
+// the output file as they are decoded instead of being buffered in memory.
+const chunkStreamThreshold int64 = 8 * 1024 * 1024 // 8MB
+
+// maxRetryBackoff caps the wait between retries of a file.
+const maxRetryBackoff = 30 * time.Second
+
+// chunkedFailureThreshold is how many failed concurrent-range downloads of a
+// blob trigger the fallback to sequential streaming for that blob.
+const chunkedFailureThreshold = 2
+
 func NewDownloader(resolver BlobResolver, storage storage.Storage) Downloader {
 	return &downloader{
-		resolver: resolver,
-		storage:  storage,
+		resolver:   resolver,
+		storage:    storage,
+		boundaries: newMemberBoundaries(),
 	}
 }
 
@@ -84,6 +222,34 @@ func (d *downloader) StartDownload(ctx context.Context, jobs []*DownloadJob, pro
 		return &DownloadStats{}, nil
 	}
 
+	session, planned := d.newSession(jobs, progress, opts, nil)
+	return session.run(ctx, planned)
+}
+
+func (d *downloader) StartDownloadAsync(ctx context.Context, jobs []*DownloadJob, progress ProgressCallback, opts *DownloadOptions) DownloadController {
+	ctx, cancel := context.WithCancel(ctx)
+	ctrl := &downloadController{
+		cancel: cancel,
+		gate:   &pauseGate{},
+		done:   make(chan struct{}),
+	}
+
+	if len(jobs) == 0 {
+		ctrl.finish(&DownloadStats{}, nil)
+		return ctrl
+	}
+
+	session, planned := d.newSession(jobs, progress, opts, ctrl.gate)
+	ctrl.session = session
+	go func() {
+		ctrl.finish(session.run(ctx, planned))
+	}()
+	return ctrl
+}
+
+// newSession applies option defaults and computes each job's progress
+// offset. gate may be nil for downloads that cannot be paused.
+func (d *downloader) newSession(jobs []*DownloadJob, progress ProgressCallback, opts *DownloadOptions, gate *pauseGate) (*downloadSession, []*jobWithOffset) {
 	// Use default options if not provided
 	if opts == nil {
 		opts = &DownloadOptions{
@@ -106,6 +272,24 @@ func (d *downloader) StartDownload(ctx context.Context, jobs []*DownloadJob, pro
 		opts.SingleFileChunkThreshold = defaultSingleFileChunkThreshold
 	}
 
+	if opts.MaxChunkSize <= 0 {
+		opts.MaxChunkSize = defaultMaxChunkSize
+	}
+
+	ownership := opts.Ownership
+	if opts.Archive != nil {
+		ownership = nil
+		if !opts.Archive.supportsLinks() {
+			jobs = withoutLinks(jobs)
+		}
+	}
+
+	jobs, duplicates := dedupeOutputPaths(jobs)
+	jobs, issues, planErr := planPortablePaths(jobs, opts.Portability)
+	issues = append(duplicates, issues...)
+	jobs, filtered := planContentFilter(jobs, opts.ContentFilter)
+	jobs, links := splitLinkJobs(jobs, issues)
+
 	// Calculate total size
 	var totalSize int64
 	for _, job := range jobs {
@@ -113,23 +297,115 @@ func (d *downloader) StartDownload(ctx context.Context, jobs []*DownloadJob, pro
 	}
 
 	stats := &DownloadStats{
-		TotalFiles: len(jobs),
+		TotalFiles: len(jobs) + len(links),
 		TotalBytes: totalSize,
+		PathIssues: issues,
+		Filtered:   filtered,
+	}
+
+	// Each session meters its own reads so per-blob stats are not mixed
+	// with those of concurrent downloads sharing the downloader.
+	meter := newBlobMeter()
+	if opts.AuditFetches {
+		sizer, _ := d.storage.(storage.BlobSizer)
+		meter.audit = newFetchAuditor(sizer)
+	}
+	session := &downloadSession{
+		d:           &downloader{resolver: d.resolver, storage: meter.wrap(contextStorage{d.storage}), boundaries: d.boundaries, ends: newMemberEnds()},
+		meter:       meter,
+		opts:        opts,
+		progress:    progress,
+		totalSize:   totalSize,
+		stats:       stats,
+		owner:       newOwnershipApplier(ownership, opts.Transaction),
+		prov:        newProvenanceLog(opts.Provenance),
+		members:     newMemberCache(),
+		streams:     newLayerStreams(),
+		gate:        gate,
+		planErr:     planErr,
+		links:       links,
+		activeFiles: make([]string, 0, opts.Concurrency),
+		verdicts:    make(map[string]FilterVerdict),
+		blocked:     make(map[string]bool),
+	}
+	for _, hit := range filtered {
+		if hit.Action == FilterBlock {
+			session.blocked[hit.OutputPath] = true
+		}
+	}
+
+	planned := make([]*jobWithOffset, 0, len(jobs))
+	var currentOffset int64
+	for _, job := range jobs {
+		planned = append(planned, &jobWithOffset{
+			job:        job,
+			baseOffset: currentOffset,
+		})
+		currentOffset += job.Size
+	}
+
+	return session, planned
+}
+
+// run executes the planned jobs on a pool of workers and returns the final
+// stats. If ctx is cancelled, unstarted jobs are skipped and ctx.Err() is
+// returned alongside the partial stats; a download aborted by the stall
+// watchdog returns its ErrDownloadStalled error instead.
+func (s *downloadSession) run(ctx context.Context, planned []*jobWithOffset) (*DownloadStats, error) {
+	opts := s.opts
+	began := time.Now()
+	defer func() { opts.Stats.record(s.stats, time.Since(began)) }()
+	if s.planErr != nil {
+		return s.stats, s.planErr
+	}
+	for _, hit := range s.stats.Filtered {
+		s.warnFiltered(hit)
+	}
+
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	defer s.streams.cleanup()
+
+	// Resolve metadata up front so gzip members shared by several files
+	// (min-chunk-size images) are decoded once for all of them.
+	for _, jwo := range planned {
+		if ctx.Err() != nil {
+			break
+		}
+		var meta *FileMetadata
+		err := recoverJob(jwo.job, func() (err error) {
+			meta, err = s.d.resolver.FileMetadata(ctx, jwo.job.BlobDigest, jwo.job.Path)
+			return err
+		})
+		if err == nil && meta != nil {
+			jwo.metadata = meta
+			var spans []ChunkSpan
+			if meta.Streamed != "" {
+				s.streams.want(jwo.job.BlobDigest, jwo.job.Path)
+			} else {
+				s.members.reference(jwo.job.BlobDigest, meta.Chunks)
+				spans = s.chunkSpans(ctx, jwo.job)
+				s.d.ends.add(jwo.job.BlobDigest, spans)
+			}
+			if s.meter.audit != nil {
+				s.meter.audit.plan(jwo.job.BlobDigest, meta, spans)
+			}
+		}
 	}
 
 	// Notify the callback of total size before starting
-	if progress != nil {
-		progress(0, totalSize)
+	if s.progress != nil {
+		s.progress(0, s.totalSize)
 	}
 
 	// Create a channel for distributing jobs to workers
-	jobChan := make(chan *jobWithOffset, len(jobs))
+	jobChan := make(chan *jobWithOffset, len(planned))
+	s.queued.Store(int64(len(planned)))
 
-	// Mutex for protecting shared state
-	var mu sync.Mutex
-
-	// Track active downloads for status updates
-	activeFiles := make([]string, 0, opts.Concurrency)
+	stopWatchdog := make(chan struct{})
+	if opts.StallTimeout > 0 {
+		go s.watchStalls(stopWatchdog, abort)
+	}
 
 	// WaitGroup to wait for all workers to complete
 	var wg sync.WaitGroup
@@ -140,137 +416,377 @@ func (d *downloader) StartDownload(ctx context.Context, jobs []*DownloadJob, pro
 		go func() {
 			defer wg.Done()
 			for jwo := range jobChan {
-				d.processDownloadJob(ctx, jwo, stats, totalSize, progress, opts, &mu, &activeFiles)
+				s.queued.Add(-1)
+				if err := s.gate.wait(ctx); err != nil {
+					continue
+				}
+				s.processDownloadJob(ctx, jwo)
 			}
 		}()
 	}
 
 	// Send all jobs to the channel with pre-calculated offsets
-	var currentOffset int64
-	for _, job := range jobs {
-		jobChan <- &jobWithOffset{
-			job:        job,
-			baseOffset: currentOffset,
-		}
-		currentOffset += job.Size
+	for _, jwo := range planned {
+		jobChan <- jwo
 	}
 	close(jobChan)
 
 	// Wait for all workers to complete
 	wg.Wait()
+	close(stopWatchdog)
+
+	// Every link target has been written now.
+	s.linkFiles(ctx, s.links)
+
+	blobs := s.meter.snapshot()
+	var fetches []FetchAudit
+	if s.meter.audit != nil {
+		fetches = s.meter.audit.audit(ctx)
+	}
+	s.mu.Lock()
+	s.stats.Blobs = blobs
+	s.stats.Fetches = fetches
+	s.stats.MemberCacheHits = int(s.members.hits.Load())
+	s.stats.Chunks = int(s.chunks.Load())
+	s.stats.ResumedChunks = int(s.resumed.Load())
+	s.stats.ChunkCacheHits = int(s.cacheHits.Load())
+	s.stats.finalPaths(opts.Transaction)
+	s.mu.Unlock()
 
-	return stats, nil
+	if err := s.owner.flush(); err != nil {
+		return s.stats, stargzerrors.ErrDownloadFailed.WithMessage("failed to write ownership records").WithCause(err)
+	}
+
+	if ctx.Err() != nil {
+		return s.stats, context.Cause(ctx)
+	}
+
+	return s.stats, nil
 }
 
-// processDownloadJob processes jobs from jobChan, handling retries, stats, and status updates.
-func (d *downloader) processDownloadJob(
-	ctx context.Context,
-	jwo *jobWithOffset,
-	stats *DownloadStats,
-	totalSize int64,
-	progress ProgressCallback,
-	opts *DownloadOptions,
-	mu *sync.Mutex,
-	activeFiles *[]string,
-) {
+// chunkSpans returns where the chunks of job's file lie in the blob, so
+// their members can be fetched with bounded ranges. Without them, members
+// are read with open-ended ranges.
+func (s *downloadSession) chunkSpans(ctx context.Context, job *DownloadJob) []ChunkSpan {
+	var spans []ChunkSpan
+	err := recoverJob(job, func() (err error) {
+		spans, err = s.d.resolver.FileChunks(ctx, job.BlobDigest, job.Path)
+		return err
+	})
+	if err != nil {
+		logger.Debug("No compressed spans for %s: %v", job.Path, err)
+	}
+	return spans
+}
+
+// downloadSession holds the state shared by the workers of one StartDownload call.
+type downloadSession struct {
+	d         *downloader
+	opts      *DownloadOptions
+	progress  ProgressCallback
+	totalSize int64
+	stats     *DownloadStats
+	owner     *ownershipApplier
+	prov      *provenanceLog
+	members   *memberCache
+	streams   *layerStreams
+	meter     *blobMeter
+	gate      *pauseGate
+	planErr   error          // Set when the portability checks rejected the job list
+	links     []*DownloadJob // Hard link jobs, created after all content jobs
+
+	queued       atomic.Int64 // Jobs not yet picked up by a worker
+	chunks       atomic.Int64 // Chunks written, for DownloadStats.Chunks
+	resumed      atomic.Int64 // Chunks kept across retries, for DownloadStats.ResumedChunks
+	cacheHits    atomic.Int64 // Chunks served from the chunk cache, for DownloadStats.ChunkCacheHits
+	lastProgress atomic.Int64 // Unix nanoseconds of the last progress seen by the stall watchdog
+
+	// mu protects stats, activeFiles, chunkedFailures, verdicts and
+	// blocked, and serializes progress callbacks.
+	mu              sync.Mutex
+	activeFiles     []string
+	chunkedFailures map[digest.Digest]int
+	verdicts        map[string]FilterVerdict // Content filter verdicts by output path, kept across retries
+	blocked         map[string]bool          // Output paths the content filter blocked
+
+	// warnMu serializes OnWarning callbacks.
+	warnMu sync.Mutex
+}
+
+// processDownloadJob downloads one job, handling retries, stats, and status updates.
+func (s *downloadSession) processDownloadJob(ctx context.Context, jwo *jobWithOffset) {
 	downloaded := false
+	attempts := 0
+	started := time.Now()
 	var lastErr error
+	defer removeSpool(jwo)
+	ctx = storage.WithOperation(ctx, storage.Operation{Path: jwo.job.Path})
 
 	// Add to active files and notify status
-	mu.Lock()
-	*activeFiles = append(*activeFiles, jwo.job.Path)
-	if opts.OnStatus != nil {
-		opts.OnStatus(append([]string{}, *activeFiles...), stats.DownloadedFiles, stats.TotalFiles)
+	s.mu.Lock()
+	s.activeFiles = append(s.activeFiles, jwo.job.Path)
+	if s.opts.OnStatus != nil {
+		s.opts.OnStatus(append([]string{}, s.activeFiles...), s.stats.DownloadedFiles, s.stats.TotalFiles)
 	}
-	mu.Unlock()
+	s.mu.Unlock()
 
 	logger.Debug("Starting download: %s (%d bytes)", jwo.job.Path, jwo.job.Size)
 
 	// Try downloading with retries
-	for attempt := 0; attempt <= opts.MaxRetries; attempt++ {
+	for attempt := 0; attempt <= s.opts.MaxRetries; attempt++ {
+		if ctx.Err() != nil {
+			lastErr = ctx.Err()
+			break
+		}
 		if attempt > 0 {
-			logger.Warn("Retrying download (attempt %d/%d): %s - %v", attempt, opts.MaxRetries, jwo.job.Path, lastErr)
-			mu.Lock()
-			stats.Retries++
-			mu.Unlock()
+			logger.Warn("Retrying download (attempt %d/%d): %s - %v", attempt, s.opts.MaxRetries, jwo.job.Path, lastErr)
+			s.mu.Lock()
+			s.stats.Retries++
+			if s.stats.RetryReasons == nil {
+				s.stats.RetryReasons = make(map[string]int)
+			}
+			s.stats.RetryReasons[stargzerrors.Reason(lastErr)]++
+			s.mu.Unlock()
+			s.meter.update(jwo.job.BlobDigest, func(b *BlobStats) { b.Retries++ })
+			s.warn(Warning{Kind: WarningRetry, BlobDigest: jwo.job.BlobDigest, Path: jwo.job.Path, Attempt: attempt, Err: lastErr})
+			if err := waitRetry(ctx, s.opts.retryDelay(attempt)); err != nil {
+				lastErr = err
+				break
+			}
 		}
 
-		err := d.downloadSingleFile(ctx, jwo.job, jwo.baseOffset, totalSize, progress, mu, opts)
+		attempts++
+		err := recoverJob(jwo.job, func() error { return s.downloadSingleFile(ctx, jwo) })
 		if err == nil {
+			if err := s.owner.apply(jwo.job); err != nil {
+				lastErr = stargzerrors.ErrDownloadFailed.WithDetail("path", jwo.job.Path).WithMessage("failed to apply ownership").WithCause(err)
+				break
+			}
+			if err := s.recordProvenance(jwo, attempts, started); err != nil {
+				lastErr = stargzerrors.ErrDownloadFailed.WithDetail("path", jwo.job.Path).WithMessage("failed to write provenance record").WithCause(err)
+				break
+			}
+			if err := s.archiveFile(jwo); err != nil {
+				lastErr = stargzerrors.ErrDownloadFailed.WithDetail("path", jwo.job.Path).WithMessage("failed to write archive entry").WithCause(err)
+				break
+			}
 			downloaded = true
-			mu.Lock()
-			stats.DownloadedFiles++
-			stats.DownloadedBytes += jwo.job.Size
-			mu.Unlock()
+			s.mu.Lock()
+			s.stats.DownloadedFiles++
+			s.stats.DownloadedBytes += jwo.job.Size
+			s.mu.Unlock()
+			s.opts.Stats.recordFile(time.Since(started))
+			s.meter.update(jwo.job.BlobDigest, func(b *BlobStats) {
+				b.Files++
+				b.Bytes += jwo.job.Size
+			})
 			logger.Info("Successfully downloaded: %s (%d bytes)", jwo.job.Path, jwo.job.Size)
 			break
 		}
 
 		lastErr = err
-		// If this wasn't the last attempt, we'll retry
+		// Chunks kept from earlier attempts cannot be trusted once the
+		// blob's content changed; the next attempt fetches the whole file.
+		if changed := contentChanged(jwo.job, err); changed != nil {
+			logger.Warn("%s: %v; fetching the whole file again", jwo.job.Path, changed)
+			jwo.resetChunks()
+			lastErr = changed
+		}
+		// Retrying cannot fix auth failures, missing blobs and the like;
+		// give up at once so the real error is reported.
+		if stargzerrors.IsPermanent(err) {
+			logger.Debug("Not retrying %s: permanent error: %v", jwo.job.Path, err)
+			break
+		}
 	}
 
 	// Remove from active files and notify status
-	mu.Lock()
-	for i, f := range *activeFiles {
+	s.mu.Lock()
+	for i, f := range s.activeFiles {
 		if f == jwo.job.Path {
-			*activeFiles = append((*activeFiles)[:i], (*activeFiles)[i+1:]...)
+			s.activeFiles = append(s.activeFiles[:i], s.activeFiles[i+1:]...)
 			break
 		}
 	}
-	if opts.OnStatus != nil {
-		opts.OnStatus(append([]string{}, *activeFiles...), stats.DownloadedFiles, stats.TotalFiles)
+	if s.opts.OnStatus != nil {
+		s.opts.OnStatus(append([]string{}, s.activeFiles...), s.stats.DownloadedFiles, s.stats.TotalFiles)
 	}
-	mu.Unlock()
+	s.mu.Unlock()
 
-	if !downloaded {
-		mu.Lock()
-		stats.FailedFiles++
-		mu.Unlock()
-		logger.Error("Failed to download after %d attempts: %s - %v", opts.MaxRetries+1, jwo.job.Path, lastErr)
+	if !downloaded && s.blockedOutput(jwo.job.OutputPath) {
+		if s.opts.Archive == nil {
+			os.Remove(jwo.job.OutputPath)
+		}
+		s.mu.Lock()
+		s.stats.BlockedFiles++
+		s.mu.Unlock()
+		logger.Info("Blocked by content filter: %s", jwo.job.Path)
+	} else if !downloaded {
+		// An ignored range, expired access or changed content says more
+		// than the DOWNLOAD_FAILED wrapping it.
+		if se := stargzerrors.MidStreamError(lastErr); se != nil {
+			lastErr = se.WithDetail("path", jwo.job.Path)
+		}
+		class := string(stargzerrors.Classify(lastErr))
+		if se, ok := lastErr.(*stargzerrors.StargzError); ok {
+			lastErr = se.WithDetail("errorClass", class).WithDetail("attempt", attempts)
+		} else if lastErr != nil {
+			lastErr = stargzerrors.ErrDownloadFailed.WithDetail("path", jwo.job.Path).WithDetail("errorClass", class).WithDetail("attempt", attempts).WithCause(lastErr)
+		}
+		s.mu.Lock()
+		s.stats.FailedFiles++
+		s.mu.Unlock()
+		logger.Error("Failed to download after %d attempts: %s - %v", attempts, jwo.job.Path, lastErr)
+		s.warn(Warning{Kind: WarningFileFailed, BlobDigest: jwo.job.BlobDigest, Path: jwo.job.Path, Err: lastErr})
 	}
 }
 
-// downloadSingleFile downloads a single file
-func (d *downloader) downloadSingleFile(ctx context.Context, job *DownloadJob, baseOffset int64, totalSize int64, progress ProgressCallback, mu *sync.Mutex, opts *DownloadOptions) error {
-	// Create target directory if needed
-	targetDir := filepath.Dir(job.OutputPath)
-	if err := os.MkdirAll(targetDir, 0o755); err != nil {
-		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+// recoverJob runs fn for job and turns a panic into an ErrWorkerPanic
+// attributed to the job's file, so one malformed TOC entry fails that file
+// instead of the whole process.
+func recoverJob(job *DownloadJob, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError(job, r)
+		}
+	}()
+	return fn()
+}
+
+// panicError describes a panic recovered while processing job, logging the
+// stack so the bug can be reported.
+func panicError(job *DownloadJob, r interface{}) error {
+	logger.Error("Recovered panic while processing %s: %v\n%s", job.Path, r, debug.Stack())
+	return stargzerrors.ErrWorkerPanic.
+		WithMessage(fmt.Sprintf("internal error while processing file: %v", r)).
+		WithDetail("path", job.Path).
+		WithDetail("blobDigest", job.BlobDigest.String())
+}
+
+// retryDelay returns how long to wait before the given retry (1 for the
+// first).
+func (o *DownloadOptions) retryDelay(attempt int) time.Duration {
+	if o.RetryBackoff <= 0 || attempt < 1 {
+		return 0
+	}
+	delay := o.RetryBackoff
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
 	}
+	return min(delay, maxRetryBackoff)
+}
 
-	// Create target file
-	outFile, err := os.Create(job.OutputPath)
+// waitRetry sleeps for delay unless ctx ends first.
+func waitRetry(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// warn forwards w to the OnWarning callback, if any.
+func (s *downloadSession) warn(w Warning) {
+	if s.opts.OnWarning == nil {
+		return
+	}
+	s.warnMu.Lock()
+	defer s.warnMu.Unlock()
+	s.opts.OnWarning(w)
+}
+
+// downloadSingleFile downloads a single file
+func (s *downloadSession) downloadSingleFile(ctx context.Context, jwo *jobWithOffset) error {
+	job := jwo.job
+
+	outFile, err := s.createOutput(jwo)
 	if err != nil {
 		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
 	}
 	defer outFile.Close()
 
-	metadata, err := d.resolver.FileMetadata(ctx, job.BlobDigest, job.Path)
-	if err != nil {
-		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+	metadata := jwo.metadata
+	if metadata == nil {
+		metadata, err = s.d.resolver.FileMetadata(ctx, job.BlobDigest, job.Path)
+		if err != nil {
+			return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+		}
+		jwo.metadata = metadata
 	}
 
 	if metadata == nil {
 		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithMessage("missing file metadata")
 	}
 
+	if metadata.Streamed != "" && metadata.Size > 0 {
+		return s.downloadStreamed(ctx, jwo, outFile)
+	}
+
+	if err := checkChunks(job.Path, metadata, s.opts.MaxChunkSize); err != nil {
+		return err
+	}
+
 	if len(metadata.Chunks) == 0 {
-		if progress != nil && job.Size == 0 {
-			mu.Lock()
-			progress(baseOffset, totalSize)
-			mu.Unlock()
+		if s.progress != nil && job.Size == 0 {
+			s.mu.Lock()
+			s.progress(jwo.baseOffset, s.totalSize)
+			s.mu.Unlock()
 		}
 		return nil
 	}
 
+	chunkWorkers := s.chunkWorkersFor(job, metadata)
+	err = s.downloadFileChunks(ctx, jwo, outFile, chunkWorkers)
+	if err != nil && chunkWorkers > 1 && ctx.Err() == nil {
+		s.recordChunkedFailure(job.BlobDigest)
+	}
+	return err
+}
+
+// createOutput creates the file a job is written to: its output path with
+// any missing directories, or a fresh spool file when writing an archive.
+// A retry after some chunks were written reopens the file instead.
+func (s *downloadSession) createOutput(jwo *jobWithOffset) (*os.File, error) {
+	if jwo.resumable() {
+		if f, err := os.OpenFile(jwo.contentPath(), os.O_WRONLY, 0); err == nil {
+			return f, nil
+		}
+		jwo.resetChunks()
+	}
+	if s.opts.Archive == nil {
+		if err := os.MkdirAll(filepath.Dir(jwo.job.OutputPath), 0o755); err != nil {
+			return nil, err
+		}
+		return os.Create(jwo.job.OutputPath)
+	}
+	removeSpool(jwo)
+	f, err := s.opts.Archive.spool()
+	if err != nil {
+		return nil, err
+	}
+	jwo.spoolPath = f.Name()
+	return f, nil
+}
+
+// chunkWorkersFor decides how many parallel range readers to use for a
+// single file. Large multi-chunk files are fetched concurrently unless
+// chunking is disabled or the blob has already misbehaved under it.
+func (s *downloadSession) chunkWorkersFor(job *DownloadJob, metadata *FileMetadata) int {
 	useChunked := len(metadata.Chunks) > 1 &&
-		metadata.Size >= opts.SingleFileChunkThreshold &&
-		job.Size >= opts.SingleFileChunkThreshold
+		metadata.Size >= s.opts.SingleFileChunkThreshold &&
+		job.Size >= s.opts.SingleFileChunkThreshold &&
+		!s.opts.DisableChunkedSingleFile &&
+		!s.sequentialOnly(job.BlobDigest)
 
 	chunkWorkers := 1
 	if useChunked {
-		chunkWorkers = opts.Concurrency
+		chunkWorkers = s.opts.Concurrency
 		if chunkWorkers <= 0 {
 			chunkWorkers = 1
 		}
@@ -281,21 +797,43 @@ func (d *downloader) downloadSingleFile(ctx context.Context, job *DownloadJob, b
 			chunkWorkers = 1
 		}
 	}
+	return chunkWorkers
+}
 
-	return d.downloadFileChunks(ctx, job, metadata, outFile, baseOffset, totalSize, progress, mu, chunkWorkers)
+// recordChunkedFailure counts a failed concurrent-range download for a blob.
+// After chunkedFailureThreshold failures the blob is streamed sequentially
+// for the rest of the session.
+func (s *downloadSession) recordChunkedFailure(blobDigest digest.Digest) {
+	s.mu.Lock()
+	if s.chunkedFailures == nil {
+		s.chunkedFailures = make(map[digest.Digest]int)
+	}
+	s.chunkedFailures[blobDigest]++
+	fallback := s.chunkedFailures[blobDigest] == chunkedFailureThreshold
+	s.mu.Unlock()
+
+	if fallback {
+		logger.Warn("Blob %s failed %d concurrent range downloads; falling back to sequential streaming", blobDigest, chunkedFailureThreshold)
+		s.warn(Warning{Kind: WarningSequentialFallback, BlobDigest: blobDigest})
+	}
 }
 
-func (d *downloader) downloadFileChunks(
+func (s *downloadSession) sequentialOnly(blobDigest digest.Digest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chunkedFailures[blobDigest] >= chunkedFailureThreshold
+}
+
+// downloadFileChunks writes the chunks of jwo's file with workerCount
+// parallel readers, stopping at the first failure. Chunks written by an
+// earlier attempt are skipped, so a retry fetches only what is missing.
+func (s *downloadSession) downloadFileChunks(
 	ctx context.Context,
-	job *DownloadJob,
-	metadata *FileMetadata,
+	jwo *jobWithOffset,
 	outFile *os.File,
-	baseOffset int64,
-	totalSize int64,
-	progress ProgressCallback,
-	mu *sync.Mutex,
 	workerCount int,
 ) error {
+	job, metadata, baseOffset := jwo.job, jwo.metadata, jwo.baseOffset
 	ctxChunk, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -307,6 +845,24 @@ func (d *downloader) downloadFileChunks(
 		workerCount = 1
 	}
 
+	pending := make([]Chunk, 0, len(metadata.Chunks))
+	resumed := 0
+	for _, chunk := range metadata.Chunks {
+		if chunk.Size <= 0 {
+			continue
+		}
+		if jwo.chunkDone(chunk.Offset) {
+			completed += chunk.Size
+			resumed++
+			continue
+		}
+		pending = append(pending, chunk)
+	}
+	if resumed > 0 {
+		s.resumed.Add(int64(resumed))
+		logger.Info("Resuming %s: %d of %d chunks already written", job.Path, resumed, resumed+len(pending))
+	}
+
 	sendErr := func(err error) {
 		if err == nil {
 			return
@@ -321,6 +877,14 @@ func (d *downloader) downloadFileChunks(
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			// A panic here would take the process down with it; fail the
+			// file instead.
+			defer func() {
+				if r := recover(); r != nil {
+					sendErr(panicError(job, r))
+					cancel()
+				}
+			}()
 			for chunk := range chunkJobs {
 				if chunk.Size <= 0 {
 					continue
@@ -330,39 +894,28 @@ func (d *downloader) downloadFileChunks(
 					return
 				}
 
-				data, err := d.readChunk(ctxChunk, job.BlobDigest, job.Path, chunk)
-				if err != nil {
-					sendErr(stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err))
-					cancel()
-					return
-				}
-
-				if int64(len(data)) != chunk.Size {
-					sendErr(stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(io.ErrUnexpectedEOF))
-					cancel()
-					return
-				}
-
-				if _, err := outFile.WriteAt(data, chunk.Offset); err != nil {
-					sendErr(stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err))
+				if err := s.writeChunk(ctxChunk, job, chunk, outFile); err != nil {
+					sendErr(err)
 					cancel()
 					return
 				}
+				jwo.markChunkDone(chunk.Offset)
+				s.chunks.Add(1)
 
-				if progress != nil {
-					newProgress := atomic.AddInt64(&completed, int64(len(data)))
-					mu.Lock()
-					progress(baseOffset+newProgress, totalSize)
-					mu.Unlock()
+				if s.progress != nil {
+					newProgress := atomic.AddInt64(&completed, chunk.Size)
+					s.mu.Lock()
+					s.progress(baseOffset+newProgress, s.totalSize)
+					s.mu.Unlock()
 				}
 			}
 		}()
 	}
 
 chunkLoop:
-	for _, chunk := range metadata.Chunks {
-		if chunk.Size <= 0 {
-			continue
+	for _, chunk := range pending {
+		if err := s.gate.wait(ctxChunk); err != nil {
+			break chunkLoop
 		}
 		select {
 		case <-ctxChunk.Done():
@@ -379,37 +932,200 @@ chunkLoop:
 	default:
 	}
 
+	if err := ctx.Err(); err != nil {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+	}
+
 	if metadata.Size >= 0 {
 		if err := outFile.Truncate(metadata.Size); err != nil {
 			return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
 		}
 	}
 
+	// Chunks kept from an earlier attempt were decoded from what the blob
+	// served then; a file pieced together from two versions of it fails
+	// its TOC digest.
+	if resumed > 0 {
+		if err := checkFileDigest(jwo.contentPath(), metadata.Digest); err != nil {
+			return stargzerrors.ErrContentChanged.WithDetail("path", job.Path).WithCause(err)
+		}
+	}
+
 	return nil
 }
 
-func (d *downloader) readChunk(ctx context.Context, blobDigest digest.Digest, path string, chunk Chunk) ([]byte, error) {
-	reader, err := d.storage.ReadBlob(ctx, blobDigest, chunk.CompressedOffset, 0)
+// checkFileDigest checks the file at path against want, a TOC digest. A
+// missing digest, or one of an unavailable algorithm, passes.
+func checkFileDigest(path, want string) error {
+	wantDigest, err := digest.Parse(want)
+	if err != nil || !wantDigest.Algorithm().Available() {
+		return nil
+	}
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+		return err
 	}
-	defer reader.Close()
+	defer f.Close()
+	got, err := wantDigest.Algorithm().FromReader(f)
+	if err != nil {
+		return err
+	}
+	if got != wantDigest {
+		return fmt.Errorf("resumed file has digest %s, TOC digest is %s", got, wantDigest)
+	}
+	return nil
+}
 
-	gz, err := gzip.NewReader(reader)
+// contentChanged returns err as an ErrContentChanged when it says the blob
+// no longer holds what the TOC describes: a resumed file failed its digest,
+// or a gzip member failed its checksum or did not decode. It returns nil
+// for other errors.
+func contentChanged(job *DownloadJob, err error) *stargzerrors.StargzError {
+	if se := stargzerrors.MidStreamError(err); se != nil {
+		if se.Code == stargzerrors.ErrContentChanged.Code {
+			return se
+		}
+		return nil
+	}
+	var corrupt flate.CorruptInputError
+	if errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt) {
+		return stargzerrors.ErrContentChanged.WithDetail("path", job.Path).WithCause(err)
+	}
+	return nil
+}
+
+// contextStorage ties every body it returns to the request's context, so
+// that cancelling a download, or the chunk workers of a file after one of
+// them fails, aborts reads in flight even when the storage's bodies ignore
+// the context.
+type contextStorage struct {
+	storage.Storage
+}
+
+func (s contextStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	body, err := s.Storage.ReadBlob(ctx, dgst, offset, length)
 	if err != nil {
-		return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+		return nil, err
 	}
-	defer gz.Close()
+	return storage.NewContextReadCloser(ctx, body), nil
+}
 
-	if chunk.InnerOffset > 0 {
-		if _, err := io.CopyN(io.Discard, gz, chunk.InnerOffset); err != nil {
+// writeChunk decodes chunk into outFile at the chunk's offset. Large chunks
+// are streamed so a file stored as one huge chunk is never held in memory.
+func (s *downloadSession) writeChunk(ctx context.Context, job *DownloadJob, chunk Chunk, outFile *os.File) error {
+	sniff := s.opts.ContentFilter != nil && chunk.Offset == 0
+	if chunk.Size > chunkStreamThreshold && !s.members.shared(job.BlobDigest, chunk.CompressedOffset) {
+		if !sniff {
+			return s.d.streamChunk(ctx, job.BlobDigest, job.Path, chunk, io.NewOffsetWriter(outFile, chunk.Offset))
+		}
+		sw := &sniffWriter{w: io.NewOffsetWriter(outFile, 0), check: func(head []byte) error { return s.checkContent(job, head) }}
+		if err := s.d.streamChunk(ctx, job.BlobDigest, job.Path, chunk, sw); err != nil {
+			return err
+		}
+		return sw.flush()
+	}
+
+	data, err := s.readChunk(ctx, job.BlobDigest, job.Path, chunk)
+	if err != nil {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+	}
+	if int64(len(data)) != chunk.Size {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(io.ErrUnexpectedEOF)
+	}
+	if sniff {
+		if err := s.checkContent(job, data[:min(len(data), contentSniffLen)]); err != nil {
+			return err
+		}
+	}
+	if _, err := outFile.WriteAt(data, chunk.Offset); err != nil {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+	}
+	return nil
+}
+
+// checkChunks rejects chunk lists that would make the downloader allocate or
+// write more than the file can hold: negative offsets, chunks larger than
+// maxChunkSize, and chunks reaching past the end of the file.
+func checkChunks(path string, metadata *FileMetadata, maxChunkSize int64) error {
+	for _, chunk := range metadata.Chunks {
+		var problem string
+		switch {
+		case chunk.Offset < 0 || chunk.Size < 0 || chunk.InnerOffset < 0:
+			problem = fmt.Sprintf("chunk at offset %d has a negative offset or size", chunk.Offset)
+		case chunk.Size > maxChunkSize:
+			problem = fmt.Sprintf("chunk at offset %d claims %d bytes, more than the limit of %d", chunk.Offset, chunk.Size, maxChunkSize)
+		case metadata.Size >= 0 && chunk.Offset+chunk.Size > metadata.Size:
+			problem = fmt.Sprintf("chunk at offset %d (%d bytes) extends past the end of the %d-byte file", chunk.Offset, chunk.Size, metadata.Size)
+		default:
+			continue
+		}
+		return stargzerrors.ErrChunkLimit.WithMessage(problem).WithDetail("path", path)
+	}
+	return nil
+}
+
+// readChunk returns the decompressed bytes of a chunk, from the chunk cache
+// when it has the chunk's digest and from the blob otherwise.
+func (s *downloadSession) readChunk(ctx context.Context, blobDigest digest.Digest, path string, chunk Chunk) ([]byte, error) {
+	cache := s.opts.ChunkCache
+	chunkDigest, err := digest.Parse(chunk.Digest)
+	if cache == nil || err != nil {
+		return s.readBlobChunk(ctx, blobDigest, path, chunk)
+	}
+	if data, ok := cache.Get(chunkDigest); ok && int64(len(data)) == chunk.Size {
+		s.cacheHits.Add(1)
+		// The member this chunk would have been decoded from is needed by
+		// one chunk fewer.
+		s.members.release(blobDigest, chunk.CompressedOffset)
+		return data, nil
+	}
+
+	data, err := s.readBlobChunk(ctx, blobDigest, path, chunk)
+	if err != nil {
+		return nil, err
+	}
+	// Only chunks that match their digest are cached; a mismatch is left
+	// to the file's own verification.
+	if chunkDigest.Algorithm().Available() && chunkDigest.Algorithm().FromBytes(data) == chunkDigest {
+		if err := cache.Put(chunkDigest, data); err != nil {
+			logger.Debug("Not caching chunk %s: %v", chunkDigest, err)
+		}
+	}
+	return data, nil
+}
+
+// readBlobChunk reads a chunk from the blob. Chunks living in a gzip member
+// shared with other chunks of this session are served from the member
+// cache so the member is fetched and decoded only once.
+func (s *downloadSession) readBlobChunk(ctx context.Context, blobDigest digest.Digest, path string, chunk Chunk) ([]byte, error) {
+	if s.members.shared(blobDigest, chunk.CompressedOffset) {
+		member, err := s.members.get(ctx, blobDigest, chunk.CompressedOffset, func() ([]byte, error) {
+			return s.d.readMember(ctx, blobDigest, chunk.CompressedOffset, s.opts.MaxChunkSize)
+		})
+		if err != nil {
 			return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
 		}
+		end := chunk.InnerOffset + chunk.Size
+		if chunk.InnerOffset < 0 || end > int64(len(member)) {
+			return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(io.ErrUnexpectedEOF)
+		}
+		return append([]byte(nil), member[chunk.InnerOffset:end]...), nil
+	}
+
+	return s.d.readChunk(ctx, blobDigest, path, chunk)
+}
+
+func (d *downloader) readChunk(ctx context.Context, blobDigest digest.Digest, path string, chunk Chunk) ([]byte, error) {
+	data, done, err := d.openChunk(ctx, blobDigest, path, chunk)
+	if err != nil {
+		return nil, err
 	}
+	defer done()
 
 	buf := make([]byte, chunk.Size)
-	n, err := io.ReadFull(gz, buf)
+	n, err := io.ReadFull(data, buf)
 	if err != nil && err != io.EOF {
+		d.ends.forget(blobDigest, chunk.CompressedOffset, err)
 		return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
 	}
 	if int64(n) != chunk.Size {
@@ -418,3 +1134,71 @@ func (d *downloader) readChunk(ctx context.Context, blobDigest digest.Digest, pa
 
 	return buf, nil
 }
+
+// streamChunk decodes chunk into w without buffering it.
+func (d *downloader) streamChunk(ctx context.Context, blobDigest digest.Digest, path string, chunk Chunk, w io.Writer) error {
+	data, done, err := d.openChunk(ctx, blobDigest, path, chunk)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	n, err := io.Copy(w, data)
+	if err != nil {
+		d.ends.forget(blobDigest, chunk.CompressedOffset, err)
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+	}
+	if n != chunk.Size {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// openChunk returns a reader for the decompressed bytes of chunk, at most
+// chunk.Size of them, and a function releasing the blob body and gzip reader.
+func (d *downloader) openChunk(ctx context.Context, blobDigest digest.Digest, path string, chunk Chunk) (io.Reader, func(), error) {
+	reader, gz, err := d.openMember(ctx, blobDigest, chunk.CompressedOffset)
+	if err != nil {
+		return nil, nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+	}
+	done := func() {
+		putGzipReader(gz)
+		reader.Close()
+	}
+
+	// A chunk never spans members. Stopping at the member's end turns a
+	// chunk that claims otherwise into a short read instead of data taken
+	// from the next member.
+	gz.Multistream(false)
+
+	if chunk.InnerOffset > 0 {
+		if _, err := io.CopyN(io.Discard, gz, chunk.InnerOffset); err != nil {
+			done()
+			return nil, nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+		}
+	}
+	return io.LimitReader(gz, chunk.Size), done, nil
+}
+
+// readMember decompresses the single gzip member starting at compressedOffset.
+// Members decoding to more than limit bytes are rejected.
+func (d *downloader) readMember(ctx context.Context, blobDigest digest.Digest, compressedOffset int64, limit int64) ([]byte, error) {
+	reader, gz, err := d.openMember(ctx, blobDigest, compressedOffset)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	defer putGzipReader(gz)
+
+	// Stop at the end of this member instead of continuing into the next one.
+	gz.Multistream(false)
+	data, err := io.ReadAll(io.LimitReader(gz, limit+1))
+	if err != nil {
+		d.ends.forget(blobDigest, compressedOffset, err)
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, stargzerrors.ErrChunkLimit.WithMessage(fmt.Sprintf("gzip member at offset %d decodes to more than %d bytes", compressedOffset, limit))
+	}
+	return data, nil
+}
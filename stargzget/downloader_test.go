@@ -2,18 +2,24 @@ package stargzget
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
 	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
 	"github.com/flaneur2020/stargz-get/stargzget/storage"
 	"github.com/opencontainers/go-digest"
 )
@@ -51,6 +57,26 @@ func (m *mockBlobResolver) TOC(ctx context.Context, blobDigest digest.Digest) (*
 	return &estargzutil.JTOC{}, nil
 }
 
+func (m *mockBlobResolver) FileChunks(ctx context.Context, blobDigest digest.Digest, path string) ([]ChunkSpan, error) {
+	meta, err := m.FileMetadata(ctx, blobDigest, path)
+	if err != nil {
+		return nil, err
+	}
+	// Like the real resolver, a member ends where the next one starts; the
+	// end of the last one is not known.
+	spans := make([]ChunkSpan, len(meta.Chunks))
+	for i, chunk := range meta.Chunks {
+		spans[i].Chunk = chunk
+		for _, next := range meta.Chunks[i:] {
+			if next.CompressedOffset > chunk.CompressedOffset {
+				spans[i].CompressedLength = next.CompressedOffset - chunk.CompressedOffset
+				break
+			}
+		}
+	}
+	return spans, nil
+}
+
 func addFileToStorage(t *testing.T, store *storage.MockStorage, resolver *mockBlobResolver, path string, content []byte, chunkSize int64) digest.Digest {
 	t.Helper()
 
@@ -114,9 +140,11 @@ func gzipCompress(t *testing.T, data []byte) []byte {
 }
 
 type failingStorage struct {
+	mu         sync.Mutex
 	base       *storage.MockStorage
 	failCounts map[digest.Digest]int
 	attempts   map[digest.Digest]int
+	failErr    error // Returned on failure; defaults to io.ErrUnexpectedEOF
 }
 
 func newFailingStorage(base *storage.MockStorage, failCounts map[digest.Digest]int) *failingStorage {
@@ -132,8 +160,15 @@ func (m *failingStorage) ListBlobs(ctx context.Context) ([]storage.BlobDescripto
 }
 
 func (m *failingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	m.mu.Lock()
 	m.attempts[dgst]++
-	if failTimes, ok := m.failCounts[dgst]; ok && m.attempts[dgst] <= failTimes {
+	failTimes, ok := m.failCounts[dgst]
+	fail := ok && m.attempts[dgst] <= failTimes
+	m.mu.Unlock()
+	if fail {
+		if m.failErr != nil {
+			return nil, m.failErr
+		}
 		return nil, io.ErrUnexpectedEOF
 	}
 	return m.base.ReadBlob(ctx, dgst, offset, length)
@@ -335,6 +370,169 @@ func TestDownloader_SingleFileChunkedDownload(t *testing.T) {
 	}
 }
 
+// offsetFailingStorage fails the first read at failOffset and counts reads
+// by offset.
+type offsetFailingStorage struct {
+	storage.Storage
+	failOffset int64
+	mu         sync.Mutex
+	reads      map[int64]int
+}
+
+func (s *offsetFailingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.reads[offset]++
+	fail := offset == s.failOffset && s.reads[offset] == 1
+	s.mu.Unlock()
+	if fail {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return s.Storage.ReadBlob(ctx, dgst, offset, length)
+}
+
+func TestDownloader_RetryResumesChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("chunk-data"), 64) // 640 bytes, 5 chunks
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, base, resolver, "usr/bin/bash", content, 128)
+	metadata, _ := resolver.FileMetadata(context.Background(), dgst, "usr/bin/bash")
+	chunks := metadata.Chunks
+
+	store := &offsetFailingStorage{Storage: base, failOffset: chunks[2].CompressedOffset, reads: make(map[int64]int)}
+	job := &DownloadJob{Path: "usr/bin/bash", BlobDigest: dgst, Size: int64(len(content)), OutputPath: filepath.Join(t.TempDir(), "bash")}
+	opts := &DownloadOptions{Concurrency: 1, SingleFileChunkThreshold: 256, MaxRetries: 2}
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, opts)
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	if stats.DownloadedFiles != 1 || stats.Retries != 1 || stats.ResumedChunks != 2 {
+		t.Fatalf("stats = %+v, want 1 file downloaded after 1 retry that kept 2 chunks", stats)
+	}
+
+	// Only the failed chunk is read twice; the retry kept the two before it.
+	for i, chunk := range chunks {
+		want := 1
+		if i == 2 {
+			want = 2
+		}
+		if got := store.reads[chunk.CompressedOffset]; got != want {
+			t.Errorf("chunk %d read %d times, want %d", i, got, want)
+		}
+	}
+	data, err := os.ReadFile(job.OutputPath)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("output = %d bytes, err %v; want the original content", len(data), err)
+	}
+}
+
+// tamperingStorage fails the first read at failOffset after overwriting
+// the start of output, as if the chunks written so far had been decoded
+// from another version of the blob.
+type tamperingStorage struct {
+	storage.Storage
+	failOffset int64
+	output     string
+	failed     atomic.Bool
+}
+
+func (s *tamperingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	if offset == s.failOffset && s.failed.CompareAndSwap(false, true) {
+		f, err := os.OpenFile(s.output, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		f.WriteAt([]byte("stale"), 0)
+		f.Close()
+		return nil, io.ErrUnexpectedEOF
+	}
+	return s.Storage.ReadBlob(ctx, dgst, offset, length)
+}
+
+func TestDownloader_ContentChangedRefetchesWholeFile(t *testing.T) {
+	content := bytes.Repeat([]byte("chunk-data"), 64) // 640 bytes, 5 chunks
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, base, resolver, "usr/bin/bash", content, 128)
+	metadata, _ := resolver.FileMetadata(context.Background(), dgst, "usr/bin/bash")
+	metadata.Digest = digest.FromBytes(content).String()
+
+	job := &DownloadJob{Path: "usr/bin/bash", BlobDigest: dgst, Size: int64(len(content)), OutputPath: filepath.Join(t.TempDir(), "bash")}
+	store := &tamperingStorage{Storage: base, failOffset: metadata.Chunks[2].CompressedOffset, output: job.OutputPath}
+	opts := &DownloadOptions{Concurrency: 1, SingleFileChunkThreshold: 256, MaxRetries: 2}
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, opts)
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	// The first retry resumes and fails the digest check; the second
+	// fetches the whole file.
+	if stats.DownloadedFiles != 1 || stats.RetryReasons["unexpected_eof"] != 1 || stats.RetryReasons["content_changed"] != 1 || stats.ResumedChunks != 2 {
+		t.Fatalf("stats = %+v, want a resumed retry that failed as content_changed, then a full one", stats)
+	}
+	data, err := os.ReadFile(job.OutputPath)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("output = %q, err %v; want the original content", data, err)
+	}
+}
+
+func TestDownloader_ReportsMidStreamFailure(t *testing.T) {
+	content := []byte("layer content")
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, base, resolver, "etc/motd", content, 0)
+	store := &errorStorage{Storage: base, err: stargzerrors.ErrRangeIgnored.WithCause(errors.New("asked for bytes from offset 0"))}
+
+	var failure error
+	opts := &DownloadOptions{Concurrency: 1, MaxRetries: 1, OnWarning: func(w Warning) {
+		if w.Kind == WarningFileFailed {
+			failure = w.Err
+		}
+	}}
+	job := &DownloadJob{Path: "etc/motd", BlobDigest: dgst, Size: int64(len(content)), OutputPath: filepath.Join(t.TempDir(), "motd")}
+	stats, _ := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, opts)
+	if stats.FailedFiles != 1 || stats.RetryReasons["range_ignored"] != 1 {
+		t.Fatalf("stats = %+v, want 1 failed file retried once for range_ignored", stats)
+	}
+	if code := stargzerrors.GetErrorCode(failure); code != stargzerrors.ErrRangeIgnored.Code {
+		t.Fatalf("failure = %v, want code %s rather than the DOWNLOAD_FAILED wrapping it", failure, stargzerrors.ErrRangeIgnored.Code)
+	}
+}
+
+// errorStorage fails every blob read with err.
+type errorStorage struct {
+	storage.Storage
+	err error
+}
+
+func (s *errorStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	return nil, s.err
+}
+
+func TestContentChanged(t *testing.T) {
+	job := &DownloadJob{Path: "etc/motd"}
+	tests := []struct {
+		name    string
+		err     error
+		changed bool
+	}{
+		{name: "checksum", err: stargzerrors.ErrDownloadFailed.WithCause(fmt.Errorf("read member: %w", gzip.ErrChecksum)), changed: true},
+		{name: "corrupt deflate", err: stargzerrors.ErrDownloadFailed.WithCause(flate.CorruptInputError(12)), changed: true},
+		{name: "already reported", err: stargzerrors.ErrContentChanged.WithCause(errors.New("digest mismatch")), changed: true},
+		{name: "short read", err: stargzerrors.ErrDownloadFailed.WithCause(io.ErrUnexpectedEOF)},
+		{name: "other mid-stream failure", err: stargzerrors.ErrRangeIgnored.WithCause(gzip.ErrChecksum)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentChanged(job, tt.err)
+			if (got != nil) != tt.changed {
+				t.Fatalf("contentChanged() = %v, want changed %v", got, tt.changed)
+			}
+			if got != nil && got.Code != stargzerrors.ErrContentChanged.Code {
+				t.Fatalf("contentChanged() code = %s", got.Code)
+			}
+		})
+	}
+}
+
 func TestDownloadJob_Creation(t *testing.T) {
 	digest1 := digest.FromString("test-digest")
 
@@ -468,8 +666,12 @@ func TestDownloader_StartDownload_WithRetries(t *testing.T) {
 				})
 			}
 
+			warningsByKind := make(map[WarningKind]int)
 			opts := &DownloadOptions{
 				MaxRetries: tt.maxRetries,
+				OnWarning: func(w Warning) {
+					warningsByKind[w.Kind]++
+				},
 			}
 
 			stats, err := downloader.StartDownload(context.Background(), jobs, nil, opts)
@@ -478,6 +680,13 @@ func TestDownloader_StartDownload_WithRetries(t *testing.T) {
 				return
 			}
 
+			if warningsByKind[WarningRetry] != tt.wantRetries {
+				t.Errorf("retry warnings = %d, want %d", warningsByKind[WarningRetry], tt.wantRetries)
+			}
+			if warningsByKind[WarningFileFailed] != tt.wantFailed {
+				t.Errorf("file-failed warnings = %d, want %d", warningsByKind[WarningFileFailed], tt.wantFailed)
+			}
+
 			if stats.DownloadedFiles != tt.wantSuccess {
 				t.Errorf("DownloadedFiles = %d, want %d", stats.DownloadedFiles, tt.wantSuccess)
 			}
@@ -677,7 +886,7 @@ func TestIntegrationSingleFileChunkedDownload(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
 
-	client := storage.NewRemoteRegistryStorage()
+	client := storage.NewRemoteRegistryStorage(false)
 	manifest, err := client.GetManifest(ctx, imageRef)
 	if err != nil {
 		t.Fatalf("GetManifest(%q) error = %v", imageRef, err)
@@ -765,3 +974,637 @@ func splitImageRef(t *testing.T, ref string) (string, string) {
 
 	return registry, repository
 }
+
+type countingStorage struct {
+	storage.Storage
+	mu      sync.Mutex
+	reads   int
+	lengths []int64
+}
+
+func (c *countingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	c.mu.Lock()
+	c.reads++
+	c.lengths = append(c.lengths, length)
+	c.mu.Unlock()
+	return c.Storage.ReadBlob(ctx, dgst, offset, length)
+}
+
+func TestDownloader_SharedGzipMemberDecodedOnce(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Three small files packed into a single gzip member, as produced by
+	// estargz builders with min-chunk-size > 0.
+	files := []struct {
+		path    string
+		content string
+	}{
+		{"etc/hostname", "box"},
+		{"etc/hosts", "127.0.0.1 localhost"},
+		{"etc/motd", "welcome"},
+	}
+	var packed []byte
+	for _, f := range files {
+		packed = append(packed, f.content...)
+	}
+
+	base := storage.NewMockStorage()
+	dgst := base.AddBlob("application/vnd.test.gzip", gzipCompress(t, packed))
+	resolver := newMockBlobResolver()
+
+	var jobs []*DownloadJob
+	var inner int64
+	for _, f := range files {
+		size := int64(len(f.content))
+		resolver.addFile(dgst, f.path, &FileMetadata{
+			Size:   size,
+			Chunks: []Chunk{{Offset: 0, Size: size, CompressedOffset: 0, InnerOffset: inner}},
+		})
+		jobs = append(jobs, &DownloadJob{
+			Path:       f.path,
+			BlobDigest: dgst,
+			Size:       size,
+			OutputPath: filepath.Join(tempDir, f.path),
+		})
+		inner += size
+	}
+
+	store := &countingStorage{Storage: base}
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, &DownloadOptions{Concurrency: 3})
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	if stats.DownloadedFiles != len(files) {
+		t.Fatalf("DownloadedFiles = %d, want %d", stats.DownloadedFiles, len(files))
+	}
+	if store.reads != 1 {
+		t.Fatalf("blob reads = %d, want 1", store.reads)
+	}
+	if stats.MemberCacheHits != len(files)-1 || stats.Chunks != len(files) {
+		t.Errorf("MemberCacheHits = %d of %d chunks, want %d of %d", stats.MemberCacheHits, stats.Chunks, len(files)-1, len(files))
+	}
+
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(tempDir, f.path))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) error = %v", f.path, err)
+		}
+		if string(data) != f.content {
+			t.Fatalf("%s content = %q, want %q", f.path, data, f.content)
+		}
+	}
+}
+
+func TestDownloadSession_ChunkWorkers(t *testing.T) {
+	dgst := digest.FromString("blob")
+	job := &DownloadJob{Path: "big", BlobDigest: dgst, Size: 1024}
+	metadata := &FileMetadata{
+		Size:   1024,
+		Chunks: make([]Chunk, 8),
+	}
+
+	tests := []struct {
+		name     string
+		opts     DownloadOptions
+		failures int
+		want     int
+	}{
+		{name: "chunked", opts: DownloadOptions{Concurrency: 4, SingleFileChunkThreshold: 256}, want: 4},
+		{name: "disabled", opts: DownloadOptions{Concurrency: 4, SingleFileChunkThreshold: 256, DisableChunkedSingleFile: true}, want: 1},
+		{name: "below threshold", opts: DownloadOptions{Concurrency: 4, SingleFileChunkThreshold: 4096}, want: 1},
+		{name: "one failure keeps chunking", opts: DownloadOptions{Concurrency: 4, SingleFileChunkThreshold: 256}, failures: 1, want: 4},
+		{name: "repeated failures fall back", opts: DownloadOptions{Concurrency: 4, SingleFileChunkThreshold: 256}, failures: chunkedFailureThreshold, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDownloader(newMockBlobResolver(), storage.NewMockStorage()).(*downloader)
+			opts := tt.opts
+			session, _ := d.newSession([]*DownloadJob{job}, nil, &opts, nil)
+			for i := 0; i < tt.failures; i++ {
+				session.recordChunkedFailure(dgst)
+			}
+			if got := session.chunkWorkersFor(job, metadata); got != tt.want {
+				t.Fatalf("chunkWorkersFor() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloader_SyntheticLayer(t *testing.T) {
+	big := bytes.Repeat([]byte("stargz"), 200)
+	contents := map[string][]byte{
+		"etc/hostname": []byte("box"),
+		"etc/hosts":    []byte("127.0.0.1 localhost\n"),
+		"usr/lib/big":  big,
+		"bin/busybox":  []byte("busybox binary"),
+	}
+
+	tests := []struct {
+		name string
+		opts []estargztest.Option
+	}{
+		{name: "one member per chunk", opts: []estargztest.Option{estargztest.WithChunkSize(100)}},
+		{name: "packed members", opts: []estargztest.Option{estargztest.WithChunkSize(100), estargztest.WithMinChunkSize(512)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layer := estargztest.NewBuilder(tt.opts...).
+				Dir("etc").
+				File("etc/hostname", contents["etc/hostname"]).
+				File("etc/hosts", contents["etc/hosts"]).
+				File("usr/lib/big", contents["usr/lib/big"]).
+				File("bin/busybox", contents["bin/busybox"]).
+				Symlink("bin/sh", "busybox").
+				MustBuild()
+
+			store := storage.NewMockStorage()
+			store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+			resolver := NewBlobResolver(store)
+
+			index, err := NewBlobIndexLoader(store, resolver).Load(context.Background())
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+
+			tempDir := t.TempDir()
+			var jobs []*DownloadJob
+			for path := range contents {
+				info, err := index.FindFile(path, layer.Digest)
+				if err != nil {
+					t.Fatalf("FindFile(%s) error = %v", path, err)
+				}
+				jobs = append(jobs, &DownloadJob{
+					Path:       info.Path,
+					BlobDigest: info.BlobDigest,
+					Size:       info.Size,
+					OutputPath: filepath.Join(tempDir, path),
+				})
+			}
+
+			opts := &DownloadOptions{Concurrency: 2, SingleFileChunkThreshold: 256}
+			if _, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, opts); err != nil {
+				t.Fatalf("StartDownload() error = %v", err)
+			}
+			for path, want := range contents {
+				got, err := os.ReadFile(filepath.Join(tempDir, path))
+				if err != nil {
+					t.Fatalf("ReadFile(%s) error = %v", path, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("%s content mismatch: got %d bytes, want %d", path, len(got), len(want))
+				}
+			}
+
+			link, err := index.ResolvePath("bin/sh", layer.Digest)
+			if err != nil || link.Path != "bin/busybox" {
+				t.Fatalf("ResolvePath(bin/sh) = %v, %v; want bin/busybox", link, err)
+			}
+		})
+	}
+}
+
+func TestDownloader_PermanentErrorsNotRetried(t *testing.T) {
+	tempDir := t.TempDir()
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, base, resolver, "bin/gone", []byte("content"), 0)
+
+	tests := []struct {
+		name        string
+		failErr     error
+		wantRetries int
+		wantClass   stargzerrors.ErrorClass
+	}{
+		{name: "not found", failErr: &stargzerrors.HTTPStatusError{Op: "range request", StatusCode: 404, URL: "https://r.example/v2/app/blobs/x", Registry: "r.example"}, wantRetries: 0, wantClass: stargzerrors.ClassPermanent},
+		{name: "server error", failErr: &stargzerrors.HTTPStatusError{Op: "range request", StatusCode: 502, URL: "https://r.example/v2/app/blobs/x", Registry: "r.example"}, wantRetries: 2, wantClass: stargzerrors.ClassTransient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFailingStorage(base, map[digest.Digest]int{dgst: 100})
+			store.failErr = tt.failErr
+
+			var failed []Warning
+			opts := &DownloadOptions{
+				MaxRetries: 2,
+				OnWarning: func(w Warning) {
+					if w.Kind == WarningFileFailed {
+						failed = append(failed, w)
+					}
+				},
+			}
+			job := &DownloadJob{Path: "bin/gone", BlobDigest: dgst, Size: 7, OutputPath: filepath.Join(tempDir, tt.name)}
+
+			stats, _ := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, opts)
+			if stats.FailedFiles != 1 {
+				t.Fatalf("FailedFiles = %d, want 1", stats.FailedFiles)
+			}
+			if stats.Retries != tt.wantRetries {
+				t.Fatalf("Retries = %d, want %d", stats.Retries, tt.wantRetries)
+			}
+			if got := stats.RetryReasons["http_502"]; tt.wantRetries > 0 && got != tt.wantRetries {
+				t.Errorf("RetryReasons = %v, want %d retries for http_502", stats.RetryReasons, tt.wantRetries)
+			}
+			if len(failed) != 1 {
+				t.Fatalf("file-failed warnings = %d, want 1", len(failed))
+			}
+			se, ok := failed[0].Err.(*stargzerrors.StargzError)
+			if !ok || se.Details["errorClass"] != string(tt.wantClass) {
+				t.Fatalf("failure error = %#v, want errorClass %q", failed[0].Err, tt.wantClass)
+			}
+			status := tt.failErr.(*stargzerrors.HTTPStatusError)
+			for key, want := range map[string]interface{}{
+				"statusCode": status.StatusCode,
+				"requestURL": status.URL,
+				"registry":   status.Registry,
+				"attempt":    tt.wantRetries + 1,
+			} {
+				if se.Details[key] != want {
+					t.Fatalf("Details[%s] = %v, want %v (details %v)", key, se.Details[key], want, se.Details)
+				}
+			}
+		})
+	}
+}
+
+// panickingResolver panics when asked for the metadata of panicPath.
+type panickingResolver struct {
+	*mockBlobResolver
+	panicPath string
+}
+
+func (r *panickingResolver) FileMetadata(ctx context.Context, blobDigest digest.Digest, path string) (*FileMetadata, error) {
+	if path == r.panicPath {
+		var entries []*FileMetadata
+		return entries[1], nil
+	}
+	return r.mockBlobResolver.FileMetadata(ctx, blobDigest, path)
+}
+
+// panickingStorage panics on reads from panicBlob.
+type panickingStorage struct {
+	*storage.MockStorage
+	panicBlob digest.Digest
+}
+
+func (s *panickingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	if dgst == s.panicBlob {
+		panic("malformed chunk")
+	}
+	return s.MockStorage.ReadBlob(ctx, dgst, offset, length)
+}
+
+func TestDownloader_RecoversWorkerPanics(t *testing.T) {
+	base := storage.NewMockStorage()
+	mock := newMockBlobResolver()
+	good := addFileToStorage(t, base, mock, "bin/good", []byte("good content"), 0)
+	badMeta := addFileToStorage(t, base, mock, "bin/bad-meta", []byte("bad metadata"), 0)
+	badChunk := addFileToStorage(t, base, mock, "bin/bad-chunk", bytes.Repeat([]byte("c"), 4096), 1024)
+	resolver := &panickingResolver{mockBlobResolver: mock, panicPath: "bin/bad-meta"}
+	store := &panickingStorage{MockStorage: base, panicBlob: badChunk}
+
+	dir := t.TempDir()
+	jobs := []*DownloadJob{
+		{Path: "bin/bad-meta", BlobDigest: badMeta, Size: 12, OutputPath: filepath.Join(dir, "bad-meta")},
+		{Path: "bin/bad-chunk", BlobDigest: badChunk, Size: 4096, OutputPath: filepath.Join(dir, "bad-chunk")},
+		{Path: "bin/good", BlobDigest: good, Size: 12, OutputPath: filepath.Join(dir, "good")},
+	}
+
+	var mu sync.Mutex
+	failed := map[string]error{}
+	opts := &DownloadOptions{
+		MaxRetries:               2,
+		SingleFileChunkThreshold: 1,
+		OnWarning: func(w Warning) {
+			if w.Kind == WarningFileFailed {
+				mu.Lock()
+				failed[w.Path] = w.Err
+				mu.Unlock()
+			}
+		},
+	}
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, opts)
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	if stats.DownloadedFiles != 1 || stats.FailedFiles != 2 || stats.Retries != 0 {
+		t.Fatalf("stats = %d downloaded, %d failed, %d retries; want 1, 2 and no retries", stats.DownloadedFiles, stats.FailedFiles, stats.Retries)
+	}
+	for _, path := range []string{"bin/bad-meta", "bin/bad-chunk"} {
+		se, ok := failed[path].(*stargzerrors.StargzError)
+		if !ok || se.Code != stargzerrors.ErrWorkerPanic.Code || se.Details["path"] != path {
+			t.Errorf("failure for %s = %v, want %s attributed to the file", path, failed[path], stargzerrors.ErrWorkerPanic.Code)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "good")); err != nil || string(data) != "good content" {
+		t.Errorf("good file = %q, %v", data, err)
+	}
+}
+
+func TestDownloader_ChunkDoesNotReadIntoNextMember(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Two gzip members back to back. A chunk whose size overruns the first
+	// member must fail instead of being filled from the second one.
+	blob := append(gzipCompress(t, []byte("abc")), gzipCompress(t, []byte("def"))...)
+	store := storage.NewMockStorage()
+	dgst := store.AddBlob("application/vnd.test.gzip", blob)
+	resolver := newMockBlobResolver()
+	resolver.addFile(dgst, "bad", &FileMetadata{
+		Size:   6,
+		Chunks: []Chunk{{Offset: 0, Size: 6, CompressedOffset: 0}},
+	})
+
+	job := &DownloadJob{Path: "bad", BlobDigest: dgst, Size: 6, OutputPath: filepath.Join(tempDir, "bad")}
+	stats, _ := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, &DownloadOptions{MaxRetries: 1})
+	if stats.FailedFiles != 1 {
+		t.Fatalf("FailedFiles = %d, want 1", stats.FailedFiles)
+	}
+}
+
+func TestDownloader_HardlinkGroups(t *testing.T) {
+	busybox := bytes.Repeat([]byte("busybox"), 1000)
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(512)).
+		File("bin/busybox", busybox).
+		Hardlink("bin/ls", "bin/busybox").
+		Hardlink("bin/cat", "bin/busybox").
+		Hardlink("usr/bin/env", "bin/busybox").
+		MustBuild()
+
+	store := storage.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	resolver := NewBlobResolver(store)
+	index, err := NewBlobIndexLoader(store, resolver).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	for _, concurrency := range []int{1, 8} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			tempDir := t.TempDir()
+			out := func(p string) string { return filepath.Join(tempDir, p) }
+
+			// Links come first so that, without deferral, workers would try to
+			// link to a target that has not been written yet.
+			var jobs []*DownloadJob
+			for _, p := range []string{"bin/ls", "bin/cat", "usr/bin/env"} {
+				jobs = append(jobs, &DownloadJob{Path: "bin/busybox", BlobDigest: layer.Digest, Size: int64(len(busybox)), OutputPath: out(p), LinkTo: out("bin/busybox")})
+			}
+			target, err := index.ResolvePath("bin/ls", layer.Digest)
+			if err != nil {
+				t.Fatalf("ResolvePath(bin/ls) error = %v", err)
+			}
+			jobs = append(jobs, &DownloadJob{Path: target.Path, BlobDigest: target.BlobDigest, Size: target.Size, OutputPath: out("bin/busybox")})
+
+			opts := &DownloadOptions{Concurrency: concurrency, SingleFileChunkThreshold: 1}
+			stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, opts)
+			if err != nil {
+				t.Fatalf("StartDownload() error = %v", err)
+			}
+			if stats.DownloadedFiles != 4 || stats.FailedFiles != 0 {
+				t.Fatalf("stats = %+v, want 4 downloaded", stats)
+			}
+			if stats.DownloadedBytes != int64(len(busybox)) {
+				t.Fatalf("DownloadedBytes = %d, want %d (links are not downloaded)", stats.DownloadedBytes, len(busybox))
+			}
+
+			targetInfo, err := os.Stat(out("bin/busybox"))
+			if err != nil {
+				t.Fatalf("Stat(target) error = %v", err)
+			}
+			for _, p := range []string{"bin/ls", "bin/cat", "usr/bin/env"} {
+				info, err := os.Stat(out(p))
+				if err != nil {
+					t.Fatalf("Stat(%s) error = %v", p, err)
+				}
+				if !os.SameFile(info, targetInfo) {
+					t.Fatalf("%s is not a hard link to bin/busybox", p)
+				}
+			}
+		})
+	}
+}
+
+// stallingStorage serves the chunk at stallOffset with a body that blocks
+// until closed, ignoring the context, and fails every other read.
+type stallingStorage struct {
+	*storage.MockStorage
+	stallOffset int64
+	failErr     error
+}
+
+func (s *stallingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	if offset == s.stallOffset {
+		return &stalledBody{closed: make(chan struct{})}, nil
+	}
+	return nil, s.failErr
+}
+
+type stalledBody struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (b *stalledBody) Read(p []byte) (int, error) {
+	<-b.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (b *stalledBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+func TestDownloader_ChunkFailureAbortsStalledReads(t *testing.T) {
+	content := bytes.Repeat([]byte("chunk-data"), 64)
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, base, resolver, "usr/bin/bash", content, 128)
+
+	store := &stallingStorage{
+		MockStorage: base,
+		failErr:     &stargzerrors.HTTPStatusError{Op: "range request", StatusCode: 404},
+	}
+	job := &DownloadJob{
+		Path:       "usr/bin/bash",
+		BlobDigest: dgst,
+		Size:       int64(len(content)),
+		OutputPath: filepath.Join(t.TempDir(), "bash"),
+	}
+	opts := &DownloadOptions{
+		MaxRetries:               1,
+		Concurrency:              4,
+		SingleFileChunkThreshold: 256,
+	}
+
+	type result struct {
+		stats *DownloadStats
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, opts)
+		done <- result{stats, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("StartDownload() unexpected error: %v", res.err)
+		}
+		if res.stats.FailedFiles != 1 {
+			t.Fatalf("FailedFiles = %d, want 1", res.stats.FailedFiles)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("StartDownload() still blocked on a stalled body after another chunk failed")
+	}
+}
+
+func TestDownloader_ChunkLimits(t *testing.T) {
+	blob := gzipCompress(t, []byte("abcdef"))
+
+	tests := []struct {
+		name     string
+		meta     *FileMetadata
+		maxChunk int64
+	}{
+		{
+			name:     "chunk over the cap",
+			meta:     &FileMetadata{Size: 6, Chunks: []Chunk{{Offset: 0, Size: 6}}},
+			maxChunk: 4,
+		},
+		{
+			name: "chunk past the end of the file",
+			meta: &FileMetadata{Size: 6, Chunks: []Chunk{{Offset: 0, Size: 1 << 40}}},
+		},
+		{
+			name: "negative size",
+			meta: &FileMetadata{Size: 6, Chunks: []Chunk{{Offset: 0, Size: -1}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMockStorage()
+			dgst := store.AddBlob("application/vnd.test.gzip", blob)
+			resolver := newMockBlobResolver()
+			resolver.addFile(dgst, "bomb", tt.meta)
+
+			var failure error
+			opts := &DownloadOptions{
+				MaxRetries:   3,
+				MaxChunkSize: tt.maxChunk,
+				OnWarning: func(w Warning) {
+					if w.Kind == WarningFileFailed {
+						failure = w.Err
+					}
+				},
+			}
+			job := &DownloadJob{Path: "bomb", BlobDigest: dgst, Size: 6, OutputPath: filepath.Join(t.TempDir(), "bomb")}
+			stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, opts)
+			if err != nil {
+				t.Fatalf("StartDownload() error = %v", err)
+			}
+			if stats.FailedFiles != 1 || stats.Retries != 0 {
+				t.Fatalf("FailedFiles = %d, Retries = %d; want 1 failure without retries", stats.FailedFiles, stats.Retries)
+			}
+			if code := stargzerrors.GetErrorCode(failure); code != stargzerrors.ErrChunkLimit.Code {
+				t.Fatalf("failure = %v, want code %s", failure, stargzerrors.ErrChunkLimit.Code)
+			}
+		})
+	}
+}
+
+func TestDownloader_StreamsLargeChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(chunkStreamThreshold/16)+1024)
+	store := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, store, resolver, "big", content, 0)
+	output := filepath.Join(t.TempDir(), "big")
+
+	job := &DownloadJob{Path: "big", BlobDigest: dgst, Size: int64(len(content)), OutputPath: output}
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, nil)
+	if err != nil || stats.FailedFiles != 0 {
+		t.Fatalf("StartDownload() error = %v, FailedFiles = %d", err, stats.FailedFiles)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("output differs from content (%d vs %d bytes)", len(got), len(content))
+	}
+
+	// A chunk that decodes to fewer bytes than it claims still fails.
+	resolver.addFile(dgst, "short", &FileMetadata{Size: int64(len(content)) + 1, Chunks: []Chunk{{Offset: 0, Size: int64(len(content)) + 1}}})
+	job = &DownloadJob{Path: "short", BlobDigest: dgst, Size: int64(len(content)) + 1, OutputPath: filepath.Join(t.TempDir(), "short")}
+	stats, _ = NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, &DownloadOptions{MaxRetries: 1})
+	if stats.FailedFiles != 1 {
+		t.Fatalf("FailedFiles = %d, want 1", stats.FailedFiles)
+	}
+}
+
+// BenchmarkDownloader_LocalRootfs extracts a whole layer from a local OCI
+// layout, comparing reads served from a memory mapping with regular IO.
+func BenchmarkDownloader_LocalRootfs(b *testing.B) {
+	ctx := context.Background()
+	builder := estargztest.NewBuilder(estargztest.WithChunkSize(4096))
+	var jobs []*DownloadJob
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("usr/lib/file%03d", i)
+		content := bytes.Repeat([]byte(name), 400+i)
+		builder.File(name, content)
+		jobs = append(jobs, &DownloadJob{Path: name, Size: int64(len(content)), OutputPath: name})
+	}
+	layer := builder.MustBuild()
+
+	inner := storage.NewMockStorage()
+	inner.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	manifest := &storage.Manifest{
+		SchemaVersion: 2,
+		Layers:        []storage.Layer{{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layer.Digest.String(), Size: int64(len(layer.Blob))}},
+	}
+	dir := b.TempDir()
+	mirror, err := storage.NewMirrorStorage(ctx, inner, dir, manifest, "latest")
+	if err != nil {
+		b.Fatalf("NewMirrorStorage() error = %v", err)
+	}
+	rc, err := mirror.ReadBlob(ctx, layer.Digest, 0, 0)
+	if err != nil {
+		b.Fatalf("ReadBlob() error = %v", err)
+	}
+	io.Copy(io.Discard, rc)
+	rc.Close()
+	for _, job := range jobs {
+		job.BlobDigest = layer.Digest
+	}
+
+	local, err := storage.NewLocalStorage(dir, "latest")
+	if err != nil {
+		b.Fatalf("NewLocalStorage() error = %v", err)
+	}
+	defer local.Close()
+
+	for _, bc := range []struct {
+		name  string
+		store *storage.LocalStorage
+	}{{"mmap", local}, {"pread", local.WithoutMmap()}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(layer.Blob)))
+			for i := 0; i < b.N; i++ {
+				out := b.TempDir()
+				run := make([]*DownloadJob, len(jobs))
+				for j, job := range jobs {
+					copied := *job
+					copied.OutputPath = filepath.Join(out, job.OutputPath)
+					run[j] = &copied
+				}
+				stats, err := NewDownloader(NewBlobResolver(bc.store), bc.store).StartDownload(ctx, run, nil, &DownloadOptions{})
+				if err != nil || stats.FailedFiles != 0 {
+					b.Fatalf("StartDownload() = %+v, %v", stats, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package errors
+
+import (
+	"context"
+	stderrs "errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrorClass tells whether retrying a failed operation can help.
+type ErrorClass string
+
+const (
+	ClassTransient ErrorClass = "transient" // Timeouts, throttling, server and network errors
+	ClassPermanent ErrorClass = "permanent" // Auth failures, missing content, invalid input
+)
+
+// HTTPStatusError is a non-success response from a registry.
+type HTTPStatusError struct {
+	Op         string // Request that failed, e.g. "range request"
+	StatusCode int
+	Body       string // Response body, if any
+	URL        string // Request URL without its query, which may hold signatures
+	Registry   string // Registry host the request was made for
+}
+
+func (e *HTTPStatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s failed: %d", e.Op, e.StatusCode)
+	}
+	return fmt.Sprintf("%s failed: %d %s", e.Op, e.StatusCode, e.Body)
+}
+
+// HTTPStatus returns the response status code.
+func (e *HTTPStatusError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+// RedactURL formats u without its query, fragment and user info. Blob downloads are often
+// redirected to signed storage URLs whose query carries credentials.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	redacted.RawQuery = ""
+	redacted.Fragment = ""
+	redacted.User = nil
+	return redacted.String()
+}
+
+// httpDiagnostics extracts structured details about the HTTP request behind
+// err: the status code, the redacted request URL and the registry. It returns
+// nil if err did not come from an HTTP request.
+func httpDiagnostics(err error) map[string]interface{} {
+	var statusErr *HTTPStatusError
+	if stderrs.As(err, &statusErr) {
+		details := map[string]interface{}{"statusCode": statusErr.StatusCode}
+		if statusErr.URL != "" {
+			details["requestURL"] = statusErr.URL
+		}
+		if statusErr.Registry != "" {
+			details["registry"] = statusErr.Registry
+		}
+		return details
+	}
+
+	details := make(map[string]interface{})
+	var status interface{ HTTPStatus() int }
+	if stderrs.As(err, &status) {
+		details["statusCode"] = status.HTTPStatus()
+	}
+	var urlErr *url.Error
+	if stderrs.As(err, &urlErr) {
+		if u, perr := url.Parse(urlErr.URL); perr == nil {
+			details["requestURL"] = RedactURL(u)
+			details["registry"] = u.Host
+		}
+	}
+	if len(details) == 0 {
+		return nil
+	}
+	return details
+}
+
+// permanentCodes are StargzError codes that retrying cannot fix.
+var permanentCodes = map[string]bool{
+	ErrBlobNotFound.Code:           true,
+	ErrFileNotFound.Code:           true,
+	ErrAuthFailed.Code:             true,
+	ErrInvalidDigest.Code:          true,
+	ErrNotRegularFile.Code:         true,
+	ErrUnresolvedSymlink.Code:      true,
+	ErrDiffIDMismatch.Code:         true,
+	ErrChunkLimit.Code:             true,
+	ErrUnsupportedLayerFormat.Code: true,
+	ErrNotStargzImage.Code:         true,
+	ErrWorkerPanic.Code:            true,
+	ErrContentBlocked.Code:         true,
+	ErrIndexStale.Code:             true,
+	ErrImageNotIndexed.Code:        true,
+	ErrUnknownTOCEntryType.Code:    true,
+}
+
+// Classify reports whether err is worth retrying. Any error in the chain that
+// carries an HTTP status (see HTTPStatusError) decides by status: 401, 403,
+// 404 and other 4xx are permanent, while 408, 429 and 5xx are transient.
+// Otherwise a StargzError with a permanent code (not found, auth, invalid
+// digest, ...) is permanent. Everything else, including network errors and
+// timeouts, is transient.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ClassTransient
+	}
+
+	var status interface{ HTTPStatus() int }
+	if stderrs.As(err, &status) {
+		return classifyStatus(status.HTTPStatus())
+	}
+
+	for e := err; e != nil; {
+		var se *StargzError
+		if !stderrs.As(e, &se) {
+			break
+		}
+		if permanentCodes[se.Code] {
+			return ClassPermanent
+		}
+		e = se.Cause
+	}
+	return ClassTransient
+}
+
+// Reason names the cause of err in a few words, for grouping failures in
+// metrics: the code of a mid-stream failure (see MidStreamError, e.g.
+// "range_ignored"), "http_503" for a status anywhere in the chain,
+// "timeout", "unexpected_eof", "connection_reset", "canceled", the code of
+// the innermost StargzError (e.g. "download_failed"), or "other".
+func Reason(err error) string {
+	if err == nil {
+		return ""
+	}
+	if se := MidStreamError(err); se != nil {
+		return strings.ToLower(se.Code)
+	}
+	var status interface{ HTTPStatus() int }
+	if stderrs.As(err, &status) {
+		return fmt.Sprintf("http_%d", status.HTTPStatus())
+	}
+	var netErr net.Error
+	switch {
+	case stderrs.Is(err, context.DeadlineExceeded), stderrs.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case stderrs.Is(err, context.Canceled):
+		return "canceled"
+	case stderrs.Is(err, io.ErrUnexpectedEOF):
+		return "unexpected_eof"
+	case stderrs.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	}
+
+	code := ""
+	for e := err; e != nil; {
+		var se *StargzError
+		if !stderrs.As(e, &se) {
+			break
+		}
+		code = se.Code
+		e = se.Cause
+	}
+	if code != "" {
+		return strings.ToLower(code)
+	}
+	return "other"
+}
+
+// midStreamCodes are the codes of failures that interrupt a download the
+// registry had been serving, each with its own remedy.
+var midStreamCodes = map[string]bool{
+	ErrRangeIgnored.Code:   true,
+	ErrTokenExpired.Code:   true,
+	ErrContentChanged.Code: true,
+}
+
+// MidStreamError returns the outermost ErrRangeIgnored, ErrTokenExpired or
+// ErrContentChanged in err's chain, or nil. Downloads report these instead
+// of the DOWNLOAD_FAILED wrapping them, as they say what went wrong.
+func MidStreamError(err error) *StargzError {
+	for e := err; e != nil; {
+		var se *StargzError
+		if !stderrs.As(e, &se) {
+			break
+		}
+		if midStreamCodes[se.Code] {
+			return se
+		}
+		e = se.Cause
+	}
+	return nil
+}
+
+// IsPermanent reports whether Classify(err) is ClassPermanent.
+func IsPermanent(err error) bool {
+	return Classify(err) == ClassPermanent
+}
+
+// IsAuthFailure reports whether err means access was denied: an HTTP 401 or
+// 403 anywhere in the chain, or ErrAuthFailed. Unlike other permanent
+// failures, these usually mean the caller lacks credentials or permissions
+// for a particular repository rather than that the content is missing.
+func IsAuthFailure(err error) bool {
+	var status interface{ HTTPStatus() int }
+	if stderrs.As(err, &status) {
+		code := status.HTTPStatus()
+		return code == http.StatusUnauthorized || code == http.StatusForbidden
+	}
+	for e := err; e != nil; {
+		var se *StargzError
+		if !stderrs.As(e, &se) {
+			break
+		}
+		if se.Code == ErrAuthFailed.Code {
+			return true
+		}
+		e = se.Cause
+	}
+	return false
+}
+
+func classifyStatus(code int) ErrorClass {
+	switch {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+		return ClassTransient
+	case code >= 400:
+		return ClassPermanent
+	default:
+		return ClassTransient
+	}
+}
@@ -24,6 +24,51 @@ var (
 
 	// ErrDownloadFailed is returned when file download fails after all retries
 	ErrDownloadFailed = &StargzError{Code: "DOWNLOAD_FAILED", Message: "download failed after retries"}
+
+	// ErrNotRegularFile is returned when a path names a device, FIFO or other special file
+	ErrNotRegularFile = &StargzError{Code: "NOT_REGULAR_FILE", Message: "not a regular file"}
+
+	// ErrUnresolvedSymlink is returned when a symlink is dangling, loops, or points outside the image
+	ErrUnresolvedSymlink = &StargzError{Code: "UNRESOLVED_SYMLINK", Message: "symlink cannot be resolved within the image"}
+
+	// ErrDiffIDMismatch is returned when a layer's uncompressed content does not match the image config's diff_id
+	ErrDiffIDMismatch = &StargzError{Code: "DIFF_ID_MISMATCH", Message: "layer diff ID does not match the image config"}
+
+	// ErrChunkLimit is returned when a TOC declares a chunk or file larger than the download allows or the layer can hold
+	ErrChunkLimit = &StargzError{Code: "CHUNK_LIMIT_EXCEEDED", Message: "chunk size exceeds the allowed limit"}
+
+	// ErrDownloadStalled is returned when a download made no progress for longer than its stall timeout
+	ErrDownloadStalled = &StargzError{Code: "DOWNLOAD_STALLED", Message: "download made no progress"}
+
+	// ErrUnsupportedLayerFormat is returned when a layer is in a format other than eStargz, such as nydus or zstd:chunked
+	ErrUnsupportedLayerFormat = &StargzError{Code: "UNSUPPORTED_LAYER_FORMAT", Message: "layer is not in eStargz format"}
+
+	// ErrNotStargzImage is returned when none of an image's layers is in eStargz format, e.g. for a plain gzip image
+	ErrNotStargzImage = &StargzError{Code: "NOT_STARGZ_IMAGE", Message: "image has no eStargz layers"}
+
+	// ErrContentBlocked is returned for a file a content filter refused to write, e.g. because it holds a private key
+	ErrContentBlocked = &StargzError{Code: "CONTENT_BLOCKED", Message: "file blocked by content filter"}
+
+	// ErrIndexStale is returned when a saved image index was built for a different manifest than the image now has
+	ErrIndexStale = &StargzError{Code: "INDEX_STALE", Message: "saved image index does not match the image"}
+
+	// ErrImageNotIndexed is returned when an index database has no index for the requested image
+	ErrImageNotIndexed = &StargzError{Code: "IMAGE_NOT_INDEXED", Message: "image is not in the index database"}
+
+	// ErrUnknownTOCEntryType is returned in strict TOC mode for a layer whose TOC has entries of types this version does not know
+	ErrUnknownTOCEntryType = &StargzError{Code: "UNKNOWN_TOC_ENTRY_TYPE", Message: "TOC has entries of unknown types"}
+
+	// ErrWorkerPanic is returned for a file whose processing panicked, e.g. on a malformed TOC entry; other files continue
+	ErrWorkerPanic = &StargzError{Code: "WORKER_PANIC", Message: "internal error while processing file"}
+
+	// ErrRangeIgnored is returned when a server answers a range request with bytes other than those asked for
+	ErrRangeIgnored = &StargzError{Code: "RANGE_IGNORED", Message: "server did not honor the requested byte range"}
+
+	// ErrTokenExpired is returned when access that worked earlier in a download is refused and a new token or signed blob URL does not restore it
+	ErrTokenExpired = &StargzError{Code: "TOKEN_EXPIRED", Message: "registry access expired and could not be renewed"}
+
+	// ErrContentChanged is returned when blob bytes fail to decode, or a resumed file does not match its TOC digest; the file is then fetched again in full
+	ErrContentChanged = &StargzError{Code: "CONTENT_CHANGED", Message: "blob content differs from what the TOC describes"}
 )
 
 // StargzError represents a structured error in stargz-get operations
@@ -50,13 +95,26 @@ func (e *StargzError) Unwrap() error {
 	return e.Cause
 }
 
-// WithCause adds a cause to the error
+// WithCause adds a cause to the error. If the cause came from an HTTP
+// request, its status code, redacted URL and registry are copied into the
+// details (statusCode, requestURL, registry) unless already set, so callers
+// can inspect registry failures without parsing messages.
 func (e *StargzError) WithCause(cause error) *StargzError {
+	details := e.Details
+	if diag := httpDiagnostics(cause); diag != nil {
+		details = make(map[string]interface{}, len(e.Details)+len(diag))
+		for k, v := range diag {
+			details[k] = v
+		}
+		for k, v := range e.Details {
+			details[k] = v
+		}
+	}
 	return &StargzError{
 		Code:    e.Code,
 		Message: e.Message,
 		Cause:   cause,
-		Details: e.Details,
+		Details: details,
 	}
 }
 
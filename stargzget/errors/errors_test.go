@@ -1,8 +1,14 @@
 package errors
 
 import (
+	"context"
 	stderrs "errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/opencontainers/go-digest"
@@ -64,6 +70,61 @@ func TestStargzError_WithCause(t *testing.T) {
 	}
 }
 
+func TestStargzError_WithCause_HTTPDiagnostics(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  *StargzError
+		cause error
+		want  map[string]interface{}
+	}{
+		{
+			name: "status error",
+			base: ErrTOCDownload,
+			cause: fmt.Errorf("read footer: %w", &HTTPStatusError{
+				Op: "range request", StatusCode: 403,
+				URL: "https://registry.example/v2/app/blobs/sha256:abc", Registry: "registry.example",
+			}),
+			want: map[string]interface{}{"statusCode": 403, "requestURL": "https://registry.example/v2/app/blobs/sha256:abc", "registry": "registry.example"},
+		},
+		{
+			name:  "transport error redacts query",
+			base:  ErrDownloadFailed,
+			cause: &url.Error{Op: "Get", URL: "https://blobs.example/x?X-Amz-Signature=secret", Err: stderrs.New("connection reset")},
+			want:  map[string]interface{}{"requestURL": "https://blobs.example/x", "registry": "blobs.example"},
+		},
+		{
+			name:  "explicit details win",
+			base:  ErrAuthFailed.WithDetail("registry", "docker.io"),
+			cause: &HTTPStatusError{Op: "token request", StatusCode: 401, Registry: "auth.docker.io"},
+			want:  map[string]interface{}{"statusCode": 401, "registry": "docker.io"},
+		},
+		{
+			name:  "plain error",
+			base:  ErrDownloadFailed,
+			cause: stderrs.New("disk full"),
+			want:  map[string]interface{}{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.base.WithCause(tt.cause)
+			if len(err.Details) != len(tt.want) {
+				t.Fatalf("Details = %v, want %v", err.Details, tt.want)
+			}
+			for k, v := range tt.want {
+				if err.Details[k] != v {
+					t.Fatalf("Details[%s] = %v, want %v", k, err.Details[k], v)
+				}
+			}
+		})
+	}
+
+	if len(ErrTOCDownload.Details) != 0 {
+		t.Fatalf("WithCause() mutated the sentinel error's details: %v", ErrTOCDownload.Details)
+	}
+}
+
 func TestStargzError_WithDetail(t *testing.T) {
 	err := ErrFileNotFound.WithDetail("path", "/bin/echo")
 	if err.Details["path"] != "/bin/echo" {
@@ -215,3 +276,95 @@ func TestGetErrorCode(t *testing.T) {
 		})
 	}
 }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{name: "not found status", err: &HTTPStatusError{Op: "range request", StatusCode: 404}, want: ClassPermanent},
+		{name: "forbidden status", err: &HTTPStatusError{Op: "range request", StatusCode: 403}, want: ClassPermanent},
+		{name: "throttled", err: &HTTPStatusError{Op: "range request", StatusCode: 429}, want: ClassTransient},
+		{name: "server error", err: &HTTPStatusError{Op: "range request", StatusCode: 503}, want: ClassTransient},
+		{
+			name: "wrapped status",
+			err:  ErrDownloadFailed.WithCause(fmt.Errorf("read chunk: %w", &HTTPStatusError{Op: "range request", StatusCode: 401})),
+			want: ClassPermanent,
+		},
+		{name: "permanent code", err: ErrInvalidDigest, want: ClassPermanent},
+		{name: "permanent code as cause", err: ErrDownloadFailed.WithCause(ErrBlobNotFound), want: ClassPermanent},
+		{name: "generic download failure", err: ErrDownloadFailed.WithCause(stderrs.New("connection reset")), want: ClassTransient},
+		{name: "range ignored", err: ErrDownloadFailed.WithCause(ErrRangeIgnored), want: ClassTransient},
+		{name: "content changed", err: ErrContentChanged.WithCause(stderrs.New("gzip: invalid checksum")), want: ClassTransient},
+		{name: "token expired", err: ErrTokenExpired.WithCause(&HTTPStatusError{Op: "range request", StatusCode: 403}), want: ClassPermanent},
+		{name: "plain error", err: stderrs.New("timeout"), want: ClassTransient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("Classify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "status", err: ErrDownloadFailed.WithCause(fmt.Errorf("read chunk: %w", &HTTPStatusError{Op: "range request", StatusCode: 503})), want: "http_503"},
+		{name: "deadline", err: ErrDownloadFailed.WithCause(context.DeadlineExceeded), want: "timeout"},
+		{name: "short body", err: ErrDownloadFailed.WithCause(io.ErrUnexpectedEOF), want: "unexpected_eof"},
+		{name: "reset", err: ErrDownloadFailed.WithCause(&net.OpError{Op: "read", Err: syscall.ECONNRESET}), want: "connection_reset"},
+		{name: "innermost code", err: ErrDownloadFailed.WithCause(ErrChunkLimit), want: "chunk_limit_exceeded"},
+		{name: "mid-stream code", err: ErrDownloadFailed.WithCause(ErrTokenExpired.WithCause(&HTTPStatusError{Op: "range request", StatusCode: 403})), want: "token_expired"},
+		{name: "mid-stream code wrapping another", err: ErrContentChanged.WithCause(ErrDownloadFailed.WithCause(stderrs.New("gzip: invalid checksum"))), want: "content_changed"},
+		{name: "plain", err: stderrs.New("boom"), want: "other"},
+		{name: "nil", err: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Reason(tt.err); got != tt.want {
+				t.Errorf("Reason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMidStreamError(t *testing.T) {
+	expired := ErrTokenExpired.WithDetail("registry", "registry.example.com")
+	if got := MidStreamError(ErrDownloadFailed.WithCause(fmt.Errorf("read chunk: %w", expired))); got != expired {
+		t.Errorf("MidStreamError() = %v, want %v", got, expired)
+	}
+	if got := MidStreamError(ErrDownloadFailed.WithCause(io.ErrUnexpectedEOF)); got != nil {
+		t.Errorf("MidStreamError() = %v for a generic failure, want nil", got)
+	}
+}
+
+func TestIsAuthFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unauthorized", err: &HTTPStatusError{Op: "range request", StatusCode: 401}, want: true},
+		{name: "forbidden wrapped", err: ErrTOCDownload.WithCause(fmt.Errorf("read footer: %w", &HTTPStatusError{Op: "range request", StatusCode: 403})), want: true},
+		{name: "auth failed code", err: ErrAuthFailed.WithCause(stderrs.New("no credentials")), want: true},
+		{name: "token server down", err: ErrAuthFailed.WithCause(&HTTPStatusError{Op: "token request", StatusCode: 503}), want: false},
+		{name: "not found", err: &HTTPStatusError{Op: "range request", StatusCode: 404}, want: false},
+		{name: "plain error", err: stderrs.New("not an estargz blob"), want: false},
+		{name: "nil", err: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsAuthFailure(tt.err); got != tt.want {
+				t.Errorf("IsAuthFailure() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ type Chunk struct {
 	Size             int64
 	CompressedOffset int64
 	InnerOffset      int64
+	Digest           string // chunkDigest of the uncompressed chunk; empty if the TOC has none
 }
 
 // ChunksForFile extracts the chunk list for a specific file entry.
@@ -40,6 +41,7 @@ func ChunksForFile(toc *JTOC, fileName string) (int64, []Chunk, error) {
 				Size:             chunkSize,
 				CompressedOffset: entry.Offset,
 				InnerOffset:      entry.InnerOffset,
+				Digest:           entry.ChunkDigest,
 			})
 		case "chunk":
 			found = true
@@ -52,6 +54,7 @@ func ChunksForFile(toc *JTOC, fileName string) (int64, []Chunk, error) {
 				Size:             chunkSize,
 				CompressedOffset: entry.Offset,
 				InnerOffset:      entry.InnerOffset,
+				Digest:           entry.ChunkDigest,
 			})
 		}
 	}
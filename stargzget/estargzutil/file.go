@@ -15,6 +15,14 @@ type FileReader struct {
 	pos             int64
 	currentChunkIdx int
 	currentChunkBuf []byte
+
+	// The most recently decoded gzip member, as far as the file's chunks
+	// reach into it. Images built with a minimum chunk size put several
+	// chunks in one member at increasing innerOffsets; decoding the member
+	// once lets consecutive chunks be sliced from it instead of
+	// re-inflating it from the start.
+	memberOffset int64
+	memberBuf    []byte
 }
 
 var _ io.ReadSeekCloser = (*FileReader)(nil)
@@ -131,6 +139,7 @@ func (f *FileReader) Seek(offset int64, whence int) (int64, error) {
 func (f *FileReader) Close() error {
 	f.chunks = nil
 	f.currentChunkBuf = nil
+	f.memberBuf = nil
 	if f.r == nil {
 		return nil
 	}
@@ -172,35 +181,67 @@ func (f *FileReader) ensureChunk(idx int) error {
 		return nil
 	}
 
-	if _, err := f.r.Seek(chunk.CompressedOffset, io.SeekStart); err != nil {
+	member, err := f.member(idx)
+	if err != nil {
 		return err
 	}
 
-	gz, err := gzip.NewReader(f.r)
-	if err != nil {
-		return err
+	end := chunk.InnerOffset + chunk.Size
+	if chunk.InnerOffset < 0 || end > int64(len(member)) {
+		return io.ErrUnexpectedEOF
 	}
+	buf := member[chunk.InnerOffset:end]
 
-	if chunk.InnerOffset > 0 {
-		if _, err := io.CopyN(io.Discard, gz, chunk.InnerOffset); err != nil {
-			gz.Close()
-			return err
-		}
+	f.currentChunkIdx = idx
+	f.currentChunkBuf = buf
+	return nil
+}
+
+// member returns the decompressed content of the gzip member holding chunk
+// idx, up to the end of the file's last chunk in it. Chunks of other files
+// may follow in the member and are not decoded, so the TOC bounds what is
+// held in memory however large the member is. Decoding stops at the
+// member's end, so a chunk that claims to extend past it is reported as
+// truncated rather than silently filled from the next member.
+func (f *FileReader) member(idx int) ([]byte, error) {
+	compressedOffset := f.chunks[idx].CompressedOffset
+	if f.memberBuf != nil && f.memberOffset == compressedOffset {
+		return f.memberBuf, nil
 	}
 
-	buf := make([]byte, chunk.Size)
-	if _, err := io.ReadFull(gz, buf); err != nil {
-		gz.Close()
-		if err == io.EOF {
-			return io.ErrUnexpectedEOF
+	// Chunks are ordered by offset, so those sharing the member follow
+	// idx; the ones before it lie at smaller innerOffsets.
+	var size int64
+	for _, ch := range f.chunks[idx:] {
+		if ch.CompressedOffset != compressedOffset {
+			break
 		}
-		return err
+		size = max(size, ch.InnerOffset+ch.Size)
 	}
-	if err := gz.Close(); err != nil {
-		return err
+
+	if _, err := f.r.Seek(compressedOffset, io.SeekStart); err != nil {
+		return nil, err
 	}
 
-	f.currentChunkIdx = idx
-	f.currentChunkBuf = buf
-	return nil
+	gz, err := gzip.NewReader(f.r)
+	if err != nil {
+		return nil, err
+	}
+	gz.Multistream(false)
+
+	// Reading through a LimitReader rather than into a buffer of the
+	// claimed size keeps a TOC that overstates it from allocating more than
+	// the member holds.
+	data, err := io.ReadAll(io.LimitReader(gz, size))
+	gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	f.memberOffset = compressedOffset
+	f.memberBuf = data
+	return data, nil
 }
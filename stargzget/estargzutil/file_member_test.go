@@ -0,0 +1,120 @@
+package estargzutil_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+)
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// countingReader counts seeks, i.e. gzip members decoded by FileReader,
+// and the compressed bytes read.
+type countingReader struct {
+	nopSeekCloser
+	seeks int
+	read  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.nopSeekCloser.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Seek(offset int64, whence int) (int64, error) {
+	c.seeks++
+	return c.nopSeekCloser.Seek(offset, whence)
+}
+
+func TestFileReader_ChunksSharingMember(t *testing.T) {
+	var content bytes.Buffer
+	for i := 0; content.Len() < 2000; i++ {
+		fmt.Fprintf(&content, "line %04d\n", i)
+	}
+
+	// 100-byte chunks packed into members of at least 1 KiB: most chunks
+	// continue a member that an earlier chunk started.
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(100), estargztest.WithMinChunkSize(1024)).
+		File("var/log/app.log", content.Bytes()).
+		MustBuild()
+
+	_, chunks, err := estargzutil.ChunksForFile(layer.TOC, "var/log/app.log")
+	if err != nil {
+		t.Fatalf("ChunksForFile() error = %v", err)
+	}
+	members := make(map[int64]bool)
+	for _, ch := range chunks {
+		members[ch.CompressedOffset] = true
+	}
+	if len(members) >= len(chunks) {
+		t.Fatalf("expected chunks to share members, got %d chunks in %d members", len(chunks), len(members))
+	}
+
+	r := &countingReader{nopSeekCloser: nopSeekCloser{bytes.NewReader(layer.Blob)}}
+	fr, err := estargzutil.NewFileReader(layer.TOC, "var/log/app.log", r)
+	if err != nil {
+		t.Fatalf("NewFileReader() error = %v", err)
+	}
+	got, err := io.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, content.Bytes()) {
+		t.Fatalf("content mismatch: got %d bytes, want %d", len(got), content.Len())
+	}
+	if r.seeks != len(members) {
+		t.Fatalf("decoded %d members, want %d", r.seeks, len(members))
+	}
+
+	// Seeking back into an earlier member must decode it again correctly.
+	if _, err := fr.Seek(150, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(fr, buf); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	if want := content.Bytes()[150:170]; !bytes.Equal(buf, want) {
+		t.Fatalf("after seek got %q, want %q", buf, want)
+	}
+}
+
+func TestFileReader_DecodesOnlyTheFilesPartOfAMember(t *testing.T) {
+	// Random content does not compress, so the member is as large as the
+	// big file that shares it.
+	big := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+	layer := estargztest.NewBuilder(estargztest.WithMinChunkSize(4<<20)).
+		File("etc/app.conf", []byte("debug = false\n")).
+		File("var/lib/big.bin", big).
+		MustBuild()
+
+	_, small, _ := estargzutil.ChunksForFile(layer.TOC, "etc/app.conf")
+	_, large, _ := estargzutil.ChunksForFile(layer.TOC, "var/lib/big.bin")
+	if small[0].CompressedOffset != large[0].CompressedOffset {
+		t.Fatalf("expected both files in one member, got offsets %d and %d", small[0].CompressedOffset, large[0].CompressedOffset)
+	}
+
+	r := &countingReader{nopSeekCloser: nopSeekCloser{bytes.NewReader(layer.Blob)}}
+	fr, err := estargzutil.NewFileReader(layer.TOC, "etc/app.conf", r)
+	if err != nil {
+		t.Fatalf("NewFileReader() error = %v", err)
+	}
+	got, err := io.ReadAll(fr)
+	if err != nil || string(got) != "debug = false\n" {
+		t.Fatalf("ReadAll() = %q, %v", got, err)
+	}
+	if r.read > 64<<10 {
+		t.Errorf("read %d compressed bytes for a 14-byte file, want the rest of its member left unread", r.read)
+	}
+}
@@ -2,20 +2,38 @@ package estargzutil
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	_ "crypto/sha512" // Registers sha384 and sha512 with go-digest
 	"encoding/json"
 	"fmt"
 	"io"
 	"sort"
+
+	"github.com/opencontainers/go-digest"
 )
 
 const TOCTarName = "stargz.index.json"
 
+const (
+	// PrefetchLandmark marks the end of the prioritized files: entries before
+	// it in the TOC are the ones an eStargz builder placed first for prefetch.
+	PrefetchLandmark = ".prefetch.landmark"
+	// NoPrefetchLandmark marks a layer built without prioritized files.
+	NoPrefetchLandmark = ".no.prefetch.landmark"
+)
+
 // JTOC models the JSON TOC structure embedded in eStargz blobs.
 type JTOC struct {
 	Version int         `json:"version"`
 	Entries []*TOCEntry `json:"entries"`
+
+	// StreamedFormat is not part of eStargz. It is set on TOCs built by
+	// reading a plain layer without a TOC from start to end, to the layer's
+	// format ("gzip" or "tar"). Such TOCs record no offsets, so their files
+	// can only be read by streaming the layer again.
+	StreamedFormat string `json:"starget.streamedFormat,omitempty"`
 }
 
 // FileEntry aggregates metadata for a regular file listed in the TOC.
@@ -29,6 +47,18 @@ type TOCEntry struct {
 	Name        string            `json:"name"`
 	Type        string            `json:"type"`
 	Size        int64             `json:"size,omitempty"`
+	ModTime3339 string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	NumLink     int               `json:"NumLink,omitempty"`
 	Offset      int64             `json:"offset,omitempty"`
 	ChunkOffset int64             `json:"chunkOffset,omitempty"`
 	ChunkSize   int64             `json:"chunkSize,omitempty"`
@@ -39,39 +69,104 @@ type TOCEntry struct {
 
 // ReadTOC streams and decodes a TOC tarball from the provided reader.
 func ReadTOC(r io.Reader) (*JTOC, error) {
-	gzReader, err := gzip.NewReader(r)
+	toc, _, err := ReadTOCWithDigest(r)
+	return toc, err
+}
+
+// ReadTOCWithDigest is like ReadTOC but also returns the digest of the TOC
+// JSON, which eStargz images record in the layer's TOC digest annotation.
+//
+// The TOC tar may span several gzip members. Reading stops at the TOC entry,
+// and data after the last gzip member, such as padding some builders leave
+// before the footer, ends the stream rather than failing it.
+func ReadTOCWithDigest(r io.Reader) (*JTOC, digest.Digest, error) {
+	return ReadTOCWithDigestAlgorithm(r, digest.Canonical)
+}
+
+// ReadTOCWithDigestAlgorithm is like ReadTOCWithDigest but digests the TOC
+// JSON with algorithm, for layers whose TOC digest annotation is not sha256.
+func ReadTOCWithDigestAlgorithm(r io.Reader, algorithm digest.Algorithm) (*JTOC, digest.Digest, error) {
+	if !algorithm.Available() {
+		return nil, "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	members, err := newMemberReader(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open gzip reader: %w", err)
+		return nil, "", fmt.Errorf("failed to open gzip reader: %w", err)
 	}
-	defer gzReader.Close()
+	defer members.Close()
 
-	tarReader := tar.NewReader(gzReader)
+	tarReader := tar.NewReader(members)
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to iterate TOC tar archive: %w", err)
+			return nil, "", fmt.Errorf("failed to iterate TOC tar archive: %w", err)
 		}
 
 		if header.Name != TOCTarName {
 			continue
 		}
 
-		tocJSONBytes, err := io.ReadAll(tarReader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read TOC JSON: %w", err)
+		// Decode while digesting rather than reading the JSON into a buffer
+		// first, so only the decoded entries outlive the read. Only the first
+		// JSON value is decoded: NUL or whitespace padding after it is not an
+		// error, and is drained so the digest covers the entry as stored.
+		digester := algorithm.Digester()
+		body := io.TeeReader(io.LimitReader(tarReader, header.Size), digester.Hash())
+		var toc JTOC
+		if err := json.NewDecoder(body).Decode(&toc); err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal TOC JSON: %w", err)
 		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return nil, "", fmt.Errorf("failed to read TOC JSON: %w", err)
+		}
+		return &toc, digester.Digest(), nil
+	}
 
-		var toc JTOC
-		if err := json.Unmarshal(tocJSONBytes, &toc); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal TOC JSON: %w", err)
+	return nil, "", fmt.Errorf("%s not found in TOC tar archive", TOCTarName)
+}
+
+// memberReader decompresses consecutive gzip members one at a time. Unlike
+// gzip's own multistream mode, it ends the stream cleanly when the bytes
+// after a member are not another gzip header, and never reads past the
+// member it is decompressing.
+type memberReader struct {
+	br *bufio.Reader
+	gz *gzip.Reader
+}
+
+func newMemberReader(r io.Reader) (*memberReader, error) {
+	br := bufio.NewReader(r)
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	gz.Multistream(false)
+	return &memberReader{br: br, gz: gz}, nil
+}
+
+func (m *memberReader) Read(p []byte) (int, error) {
+	for {
+		n, err := m.gz.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
 		}
-		return &toc, nil
+		// The member is done; continue with the next one, if any. A failed
+		// header read means EOF or trailing padding.
+		if err := m.gz.Reset(m.br); err != nil {
+			return 0, io.EOF
+		}
+		m.gz.Multistream(false)
 	}
+}
 
-	return nil, fmt.Errorf("%s not found in TOC tar archive", TOCTarName)
+func (m *memberReader) Close() error {
+	return m.gz.Close()
 }
 
 // ParseTOC parses the gzipped TOC tar section and returns the decoded TOC.
@@ -174,3 +269,26 @@ func (toc *JTOC) FileEntries() map[string]FileEntry {
 
 	return files
 }
+
+// PrioritizedFiles returns, in TOC order, the entries placed before the
+// prefetch landmark, excluding directories and chunk continuations. It
+// returns nil when the layer has no landmark or a no-prefetch landmark.
+func (toc *JTOC) PrioritizedFiles() []string {
+	if toc == nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range toc.Entries {
+		switch entry.Name {
+		case PrefetchLandmark:
+			return names
+		case NoPrefetchLandmark:
+			return nil
+		}
+		if entry.Type == "dir" || entry.Type == "chunk" {
+			continue
+		}
+		names = append(names, entry.Name)
+	}
+	return nil
+}
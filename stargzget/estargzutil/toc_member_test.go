@@ -0,0 +1,137 @@
+package estargzutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// tocTar returns a tar archive holding the TOC entry with the given content.
+func tocTar(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: TOCTarName, Typeflag: tar.TypeReg, Mode: 0o444, Size: int64(len(content))}); err != nil {
+		t.Fatalf("WriteHeader() error = %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// gzipMember compresses data into a single gzip member.
+func gzipMember(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("gzip Write() error = %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadTOCWithDigest_MemberLayouts(t *testing.T) {
+	tocJSON := []byte(`{"version":1,"entries":[{"name":"bin/","type":"dir"},{"name":"bin/sh","type":"reg","size":3}]}`)
+	tarball := tocTar(t, tocJSON)
+	half := len(tarball) / 2
+	padded := concat(tocJSON, bytes.Repeat([]byte{0}, 64))
+
+	tests := []struct {
+		name       string
+		section    []byte
+		wantDigest digest.Digest
+		wantErr    bool
+	}{
+		{
+			name:       "single member",
+			section:    gzipMember(t, tarball),
+			wantDigest: digest.FromBytes(tocJSON),
+		},
+		{
+			name:       "tar split across members",
+			section:    concat(gzipMember(t, tarball[:half]), gzipMember(t, tarball[half:])),
+			wantDigest: digest.FromBytes(tocJSON),
+		},
+		{
+			name:       "zero padding after member",
+			section:    concat(gzipMember(t, tarball), make([]byte, 512)),
+			wantDigest: digest.FromBytes(tocJSON),
+		},
+		{
+			name:       "trailing garbage",
+			section:    concat(gzipMember(t, tarball), []byte("not a gzip member")),
+			wantDigest: digest.FromBytes(tocJSON),
+		},
+		{
+			name:       "empty member then garbage",
+			section:    concat(gzipMember(t, tarball[:half]), gzipMember(t, tarball[half:]), gzipMember(t, nil), []byte{0xde, 0xad}),
+			wantDigest: digest.FromBytes(tocJSON),
+		},
+		{
+			name:       "NUL padded JSON",
+			section:    gzipMember(t, tocTar(t, padded)),
+			wantDigest: digest.FromBytes(padded),
+		},
+		{
+			name:    "truncated member",
+			section: gzipMember(t, tarball)[:40],
+			wantErr: true,
+		},
+		{
+			name:    "not gzip",
+			section: []byte("garbage"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toc, dgst, err := ReadTOCWithDigest(bytes.NewReader(tt.section))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ReadTOCWithDigest() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadTOCWithDigest() error = %v", err)
+			}
+			if dgst != tt.wantDigest {
+				t.Errorf("digest = %s, want %s", dgst, tt.wantDigest)
+			}
+			if len(toc.Entries) != 2 || toc.Entries[1].Name != "bin/sh" {
+				t.Errorf("entries = %+v, want bin/ and bin/sh", toc.Entries)
+			}
+		})
+	}
+}
+
+func TestReadTOCWithDigestAlgorithm(t *testing.T) {
+	tocJSON := []byte(`{"version":1,"entries":[{"name":"bin/sh","type":"reg","size":3}]}`)
+	section := gzipMember(t, tocTar(t, tocJSON))
+
+	_, dgst, err := ReadTOCWithDigestAlgorithm(bytes.NewReader(section), digest.SHA512)
+	if err != nil {
+		t.Fatalf("ReadTOCWithDigestAlgorithm() error = %v", err)
+	}
+	if want := digest.SHA512.FromBytes(tocJSON); dgst != want {
+		t.Errorf("digest = %s, want %s", dgst, want)
+	}
+	if _, _, err := ReadTOCWithDigestAlgorithm(bytes.NewReader(section), "md5"); err == nil {
+		t.Error("ReadTOCWithDigestAlgorithm() accepted an unavailable algorithm")
+	}
+}
@@ -374,3 +374,58 @@ func TestTOCEntryTypes(t *testing.T) {
 		t.Errorf("no directories found in TOC")
 	}
 }
+
+func TestJTOCPrioritizedFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*TOCEntry
+		want    []string
+	}{
+		{
+			name: "files before landmark",
+			entries: []*TOCEntry{
+				{Name: "bin/", Type: "dir"},
+				{Name: "bin/sh", Type: "reg", Size: 20},
+				{Name: "bin/sh", Type: "chunk", Offset: 100, ChunkOffset: 10},
+				{Name: "bin/bash", Type: "symlink", LinkName: "sh"},
+				{Name: PrefetchLandmark, Type: "reg", Size: 1},
+				{Name: "etc/motd", Type: "reg", Size: 5},
+			},
+			want: []string{"bin/sh", "bin/bash"},
+		},
+		{
+			name: "no prefetch landmark",
+			entries: []*TOCEntry{
+				{Name: NoPrefetchLandmark, Type: "reg", Size: 1},
+				{Name: "etc/motd", Type: "reg", Size: 5},
+			},
+		},
+		{
+			name: "no landmark",
+			entries: []*TOCEntry{
+				{Name: "etc/motd", Type: "reg", Size: 5},
+			},
+		},
+		{
+			name: "landmark first",
+			entries: []*TOCEntry{
+				{Name: PrefetchLandmark, Type: "reg", Size: 1},
+				{Name: "etc/motd", Type: "reg", Size: 5},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := (&JTOC{Entries: tt.entries}).PrioritizedFiles()
+			if len(got) != len(tt.want) {
+				t.Fatalf("PrioritizedFiles() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("PrioritizedFiles() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package stargzget_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/registrytest"
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// exampleImage publishes a two-layer eStargz image in registry and returns
+// its reference. The top layer overrides etc/motd from the base layer.
+func exampleImage(registry *registrytest.Registry) string {
+	base, err := estargztest.NewBuilder().
+		Dir("bin/").
+		File("bin/hello", []byte("#!/bin/sh\necho hello\n")).
+		Dir("etc/").
+		File("etc/motd", []byte("base\n")).
+		Build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	top, err := estargztest.NewBuilder().
+		Dir("etc/").
+		File("etc/motd", []byte("welcome\n")).
+		File("etc/os-release", []byte("ID=example\n")).
+		Build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return registry.AddImage("library/app", "v1", base, top)
+}
+
+func ExampleRegistryIndexLoader_Load() {
+	registry := registrytest.New()
+	defer registry.Close()
+	ref := exampleImage(registry)
+
+	loader := stargzget.NewRegistryIndexLoader(stor.NewRemoteRegistryStorage(false), 0)
+	index, err := loader.Load(context.Background(), ref)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Files come sorted by path; see ImageIndex.SetFileOrder.
+	for _, path := range index.AllFiles() {
+		fmt.Println(path)
+	}
+	fmt.Println("layers:", len(index.Layers))
+	// Output:
+	// bin/hello
+	// etc/motd
+	// etc/os-release
+	// layers: 2
+}
+
+func ExampleImageIndex_FilterFiles() {
+	registry := registrytest.New()
+	defer registry.Close()
+	ref := exampleImage(registry)
+
+	index, err := stargzget.NewRegistryIndexLoader(stor.NewRemoteRegistryStorage(false), 0).Load(context.Background(), ref)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Without a blob digest, the merged view picks each file from the
+	// topmost layer that has it.
+	for _, info := range index.FilterFiles("etc/", "") {
+		fmt.Println(info.Path, info.Size, info.BlobDigest == index.Layers[1].BlobDigest)
+	}
+	// Output:
+	// etc/motd 8 true
+	// etc/os-release 11 true
+}
+
+func ExampleDownloader_StartDownload() {
+	registry := registrytest.New()
+	defer registry.Close()
+	ref := exampleImage(registry)
+
+	ctx := context.Background()
+	client := stor.NewRemoteRegistryStorage(false)
+	manifest, err := client.GetManifest(ctx, ref)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsed, err := refs.Parse(ref)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage := client.NewStorage(parsed.Registry, parsed.Repository, manifest)
+	resolver := stargzget.NewBlobResolver(storage)
+	index, err := stargzget.NewBlobIndexLoader(storage, resolver).Load(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outDir, err := os.MkdirTemp("", "starget-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(outDir)
+
+	var jobs []*stargzget.DownloadJob
+	for _, info := range index.FilterFiles(".", "") {
+		if !info.IsRegular() {
+			continue
+		}
+		jobs = append(jobs, &stargzget.DownloadJob{
+			Path:       info.Path,
+			BlobDigest: info.BlobDigest,
+			Size:       info.Size,
+			OutputPath: filepath.Join(outDir, info.Path),
+		})
+	}
+
+	stats, err := stargzget.NewDownloader(resolver, storage).StartDownload(ctx, jobs, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	motd, err := os.ReadFile(filepath.Join(outDir, "etc/motd"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("downloaded %d files, %d bytes\n", stats.DownloadedFiles, stats.DownloadedBytes)
+	fmt.Print(string(motd))
+	// Output:
+	// downloaded 3 files, 40 bytes
+	// welcome
+}
+
+func ExampleDownloader_Walk() {
+	registry := registrytest.New()
+	defer registry.Close()
+	ref := exampleImage(registry)
+
+	ctx := context.Background()
+	client := stor.NewRemoteRegistryStorage(false)
+	manifest, err := client.GetManifest(ctx, ref)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsed, err := refs.Parse(ref)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage := client.NewStorage(parsed.Registry, parsed.Repository, manifest)
+	downloader := stargzget.NewDownloader(stargzget.NewBlobResolver(storage), storage)
+
+	// Count the lines of every file in the base layer without writing it out.
+	base := digest.Digest(manifest.Layers[0].Digest)
+	err = downloader.Walk(ctx, base, func(entry *estargzutil.TOCEntry, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		fmt.Printf("%s: %d line(s)\n", entry.Name, bytes.Count(data, []byte("\n")))
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// bin/hello: 2 line(s)
+	// etc/motd: 1 line(s)
+}
+
+func ExampleAuditImage() {
+	registry := registrytest.New()
+	defer registry.Close()
+	ref := exampleImage(registry)
+
+	ctx := context.Background()
+	client := stor.NewRemoteRegistryStorage(false)
+	manifest, err := client.GetManifest(ctx, ref)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsed, err := refs.Parse(ref)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	audits, err := stargzget.AuditImage(ctx, client.NewStorage(parsed.Registry, parsed.Repository, manifest), manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, audit := range audits {
+		fmt.Println(audit.Status)
+	}
+	// Output:
+	// verifiable
+	// verifiable
+}
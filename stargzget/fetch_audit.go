@@ -0,0 +1,222 @@
+package stargzget
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// FetchRange is Length bytes of a blob from Offset.
+type FetchRange struct {
+	Offset int64
+	Length int64
+}
+
+// End returns the offset just past the range.
+func (r FetchRange) End() int64 {
+	return r.Offset + r.Length
+}
+
+// FetchAudit compares the byte ranges a download requested from one blob
+// with those its plan needed: the compressed spans of the chunks of the
+// files it was asked for, or the whole blob for layers read as a stream.
+// Requests without a length count up to the end of the blob, since a
+// server may send all of that before the reader stops.
+type FetchAudit struct {
+	BlobDigest     digest.Digest
+	Requests       int          // Range requests made
+	OpenEnded      int          // Requests without a length, asking for the rest of the blob
+	PlannedBytes   int64        // Compressed bytes the plan needs
+	RequestedBytes int64        // Bytes asked for, counting overlapping requests once
+	ReadBytes      int64        // Bytes read from the responses
+	OverFetch      []FetchRange // Requested ranges outside the plan, sorted and merged
+}
+
+// OverFetchedBytes returns how many requested bytes the plan did not need.
+func (a FetchAudit) OverFetchedBytes() int64 {
+	return rangesLength(a.OverFetch)
+}
+
+// fetchAuditor records the ranges a download session plans and requests,
+// for DownloadOptions.AuditFetches. Ranges with a Length of 0 run to the
+// end of the blob, which is looked up when the audit is made.
+type fetchAuditor struct {
+	sizer storage.BlobSizer // Tells the sizes of blobs with open ranges; may be nil
+
+	mu        sync.Mutex
+	planned   map[digest.Digest][]FetchRange
+	requested map[digest.Digest][]*fetchRequest
+}
+
+// fetchRequest is one ReadBlob call and how much of its body was read.
+type fetchRequest struct {
+	FetchRange
+	read int64
+}
+
+func newFetchAuditor(sizer storage.BlobSizer) *fetchAuditor {
+	return &fetchAuditor{
+		sizer:     sizer,
+		planned:   make(map[digest.Digest][]FetchRange),
+		requested: make(map[digest.Digest][]*fetchRequest),
+	}
+}
+
+// plan adds the ranges the session expects to read for one file: the
+// spans of its chunks, or the whole blob for a streamed layer.
+func (a *fetchAuditor) plan(blob digest.Digest, meta *FileMetadata, spans []ChunkSpan) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if meta.Streamed != "" {
+		a.planned[blob] = append(a.planned[blob], FetchRange{})
+		return
+	}
+	for _, span := range spans {
+		a.planned[blob] = append(a.planned[blob], FetchRange{Offset: span.CompressedOffset, Length: span.CompressedLength})
+	}
+}
+
+// request records a ReadBlob call; the caller adds to its read count.
+func (a *fetchAuditor) request(blob digest.Digest, offset, length int64) *fetchRequest {
+	req := &fetchRequest{FetchRange: FetchRange{Offset: offset, Length: max(length, 0)}}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requested[blob] = append(a.requested[blob], req)
+	return req
+}
+
+func (a *fetchAuditor) addRead(req *fetchRequest, n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	req.read += n
+}
+
+// audit compares the requests made with the plan, blob by blob in digest
+// order. Blob sizes come from the sizer when it can tell them; otherwise an
+// open-ended request is taken to end where reading its body stopped.
+func (a *fetchAuditor) audit(ctx context.Context) []FetchAudit {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	audits := make([]FetchAudit, 0, len(a.requested))
+	for blob, requests := range a.requested {
+		audit := FetchAudit{BlobDigest: blob, Requests: len(requests)}
+		var size int64 = -1
+		for _, req := range requests {
+			if req.Length == 0 {
+				audit.OpenEnded++
+			}
+		}
+		if audit.OpenEnded > 0 || hasOpenRange(a.planned[blob]) {
+			size = blobSizeFor(ctx, a.sizer, blob)
+		}
+
+		var requested []FetchRange
+		var end int64
+		for _, req := range requests {
+			audit.ReadBytes += req.read
+			r := req.FetchRange
+			if r.Length == 0 {
+				r.Length = req.read
+				if size >= 0 {
+					r.Length = max(size-r.Offset, 0)
+				}
+			}
+			requested = append(requested, r)
+			end = max(end, r.End())
+		}
+		if size < 0 {
+			size = end
+		}
+
+		var planned []FetchRange
+		for _, r := range a.planned[blob] {
+			if r.Length == 0 {
+				r.Length = max(size-r.Offset, 0)
+			}
+			planned = append(planned, r)
+		}
+
+		requested, planned = mergeRanges(requested), mergeRanges(planned)
+		audit.RequestedBytes = rangesLength(requested)
+		audit.PlannedBytes = rangesLength(planned)
+		audit.OverFetch = subtractRanges(requested, planned)
+		audits = append(audits, audit)
+	}
+	sort.Slice(audits, func(i, j int) bool { return audits[i].BlobDigest < audits[j].BlobDigest })
+	return audits
+}
+
+func hasOpenRange(ranges []FetchRange) bool {
+	for _, r := range ranges {
+		if r.Length == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// blobSizeFor returns the size of blob, or -1 if sizer cannot tell it.
+func blobSizeFor(ctx context.Context, sizer storage.BlobSizer, blob digest.Digest) int64 {
+	if sizer == nil {
+		return -1
+	}
+	size, err := sizer.BlobSize(ctx, blob)
+	if err != nil {
+		logger.Debug("Auditing %s without its size: %v", blob, err)
+		return -1
+	}
+	return size
+}
+
+// mergeRanges sorts ranges and joins those that overlap or touch. Empty
+// ranges are dropped.
+func mergeRanges(ranges []FetchRange) []FetchRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Offset < ranges[j].Offset })
+	var merged []FetchRange
+	for _, r := range ranges {
+		if r.Length <= 0 {
+			continue
+		}
+		if n := len(merged); n > 0 && r.Offset <= merged[n-1].End() {
+			merged[n-1].Length = max(merged[n-1].End(), r.End()) - merged[n-1].Offset
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func rangesLength(ranges []FetchRange) int64 {
+	var n int64
+	for _, r := range ranges {
+		n += r.Length
+	}
+	return n
+}
+
+// subtractRanges returns the parts of ranges not covered by cover. Both
+// must be merged.
+func subtractRanges(ranges, cover []FetchRange) []FetchRange {
+	var out []FetchRange
+	i := 0
+	for _, r := range ranges {
+		start := r.Offset
+		for ; i < len(cover) && cover[i].End() <= start; i++ {
+		}
+		for j := i; j < len(cover) && cover[j].Offset < r.End(); j++ {
+			if cover[j].Offset > start {
+				out = append(out, FetchRange{Offset: start, Length: cover[j].Offset - start})
+			}
+			start = max(start, cover[j].End())
+		}
+		if start < r.End() {
+			out = append(out, FetchRange{Offset: start, Length: r.End() - start})
+		}
+	}
+	return out
+}
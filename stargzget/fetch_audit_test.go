@@ -0,0 +1,91 @@
+package stargzget
+
+import (
+	"context"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// sizedStorage tells the size of its one blob.
+type sizedStorage struct {
+	storage.Storage
+	size int64
+}
+
+func (s *sizedStorage) BlobSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	return s.size, nil
+}
+
+func TestDownloader_AuditFetches(t *testing.T) {
+	// Random content does not compress, so each file's member is as large
+	// as the file.
+	rng := rand.New(rand.NewSource(1))
+	first, second := make([]byte, 64<<10), make([]byte, 64<<10)
+	rng.Read(first)
+	rng.Read(second)
+	layer := estargztest.NewBuilder().File("first", first).File("second", second).MustBuild()
+	mock := storage.NewMockStorage()
+	mock.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	store := &sizedStorage{Storage: mock, size: int64(len(layer.Blob))}
+	resolver := NewBlobResolver(store)
+
+	jobs := []*DownloadJob{{Path: "first", BlobDigest: layer.Digest, Size: int64(len(first)), OutputPath: filepath.Join(t.TempDir(), "first")}}
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, &DownloadOptions{AuditFetches: true})
+	if err != nil || stats.DownloadedFiles != 1 {
+		t.Fatalf("StartDownload() = %+v, %v", stats, err)
+	}
+	if len(stats.Fetches) != 1 {
+		t.Fatalf("Fetches = %+v, want one blob", stats.Fetches)
+	}
+	audit := stats.Fetches[0]
+
+	spans, err := resolver.FileChunks(context.Background(), layer.Digest, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	planEnd := spans[len(spans)-1].CompressedOffset + spans[len(spans)-1].CompressedLength
+	if audit.PlannedBytes != planEnd-spans[0].CompressedOffset {
+		t.Errorf("PlannedBytes = %d, want %d", audit.PlannedBytes, planEnd-spans[0].CompressedOffset)
+	}
+	if audit.Requests == 0 || audit.ReadBytes < audit.PlannedBytes {
+		t.Errorf("Requests = %d, ReadBytes = %d; want the planned %d bytes read", audit.Requests, audit.ReadBytes, audit.PlannedBytes)
+	}
+	// Chunk reads stop where the file's member ends instead of asking for
+	// the second file and the TOC too.
+	if audit.OpenEnded != 0 || len(audit.OverFetch) != 0 || audit.RequestedBytes != audit.PlannedBytes {
+		t.Errorf("OpenEnded = %d, OverFetch = %+v, RequestedBytes = %d; want bounded reads of the %d planned bytes", audit.OpenEnded, audit.OverFetch, audit.RequestedBytes, audit.PlannedBytes)
+	}
+
+	stats, err = NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, nil)
+	if err != nil || stats.Fetches != nil {
+		t.Errorf("StartDownload() without auditing = Fetches %+v, %v; want none", stats.Fetches, err)
+	}
+}
+
+func TestSubtractRanges(t *testing.T) {
+	tests := []struct {
+		ranges, cover, want []FetchRange
+	}{
+		{[]FetchRange{{0, 100}}, nil, []FetchRange{{0, 100}}},
+		{[]FetchRange{{0, 100}}, []FetchRange{{0, 100}}, nil},
+		{[]FetchRange{{0, 100}}, []FetchRange{{10, 20}, {50, 10}}, []FetchRange{{0, 10}, {30, 20}, {60, 40}}},
+		{[]FetchRange{{0, 10}, {20, 10}}, []FetchRange{{5, 20}}, []FetchRange{{0, 5}, {25, 5}}},
+		{[]FetchRange{{40, 10}}, []FetchRange{{0, 10}, {45, 100}}, []FetchRange{{40, 5}}},
+	}
+	for _, tt := range tests {
+		if got := subtractRanges(tt.ranges, tt.cover); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("subtractRanges(%v, %v) = %v, want %v", tt.ranges, tt.cover, got, tt.want)
+		}
+	}
+
+	merged := mergeRanges([]FetchRange{{30, 10}, {0, 10}, {10, 5}, {35, 20}, {60, 0}})
+	if want := []FetchRange{{0, 15}, {30, 25}}; !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeRanges() = %v, want %v", merged, want)
+	}
+}
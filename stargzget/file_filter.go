@@ -0,0 +1,54 @@
+package stargzget
+
+import "time"
+
+// FileFilter selects index entries by TOC metadata alone, so files can be
+// picked by age or size without fetching their content. Zero fields do not
+// constrain the match.
+type FileFilter struct {
+	NewerThan time.Time   // Keep files modified strictly after this time
+	OlderThan time.Time   // Keep files modified strictly before this time
+	MinSize   int64       // Keep files of at least this many bytes
+	MaxSize   int64       // Keep files of at most this many bytes
+	Expr      *FilterExpr // Keep files matching this expression
+}
+
+// IsZero reports whether the filter matches every file.
+func (f FileFilter) IsZero() bool {
+	return f == FileFilter{}
+}
+
+// Match reports whether info satisfies every constraint of the filter.
+// Entries without a recorded modification time never match a time bound.
+func (f FileFilter) Match(info *FileInfo) bool {
+	if !f.NewerThan.IsZero() && (info.ModTime.IsZero() || !info.ModTime.After(f.NewerThan)) {
+		return false
+	}
+	if !f.OlderThan.IsZero() && (info.ModTime.IsZero() || !info.ModTime.Before(f.OlderThan)) {
+		return false
+	}
+	if f.MinSize > 0 && info.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && info.Size > f.MaxSize {
+		return false
+	}
+	if f.Expr != nil && !f.Expr.Match(info) {
+		return false
+	}
+	return true
+}
+
+// Filter returns the entries of files that match, preserving their order.
+func (f FileFilter) Filter(files []*FileInfo) []*FileInfo {
+	if f.IsZero() {
+		return files
+	}
+	var matched []*FileInfo
+	for _, info := range files {
+		if f.Match(info) {
+			matched = append(matched, info)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,49 @@
+package stargzget
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileFilter_Match(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	file := &FileInfo{Path: "etc/app.conf", Size: 2048, ModTime: base}
+	undated := &FileInfo{Path: "etc/old.conf", Size: 2048}
+
+	tests := []struct {
+		name   string
+		filter FileFilter
+		info   *FileInfo
+		want   bool
+	}{
+		{name: "zero filter", info: undated, want: true},
+		{name: "newer than earlier", filter: FileFilter{NewerThan: base.Add(-time.Hour)}, info: file, want: true},
+		{name: "newer than same instant", filter: FileFilter{NewerThan: base}, info: file, want: false},
+		{name: "older than later", filter: FileFilter{OlderThan: base.Add(time.Hour)}, info: file, want: true},
+		{name: "older than earlier", filter: FileFilter{OlderThan: base.Add(-time.Hour)}, info: file, want: false},
+		{name: "time bound without mtime", filter: FileFilter{OlderThan: base}, info: undated, want: false},
+		{name: "min size met", filter: FileFilter{MinSize: 2048}, info: file, want: true},
+		{name: "min size not met", filter: FileFilter{MinSize: 2049}, info: file, want: false},
+		{name: "max size met", filter: FileFilter{MaxSize: 2048}, info: file, want: true},
+		{name: "max size exceeded", filter: FileFilter{MaxSize: 1024}, info: file, want: false},
+		{name: "expression met", filter: FileFilter{Expr: mustParseFilterExpr(t, `path contains "app"`)}, info: file, want: true},
+		{name: "expression not met", filter: FileFilter{MinSize: 1, Expr: mustParseFilterExpr(t, `size > 4K`)}, info: file, want: false},
+		{name: "all bounds", filter: FileFilter{NewerThan: base.Add(-time.Hour), OlderThan: base.Add(time.Hour), MinSize: 1, MaxSize: 4096}, info: file, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.info); got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustParseFilterExpr(t *testing.T, s string) *FilterExpr {
+	t.Helper()
+	e, err := ParseFilterExpr(s)
+	if err != nil {
+		t.Fatalf("ParseFilterExpr(%q) error = %v", s, err)
+	}
+	return e
+}
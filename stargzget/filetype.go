@@ -0,0 +1,258 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// FileTypeSniffLen is the number of leading bytes DetectFileType looks at.
+// It covers the tar header magic at offset 257 and every ELF/PE field used.
+const FileTypeSniffLen = 512
+
+// FileType is the result of sniffing a file's leading bytes.
+type FileType struct {
+	Kind        string // elf, mach-o, pe, script, gzip, zip, tar, bzip2, xz, zstd, 7z, text, data, empty
+	Description string // Human readable detail, e.g. "ELF 64-bit LSB executable, x86-64"
+}
+
+func (t FileType) String() string {
+	if t.Description != "" {
+		return t.Description
+	}
+	return t.Kind
+}
+
+// ReadFileHead returns up to n leading bytes of path in blobDigest. Only the
+// gzip members covering those bytes are fetched, and each member is decoded
+// just far enough to fill the buffer, so large files are never downloaded in
+// full. Files of layers indexed by WithTarFallback are read by streaming
+// the layer up to the file.
+func ReadFileHead(ctx context.Context, resolver BlobResolver, storage stor.Storage, blobDigest digest.Digest, path string, n int64) ([]byte, error) {
+	metadata, err := resolver.FileMetadata(ctx, blobDigest, path)
+	if err != nil {
+		return nil, err
+	}
+	if n > metadata.Size {
+		n = metadata.Size
+	}
+	if metadata.Streamed != "" {
+		return readStreamedHead(ctx, storage, blobDigest, metadata.Streamed, path, n)
+	}
+
+	spans, err := resolver.FileChunks(ctx, blobDigest, path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Offset < spans[j].Offset })
+
+	head := make([]byte, 0, n)
+	for _, span := range spans {
+		chunk := span.Chunk
+		if int64(len(head)) >= n {
+			break
+		}
+		if chunk.Size <= 0 {
+			continue
+		}
+		want := n - int64(len(head))
+		if want > chunk.Size {
+			want = chunk.Size
+		}
+		data, err := readChunkPrefix(ctx, storage, blobDigest, span, want)
+		if err != nil {
+			return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+		}
+		head = append(head, data...)
+	}
+	return head, nil
+}
+
+// readChunkPrefix decodes the first want bytes of span's chunk and closes the
+// blob stream as soon as they are available. The read is bounded by the
+// span's gzip member, and open-ended only when its end is not known.
+func readChunkPrefix(ctx context.Context, storage stor.Storage, blobDigest digest.Digest, span ChunkSpan, want int64) ([]byte, error) {
+	chunk := span.Chunk
+	reader, err := storage.ReadBlob(ctx, blobDigest, chunk.CompressedOffset, span.CompressedLength)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	gz, err := getGzipReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer putGzipReader(gz)
+	gz.Multistream(false)
+
+	if chunk.InnerOffset > 0 {
+		if _, err := io.CopyN(io.Discard, gz, chunk.InnerOffset); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, want)
+	if _, err := io.ReadFull(gz, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// DetectFileType identifies executables, scripts and archives from the
+// leading bytes of a file.
+func DetectFileType(head []byte) FileType {
+	if len(head) > FileTypeSniffLen {
+		head = head[:FileTypeSniffLen]
+	}
+
+	switch {
+	case len(head) == 0:
+		return FileType{Kind: "empty", Description: "empty"}
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return detectELF(head)
+	case bytes.HasPrefix(head, []byte("#!")):
+		return detectScript(head)
+	case isMachO(head):
+		return FileType{Kind: "mach-o", Description: "Mach-O binary"}
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return detectPE(head)
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return FileType{Kind: "gzip", Description: "gzip compressed data"}
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return FileType{Kind: "zip", Description: "Zip archive"}
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return FileType{Kind: "bzip2", Description: "bzip2 compressed data"}
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return FileType{Kind: "xz", Description: "XZ compressed data"}
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FileType{Kind: "zstd", Description: "Zstandard compressed data"}
+	case bytes.HasPrefix(head, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}):
+		return FileType{Kind: "7z", Description: "7-zip archive"}
+	case len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar")):
+		return FileType{Kind: "tar", Description: "POSIX tar archive"}
+	case isText(head):
+		return FileType{Kind: "text", Description: "text"}
+	}
+	return FileType{Kind: "data", Description: "data"}
+}
+
+var elfMachines = map[uint16]string{
+	0x03:  "Intel 80386",
+	0x08:  "MIPS",
+	0x14:  "PowerPC",
+	0x15:  "64-bit PowerPC",
+	0x16:  "IBM S/390",
+	0x28:  "ARM",
+	0x3e:  "x86-64",
+	0xb7:  "ARM aarch64",
+	0xf3:  "RISC-V",
+	0x102: "LoongArch",
+}
+
+var elfTypes = map[uint16]string{
+	1: "relocatable",
+	2: "executable",
+	3: "shared object",
+	4: "core file",
+}
+
+func detectELF(head []byte) FileType {
+	if len(head) < 20 {
+		return FileType{Kind: "elf", Description: "ELF (truncated)"}
+	}
+
+	class := "32-bit"
+	if head[4] == 2 {
+		class = "64-bit"
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	endian := "LSB"
+	if head[5] == 2 {
+		order = binary.BigEndian
+		endian = "MSB"
+	}
+
+	elfType, ok := elfTypes[order.Uint16(head[16:18])]
+	if !ok {
+		elfType = "unknown type"
+	}
+	machine, ok := elfMachines[order.Uint16(head[18:20])]
+	if !ok {
+		machine = fmt.Sprintf("machine 0x%x", order.Uint16(head[18:20]))
+	}
+
+	return FileType{
+		Kind:        "elf",
+		Description: fmt.Sprintf("ELF %s %s %s, %s", class, endian, elfType, machine),
+	}
+}
+
+func detectScript(head []byte) FileType {
+	line := head[2:]
+	if idx := bytes.IndexByte(line, '\n'); idx != -1 {
+		line = line[:idx]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return FileType{Kind: "script", Description: "script"}
+	}
+
+	interpreter := fields[0]
+	// "#!/usr/bin/env python3" names the real interpreter as an argument.
+	if strings.HasSuffix(interpreter, "/env") {
+		for _, arg := range fields[1:] {
+			if !strings.HasPrefix(arg, "-") {
+				interpreter = arg
+				break
+			}
+		}
+	}
+	if idx := strings.LastIndex(interpreter, "/"); idx != -1 {
+		interpreter = interpreter[idx+1:]
+	}
+
+	return FileType{Kind: "script", Description: interpreter + " script"}
+}
+
+func detectPE(head []byte) FileType {
+	if len(head) >= 0x40 {
+		peOffset := int(binary.LittleEndian.Uint32(head[0x3c:0x40]))
+		if peOffset+4 <= len(head) && bytes.Equal(head[peOffset:peOffset+4], []byte("PE\x00\x00")) {
+			return FileType{Kind: "pe", Description: "PE executable (Windows)"}
+		}
+	}
+	return FileType{Kind: "pe", Description: "MS-DOS executable"}
+}
+
+func isMachO(head []byte) bool {
+	if len(head) < 4 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(head[:4]) {
+	case 0xfeedface, 0xfeedfacf, 0xcefaedfe, 0xcffaedfe:
+		return true
+	}
+	return false
+}
+
+func isText(head []byte) bool {
+	if bytes.IndexByte(head, 0) != -1 {
+		return false
+	}
+	// The sniffed prefix may end in the middle of a multi-byte rune.
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+	return utf8.Valid(head)
+}
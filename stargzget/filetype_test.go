@@ -0,0 +1,101 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestDetectFileType(t *testing.T) {
+	elf64 := make([]byte, 64)
+	copy(elf64, "\x7fELF\x02\x01\x01")
+	elf64[16] = 2    // ET_EXEC
+	elf64[18] = 0x3e // x86-64
+
+	elfARM := make([]byte, 64)
+	copy(elfARM, "\x7fELF\x02\x01\x01")
+	elfARM[16] = 3    // ET_DYN
+	elfARM[18] = 0xb7 // aarch64
+
+	tarHeader := make([]byte, 512)
+	copy(tarHeader, "etc/passwd")
+	copy(tarHeader[257:], "ustar\x0000")
+
+	tests := []struct {
+		name     string
+		head     []byte
+		wantKind string
+		wantDesc string
+	}{
+		{name: "empty", head: nil, wantKind: "empty", wantDesc: "empty"},
+		{name: "elf x86-64", head: elf64, wantKind: "elf", wantDesc: "ELF 64-bit LSB executable, x86-64"},
+		{name: "elf aarch64 shared", head: elfARM, wantKind: "elf", wantDesc: "ELF 64-bit LSB shared object, ARM aarch64"},
+		{name: "shell script", head: []byte("#!/bin/sh\necho hi\n"), wantKind: "script", wantDesc: "sh script"},
+		{name: "env script", head: []byte("#!/usr/bin/env -S python3 -u\n"), wantKind: "script", wantDesc: "python3 script"},
+		{name: "gzip", head: []byte{0x1f, 0x8b, 0x08, 0x00}, wantKind: "gzip"},
+		{name: "zip", head: []byte("PK\x03\x04rest"), wantKind: "zip"},
+		{name: "xz", head: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, wantKind: "xz"},
+		{name: "zstd", head: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, wantKind: "zstd"},
+		{name: "tar", head: tarHeader, wantKind: "tar"},
+		{name: "text", head: []byte("root:x:0:0:root:/root:/bin/bash\n"), wantKind: "text"},
+		{name: "text cut mid rune", head: []byte("caf\xc3"), wantKind: "text"},
+		{name: "binary data", head: []byte{0x00, 0x01, 0x02, 0xff}, wantKind: "data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DetectFileType(tt.head)
+			if got.Kind != tt.wantKind {
+				t.Fatalf("Kind = %q, want %q", got.Kind, tt.wantKind)
+			}
+			if tt.wantDesc != "" && got.Description != tt.wantDesc {
+				t.Fatalf("Description = %q, want %q", got.Description, tt.wantDesc)
+			}
+		})
+	}
+}
+
+func TestReadFileHead_ReadsOnlyLeadingChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 256) // 4KB
+	store := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, store, resolver, "usr/lib/big", content, 1024)
+
+	counting := &countingStorage{Storage: store}
+	head, err := ReadFileHead(context.Background(), resolver, counting, dgst, "usr/lib/big", FileTypeSniffLen)
+	if err != nil {
+		t.Fatalf("ReadFileHead() unexpected error: %v", err)
+	}
+	if !bytes.Equal(head, content[:FileTypeSniffLen]) {
+		t.Fatalf("head mismatch")
+	}
+	if got := counting.reads; got != 1 {
+		t.Fatalf("ReadBlob calls = %d, want 1", got)
+	}
+	// The read stops where the next chunk's member starts instead of
+	// fetching the rest of the layer.
+	meta, _ := resolver.FileMetadata(context.Background(), dgst, "usr/lib/big")
+	if want := meta.Chunks[1].CompressedOffset - meta.Chunks[0].CompressedOffset; counting.lengths[0] != want {
+		t.Fatalf("ReadBlob length = %d, want %d", counting.lengths[0], want)
+	}
+
+	// Heads spanning chunk boundaries are stitched together.
+	head, err = ReadFileHead(context.Background(), resolver, store, dgst, "usr/lib/big", 1500)
+	if err != nil {
+		t.Fatalf("ReadFileHead() unexpected error: %v", err)
+	}
+	if !bytes.Equal(head, content[:1500]) {
+		t.Fatalf("head across chunks mismatch")
+	}
+
+	// Requests larger than the file are clamped.
+	head, err = ReadFileHead(context.Background(), resolver, store, dgst, "usr/lib/big", 1<<20)
+	if err != nil {
+		t.Fatalf("ReadFileHead() unexpected error: %v", err)
+	}
+	if !bytes.Equal(head, content) {
+		t.Fatalf("full head mismatch")
+	}
+}
@@ -0,0 +1,435 @@
+package stargzget
+
+import (
+	"fmt"
+	pathpkg "path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FilterExpr is a boolean expression over TOC metadata, such as
+//
+//	size > 1MB && path =~ "^usr/lib" && !(path contains ".debug")
+//
+// Comparisons are combined with &&, || and !, grouped with parentheses.
+// Fields and the operators they accept:
+//
+//	path, name, type, link, layer   == != =~ !~ contains   (string literals)
+//	size, mode, uid, gid            == != < <= > >=        (numbers)
+//	mtime                           == != < <= > >=        (RFC 3339 time or YYYY-MM-DD)
+//
+// name is the base name of path, type is reg, symlink, hardlink, char,
+// block or fifo, link is the symlink or hard link target and layer is the
+// layer digest (sha256:...). Numbers accept a K, M or G suffix, optionally
+// followed by B or iB, all meaning powers of 1024 (1MB is 1048576 bytes);
+// a leading 0 makes a number octal, as in mode == 0755. Comparisons on mtime
+// never match entries without a recorded modification time.
+type FilterExpr struct {
+	src  string
+	root exprNode
+}
+
+type exprNode interface {
+	eval(info *FileInfo) bool
+}
+
+type exprField struct {
+	kind  exprKind
+	value func(info *FileInfo) string // For string fields
+	num   func(info *FileInfo) int64  // For number fields
+}
+
+type exprKind int
+
+const (
+	exprString exprKind = iota
+	exprNumber
+	exprTime
+)
+
+var exprFields = map[string]exprField{
+	"path":  {kind: exprString, value: func(f *FileInfo) string { return f.Path }},
+	"name":  {kind: exprString, value: func(f *FileInfo) string { return pathpkg.Base(f.Path) }},
+	"type":  {kind: exprString, value: exprFileType},
+	"link":  {kind: exprString, value: func(f *FileInfo) string { return f.LinkName }},
+	"layer": {kind: exprString, value: func(f *FileInfo) string { return f.BlobDigest.String() }},
+	"size":  {kind: exprNumber, num: func(f *FileInfo) int64 { return f.Size }},
+	"mode":  {kind: exprNumber, num: exprUnixMode},
+	"uid":   {kind: exprNumber, num: func(f *FileInfo) int64 { return int64(f.UID) }},
+	"gid":   {kind: exprNumber, num: func(f *FileInfo) int64 { return int64(f.GID) }},
+	"mtime": {kind: exprTime},
+}
+
+// ParseFilterExpr parses s. Unknown fields, operators a field does not
+// accept, values of the wrong kind and invalid regular expressions are
+// reported here rather than when files are matched.
+func ParseFilterExpr(s string) (*FilterExpr, error) {
+	toks, err := lexFilterExpr(s)
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %w", s, err)
+	}
+	p := &exprParser{toks: toks}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf("unexpected %s", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %w", s, err)
+	}
+	return &FilterExpr{src: s, root: root}, nil
+}
+
+// String returns the expression as given.
+func (e *FilterExpr) String() string {
+	return e.src
+}
+
+// Match reports whether info satisfies the expression.
+func (e *FilterExpr) Match(info *FileInfo) bool {
+	return e.root.eval(info)
+}
+
+type andNode struct{ left, right exprNode }
+
+func (n andNode) eval(info *FileInfo) bool { return n.left.eval(info) && n.right.eval(info) }
+
+type orNode struct{ left, right exprNode }
+
+func (n orNode) eval(info *FileInfo) bool { return n.left.eval(info) || n.right.eval(info) }
+
+type notNode struct{ expr exprNode }
+
+func (n notNode) eval(info *FileInfo) bool { return !n.expr.eval(info) }
+
+type compareNode struct {
+	field exprField
+	op    string
+	str   string
+	re    *regexp.Regexp
+	num   int64
+	time  time.Time
+}
+
+func (n compareNode) eval(info *FileInfo) bool {
+	switch n.field.kind {
+	case exprString:
+		v := n.field.value(info)
+		switch n.op {
+		case "==":
+			return v == n.str
+		case "!=":
+			return v != n.str
+		case "=~":
+			return n.re.MatchString(v)
+		case "!~":
+			return !n.re.MatchString(v)
+		case "contains":
+			return strings.Contains(v, n.str)
+		}
+	case exprNumber:
+		return compareOrdered(n.op, n.field.num(info), n.num)
+	case exprTime:
+		if info.ModTime.IsZero() {
+			return false
+		}
+		return compareOrdered(n.op, info.ModTime.Compare(n.time), 0)
+	}
+	return false
+}
+
+func compareOrdered[T int | int64](op string, a, b T) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// exprFileType names the entry type, counting untyped entries as regular
+// files.
+func exprFileType(info *FileInfo) string {
+	if info.Type == "" {
+		return "reg"
+	}
+	return info.Type
+}
+
+// exprUnixMode returns the mode as the TOC records it, with the setuid,
+// setgid and sticky bits at their octal positions.
+func exprUnixMode(info *FileInfo) int64 {
+	return unixModeFromFileMode(info.Mode)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string // Unquoted for strings
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// exprOperators lists the symbolic operators, longest first so that "<="
+// is not read as "<".
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")"}
+
+func lexFilterExpr(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '`':
+			quoted, err := strconv.QuotedPrefix(s[i:])
+			if err != nil {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			text, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %v", i, err)
+			}
+			toks = append(toks, token{kind: tokString, text: text, pos: i})
+			i += len(quoted)
+		case isExprDigit(c):
+			end := i
+			for end < len(s) && (isExprLetter(s[end]) || isExprDigit(s[end]) || s[end] == '.') {
+				end++
+			}
+			toks = append(toks, token{kind: tokNumber, text: s[i:end], pos: i})
+			i = end
+		case isExprLetter(c):
+			end := i
+			for end < len(s) && (isExprLetter(s[end]) || isExprDigit(s[end])) {
+				end++
+			}
+			toks = append(toks, token{kind: tokIdent, text: s[i:end], pos: i})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range exprOperators {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(s)}), nil
+}
+
+func isExprDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isExprLetter(c byte) bool { return c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z') }
+
+// exprParser is a recursive descent parser; && binds tighter than ||.
+type exprParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *exprParser) peek() token { return p.toks[p.pos] }
+
+func (p *exprParser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%s at offset %d", fmt.Sprintf(format, args...), p.peek().pos)
+}
+
+func (p *exprParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{expr}, nil
+	}
+	if p.accept("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("expected ')', got %s", p.peek())
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	name := p.peek()
+	if name.kind != tokIdent {
+		return nil, p.errorf("expected a field name, got %s", name)
+	}
+	field, ok := exprFields[name.text]
+	if !ok {
+		return nil, p.errorf("unknown field %q", name.text)
+	}
+	p.next()
+
+	opTok := p.peek()
+	op := opTok.text
+	if opTok.kind != tokOp && !(opTok.kind == tokIdent && op == "contains") {
+		return nil, p.errorf("expected an operator after %s, got %s", name.text, opTok)
+	}
+	if !fieldAccepts(field.kind, op) {
+		return nil, p.errorf("operator %s does not apply to %s", op, name.text)
+	}
+	p.next()
+
+	value := p.peek()
+	n := compareNode{field: field, op: op}
+	switch field.kind {
+	case exprString:
+		if value.kind != tokString {
+			return nil, p.errorf("%s %s needs a quoted string, got %s", name.text, op, value)
+		}
+		n.str = value.text
+		if op == "=~" || op == "!~" {
+			re, err := regexp.Compile(value.text)
+			if err != nil {
+				return nil, p.errorf("invalid regular expression: %v", err)
+			}
+			n.re = re
+		}
+	case exprNumber:
+		if value.kind != tokNumber {
+			return nil, p.errorf("%s %s needs a number, got %s", name.text, op, value)
+		}
+		num, err := parseExprNumber(value.text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		n.num = num
+	case exprTime:
+		if value.kind != tokString {
+			return nil, p.errorf("%s %s needs a quoted time, got %s", name.text, op, value)
+		}
+		t, err := time.Parse(time.RFC3339, value.text)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, value.text); err != nil {
+				return nil, p.errorf("invalid time %q: expected RFC 3339 or YYYY-MM-DD", value.text)
+			}
+		}
+		n.time = t
+	}
+	p.next()
+	return n, nil
+}
+
+func fieldAccepts(kind exprKind, op string) bool {
+	switch op {
+	case "==", "!=":
+		return true
+	case "=~", "!~", "contains":
+		return kind == exprString
+	case "<", "<=", ">", ">=":
+		return kind != exprString
+	}
+	return false
+}
+
+// exprUnits maps number suffixes to their multipliers.
+var exprUnits = map[string]int64{
+	"b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+}
+
+// parseExprNumber parses an integer, which may be octal or hex, or a
+// possibly fractional count with a size unit, such as 1.5MB.
+func parseExprNumber(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return n, nil
+	}
+	digits := strings.TrimRightFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	unit := strings.ToLower(s[len(digits):])
+	multiplier, ok := exprUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid number %q: unknown unit %q", s, s[len(digits):])
+	}
+	f, err := strconv.ParseFloat(digits, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return int64(f * float64(multiplier)), nil
+}
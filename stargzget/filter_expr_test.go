@@ -0,0 +1,90 @@
+package stargzget
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFilterExpr_Match(t *testing.T) {
+	lib := &FileInfo{
+		Path:       "usr/lib/libc.so.6",
+		BlobDigest: digest.FromString("layer"),
+		Size:       2 << 20,
+		Mode:       0o755,
+		ModTime:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	debug := &FileInfo{Path: "usr/lib/debug/libc.so.6.debug", Size: 8 << 20, Mode: 0o644}
+	suid := &FileInfo{Path: "usr/bin/su", Size: 512, Mode: 0o755 | os.ModeSetuid, UID: 0, GID: 0}
+	link := &FileInfo{Path: "usr/bin/sh", Type: "symlink", LinkName: "bash", UID: 1000}
+
+	tests := []struct {
+		expr string
+		info *FileInfo
+		want bool
+	}{
+		{expr: `size > 1MB && path =~ "^usr/lib" && !(path contains ".debug")`, info: lib, want: true},
+		{expr: `size > 1MB && path =~ "^usr/lib" && !(path contains ".debug")`, info: debug, want: false},
+		{expr: `size >= 2MiB && size <= 2097152`, info: lib, want: true},
+		{expr: `size < 1.5K`, info: suid, want: true},
+		{expr: `path == "usr/bin/su" || size > 1G`, info: suid, want: true},
+		{expr: `path == "usr/bin/sh" || size > 1G`, info: suid, want: false},
+		{expr: `name == "su"`, info: suid, want: true},
+		{expr: `name !~ "\\.so"`, info: lib, want: false},
+		{expr: `mode == 04755`, info: suid, want: true},
+		{expr: `mode == 0755`, info: lib, want: true},
+		{expr: `type == "reg"`, info: lib, want: true},
+		{expr: `type == "symlink" && link == "bash"`, info: link, want: true},
+		{expr: `uid != 0`, info: link, want: true},
+		{expr: `gid == 0 && uid == 0`, info: suid, want: true},
+		{expr: `layer == "` + digest.FromString("layer").String() + `"`, info: lib, want: true},
+		{expr: `mtime >= "2024-05-01" && mtime < "2024-05-01T13:00:00Z"`, info: lib, want: true},
+		{expr: `mtime < "2030-01-01"`, info: debug, want: false},
+		{expr: `!(mtime < "2030-01-01")`, info: debug, want: true},
+		{expr: `size > 1M || size < 1K && path contains "bin"`, info: suid, want: true},
+		{expr: `(size > 1M || size < 1K) && path contains "lib"`, info: suid, want: false},
+		{expr: `!!(uid == 0)`, info: suid, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := ParseFilterExpr(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseFilterExpr() error = %v", err)
+			}
+			if got := e.Match(tt.info); got != tt.want {
+				t.Errorf("Match(%s) = %v, want %v", tt.info.Path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterExpr_Errors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{expr: ``, wantErr: "expected a field name"},
+		{expr: `owner == "root"`, wantErr: `unknown field "owner"`},
+		{expr: `size > "big"`, wantErr: "needs a number"},
+		{expr: `size > 1TB`, wantErr: `unknown unit "TB"`},
+		{expr: `path > "a"`, wantErr: "operator > does not apply to path"},
+		{expr: `size contains "1"`, wantErr: "operator contains does not apply to size"},
+		{expr: `path =~ "("`, wantErr: "invalid regular expression"},
+		{expr: `mtime > "yesterday"`, wantErr: `invalid time "yesterday"`},
+		{expr: `(size > 1`, wantErr: "expected ')'"},
+		{expr: `size > 1 size < 2`, wantErr: "unexpected \"size\" at offset 9"},
+		{expr: `path == "usr`, wantErr: "unterminated string"},
+		{expr: `size > 1 & size < 2`, wantErr: "unexpected character '&'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := ParseFilterExpr(tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParseFilterExpr() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package stargzget
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// gzipReaderPool recycles gzip.Readers across chunk reads. A fresh reader
+// allocates a ~40KB inflate window plus a bufio.Reader; Reset reuses both,
+// which matters when extracting tens of thousands of small files.
+var gzipReaderPool sync.Pool
+
+// getGzipReader returns a reader decoding r, reusing a pooled one if
+// available. Release it with putGzipReader once done.
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if gz, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		if err := gz.Reset(r); err != nil {
+			// A failed Reset leaves the reader usable for a later Reset.
+			gzipReaderPool.Put(gz)
+			return nil, err
+		}
+		return gz, nil
+	}
+	return gzip.NewReader(r)
+}
+
+// putGzipReader returns gz to the pool. gz must not be used afterwards.
+func putGzipReader(gz *gzip.Reader) {
+	gz.Close()
+	gzipReaderPool.Put(gz)
+}
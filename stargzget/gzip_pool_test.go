@@ -0,0 +1,117 @@
+package stargzget
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func gzipMember(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		tb.Fatalf("gzip write: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		tb.Fatalf("gzip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decodeNew(tb testing.TB, member []byte) {
+	gz, err := gzip.NewReader(bytes.NewReader(member))
+	if err != nil {
+		tb.Fatalf("gzip.NewReader: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		tb.Fatalf("decode: %v", err)
+	}
+	gz.Close()
+}
+
+func decodePooled(tb testing.TB, member []byte) {
+	gz, err := getGzipReader(bytes.NewReader(member))
+	if err != nil {
+		tb.Fatalf("getGzipReader: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		tb.Fatalf("decode: %v", err)
+	}
+	putGzipReader(gz)
+}
+
+func TestGzipReaderPool_ReducesAllocations(t *testing.T) {
+	member := gzipMember(t, bytes.Repeat([]byte("small file "), 64))
+
+	// Warm the pool so the measured runs reuse a reader.
+	decodePooled(t, member)
+
+	fresh := testing.AllocsPerRun(100, func() { decodeNew(t, member) })
+	pooled := testing.AllocsPerRun(100, func() { decodePooled(t, member) })
+	if pooled >= fresh {
+		t.Fatalf("pooled allocs/op = %.1f, want fewer than fresh allocs/op = %.1f", pooled, fresh)
+	}
+}
+
+func TestGzipReaderPool_ResetBetweenMembers(t *testing.T) {
+	first := gzipMember(t, []byte("first"))
+	second := gzipMember(t, []byte("second"))
+
+	for _, tc := range []struct {
+		member []byte
+		want   string
+	}{{first, "first"}, {second, "second"}, {first, "first"}} {
+		gz, err := getGzipReader(bytes.NewReader(tc.member))
+		if err != nil {
+			t.Fatalf("getGzipReader: %v", err)
+		}
+		got, err := io.ReadAll(gz)
+		putGzipReader(gz)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("decoded %q, want %q", got, tc.want)
+		}
+	}
+
+	if _, err := getGzipReader(bytes.NewReader([]byte("not gzip"))); err == nil {
+		t.Fatalf("getGzipReader(invalid) expected error")
+	}
+}
+
+func BenchmarkGzipDecode_NewReader(b *testing.B) {
+	member := gzipMember(b, bytes.Repeat([]byte("small file "), 64))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		decodeNew(b, member)
+	}
+}
+
+func BenchmarkGzipDecode_PooledReader(b *testing.B) {
+	member := gzipMember(b, bytes.Repeat([]byte("small file "), 64))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		decodePooled(b, member)
+	}
+}
+
+func BenchmarkDownloader_ReadChunk(b *testing.B) {
+	content := bytes.Repeat([]byte("chunk-data"), 100)
+	store := storage.NewMockStorage()
+	dgst := store.AddBlob("application/vnd.test.gzip", gzipMember(b, content))
+	d := NewDownloader(newMockBlobResolver(), store).(*downloader)
+	chunk := Chunk{Size: int64(len(content))}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.readChunk(context.Background(), dgst, "file", chunk); err != nil {
+			b.Fatalf("readChunk: %v", err)
+		}
+	}
+}
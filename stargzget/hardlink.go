@@ -0,0 +1,136 @@
+package stargzget
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+)
+
+// splitLinkJobs separates hard link jobs from jobs that fetch content. Link
+// targets are updated for files the portability checks renamed, and links to
+// other links are pointed at the file that is actually downloaded.
+//
+// Links are created in a deferred pass after every content job has finished,
+// so a link never races the worker writing its target, whatever the
+// concurrency.
+func splitLinkJobs(jobs []*DownloadJob, issues []PathIssue) (content, links []*DownloadJob) {
+	renamed := make(map[string]string)
+	for _, issue := range issues {
+		if issue.Renamed != "" {
+			renamed[issue.OutputPath] = issue.Renamed
+		}
+	}
+
+	byOutput := make(map[string]*DownloadJob, len(jobs))
+	for _, job := range jobs {
+		byOutput[job.OutputPath] = job
+	}
+
+	for _, job := range jobs {
+		if job.LinkTo == "" {
+			content = append(content, job)
+			continue
+		}
+
+		target := job.LinkTo
+		for hops := 0; hops < len(jobs); hops++ {
+			if r, ok := renamed[target]; ok {
+				target = r
+			}
+			next, ok := byOutput[target]
+			if !ok || next.LinkTo == "" {
+				break
+			}
+			target = next.LinkTo
+		}
+
+		link := *job
+		link.LinkTo = target
+		links = append(links, &link)
+	}
+	return content, links
+}
+
+// linkFiles creates the hard links planned for the session, after all
+// content has been written.
+func (s *downloadSession) linkFiles(ctx context.Context, links []*DownloadJob) {
+	for _, job := range links {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if s.blockedOutput(job.LinkTo) {
+			// Block the link too, rather than leave a copy of the file.
+			s.recordFiltered(FilteredFile{Path: job.Path, OutputPath: job.OutputPath, Action: FilterBlock, Reason: "hard link to a blocked file"})
+			s.mu.Lock()
+			s.stats.BlockedFiles++
+			s.mu.Unlock()
+			continue
+		}
+
+		var err error
+		if s.opts.Archive != nil {
+			err = s.opts.Archive.addLink(job)
+		} else if err = linkOrCopy(job.LinkTo, job.OutputPath); err == nil {
+			err = s.owner.apply(job)
+		}
+
+		s.mu.Lock()
+		if err == nil {
+			s.stats.DownloadedFiles++
+		} else {
+			s.stats.FailedFiles++
+		}
+		s.mu.Unlock()
+
+		if err != nil {
+			err = stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithMessage("failed to create hard link").WithCause(err)
+			logger.Error("Failed to link %s to %s: %v", job.OutputPath, job.LinkTo, err)
+			s.warn(Warning{Kind: WarningFileFailed, BlobDigest: job.BlobDigest, Path: job.Path, Err: err})
+			continue
+		}
+		logger.Info("Linked %s to %s", job.OutputPath, job.LinkTo)
+	}
+}
+
+// linkOrCopy makes output a hard link to target, replacing any existing
+// file. Where hard links are not possible (e.g. across devices or on
+// filesystems without them), the target's content is copied instead.
+func linkOrCopy(target, output string) error {
+	info, err := os.Stat(target)
+	if err != nil {
+		return fmt.Errorf("link target was not extracted: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(output); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	linkErr := os.Link(target, output)
+	if linkErr == nil {
+		return nil
+	}
+	logger.Debug("Hard link %s -> %s failed, copying instead: %v", output, target, linkErr)
+
+	src, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,117 @@
+package stargzget
+
+import (
+	"encoding/json"
+	"fmt"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// indexFileVersion is the format version of a saved ImageIndex.
+const indexFileVersion = 1
+
+// savedIndex is the JSON form of an ImageIndex. Layers are saved with the
+// TOCs they were indexed from rather than as the derived file lists, so a
+// loaded index is rebuilt exactly as BlobIndexLoader built it and its TOCs
+// can seed a resolver.
+type savedIndex struct {
+	Version        int           `json:"version"`
+	ManifestDigest digest.Digest `json:"manifestDigest,omitempty"`
+	Layers         []savedLayer  `json:"layers"`
+}
+
+type savedLayer struct {
+	Digest digest.Digest     `json:"digest"`
+	TOC    *estargzutil.JTOC `json:"toc"`
+}
+
+// MarshalJSON saves the index with the TOC of each layer, for a later step
+// of a pipeline to load instead of fetching the TOCs again. Only indexes
+// built by BlobIndexLoader (or loaded from JSON) can be saved.
+func (idx *ImageIndex) MarshalJSON() ([]byte, error) {
+	saved := savedIndex{
+		Version:        indexFileVersion,
+		ManifestDigest: idx.ManifestDigest,
+		Layers:         make([]savedLayer, 0, len(idx.Layers)),
+	}
+	for _, layer := range idx.Layers {
+		if layer.toc == nil {
+			return nil, fmt.Errorf("layer %s has no TOC to save", layer.BlobDigest)
+		}
+		saved.Layers = append(saved.Layers, savedLayer{Digest: layer.BlobDigest, TOC: layer.toc})
+	}
+	return json.Marshal(saved)
+}
+
+// UnmarshalJSON loads an index saved by MarshalJSON, replacing the contents
+// of idx. Check it against the image's current manifest with CheckManifest
+// before use.
+func (idx *ImageIndex) UnmarshalJSON(data []byte) error {
+	var saved savedIndex
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if saved.Version != indexFileVersion {
+		return fmt.Errorf("unsupported image index version %d (want %d)", saved.Version, indexFileVersion)
+	}
+	if saved.ManifestDigest != "" {
+		if err := saved.ManifestDigest.Validate(); err != nil {
+			return stargzerrors.ErrInvalidDigest.WithDetail("manifestDigest", saved.ManifestDigest.String()).WithCause(err)
+		}
+	}
+
+	loaded := newImageIndex(len(saved.Layers))
+	loaded.ManifestDigest = saved.ManifestDigest
+	for i, layer := range saved.Layers {
+		if err := layer.Digest.Validate(); err != nil {
+			return stargzerrors.ErrInvalidDigest.WithDetail("blobDigest", layer.Digest.String()).WithCause(err)
+		}
+		if layer.TOC == nil {
+			return fmt.Errorf("layer %d (%s) has no TOC", i, layer.Digest)
+		}
+		loaded.addLayer(layer.Digest, layer.TOC)
+	}
+	*idx = *loaded
+	return nil
+}
+
+// CheckManifest reports whether the index still describes the image whose
+// current manifest is manifest. It fails with ErrIndexStale when the index
+// was built for another manifest digest or, for an index that does not
+// record one, when it has a layer the manifest does not list.
+func (idx *ImageIndex) CheckManifest(manifest *stor.Manifest) error {
+	if idx.ManifestDigest != "" {
+		if manifest.Digest != idx.ManifestDigest {
+			return stargzerrors.ErrIndexStale.
+				WithDetail("indexManifest", idx.ManifestDigest.String()).
+				WithDetail("imageManifest", manifest.Digest.String())
+		}
+		return nil
+	}
+	listed := make(map[digest.Digest]bool, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		listed[digest.Digest(layer.Digest)] = true
+	}
+	for _, layer := range idx.Layers {
+		if !listed[layer.BlobDigest] {
+			return stargzerrors.ErrIndexStale.WithDetail("blobDigest", layer.BlobDigest.String())
+		}
+	}
+	return nil
+}
+
+// ResolverOptions returns BlobResolver options seeding the resolver with
+// the index's TOCs, so downloading files from a loaded index makes no TOC
+// requests.
+func (idx *ImageIndex) ResolverOptions() []BlobResolverOption {
+	var opts []BlobResolverOption
+	for _, layer := range idx.Layers {
+		if layer.toc != nil {
+			opts = append(opts, WithPrefetchedTOC(layer.BlobDigest, layer.toc))
+		}
+	}
+	return opts
+}
@@ -0,0 +1,112 @@
+package stargzget
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImageIndex_JSONRoundTrip(t *testing.T) {
+	const layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	storage := stor.NewMockStorage()
+	lower := storage.AddBlob(layerType, estargztest.NewBuilder().
+		File("etc/conf", []byte("conf")).
+		File("var/cache/x", []byte("x")).
+		Symlink("etc/link", "conf").
+		MustBuild().Blob)
+	upper := storage.AddBlob(layerType, estargztest.NewBuilder().
+		Whiteout("var/cache/x").
+		File("etc/conf", []byte("new conf")).
+		MustBuild().Blob)
+
+	index, err := NewBlobIndexLoader(storage, NewBlobResolver(storage)).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	index.ManifestDigest = digest.FromString("manifest")
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var loaded ImageIndex
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if loaded.ManifestDigest != index.ManifestDigest || len(loaded.Layers) != 2 || loaded.Layers[0].BlobDigest != lower || loaded.Layers[1].BlobDigest != upper {
+		t.Fatalf("loaded index = %+v, want the manifest digest and both layers in order", loaded)
+	}
+	want, got := index.AllFiles(), loaded.AllFiles()
+	sort.Strings(want)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AllFiles() = %v, want %v", got, want)
+	}
+	for _, path := range want {
+		before, _ := index.FindFile(path, "")
+		after, err := loaded.FindFile(path, "")
+		if err != nil || !reflect.DeepEqual(after, before) {
+			t.Errorf("FindFile(%s) = %+v, %v; want %+v", path, after, err, before)
+		}
+	}
+
+	// The loaded TOCs serve a resolver whose storage does not hold them.
+	resolver := NewBlobResolver(stor.NewMockStorage(), loaded.ResolverOptions()...)
+	if _, err := resolver.FileMetadata(context.Background(), upper, "etc/conf"); err != nil {
+		t.Errorf("FileMetadata() from loaded TOCs error = %v", err)
+	}
+}
+
+func TestImageIndex_UnmarshalJSONErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"version":         `{"version":2,"layers":[]}`,
+		"manifest digest": `{"version":1,"manifestDigest":"sha256:zz","layers":[]}`,
+		"layer digest":    `{"version":1,"layers":[{"digest":"nope","toc":{"version":1}}]}`,
+		"missing toc":     `{"version":1,"layers":[{"digest":"` + digest.FromString("x").String() + `"}]}`,
+	} {
+		var index ImageIndex
+		if err := json.Unmarshal([]byte(data), &index); err == nil {
+			t.Errorf("%s: Unmarshal(%s) succeeded", name, data)
+		}
+	}
+
+	if _, err := json.Marshal(&ImageIndex{Layers: []*LayerInfo{{BlobDigest: digest.FromString("x")}}}); err == nil {
+		t.Error("Marshal() of a layer without a TOC succeeded")
+	}
+}
+
+func TestImageIndex_CheckManifest(t *testing.T) {
+	layer := digest.FromString("layer")
+	manifestDigest := digest.FromString("manifest")
+	manifest := &stor.Manifest{Digest: manifestDigest, Layers: []stor.Layer{{Digest: layer.String()}}}
+
+	tests := []struct {
+		name    string
+		index   *ImageIndex
+		wantErr bool
+	}{
+		{name: "same manifest", index: &ImageIndex{ManifestDigest: manifestDigest}},
+		{name: "moved tag", index: &ImageIndex{ManifestDigest: digest.FromString("old")}, wantErr: true},
+		{name: "no digest, listed layer", index: &ImageIndex{Layers: []*LayerInfo{{BlobDigest: layer}}}},
+		{name: "no digest, unlisted layer", index: &ImageIndex{Layers: []*LayerInfo{{BlobDigest: digest.FromString("gone")}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.index.CheckManifest(manifest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && stargzerrors.GetErrorCode(err) != stargzerrors.ErrIndexStale.Code {
+				t.Errorf("CheckManifest() error code = %s, want %s", stargzerrors.GetErrorCode(err), stargzerrors.ErrIndexStale.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+// Package estargztest builds synthetic eStargz layers for tests.
+//
+// Layers are assembled the way estargz writers lay them out: a tar stream
+// split into gzip members where every file chunk starts a new member (or, with
+// a minimum chunk size, small chunks share a member and are addressed by
+// innerOffset), followed by a member holding the TOC tar entry and the
+// 51-byte footer. Tests can then exercise chunking, innerOffset packing,
+// symlinks, hardlinks and whiteouts without opaque binary fixtures.
+package estargztest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// Layer is a built eStargz blob together with its decoded TOC.
+type Layer struct {
+	Blob      []byte            // Compressed eStargz blob
+	TOC       *estargzutil.JTOC // TOC as written into the blob
+	Digest    digest.Digest     // Digest of Blob
+	DiffID    digest.Digest     // Digest of the uncompressed tar stream
+	TOCDigest digest.Digest     // Digest of the TOC JSON, as in the TOC digest annotation
+}
+
+// Builder accumulates entries for a layer. The zero value is not usable; use
+// NewBuilder.
+type Builder struct {
+	chunkSize    int64
+	minChunkSize int64
+	algorithm    digest.Algorithm
+	modTime      time.Time
+	entries      []*entry
+}
+
+type entry struct {
+	header  *tar.Header
+	content []byte
+}
+
+// Option configures a Builder.
+type Option func(*Builder)
+
+// WithChunkSize splits regular files into chunks of at most n bytes.
+// The default keeps each file in a single chunk.
+func WithChunkSize(n int64) Option {
+	return func(b *Builder) { b.chunkSize = n }
+}
+
+// WithMinChunkSize packs chunks into the current gzip member until it holds
+// at least n uncompressed bytes, producing entries with non-zero innerOffset.
+func WithMinChunkSize(n int64) Option {
+	return func(b *Builder) { b.minChunkSize = n }
+}
+
+// WithDigestAlgorithm computes every digest of the layer, from the chunk
+// and entry digests in the TOC to Digest and TOCDigest, with algorithm
+// instead of sha256.
+func WithDigestAlgorithm(algorithm digest.Algorithm) Option {
+	return func(b *Builder) { b.algorithm = algorithm }
+}
+
+// NewBuilder returns an empty layer builder.
+func NewBuilder(opts ...Option) *Builder {
+	b := &Builder{algorithm: digest.Canonical, modTime: time.Unix(1700000000, 0).UTC()}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// EntryOption adjusts the tar header of a single entry.
+type EntryOption func(*tar.Header)
+
+// WithMode sets the permission bits of an entry.
+func WithMode(mode int64) EntryOption {
+	return func(h *tar.Header) { h.Mode = mode }
+}
+
+// WithOwner sets the numeric owner of an entry.
+func WithOwner(uid, gid int) EntryOption {
+	return func(h *tar.Header) { h.Uid, h.Gid = uid, gid }
+}
+
+func (b *Builder) add(h *tar.Header, content []byte, opts []EntryOption) *Builder {
+	h.ModTime = b.modTime
+	h.Format = tar.FormatPAX
+	for _, opt := range opts {
+		opt(h)
+	}
+	b.entries = append(b.entries, &entry{header: h, content: content})
+	return b
+}
+
+// Dir adds a directory.
+func (b *Builder) Dir(name string, opts ...EntryOption) *Builder {
+	return b.add(&tar.Header{Typeflag: tar.TypeDir, Name: strings.TrimSuffix(name, "/") + "/", Mode: 0o755}, nil, opts)
+}
+
+// File adds a regular file.
+func (b *Builder) File(name string, content []byte, opts ...EntryOption) *Builder {
+	return b.add(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(content))}, content, opts)
+}
+
+// Symlink adds a symbolic link at name pointing to target.
+func (b *Builder) Symlink(name, target string, opts ...EntryOption) *Builder {
+	return b.add(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0o777}, nil, opts)
+}
+
+// Hardlink adds a hard link at name to the earlier entry target.
+func (b *Builder) Hardlink(name, target string, opts ...EntryOption) *Builder {
+	return b.add(&tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target, Mode: 0o644}, nil, opts)
+}
+
+// CharDevice adds a character device node.
+func (b *Builder) CharDevice(name string, major, minor int64, opts ...EntryOption) *Builder {
+	return b.add(&tar.Header{Typeflag: tar.TypeChar, Name: name, Devmajor: major, Devminor: minor, Mode: 0o666}, nil, opts)
+}
+
+// Whiteout adds an overlay whiteout hiding path from lower layers.
+func (b *Builder) Whiteout(path string) *Builder {
+	dir, base := splitPath(path)
+	return b.File(dir+".wh."+base, nil)
+}
+
+// OpaqueDir marks dir as opaque, hiding everything lower layers put in it.
+func (b *Builder) OpaqueDir(dir string) *Builder {
+	return b.File(strings.TrimSuffix(dir, "/")+"/.wh..wh..opq", nil)
+}
+
+func splitPath(path string) (string, string) {
+	if idx := strings.LastIndex(path, "/"); idx != -1 {
+		return path[:idx+1], path[idx+1:]
+	}
+	return "", path
+}
+
+// Build assembles the layer.
+func (b *Builder) Build() (*Layer, error) {
+	w := newMemberWriter()
+	tw := tar.NewWriter(w)
+	toc := &estargzutil.JTOC{Version: 1}
+
+	for _, e := range b.entries {
+		if err := tw.WriteHeader(e.header); err != nil {
+			return nil, err
+		}
+		tocEntry := tocEntryFor(e.header)
+		toc.Entries = append(toc.Entries, tocEntry)
+
+		if e.header.Typeflag != tar.TypeReg || len(e.content) == 0 {
+			continue
+		}
+		tocEntry.Digest = b.algorithm.FromBytes(e.content).String()
+
+		chunkSize := b.chunkSize
+		if chunkSize <= 0 || chunkSize > int64(len(e.content)) {
+			chunkSize = int64(len(e.content))
+		}
+		multi := chunkSize < int64(len(e.content))
+
+		for off := int64(0); off < int64(len(e.content)); off += chunkSize {
+			end := off + chunkSize
+			if end > int64(len(e.content)) {
+				end = int64(len(e.content))
+			}
+			chunk := e.content[off:end]
+
+			// tar.Writer emits headers and padding eagerly, so the member
+			// state here is exactly where the chunk data will start.
+			if b.minChunkSize <= 0 || w.memberSize >= b.minChunkSize {
+				if err := w.newMember(); err != nil {
+					return nil, err
+				}
+			}
+
+			target := tocEntry
+			if off > 0 {
+				target = &estargzutil.TOCEntry{Name: tocEntry.Name, Type: "chunk"}
+				toc.Entries = append(toc.Entries, target)
+			}
+			target.Offset = w.memberStart
+			target.InnerOffset = w.memberSize
+			target.ChunkOffset = off
+			if multi {
+				target.ChunkSize = end - off
+			}
+			target.ChunkDigest = b.algorithm.FromBytes(chunk).String()
+
+			if _, err := tw.Write(chunk); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The TOC lives in its own member at the end of the tar stream.
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := w.newMember(); err != nil {
+		return nil, err
+	}
+	tocOffset := w.memberStart
+
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargzutil.TOCTarName,
+		Mode:     0o444,
+		Size:     int64(len(tocJSON)),
+		ModTime:  b.modTime,
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := w.close(); err != nil {
+		return nil, err
+	}
+
+	w.out.Write(footerBytes(tocOffset))
+
+	blob := w.out.Bytes()
+	return &Layer{
+		Blob:      blob,
+		TOC:       toc,
+		Digest:    b.algorithm.FromBytes(blob),
+		DiffID:    b.algorithm.FromBytes(w.raw.Bytes()),
+		TOCDigest: b.algorithm.FromBytes(tocJSON),
+	}, nil
+}
+
+// MustBuild is Build for tests; it panics on error.
+func (b *Builder) MustBuild() *Layer {
+	layer, err := b.Build()
+	if err != nil {
+		panic(fmt.Sprintf("estargztest: %v", err))
+	}
+	return layer
+}
+
+func tocEntryFor(h *tar.Header) *estargzutil.TOCEntry {
+	e := &estargzutil.TOCEntry{
+		Name:        strings.TrimSuffix(h.Name, "/"),
+		ModTime3339: h.ModTime.Format(time.RFC3339),
+		Mode:        h.Mode,
+		UID:         h.Uid,
+		GID:         h.Gid,
+		Uname:       h.Uname,
+		Gname:       h.Gname,
+	}
+	switch h.Typeflag {
+	case tar.TypeDir:
+		e.Type = "dir"
+	case tar.TypeReg:
+		e.Type = "reg"
+		e.Size = h.Size
+	case tar.TypeSymlink:
+		e.Type = "symlink"
+		e.LinkName = h.Linkname
+	case tar.TypeLink:
+		e.Type = "hardlink"
+		e.LinkName = h.Linkname
+	case tar.TypeChar:
+		e.Type = "char"
+		e.DevMajor = int(h.Devmajor)
+		e.DevMinor = int(h.Devminor)
+	case tar.TypeBlock:
+		e.Type = "block"
+		e.DevMajor = int(h.Devmajor)
+		e.DevMinor = int(h.Devminor)
+	case tar.TypeFifo:
+		e.Type = "fifo"
+	}
+	return e
+}
+
+// memberWriter writes an uncompressed stream as a series of gzip members,
+// tracking where the current member starts in the compressed output and how
+// many uncompressed bytes it holds so far.
+type memberWriter struct {
+	out         bytes.Buffer // Compressed blob
+	raw         bytes.Buffer // Uncompressed tar stream, for the diff ID
+	gz          *gzip.Writer
+	memberStart int64
+	memberSize  int64
+}
+
+func newMemberWriter() *memberWriter {
+	return &memberWriter{}
+}
+
+func (w *memberWriter) Write(p []byte) (int, error) {
+	if w.gz == nil {
+		if err := w.newMember(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.gz.Write(p)
+	w.raw.Write(p[:n])
+	w.memberSize += int64(n)
+	return n, err
+}
+
+func (w *memberWriter) newMember() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	w.memberStart = int64(w.out.Len())
+	w.memberSize = 0
+	w.gz = gzip.NewWriter(&w.out)
+	return nil
+}
+
+func (w *memberWriter) close() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz = nil
+	return err
+}
+
+// footerBytes encodes the 51-byte eStargz footer pointing at tocOffset: an
+// empty gzip member whose extra field carries the offset. The member is
+// written by hand because compress/gzip ends an empty stream with a 2-byte
+// fixed block, while the format requires a 5-byte final stored block.
+func footerBytes(tocOffset int64) []byte {
+	payload := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	footer := make([]byte, 0, estargzutil.FooterSize)
+	footer = append(footer, 0x1f, 0x8b, 8, 1<<2, 0, 0, 0, 0, 0, 0xff) // magic, deflate, FEXTRA, no mtime, unknown OS
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(payload)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(payload)))
+	footer = append(footer, payload...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)    // final empty stored block
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0) // CRC-32 and size of no data
+	return footer
+}
@@ -0,0 +1,147 @@
+package estargztest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/opencontainers/go-digest"
+)
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func readTOC(t *testing.T, layer *Layer) *estargzutil.JTOC {
+	t.Helper()
+	tocOffset, _, err := estargzutil.ParseFooter(layer.Blob[len(layer.Blob)-estargzutil.FooterSize:])
+	if err != nil {
+		t.Fatalf("ParseFooter() error = %v", err)
+	}
+	toc, err := estargzutil.ReadTOC(bytes.NewReader(layer.Blob[tocOffset:]))
+	if err != nil {
+		t.Fatalf("ReadTOC() error = %v", err)
+	}
+	return toc
+}
+
+func TestBuilder_RoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 100)
+
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantChunks int
+		wantInner  bool
+	}{
+		{name: "single chunk", wantChunks: 1},
+		{name: "chunked", opts: []Option{WithChunkSize(64)}, wantChunks: 16},
+		{name: "packed", opts: []Option{WithChunkSize(64), WithMinChunkSize(256)}, wantChunks: 16, wantInner: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layer := NewBuilder(tt.opts...).
+				Dir("etc").
+				File("etc/hosts", []byte("127.0.0.1 localhost\n")).
+				File("usr/lib/big", big).
+				MustBuild()
+
+			toc := readTOC(t, layer)
+			for _, name := range []string{"etc/hosts", "usr/lib/big"} {
+				size, chunks, err := estargzutil.ChunksForFile(toc, name)
+				if err != nil {
+					t.Fatalf("ChunksForFile(%s) error = %v", name, err)
+				}
+				if name == "usr/lib/big" {
+					if len(chunks) != tt.wantChunks {
+						t.Fatalf("chunks = %d, want %d", len(chunks), tt.wantChunks)
+					}
+					inner := false
+					for _, ch := range chunks {
+						inner = inner || ch.InnerOffset > 0
+					}
+					if inner != tt.wantInner {
+						t.Fatalf("innerOffset used = %v, want %v", inner, tt.wantInner)
+					}
+				}
+
+				fr, err := estargzutil.NewFileReader(toc, name, nopSeekCloser{bytes.NewReader(layer.Blob)})
+				if err != nil {
+					t.Fatalf("NewFileReader(%s) error = %v", name, err)
+				}
+				got, err := io.ReadAll(fr)
+				if err != nil {
+					t.Fatalf("read %s: %v", name, err)
+				}
+				if int64(len(got)) != size {
+					t.Fatalf("%s: read %d bytes, want %d", name, len(got), size)
+				}
+			}
+		})
+	}
+}
+
+func TestBuilder_TarStream(t *testing.T) {
+	layer := NewBuilder(WithChunkSize(4)).
+		File("bin/busybox", []byte("busybox binary")).
+		Symlink("bin/sh", "busybox").
+		Hardlink("bin/ash", "bin/busybox").
+		CharDevice("dev/null", 1, 3).
+		Whiteout("etc/motd").
+		OpaqueDir("var/cache").
+		MustBuild()
+
+	gz, err := gzip.NewReader(bytes.NewReader(layer.Blob))
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("decompress blob: %v", err)
+	}
+	if got := digest.FromBytes(raw); got != layer.DiffID {
+		t.Fatalf("DiffID = %s, want %s", layer.DiffID, got)
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(raw))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Next() error = %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	want := "bin/busybox bin/sh bin/ash dev/null etc/.wh.motd var/cache/.wh..wh..opq stargz.index.json"
+	if got := strings.Join(names, " "); got != want {
+		t.Fatalf("tar entries = %q, want %q", got, want)
+	}
+
+	toc := readTOC(t, layer)
+	types := make(map[string]string)
+	for _, e := range toc.Entries {
+		if e.Type != "chunk" {
+			types[e.Name] = e.Type + ":" + e.LinkName
+		}
+	}
+	for name, want := range map[string]string{
+		"bin/sh":   "symlink:busybox",
+		"bin/ash":  "hardlink:bin/busybox",
+		"dev/null": "char:",
+	} {
+		if types[name] != want {
+			t.Fatalf("TOC %s = %q, want %q", name, types[name], want)
+		}
+	}
+}
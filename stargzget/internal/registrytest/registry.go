@@ -0,0 +1,206 @@
+// Package registrytest serves container images from memory over the OCI
+// distribution API, so examples and tests can exercise the registry client
+// end to end without network access.
+//
+// The registry listens on 127.0.0.1, which the registry client talks to over
+// plain HTTP, and needs no authentication unless RequireToken is called.
+// Manifests are served by tag and by digest; blobs honour Range requests.
+package registrytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	configMediaType   = "application/vnd.oci.image.config.v1+json"
+	layerMediaType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// Registry is an in-memory registry. The zero value is not usable; use New.
+type Registry struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string][]byte // "repository:tag" and "repository@digest" -> manifest JSON
+	blobs     map[digest.Digest][]byte
+	auth      bool // Whether /v2/ requests need the token from /token
+	tokens    int  // Tokens issued
+}
+
+// testToken is the bearer token the registry issues; it grants nothing
+// outside the test.
+const testToken = "fakeToken"
+
+// New starts an empty registry. Call Close when done.
+func New() *Registry {
+	r := &Registry{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+	r.server = httptest.NewServer(r)
+	return r
+}
+
+// Host returns the registry's host:port, for use in image references.
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// Close shuts the registry down.
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// RequireToken makes the registry answer requests without a bearer token
+// with a 401 challenge pointing at its own token endpoint, which issues a
+// token to anyone, as anonymous pulls from public registries work.
+func (r *Registry) RequireToken() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.auth = true
+}
+
+// TokensIssued returns how many tokens the token endpoint has issued.
+func (r *Registry) TokensIssued() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokens
+}
+
+// AddImage publishes an image made of layers, bottom layer first, as
+// repository:tag and returns its image reference. Only the Blob and
+// TOCDigest of each layer are used, so a prebuilt blob can be wrapped as
+// &estargztest.Layer{Blob: data}. Layers with a TOCDigest carry the TOC
+// digest annotation. The image has an empty config.
+func (r *Registry) AddImage(repository, tag string, layers ...*estargztest.Layer) string {
+	config := []byte(`{"rootfs":{"type":"layers","diff_ids":[]}}`)
+	manifest := storage.Manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		Config: storage.Descriptor{
+			MediaType: configMediaType,
+			Digest:    digest.FromBytes(config).String(),
+			Size:      int64(len(config)),
+		},
+	}
+	for _, layer := range layers {
+		desc := storage.Layer{
+			MediaType: layerMediaType,
+			Digest:    digest.FromBytes(layer.Blob).String(),
+			Size:      int64(len(layer.Blob)),
+		}
+		if layer.TOCDigest != "" {
+			desc.Annotations = map[string]string{storage.TOCDigestAnnotation: layer.TOCDigest.String()}
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+	data, err := json.Marshal(&manifest)
+	if err != nil {
+		panic(fmt.Sprintf("registrytest: encode manifest: %v", err))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[digest.FromBytes(config)] = config
+	for _, layer := range layers {
+		r.blobs[digest.FromBytes(layer.Blob)] = layer.Blob
+	}
+	r.manifests[repository+":"+tag] = data
+	r.manifests[repository+"@"+digest.FromBytes(data).String()] = data
+	return fmt.Sprintf("%s/%s:%s", r.Host(), repository, tag)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	auth := r.auth
+	if auth && req.URL.Path == "/token" {
+		r.tokens++
+	}
+	r.mu.Unlock()
+	if auth && req.URL.Path == "/token" {
+		json.NewEncoder(w).Encode(map[string]string{"token": testToken})
+		return
+	}
+
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v2/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if auth && req.Header.Get("Authorization") != "Bearer "+testToken {
+		scope := ""
+		if repository, _, ok := strings.Cut(rest, "/manifests/"); ok {
+			scope = fmt.Sprintf(`,scope="repository:%s:pull"`, repository)
+		} else if repository, _, ok := strings.Cut(rest, "/blobs/"); ok {
+			scope = fmt.Sprintf(`,scope="repository:%s:pull"`, repository)
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registrytest"%s`, r.server.URL, scope))
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+	if rest == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if idx := strings.LastIndex(rest, "/manifests/"); idx != -1 {
+		repository, reference := rest[:idx], rest[idx+len("/manifests/"):]
+		sep := ":"
+		if strings.Contains(reference, ":") {
+			sep = "@"
+		}
+		r.mu.Lock()
+		data, ok := r.manifests[repository+sep+reference]
+		r.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", manifestMediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+
+	if idx := strings.LastIndex(rest, "/blobs/"); idx != -1 {
+		dgst, err := digest.Parse(rest[idx+len("/blobs/"):])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+		r.mu.Lock()
+		data, ok := r.blobs[dgst]
+		r.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+
+	http.NotFound(w, req)
+}
+
+// writeError replies with a distribution-spec error body.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
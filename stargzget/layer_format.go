@@ -0,0 +1,220 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// LayerFormat names the format of a layer blob as far as starget can tell
+// from its descriptor and its last bytes.
+type LayerFormat string
+
+const (
+	LayerFormatEstargz     LayerFormat = "estargz"      // Readable: the blob ends with an eStargz footer
+	LayerFormatNydus       LayerFormat = "nydus"        // Nydus (RAFS) data or bootstrap blob, including zran references
+	LayerFormatZstdChunked LayerFormat = "zstd:chunked" // containers/storage zstd:chunked
+	LayerFormatZstd        LayerFormat = "zstd"         // Plain zstd-compressed tar
+	LayerFormatGzip        LayerFormat = "gzip"         // Plain gzip-compressed tar without a TOC
+	LayerFormatTar         LayerFormat = "tar"          // Uncompressed tar
+	LayerFormatUnknown     LayerFormat = "unknown"
+)
+
+const (
+	nydusBlobMediaType       = "application/vnd.oci.image.layer.nydus.blob.v1"
+	nydusAnnotationPrefix    = "containerd.io/snapshot/nydus-"
+	zstdChunkedAnnotation    = "io.github.containers.zstd-chunked.manifest-checksum"
+	zstdChunkedFooterMagic   = "GNUlInUx"
+	dockerLayerMediaTypeBase = "application/vnd.docker.image.rootfs.diff.tar"
+)
+
+// DetectLayerFormat identifies the format of the blob described by desc
+// from tail, the last bytes of the blob. The footer is the capability probe:
+// a blob that ends with an eStargz footer is read lazily whatever its media
+// type or annotations claim, so eStargz blobs referenced from images built
+// by other accelerators (such as nydus zran images) still work. Otherwise
+// the descriptor's nydus and zstd:chunked annotations, the zstd:chunked
+// footer magic and finally the media type name the format.
+func DetectLayerFormat(desc stor.BlobDescriptor, tail []byte) LayerFormat {
+	if _, _, err := estargzutil.ParseFooter(tail); err == nil {
+		return LayerFormatEstargz
+	}
+	if desc.MediaType == nydusBlobMediaType {
+		return LayerFormatNydus
+	}
+	for key := range desc.Annotations {
+		if strings.HasPrefix(key, nydusAnnotationPrefix) {
+			return LayerFormatNydus
+		}
+	}
+	if desc.Annotations[zstdChunkedAnnotation] != "" || bytes.HasSuffix(tail, []byte(zstdChunkedFooterMagic)) {
+		return LayerFormatZstdChunked
+	}
+
+	mediaType := desc.MediaType
+	switch {
+	case strings.HasSuffix(mediaType, "+zstd") || strings.HasSuffix(mediaType, ".zstd"):
+		return LayerFormatZstd
+	case strings.HasSuffix(mediaType, "+gzip") || strings.HasSuffix(mediaType, ".gzip"):
+		return LayerFormatGzip
+	case strings.HasSuffix(mediaType, "layer.v1.tar") || mediaType == dockerLayerMediaTypeBase:
+		return LayerFormatTar
+	}
+	return LayerFormatUnknown
+}
+
+// unsupportedFormatError reports a layer whose format starget cannot read
+// lazily, with a hint on how to get an eStargz image instead.
+func unsupportedFormatError(desc stor.BlobDescriptor, format LayerFormat) error {
+	var hint string
+	switch format {
+	case LayerFormatNydus:
+		hint = "nydus blobs need the nydus snapshotter or nydusify to convert them back"
+	case LayerFormatZstdChunked:
+		hint = "zstd:chunked layers carry a different TOC; rebuild the image with eStargz compression"
+	default:
+		hint = "rebuild or convert the image with eStargz compression (e.g. nerdctl image convert --estargz)"
+	}
+	return stargzerrors.ErrUnsupportedLayerFormat.
+		WithMessage(fmt.Sprintf("layer is %s, not eStargz: %s", format, hint)).
+		WithDetail("blobDigest", desc.Digest.String()).
+		WithDetail("format", string(format)).
+		WithDetail("mediaType", desc.MediaType)
+}
+
+// LayerProbe is the outcome of probing one layer for an eStargz footer.
+type LayerProbe struct {
+	BlobDigest digest.Digest
+	MediaType  string
+	Format     LayerFormat
+	Err        error         // Why the layer could not be read
+	Size       int64         // Blob size; set by ProbeLayers
+	TOCOffset  int64         // Where the TOC starts in the blob; set by ProbeLayers for eStargz layers
+	Latency    time.Duration // Time ProbeLayers took for the layer's requests
+}
+
+// probeConcurrency bounds the layers ProbeLayers probes at once.
+const probeConcurrency = 8
+
+// ProbeLayers checks every layer of manifest for an eStargz footer, several
+// layers at a time. For each layer it looks the blob size up with a HEAD
+// request when storage is a BlobSizer (which also shows the blob is
+// reachable with the current credentials), reads the footer and records the
+// format and, for eStargz layers, the TOC offset. Nothing beyond the footers
+// is fetched, so it answers whether lazy access will work in about one
+// round trip per layer. Failures are reported per layer in Err.
+func ProbeLayers(ctx context.Context, storage stor.Storage, manifest *stor.Manifest) []LayerProbe {
+	probes := make([]LayerProbe, len(manifest.Layers))
+	sem := make(chan struct{}, probeConcurrency)
+	var wg sync.WaitGroup
+	for i, layer := range manifest.Layers {
+		wg.Add(1)
+		go func(i int, layer stor.Layer) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			probes[i] = probeLayer(ctx, storage, layer)
+		}(i, layer)
+	}
+	wg.Wait()
+	return probes
+}
+
+func probeLayer(ctx context.Context, storage stor.Storage, layer stor.Layer) LayerProbe {
+	started := time.Now()
+	probe := LayerProbe{BlobDigest: digest.Digest(layer.Digest), MediaType: layer.MediaType, Format: LayerFormatUnknown, Size: layer.Size}
+	defer func() { probe.Latency = time.Since(started) }()
+
+	dgst, err := digest.Parse(layer.Digest)
+	if err != nil {
+		probe.Err = stargzerrors.ErrInvalidDigest.WithDetail("blobDigest", layer.Digest).WithCause(err)
+		return probe
+	}
+	if sizer, ok := storage.(stor.BlobSizer); ok {
+		size, err := sizer.BlobSize(ctx, dgst)
+		if err != nil {
+			probe.Err = err
+			return probe
+		}
+		if probe.Size > 0 && size != probe.Size {
+			probe.Err = fmt.Errorf("blob is %d bytes, but the manifest says %d", size, probe.Size)
+			return probe
+		}
+		probe.Size = size
+	}
+	if probe.Size <= 0 {
+		probe.Err = fmt.Errorf("blob size unknown")
+		return probe
+	}
+
+	footerLength := min(int64(estargzutil.FooterSize), probe.Size)
+	reader, err := storage.ReadBlob(ctx, dgst, probe.Size-footerLength, footerLength)
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	tail, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+
+	desc := stor.BlobDescriptor{Digest: dgst, Size: probe.Size, MediaType: layer.MediaType, Annotations: layer.Annotations}
+	probe.Format = DetectLayerFormat(desc, tail)
+	if probe.Format == LayerFormatEstargz {
+		probe.TOCOffset, _, _ = estargzutil.ParseFooter(tail)
+	}
+	return probe
+}
+
+// layerProbeFor describes a layer whose TOC failed to load with err. It
+// reports ok only when err says the layer is in a known non-eStargz format.
+func layerProbeFor(desc stor.BlobDescriptor, err error) (LayerProbe, bool) {
+	probe := LayerProbe{BlobDigest: desc.Digest, MediaType: desc.MediaType, Format: LayerFormatUnknown, Err: err}
+	var se *stargzerrors.StargzError
+	if !errors.As(err, &se) || se.Code != stargzerrors.ErrUnsupportedLayerFormat.Code {
+		return probe, false
+	}
+	if format, ok := se.Details["format"].(string); ok {
+		probe.Format = LayerFormat(format)
+	}
+	return probe, true
+}
+
+// notStargzImageError reports an image none of whose layers has an eStargz
+// footer. The probes are kept in the "layers" detail; see LayerProbes.
+func notStargzImageError(probes []LayerProbe) error {
+	seen := make(map[LayerFormat]bool)
+	var names []string
+	for _, p := range probes {
+		if !seen[p.Format] {
+			seen[p.Format] = true
+			names = append(names, string(p.Format))
+		}
+	}
+	return stargzerrors.ErrNotStargzImage.
+		WithMessage(fmt.Sprintf("none of the image's %d layer(s) is in eStargz format (found %s)", len(probes), strings.Join(names, ", "))).
+		WithDetail("layers", probes)
+}
+
+// LayerProbes returns the per-layer probe results carried by an
+// ErrNotStargzImage error, or nil for any other error.
+func LayerProbes(err error) []LayerProbe {
+	var se *stargzerrors.StargzError
+	if !errors.As(err, &se) || se.Code != stargzerrors.ErrNotStargzImage.Code {
+		return nil
+	}
+	probes, _ := se.Details["layers"].([]LayerProbe)
+	return probes
+}
@@ -0,0 +1,119 @@
+package stargzget
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestDetectLayerFormat(t *testing.T) {
+	layer := estargztest.NewBuilder().File("etc/hosts", []byte("127.0.0.1 localhost\n")).MustBuild()
+	footer := layer.Blob[len(layer.Blob)-estargzutil.FooterSize:]
+	opaque := bytes.Repeat([]byte{0xa5}, 64)
+
+	tests := []struct {
+		name string
+		desc stor.BlobDescriptor
+		tail []byte
+		want LayerFormat
+	}{
+		{name: "estargz", desc: stor.BlobDescriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip"}, tail: footer, want: LayerFormatEstargz},
+		{name: "estargz behind a nydus media type", desc: stor.BlobDescriptor{MediaType: nydusBlobMediaType}, tail: footer, want: LayerFormatEstargz},
+		{name: "nydus blob", desc: stor.BlobDescriptor{MediaType: nydusBlobMediaType}, tail: opaque, want: LayerFormatNydus},
+		{
+			name: "nydus bootstrap",
+			desc: stor.BlobDescriptor{
+				MediaType:   "application/vnd.oci.image.layer.v1.tar+gzip",
+				Annotations: map[string]string{"containerd.io/snapshot/nydus-bootstrap": "true"},
+			},
+			tail: opaque,
+			want: LayerFormatNydus,
+		},
+		{
+			name: "zstd:chunked annotation",
+			desc: stor.BlobDescriptor{
+				MediaType:   "application/vnd.oci.image.layer.v1.tar+zstd",
+				Annotations: map[string]string{zstdChunkedAnnotation: "sha256:abc"},
+			},
+			tail: opaque,
+			want: LayerFormatZstdChunked,
+		},
+		{name: "zstd:chunked footer", desc: stor.BlobDescriptor{}, tail: append(opaque, zstdChunkedFooterMagic...), want: LayerFormatZstdChunked},
+		{name: "zstd", desc: stor.BlobDescriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+zstd"}, tail: opaque, want: LayerFormatZstd},
+		{name: "gzip", desc: stor.BlobDescriptor{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip"}, tail: opaque, want: LayerFormatGzip},
+		{name: "tar", desc: stor.BlobDescriptor{MediaType: "application/vnd.oci.image.layer.v1.tar"}, tail: opaque, want: LayerFormatTar},
+		{name: "unknown", desc: stor.BlobDescriptor{}, tail: opaque, want: LayerFormatUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectLayerFormat(tt.desc, tt.tail); got != tt.want {
+				t.Fatalf("DetectLayerFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlobResolver_TOC_UnsupportedFormat(t *testing.T) {
+	data := bytes.Repeat([]byte{0xa5}, 4096)
+	desc := stor.BlobDescriptor{
+		Digest:    "sha256:0000000000000000000000000000000000000000000000000000000000000001",
+		Size:      int64(len(data)),
+		MediaType: nydusBlobMediaType,
+	}
+	storage := &sizeProbeStorage{stubStorage: stubStorage{data: data}, blobs: []stor.BlobDescriptor{desc}}
+
+	_, err := NewBlobResolver(storage).TOC(context.Background(), desc.Digest)
+	se, ok := err.(*stargzerrors.StargzError)
+	if !ok || se.Code != stargzerrors.ErrUnsupportedLayerFormat.Code {
+		t.Fatalf("TOC() error = %v, want code %s", err, stargzerrors.ErrUnsupportedLayerFormat.Code)
+	}
+	if se.Details["format"] != string(LayerFormatNydus) {
+		t.Errorf("format detail = %v, want %s", se.Details["format"], LayerFormatNydus)
+	}
+	if !stargzerrors.IsPermanent(err) {
+		t.Errorf("IsPermanent() = false, want true")
+	}
+}
+
+func TestProbeLayers(t *testing.T) {
+	const layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	layer := estargztest.NewBuilder().File("etc/hosts", []byte("127.0.0.1 localhost\n")).MustBuild()
+	tocOffset, _, err := estargzutil.ParseFooter(layer.Blob)
+	if err != nil {
+		t.Fatalf("ParseFooter() error = %v", err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(bytes.Repeat([]byte{0}, 1024))
+	zw.Close()
+
+	storage := stor.NewMockStorage()
+	estargzDigest := storage.AddBlob(layerType, layer.Blob)
+	gzipDigest := storage.AddBlob(layerType, gz.Bytes())
+	manifest := &stor.Manifest{Layers: []stor.Layer{
+		{MediaType: layerType, Digest: estargzDigest.String(), Size: int64(len(layer.Blob))},
+		{MediaType: layerType, Digest: gzipDigest.String(), Size: int64(gz.Len())},
+		{MediaType: layerType, Digest: digest.FromString("missing").String(), Size: 100},
+	}}
+
+	probes := ProbeLayers(context.Background(), storage, manifest)
+	if len(probes) != 3 {
+		t.Fatalf("ProbeLayers() returned %d probes, want 3", len(probes))
+	}
+	if p := probes[0]; p.Err != nil || p.BlobDigest != estargzDigest || p.Format != LayerFormatEstargz || p.TOCOffset != tocOffset {
+		t.Errorf("estargz probe = %+v, want format %s and TOC offset %d", p, LayerFormatEstargz, tocOffset)
+	}
+	if p := probes[1]; p.Err != nil || p.Format != LayerFormatGzip || p.TOCOffset != 0 {
+		t.Errorf("gzip probe = %+v, want format %s and no TOC offset", p, LayerFormatGzip)
+	}
+	if p := probes[2]; p.Err == nil || p.Format != LayerFormatUnknown {
+		t.Errorf("missing blob probe = %+v, want an error", p)
+	}
+}
@@ -0,0 +1,53 @@
+package stargzget
+
+import "github.com/opencontainers/go-digest"
+
+// LayerUsage tells what a layer contributes to a set of files.
+type LayerUsage struct {
+	BlobDigest digest.Digest
+	Files      int   // Files of the set taken from this layer, link targets included
+	Bytes      int64 // Uncompressed size of the regular files among them
+}
+
+// LayersFor returns the layers holding files, in image order, leaving out
+// layers that contribute none of them. A symlink or hard link also needs
+// the layer its target comes from, so links are resolved through the
+// merged view and the target's layer is counted too; dangling links count
+// only their own layer. Files must come from idx, e.g. from FilterFiles.
+func (idx *ImageIndex) LayersFor(files []*FileInfo) []LayerUsage {
+	usage := make(map[digest.Digest]*LayerUsage)
+	counted := make(map[*FileInfo]bool)
+	add := func(info *FileInfo) {
+		if counted[info] {
+			return
+		}
+		counted[info] = true
+		u, ok := usage[info.BlobDigest]
+		if !ok {
+			u = &LayerUsage{BlobDigest: info.BlobDigest}
+			usage[info.BlobDigest] = u
+		}
+		u.Files++
+		if info.IsRegular() {
+			u.Bytes += info.Size
+		}
+	}
+
+	for _, info := range files {
+		add(info)
+		if info.IsSymlink() || info.IsHardlink() {
+			if target, err := idx.ResolveFile(info, ""); err == nil {
+				add(target)
+			}
+		}
+	}
+
+	layers := make([]LayerUsage, 0, len(usage))
+	for _, layer := range idx.Layers {
+		if u, ok := usage[layer.BlobDigest]; ok {
+			layers = append(layers, *u)
+			delete(usage, layer.BlobDigest)
+		}
+	}
+	return layers
+}
@@ -0,0 +1,49 @@
+package stargzget
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestImageIndex_LayersFor(t *testing.T) {
+	const layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	storage := stor.NewMockStorage()
+	base := storage.AddBlob(layerType, estargztest.NewBuilder().
+		File("bin/busybox", []byte("busybox")).
+		File("etc/passwd", []byte("root")).
+		MustBuild().Blob)
+	users := storage.AddBlob(layerType, estargztest.NewBuilder().
+		File("etc/passwd", []byte("root\napp")).
+		MustBuild().Blob)
+	app := storage.AddBlob(layerType, estargztest.NewBuilder().
+		Symlink("bin/sh", "busybox").
+		File("app/main", []byte("main")).
+		MustBuild().Blob)
+
+	index, err := NewBlobIndexLoader(storage, NewBlobResolver(storage)).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	tests := []struct {
+		pattern string
+		want    []LayerUsage
+	}{
+		{"app", []LayerUsage{{BlobDigest: app, Files: 1, Bytes: 4}}},
+		// The link's target comes from the base layer.
+		{"bin/sh", []LayerUsage{{BlobDigest: base, Files: 1, Bytes: 7}, {BlobDigest: app, Files: 1}}},
+		// The middle layer replaced etc/passwd, so the base layer is not needed for it.
+		{"etc", []LayerUsage{{BlobDigest: users, Files: 1, Bytes: 8}}},
+		{"nothing", []LayerUsage{}},
+	}
+	for _, tt := range tests {
+		got := index.LayersFor(index.FilterFiles(tt.pattern, ""))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LayersFor(%q) = %+v, want %+v", tt.pattern, got, tt.want)
+		}
+	}
+}
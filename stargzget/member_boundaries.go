@@ -0,0 +1,258 @@
+package stargzget
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+// memberSnapDistance is how far from a TOC offset a gzip member start is
+// looked for when the offset does not point at one. Builders that get the
+// offsets wrong are off by a few bytes, such as a header field.
+const memberSnapDistance = 64
+
+// memberProbeSize is how many bytes a candidate member start must decode
+// without error, unless the member ends cleanly first, to be accepted.
+const memberProbeSize = 512
+
+// gzipMagic starts every gzip member: ID1, ID2 and the deflate method.
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+// memberBoundaries remembers, per blob, where the gzip members whose TOC
+// offsets do not point at a gzip header really start. Offsets are snapped
+// only within the gap between the TOC offsets around them, so a snapped
+// read never starts in another listed member, and a candidate start must
+// decode to be accepted. It is shared by the sessions of a downloader, so
+// each broken offset is scanned for once.
+type memberBoundaries struct {
+	mu         sync.Mutex
+	starts     map[memberKey]int64       // TOC offset -> validated member start
+	tocOffsets map[digest.Digest][]int64 // Sorted distinct TOC offsets, read when first needed
+}
+
+func newMemberBoundaries() *memberBoundaries {
+	return &memberBoundaries{
+		starts:     make(map[memberKey]int64),
+		tocOffsets: make(map[digest.Digest][]int64),
+	}
+}
+
+// start returns where the member at TOC offset starts, as far as known.
+func (b *memberBoundaries) start(blob digest.Digest, offset int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if start, ok := b.starts[memberKey{blob: blob, offset: offset}]; ok {
+		return start
+	}
+	return offset
+}
+
+func (b *memberBoundaries) record(blob digest.Digest, offset, start int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.starts[memberKey{blob: blob, offset: offset}] = start
+}
+
+// window returns the range [lo, hi] searched for the member at offset:
+// memberSnapDistance bytes either way, minus anything at or beyond the
+// neighbouring TOC offsets.
+func (b *memberBoundaries) window(ctx context.Context, resolver BlobResolver, blob digest.Digest, offset int64) (int64, int64) {
+	lo, hi := max(offset-memberSnapDistance, 0), offset+memberSnapDistance
+
+	b.mu.Lock()
+	offsets, ok := b.tocOffsets[blob]
+	b.mu.Unlock()
+	if !ok && resolver != nil {
+		// Without a TOC the window is bounded by distance alone.
+		if toc, err := resolver.TOC(ctx, blob); err == nil {
+			seen := make(map[int64]bool)
+			for _, entry := range toc.Entries {
+				if entry != nil && entry.Offset > 0 && !seen[entry.Offset] {
+					seen[entry.Offset] = true
+					offsets = append(offsets, entry.Offset)
+				}
+			}
+			sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+			b.mu.Lock()
+			b.tocOffsets[blob] = offsets
+			b.mu.Unlock()
+		}
+	}
+
+	i := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= offset })
+	if i > 0 {
+		lo = max(lo, offsets[i-1]+1)
+	}
+	if i < len(offsets) && offsets[i] == offset {
+		i++
+	}
+	if i < len(offsets) {
+		hi = min(hi, offsets[i]-1)
+	}
+	return lo, hi
+}
+
+// openMember returns the blob from the gzip member at offset onwards and
+// a gzip reader over it, which the caller releases with putGzipReader
+// before closing the blob. When offset does not point at a gzip header,
+// the member is looked for nearby and, if found, remembered for later
+// reads of the same offset.
+func (d *downloader) openMember(ctx context.Context, blob digest.Digest, offset int64) (io.ReadCloser, *gzip.Reader, error) {
+	start := offset
+	if d.boundaries != nil {
+		start = d.boundaries.start(blob, offset)
+	}
+	reader, gz, err := d.openGzip(ctx, blob, start, d.ends.length(blob, offset, start))
+	if err == nil || d.boundaries == nil || start != offset || !errors.Is(err, gzip.ErrHeader) {
+		return reader, gz, err
+	}
+
+	snapped, snapErr := d.snapMember(ctx, blob, offset)
+	if snapErr != nil {
+		return nil, nil, fmt.Errorf("%w (%v)", err, snapErr)
+	}
+	logger.Warn("TOC offset %d in blob %s is not the start of a gzip member; reading the member at %d instead", offset, blob, snapped)
+	d.boundaries.record(blob, offset, snapped)
+	return d.openGzip(ctx, blob, snapped, d.ends.length(blob, offset, snapped))
+}
+
+func (d *downloader) openGzip(ctx context.Context, blob digest.Digest, offset, length int64) (io.ReadCloser, *gzip.Reader, error) {
+	reader, err := d.storage.ReadBlob(ctx, blob, offset, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	gz, err := getGzipReader(reader)
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	return reader, gz, nil
+}
+
+// snapMember finds the gzip member start nearest to offset within its
+// window. Candidates are the positions of the gzip magic; each is accepted
+// only if it decodes.
+func (d *downloader) snapMember(ctx context.Context, blob digest.Digest, offset int64) (int64, error) {
+	lo, hi := d.boundaries.window(ctx, d.resolver, blob, offset)
+	if hi < lo {
+		return 0, fmt.Errorf("no room for a gzip member start near offset %d", offset)
+	}
+	reader, err := d.storage.ReadBlob(ctx, blob, lo, hi-lo+int64(len(gzipMagic)))
+	if err != nil {
+		return 0, err
+	}
+	window, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	var candidates []int64
+	for i := 0; i+len(gzipMagic) <= len(window) && lo+int64(i) <= hi; i++ {
+		if bytes.Equal(window[i:i+len(gzipMagic)], gzipMagic) {
+			candidates = append(candidates, lo+int64(i))
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return distance(candidates[i], offset) < distance(candidates[j], offset)
+	})
+	for _, candidate := range candidates {
+		if d.validMember(ctx, blob, candidate, d.ends.length(blob, offset, candidate)) {
+			return candidate, nil
+		}
+	}
+	return 0, fmt.Errorf("no gzip member starts within %d bytes of offset %d", memberSnapDistance, offset)
+}
+
+// validMember reports whether a gzip member that decodes starts at offset,
+// reading at most length bytes of the blob (0 for no limit).
+func (d *downloader) validMember(ctx context.Context, blob digest.Digest, offset, length int64) bool {
+	reader, gz, err := d.openGzip(ctx, blob, offset, length)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	defer putGzipReader(gz)
+	gz.Multistream(false)
+	_, err = io.CopyN(io.Discard, gz, memberProbeSize)
+	return err == nil || err == io.EOF
+}
+
+func distance(a, b int64) int64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// memberEnds records where the gzip members a download session reads end,
+// taken from the chunk spans of its files: the next TOC offset, or the TOC
+// itself for the last member. Members are then fetched with ranges that stop
+// there instead of asking for the rest of the blob.
+type memberEnds struct {
+	mu   sync.Mutex
+	ends map[memberKey]int64
+}
+
+func newMemberEnds() *memberEnds {
+	return &memberEnds{ends: make(map[memberKey]int64)}
+}
+
+// add records the ends of the members spans start at. Spans of unknown
+// length are left out.
+func (e *memberEnds) add(blob digest.Digest, spans []ChunkSpan) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, span := range spans {
+		if span.CompressedLength > 0 {
+			e.ends[memberKey{blob: blob, offset: span.CompressedOffset}] = span.CompressedOffset + span.CompressedLength
+		}
+	}
+}
+
+// length returns how many bytes to request for the member at TOC offset,
+// read from start, or 0 to read to the end of the blob when its end is not
+// known. A member found away from its TOC offset may also end away from
+// the next one, so snapped reads reach memberSnapDistance bytes further.
+// A nil memberEnds knows no ends.
+func (e *memberEnds) length(blob digest.Digest, offset, start int64) int64 {
+	if e == nil {
+		return 0
+	}
+	e.mu.Lock()
+	end, ok := e.ends[memberKey{blob: blob, offset: offset}]
+	e.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	if start != offset {
+		end += memberSnapDistance
+	}
+	return max(end-start, 0)
+}
+
+// forget drops the end of the member at TOC offset when reading it failed
+// with err for want of data, so the file's retry reads to the end of the
+// blob. A member can run past the next TOC offset when that offset is a few
+// bytes short of the next member. A nil memberEnds ignores it.
+func (e *memberEnds) forget(blob digest.Digest, offset int64, err error) {
+	if e == nil || !errors.Is(err, io.ErrUnexpectedEOF) {
+		return
+	}
+	key := memberKey{blob: blob, offset: offset}
+	e.mu.Lock()
+	_, ok := e.ends[key]
+	delete(e.ends, key)
+	e.mu.Unlock()
+	if ok {
+		logger.Debug("Member at offset %d in blob %s runs past its expected end; reading it unbounded", offset, blob)
+	}
+}
@@ -0,0 +1,124 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestDownloader_SnapsOffsetsToMemberStarts(t *testing.T) {
+	content := bytes.Repeat([]byte("member-data"), 60) // 660 bytes, 6 chunks
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, base, resolver, "usr/bin/tool", content, 128)
+
+	// A builder quirk: every TOC offset is 3 bytes past its member start.
+	metadata := resolver.metadata[dgst]["usr/bin/tool"]
+	for i := range metadata.Chunks {
+		metadata.Chunks[i].CompressedOffset += 3
+	}
+
+	store := &countingStorage{Storage: base}
+	downloader := NewDownloader(resolver, store)
+	opts := &DownloadOptions{Concurrency: 1, SingleFileChunkThreshold: 256, MaxRetries: 1}
+	for run := 0; run < 2; run++ {
+		job := &DownloadJob{Path: "usr/bin/tool", BlobDigest: dgst, Size: int64(len(content)), OutputPath: filepath.Join(t.TempDir(), "tool")}
+		store.reads = 0
+		stats, err := downloader.StartDownload(context.Background(), []*DownloadJob{job}, nil, opts)
+		if err != nil || stats.DownloadedFiles != 1 {
+			t.Fatalf("run %d: StartDownload() = %+v, %v; want the file downloaded", run, stats, err)
+		}
+		data, err := os.ReadFile(job.OutputPath)
+		if err != nil || !bytes.Equal(data, content) {
+			t.Fatalf("run %d: output = %d bytes, err %v; want the original content", run, len(data), err)
+		}
+		// Once snapped, each offset is read from its member start directly.
+		if run == 1 && store.reads != len(metadata.Chunks) {
+			t.Errorf("second run made %d reads, want %d", store.reads, len(metadata.Chunks))
+		}
+	}
+}
+
+func TestDownloader_SnapStaysNearTOCOffset(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 300)
+	// The only member starts further from the TOC offset than snapping
+	// looks, so the chunk fails rather than being guessed at.
+	blob := append(bytes.Repeat([]byte{0}, 3*memberSnapDistance), gzipCompress(t, content)...)
+	store := storage.NewMockStorage()
+	dgst := store.AddBlob("application/vnd.test.gzip", blob)
+	resolver := newMockBlobResolver()
+	resolver.addFile(dgst, "file", &FileMetadata{Size: 300, Chunks: []Chunk{{Size: 300, CompressedOffset: memberSnapDistance}}})
+
+	job := &DownloadJob{Path: "file", BlobDigest: dgst, Size: 300, OutputPath: filepath.Join(t.TempDir(), "file")}
+	stats, _ := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, &DownloadOptions{MaxRetries: 1})
+	if stats.FailedFiles != 1 {
+		t.Fatalf("FailedFiles = %d, want 1", stats.FailedFiles)
+	}
+}
+
+func TestMemberBoundaries_WindowStopsAtTOCOffsets(t *testing.T) {
+	b := newMemberBoundaries()
+	b.tocOffsets["sha256:x"] = []int64{100, 110, 300}
+
+	tests := []struct {
+		offset, lo, hi int64
+	}{
+		{offset: 110, lo: 101, hi: 174},
+		{offset: 105, lo: 101, hi: 109},
+		{offset: 20, lo: 0, hi: 84},
+		{offset: 300, lo: 236, hi: 364},
+	}
+	for _, tt := range tests {
+		lo, hi := b.window(context.Background(), nil, "sha256:x", tt.offset)
+		if lo != tt.lo || hi != tt.hi {
+			t.Errorf("window(%d) = [%d, %d], want [%d, %d]", tt.offset, lo, hi, tt.lo, tt.hi)
+		}
+	}
+}
+
+// spanResolver serves the given chunk spans instead of computing them.
+type spanResolver struct {
+	*mockBlobResolver
+	spans map[string][]ChunkSpan
+}
+
+func (r *spanResolver) FileChunks(ctx context.Context, blobDigest digest.Digest, path string) ([]ChunkSpan, error) {
+	return r.spans[path], nil
+}
+
+func TestDownloader_MemberPastItsBound(t *testing.T) {
+	first, second := bytes.Repeat([]byte("first "), 50), bytes.Repeat([]byte("second "), 50)
+	firstMember := gzipCompress(t, first)
+	store := storage.NewMockStorage()
+	dgst := store.AddBlob("application/vnd.test.gzip", append(firstMember, gzipCompress(t, second)...))
+
+	// The second TOC offset is 3 bytes short of its member, so a read of the
+	// first member bounded by it is cut short.
+	secondOffset := int64(len(firstMember)) - 3
+	resolver := &spanResolver{mockBlobResolver: newMockBlobResolver(), spans: map[string][]ChunkSpan{
+		"first":  {{Chunk: Chunk{Size: int64(len(first))}, CompressedLength: secondOffset}},
+		"second": {{Chunk: Chunk{Size: int64(len(second)), CompressedOffset: secondOffset}}},
+	}}
+	resolver.addFile(dgst, "first", &FileMetadata{Size: int64(len(first)), Chunks: []Chunk{{Size: int64(len(first))}}})
+	resolver.addFile(dgst, "second", &FileMetadata{Size: int64(len(second)), Chunks: []Chunk{{Size: int64(len(second)), CompressedOffset: secondOffset}}})
+
+	dir := t.TempDir()
+	jobs := []*DownloadJob{
+		{Path: "first", BlobDigest: dgst, Size: int64(len(first)), OutputPath: filepath.Join(dir, "first")},
+		{Path: "second", BlobDigest: dgst, Size: int64(len(second)), OutputPath: filepath.Join(dir, "second")},
+	}
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, &DownloadOptions{MaxRetries: 1})
+	if err != nil || stats.DownloadedFiles != 2 {
+		t.Fatalf("StartDownload() = %+v, %v; want both files, the first read unbounded on retry", stats, err)
+	}
+	for _, job := range jobs {
+		if data, _ := os.ReadFile(job.OutputPath); len(data) != int(job.Size) {
+			t.Errorf("%s = %d bytes, want %d", job.Path, len(data), job.Size)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package stargzget
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// memberKey identifies a gzip member by blob and compressed start offset.
+type memberKey struct {
+	blob   digest.Digest
+	offset int64
+}
+
+type memberEntry struct {
+	ready chan struct{}
+	data  []byte
+	err   error
+}
+
+// memberCache decodes gzip members shared by several chunks once per
+// download session. Images built with min-chunk-size pack many small files
+// into one member (distinguished by innerOffset); without the cache every
+// file would fetch and inflate the same member again.
+//
+// Decoded members are kept only while chunks planned for the session still
+// reference them, so memory stays bounded by the members in flight.
+type memberCache struct {
+	mu        sync.Mutex
+	total     map[memberKey]int
+	remaining map[memberKey]int
+	entries   map[memberKey]*memberEntry
+	hits      atomic.Int64 // Chunks served from a member another chunk decoded
+}
+
+func newMemberCache() *memberCache {
+	return &memberCache{
+		total:     make(map[memberKey]int),
+		remaining: make(map[memberKey]int),
+		entries:   make(map[memberKey]*memberEntry),
+	}
+}
+
+// reference records the chunks a planned job will read.
+func (c *memberCache) reference(blob digest.Digest, chunks []Chunk) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, chunk := range chunks {
+		if chunk.Size <= 0 {
+			continue
+		}
+		key := memberKey{blob: blob, offset: chunk.CompressedOffset}
+		c.total[key]++
+		c.remaining[key]++
+	}
+}
+
+// shared reports whether more than one planned chunk lives in the member.
+func (c *memberCache) shared(blob digest.Digest, offset int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total[memberKey{blob: blob, offset: offset}] > 1
+}
+
+// release records that a planned chunk of the member was served without
+// reading the member, so it is not kept waiting for that chunk.
+func (c *memberCache) release(blob digest.Digest, offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := memberKey{blob: blob, offset: offset}
+	c.remaining[key]--
+	if c.remaining[key] <= 0 {
+		delete(c.entries, key)
+	}
+}
+
+// get returns the decoded member, calling load at most once while the member
+// is cached. Failed loads are not cached so retries fetch again.
+func (c *memberCache) get(ctx context.Context, blob digest.Digest, offset int64, load func() ([]byte, error)) ([]byte, error) {
+	key := memberKey{blob: blob, offset: offset}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &memberEntry{ready: make(chan struct{})}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		entry.data, entry.err = load()
+		close(entry.ready)
+	} else {
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.err != nil {
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		return nil, entry.err
+	}
+	if ok {
+		c.hits.Add(1)
+	}
+	c.remaining[key]--
+	if c.remaining[key] <= 0 && c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+	return entry.data, nil
+}
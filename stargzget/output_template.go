@@ -0,0 +1,141 @@
+package stargzget
+
+import (
+	"fmt"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// OutputTemplate maps image files to output paths, such as
+// "out/{layer_short}/{path}" to split a download by layer or "bin/{basename}"
+// to flatten a tree. Placeholders:
+//
+//	{path}        image path of the file, e.g. usr/bin/env
+//	{dir}         directory of the file, e.g. usr/bin ("." at the root)
+//	{basename}    file name, e.g. env
+//	{layer}       hex digest of the layer the file comes from
+//	{layer_short} first 12 hex digits of that digest
+type OutputTemplate struct {
+	template string
+	parts    []templatePart
+}
+
+type templatePart struct {
+	literal     string
+	placeholder string // Empty for literal parts
+}
+
+var templatePlaceholders = map[string]bool{
+	"path":        true,
+	"dir":         true,
+	"basename":    true,
+	"layer":       true,
+	"layer_short": true,
+}
+
+// IsOutputTemplate reports whether s uses placeholders and should be parsed
+// as an OutputTemplate rather than taken as a plain output directory.
+func IsOutputTemplate(s string) bool {
+	return strings.Contains(s, "{")
+}
+
+// ParseOutputTemplate parses s. Unknown placeholders and unbalanced braces
+// are errors, as is a template without {path} or {basename}, which would
+// send every file to the same place.
+func ParseOutputTemplate(s string) (*OutputTemplate, error) {
+	t := &OutputTemplate{template: s}
+	perFile := false
+	rest := s
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open == -1 {
+			if strings.Contains(rest, "}") {
+				return nil, fmt.Errorf("output template %q: unmatched '}'", s)
+			}
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if strings.Contains(rest[:open], "}") {
+			return nil, fmt.Errorf("output template %q: unmatched '}'", s)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("output template %q: unterminated placeholder", s)
+		}
+		name := rest[open+1 : open+end]
+		if !templatePlaceholders[name] {
+			return nil, fmt.Errorf("output template %q: unknown placeholder {%s}", s, name)
+		}
+		if name == "path" || name == "basename" {
+			perFile = true
+		}
+		t.parts = append(t.parts, templatePart{placeholder: name})
+		rest = rest[open+end+1:]
+	}
+	if !perFile {
+		return nil, fmt.Errorf("output template %q must contain {path} or {basename}", s)
+	}
+	return t, nil
+}
+
+// String returns the template as given.
+func (t *OutputTemplate) String() string {
+	return t.template
+}
+
+// Root returns the directory holding every expanded path: the part of the
+// template before its first placeholder, up to the last separator.
+func (t *OutputTemplate) Root() string {
+	prefix := ""
+	if len(t.parts) > 0 && t.parts[0].placeholder == "" {
+		prefix = t.parts[0].literal
+	}
+	idx := strings.LastIndexAny(prefix, `/`+string(filepath.Separator))
+	if idx == -1 {
+		return "."
+	}
+	if idx == 0 {
+		return prefix[:1]
+	}
+	return filepath.Clean(prefix[:idx])
+}
+
+// Expand returns the output path of the image file at path, found in the
+// layer blobDigest. The image path is cleaned as if rooted, so it cannot
+// climb out of the template's directory.
+func (t *OutputTemplate) Expand(path string, blobDigest digest.Digest) string {
+	clean := strings.TrimPrefix(pathpkg.Clean("/"+path), "/")
+	if clean == "" {
+		clean = "."
+	}
+	layer := blobDigest.Encoded()
+	short := layer
+	if len(short) > 12 {
+		short = short[:12]
+	}
+
+	var b strings.Builder
+	for _, part := range t.parts {
+		switch part.placeholder {
+		case "":
+			b.WriteString(part.literal)
+		case "path":
+			b.WriteString(clean)
+		case "dir":
+			b.WriteString(pathpkg.Dir(clean))
+		case "basename":
+			b.WriteString(pathpkg.Base(clean))
+		case "layer":
+			b.WriteString(layer)
+		case "layer_short":
+			b.WriteString(short)
+		}
+	}
+	return filepath.Clean(filepath.FromSlash(b.String()))
+}
@@ -0,0 +1,63 @@
+package stargzget
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestOutputTemplate_Expand(t *testing.T) {
+	layer := digest.Digest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		name     string
+		template string
+		path     string
+		want     string
+		wantRoot string
+	}{
+		{name: "by layer", template: "out/{layer_short}/{path}", path: "usr/bin/env", want: "out/0123456789ab/usr/bin/env", wantRoot: "out"},
+		{name: "flatten", template: "bin/{basename}", path: "usr/local/bin/tool", want: "bin/tool", wantRoot: "bin"},
+		{name: "full layer", template: "{layer}/{dir}/{basename}.orig", path: "etc/hosts", want: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/etc/hosts.orig", wantRoot: "."},
+		{name: "root file dir", template: "x/{dir}/{basename}", path: "motd", want: "x/motd", wantRoot: "x"},
+		{name: "cannot climb out", template: "out/{path}", path: "../../etc/passwd", want: "out/etc/passwd", wantRoot: "out"},
+		{name: "partial prefix", template: "out/layer-{layer_short}/{path}", path: "a", want: "out/layer-0123456789ab/a", wantRoot: "out"},
+		{name: "absolute", template: "/srv/{path}", path: "a/b", want: "/srv/a/b", wantRoot: "/srv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseOutputTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("ParseOutputTemplate() error = %v", err)
+			}
+			if got := tmpl.Expand(tt.path, layer); got != filepath.FromSlash(tt.want) {
+				t.Errorf("Expand() = %q, want %q", got, tt.want)
+			}
+			if got := tmpl.Root(); got != filepath.FromSlash(tt.wantRoot) {
+				t.Errorf("Root() = %q, want %q", got, tt.wantRoot)
+			}
+		})
+	}
+}
+
+func TestParseOutputTemplate_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{name: "unknown placeholder", template: "out/{name}"},
+		{name: "unterminated", template: "out/{path"},
+		{name: "stray close", template: "out}/{path}"},
+		{name: "no per-file placeholder", template: "out/{layer_short}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseOutputTemplate(tt.template); err == nil {
+				t.Fatalf("ParseOutputTemplate(%q) expected error", tt.template)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package stargzget
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// overflowID is the ID assigned to owners not covered by a configured map,
+// matching the kernel's overflow uid/gid for user namespaces.
+const overflowID = 65534
+
+// geteuid is swapped in tests to exercise both the chown and record paths.
+var geteuid = os.Geteuid
+
+// IDMapping maps a contiguous range of container IDs onto host IDs, using
+// the CONTAINER:HOST:SIZE form of /etc/subuid and user namespace maps.
+type IDMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// ParseIDMapping parses a CONTAINER:HOST:SIZE mapping.
+func ParseIDMapping(s string) (IDMapping, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return IDMapping{}, fmt.Errorf("invalid id mapping %q, expected CONTAINER:HOST:SIZE", s)
+	}
+
+	values := make([]int, len(parts))
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return IDMapping{}, fmt.Errorf("invalid id mapping %q: %q is not a non-negative integer", s, part)
+		}
+		values[i] = v
+	}
+	if values[2] == 0 {
+		return IDMapping{}, fmt.Errorf("invalid id mapping %q: size must be positive", s)
+	}
+
+	return IDMapping{ContainerID: values[0], HostID: values[1], Size: values[2]}, nil
+}
+
+// mapID translates a container ID through maps. Without maps the ID is kept;
+// IDs outside every mapped range become the overflow ID.
+func mapID(id int, maps []IDMapping) int {
+	if len(maps) == 0 {
+		return id
+	}
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + (id - m.ContainerID)
+		}
+	}
+	return overflowID
+}
+
+// OwnershipOptions controls how file ownership from the TOC is applied to
+// extracted files. When the process runs as root, files are chowned to the
+// mapped IDs and receive their recorded mode bits. Otherwise ownership cannot
+// be changed, so the mapped IDs are written to RecordPath as JSON lines for a
+// later privileged step (e.g. when preparing a container volume).
+type OwnershipOptions struct {
+	UIDMap     []IDMapping
+	GIDMap     []IDMapping
+	RecordPath string
+}
+
+// OwnershipRecord is one line of the ownership metadata file. Mode holds unix
+// mode bits (permissions plus 04000 setuid, 02000 setgid and 01000 sticky),
+// not os.FileMode, so a restore step can pass it straight to chmod.
+type OwnershipRecord struct {
+	Path string `json:"path"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+	Mode uint32 `json:"mode"`
+}
+
+// ownershipApplier applies or records ownership for completed jobs.
+type ownershipApplier struct {
+	opts *OwnershipOptions
+	tx   *Transaction
+	root bool
+
+	mu      sync.Mutex
+	records []OwnershipRecord
+}
+
+func newOwnershipApplier(opts *OwnershipOptions, tx *Transaction) *ownershipApplier {
+	if opts == nil {
+		return nil
+	}
+	return &ownershipApplier{opts: opts, tx: tx, root: geteuid() == 0}
+}
+
+func (a *ownershipApplier) apply(job *DownloadJob) error {
+	if a == nil {
+		return nil
+	}
+
+	uid := mapID(job.UID, a.opts.UIDMap)
+	gid := mapID(job.GID, a.opts.GIDMap)
+
+	if a.root {
+		if err := os.Lchown(job.OutputPath, uid, gid); err != nil {
+			return err
+		}
+		if job.Mode != 0 {
+			return os.Chmod(job.OutputPath, job.Mode)
+		}
+		return nil
+	}
+
+	a.mu.Lock()
+	a.records = append(a.records, OwnershipRecord{
+		Path: a.tx.Final(job.OutputPath),
+		UID:  uid,
+		GID:  gid,
+		Mode: uint32(unixModeFromFileMode(job.Mode)),
+	})
+	a.mu.Unlock()
+	return nil
+}
+
+// flush writes recorded ownership entries sorted by path, so the file does
+// not depend on the order workers finished in. It is a no-op when running as
+// root or when no record path is configured.
+func (a *ownershipApplier) flush() error {
+	if a == nil || a.root || a.opts.RecordPath == "" {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sort.Slice(a.records, func(i, j int) bool { return a.records[i].Path < a.records[j].Path })
+	f, err := os.Create(a.opts.RecordPath)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, rec := range a.records {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,169 @@
+package stargzget
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestParseIDMapping(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    IDMapping
+		wantErr bool
+	}{
+		{in: "0:100000:65536", want: IDMapping{ContainerID: 0, HostID: 100000, Size: 65536}},
+		{in: "1000:1000:1", want: IDMapping{ContainerID: 1000, HostID: 1000, Size: 1}},
+		{in: "0:100000", wantErr: true},
+		{in: "0:-1:1", wantErr: true},
+		{in: "0:1:0", wantErr: true},
+		{in: "a:b:c", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseIDMapping(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIDMapping(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("ParseIDMapping(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMapID(t *testing.T) {
+	maps := []IDMapping{{ContainerID: 0, HostID: 100000, Size: 1000}}
+
+	if got := mapID(5, nil); got != 5 {
+		t.Fatalf("mapID without maps = %d, want 5", got)
+	}
+	if got := mapID(5, maps); got != 100005 {
+		t.Fatalf("mapID(5) = %d, want 100005", got)
+	}
+	if got := mapID(1000, maps); got != overflowID {
+		t.Fatalf("mapID(1000) = %d, want overflow %d", got, overflowID)
+	}
+}
+
+func TestDownloader_OwnershipRecordedWhenNotRoot(t *testing.T) {
+	origGeteuid := geteuid
+	geteuid = func() int { return 1000 }
+	defer func() { geteuid = origGeteuid }()
+
+	tempDir := t.TempDir()
+	store := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, store, resolver, "etc/passwd", []byte("root:x:0:0"), 0)
+	suDigest := addFileToStorage(t, store, resolver, "usr/bin/su", []byte("#!/bin/sh"), 0)
+
+	recordPath := filepath.Join(tempDir, "ownership.jsonl")
+	opts := &DownloadOptions{
+		Ownership: &OwnershipOptions{
+			UIDMap:     []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+			GIDMap:     []IDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}},
+			RecordPath: recordPath,
+		},
+	}
+	job := &DownloadJob{
+		Path:       "etc/passwd",
+		BlobDigest: dgst,
+		Size:       10,
+		OutputPath: filepath.Join(tempDir, "etc", "passwd"),
+		Mode:       0o644,
+		UID:        0,
+		GID:        42,
+	}
+	suJob := &DownloadJob{
+		Path:       "usr/bin/su",
+		BlobDigest: suDigest,
+		Size:       9,
+		OutputPath: filepath.Join(tempDir, "usr", "bin", "su"),
+		Mode:       0o755 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky,
+	}
+
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{suJob, job}, nil, opts)
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	if stats.DownloadedFiles != 2 {
+		t.Fatalf("DownloadedFiles = %d, want 2", stats.DownloadedFiles)
+	}
+
+	f, err := os.Open(recordPath)
+	if err != nil {
+		t.Fatalf("open ownership record: %v", err)
+	}
+	defer f.Close()
+
+	var records []OwnershipRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec OwnershipRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid record line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+
+	want := []OwnershipRecord{
+		{Path: job.OutputPath, UID: 100000, GID: 200042, Mode: 0o644},
+		{Path: suJob.OutputPath, UID: 100000, GID: 200000, Mode: 0o7755},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("records = %d, want %d", len(records), len(want))
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Fatalf("record %d = %+v, want %+v", i, records[i], want[i])
+		}
+	}
+}
+
+func TestDownloader_OwnershipAppliedAsRoot(t *testing.T) {
+	origGeteuid := geteuid
+	geteuid = func() int { return 0 }
+	defer func() { geteuid = origGeteuid }()
+
+	tempDir := t.TempDir()
+	store := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, store, resolver, "bin/tool", []byte("#!/bin/sh"), 0)
+
+	// Map container root onto the current user so chown succeeds unprivileged.
+	opts := &DownloadOptions{
+		Ownership: &OwnershipOptions{
+			UIDMap:     []IDMapping{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GIDMap:     []IDMapping{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+			RecordPath: filepath.Join(tempDir, "unused.jsonl"),
+		},
+	}
+	job := &DownloadJob{
+		Path:       "bin/tool",
+		BlobDigest: dgst,
+		Size:       9,
+		OutputPath: filepath.Join(tempDir, "tool"),
+		Mode:       0o750,
+	}
+
+	if _, err := NewDownloader(resolver, store).StartDownload(context.Background(), []*DownloadJob{job}, nil, opts); err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+
+	info, err := os.Stat(job.OutputPath)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Mode().Perm() != 0o750 {
+		t.Fatalf("mode = %v, want 0750", info.Mode().Perm())
+	}
+	if _, err := os.Stat(opts.Ownership.RecordPath); !os.IsNotExist(err) {
+		t.Fatalf("record file should not be written as root, stat err = %v", err)
+	}
+}
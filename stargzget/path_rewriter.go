@@ -0,0 +1,84 @@
+package stargzget
+
+import (
+	"fmt"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+)
+
+// PathRewriter maps the path of a file in the image, as the TOC records it,
+// to the path it is extracted to, relative to the output directory or
+// archive root. Returning skip leaves the file out. Callers apply it when
+// they plan DownloadJobs, through Rewrite.
+type PathRewriter func(tocPath string) (outPath string, skip bool)
+
+// StripComponents removes the first n directories from each path, as tar's
+// --strip-components does. Files with no more than n components are
+// skipped.
+func StripComponents(n int) PathRewriter {
+	return func(tocPath string) (string, bool) {
+		parts := strings.Split(pathpkg.Clean(tocPath), "/")
+		if len(parts) <= n {
+			return "", true
+		}
+		return pathpkg.Join(parts[n:]...), false
+	}
+}
+
+// PrefixPath places every file under dir.
+func PrefixPath(dir string) PathRewriter {
+	return func(tocPath string) (string, bool) {
+		return pathpkg.Join(dir, tocPath), false
+	}
+}
+
+// ChainPathRewriters applies rewriters in order, each to the output of the
+// one before, and skips a file as soon as one of them does. Nil rewriters
+// are ignored; with none left the result is nil.
+func ChainPathRewriters(rewriters ...PathRewriter) PathRewriter {
+	var chain []PathRewriter
+	for _, r := range rewriters {
+		if r != nil {
+			chain = append(chain, r)
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return func(tocPath string) (string, bool) {
+		path := tocPath
+		for _, r := range chain {
+			var skip bool
+			if path, skip = r(path); skip {
+				return "", true
+			}
+		}
+		return path, false
+	}
+}
+
+// Rewrite applies r to tocPath, cleaned of any leading "./" or "/", and
+// returns the cleaned result in the host's path syntax. It fails when the
+// result is empty, absolute or climbs out of the output directory, so a
+// rewriter cannot write outside it. A nil r leaves the path as it is.
+func (r PathRewriter) Rewrite(tocPath string) (string, bool, error) {
+	out := cleanTOCPath(tocPath)
+	if r != nil {
+		var skip bool
+		if out, skip = r(out); skip {
+			return "", true, nil
+		}
+	}
+	out = filepath.Clean(filepath.FromSlash(out))
+	if out == "." || !filepath.IsLocal(out) {
+		return "", false, fmt.Errorf("path %s is rewritten to %q, which is not inside the output directory", tocPath, out)
+	}
+	return out, false, nil
+}
+
+// cleanTOCPath cleans p and drops the leading "./" or "/" some builders
+// write.
+func cleanTOCPath(p string) string {
+	return strings.TrimPrefix(pathpkg.Clean("/"+p), "/")
+}
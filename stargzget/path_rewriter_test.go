@@ -0,0 +1,39 @@
+package stargzget
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPathRewriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		rewriter PathRewriter
+		in       string
+		want     string
+		skip     bool
+		wantErr  bool
+	}{
+		{name: "nil", in: "./usr/bin/env", want: "usr/bin/env"},
+		{name: "strip", rewriter: StripComponents(1), in: "usr/bin/env", want: "bin/env"},
+		{name: "strip all", rewriter: StripComponents(2), in: "usr/bin", skip: true},
+		{name: "prefix", rewriter: PrefixPath("root"), in: "/etc/hosts", want: "root/etc/hosts"},
+		{name: "strip then prefix", rewriter: ChainPathRewriters(StripComponents(1), nil, PrefixPath("opt/app")), in: "app/bin/run", want: "opt/app/bin/run"},
+		{name: "chain skips", rewriter: ChainPathRewriters(StripComponents(3), PrefixPath("x")), in: "a/b", skip: true},
+		{name: "escape", rewriter: PrefixPath("../up"), in: "etc/hosts", wantErr: true},
+		{name: "empty", rewriter: func(string) (string, bool) { return "", false }, in: "etc/hosts", wantErr: true},
+		{name: "absolute", rewriter: func(p string) (string, bool) { return "/" + p, false }, in: "etc/hosts", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skip, err := tt.rewriter.Rewrite(tt.in)
+			if (err != nil) != tt.wantErr || skip != tt.skip || got != filepath.FromSlash(tt.want) {
+				t.Errorf("Rewrite(%q) = %q, %v, %v; want %q, %v, error %v", tt.in, got, skip, err, tt.want, tt.skip, tt.wantErr)
+			}
+		})
+	}
+
+	if ChainPathRewriters(nil, nil) != nil {
+		t.Error("ChainPathRewriters(nil, nil) != nil")
+	}
+}
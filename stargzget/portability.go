@@ -0,0 +1,403 @@
+package stargzget
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+// ConflictPolicy decides what happens to a file whose output path cannot be
+// created faithfully on the target filesystem.
+type ConflictPolicy string
+
+const (
+	ConflictError  ConflictPolicy = "error"  // Fail before downloading anything
+	ConflictRename ConflictPolicy = "rename" // Write the file under a safe alternative name
+	ConflictSkip   ConflictPolicy = "skip"   // Leave the file out
+)
+
+// ParseConflictPolicy parses an --on-conflict value.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(s)); p {
+	case ConflictError, ConflictRename, ConflictSkip:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid conflict policy %q, expected error, rename or skip", s)
+}
+
+// windowsMaxPath is the classic MAX_PATH limit that still applies to most
+// Windows tooling unless long path support is enabled.
+const windowsMaxPath = 260
+
+// PortabilityOptions describes the filesystem the files are extracted to.
+// Paths that would collide or be rejected there are handled per OnConflict.
+type PortabilityOptions struct {
+	OnConflict      ConflictPolicy
+	CaseInsensitive bool // Paths differing only in case refer to the same file (macOS, Windows)
+	WindowsNames    bool // Reject reserved device names (aux, con, nul, ...) and characters invalid on Windows
+	MaxPathLength   int  // Maximum absolute output path length; 0 means unlimited
+
+	// RenameSuffix is inserted before the extension of a file renamed for
+	// colliding with another, with %d replaced by 1, 2, ... until the name
+	// is free; see CheckRenameSuffix. Empty means DefaultRenameSuffix.
+	RenameSuffix string
+}
+
+// DefaultRenameSuffix renames a colliding "Makefile" to "Makefile~1".
+const DefaultRenameSuffix = "~%d"
+
+// CheckRenameSuffix validates a RenameSuffix: it must hold exactly one %d,
+// no other verbs and no path separators.
+func CheckRenameSuffix(suffix string) error {
+	if strings.Count(suffix, "%d") != 1 || strings.Count(suffix, "%") != 1 {
+		return fmt.Errorf("invalid rename suffix %q: it must contain %%d exactly once and no other %%", suffix)
+	}
+	if strings.ContainsAny(suffix, `/\`) {
+		return fmt.Errorf("invalid rename suffix %q: it must not contain path separators", suffix)
+	}
+	return nil
+}
+
+// HostPortability returns the checks needed for the filesystem conventions
+// of the current OS. On Linux no checks apply.
+func HostPortability(policy ConflictPolicy) *PortabilityOptions {
+	opts := &PortabilityOptions{OnConflict: policy}
+	switch runtime.GOOS {
+	case "darwin":
+		opts.CaseInsensitive = true
+	case "windows":
+		opts.CaseInsensitive = true
+		opts.WindowsNames = true
+		opts.MaxPathLength = windowsMaxPath
+	}
+	return opts
+}
+
+// StrictPortability enables every check regardless of the host, so CI on
+// Linux can catch paths that would break extraction on macOS or Windows.
+func StrictPortability(policy ConflictPolicy) *PortabilityOptions {
+	return &PortabilityOptions{
+		OnConflict:      policy,
+		CaseInsensitive: true,
+		WindowsNames:    true,
+		MaxPathLength:   windowsMaxPath,
+	}
+}
+
+// PathIssue records a file whose output path was not portable and what was
+// done about it.
+type PathIssue struct {
+	Path       string         // File path in the image
+	BlobDigest digest.Digest  // Layer the file comes from
+	OutputPath string         // Original output path
+	Renamed    string         // New output path when Action is ConflictRename
+	Reason     string         // Why the path is not portable
+	Action     ConflictPolicy // What was done
+
+	// CollidesWith and CollidesWithBlob name the file, and its layer, that
+	// already holds the output path on a case-insensitive filesystem; empty
+	// for other issues.
+	CollidesWith     string
+	CollidesWithBlob digest.Digest
+}
+
+func (i PathIssue) String() string {
+	switch i.Action {
+	case ConflictRename:
+		return fmt.Sprintf("%s: %s, renamed to %s", i.Path, i.Reason, i.Renamed)
+	case ConflictSkip:
+		return fmt.Sprintf("%s: %s, skipped", i.Path, i.Reason)
+	}
+	return fmt.Sprintf("%s: %s", i.Path, i.Reason)
+}
+
+// planPortablePaths checks every job's output path against opts and applies
+// the conflict policy. It returns the jobs to download and the issues found.
+// Under ConflictError an error is returned if any file is affected.
+func planPortablePaths(jobs []*DownloadJob, opts *PortabilityOptions) ([]*DownloadJob, []PathIssue, error) {
+	if opts == nil {
+		return jobs, nil, nil
+	}
+	policy := opts.OnConflict
+	if policy == "" {
+		policy = ConflictError
+	}
+
+	suffix := opts.RenameSuffix
+	if suffix == "" {
+		suffix = DefaultRenameSuffix
+	}
+
+	var (
+		kept   = make([]*DownloadJob, 0, len(jobs))
+		issues []PathIssue
+		files  = make(map[string]*DownloadJob) // Kept files by lower-cased output path
+		dirs   = make(map[string]*DownloadJob) // First kept file under each lower-cased parent directory
+	)
+
+	// holder returns the kept file whose output path, or one of whose
+	// parent directories, is p when case is ignored.
+	holder := func(p string) *DownloadJob {
+		key := strings.ToLower(filepath.Clean(p))
+		if job := files[key]; job != nil {
+			return job
+		}
+		return dirs[key]
+	}
+	taken := func(p string) bool {
+		return holder(p) != nil
+	}
+	claim := func(p string, job *DownloadJob) {
+		p = strings.ToLower(filepath.Clean(p))
+		files[p] = job
+		for dir := filepath.Dir(p); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+			if dirs[dir] == nil {
+				dirs[dir] = job
+			}
+		}
+	}
+
+	for _, job := range jobs {
+		outputPath := job.OutputPath
+		var reasons []string
+
+		if opts.WindowsNames {
+			if fixed, reason := windowsSafePath(outputPath); reason != "" {
+				reasons = append(reasons, reason)
+				outputPath = fixed
+			}
+		}
+		if opts.MaxPathLength > 0 && absLen(outputPath) > opts.MaxPathLength {
+			reasons = append(reasons, fmt.Sprintf("path longer than %d characters", opts.MaxPathLength))
+			outputPath = hashedPath(outputPath, job.Path)
+		}
+		var other *DownloadJob
+		if opts.CaseInsensitive {
+			if other = holder(outputPath); other != nil {
+				source := other.Path
+				if other.BlobDigest != "" {
+					source += " from layer " + shortDigest(other.BlobDigest)
+				}
+				reasons = append(reasons, fmt.Sprintf("collides with %s on a case-insensitive filesystem", source))
+				outputPath = uniquePath(outputPath, suffix, taken)
+			}
+		}
+
+		if len(reasons) == 0 {
+			claim(job.OutputPath, job)
+			kept = append(kept, job)
+			continue
+		}
+
+		issue := PathIssue{
+			Path:       job.Path,
+			BlobDigest: job.BlobDigest,
+			OutputPath: job.OutputPath,
+			Reason:     strings.Join(reasons, "; "),
+			Action:     policy,
+		}
+		if other != nil {
+			issue.CollidesWith, issue.CollidesWithBlob = other.Path, other.BlobDigest
+		}
+		if policy == ConflictRename && opts.MaxPathLength > 0 && absLen(outputPath) > opts.MaxPathLength {
+			// Even the hashed name does not fit; renaming cannot help.
+			issue.Action = ConflictError
+		}
+
+		switch issue.Action {
+		case ConflictRename:
+			issue.Renamed = outputPath
+			renamed := *job
+			renamed.OutputPath = outputPath
+			claim(outputPath, &renamed)
+			kept = append(kept, &renamed)
+		case ConflictSkip:
+		default:
+			issue.Action = ConflictError
+		}
+		issues = append(issues, issue)
+	}
+
+	failed := 0
+	for _, issue := range issues {
+		if issue.Action == ConflictError {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return nil, issues, stargzerrors.ErrDownloadFailed.
+			WithMessage(fmt.Sprintf("%d file(s) cannot be extracted portably, see DownloadStats.PathIssues", failed))
+	}
+	return kept, issues, nil
+}
+
+// dedupeOutputPaths keeps one job per output path so that two workers never
+// write the same file. Jobs are taken to be listed from the lowest layer up,
+// as an overlay would apply them, so the last job for a path wins; it takes
+// the place of the first one in the job order. Each dropped job is reported
+// as a skipped PathIssue, once per distinct source, unless it is an exact
+// repeat of the winner.
+func dedupeOutputPaths(jobs []*DownloadJob) ([]*DownloadJob, []PathIssue) {
+	index := make(map[string]int, len(jobs))
+	kept := make([]*DownloadJob, 0, len(jobs))
+	var dropped []*DownloadJob
+	for _, job := range jobs {
+		key := filepath.Clean(job.OutputPath)
+		if i, ok := index[key]; ok {
+			dropped = append(dropped, kept[i])
+			kept[i] = job
+			continue
+		}
+		index[key] = len(kept)
+		kept = append(kept, job)
+	}
+
+	var issues []PathIssue
+	reported := make(map[string]bool)
+	for _, job := range dropped {
+		key := filepath.Clean(job.OutputPath)
+		winner := kept[index[key]]
+		if job.Path == winner.Path && job.BlobDigest == winner.BlobDigest && job.LinkTo == winner.LinkTo {
+			continue
+		}
+		source := key + "\x00" + job.BlobDigest.String() + "\x00" + job.Path
+		if reported[source] {
+			continue
+		}
+		reported[source] = true
+		issue := PathIssue{
+			Path:       job.Path,
+			BlobDigest: job.BlobDigest,
+			OutputPath: job.OutputPath,
+			Reason:     fmt.Sprintf("same output path as %s in blob %s", winner.Path, winner.BlobDigest),
+			Action:     ConflictSkip,
+		}
+		logger.Warn("Duplicate output path: %s", issue)
+		issues = append(issues, issue)
+	}
+	return kept, issues
+}
+
+var windowsReservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+const windowsInvalidChars = `<>:"|?*\`
+
+// windowsSafePath rewrites the components of p that Windows refuses to
+// create. It returns the rewritten path and a reason, or an empty reason if
+// p is already valid. Only components below the volume are inspected.
+func windowsSafePath(p string) (string, string) {
+	volume := filepath.VolumeName(p)
+	parts := strings.Split(filepath.ToSlash(p[len(volume):]), "/")
+	var reasons []string
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+
+		stem := part
+		if idx := strings.Index(stem, "."); idx != -1 {
+			stem = stem[:idx]
+		}
+		if windowsReservedNames[strings.ToLower(stem)] {
+			reasons = append(reasons, fmt.Sprintf("%q is a reserved name on Windows", part))
+			part = stem + "_" + part[len(stem):]
+		}
+		if strings.ContainsAny(part, windowsInvalidChars) || strings.ContainsFunc(part, func(r rune) bool { return r < 0x20 }) {
+			reasons = append(reasons, fmt.Sprintf("%q contains characters invalid on Windows", part))
+			part = strings.Map(func(r rune) rune {
+				if r < 0x20 || strings.ContainsRune(windowsInvalidChars, r) {
+					return '_'
+				}
+				return r
+			}, part)
+		}
+		if trimmed := strings.TrimRight(part, ". "); trimmed != part {
+			reasons = append(reasons, fmt.Sprintf("%q ends with a dot or space", part))
+			part = trimmed + "_"
+		}
+		parts[i] = part
+	}
+	if len(reasons) == 0 {
+		return p, ""
+	}
+	return volume + filepath.FromSlash(strings.Join(parts, "/")), strings.Join(reasons, "; ")
+}
+
+// hashedPath replaces the base name of outputPath with a short hash of the
+// image path, keeping the extension so the file stays recognizable.
+func hashedPath(outputPath, imagePath string) string {
+	sum := sha256.Sum256([]byte(imagePath))
+	name := hex.EncodeToString(sum[:8]) + filepath.Ext(outputPath)
+	return filepath.Join(filepath.Dir(outputPath), name)
+}
+
+// uniquePath inserts suffix, numbered from 1, before the extension until
+// the path is free.
+func uniquePath(p, suffix string, taken func(string) bool) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		candidate := base + fmt.Sprintf(suffix, i) + ext
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// shortDigest abbreviates d to the first 12 characters of its encoded
+// part, or returns it whole if it is malformed.
+func shortDigest(d digest.Digest) string {
+	if d.Validate() != nil {
+		return d.String()
+	}
+	encoded := d.Encoded()
+	return encoded[:min(12, len(encoded))]
+}
+
+// CaseInsensitiveDir reports whether the filesystem holding dir, or its
+// closest existing parent, treats names differing only in case as the same
+// file, as macOS and Windows do by default and Linux does for casefold
+// directories and FAT or SMB mounts. It creates and removes a probe file;
+// when that fails it reports false.
+func CaseInsensitiveDir(dir string) bool {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".starget-case-probe-")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	upper := filepath.Join(dir, strings.ToUpper(filepath.Base(f.Name())))
+	_, err = os.Stat(upper)
+	return err == nil
+}
+
+func absLen(p string) int {
+	if abs, err := filepath.Abs(p); err == nil {
+		return len(abs)
+	}
+	return len(p)
+}
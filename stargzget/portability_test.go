@@ -0,0 +1,250 @@
+package stargzget
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, in := range []string{"error", "rename", "SKIP"} {
+		if _, err := ParseConflictPolicy(in); err != nil {
+			t.Fatalf("ParseConflictPolicy(%q) unexpected error: %v", in, err)
+		}
+	}
+	if _, err := ParseConflictPolicy("overwrite"); err == nil {
+		t.Fatalf("ParseConflictPolicy(overwrite) expected error")
+	}
+}
+
+func TestPlanPortablePaths(t *testing.T) {
+	root := t.TempDir()
+	longName := strings.Repeat("x", 300) + ".txt"
+
+	jobs := []*DownloadJob{
+		{Path: "etc/Makefile", OutputPath: filepath.Join(root, "etc/Makefile")},
+		{Path: "etc/makefile", OutputPath: filepath.Join(root, "etc/makefile")},
+		{Path: "dev/aux.c", OutputPath: filepath.Join(root, "dev/aux.c")},
+		{Path: "docs/what?.md", OutputPath: filepath.Join(root, "docs/what?.md")},
+		{Path: "deep/" + longName, OutputPath: filepath.Join(root, "deep", longName)},
+		{Path: "bin/sh", OutputPath: filepath.Join(root, "bin/sh")},
+	}
+
+	tests := []struct {
+		name       string
+		policy     ConflictPolicy
+		wantErr    bool
+		wantKept   int
+		wantIssues int
+		wantPaths  []string
+	}{
+		{name: "error", policy: ConflictError, wantErr: true, wantIssues: 4},
+		{name: "skip", policy: ConflictSkip, wantKept: 2, wantIssues: 4, wantPaths: []string{"etc/Makefile", "bin/sh"}},
+		{
+			name:       "rename",
+			policy:     ConflictRename,
+			wantKept:   6,
+			wantIssues: 4,
+			wantPaths:  []string{"etc/Makefile", "etc/makefile~1", "dev/aux_.c", "docs/what_.md", "bin/sh"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, issues, err := planPortablePaths(jobs, StrictPortability(tt.policy))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("planPortablePaths() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(issues) != tt.wantIssues {
+				t.Fatalf("issues = %d, want %d: %v", len(issues), tt.wantIssues, issues)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(kept) != tt.wantKept {
+				t.Fatalf("kept = %d, want %d", len(kept), tt.wantKept)
+			}
+
+			outputs := make(map[string]bool)
+			for _, job := range kept {
+				rel, _ := filepath.Rel(root, job.OutputPath)
+				outputs[filepath.ToSlash(rel)] = true
+				if len(job.OutputPath) > windowsMaxPath {
+					t.Fatalf("output path %q exceeds %d characters", job.OutputPath, windowsMaxPath)
+				}
+			}
+			for _, want := range tt.wantPaths {
+				if !outputs[want] {
+					t.Fatalf("missing output %q in %v", want, outputs)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanPortablePaths_CaseCollisionReport(t *testing.T) {
+	lower, upper := digest.FromString("lower"), digest.FromString("upper")
+	jobs := []*DownloadJob{
+		{Path: "src/Foo.go", BlobDigest: lower, OutputPath: "out/src/Foo.go"},
+		{Path: "src/foo.go", BlobDigest: upper, OutputPath: "out/src/foo.go"},
+		{Path: "SRC/bar", BlobDigest: upper, OutputPath: "out/SRC"},
+	}
+	opts := &PortabilityOptions{OnConflict: ConflictRename, CaseInsensitive: true, RenameSuffix: ".case%d"}
+	kept, issues, err := planPortablePaths(jobs, opts)
+	if err != nil {
+		t.Fatalf("planPortablePaths() error = %v", err)
+	}
+	if len(kept) != 3 || len(issues) != 2 {
+		t.Fatalf("kept = %d, issues = %v; want 3 kept and 2 issues", len(kept), issues)
+	}
+	if got := issues[0]; got.Renamed != "out/src/foo.case1.go" || got.BlobDigest != upper || got.CollidesWith != "src/Foo.go" || got.CollidesWithBlob != lower {
+		t.Errorf("issues[0] = %+v, want foo.go renamed with its collision against the lower Foo.go", got)
+	}
+	if !strings.Contains(issues[0].String(), shortDigest(lower)) {
+		t.Errorf("issues[0].String() = %q, want the other file's layer", issues[0])
+	}
+	// A file named like a directory of another file collides with it too.
+	if got := issues[1]; got.Renamed != "out/SRC.case1" || got.CollidesWith != "src/Foo.go" {
+		t.Errorf("issues[1] = %+v, want SRC renamed for the src directory", got)
+	}
+}
+
+func TestCheckRenameSuffix(t *testing.T) {
+	for suffix, valid := range map[string]bool{
+		"~%d":    true,
+		"_%d":    true,
+		".dup%d": true,
+		"":       false,
+		"~":      false,
+		"%d%d":   false,
+		"%s%d":   false,
+		"/%d":    false,
+		`\%d`:    false,
+		"%d-%%x": false,
+	} {
+		if err := CheckRenameSuffix(suffix); (err == nil) != valid {
+			t.Errorf("CheckRenameSuffix(%q) = %v, want valid %v", suffix, err, valid)
+		}
+	}
+}
+
+func TestCaseInsensitiveDir(t *testing.T) {
+	dir := t.TempDir()
+	// The probe runs in the closest existing parent and leaves nothing.
+	got := CaseInsensitiveDir(filepath.Join(dir, "not", "yet"))
+	if got != CaseInsensitiveDir(dir) {
+		t.Errorf("CaseInsensitiveDir() of a missing directory = %v, want the parent's answer", got)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("probe left %v, %v behind", entries, err)
+	}
+}
+
+func TestPlanPortablePaths_NilOptionsKeepsJobs(t *testing.T) {
+	jobs := []*DownloadJob{
+		{Path: "a", OutputPath: "out/A"},
+		{Path: "b", OutputPath: "out/a"},
+	}
+	kept, issues, err := planPortablePaths(jobs, nil)
+	if err != nil || len(issues) != 0 || len(kept) != 2 {
+		t.Fatalf("planPortablePaths(nil) = %d jobs, %v, %v", len(kept), issues, err)
+	}
+}
+
+func TestDownloader_PortabilityRenameReportsIssues(t *testing.T) {
+	tempDir := t.TempDir()
+	store := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	upper := addFileToStorage(t, store, resolver, "README", []byte("upper"), 0)
+	lower := addFileToStorage(t, store, resolver, "readme", []byte("lower"), 0)
+
+	jobs := []*DownloadJob{
+		{Path: "README", BlobDigest: upper, Size: 5, OutputPath: filepath.Join(tempDir, "README")},
+		{Path: "readme", BlobDigest: lower, Size: 5, OutputPath: filepath.Join(tempDir, "readme")},
+	}
+	opts := &DownloadOptions{Portability: StrictPortability(ConflictRename)}
+
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, opts)
+	if err != nil {
+		t.Fatalf("StartDownload() unexpected error: %v", err)
+	}
+	if stats.DownloadedFiles != 2 {
+		t.Fatalf("DownloadedFiles = %d, want 2", stats.DownloadedFiles)
+	}
+	if len(stats.PathIssues) != 1 || stats.PathIssues[0].Action != ConflictRename {
+		t.Fatalf("PathIssues = %v, want one rename", stats.PathIssues)
+	}
+
+	data, err := os.ReadFile(stats.PathIssues[0].Renamed)
+	if err != nil {
+		t.Fatalf("failed to read renamed file: %v", err)
+	}
+	if string(data) != "lower" {
+		t.Fatalf("renamed file content = %q, want %q", data, "lower")
+	}
+}
+
+func TestDedupeOutputPaths(t *testing.T) {
+	lower, upper := digest.FromString("lower"), digest.FromString("upper")
+	jobs := []*DownloadJob{
+		{Path: "etc/hosts", BlobDigest: lower, OutputPath: "out/etc/hosts"},
+		{Path: "bin/sh", BlobDigest: lower, OutputPath: "out/bin/sh"},
+		{Path: "etc/hosts", BlobDigest: upper, OutputPath: "out/etc/./hosts"},
+		{Path: "bin/sh", BlobDigest: lower, OutputPath: "out/bin/sh"},
+	}
+
+	kept, issues := dedupeOutputPaths(jobs)
+	if len(kept) != 2 {
+		t.Fatalf("kept %d jobs, want 2", len(kept))
+	}
+	if kept[0].BlobDigest != upper || kept[0].Path != "etc/hosts" {
+		t.Fatalf("kept[0] = %+v, want the upper etc/hosts in the first slot", kept[0])
+	}
+	if kept[1].Path != "bin/sh" {
+		t.Fatalf("kept[1] = %+v, want bin/sh", kept[1])
+	}
+	if len(issues) != 1 || issues[0].Action != ConflictSkip || issues[0].OutputPath != "out/etc/hosts" {
+		t.Fatalf("issues = %v, want one skip for the lower etc/hosts (exact repeats are silent)", issues)
+	}
+}
+
+func TestDownloader_DuplicateOutputPaths(t *testing.T) {
+	tempDir := t.TempDir()
+	store := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	lower := addFileToStorage(t, store, resolver, "etc/motd", []byte("lower layer"), 0)
+	upper := addFileToStorage(t, store, resolver, "etc/motd", []byte("upper"), 0)
+
+	output := filepath.Join(tempDir, "motd")
+	var jobs []*DownloadJob
+	for i := 0; i < 8; i++ {
+		jobs = append(jobs,
+			&DownloadJob{Path: "etc/motd", BlobDigest: lower, Size: 11, OutputPath: output},
+			&DownloadJob{Path: "etc/motd", BlobDigest: upper, Size: 5, OutputPath: output},
+		)
+	}
+
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, &DownloadOptions{Concurrency: 8})
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	if stats.TotalFiles != 1 || stats.DownloadedFiles != 1 {
+		t.Fatalf("stats = %+v, want a single file", stats)
+	}
+	if len(stats.PathIssues) != 1 {
+		t.Fatalf("PathIssues = %v, want one duplicate reported", stats.PathIssues)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(data) != "upper" {
+		t.Fatalf("content = %q, want the upper layer's", data)
+	}
+}
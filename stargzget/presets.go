@@ -0,0 +1,86 @@
+package stargzget
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Preset is a named bundle of download tuning, so callers can pick a
+// behavior instead of setting each knob. Apply copies it into
+// DownloadOptions; MaxRequestsPerHost is process-wide and is applied with
+// storage.SetMaxRequestsPerHost.
+type Preset struct {
+	Name        string
+	Description string
+
+	Concurrency              int
+	MaxRetries               int
+	RetryBackoff             time.Duration
+	SingleFileChunkThreshold int64
+	DisableChunkedSingleFile bool
+	StallTimeout             time.Duration
+	AbortOnStall             bool
+	MaxRequestsPerHost       int
+}
+
+var presets = []Preset{
+	{
+		Name:                     "fast",
+		Description:              "many workers, early parallel chunk fetches and quick retries, for fast links to capable registries",
+		Concurrency:              16,
+		MaxRetries:               2,
+		SingleFileChunkThreshold: 4 << 20,
+		MaxRequestsPerHost:       32,
+	},
+	{
+		Name:                     "polite",
+		Description:              "few requests at a time, one range per file and patient retries, for rate-limited or shared registries",
+		Concurrency:              2,
+		MaxRetries:               5,
+		RetryBackoff:             2 * time.Second,
+		SingleFileChunkThreshold: 64 << 20,
+		DisableChunkedSingleFile: true,
+		MaxRequestsPerHost:       4,
+	},
+	{
+		Name:               "ci",
+		Description:        "moderate parallelism, retries with backoff, and failing instead of hanging after 2m without progress",
+		Concurrency:        8,
+		MaxRetries:         5,
+		RetryBackoff:       500 * time.Millisecond,
+		StallTimeout:       2 * time.Minute,
+		AbortOnStall:       true,
+		MaxRequestsPerHost: 16,
+	},
+}
+
+// Presets returns the bundled presets.
+func Presets() []Preset {
+	return append([]Preset(nil), presets...)
+}
+
+// LookupPreset returns the bundled preset called name.
+func LookupPreset(name string) (Preset, error) {
+	names := make([]string, 0, len(presets))
+	for _, p := range presets {
+		if p.Name == name {
+			return p, nil
+		}
+		names = append(names, p.Name)
+	}
+	return Preset{}, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// Apply sets the tuning fields of opts from the preset, leaving callbacks
+// and unrelated options alone. Zero preset fields select the downloader's
+// defaults.
+func (p Preset) Apply(opts *DownloadOptions) {
+	opts.Concurrency = p.Concurrency
+	opts.MaxRetries = p.MaxRetries
+	opts.RetryBackoff = p.RetryBackoff
+	opts.SingleFileChunkThreshold = p.SingleFileChunkThreshold
+	opts.DisableChunkedSingleFile = p.DisableChunkedSingleFile
+	opts.StallTimeout = p.StallTimeout
+	opts.AbortOnStall = p.AbortOnStall
+}
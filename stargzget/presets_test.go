@@ -0,0 +1,62 @@
+package stargzget
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupPreset(t *testing.T) {
+	for _, name := range []string{"fast", "polite", "ci"} {
+		p, err := LookupPreset(name)
+		if err != nil {
+			t.Fatalf("LookupPreset(%q) error = %v", name, err)
+		}
+		if p.Name != name || p.Concurrency <= 0 || p.MaxRetries <= 0 || p.Description == "" {
+			t.Errorf("LookupPreset(%q) = %+v, want a named preset with concurrency and retries", name, p)
+		}
+	}
+
+	_, err := LookupPreset("turbo")
+	if err == nil || !strings.Contains(err.Error(), "fast, polite, ci") {
+		t.Fatalf("LookupPreset(turbo) error = %v, want the available presets listed", err)
+	}
+}
+
+func TestPreset_Apply(t *testing.T) {
+	p, err := LookupPreset("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onWarning := func(Warning) {}
+	opts := &DownloadOptions{Concurrency: 1, MaxChunkSize: 1 << 20, OnWarning: onWarning}
+	p.Apply(opts)
+
+	if opts.Concurrency != p.Concurrency || opts.RetryBackoff != p.RetryBackoff || !opts.AbortOnStall || opts.StallTimeout != p.StallTimeout {
+		t.Errorf("Apply() = %+v, want the preset's tuning", opts)
+	}
+	if opts.MaxChunkSize != 1<<20 || opts.OnWarning == nil {
+		t.Errorf("Apply() changed options outside the preset: %+v", opts)
+	}
+}
+
+func TestDownloadOptions_RetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{backoff: 0, attempt: 3, want: 0},
+		{backoff: time.Second, attempt: 1, want: time.Second},
+		{backoff: time.Second, attempt: 2, want: 2 * time.Second},
+		{backoff: time.Second, attempt: 4, want: 8 * time.Second},
+		{backoff: time.Second, attempt: 10, want: maxRetryBackoff},
+		{backoff: time.Minute, attempt: 1, want: maxRetryBackoff},
+	}
+	for _, tt := range tests {
+		opts := &DownloadOptions{RetryBackoff: tt.backoff}
+		if got := opts.retryDelay(tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d) with backoff %s = %s, want %s", tt.attempt, tt.backoff, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package stargzget
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WritePriorityList writes the prioritized files of layers as a priority
+// list: one path per line, grouped under a "# <blob digest>" comment per
+// layer. Layers without prioritized files are left out. A path prioritized
+// by several layers is listed once, under the first.
+func WritePriorityList(w io.Writer, layers []*LayerInfo) error {
+	bw := bufio.NewWriter(w)
+	seen := make(map[string]bool)
+	for _, layer := range layers {
+		if len(layer.Prioritized) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# %s\n", layer.BlobDigest)
+		for _, path := range layer.Prioritized {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			fmt.Fprintln(bw, path)
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadPriorityList reads a priority list as written by WritePriorityList.
+// Blank lines and lines starting with '#' are ignored, as are repeated
+// paths; a leading "./" or "/" is dropped so lists from other tools match
+// TOC names.
+func ReadPriorityList(r io.Reader) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path := strings.TrimPrefix(strings.TrimPrefix(line, "./"), "/")
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
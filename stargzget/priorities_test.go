@@ -0,0 +1,67 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestPriorityList_RoundTrip(t *testing.T) {
+	prioritized := estargztest.NewBuilder().
+		Dir("bin/").
+		File("bin/sh", []byte("sh")).
+		Symlink("bin/bash", "sh").
+		File(estargzutil.PrefetchLandmark, []byte{0xf}).
+		File("etc/motd", []byte("hello")).
+		MustBuild()
+	unprioritized := estargztest.NewBuilder().
+		File(estargzutil.NoPrefetchLandmark, []byte{0xf}).
+		File("etc/hosts", []byte("localhost")).
+		MustBuild()
+	upper := estargztest.NewBuilder().
+		File("bin/sh", []byte("new sh")).
+		File("usr/bin/env", []byte("env")).
+		File(estargzutil.PrefetchLandmark, []byte{0xf}).
+		MustBuild()
+
+	store := stor.NewMockStorage()
+	for _, layer := range []*estargztest.Layer{prioritized, unprioritized, upper} {
+		store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	}
+	index, err := NewBlobIndexLoader(store, NewBlobResolver(store)).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WritePriorityList(&buf, index.Layers); err != nil {
+		t.Fatalf("WritePriorityList() error = %v", err)
+	}
+	want := strings.Join([]string{
+		"# " + prioritized.Digest.String(),
+		"bin/sh",
+		"bin/bash",
+		"# " + upper.Digest.String(),
+		"usr/bin/env",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Fatalf("WritePriorityList() =\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.WriteString("\n  # hand-added\n./etc/motd\n/usr/bin/env\n")
+	paths, err := ReadPriorityList(&buf)
+	if err != nil {
+		t.Fatalf("ReadPriorityList() error = %v", err)
+	}
+	wantPaths := []string{"bin/sh", "bin/bash", "usr/bin/env", "etc/motd"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Fatalf("ReadPriorityList() = %v, want %v", paths, wantPaths)
+	}
+}
@@ -0,0 +1,156 @@
+package stargzget
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+// ProvenanceOptions turns on the provenance log: one JSON line per
+// downloaded file recording the image, layer, TOC entry and byte ranges its
+// content came from and whether it matches the digest in the TOC, so the
+// origin of every extracted file can be shown later.
+type ProvenanceOptions struct {
+	Writer      io.Writer     // Receives the records; writes are serialized
+	Image       string        // Image reference, recorded as given
+	ImageDigest digest.Digest // Manifest digest (storage.Manifest.Digest), if known
+}
+
+// Verification results recorded in ProvenanceRecord.Verification.
+const (
+	VerificationVerified   = "verified"   // The file's digest matches its TOC entry
+	VerificationMismatch   = "mismatch"   // The file's digest differs from its TOC entry
+	VerificationUnverified = "unverified" // The TOC records no usable digest for the file
+)
+
+// ProvenanceRecord is one line of the provenance log.
+type ProvenanceRecord struct {
+	Path          string            `json:"path"`
+	OutputPath    string            `json:"outputPath"`
+	Image         string            `json:"image,omitempty"`
+	ImageDigest   string            `json:"imageDigest,omitempty"`
+	LayerDigest   string            `json:"layerDigest"`
+	EntryDigest   string            `json:"entryDigest,omitempty"` // Digest the TOC records for the file
+	ContentDigest string            `json:"contentDigest"`         // Digest of the file as written
+	Verification  string            `json:"verification"`
+	Size          int64             `json:"size"`
+	Ranges        []ProvenanceRange `json:"ranges"`
+	Attempts      int               `json:"attempts"`
+	StartedAt     time.Time         `json:"startedAt"`
+	CompletedAt   time.Time         `json:"completedAt"`
+}
+
+// ProvenanceRange is one chunk of a file: Size bytes at Offset in the file,
+// decoded from the gzip member that starts at CompressedOffset in the layer
+// blob, InnerOffset bytes into it. Reads of a chunk start at
+// CompressedOffset and end with its member.
+type ProvenanceRange struct {
+	CompressedOffset int64 `json:"compressedOffset"`
+	InnerOffset      int64 `json:"innerOffset,omitempty"`
+	Offset           int64 `json:"offset"`
+	Size             int64 `json:"size"`
+}
+
+// provenanceLog writes provenance records for a download session.
+type provenanceLog struct {
+	opts *ProvenanceOptions
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newProvenanceLog(opts *ProvenanceOptions) *provenanceLog {
+	if opts == nil || opts.Writer == nil {
+		return nil
+	}
+	return &provenanceLog{opts: opts, enc: json.NewEncoder(opts.Writer)}
+}
+
+// recordProvenance writes the provenance record of a completed job. A file
+// whose content does not match its TOC digest is reported as a warning; it
+// stays downloaded, and the record says so.
+func (s *downloadSession) recordProvenance(jwo *jobWithOffset, attempts int, started time.Time) error {
+	if s.prov == nil {
+		return nil
+	}
+	rec, err := newProvenanceRecord(s.prov.opts, jwo.job, jwo.metadata, jwo.contentPath())
+	if err != nil {
+		return err
+	}
+	rec.OutputPath = s.opts.Transaction.Final(rec.OutputPath)
+	rec.Attempts = attempts
+	rec.StartedAt = started.UTC()
+	rec.CompletedAt = time.Now().UTC()
+
+	if rec.Verification == VerificationMismatch {
+		err := fmt.Errorf("content digest %s does not match TOC digest %s", rec.ContentDigest, rec.EntryDigest)
+		logger.Warn("%s: %v", jwo.job.Path, err)
+		s.warn(Warning{Kind: WarningDigestMismatch, BlobDigest: jwo.job.BlobDigest, Path: jwo.job.Path, Err: err})
+	}
+
+	s.prov.mu.Lock()
+	defer s.prov.mu.Unlock()
+	return s.prov.enc.Encode(rec)
+}
+
+// newProvenanceRecord describes the file job wrote, hashing the content at
+// contentPath with the algorithm of its TOC digest (sha256 when there is
+// none).
+func newProvenanceRecord(opts *ProvenanceOptions, job *DownloadJob, metadata *FileMetadata, contentPath string) (ProvenanceRecord, error) {
+	rec := ProvenanceRecord{
+		Path:         job.Path,
+		OutputPath:   job.OutputPath,
+		Image:        opts.Image,
+		ImageDigest:  opts.ImageDigest.String(),
+		LayerDigest:  job.BlobDigest.String(),
+		Verification: VerificationUnverified,
+		Size:         job.Size,
+		Ranges:       []ProvenanceRange{},
+	}
+
+	algorithm := digest.Canonical
+	var want digest.Digest
+	if metadata != nil {
+		rec.EntryDigest = metadata.Digest
+		if d, err := digest.Parse(metadata.Digest); err == nil && d.Algorithm().Available() {
+			want, algorithm = d, d.Algorithm()
+		}
+		for _, chunk := range metadata.Chunks {
+			if chunk.Size <= 0 {
+				continue
+			}
+			rec.Ranges = append(rec.Ranges, ProvenanceRange{
+				CompressedOffset: chunk.CompressedOffset,
+				InnerOffset:      chunk.InnerOffset,
+				Offset:           chunk.Offset,
+				Size:             chunk.Size,
+			})
+		}
+	}
+
+	f, err := os.Open(contentPath)
+	if err != nil {
+		return rec, err
+	}
+	defer f.Close()
+	got, err := algorithm.FromReader(f)
+	if err != nil {
+		return rec, err
+	}
+	rec.ContentDigest = got.String()
+
+	switch {
+	case want == "":
+	case got == want:
+		rec.Verification = VerificationVerified
+	default:
+		rec.Verification = VerificationMismatch
+	}
+	return rec, nil
+}
@@ -0,0 +1,127 @@
+package stargzget
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func readProvenance(t *testing.T, data []byte) []ProvenanceRecord {
+	t.Helper()
+	var records []ProvenanceRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var rec ProvenanceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid provenance line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+	return records
+}
+
+func TestDownloader_Provenance(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(4096)).
+		File("bin/app", big).
+		File("etc/app.conf", []byte("debug = false\n")).
+		MustBuild()
+	store := storage.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	resolver := NewBlobResolver(store)
+
+	dir := t.TempDir()
+	var jobs []*DownloadJob
+	for path, size := range map[string]int64{"bin/app": int64(len(big)), "etc/app.conf": 14} {
+		jobs = append(jobs, &DownloadJob{Path: path, BlobDigest: layer.Digest, Size: size, OutputPath: filepath.Join(dir, path)})
+	}
+
+	var log bytes.Buffer
+	imageDigest := digest.FromString("manifest")
+	opts := &DownloadOptions{Provenance: &ProvenanceOptions{Writer: &log, Image: "registry.example/app:v1", ImageDigest: imageDigest}}
+	if _, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, opts); err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+
+	records := readProvenance(t, log.Bytes())
+	if len(records) != 2 {
+		t.Fatalf("got %d provenance records, want 2:\n%s", len(records), log.String())
+	}
+	app := records[0]
+	if app.Path != "bin/app" || app.Image != "registry.example/app:v1" || app.ImageDigest != imageDigest.String() || app.LayerDigest != layer.Digest.String() {
+		t.Errorf("record identity = %+v", app)
+	}
+	if want := digest.FromBytes(big).String(); app.EntryDigest != want || app.ContentDigest != want || app.Verification != VerificationVerified {
+		t.Errorf("record verification = entry %s, content %s, %s; want %s verified", app.EntryDigest, app.ContentDigest, app.Verification, want)
+	}
+	if len(app.Ranges) != 3 {
+		t.Errorf("Ranges = %+v, want 3 chunks", app.Ranges)
+	}
+	var covered int64
+	for _, r := range app.Ranges {
+		covered += r.Size
+	}
+	if covered != int64(len(big)) || app.Attempts != 1 || app.CompletedAt.Before(app.StartedAt) {
+		t.Errorf("record = %+v, want ranges covering %d bytes, 1 attempt and ordered timestamps", app, len(big))
+	}
+	if records[1].Path != "etc/app.conf" || records[1].Verification != VerificationVerified {
+		t.Errorf("second record = %+v, want etc/app.conf verified", records[1])
+	}
+}
+
+func TestDownloader_ProvenanceDigestMismatch(t *testing.T) {
+	store := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	content := []byte("tampered")
+	dgst := addFileToStorage(t, store, resolver, "bin/tool", content, 0)
+	resolver.metadata[dgst]["bin/tool"].Digest = digest.FromString("original").String()
+	resolver.addFile(dgst, "bin/plain", &FileMetadata{Size: int64(len(content)), Chunks: resolver.metadata[dgst]["bin/tool"].Chunks})
+
+	dir := t.TempDir()
+	jobs := []*DownloadJob{
+		{Path: "bin/tool", BlobDigest: dgst, Size: int64(len(content)), OutputPath: filepath.Join(dir, "tool")},
+		{Path: "bin/plain", BlobDigest: dgst, Size: int64(len(content)), OutputPath: filepath.Join(dir, "plain")},
+	}
+
+	var log bytes.Buffer
+	var mismatches []Warning
+	opts := &DownloadOptions{
+		Concurrency: 1,
+		Provenance:  &ProvenanceOptions{Writer: &log},
+		OnWarning: func(w Warning) {
+			if w.Kind == WarningDigestMismatch {
+				mismatches = append(mismatches, w)
+			}
+		},
+	}
+	stats, err := NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, opts)
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	if stats.DownloadedFiles != 2 {
+		t.Errorf("DownloadedFiles = %d, want 2", stats.DownloadedFiles)
+	}
+
+	records := readProvenance(t, log.Bytes())
+	if len(records) != 2 {
+		t.Fatalf("got %d provenance records, want 2", len(records))
+	}
+	if records[0].Path != "bin/plain" || records[0].Verification != VerificationUnverified || records[0].ContentDigest != digest.FromBytes(content).String() {
+		t.Errorf("record without TOC digest = %+v, want unverified with the content digest", records[0])
+	}
+	if records[1].Path != "bin/tool" || records[1].Verification != VerificationMismatch {
+		t.Errorf("record with wrong TOC digest = %+v, want mismatch", records[1])
+	}
+	if len(mismatches) != 1 || mismatches[0].Path != "bin/tool" {
+		t.Errorf("digest mismatch warnings = %v, want one for bin/tool", mismatches)
+	}
+}
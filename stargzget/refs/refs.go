@@ -0,0 +1,136 @@
+// Package refs parses and formats image references such as
+// "ghcr.io/org/app:v1", "localhost:5000/app@sha256:..." or
+// "r.example/app:v1@sha256:...". Every part of starget that takes an image
+// reference goes through Parse, so they agree on what a reference means.
+package refs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DockerHub is the registry host Docker Hub references are stored under.
+const DockerHub = "docker.io"
+
+var (
+	// repositoryPattern matches repository paths: lowercase components
+	// separated by "/", each of alphanumerics joined by ".", "_", "__" or
+	// runs of "-", as in the distribution spec.
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// Reference is a parsed image reference. A reference names a tag, a
+// digest or both; when it has both, the digest identifies the manifest and
+// the tag is informational.
+type Reference struct {
+	Registry   string        // Registry host, with its port if any
+	Repository string        // Repository path within the registry
+	Tag        string        // Tag; empty if the reference only has a digest
+	Digest     digest.Digest // Manifest digest; empty if the reference only has a tag
+}
+
+// dockerHubAliases are other names of Docker Hub's registry, stored as
+// DockerHub.
+var dockerHubAliases = map[string]bool{
+	"index.docker.io":         true,
+	"registry-1.docker.io":    true,
+	"registry.hub.docker.com": true,
+}
+
+// Parse parses [REGISTRY/]REPOSITORY[:TAG][@DIGEST]. The part before the
+// first "/" is the registry host when it looks like one, as the docker CLI
+// decides: it holds a "." or a ":" (so a port there is never taken for a
+// tag), is "localhost", or has uppercase letters. Otherwise the reference is
+// a Docker Hub short name such as "ubuntu:22.04" or "org/app:v1", stored
+// with DockerHub as its registry and, for official images, the "library/"
+// prefix. Docker Hub's aliases, such as index.docker.io, become DockerHub
+// too. A reference needs a tag, a digest or both.
+func Parse(s string) (Reference, error) {
+	var ref Reference
+	rest := s
+	if i := strings.Index(rest, "@"); i >= 0 {
+		dgst, err := digest.Parse(rest[i+1:])
+		if err != nil {
+			return Reference{}, fmt.Errorf("invalid digest in image ref %s: %w", s, err)
+		}
+		ref.Digest, rest = dgst, rest[:i]
+	}
+
+	registry, path, ok := strings.Cut(rest, "/")
+	if !ok || !isRegistryHost(registry) {
+		registry, path = DockerHub, rest
+	}
+	if dockerHubAliases[registry] {
+		registry = DockerHub
+	}
+	ref.Registry = registry
+	// The registry is split off, so any ":" left starts the tag.
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		path, ref.Tag = path[:i], path[i+1:]
+		if !tagPattern.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("invalid tag %q in image ref %s", ref.Tag, s)
+		}
+	}
+	if !repositoryPattern.MatchString(path) {
+		return Reference{}, fmt.Errorf("invalid repository %q in image ref %s", path, s)
+	}
+	if registry == DockerHub && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	ref.Repository = path
+	if ref.Tag == "" && ref.Digest == "" {
+		return Reference{}, fmt.Errorf("missing tag in image ref: %s", s)
+	}
+	return ref, nil
+}
+
+// isRegistryHost reports whether the first component of a reference names
+// a registry rather than the first part of a Docker Hub repository.
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost" || strings.ToLower(component) != component
+}
+
+// Name returns REGISTRY/REPOSITORY.
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// Identifier returns what the registry's manifest endpoint is asked for:
+// the digest if there is one, otherwise the tag.
+func (r Reference) Identifier() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+// String returns the reference in canonical form, registry included.
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// Familiar returns the reference the way the docker CLI shows it: Docker
+// Hub references lose the registry, and official images their "library/"
+// prefix. Other references are returned as String does.
+func (r Reference) Familiar() string {
+	s := r.String()
+	if r.Registry != DockerHub {
+		return s
+	}
+	s = strings.TrimPrefix(s, DockerHub+"/")
+	if rest, ok := strings.CutPrefix(s, "library/"); ok && !strings.Contains(r.Repository[len("library/"):], "/") {
+		s = rest
+	}
+	return s
+}
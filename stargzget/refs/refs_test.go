@@ -0,0 +1,109 @@
+package refs
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const testDigest = "sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Reference
+	}{
+		{"ghcr.io/org/app:v1", Reference{Registry: "ghcr.io", Repository: "org/app", Tag: "v1"}},
+		{"localhost:5000/app:latest", Reference{Registry: "localhost:5000", Repository: "app", Tag: "latest"}},
+		{"127.0.0.1:5000/a/b/c:1.0_rc-1", Reference{Registry: "127.0.0.1:5000", Repository: "a/b/c", Tag: "1.0_rc-1"}},
+		{"localhost:5000/app@" + testDigest, Reference{Registry: "localhost:5000", Repository: "app", Digest: testDigest}},
+		{"r.example/app:v1@" + testDigest, Reference{Registry: "r.example", Repository: "app", Tag: "v1", Digest: testDigest}},
+		{"docker.io/library/ubuntu:22.04", Reference{Registry: "docker.io", Repository: "library/ubuntu", Tag: "22.04"}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if got.String() != tt.in {
+			t.Errorf("Parse(%q).String() = %q, want the input back", tt.in, got.String())
+		}
+	}
+}
+
+func TestParse_DockerHub(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"ubuntu:22.04", "docker.io/library/ubuntu:22.04"},
+		{"ubuntu@" + testDigest, "docker.io/library/ubuntu@" + testDigest},
+		{"org/app:v1", "docker.io/org/app:v1"},
+		{"docker.io/ubuntu:22.04", "docker.io/library/ubuntu:22.04"},
+		{"index.docker.io/library/ubuntu:22.04", "docker.io/library/ubuntu:22.04"},
+		{"registry-1.docker.io/org/app:v1", "docker.io/org/app:v1"},
+		{"localhost/app:v1", "localhost/app:v1"},
+		{"Registry/app:v1", "Registry/app:v1"},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, in := range []string{
+		"ubuntu",                      // no tag
+		"localhost:5000/app",          // no tag or digest
+		"r.example/app:",              // empty tag
+		"r.example/App:v1",            // uppercase repository
+		"r.example/app:v1@sha256:abc", // malformed digest
+		"r.example//app:v1",
+		"/app:v1",
+		"r.example/app:v:1",
+	} {
+		if ref, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", in, ref)
+		}
+	}
+}
+
+func TestReference_Identifier(t *testing.T) {
+	tagged := Reference{Registry: "r.example", Repository: "app", Tag: "v1"}
+	if got := tagged.Identifier(); got != "v1" {
+		t.Errorf("Identifier() = %q, want the tag", got)
+	}
+	pinned := Reference{Registry: "r.example", Repository: "app", Tag: "v1", Digest: digest.Digest(testDigest)}
+	if got := pinned.Identifier(); got != testDigest {
+		t.Errorf("Identifier() = %q, want the digest", got)
+	}
+}
+
+func TestReference_Familiar(t *testing.T) {
+	tests := map[string]string{
+		"docker.io/library/ubuntu:22.04":         "ubuntu:22.04",
+		"docker.io/library/team/tool:v1":         "library/team/tool:v1",
+		"docker.io/bitnami/redis:7":              "bitnami/redis:7",
+		"ghcr.io/library/app:v1":                 "ghcr.io/library/app:v1",
+		"docker.io/library/alpine@" + testDigest: "alpine@" + testDigest,
+	}
+	for in, want := range tests {
+		ref, err := Parse(in)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", in, err)
+		}
+		if got := ref.Familiar(); got != want {
+			t.Errorf("Familiar(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
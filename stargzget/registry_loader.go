@@ -0,0 +1,112 @@
+package stargzget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+const defaultLoadConcurrency = 4
+
+// RegistryIndexLoader loads image indexes straight from image references.
+// All images share one RemoteRegistryStorage, so credentials and bearer
+// tokens obtained for a repository are reused by every image in it.
+type RegistryIndexLoader struct {
+	client       *stor.RemoteRegistryStorage
+	concurrency  int
+	resolverOpts []BlobResolverOption
+}
+
+// NewRegistryIndexLoader returns a loader that fetches at most concurrency
+// images at a time (default 4). resolverOpts are applied to the BlobResolver
+// created for each image.
+func NewRegistryIndexLoader(client *stor.RemoteRegistryStorage, concurrency int, resolverOpts ...BlobResolverOption) *RegistryIndexLoader {
+	if concurrency <= 0 {
+		concurrency = defaultLoadConcurrency
+	}
+	return &RegistryIndexLoader{
+		client:       client,
+		concurrency:  concurrency,
+		resolverOpts: resolverOpts,
+	}
+}
+
+// Load resolves the manifest of ref and builds its index.
+func (l *RegistryIndexLoader) Load(ctx context.Context, ref string) (*ImageIndex, error) {
+	parsed, err := refs.Parse(ref)
+	if err != nil {
+		return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", ref).WithCause(err)
+	}
+
+	manifest, err := l.client.GetManifest(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := l.client.NewStorage(parsed.Registry, parsed.Repository, manifest)
+	resolver := NewBlobResolver(storage, l.resolverOpts...)
+	index, err := NewBlobIndexLoader(storage, resolver).Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	index.ManifestDigest = manifest.Digest
+	return index, nil
+}
+
+// LoadAll loads the indexes of refs concurrently. The returned map holds
+// every image that loaded; if any failed, the error joins the failures, each
+// tagged with its image reference, so callers can still use partial results.
+func (l *RegistryIndexLoader) LoadAll(ctx context.Context, refs []string) (map[string]*ImageIndex, error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		indexes = make(map[string]*ImageIndex, len(refs))
+		errs    []error
+		sem     = make(chan struct{}, l.concurrency)
+		seen    = make(map[string]bool, len(refs))
+	)
+
+	for _, ref := range refs {
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			errs = append(errs, ctx.Err())
+			mu.Unlock()
+			wg.Wait()
+			return indexes, errors.Join(errs...)
+		}
+
+		wg.Add(1)
+		go func(ref string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			index, err := l.Load(ctx, ref)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, stargzerrors.ErrManifestFetch.
+					WithMessage(fmt.Sprintf("failed to load image index for %s", ref)).
+					WithDetail("imageRef", ref).
+					WithCause(err))
+				return
+			}
+			indexes[ref] = index
+		}(ref)
+	}
+
+	wg.Wait()
+	return indexes, errors.Join(errs...)
+}
@@ -0,0 +1,128 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeRegistry serves one single-layer image per repository behind bearer
+// auth with repository-scoped tokens.
+type fakeRegistry struct {
+	layers map[string][]byte // repository -> layer blob
+
+	mu            sync.Mutex
+	tokenRequests map[string]int
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		scope := r.URL.Query().Get("scope")
+		repo := strings.TrimSuffix(strings.TrimPrefix(scope, "repository:"), ":pull")
+		f.mu.Lock()
+		f.tokenRequests[repo]++
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"token": "token-" + repo})
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var repo, kind string
+	for _, k := range []string{"/manifests/", "/blobs/"} {
+		if idx := strings.Index(rest, k); idx != -1 {
+			repo, kind = rest[:idx], k
+			break
+		}
+	}
+	layer, ok := f.layers[repo]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer token-"+repo {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake",scope="repository:%s:pull"`, r.Host, repo))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch kind {
+	case "/manifests/":
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		json.NewEncoder(w).Encode(stor.Manifest{
+			SchemaVersion: 2,
+			MediaType:     "application/vnd.oci.image.manifest.v1+json",
+			Layers: []stor.Layer{{
+				MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+				Digest:    digest.FromBytes(layer).String(),
+				Size:      int64(len(layer)),
+			}},
+		})
+	case "/blobs/":
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(layer))
+	}
+}
+
+func TestRegistryIndexLoader_LoadAll(t *testing.T) {
+	registry := &fakeRegistry{
+		layers: map[string][]byte{
+			"team/app":    loadTestLayer(t, "000001"),
+			"team/worker": loadTestLayer(t, "000002"),
+		},
+		tokenRequests: make(map[string]int),
+	}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	refs := []string{
+		host + "/team/app:v1",
+		host + "/team/worker:v1",
+		host + "/team/app:v1", // duplicates are loaded once
+		host + "/team/missing:v1",
+	}
+
+	loader := NewRegistryIndexLoader(stor.NewRemoteRegistryStorage(false), 2)
+	indexes, err := loader.LoadAll(context.Background(), refs)
+	if err == nil {
+		t.Fatalf("LoadAll() expected error for missing image")
+	}
+	if !strings.Contains(err.Error(), "team/missing") {
+		t.Fatalf("LoadAll() error = %v, want it to name the missing image", err)
+	}
+
+	if len(indexes) != 2 {
+		t.Fatalf("indexes len = %d, want 2", len(indexes))
+	}
+	for _, ref := range refs[:2] {
+		index, ok := indexes[ref]
+		if !ok {
+			t.Fatalf("missing index for %s", ref)
+		}
+		if len(index.AllFiles()) == 0 {
+			t.Fatalf("index for %s has no files", ref)
+		}
+	}
+
+	// Each repository authenticates once; its token is reused for the
+	// manifest and every blob range request.
+	for repo, n := range registry.tokenRequests {
+		if repo != "team/missing" && n != 1 {
+			t.Fatalf("token requests for %s = %d, want 1", repo, n)
+		}
+	}
+}
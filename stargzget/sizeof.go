@@ -0,0 +1,109 @@
+package stargzget
+
+import (
+	"context"
+	"sort"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// SizeEstimate summarizes what extracting a set of files would cost.
+type SizeEstimate struct {
+	Files             int   // Regular files counted
+	UncompressedBytes int64 // Total size of the files once extracted
+	CompressedBytes   int64 // Estimated bytes read from the blobs
+}
+
+// EstimateSize adds up the sizes of the regular files in files using only
+// their TOCs; nothing but the TOCs is fetched. Non-regular entries are not
+// counted.
+//
+// The compressed size is an estimate: each gzip member spans from its offset
+// to the next member's, and that span is split among the chunks it holds in
+// proportion to their uncompressed size. The TOC does not record where the
+// last member ends, so its span is extrapolated from the blob's other
+// members.
+func EstimateSize(ctx context.Context, resolver BlobResolver, files []*FileInfo) (*SizeEstimate, error) {
+	estimate := &SizeEstimate{}
+	layouts := make(map[digest.Digest]*blobLayout)
+
+	for _, file := range files {
+		if !file.IsRegular() {
+			continue
+		}
+
+		layout, ok := layouts[file.BlobDigest]
+		if !ok {
+			toc, err := resolver.TOC(ctx, file.BlobDigest)
+			if err != nil {
+				return nil, err
+			}
+			layout = newBlobLayout(toc)
+			layouts[file.BlobDigest] = layout
+		}
+
+		estimate.Files++
+		estimate.UncompressedBytes += file.Size
+		for _, chunk := range layout.files[file.Path].Chunks {
+			estimate.CompressedBytes += layout.compressedSize(chunk)
+		}
+	}
+
+	return estimate, nil
+}
+
+// blobLayout maps a blob's chunks to the gzip members holding them.
+type blobLayout struct {
+	files        map[string]estargzutil.FileEntry
+	uncompressed map[int64]int64 // Member offset -> uncompressed bytes of the chunks in it
+	span         map[int64]int64 // Member offset -> compressed bytes up to the next member
+}
+
+func newBlobLayout(toc *estargzutil.JTOC) *blobLayout {
+	layout := &blobLayout{
+		files:        toc.FileEntries(),
+		uncompressed: make(map[int64]int64),
+		span:         make(map[int64]int64),
+	}
+	for _, entry := range layout.files {
+		for _, chunk := range entry.Chunks {
+			if chunk.Size > 0 {
+				layout.uncompressed[chunk.CompressedOffset] += chunk.Size
+			}
+		}
+	}
+
+	offsets := make([]int64, 0, len(layout.uncompressed))
+	for offset := range layout.uncompressed {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var spanned, spannedUncompressed int64
+	for i := 0; i+1 < len(offsets); i++ {
+		span := offsets[i+1] - offsets[i]
+		layout.span[offsets[i]] = span
+		spanned += span
+		spannedUncompressed += layout.uncompressed[offsets[i]]
+	}
+	if n := len(offsets); n > 0 {
+		last := offsets[n-1]
+		// Without other members to learn from, assume no compression.
+		layout.span[last] = layout.uncompressed[last]
+		if spannedUncompressed > 0 {
+			layout.span[last] = layout.uncompressed[last] * spanned / spannedUncompressed
+		}
+	}
+	return layout
+}
+
+// compressedSize returns the share of its member's compressed span that
+// chunk accounts for.
+func (l *blobLayout) compressedSize(chunk estargzutil.Chunk) int64 {
+	total := l.uncompressed[chunk.CompressedOffset]
+	if total <= 0 {
+		return 0
+	}
+	return l.span[chunk.CompressedOffset] * chunk.Size / total
+}
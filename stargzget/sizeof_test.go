@@ -0,0 +1,46 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestEstimateSize(t *testing.T) {
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(1024)).
+		File("usr/share/doc/a.txt", bytes.Repeat([]byte("a"), 4096)).
+		File("usr/share/doc/b.txt", bytes.Repeat([]byte("b"), 100)).
+		File("usr/share/doc/empty", nil).
+		Symlink("usr/share/doc/link", "a.txt").
+		File("usr/bin/tool", bytes.Repeat([]byte("tool"), 512)).
+		MustBuild()
+
+	store := storage.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	resolver := NewBlobResolver(store)
+	index, err := NewBlobIndexLoader(store, resolver).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	files := index.FilterFiles("usr/share/doc", layer.Digest)
+	estimate, err := EstimateSize(context.Background(), resolver, files)
+	if err != nil {
+		t.Fatalf("EstimateSize() error = %v", err)
+	}
+
+	if estimate.Files != 3 {
+		t.Fatalf("Files = %d, want 3", estimate.Files)
+	}
+	if estimate.UncompressedBytes != 4196 {
+		t.Fatalf("UncompressedBytes = %d, want 4196", estimate.UncompressedBytes)
+	}
+	// Repetitive content compresses well, but every member carries gzip
+	// framing, so the estimate must be positive and well under the blob.
+	if estimate.CompressedBytes <= 0 || estimate.CompressedBytes >= int64(len(layer.Blob)) {
+		t.Fatalf("CompressedBytes = %d, want within (0, %d)", estimate.CompressedBytes, len(layer.Blob))
+	}
+}
@@ -0,0 +1,11 @@
+// Package sqlindex keeps the indexes of many images in one SQLite database,
+// for tools that index whole fleets. Layer TOCs are stored once however
+// many images share them, and the merged file list of every image is kept
+// in a table that can be queried across images, e.g. for every image that
+// contains usr/bin/log4j*.
+//
+// It is only built with the sqlite build tag, which keeps the SQLite driver
+// out of default builds:
+//
+//	go build -tags sqlite ./cmd/starget
+package sqlindex
@@ -0,0 +1,512 @@
+//go:build sqlite
+
+package sqlindex
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+	_ "modernc.org/sqlite"
+)
+
+// schemaVersion is stored in the database's user_version pragma. Version 2
+// added the file metadata columns that ls and stat read.
+const schemaVersion = 2
+
+const schema = `
+CREATE TABLE IF NOT EXISTS images (
+	id              INTEGER PRIMARY KEY,
+	ref             TEXT NOT NULL UNIQUE,
+	manifest_digest TEXT NOT NULL,
+	indexed_at      INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS layers (
+	digest TEXT PRIMARY KEY,
+	toc    BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS image_layers (
+	image_id     INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+	position     INTEGER NOT NULL,
+	layer_digest TEXT NOT NULL REFERENCES layers(digest),
+	PRIMARY KEY (image_id, position)
+);
+CREATE TABLE IF NOT EXISTS files (
+	image_id     INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+	path         TEXT NOT NULL,
+	layer_digest TEXT NOT NULL,
+	type         TEXT NOT NULL,
+	size         INTEGER NOT NULL,
+	digest       TEXT NOT NULL,
+	mode         INTEGER NOT NULL,
+	uid          INTEGER NOT NULL,
+	gid          INTEGER NOT NULL,
+	link_name    TEXT NOT NULL,
+	mod_time     INTEGER,
+	PRIMARY KEY (image_id, path)
+);
+CREATE INDEX IF NOT EXISTS files_path ON files(path);
+CREATE INDEX IF NOT EXISTS files_digest ON files(digest);
+`
+
+// DB is an index database. Its methods are safe for concurrent use.
+type DB struct {
+	db *sql.DB
+}
+
+// Open opens the index database at path for adding images, creating it if
+// it does not exist.
+func Open(path string) (*DB, error) {
+	return open(path, "rwc")
+}
+
+// OpenReadOnly opens an existing index database for queries only, so
+// several readers can share a database another process keeps up to date.
+func OpenReadOnly(path string) (*DB, error) {
+	// SQLite reports a missing file as "out of memory"; say what happened.
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return open(path, "ro")
+}
+
+func open(path, mode string) (*DB, error) {
+	// SQLite parses the file: URI itself, so the path is escaped to keep a
+	// '?', '#' or '%' in it from being read as the query or a fragment.
+	dsn := url.URL{
+		Scheme:   "file",
+		OmitHost: true,
+		Path:     path,
+		RawQuery: "mode=" + mode + "&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)",
+	}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db, mode == "ro"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("index database %s: %w", path, err)
+	}
+	return &DB{db: db}, nil
+}
+
+// migrate creates the schema of a new database and rejects databases
+// written by an incompatible version.
+func migrate(db *sql.DB, readOnly bool) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	switch {
+	case version == schemaVersion:
+		return nil
+	case version != 0 && version < schemaVersion:
+		return fmt.Errorf("schema version %d is too old (want %d); add the images to a new database", version, schemaVersion)
+	case version != 0:
+		return fmt.Errorf("unsupported schema version %d (want %d)", version, schemaVersion)
+	case readOnly:
+		return fmt.Errorf("not an index database")
+	}
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	_, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
+	return err
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Add stores the index of the image ref, replacing what was stored for ref
+// before. The index must come from BlobIndexLoader, or otherwise have its
+// layers' TOCs, and record the manifest digest it was built for.
+func (d *DB) Add(ctx context.Context, ref string, index *stargzget.ImageIndex) error {
+	if index.ManifestDigest == "" {
+		return fmt.Errorf("index of %s has no manifest digest", ref)
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM images WHERE ref = ?`, ref); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO images (ref, manifest_digest, indexed_at) VALUES (?, ?, ?)`,
+		ref, index.ManifestDigest.String(), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	imageID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	// Content digests come from the TOC entries, which the merged view
+	// does not keep.
+	fileDigests := make(map[digest.Digest]map[string]string, len(index.Layers))
+	for i, layer := range index.Layers {
+		toc := layer.TOC()
+		if toc == nil {
+			return fmt.Errorf("layer %s has no TOC to store", layer.BlobDigest)
+		}
+		data, err := json.Marshal(toc)
+		if err != nil {
+			return err
+		}
+		// Layers are content addressed, so a stored TOC never changes.
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO layers (digest, toc) VALUES (?, ?)`, layer.BlobDigest.String(), data); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO image_layers (image_id, position, layer_digest) VALUES (?, ?, ?)`, imageID, i, layer.BlobDigest.String()); err != nil {
+			return err
+		}
+		digests := make(map[string]string, len(toc.Entries))
+		for _, entry := range toc.Entries {
+			if entry != nil && entry.Digest != "" {
+				digests[entry.Name] = entry.Digest
+			}
+		}
+		fileDigests[layer.BlobDigest] = digests
+	}
+
+	insert, err := tx.PrepareContext(ctx, `INSERT INTO files (image_id, path, layer_digest, type, size, digest, mode, uid, gid, link_name, mod_time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, path := range index.AllFiles() {
+		info, err := index.FindFile(path, "")
+		if err != nil {
+			return err
+		}
+		fileType := info.Type
+		if fileType == "" {
+			fileType = "reg"
+		}
+		var modTime sql.NullInt64
+		if !info.ModTime.IsZero() {
+			modTime = sql.NullInt64{Int64: info.ModTime.UnixNano(), Valid: true}
+		}
+		if _, err := insert.ExecContext(ctx, imageID, path, info.BlobDigest.String(), fileType, info.Size, fileDigests[info.BlobDigest][path],
+			unixMode(info.Mode), info.UID, info.GID, info.LinkName, modTime); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// image returns the row ID and manifest digest stored for ref. It fails
+// with ErrImageNotIndexed when ref was never added.
+func (d *DB) image(ctx context.Context, ref string) (int64, digest.Digest, error) {
+	var imageID int64
+	var manifestDigest string
+	err := d.db.QueryRowContext(ctx, `SELECT id, manifest_digest FROM images WHERE ref = ?`, ref).Scan(&imageID, &manifestDigest)
+	if err == sql.ErrNoRows {
+		return 0, "", stargzerrors.ErrImageNotIndexed.WithDetail("image", ref)
+	}
+	return imageID, digest.Digest(manifestDigest), err
+}
+
+// currentImage is image for the queries that skip the TOCs: it also fails
+// with ErrIndexStale when manifest is not the one ref was added with.
+func (d *DB) currentImage(ctx context.Context, ref string, manifest *stor.Manifest) (int64, error) {
+	imageID, manifestDigest, err := d.image(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+	if manifest.Digest != manifestDigest {
+		return 0, stargzerrors.ErrIndexStale.
+			WithDetail("indexManifest", manifestDigest.String()).
+			WithDetail("imageManifest", manifest.Digest.String())
+	}
+	return imageID, nil
+}
+
+// Index rebuilds the stored index of the image ref and checks it against
+// the image's current manifest, failing with ErrIndexStale when the image
+// changed since it was added. It fails with ErrImageNotIndexed when ref
+// was never added. Every layer's TOC is decoded, which downloads need;
+// Files, Stat and LayerIndex answer listings from the tables instead.
+func (d *DB) Index(ctx context.Context, ref string, manifest *stor.Manifest) (*stargzget.ImageIndex, error) {
+	imageID, manifestDigest, err := d.image(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT l.digest, l.toc FROM image_layers il JOIN layers l ON l.digest = il.layer_digest
+		WHERE il.image_id = ? ORDER BY il.position`, imageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var layers []stargzget.LayerTOC
+	for rows.Next() {
+		var blobDigest string
+		var data []byte
+		if err := rows.Scan(&blobDigest, &data); err != nil {
+			return nil, err
+		}
+		var toc estargzutil.JTOC
+		if err := json.Unmarshal(data, &toc); err != nil {
+			return nil, fmt.Errorf("stored TOC of layer %s: %w", blobDigest, err)
+		}
+		layers = append(layers, stargzget.LayerTOC{BlobDigest: digest.Digest(blobDigest), TOC: &toc})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	index := stargzget.NewImageIndexFromTOCs(manifestDigest, layers)
+	if err := index.CheckManifest(manifest); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Images lists the stored images by reference.
+func (d *DB) Images(ctx context.Context) ([]Image, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT i.ref, i.manifest_digest, i.indexed_at, (SELECT COUNT(*) FROM files f WHERE f.image_id = i.id)
+		FROM images i ORDER BY i.ref`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var images []Image
+	for rows.Next() {
+		var image Image
+		var manifestDigest string
+		var indexedAt int64
+		if err := rows.Scan(&image.Ref, &manifestDigest, &indexedAt, &image.Files); err != nil {
+			return nil, err
+		}
+		image.ManifestDigest = digest.Digest(manifestDigest)
+		image.IndexedAt = time.Unix(indexedAt, 0)
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// Image is an image stored in the database.
+type Image struct {
+	Ref            string
+	ManifestDigest digest.Digest
+	IndexedAt      time.Time
+	Files          int // Files in the image's merged view
+}
+
+// Match is a file found by Search.
+type Match struct {
+	Image          string
+	ManifestDigest digest.Digest
+	Path           string
+	BlobDigest     digest.Digest // Layer the file comes from in the merged view
+	Type           string
+	Size           int64
+	Digest         string // Content digest from the TOC; empty for non-regular files
+}
+
+// Query selects files for Search. Empty fields match everything.
+type Query struct {
+	// Pattern is a glob over file paths as in path.Match ('*' also matches
+	// '/'). A leading slash is ignored, since paths are stored without it.
+	Pattern string
+	// Digest matches the content digest of files.
+	Digest string
+	// Layer matches files the merged view takes from this layer.
+	Layer digest.Digest
+}
+
+// where returns the SQL conditions on the files table f selecting q, with
+// their arguments.
+func (q Query) where() ([]string, []any) {
+	var where []string
+	var args []any
+	if q.Pattern != "" {
+		where = append(where, "f.path GLOB ?")
+		args = append(args, strings.TrimPrefix(q.Pattern, "/"))
+	}
+	if q.Digest != "" {
+		where = append(where, "f.digest = ?")
+		args = append(args, q.Digest)
+	}
+	if q.Layer != "" {
+		where = append(where, "f.layer_digest = ?")
+		args = append(args, q.Layer.String())
+	}
+	return where, args
+}
+
+// Search returns the files that match q in every stored image, ordered by
+// image and path. Files deleted by a later layer's whiteouts are not
+// matched, since only the merged view of each image is stored.
+func (d *DB) Search(ctx context.Context, q Query) ([]Match, error) {
+	where, args := q.where()
+	query := `SELECT i.ref, i.manifest_digest, f.path, f.layer_digest, f.type, f.size, f.digest
+		FROM files f JOIN images i ON i.id = f.image_id`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY i.ref, f.path"
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var matches []Match
+	for rows.Next() {
+		var m Match
+		var manifestDigest, blobDigest string
+		if err := rows.Scan(&m.Image, &manifestDigest, &m.Path, &blobDigest, &m.Type, &m.Size, &m.Digest); err != nil {
+			return nil, err
+		}
+		m.ManifestDigest = digest.Digest(manifestDigest)
+		m.BlobDigest = digest.Digest(blobDigest)
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// fileColumns are the files columns scanFile reads, in order.
+const fileColumns = `f.path, f.layer_digest, f.type, f.size, f.mode, f.uid, f.gid, f.link_name, f.mod_time`
+
+func scanFile(row interface{ Scan(...any) error }) (*stargzget.FileInfo, error) {
+	var info stargzget.FileInfo
+	var blobDigest string
+	var mode int64
+	var modTime sql.NullInt64
+	if err := row.Scan(&info.Path, &blobDigest, &info.Type, &info.Size, &mode, &info.UID, &info.GID, &info.LinkName, &modTime); err != nil {
+		return nil, err
+	}
+	info.BlobDigest = digest.Digest(blobDigest)
+	info.Mode = fileMode(mode)
+	if modTime.Valid {
+		info.ModTime = time.Unix(0, modTime.Int64)
+	}
+	return &info, nil
+}
+
+// Files returns the files of ref's merged view that match q, ordered by
+// path, from the files table alone: no TOC is decoded, so listing an image
+// costs the same however large its layers are. It fails with
+// ErrImageNotIndexed when ref was never added and ErrIndexStale when
+// manifest is not the one it was added with.
+func (d *DB) Files(ctx context.Context, ref string, manifest *stor.Manifest, q Query) ([]*stargzget.FileInfo, error) {
+	imageID, err := d.currentImage(ctx, ref, manifest)
+	if err != nil {
+		return nil, err
+	}
+	where, args := q.where()
+	query := `SELECT ` + fileColumns + ` FROM files f WHERE f.image_id = ?`
+	for _, cond := range where {
+		query += " AND " + cond
+	}
+	query += " ORDER BY f.path"
+
+	rows, err := d.db.QueryContext(ctx, query, append([]any{imageID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []*stargzget.FileInfo
+	for rows.Next() {
+		info, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, info)
+	}
+	return files, rows.Err()
+}
+
+// Stat returns the file at path in ref's merged view from the files table,
+// failing with ErrFileNotFound when there is none and otherwise like Files.
+func (d *DB) Stat(ctx context.Context, ref string, manifest *stor.Manifest, path string) (*stargzget.FileInfo, error) {
+	imageID, err := d.currentImage(ctx, ref, manifest)
+	if err != nil {
+		return nil, err
+	}
+	path = strings.TrimPrefix(path, "/")
+	row := d.db.QueryRowContext(ctx, `SELECT `+fileColumns+` FROM files f WHERE f.image_id = ? AND f.path = ?`, imageID, path)
+	info, err := scanFile(row)
+	if err == sql.ErrNoRows {
+		return nil, stargzerrors.ErrFileNotFound.WithDetail("path", path)
+	}
+	return info, err
+}
+
+// LayerIndex returns an index holding only the layer blobDigest of ref,
+// decoding that one TOC, for callers that need a layer's full entries (its
+// overridden files, chunks for reading content) without loading the whole
+// image. It fails with ErrBlobNotFound when ref has no such layer and
+// otherwise like Files.
+func (d *DB) LayerIndex(ctx context.Context, ref string, manifest *stor.Manifest, blobDigest digest.Digest) (*stargzget.ImageIndex, error) {
+	imageID, err := d.currentImage(ctx, ref, manifest)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = d.db.QueryRowContext(ctx, `
+		SELECT l.toc FROM image_layers il JOIN layers l ON l.digest = il.layer_digest
+		WHERE il.image_id = ? AND il.layer_digest = ?`, imageID, blobDigest.String()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, stargzerrors.ErrBlobNotFound.WithDetail("blobDigest", blobDigest.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	var toc estargzutil.JTOC
+	if err := json.Unmarshal(data, &toc); err != nil {
+		return nil, fmt.Errorf("stored TOC of layer %s: %w", blobDigest, err)
+	}
+	return stargzget.NewImageIndexFromTOCs(manifest.Digest, []stargzget.LayerTOC{{BlobDigest: blobDigest, TOC: &toc}}), nil
+}
+
+// unixMode stores fm as unix mode bits, so SQL queries can test e.g.
+// mode & 2048 for setuid files.
+func unixMode(fm os.FileMode) int64 {
+	mode := int64(fm.Perm())
+	if fm&os.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if fm&os.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if fm&os.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return mode
+}
+
+// fileMode is the inverse of unixMode.
+func fileMode(mode int64) os.FileMode {
+	fm := os.FileMode(mode) & os.ModePerm
+	if mode&0o4000 != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		fm |= os.ModeSticky
+	}
+	return fm
+}
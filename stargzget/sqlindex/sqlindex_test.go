@@ -0,0 +1,213 @@
+//go:build sqlite
+
+package sqlindex
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget"
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+const layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+// loadImage indexes an image made of layers, bottom layer first.
+func loadImage(t *testing.T, name string, layers ...[]byte) (*stargzget.ImageIndex, *stor.Manifest) {
+	t.Helper()
+	storage := stor.NewMockStorage()
+	manifest := &stor.Manifest{Digest: digest.FromString(name)}
+	for _, blob := range layers {
+		dgst := storage.AddBlob(layerType, blob)
+		manifest.Layers = append(manifest.Layers, stor.Layer{MediaType: layerType, Digest: dgst.String(), Size: int64(len(blob))})
+	}
+	index, err := stargzget.NewBlobIndexLoader(storage, stargzget.NewBlobResolver(storage)).Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	index.ManifestDigest = manifest.Digest
+	return index, manifest
+}
+
+func TestDB_AddSearchIndex(t *testing.T) {
+	ctx := context.Background()
+	base := estargztest.NewBuilder().
+		File("usr/bin/log4j-cli", []byte("old")).
+		File("etc/os-release", []byte("base")).
+		MustBuild()
+	app, appManifest := loadImage(t, "app", base.Blob, estargztest.NewBuilder().
+		File("app/server", []byte("server")).
+		MustBuild().Blob)
+	patched, _ := loadImage(t, "patched", base.Blob, estargztest.NewBuilder().
+		Whiteout("usr/bin/log4j-cli").
+		MustBuild().Blob)
+
+	path := filepath.Join(t.TempDir(), "index.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for ref, index := range map[string]*stargzget.ImageIndex{"app:1": app, "patched:1": patched} {
+		if err := db.Add(ctx, ref, index); err != nil {
+			t.Fatalf("Add(%s) error = %v", ref, err)
+		}
+	}
+	// Adding an image again replaces it.
+	if err := db.Add(ctx, "app:1", app); err != nil {
+		t.Fatalf("Add() again error = %v", err)
+	}
+	db.Close()
+
+	db, err = OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	defer db.Close()
+
+	images, err := db.Images(ctx)
+	if err != nil || len(images) != 2 || images[0].Ref != "app:1" || images[0].Files != 3 || images[1].Files != 1 {
+		t.Fatalf("Images() = %+v, %v; want app:1 with 3 files and patched:1 with 1", images, err)
+	}
+
+	matches, err := db.Search(ctx, Query{Pattern: "/usr/bin/log4j*"})
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if len(matches) != 1 || matches[0].Image != "app:1" || matches[0].Path != "usr/bin/log4j-cli" || matches[0].Size != 3 {
+		t.Errorf("Search(log4j) = %+v, want only app:1's usr/bin/log4j-cli, as patched:1 deletes it", matches)
+	}
+	matches, err = db.Search(ctx, Query{Digest: digest.FromString("base").String()})
+	if err != nil || len(matches) != 2 || matches[0].Path != "etc/os-release" || matches[1].Image != "patched:1" {
+		t.Errorf("Search(digest) = %+v, %v; want etc/os-release in both images", matches, err)
+	}
+
+	loaded, err := db.Index(ctx, "app:1", appManifest)
+	if err != nil {
+		t.Fatalf("Index() error = %v", err)
+	}
+	want, got := app.AllFiles(), loaded.AllFiles()
+	sort.Strings(want)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) || loaded.ManifestDigest != appManifest.Digest {
+		t.Errorf("Index() files = %v (manifest %s), want %v (manifest %s)", got, loaded.ManifestDigest, want, appManifest.Digest)
+	}
+	if info, err := loaded.FindFile("app/server", ""); err != nil || info.BlobDigest != app.Layers[1].BlobDigest {
+		t.Errorf("FindFile(app/server) = %+v, %v; want the top layer", info, err)
+	}
+
+	moved := &stor.Manifest{Digest: digest.FromString("app v2"), Layers: appManifest.Layers}
+	if _, err := db.Index(ctx, "app:1", moved); stargzerrors.GetErrorCode(err) != stargzerrors.ErrIndexStale.Code {
+		t.Errorf("Index() for a moved tag error = %v, want %s", err, stargzerrors.ErrIndexStale.Code)
+	}
+	if _, err := db.Index(ctx, "other:1", appManifest); stargzerrors.GetErrorCode(err) != stargzerrors.ErrImageNotIndexed.Code {
+		t.Errorf("Index() for an unknown image error = %v, want %s", err, stargzerrors.ErrImageNotIndexed.Code)
+	}
+	if err := db.Add(ctx, "app:2", app); err == nil {
+		t.Error("Add() on a read-only database succeeded")
+	}
+}
+
+func TestOpenReadOnly_Missing(t *testing.T) {
+	if db, err := OpenReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		db.Close()
+		t.Fatal("OpenReadOnly() of a missing database succeeded")
+	}
+}
+
+func TestDB_FilesStatLayerIndex(t *testing.T) {
+	ctx := context.Background()
+	base := estargztest.NewBuilder().
+		File("usr/bin/su", []byte("su"), estargztest.WithMode(0o4755), estargztest.WithOwner(0, 0)).
+		File("etc/os-release", []byte("base")).
+		MustBuild()
+	top := estargztest.NewBuilder().
+		File("etc/os-release", []byte("top"), estargztest.WithOwner(1000, 1000)).
+		Symlink("etc/release", "os-release").
+		MustBuild()
+	app, manifest := loadImage(t, "app", base.Blob, top.Blob)
+
+	// A '?' or '#' in the path must not be read as part of the URI.
+	path := filepath.Join(t.TempDir(), "fleet?v=1#main.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if err := db.Add(ctx, "app:1", app); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	db.Close()
+	db, err = OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenReadOnly() error = %v", err)
+	}
+	defer db.Close()
+
+	files, err := db.Files(ctx, "app:1", manifest, Query{})
+	if err != nil {
+		t.Fatalf("Files() error = %v", err)
+	}
+	var paths []string
+	for _, info := range files {
+		paths = append(paths, info.Path)
+	}
+	want := app.AllFiles()
+	sort.Strings(want)
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Files() = %v, want %v", paths, want)
+	}
+	topLayer := app.Layers[1].BlobDigest
+	if files, err := db.Files(ctx, "app:1", manifest, Query{Pattern: "/etc/*", Layer: topLayer}); err != nil || len(files) != 2 {
+		t.Errorf("Files(etc/* in top layer) = %v, %v; want etc/os-release and etc/release", files, err)
+	}
+
+	tests := []struct {
+		path string
+		want func(info *stargzget.FileInfo) bool
+	}{
+		{path: "/usr/bin/su", want: func(info *stargzget.FileInfo) bool {
+			return info.Mode == 0o755|os.ModeSetuid && info.Size == 2 && info.BlobDigest == app.Layers[0].BlobDigest
+		}},
+		{path: "etc/os-release", want: func(info *stargzget.FileInfo) bool {
+			return info.UID == 1000 && info.GID == 1000 && info.Size == 3 && info.BlobDigest == topLayer && !info.ModTime.IsZero()
+		}},
+		{path: "etc/release", want: func(info *stargzget.FileInfo) bool {
+			return info.IsSymlink() && info.LinkName == "os-release"
+		}},
+	}
+	for _, tt := range tests {
+		info, err := db.Stat(ctx, "app:1", manifest, tt.path)
+		if err != nil || !tt.want(info) {
+			t.Errorf("Stat(%s) = %+v, %v", tt.path, info, err)
+		}
+	}
+	if _, err := db.Stat(ctx, "app:1", manifest, "missing"); stargzerrors.GetErrorCode(err) != stargzerrors.ErrFileNotFound.Code {
+		t.Errorf("Stat(missing) error = %v, want %s", err, stargzerrors.ErrFileNotFound.Code)
+	}
+
+	// The bottom layer still lists the etc/os-release the top one overrides.
+	layer, err := db.LayerIndex(ctx, "app:1", manifest, app.Layers[0].BlobDigest)
+	if err != nil {
+		t.Fatalf("LayerIndex() error = %v", err)
+	}
+	if info, err := layer.FindFile("etc/os-release", app.Layers[0].BlobDigest); err != nil || info.Size != 4 {
+		t.Errorf("LayerIndex() etc/os-release = %+v, %v; want the bottom layer's 4-byte file", info, err)
+	}
+	if _, err := db.LayerIndex(ctx, "app:1", manifest, digest.FromString("other")); stargzerrors.GetErrorCode(err) != stargzerrors.ErrBlobNotFound.Code {
+		t.Errorf("LayerIndex() of a foreign layer error = %v, want %s", err, stargzerrors.ErrBlobNotFound.Code)
+	}
+
+	moved := &stor.Manifest{Digest: digest.FromString("app v2"), Layers: manifest.Layers}
+	if _, err := db.Files(ctx, "app:1", moved, Query{}); stargzerrors.GetErrorCode(err) != stargzerrors.ErrIndexStale.Code {
+		t.Errorf("Files() for a moved tag error = %v, want %s", err, stargzerrors.ErrIndexStale.Code)
+	}
+	if _, err := db.Stat(ctx, "other:1", manifest, "etc/os-release"); stargzerrors.GetErrorCode(err) != stargzerrors.ErrImageNotIndexed.Code {
+		t.Errorf("Stat() for an unknown image error = %v, want %s", err, stargzerrors.ErrImageNotIndexed.Code)
+	}
+}
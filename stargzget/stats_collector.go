@@ -0,0 +1,91 @@
+package stargzget
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// CollectedStats totals the downloads a StatsCollector has seen.
+type CollectedStats struct {
+	Downloads       int // StartDownload calls recorded
+	TotalFiles      int
+	TotalBytes      int64
+	DownloadedFiles int
+	DownloadedBytes int64
+	FailedFiles     int
+	Retries         int
+	Stalls          int
+	MemberCacheHits int           // Chunks served from gzip members already decoded
+	Elapsed         time.Duration // Wall time of the calls, summed
+}
+
+// StatsCollector accumulates stats across StartDownload calls, for callers
+// that split one logical download into several (e.g. one per directory) and
+// want combined totals. Set it as DownloadOptions.Stats on each call; it is
+// safe for concurrent calls.
+type StatsCollector struct {
+	mu        sync.Mutex
+	totals    CollectedStats
+	fileTimes []time.Duration // Time to download each file, retries included
+}
+
+// NewStatsCollector returns an empty collector.
+func NewStatsCollector() *StatsCollector {
+	return &StatsCollector{}
+}
+
+// Totals returns the stats accumulated so far.
+func (c *StatsCollector) Totals() CollectedStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.totals
+}
+
+// FilePercentile returns the p-th percentile (0-100, nearest rank) of the
+// time taken by the files downloaded so far, from the first attempt to the
+// last; 0 when none were.
+func (c *StatsCollector) FilePercentile(p float64) time.Duration {
+	c.mu.Lock()
+	times := append([]time.Duration(nil), c.fileTimes...)
+	c.mu.Unlock()
+	if len(times) == 0 {
+		return 0
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	rank := int(p/100*float64(len(times))+0.5) - 1
+	return times[min(max(rank, 0), len(times)-1)]
+}
+
+// recordFile adds the time taken by one downloaded file. A nil collector
+// ignores it.
+func (c *StatsCollector) recordFile(elapsed time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fileTimes = append(c.fileTimes, elapsed)
+}
+
+// record adds the final stats of one StartDownload call. A nil collector
+// ignores them.
+func (c *StatsCollector) record(stats *DownloadStats, elapsed time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &c.totals
+	t.Downloads++
+	t.TotalFiles += stats.TotalFiles
+	t.TotalBytes += stats.TotalBytes
+	t.DownloadedFiles += stats.DownloadedFiles
+	t.DownloadedBytes += stats.DownloadedBytes
+	t.FailedFiles += stats.FailedFiles
+	t.Retries += stats.Retries
+	t.Stalls += stats.Stalls
+	t.MemberCacheHits += stats.MemberCacheHits
+	t.Elapsed += elapsed
+}
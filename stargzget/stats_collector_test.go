@@ -0,0 +1,75 @@
+package stargzget
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestStatsCollector_AcrossDownloads(t *testing.T) {
+	tempDir := t.TempDir()
+	store := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	blobA := addFileToStorage(t, store, resolver, "a/one", []byte("first file"), 0)
+	blobB := addFileToStorage(t, store, resolver, "b/two", []byte("second file, longer"), 4)
+	blobC := addFileToStorage(t, store, resolver, "b/three", []byte("third"), 0)
+
+	collector := NewStatsCollector()
+	downloader := NewDownloader(resolver, store)
+	batches := [][]*DownloadJob{
+		{{Path: "a/one", BlobDigest: blobA, Size: 10, OutputPath: filepath.Join(tempDir, "a/one")}},
+		{
+			{Path: "b/two", BlobDigest: blobB, Size: 19, OutputPath: filepath.Join(tempDir, "b/two")},
+			{Path: "b/three", BlobDigest: blobC, Size: 5, OutputPath: filepath.Join(tempDir, "b/three")},
+			{Path: "b/missing", BlobDigest: blobC, Size: 1, OutputPath: filepath.Join(tempDir, "b/missing")},
+		},
+	}
+	for _, jobs := range batches {
+		if _, err := downloader.StartDownload(context.Background(), jobs, nil, &DownloadOptions{Stats: collector}); err != nil {
+			t.Fatalf("StartDownload() error = %v", err)
+		}
+	}
+
+	got := collector.Totals()
+	if got.Downloads != 2 || got.TotalFiles != 4 || got.DownloadedFiles != 3 || got.FailedFiles != 1 {
+		t.Errorf("Totals() = %+v, want 2 downloads of 4 files, 3 downloaded and 1 failed", got)
+	}
+	if got.TotalBytes != 35 || got.DownloadedBytes != 34 {
+		t.Errorf("bytes = %d of %d, want 34 of 35", got.DownloadedBytes, got.TotalBytes)
+	}
+	if got.Elapsed <= 0 {
+		t.Errorf("Elapsed = %v, want the time spent downloading", got.Elapsed)
+	}
+	if p50, p100 := collector.FilePercentile(50), collector.FilePercentile(100); p50 <= 0 || p100 < p50 {
+		t.Errorf("file percentiles p50 %v, p100 %v; want 0 < p50 <= p100", p50, p100)
+	}
+}
+
+func TestStatsCollector_FilePercentile(t *testing.T) {
+	collector := NewStatsCollector()
+	if got := collector.FilePercentile(90); got != 0 {
+		t.Fatalf("FilePercentile() without files = %v, want 0", got)
+	}
+	for i := 10; i >= 1; i-- {
+		collector.recordFile(time.Duration(i) * time.Second)
+	}
+
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 0, want: time.Second},
+		{p: 50, want: 5 * time.Second},
+		{p: 90, want: 9 * time.Second},
+		{p: 99, want: 10 * time.Second},
+		{p: 100, want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := collector.FilePercentile(tt.p); got != tt.want {
+			t.Errorf("FilePercentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// dockerManifestFile lists the images of a `docker save` archive.
+const dockerManifestFile = "manifest.json"
+
+const (
+	ociConfigMedia    = "application/vnd.oci.image.config.v1+json"
+	ociLayerMedia     = "application/vnd.oci.image.layer.v1.tar"
+	ociLayerGzipMedia = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociLayerZstdMedia = "application/vnd.oci.image.layer.v1.tar+zstd"
+)
+
+// dockerArchiveImage is an entry of a `docker save` manifest.json. Config
+// and Layers are paths within the archive.
+type dockerArchiveImage struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// archiveEntry locates the content of a regular file in the archive.
+type archiveEntry struct {
+	offset int64
+	size   int64
+}
+
+// ArchiveStorage reads an image from an uncompressed tar archive of it,
+// without unpacking the archive: blobs are served as sections of the tar
+// file. It understands the archives `docker save` writes, with a
+// manifest.json naming the config and layer files, and OCI layouts in a
+// tar, as written by `ctr images export`, `docker save` since Docker 25 and
+// `skopeo copy ... oci-archive:`. When an archive holds both, the OCI
+// layout is preferred, as its manifests keep the layers' media types and
+// annotations.
+type ArchiveStorage struct {
+	file     *os.File
+	entries  map[string]archiveEntry
+	blobs    map[digest.Digest]string // Entry of each blob listed by manifest.json
+	manifest *Manifest
+}
+
+// NewArchiveStorage opens the archive at path and loads the image named ref:
+// a RepoTags entry of manifest.json (e.g. busybox:latest), or the ref name
+// or image name annotation of an OCI layout. An empty ref selects the first
+// image. Compressed archives are rejected, since they cannot be read at an
+// offset; decompress them first.
+func NewArchiveStorage(path, ref string) (*ArchiveStorage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &ArchiveStorage{file: file, entries: make(map[string]archiveEntry)}
+	if err := s.scan(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read archive %s: %w", path, err)
+	}
+
+	where := "archive " + path
+	_, hasIndex := s.entries[ociIndexFile]
+	_, hasDockerManifest := s.entries[dockerManifestFile]
+	switch {
+	case hasIndex:
+		s.manifest, err = loadLayoutManifest(where, s.readEntry, ref)
+		if err != nil && hasDockerManifest {
+			// Docker names images in manifest.json by tag, e.g.
+			// busybox:latest, but in index.json only by full name.
+			s.manifest, err = s.loadDockerManifest(where, ref)
+		}
+	case hasDockerManifest:
+		s.manifest, err = s.loadDockerManifest(where, ref)
+	default:
+		err = fmt.Errorf("%s holds neither %s nor %s; is it an image archive?", where, dockerManifestFile, ociIndexFile)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// scan records where each regular file of the archive is stored. The tar
+// reader seeks over file contents, so only headers are read. Symbolic and
+// hard links are recorded as the file they lead to, since older `docker
+// save` archives store a layer shared by several images once and link the
+// other layer.tar paths to it.
+func (s *ArchiveStorage) scan() error {
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(s.file, magic)
+	if sniffLayerMediaType(magic[:n]) != ociLayerMedia {
+		return fmt.Errorf("archive is compressed; decompress it first (e.g. with gunzip or zstd -d)")
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	links := make(map[string]string)
+	tr := tar.NewReader(s.file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			s.resolveLinks(links)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := archiveEntryName(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			// Next leaves the file positioned at the entry's content.
+			offset, err := s.file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			s.entries[name] = archiveEntry{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			// Symlink targets are relative to the link's directory, hard
+			// link targets to the archive root.
+			target := hdr.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(name), target)
+			}
+			links[name] = archiveEntryName(target)
+		case tar.TypeLink:
+			links[name] = archiveEntryName(hdr.Linkname)
+		}
+	}
+}
+
+// resolveLinks records each link as the regular file it leads to, following
+// links to links. Links to missing files and link cycles are left out, so
+// reading them fails as for any missing file.
+func (s *ArchiveStorage) resolveLinks(links map[string]string) {
+	for name, target := range links {
+		for hops := 0; hops <= len(links); hops++ {
+			if entry, ok := s.entries[target]; ok {
+				s.entries[name] = entry
+				break
+			}
+			next, ok := links[target]
+			if !ok {
+				break
+			}
+			target = next
+		}
+	}
+}
+
+// archiveEntryName cleans a tar entry name into a slash-separated path
+// relative to the archive root.
+func archiveEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// readEntry returns the content of a file of the archive.
+func (s *ArchiveStorage) readEntry(name string) ([]byte, error) {
+	entry, ok := s.entries[archiveEntryName(name)]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the archive", name)
+	}
+	data := make([]byte, entry.size)
+	if _, err := s.file.ReadAt(data, entry.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// loadDockerManifest builds a manifest for the image named ref in
+// manifest.json. Layers stored under blobs/ take their digest from the
+// path; the layer.tar files of older archives are the uncompressed layers,
+// so their digests are the diff IDs in the config.
+func (s *ArchiveStorage) loadDockerManifest(where, ref string) (*Manifest, error) {
+	data, err := s.readEntry(dockerManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	var images []dockerArchiveImage
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", dockerManifestFile, err)
+	}
+	var image *dockerArchiveImage
+	for i := range images {
+		if ref == "" || slices.Contains(images[i].RepoTags, ref) {
+			image = &images[i]
+			break
+		}
+	}
+	if image == nil {
+		if ref == "" {
+			return nil, fmt.Errorf("%s has no images", where)
+		}
+		return nil, fmt.Errorf("%s has no image tagged %q", where, ref)
+	}
+
+	configData, err := s.readEntry(image.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	var config ImageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+
+	s.blobs = make(map[digest.Digest]string)
+	configDigest := digest.FromBytes(configData)
+	s.blobs[configDigest] = archiveEntryName(image.Config)
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMedia,
+		Config:        Descriptor{MediaType: ociConfigMedia, Digest: configDigest.String(), Size: int64(len(configData))},
+	}
+	for i, name := range image.Layers {
+		name = archiveEntryName(name)
+		entry, ok := s.entries[name]
+		if !ok {
+			return nil, fmt.Errorf("layer %s is not in the archive", name)
+		}
+		dgst, err := s.dockerLayerDigest(name, i, &config)
+		if err != nil {
+			return nil, err
+		}
+		s.blobs[dgst] = name
+		manifest.Layers = append(manifest.Layers, Layer{
+			MediaType: s.layerMediaType(entry),
+			Digest:    dgst.String(),
+			Size:      entry.size,
+		})
+	}
+	encoded, _, err := manifest.Encode()
+	if err != nil {
+		return nil, err
+	}
+	manifest.Digest = digest.FromBytes(encoded)
+	return manifest, nil
+}
+
+// dockerLayerDigest returns the digest of the i-th layer, stored at name.
+func (s *ArchiveStorage) dockerLayerDigest(name string, i int, config *ImageConfig) (digest.Digest, error) {
+	if rest, ok := strings.CutPrefix(name, "blobs/"); ok {
+		if dgst, err := digest.Parse(strings.Replace(rest, "/", ":", 1)); err == nil {
+			return dgst, nil
+		}
+	}
+	if i >= len(config.RootFS.DiffIDs) {
+		return "", fmt.Errorf("image config lists %d diff IDs for %d layers", len(config.RootFS.DiffIDs), i+1)
+	}
+	return digest.Parse(config.RootFS.DiffIDs[i])
+}
+
+// layerMediaType tells compressed layers from plain tar by their magic.
+func (s *ArchiveStorage) layerMediaType(entry archiveEntry) string {
+	magic := make([]byte, 4)
+	n, _ := s.file.ReadAt(magic, entry.offset)
+	return sniffLayerMediaType(magic[:n])
+}
+
+// sniffLayerMediaType names the media type of a layer from its first bytes.
+func sniffLayerMediaType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return ociLayerGzipMedia
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ociLayerZstdMedia
+	}
+	return ociLayerMedia
+}
+
+// blobEntry finds the archive file holding blob dgst.
+func (s *ArchiveStorage) blobEntry(dgst digest.Digest) (archiveEntry, error) {
+	name, ok := s.blobs[dgst]
+	if !ok {
+		if dgst.Validate() != nil {
+			return archiveEntry{}, fmt.Errorf("invalid digest %q", dgst)
+		}
+		name = layoutBlobName(dgst)
+	}
+	entry, ok := s.entries[name]
+	if !ok {
+		return archiveEntry{}, fmt.Errorf("blob %s is not in the archive", dgst)
+	}
+	return entry, nil
+}
+
+// Manifest returns the manifest of the image the storage was opened with.
+func (s *ArchiveStorage) Manifest() *Manifest {
+	return s.manifest
+}
+
+// Close closes the archive. Readers returned by ReadBlob must not be used
+// afterwards.
+func (s *ArchiveStorage) Close() error {
+	return s.file.Close()
+}
+
+// ListBlobs lists the layers of the manifest.
+func (s *ArchiveStorage) ListBlobs(ctx context.Context) ([]BlobDescriptor, error) {
+	layers := s.manifest.contentLayers()
+	blobs := make([]BlobDescriptor, 0, len(layers))
+	for _, layer := range layers {
+		dgst, err := digest.Parse(layer.Digest)
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, BlobDescriptor{
+			Digest:           dgst,
+			Size:             layer.Size,
+			MediaType:        layer.MediaType,
+			UncompressedSize: layer.UncompressedSize(),
+			Annotations:      layer.Annotations,
+		})
+	}
+	return blobs, nil
+}
+
+// ReadBlob reads a range of a blob. A length of 0 or less reads to the end.
+func (s *ArchiveStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must be non-negative")
+	}
+	entry, err := s.blobEntry(dgst)
+	if err != nil {
+		return nil, err
+	}
+	offset = min(offset, entry.size)
+	if length <= 0 || offset+length > entry.size {
+		length = entry.size - offset
+	}
+	return io.NopCloser(io.NewSectionReader(s.file, entry.offset+offset, length)), nil
+}
+
+// BlobSize returns the size of a blob in the archive.
+func (s *ArchiveStorage) BlobSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	entry, err := s.blobEntry(dgst)
+	if err != nil {
+		return 0, err
+	}
+	return entry.size, nil
+}
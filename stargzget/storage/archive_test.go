@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// writeArchive writes name/content pairs, in order, to a tar file. A
+// content of "-> TARGET" writes a symbolic link and "=> TARGET" a hard link.
+func writeArchive(t *testing.T, files ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		hdr := &tar.Header{Name: files[i], Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(files[i+1]))}
+		if target, ok := strings.CutPrefix(files[i+1], "-> "); ok {
+			hdr = &tar.Header{Name: files[i], Typeflag: tar.TypeSymlink, Mode: 0o777, Linkname: target}
+		} else if target, ok := strings.CutPrefix(files[i+1], "=> "); ok {
+			hdr = &tar.Header{Name: files[i], Typeflag: tar.TypeLink, Mode: 0o644, Linkname: target}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func blobName(data string) string {
+	return "blobs/sha256/" + digest.FromString(data).Encoded()
+}
+
+func TestArchiveStorage_DockerSave(t *testing.T) {
+	layer := "uncompressed layer tar"
+	config := mustJSON(t, ImageConfig{OS: "linux", RootFS: RootFS{Type: "layers", DiffIDs: []string{digest.FromString(layer).String()}}})
+	path := writeArchive(t,
+		"0123abcd.json", config,
+		"f00d/layer.tar", layer,
+		"manifest.json", mustJSON(t, []dockerArchiveImage{{Config: "0123abcd.json", RepoTags: []string{"app:v1"}, Layers: []string{"f00d/layer.tar"}}}),
+	)
+
+	s, err := NewArchiveStorage(path, "app:v1")
+	if err != nil {
+		t.Fatalf("NewArchiveStorage() error = %v", err)
+	}
+	defer s.Close()
+	blobs, err := s.ListBlobs(context.Background())
+	if err != nil || len(blobs) != 1 {
+		t.Fatalf("ListBlobs() = %v, %v; want one layer", blobs, err)
+	}
+	if blobs[0].Digest != digest.FromString(layer) || blobs[0].MediaType != ociLayerMedia || blobs[0].Size != int64(len(layer)) {
+		t.Errorf("layer = %+v, want the diff ID as digest and the tar media type", blobs[0])
+	}
+	if got := readAll(t, s, blobs[0], 2, 10); string(got) != layer[2:12] {
+		t.Errorf("ReadBlob(2, 10) = %q, want %q", got, layer[2:12])
+	}
+	if got := readAll(t, s, blobs[0], 100, 0); len(got) != 0 {
+		t.Errorf("ReadBlob past the end = %q, want nothing", got)
+	}
+	if cfg, err := ReadImageConfig(context.Background(), s, s.Manifest().Config); err != nil || cfg.OS != "linux" {
+		t.Errorf("ReadImageConfig() = %+v, %v; want the archive's config", cfg, err)
+	}
+
+	if _, err := NewArchiveStorage(path, "app:v2"); err == nil || !strings.Contains(err.Error(), `no image tagged "app:v2"`) {
+		t.Errorf("NewArchiveStorage() with an unknown tag error = %v", err)
+	}
+}
+
+func TestArchiveStorage_DockerSaveLinkedLayers(t *testing.T) {
+	base := "shared base layer tar"
+	app := "app layer tar"
+	config := mustJSON(t, ImageConfig{OS: "linux", RootFS: RootFS{Type: "layers", DiffIDs: []string{
+		digest.FromString(base).String(),
+		digest.FromString(base).String(),
+		digest.FromString(app).String(),
+	}}})
+
+	tests := []struct {
+		name  string
+		files []string
+	}{
+		{
+			name: "symlink to a sibling layer directory",
+			files: []string{
+				"aaaa/layer.tar", base,
+				"bbbb/layer.tar", "-> ../aaaa/layer.tar",
+				"cccc/layer.tar", app,
+			},
+		},
+		{
+			name: "hard link",
+			files: []string{
+				"aaaa/layer.tar", base,
+				"bbbb/layer.tar", "=> aaaa/layer.tar",
+				"cccc/layer.tar", app,
+			},
+		},
+		{
+			name: "symlink to a link",
+			files: []string{
+				"aaaa/layer.tar", base,
+				"dddd/layer.tar", "=> aaaa/layer.tar",
+				"bbbb/layer.tar", "-> /dddd/layer.tar",
+				"cccc/layer.tar", app,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := append([]string{"0123abcd.json", config}, tt.files...)
+			files = append(files, "manifest.json", mustJSON(t, []dockerArchiveImage{{
+				Config:   "0123abcd.json",
+				RepoTags: []string{"app:v1"},
+				Layers:   []string{"aaaa/layer.tar", "bbbb/layer.tar", "cccc/layer.tar"},
+			}}))
+			s, err := NewArchiveStorage(writeArchive(t, files...), "app:v1")
+			if err != nil {
+				t.Fatalf("NewArchiveStorage() error = %v", err)
+			}
+			defer s.Close()
+
+			layers := s.Manifest().Layers
+			if len(layers) != 3 {
+				t.Fatalf("layers = %+v, want 3", layers)
+			}
+			for i, want := range []string{base, base, app} {
+				desc := BlobDescriptor{Digest: digest.Digest(layers[i].Digest), Size: layers[i].Size}
+				if got := readAll(t, s, desc, 0, 0); string(got) != want {
+					t.Errorf("layer %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+
+	dangling := writeArchive(t,
+		"0123abcd.json", config,
+		"bbbb/layer.tar", "-> ../aaaa/layer.tar",
+		"manifest.json", mustJSON(t, []dockerArchiveImage{{Config: "0123abcd.json", Layers: []string{"bbbb/layer.tar"}}}),
+	)
+	if _, err := NewArchiveStorage(dangling, ""); err == nil || !strings.Contains(err.Error(), "bbbb/layer.tar is not in the archive") {
+		t.Errorf("NewArchiveStorage() with a dangling link error = %v", err)
+	}
+}
+
+func TestArchiveStorage_OCILayout(t *testing.T) {
+	layer := "\x1f\x8b compressed layer"
+	config := `{"rootfs":{"type":"layers"}}`
+	manifest := mustJSON(t, Manifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMedia,
+		Config:        Descriptor{MediaType: ociConfigMedia, Digest: digest.FromString(config).String(), Size: int64(len(config))},
+		Layers: []Layer{{
+			MediaType:   ociLayerGzipMedia,
+			Digest:      digest.FromString(layer).String(),
+			Size:        int64(len(layer)),
+			Annotations: map[string]string{TOCDigestAnnotation: "sha256:" + strings.Repeat("0", 64)},
+		}},
+	})
+	// An index of two platforms, of which the export holds one.
+	missing := mustJSON(t, Manifest{SchemaVersion: 2, MediaType: ociManifestMedia})
+	nested := mustJSON(t, Manifest{SchemaVersion: 2, MediaType: ociIndexMedia, Manifests: []Descriptor{
+		{MediaType: ociManifestMedia, Digest: digest.FromString(missing).String(), Platform: &Platform{OS: "linux", Architecture: "arm64"}},
+		{MediaType: ociManifestMedia, Digest: digest.FromString(manifest).String(), Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+	}})
+	index := mustJSON(t, Manifest{SchemaVersion: 2, MediaType: ociIndexMedia, Manifests: []Descriptor{{
+		MediaType:   ociIndexMedia,
+		Digest:      digest.FromString(nested).String(),
+		Annotations: map[string]string{containerdImageNameAnnotation: "docker.io/library/app:v1", ociRefNameAnnotation: "v1"},
+	}}})
+	path := writeArchive(t,
+		"oci-layout", `{"imageLayoutVersion":"1.0.0"}`,
+		"index.json", index,
+		blobName(nested), nested,
+		blobName(manifest), manifest,
+		blobName(config), config,
+		blobName(layer), layer,
+		// Docker 25 writes a manifest.json naming the same blobs.
+		"manifest.json", mustJSON(t, []dockerArchiveImage{{Config: blobName(config), RepoTags: []string{"app:v1"}, Layers: []string{blobName(layer)}}}),
+	)
+
+	for _, ref := range []string{"", "v1", "docker.io/library/app:v1"} {
+		s, err := NewArchiveStorage(path, ref)
+		if err != nil {
+			t.Fatalf("NewArchiveStorage(%q) error = %v", ref, err)
+		}
+		if s.Manifest().Digest != digest.FromString(manifest) {
+			t.Errorf("NewArchiveStorage(%q) manifest = %s, want the amd64 child", ref, s.Manifest().Digest)
+		}
+		blobs, _ := s.ListBlobs(context.Background())
+		if len(blobs) != 1 || blobs[0].Annotations[TOCDigestAnnotation] == "" {
+			t.Errorf("NewArchiveStorage(%q) layers = %+v, want the layer with its annotations", ref, blobs)
+		}
+		s.Close()
+	}
+
+	// The tag Docker records only in manifest.json still resolves.
+	s, err := NewArchiveStorage(path, "app:v1")
+	if err != nil {
+		t.Fatalf("NewArchiveStorage(app:v1) error = %v", err)
+	}
+	defer s.Close()
+	blobs, _ := s.ListBlobs(context.Background())
+	if len(blobs) != 1 || blobs[0].Digest != digest.FromString(layer) || blobs[0].MediaType != ociLayerGzipMedia {
+		t.Fatalf("layers = %+v, want the gzip layer by its blob digest", blobs)
+	}
+	if got := readAll(t, s, blobs[0], 0, 0); string(got) != layer {
+		t.Errorf("ReadBlob() = %q, want %q", got, layer)
+	}
+}
+
+func TestArchiveStorage_RejectsCompressedArchives(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("tar"))
+	gz.Close()
+	path := filepath.Join(t.TempDir(), "image.tar.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewArchiveStorage(path, ""); err == nil || !strings.Contains(err.Error(), "decompress it first") {
+		t.Errorf("NewArchiveStorage() of a gzip archive error = %v, want a hint to decompress it", err)
+	}
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+)
+
+const (
+	// EnvSTSEndpoint overrides the STS endpoint web identity credentials
+	// are obtained from, as it does for the AWS SDKs.
+	EnvSTSEndpoint = "AWS_ENDPOINT_URL_STS"
+
+	// EnvIMDSEndpoint overrides the EC2 instance metadata endpoint, as it
+	// does for the AWS SDKs.
+	EnvIMDSEndpoint = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+
+	// ecsCredentialsHost serves AWS_CONTAINER_CREDENTIALS_RELATIVE_URI on
+	// ECS.
+	ecsCredentialsHost = "http://169.254.170.2"
+
+	defaultIMDSEndpoint = "http://169.254.169.254"
+
+	// imdsProbeTimeout bounds the first instance metadata request, so hosts
+	// outside EC2, where nothing answers it, fall through quickly.
+	imdsProbeTimeout = 2 * time.Second
+)
+
+// lookupAWSCredentials finds AWS credentials the way the AWS SDKs do: from
+// the environment or the shared credentials file, then a web identity token
+// (EKS IAM roles for service accounts), the container credentials endpoint
+// (ECS tasks, EKS Pod Identity) and the EC2 instance metadata service.
+// region is the region STS is called in for a web identity. ok is false when
+// no source has any.
+func lookupAWSCredentials(ctx context.Context, client *http.Client, region string) (awsCredentials, bool, error) {
+	if creds, ok, err := awsCredentialsFromEnv(); err != nil || ok {
+		return creds, ok, err
+	}
+	if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "" {
+		creds, err := webIdentityCredentials(ctx, client, region)
+		if err != nil {
+			return awsCredentials{}, false, fmt.Errorf("web identity credentials: %w", err)
+		}
+		return creds, true, nil
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		creds, err := containerCredentials(ctx, client)
+		if err != nil {
+			return awsCredentials{}, false, fmt.Errorf("container credentials: %w", err)
+		}
+		return creds, true, nil
+	}
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return awsCredentials{}, false, nil
+	}
+	creds, ok, err := instanceCredentials(ctx, client)
+	if err != nil {
+		return awsCredentials{}, false, fmt.Errorf("instance metadata credentials: %w", err)
+	}
+	return creds, ok, nil
+}
+
+// webIdentityCredentials exchanges the token in AWS_WEB_IDENTITY_TOKEN_FILE
+// for credentials of AWS_ROLE_ARN with STS AssumeRoleWithWebIdentity, which
+// takes no signature.
+func webIdentityCredentials(ctx context.Context, client *http.Client, region string) (awsCredentials, error) {
+	token, err := os.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "starget-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stsEndpoint(region)+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	data, resp, err := doMetadataRequest(client, req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+			return awsCredentials{}, fmt.Errorf("%s: %s", apiErr.Code, apiErr.Message)
+		}
+		return awsCredentials{}, statusError("STS AssumeRoleWithWebIdentity", "", resp, data)
+	}
+
+	var out struct {
+		AccessKeyID     string `xml:"AssumeRoleWithWebIdentityResult>Credentials>AccessKeyId"`
+		SecretAccessKey string `xml:"AssumeRoleWithWebIdentityResult>Credentials>SecretAccessKey"`
+		SessionToken    string `xml:"AssumeRoleWithWebIdentityResult>Credentials>SessionToken"`
+	}
+	if err := xml.Unmarshal(data, &out); err != nil {
+		return awsCredentials{}, fmt.Errorf("decoding AssumeRoleWithWebIdentity response: %w", err)
+	}
+	if out.AccessKeyID == "" || out.SecretAccessKey == "" {
+		return awsCredentials{}, errors.New("AssumeRoleWithWebIdentity returned no credentials")
+	}
+	return awsCredentials{AccessKeyID: out.AccessKeyID, SecretAccessKey: out.SecretAccessKey, SessionToken: out.SessionToken}, nil
+}
+
+// stsEndpoint returns the STS endpoint of region, or the one set in
+// AWS_ENDPOINT_URL_STS.
+func stsEndpoint(region string) string {
+	if endpoint := os.Getenv(EnvSTSEndpoint); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	host := "sts." + region + ".amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		host += ".cn"
+	}
+	return "https://" + host
+}
+
+// containerCredentials reads credentials from the endpoint ECS and EKS Pod
+// Identity announce in AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or _FULL_URI,
+// authorized by AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE or
+// AWS_CONTAINER_AUTHORIZATION_TOKEN when set.
+func containerCredentials(ctx context.Context, client *http.Client) (awsCredentials, error) {
+	endpoint := ecsCredentialsHost + os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") == "" {
+		endpoint = os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+		if err := checkContainerCredentialsURI(endpoint); err != nil {
+			return awsCredentials{}, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	data, resp, err := doMetadataRequest(client, req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, statusError("container credentials request", "", resp, data)
+	}
+	return decodeMetadataCredentials(data)
+}
+
+// checkContainerCredentialsURI accepts what the AWS SDKs accept for
+// AWS_CONTAINER_CREDENTIALS_FULL_URI: HTTPS, or HTTP to a loopback address
+// or the ECS and EKS credential endpoints, so credentials are not sent in
+// the clear elsewhere.
+func checkContainerCredentialsURI(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid AWS_CONTAINER_CREDENTIALS_FULL_URI: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" || host == "169.254.170.2" || host == "169.254.170.23" || host == "fd00:ec2::23" {
+			return nil
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return nil
+		}
+	}
+	return fmt.Errorf("AWS_CONTAINER_CREDENTIALS_FULL_URI %q is neither HTTPS nor a local endpoint", endpoint)
+}
+
+// instanceCredentials reads the credentials of the EC2 instance profile
+// from the instance metadata service, with an IMDSv2 session token. ok is
+// false when the service does not answer, as outside EC2, or the instance
+// has no profile.
+func instanceCredentials(ctx context.Context, client *http.Client) (awsCredentials, bool, error) {
+	endpoint := defaultIMDSEndpoint
+	if override := os.Getenv(EnvIMDSEndpoint); override != "" {
+		endpoint = strings.TrimSuffix(override, "/")
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, imdsProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(probeCtx, http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	data, resp, err := doMetadataRequest(client, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return awsCredentials{}, false, ctx.Err()
+		}
+		logger.Debug("No EC2 instance metadata service at %s: %v", endpoint, err)
+		return awsCredentials{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, false, statusError("instance metadata token request", "", resp, data)
+	}
+	token := string(data)
+
+	get := func(path string) ([]byte, *http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+path, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return doMetadataRequest(client, req)
+	}
+	const credentialsPath = "/latest/meta-data/iam/security-credentials/"
+	data, resp, err = get(credentialsPath)
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return awsCredentials{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, false, statusError("instance profile request", "", resp, data)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	if role == "" {
+		return awsCredentials{}, false, nil
+	}
+
+	data, resp, err = get(credentialsPath + url.PathEscape(role))
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, false, statusError("instance profile credentials request", "", resp, data)
+	}
+	creds, err := decodeMetadataCredentials(data)
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	return creds, true, nil
+}
+
+// doMetadataRequest sends req and reads at most 1MiB of the response.
+func doMetadataRequest(client *http.Client, req *http.Request) ([]byte, *http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, resp, nil
+}
+
+// decodeMetadataCredentials decodes the JSON credentials served by the
+// container credentials endpoint and the instance metadata service.
+func decodeMetadataCredentials(data []byte) (awsCredentials, error) {
+	var out struct {
+		Code            string `json:"Code"`
+		Message         string `json:"Message"`
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return awsCredentials{}, fmt.Errorf("decoding credentials: %w", err)
+	}
+	if out.Code != "" && out.Code != "Success" {
+		return awsCredentials{}, fmt.Errorf("%s: %s", out.Code, out.Message)
+	}
+	if out.AccessKeyID == "" || out.SecretAccessKey == "" {
+		return awsCredentials{}, errors.New("response has no credentials")
+	}
+	return awsCredentials{AccessKeyID: out.AccessKeyID, SecretAccessKey: out.SecretAccessKey, SessionToken: out.Token}, nil
+}
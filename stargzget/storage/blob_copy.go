@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// CopyBlob streams the whole blob described by desc from storage to w and
+// returns the number of bytes copied. The blob can be of any media type, e.g.
+// an artifact's WASM module or Helm chart. Its digest is always verified, and
+// so is its size when desc.Size is positive. Bytes reach w as they arrive, so
+// on a mismatch w has already received them; callers writing files should
+// write to a temporary name and rename it once CopyBlob succeeds.
+func CopyBlob(ctx context.Context, storage Storage, desc Descriptor, w io.Writer) (int64, error) {
+	dgst, err := digest.Parse(desc.Digest)
+	if err != nil {
+		return 0, fmt.Errorf("invalid blob digest %q: %w", desc.Digest, err)
+	}
+
+	body, err := storage.ReadBlob(ctx, dgst, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	var src io.Reader = body
+	if desc.Size > 0 {
+		// One extra byte tells an oversized blob from an exact one.
+		src = io.LimitReader(body, desc.Size+1)
+	}
+	verifier := dgst.Verifier()
+	n, err := io.Copy(io.MultiWriter(w, verifier), src)
+	if err != nil {
+		return n, err
+	}
+	if desc.Size > 0 && n != desc.Size {
+		return n, fmt.Errorf("blob %s size mismatch: got %s%d bytes, want %d", dgst, sizeQualifier(n, desc.Size), n, desc.Size)
+	}
+	if !verifier.Verified() {
+		return n, fmt.Errorf("blob %s digest mismatch", dgst)
+	}
+	return n, nil
+}
+
+// sizeQualifier marks a count cut off by the size limit as a lower bound.
+func sizeQualifier(n, want int64) string {
+	if n > want {
+		return "at least "
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// tamperedStorage serves other bytes than the ones a digest names.
+type tamperedStorage struct {
+	*MockStorage
+	data []byte
+}
+
+func (s *tamperedStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(s.data)), nil
+}
+
+func TestCopyBlob(t *testing.T) {
+	wasm := []byte("\x00asm\x01\x00\x00\x00")
+	store := NewMockStorage()
+	dgst := store.AddBlob("application/wasm", wasm)
+
+	tests := []struct {
+		name    string
+		storage Storage
+		desc    Descriptor
+		wantErr bool
+	}{
+		{name: "with size", storage: store, desc: Descriptor{MediaType: "application/wasm", Digest: dgst.String(), Size: int64(len(wasm))}},
+		{name: "without size", storage: store, desc: Descriptor{Digest: dgst.String()}},
+		{name: "size too small", storage: store, desc: Descriptor{Digest: dgst.String(), Size: 4}, wantErr: true},
+		{name: "size too large", storage: store, desc: Descriptor{Digest: dgst.String(), Size: 100}, wantErr: true},
+		{name: "tampered content", storage: &tamperedStorage{MockStorage: store, data: []byte("\x00asm\x02\x00\x00\x00")}, desc: Descriptor{Digest: dgst.String()}, wantErr: true},
+		{name: "invalid digest", storage: store, desc: Descriptor{Digest: "sha256:zz"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := CopyBlob(context.Background(), tt.storage, tt.desc, &buf)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("CopyBlob() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CopyBlob() error = %v", err)
+			}
+			if n != int64(len(wasm)) || !bytes.Equal(buf.Bytes(), wasm) {
+				t.Fatalf("CopyBlob() copied %d bytes %q, want %q", n, buf.Bytes(), wasm)
+			}
+		})
+	}
+}
+
+func TestManifestAllDescriptors(t *testing.T) {
+	manifest := &Manifest{
+		ArtifactType: "application/vnd.cncf.helm.config.v1+json",
+		Config:       Descriptor{MediaType: "application/vnd.cncf.helm.config.v1+json", Digest: digest.FromString("config").String()},
+		Layers:       []Layer{{MediaType: "application/vnd.cncf.helm.chart.content.v1.tar+gzip", Digest: digest.FromString("chart").String()}},
+		Blobs:        []Layer{{MediaType: "application/wasm", Digest: digest.FromString("module").String()}},
+	}
+	descs := manifest.AllDescriptors()
+	want := []string{"config", "chart", "module"}
+	if len(descs) != len(want) {
+		t.Fatalf("AllDescriptors() = %+v, want %d descriptors", descs, len(want))
+	}
+	for i, name := range want {
+		if descs[i].Digest != digest.FromString(name).String() {
+			t.Errorf("AllDescriptors()[%d] = %s, want digest of %q", i, descs[i].Digest, name)
+		}
+	}
+}
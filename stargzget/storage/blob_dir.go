@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// blobFile is a blob found in a BlobDirStorage directory.
+type blobFile struct {
+	path      string
+	size      int64
+	mediaType string // Sniffed layer media type; empty for blobs that are not layers
+}
+
+// BlobDirStorage reads blobs from loose files in a directory, such as layers
+// downloaded earlier or the fixtures under testdata/. A file whose path ends
+// in a digest, as ALGORITHM:ENCODED, ALGORITHM/ENCODED (the blobs/ tree of
+// an OCI layout) or a bare sha256 hex, is that blob; any other file is
+// hashed with sha256 when the directory is opened. Directories whose names
+// start with a dot are skipped.
+type BlobDirStorage struct {
+	dir      string
+	files    map[digest.Digest]blobFile
+	manifest *Manifest
+}
+
+// NewBlobDirStorage indexes the files under dir. When manifest is nil, one is
+// made up of the files that look like layers (gzip, zstd or tar), ordered by
+// path, so a directory of numbered layer files reads as an image with those
+// layers from bottom to top.
+func NewBlobDirStorage(dir string, manifest *Manifest) (*BlobDirStorage, error) {
+	s := &BlobDirStorage{dir: dir, files: make(map[digest.Digest]blobFile)}
+	var layerPaths []string
+	byPath := make(map[string]digest.Digest)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		file, dgst, err := indexBlobFile(p, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		s.files[dgst] = file
+		if file.mediaType != "" {
+			layerPaths = append(layerPaths, rel)
+			byPath[rel] = dgst
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to index blob directory %s: %w", dir, err)
+	}
+
+	if manifest == nil {
+		if len(layerPaths) == 0 {
+			return nil, fmt.Errorf("blob directory %s holds no layer blobs", dir)
+		}
+		sort.Strings(layerPaths)
+		manifest = &Manifest{SchemaVersion: 2, MediaType: ociManifestMedia}
+		for _, rel := range layerPaths {
+			dgst := byPath[rel]
+			file := s.files[dgst]
+			manifest.Layers = append(manifest.Layers, Layer{MediaType: file.mediaType, Digest: dgst.String(), Size: file.size})
+		}
+		encoded, _, err := manifest.Encode()
+		if err != nil {
+			return nil, err
+		}
+		manifest.Digest = digest.FromBytes(encoded)
+	}
+	s.manifest = manifest
+	return s, nil
+}
+
+// indexBlobFile returns the blob stored at p, whose slash-separated path
+// within the directory is rel, with its digest.
+func indexBlobFile(p, rel string) (blobFile, digest.Digest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return blobFile{}, "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return blobFile{}, "", err
+	}
+	file := blobFile{path: p, size: info.Size()}
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if isLayerHead(head[:n]) {
+		file.mediaType = sniffLayerMediaType(head[:n])
+	}
+
+	if dgst, ok := digestFromPath(rel); ok {
+		return file, dgst, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return blobFile{}, "", err
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), f); err != nil {
+		return blobFile{}, "", err
+	}
+	return file, digester.Digest(), nil
+}
+
+// digestFromPath returns the digest a blob's path names, if any.
+func digestFromPath(rel string) (digest.Digest, bool) {
+	base := path.Base(rel)
+	candidates := []string{base, path.Base(path.Dir(rel)) + ":" + base}
+	if len(base) == 64 {
+		if _, err := hex.DecodeString(base); err == nil {
+			candidates = append(candidates, "sha256:"+base)
+		}
+	}
+	for _, c := range candidates {
+		if dgst, err := digest.Parse(c); err == nil {
+			return dgst, true
+		}
+	}
+	return "", false
+}
+
+// isLayerHead reports whether a blob starting with head looks like a layer:
+// gzip, zstd or a tar archive.
+func isLayerHead(head []byte) bool {
+	if sniffLayerMediaType(head) != ociLayerMedia {
+		return true
+	}
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// Manifest returns the manifest the storage serves, as given or made up
+// from the directory's layer files.
+func (s *BlobDirStorage) Manifest() *Manifest {
+	return s.manifest
+}
+
+// ListBlobs lists the layers of the manifest.
+func (s *BlobDirStorage) ListBlobs(ctx context.Context) ([]BlobDescriptor, error) {
+	layers := s.manifest.contentLayers()
+	blobs := make([]BlobDescriptor, 0, len(layers))
+	for _, layer := range layers {
+		dgst, err := digest.Parse(layer.Digest)
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, BlobDescriptor{
+			Digest:           dgst,
+			Size:             layer.Size,
+			MediaType:        layer.MediaType,
+			UncompressedSize: layer.UncompressedSize(),
+			Annotations:      layer.Annotations,
+		})
+	}
+	return blobs, nil
+}
+
+// ReadBlob reads a range of a blob. A length of 0 or less reads to the end.
+func (s *BlobDirStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must be non-negative")
+	}
+	file, ok := s.files[dgst]
+	if !ok {
+		return nil, fmt.Errorf("blob %s is not in %s", dgst, s.dir)
+	}
+	f, err := os.Open(file.path)
+	if err != nil {
+		return nil, err
+	}
+	return sectionReadCloser(f, min(offset, file.size), length, file.size), nil
+}
+
+// BlobSize returns the size of a blob in the directory.
+func (s *BlobDirStorage) BlobSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	file, ok := s.files[dgst]
+	if !ok {
+		return 0, fmt.Errorf("blob %s is not in %s", dgst, s.dir)
+	}
+	return file.size, nil
+}
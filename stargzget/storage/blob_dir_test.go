@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestBlobDirStorage(t *testing.T) {
+	var tarLayer bytes.Buffer
+	tw := tar.NewWriter(&tarLayer)
+	tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755})
+	tw.Close()
+	gzipLayer := "\x1f\x8b not really gzip"
+	laidOut := "\x1f\x8b a layer from a layout"
+	config := `{"rootfs":{"type":"layers"}}`
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"000002": tarLayer.String(),
+		"000001": gzipLayer,
+		"blobs/sha256/" + digest.FromString(laidOut).Encoded(): laidOut,
+		digest.FromString(config).String():                     config,
+		".partial/sha256/" + digest.FromString("x").Encoded():  "partial",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewBlobDirStorage(dir, nil)
+	if err != nil {
+		t.Fatalf("NewBlobDirStorage() error = %v", err)
+	}
+	blobs, err := s.ListBlobs(context.Background())
+	if err != nil {
+		t.Fatalf("ListBlobs() error = %v", err)
+	}
+	// Layers in path order; the config is not a layer and .partial is skipped.
+	want := []struct {
+		dgst      digest.Digest
+		mediaType string
+	}{
+		{digest.FromString(gzipLayer), ociLayerGzipMedia},
+		{digest.FromString(tarLayer.String()), ociLayerMedia},
+		{digest.FromString(laidOut), ociLayerGzipMedia},
+	}
+	if len(blobs) != len(want) {
+		t.Fatalf("ListBlobs() = %+v, want %d layers", blobs, len(want))
+	}
+	for i, w := range want {
+		if blobs[i].Digest != w.dgst || blobs[i].MediaType != w.mediaType {
+			t.Errorf("layer %d = %s %s, want %s %s", i, blobs[i].Digest, blobs[i].MediaType, w.dgst, w.mediaType)
+		}
+	}
+	if got := readAll(t, s, blobs[0], 4, 6); string(got) != gzipLayer[4:10] {
+		t.Errorf("ReadBlob(4, 6) = %q, want %q", got, gzipLayer[4:10])
+	}
+	if size, err := s.BlobSize(context.Background(), digest.FromString(config)); err != nil || size != int64(len(config)) {
+		t.Errorf("BlobSize(config) = %d, %v; want %d", size, err, len(config))
+	}
+	if _, err := s.ReadBlob(context.Background(), digest.FromString("x"), 0, 0); err == nil {
+		t.Error("ReadBlob() of a blob under .partial succeeded, want it skipped")
+	}
+
+	// A given manifest picks the layers and their order.
+	manifest := &Manifest{SchemaVersion: 2, Layers: []Layer{{MediaType: ociLayerGzipMedia, Digest: digest.FromString(laidOut).String(), Size: int64(len(laidOut))}}}
+	s, err = NewBlobDirStorage(dir, manifest)
+	if err != nil {
+		t.Fatalf("NewBlobDirStorage() with a manifest error = %v", err)
+	}
+	if blobs, _ := s.ListBlobs(context.Background()); len(blobs) != 1 || blobs[0].Digest != digest.FromString(laidOut) {
+		t.Errorf("ListBlobs() with a manifest = %+v, want its one layer", blobs)
+	}
+
+	if _, err := NewBlobDirStorage(t.TempDir(), nil); err == nil {
+		t.Error("NewBlobDirStorage() of an empty directory succeeded, want an error")
+	}
+}
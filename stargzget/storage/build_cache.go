@@ -0,0 +1,52 @@
+package storage
+
+import "strings"
+
+// BuildCacheConfigMediaType is the media type of the cache config that
+// BuildKit stores with cache exports (--cache-to type=registry or
+// type=local).
+const BuildCacheConfigMediaType = "application/vnd.buildkit.cacheconfig.v0"
+
+// IsBuildCache reports whether m is a BuildKit cache export rather than an
+// image. Its layers are the results of build steps, each a diff against
+// whichever step it followed, so together they do not form one filesystem.
+func (m *Manifest) IsBuildCache() bool {
+	if m.Config.MediaType == BuildCacheConfigMediaType {
+		return true
+	}
+	for _, entry := range m.Manifests {
+		if entry.MediaType == BuildCacheConfigMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// flattenBuildCache rewrites a cache export stored as an index, whose
+// entries are the layer blobs and the cache config themselves rather than
+// manifests, into the manifest BuildKit writes with image-manifest=true:
+// the cache config as config and the other entries as layers. Selecting a
+// child of such an index would fetch a layer as if it were a manifest.
+// Other manifests are left alone.
+func flattenBuildCache(m *Manifest) {
+	if len(m.Manifests) == 0 || !m.IsBuildCache() {
+		return
+	}
+	for _, entry := range m.Manifests {
+		switch {
+		case entry.MediaType == BuildCacheConfigMediaType:
+			m.Config = Descriptor{MediaType: entry.MediaType, Digest: entry.Digest, Size: entry.Size}
+		case strings.Contains(entry.MediaType, "manifest") || strings.Contains(entry.MediaType, "index"):
+			// Nested manifests are not cache blobs.
+		default:
+			m.Layers = append(m.Layers, Layer{
+				MediaType:   entry.MediaType,
+				Digest:      entry.Digest,
+				Size:        entry.Size,
+				Annotations: entry.Annotations,
+			})
+		}
+	}
+	m.MediaType = ociManifestMedia
+	m.Manifests = nil
+}
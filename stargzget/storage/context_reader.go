@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// NewContextReadCloser ties body to ctx: once ctx is done, body is closed,
+// which unblocks a Read stuck waiting on the network, and every Read from
+// then on returns ctx.Err(). Bodies whose transport already honours the
+// context are unaffected; the wrapper matters for those that would otherwise
+// block until a TCP timeout.
+func NewContextReadCloser(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	r := &contextReadCloser{ctx: ctx, body: body}
+	r.stop = context.AfterFunc(ctx, r.closeBody)
+	return r
+}
+
+type contextReadCloser struct {
+	ctx  context.Context
+	body io.ReadCloser
+	stop func() bool
+
+	once     sync.Once
+	closeErr error
+}
+
+func (r *contextReadCloser) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.body.Read(p)
+	if err != nil {
+		if ctxErr := r.ctx.Err(); ctxErr != nil {
+			// The error most likely comes from the body being closed under
+			// the Read; report why it was closed instead.
+			return n, ctxErr
+		}
+	}
+	return n, err
+}
+
+func (r *contextReadCloser) Close() error {
+	r.stop()
+	r.closeBody()
+	return r.closeErr
+}
+
+func (r *contextReadCloser) closeBody() {
+	r.once.Do(func() {
+		r.closeErr = r.body.Close()
+	})
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingBody blocks in Read until closed.
+type blockingBody struct {
+	closed chan struct{}
+}
+
+func (b *blockingBody) Read(p []byte) (int, error) {
+	<-b.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (b *blockingBody) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestContextReadCloser(t *testing.T) {
+	t.Run("cancel aborts blocked read", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		body := NewContextReadCloser(ctx, &blockingBody{closed: make(chan struct{})})
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := body.Read(make([]byte, 8))
+			errCh <- err
+		}()
+		cancel()
+
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("Read() error = %v, want context.Canceled", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Read() still blocked after cancel")
+		}
+		// Close after the context closed the body must not close it again.
+		if err := body.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	})
+
+	t.Run("reads pass through", func(t *testing.T) {
+		body := NewContextReadCloser(context.Background(), io.NopCloser(strings.NewReader("hello")))
+		data, err := io.ReadAll(body)
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("ReadAll() = %q, %v; want hello", data, err)
+		}
+		if err := body.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	})
+
+	t.Run("read after cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		body := NewContextReadCloser(ctx, io.NopCloser(strings.NewReader("hello")))
+		cancel()
+		if _, err := body.Read(make([]byte, 8)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Read() error = %v, want context.Canceled", err)
+		}
+		body.Close()
+	})
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+)
+
+// dockerHubServerURL is the key Docker uses for Docker Hub credentials.
+const dockerHubServerURL = "https://index.docker.io/v1/"
+
+// credentialConfig is the subset of the Docker config.json format shared by
+// the starget config file and ~/.docker/config.json.
+type credentialConfig struct {
+	Auths       map[string]configAuth `json:"auths,omitempty"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+}
+
+type configAuth struct {
+	Auth     string `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// DefaultConfigPath returns the starget config file location. STARGET_CONFIG
+// overrides the default of <user config dir>/starget/config.json.
+func DefaultConfigPath() (string, error) {
+	if path := os.Getenv("STARGET_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "starget", "config.json"), nil
+}
+
+// DefaultDockerConfigPath returns the Docker CLI config location, honoring DOCKER_CONFIG.
+func DefaultDockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// ErrPlaintextCredential is returned by FileCredentialStore.Store when no
+// credential helper is configured and writing the password into the config
+// file has not been allowed with AllowPlaintext.
+var ErrPlaintextCredential = errors.New("no credential helper configured; refusing to store the password unencrypted")
+
+// FileCredentialStore keeps registry credentials in the starget config file.
+// When the file names a credsStore, secrets are delegated to that
+// docker-credential-* helper (OS keychain, pass, secretservice) and never
+// written to disk. Without a helper, Store refuses unless AllowPlaintext was
+// called, since the base64 auth entry of a 0600 file is not encryption.
+type FileCredentialStore struct {
+	path           string
+	allowPlaintext bool
+}
+
+// NewFileCredentialStore returns a store backed by the config file at path.
+func NewFileCredentialStore(path string) *FileCredentialStore {
+	return &FileCredentialStore{path: path}
+}
+
+// Path returns the config file location.
+func (s *FileCredentialStore) Path() string {
+	return s.path
+}
+
+// AllowPlaintext lets Store write passwords into the config file when no
+// credential helper is configured.
+func (s *FileCredentialStore) AllowPlaintext() *FileCredentialStore {
+	s.allowPlaintext = true
+	return s
+}
+
+// Credential implements CredentialProvider.
+func (s *FileCredentialStore) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	cfg, err := readCredentialConfig(s.path)
+	if err != nil {
+		return Credential{}, false, err
+	}
+	return lookupConfigCredential(ctx, cfg, registry)
+}
+
+// Store saves cred for registry. helper, when non-empty, becomes the config's
+// credsStore so this and later logins are kept in that helper. It returns
+// ErrPlaintextCredential if no helper applies and AllowPlaintext was not
+// called.
+func (s *FileCredentialStore) Store(ctx context.Context, registry string, cred Credential, helper string) error {
+	cfg, err := readCredentialConfig(s.path)
+	if err != nil {
+		return err
+	}
+	if helper != "" {
+		cfg.CredsStore = helper
+	}
+
+	host := normalizeRegistryHost(registry)
+	if name := configHelperFor(cfg, host); name != "" {
+		if err := helperStore(ctx, name, helperServerURL(host), cred); err != nil {
+			return err
+		}
+		delete(cfg.Auths, host)
+		return writeCredentialConfig(s.path, cfg)
+	}
+	if !s.allowPlaintext {
+		return ErrPlaintextCredential
+	}
+
+	if cfg.Auths == nil {
+		cfg.Auths = make(map[string]configAuth)
+	}
+	cfg.Auths[host] = configAuth{
+		Auth: base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password)),
+	}
+	return writeCredentialConfig(s.path, cfg)
+}
+
+// Erase removes any stored credential for registry. It reports whether
+// anything was removed.
+func (s *FileCredentialStore) Erase(ctx context.Context, registry string) (bool, error) {
+	cfg, err := readCredentialConfig(s.path)
+	if err != nil {
+		return false, err
+	}
+
+	host := normalizeRegistryHost(registry)
+	removed := false
+	if name := configHelperFor(cfg, host); name != "" {
+		erased, err := helperErase(ctx, name, helperServerURL(host))
+		if err != nil {
+			return false, err
+		}
+		removed = erased
+	}
+	for key := range cfg.Auths {
+		if normalizeRegistryHost(key) == host {
+			delete(cfg.Auths, key)
+			removed = true
+		}
+	}
+	if !removed {
+		return false, nil
+	}
+	return true, writeCredentialConfig(s.path, cfg)
+}
+
+// DockerConfigCredentials reads credentials from a Docker CLI config.json,
+// including its credsStore and credHelpers entries. It never writes.
+type DockerConfigCredentials struct {
+	path string
+}
+
+// NewDockerConfigCredentials returns a read-only provider for the Docker config at path.
+func NewDockerConfigCredentials(path string) *DockerConfigCredentials {
+	return &DockerConfigCredentials{path: path}
+}
+
+// Credential implements CredentialProvider.
+func (d *DockerConfigCredentials) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	cfg, err := readCredentialConfig(d.path)
+	if err != nil {
+		return Credential{}, false, err
+	}
+	return lookupConfigCredential(ctx, cfg, registry)
+}
+
+func readCredentialConfig(path string) (*credentialConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &credentialConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg credentialConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func writeCredentialConfig(path string, cfg *credentialConfig) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func lookupConfigCredential(ctx context.Context, cfg *credentialConfig, registry string) (Credential, bool, error) {
+	host := normalizeRegistryHost(registry)
+
+	if name := configHelperFor(cfg, host); name != "" {
+		cred, ok, err := helperGet(ctx, name, helperServerURL(host))
+		if err != nil {
+			logger.Warn("Credential helper %s failed for %s: %v", name, host, err)
+		} else if ok {
+			return cred, true, nil
+		}
+	}
+
+	for key, auth := range cfg.Auths {
+		if normalizeRegistryHost(key) != host {
+			continue
+		}
+		if auth.Username != "" || auth.Password != "" {
+			return Credential{Username: auth.Username, Password: auth.Password}, true, nil
+		}
+		if auth.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return Credential{}, false, fmt.Errorf("invalid auth entry for %s: %w", key, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return Credential{}, false, fmt.Errorf("invalid auth entry for %s", key)
+		}
+		return Credential{Username: parts[0], Password: parts[1]}, true, nil
+	}
+
+	return Credential{}, false, nil
+}
+
+func configHelperFor(cfg *credentialConfig, host string) string {
+	for key, helper := range cfg.CredHelpers {
+		if normalizeRegistryHost(key) == host {
+			return helper
+		}
+	}
+	return cfg.CredsStore
+}
+
+func helperServerURL(host string) string {
+	if host == "docker.io" {
+		return dockerHubServerURL
+	}
+	return host
+}
+
+// helperCredential is the JSON payload spoken by docker-credential-* helpers.
+type helperCredential struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func runCredentialHelper(ctx context.Context, name, action string, input []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+name, action)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(string(out) + " " + stderr.String())
+		return nil, fmt.Errorf("docker-credential-%s %s: %w: %s", name, action, err, msg)
+	}
+	return out, nil
+}
+
+func isHelperNotFound(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "credentials not found")
+}
+
+func helperGet(ctx context.Context, name, serverURL string) (Credential, bool, error) {
+	out, err := runCredentialHelper(ctx, name, "get", []byte(serverURL))
+	if isHelperNotFound(err) {
+		return Credential{}, false, nil
+	}
+	if err != nil {
+		return Credential{}, false, err
+	}
+
+	var hc helperCredential
+	if err := json.Unmarshal(out, &hc); err != nil {
+		return Credential{}, false, fmt.Errorf("docker-credential-%s returned invalid JSON: %w", name, err)
+	}
+	return Credential{Username: hc.Username, Password: hc.Secret}, true, nil
+}
+
+func helperStore(ctx context.Context, name, serverURL string, cred Credential) error {
+	payload, err := json.Marshal(helperCredential{
+		ServerURL: serverURL,
+		Username:  cred.Username,
+		Secret:    cred.Password,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = runCredentialHelper(ctx, name, "store", payload)
+	return err
+}
+
+func helperErase(ctx context.Context, name, serverURL string) (bool, error) {
+	_, err := runCredentialHelper(ctx, name, "erase", []byte(serverURL))
+	if isHelperNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
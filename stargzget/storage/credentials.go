@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// Credential is a username/password pair used to authenticate against a registry.
+type Credential struct {
+	Username string
+	Password string
+
+	// ExpiresAt, if set, is when the credential stops working, as for
+	// short-lived registry tokens. The registry client looks it up again
+	// from its provider after that.
+	ExpiresAt time.Time
+}
+
+// CredentialProvider looks up credentials for a registry host.
+type CredentialProvider interface {
+	// Credential returns the credential for registry. ok is false when the
+	// provider has nothing for that registry, letting a chain fall through.
+	Credential(ctx context.Context, registry string) (cred Credential, ok bool, err error)
+}
+
+// CredentialChain consults providers in order and returns the first match.
+// An empty chain means anonymous access.
+type CredentialChain []CredentialProvider
+
+// Credential implements CredentialProvider.
+func (c CredentialChain) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	for _, provider := range c {
+		if provider == nil {
+			continue
+		}
+		cred, ok, err := provider.Credential(ctx, registry)
+		if err != nil {
+			return Credential{}, false, err
+		}
+		if ok {
+			return cred, true, nil
+		}
+	}
+	return Credential{}, false, nil
+}
+
+// StaticCredentials returns the same credential for every registry.
+func StaticCredentials(username, password string) CredentialProvider {
+	return staticCredentials{cred: Credential{Username: username, Password: password}}
+}
+
+type staticCredentials struct {
+	cred Credential
+}
+
+func (s staticCredentials) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	if s.cred.Username == "" && s.cred.Password == "" {
+		return Credential{}, false, nil
+	}
+	return s.cred, true, nil
+}
+
+// RegistryCredentials returns a provider holding a credential per registry,
+// for invocations that reach several registries, such as ghcr.io and a
+// private Harbor. Keys are registry hosts in any spelling the rest of the
+// chain accepts (a bare host, a URL, a Docker Hub alias); registries
+// without an entry fall through.
+func RegistryCredentials(creds map[string]Credential) CredentialProvider {
+	byHost := make(registryCredentials, len(creds))
+	for registry, cred := range creds {
+		byHost[normalizeRegistryHost(registry)] = cred
+	}
+	return byHost
+}
+
+type registryCredentials map[string]Credential
+
+func (r registryCredentials) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	cred, ok := r[normalizeRegistryHost(registry)]
+	return cred, ok, nil
+}
+
+const (
+	// EnvUsername and EnvPassword name the environment variables read by EnvCredentials.
+	EnvUsername = "STARGET_USERNAME"
+	EnvPassword = "STARGET_PASSWORD"
+)
+
+// EnvCredentials reads STARGET_USERNAME and STARGET_PASSWORD at lookup time.
+func EnvCredentials() CredentialProvider {
+	return envCredentials{}
+}
+
+type envCredentials struct{}
+
+func (envCredentials) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	username := os.Getenv(EnvUsername)
+	password := os.Getenv(EnvPassword)
+	if username == "" || password == "" {
+		return Credential{}, false, nil
+	}
+	return Credential{Username: username, Password: password}, true, nil
+}
+
+// DefaultCredentialChain builds the standard lookup order used by the CLI:
+// explicit credential > environment > starget config file > docker config >
+// ECR tokens from AWS credentials. ECR comes last so a registry already
+// logged in to is never held up by a failing AWS API call. Pass nil for
+// explicit when no credential flag was given.
+func DefaultCredentialChain(explicit CredentialProvider) CredentialChain {
+	chain := CredentialChain{}
+	if explicit != nil {
+		chain = append(chain, explicit)
+	}
+	chain = append(chain, EnvCredentials())
+	if path, err := DefaultConfigPath(); err == nil {
+		chain = append(chain, NewFileCredentialStore(path))
+	}
+	if path, err := DefaultDockerConfigPath(); err == nil {
+		chain = append(chain, NewDockerConfigCredentials(path))
+	}
+	return append(chain, ECRCredentials())
+}
+
+// normalizeRegistryHost maps the various spellings of a registry (URLs,
+// Docker Hub aliases) onto a bare host used as the lookup key.
+func normalizeRegistryHost(registry string) string {
+	host := strings.TrimSpace(registry)
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if idx := strings.Index(host, "/"); idx != -1 {
+		host = host[:idx]
+	}
+	host = strings.ToLower(host)
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return host
+}
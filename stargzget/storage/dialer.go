@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultConnectTimeout bounds DNS resolution plus TCP connect for a single
+// registry connection when DialOptions.ConnectTimeout is zero.
+const DefaultConnectTimeout = 10 * time.Second
+
+// DialOptions tunes how connections to registries are established. The zero
+// value uses DefaultConnectTimeout and Go's default Happy Eyeballs behavior.
+type DialOptions struct {
+	// ConnectTimeout limits DNS lookup and TCP connect for one connection.
+	ConnectTimeout time.Duration
+	// FallbackDelay is how long an IPv6 attempt may run before an IPv4
+	// attempt is raced against it (RFC 6555). Zero uses Go's default of
+	// 300ms; a negative value disables the fallback.
+	FallbackDelay time.Duration
+	// ForceIPv4 dials IPv4 addresses only, for hosts whose IPv6 routes are
+	// broken.
+	ForceIPv4 bool
+}
+
+// dialContext returns a DialContext function applying opts. Dials honor the
+// request context, so cancelling a request also aborts a pending connect.
+func (opts DialOptions) dialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout := opts.ConnectTimeout
+	if timeout <= 0 {
+		timeout = DefaultConnectTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:       timeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: opts.FallbackDelay,
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if opts.ForceIPv4 {
+			switch network {
+			case "tcp", "tcp6":
+				network = "tcp4"
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// newHTTPClient builds the HTTP client used for registry requests. Its
+// requests count against the process-wide per-host limit.
+func newHTTPClient(insecure bool, opts DialOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = opts.dialContext()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: &limitedTransport{base: transport, limiter: hostLimits}}
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDialOptions_ForceIPv4(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	dial := DialOptions{ForceIPv4: true}.dialContext()
+
+	conn, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial IPv4 address: %v", err)
+	}
+	conn.Close()
+
+	if conn, err := dial(context.Background(), "tcp", "[::1]:443"); err == nil {
+		conn.Close()
+		t.Fatalf("dial IPv6 address with ForceIPv4 succeeded, want error")
+	}
+}
+
+func TestDialOptions_HonorsContext(t *testing.T) {
+	dial := DialOptions{ConnectTimeout: time.Minute}.dialContext()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if conn, err := dial(ctx, "tcp", "192.0.2.1:443"); err == nil {
+		conn.Close()
+		t.Fatalf("dial with cancelled context succeeded, want error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("dial with cancelled context took %v", elapsed)
+	}
+}
+
+func TestRemoteRegistryStorage_WithDialOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewRemoteRegistryStorage(false).
+		WithCredential("user", "secret").
+		WithDialOptions(DialOptions{ConnectTimeout: time.Second, ForceIPv4: true})
+	if client.credentials == nil {
+		t.Fatalf("WithDialOptions dropped the credential provider")
+	}
+
+	resp, err := client.httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET via dial options: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+)
+
+// ecrHostPattern matches Amazon ECR private registry hosts, e.g.
+// 123456789012.dkr.ecr.us-west-2.amazonaws.com, capturing the account, the
+// FIPS marker, the region and the China partition suffix.
+var ecrHostPattern = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+const (
+	// ecrRefreshMargin is how long before an ECR token expires it is
+	// replaced, so a pull that starts just before the 12 hour expiry does
+	// not run out of time halfway.
+	ecrRefreshMargin = 30 * time.Minute
+
+	// EnvECREndpoint overrides the ECR API endpoint, as it does for the AWS
+	// SDKs, e.g. for a VPC endpoint.
+	EnvECREndpoint = "AWS_ENDPOINT_URL_ECR"
+)
+
+// ECRCredentials returns a provider that obtains Amazon ECR authorization
+// tokens for *.dkr.ecr.*.amazonaws.com registries by calling the ECR
+// GetAuthorizationToken API. AWS credentials are read from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables or, failing those, from the AWS_PROFILE (default "default")
+// profile of the shared credentials file, a web identity token, the
+// container credentials endpoint or the EC2 instance metadata service. Tokens
+// are cached per registry and fetched again shortly before their 12 hour
+// expiry. Other registries, and ECR registries when no AWS credentials are
+// found, fall through.
+func ECRCredentials() CredentialProvider {
+	client := &http.Client{Timeout: 30 * time.Second}
+	return &ecrCredentials{
+		httpClient: client,
+		awsCreds: func(ctx context.Context, region string) (awsCredentials, bool, error) {
+			return lookupAWSCredentials(ctx, client, region)
+		},
+		now:    time.Now,
+		tokens: make(map[string]Credential),
+	}
+}
+
+type ecrCredentials struct {
+	httpClient *http.Client
+	awsCreds   func(ctx context.Context, region string) (awsCredentials, bool, error)
+	now        func() time.Time
+
+	mu     sync.Mutex // Held while a token is fetched, so concurrent lookups share it
+	tokens map[string]Credential
+}
+
+// awsCredentials are the keys requests to AWS APIs are signed with.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Credential implements CredentialProvider.
+func (e *ecrCredentials) Credential(ctx context.Context, registry string) (Credential, bool, error) {
+	host := normalizeRegistryHost(registry)
+	match := ecrHostPattern.FindStringSubmatch(host)
+	if match == nil {
+		return Credential{}, false, nil
+	}
+	account, fips, region, china := match[1], match[2] != "", match[3], match[4] != ""
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cred, ok := e.tokens[host]; ok && e.now().Before(cred.ExpiresAt) {
+		return cred, true, nil
+	}
+
+	creds, ok, err := e.awsCreds(ctx, region)
+	if err != nil {
+		return Credential{}, false, fmt.Errorf("AWS credentials for %s: %w", host, err)
+	}
+	if !ok {
+		return Credential{}, false, nil
+	}
+	cred, expiresAt, err := e.fetchToken(ctx, creds, account, region, ecrEndpoint(region, fips, china))
+	if err != nil {
+		return Credential{}, false, fmt.Errorf("ECR authorization token for %s: %w", host, err)
+	}
+	logger.Info("Obtained ECR authorization token for %s, valid until %s", host, expiresAt.Format(time.RFC3339))
+	// Hand it out only until shortly before it expires.
+	cred.ExpiresAt = expiresAt.Add(-ecrRefreshMargin)
+	e.tokens[host] = cred
+	return cred, true, nil
+}
+
+// ecrEndpoint returns the ECR API endpoint of region, or the one set in
+// AWS_ENDPOINT_URL_ECR.
+func ecrEndpoint(region string, fips, china bool) string {
+	if endpoint := os.Getenv(EnvECREndpoint); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	host := "api.ecr." + region + ".amazonaws.com"
+	if fips {
+		host = "ecr-fips." + region + ".amazonaws.com"
+	}
+	if china {
+		host += ".cn"
+	}
+	return "https://" + host
+}
+
+// fetchToken calls GetAuthorizationToken for account and returns the
+// AWS:password pair it encodes with the time it expires.
+func (e *ecrCredentials) fetchToken(ctx context.Context, creds awsCredentials, account, region, endpoint string) (Credential, time.Time, error) {
+	body, err := json.Marshal(map[string][]string{"registryIds": {account}})
+	if err != nil {
+		return Credential{}, time.Time{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return Credential{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+	signAWSRequest(req, body, creds, region, "ecr", e.now())
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return Credential{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Credential{}, time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Type != "" {
+			return Credential{}, time.Time{}, fmt.Errorf("%s: %s", apiErr.Type, apiErr.Message)
+		}
+		return Credential{}, time.Time{}, statusError("ECR GetAuthorizationToken", "", resp, data)
+	}
+
+	var out struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"` // Seconds since the epoch
+		} `json:"authorizationData"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return Credential{}, time.Time{}, fmt.Errorf("decoding GetAuthorizationToken response: %w", err)
+	}
+	if len(out.AuthorizationData) == 0 {
+		return Credential{}, time.Time{}, errors.New("GetAuthorizationToken returned no authorization data")
+	}
+	auth := out.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(auth.AuthorizationToken)
+	if err != nil {
+		return Credential{}, time.Time{}, fmt.Errorf("decoding authorization token: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return Credential{}, time.Time{}, errors.New("authorization token is not a username:password pair")
+	}
+	seconds := int64(auth.ExpiresAt)
+	return Credential{Username: username, Password: password}, time.Unix(seconds, int64((auth.ExpiresAt-float64(seconds))*1e9)), nil
+}
+
+// awsCredentialsFromEnv reads AWS credentials from the environment, or from
+// the shared credentials file (AWS_SHARED_CREDENTIALS_FILE, by default
+// ~/.aws/credentials) under the AWS_PROFILE profile. ok is false when
+// neither has any.
+func awsCredentialsFromEnv() (awsCredentials, bool, error) {
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
+		return creds, true, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, false, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	return readAWSCredentialsFile(path, profile)
+}
+
+// readAWSCredentialsFile reads the keys of profile from an AWS shared
+// credentials file, an INI file with one [profile] section each. A missing
+// file or profile is not an error.
+func readAWSCredentialsFile(path, profile string) (awsCredentials, bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return awsCredentials{}, false, nil
+	}
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	defer file.Close()
+
+	var creds awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, false, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return creds, creds.AccessKeyID != "" && creds.SecretAccessKey != "", nil
+}
+
+// signAWSRequest signs req with AWS Signature Version 4 for service in
+// region, adding the X-Amz-Date, X-Amz-Security-Token and Authorization
+// headers. body is the request body, which req must also carry.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery sorts and encodes query parameters as SigV4 requires.
+func canonicalQuery(query map[string][]string) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters of
+// RFC 3986.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+)
+
+// DefaultMaxRequestsPerHost is the default limit on concurrent requests to
+// one registry host.
+const DefaultMaxRequestsPerHost = 16
+
+// hostLimits is shared by every registry client in the process, so many
+// resolvers and downloaders running at once still open a bounded number of
+// connections to each host.
+var hostLimits = newHostLimiter(DefaultMaxRequestsPerHost)
+
+// SetMaxRequestsPerHost sets the process-wide limit on concurrent requests to
+// one registry host (host:port), counted from sending a request until its
+// response body is closed or read to the end. n <= 0 removes the limit.
+// Requests already in flight keep their slots.
+func SetMaxRequestsPerHost(n int) {
+	hostLimits.setLimit(n)
+}
+
+type hostLimiter struct {
+	mu    sync.Mutex
+	limit int
+	hosts map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, hosts: make(map[string]chan struct{})}
+}
+
+func (l *hostLimiter) setLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = n
+	// Holders of the old semaphores release into them; new requests use
+	// fresh ones sized to the new limit.
+	l.hosts = make(map[string]chan struct{})
+}
+
+// acquire waits for a request slot for host and returns the function that
+// gives it back.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	l.mu.Lock()
+	if l.limit <= 0 {
+		l.mu.Unlock()
+		return func() {}, nil
+	}
+	sem, ok := l.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, l.limit)
+		l.hosts[host] = sem
+	}
+	l.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-sem }) }, nil
+}
+
+// limitedTransport holds a slot of its host for each request until the
+// response body is done. It also tags requests with the Operation of their
+// context, in the debug log and, when enabled, in OperationHeader.
+type limitedTransport struct {
+	base    http.RoundTripper
+	limiter *hostLimiter
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op, tagged := OperationFromContext(req.Context())
+	if tagged && operationHeader.Load() {
+		// A RoundTripper must not modify the caller's request.
+		req = req.Clone(req.Context())
+		req.Header.Set(OperationHeader, op.String())
+	}
+	release, err := t.limiter.acquire(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		requestCounts.record(0)
+		logger.Debug("%s %s%s: %v", req.Method, req.URL.Redacted(), opSuffix(op), err)
+		return nil, err
+	}
+	requestCounts.record(resp.StatusCode)
+	logger.Debug("%s %s%s: %d", req.Method, req.URL.Redacted(), opSuffix(op), resp.StatusCode)
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// opSuffix formats op for a request log line; untagged requests get none.
+func opSuffix(op Operation) string {
+	if op == (Operation{}) {
+		return ""
+	}
+	return " [" + op.String() + "]"
+}
+
+// releasingBody gives the request slot back at EOF or on Close, whichever
+// comes first.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimitedTransport_BoundsConcurrentRequests(t *testing.T) {
+	var active, peak int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &limitedTransport{base: http.DefaultTransport, limiter: newHostLimiter(2)}}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Errorf("Get() error = %v", err)
+				return
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&peak); got != 2 {
+		t.Fatalf("peak concurrent requests = %d, want 2", got)
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	t.Run("wait honours context", func(t *testing.T) {
+		l := newHostLimiter(1)
+		release, err := l.acquire(context.Background(), "r.example")
+		if err != nil {
+			t.Fatalf("acquire() error = %v", err)
+		}
+		defer release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := l.acquire(ctx, "r.example"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("acquire() error = %v, want deadline exceeded", err)
+		}
+		// Other hosts have their own slots.
+		other, err := l.acquire(context.Background(), "other.example")
+		if err != nil {
+			t.Fatalf("acquire() for other host error = %v", err)
+		}
+		other()
+	})
+
+	t.Run("release is idempotent", func(t *testing.T) {
+		l := newHostLimiter(1)
+		release, _ := l.acquire(context.Background(), "r.example")
+		release()
+		release()
+		held, err := l.acquire(context.Background(), "r.example")
+		if err != nil {
+			t.Fatalf("acquire() error = %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := l.acquire(ctx, "r.example"); err == nil {
+			t.Fatalf("double release freed a second slot")
+		}
+		held()
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		l := newHostLimiter(1)
+		l.setLimit(0)
+		for i := 0; i < 3; i++ {
+			if _, err := l.acquire(context.Background(), "r.example"); err != nil {
+				t.Fatalf("acquire() error = %v", err)
+			}
+		}
+	})
+}
+
+func TestRequestCounts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	before := RequestCounts()
+	client := newHTTPClient(false, DialOptions{})
+	for _, path := range []string{"/a", "/b", "/missing"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Get(%s) error = %v", path, err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := client.Get("http://127.0.0.1:1/unreachable"); err == nil {
+		t.Fatalf("Get() of a closed port succeeded")
+	}
+
+	after := RequestCounts()
+	for status, want := range map[int]int{200: 2, 404: 1, 0: 1} {
+		if got := after[status] - before[status]; got != want {
+			t.Errorf("requests with status %d = %d, want %d", status, got, want)
+		}
+	}
+}
+
+func TestLimitedTransport_OperationHeader(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(OperationHeader))
+	}))
+	defer server.Close()
+	defer SetOperationHeader(false)
+
+	client := &http.Client{Transport: &limitedTransport{base: http.DefaultTransport, limiter: newHostLimiter(0)}}
+	ctx := WithOperation(context.Background(), Operation{Command: "get", Image: "r.example/app:v1"})
+	ctx = WithOperation(ctx, Operation{Path: "etc/hosts"})
+	get := func(ctx context.Context) {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do() error = %v", err)
+		}
+		resp.Body.Close()
+		if req.Header.Get(OperationHeader) != "" {
+			t.Error("transport modified the caller's request")
+		}
+	}
+
+	get(ctx)
+	SetOperationHeader(true)
+	get(ctx)
+	get(context.Background())
+
+	want := []string{"", "command=get&image=r.example%2Fapp%3Av1&path=etc%2Fhosts", ""}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("request %d header = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ImageConfig is the subset of an OCI image config used by stargz-get.
+type ImageConfig struct {
+	Architecture string `json:"architecture,omitempty"`
+	OS           string `json:"os,omitempty"`
+	RootFS       RootFS `json:"rootfs"`
+}
+
+// RootFS lists the uncompressed digests (diff IDs) of an image's layers, in
+// the same order as the manifest's layers.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ReadImageConfig reads the config blob described by desc from storage and
+// verifies it against the descriptor's digest.
+func ReadImageConfig(ctx context.Context, storage Storage, desc Descriptor) (*ImageConfig, error) {
+	dgst, err := digest.Parse(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config digest %q: %w", desc.Digest, err)
+	}
+
+	body, err := storage.ReadBlob(ctx, dgst, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %w", err)
+	}
+	if got := dgst.Algorithm().FromBytes(data); got != dgst {
+		return nil, fmt.Errorf("image config digest mismatch: got %s, want %s", got, dgst)
+	}
+
+	var config ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	return &config, nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+// manifestCache keeps manifest responses on disk so later runs can
+// revalidate them with If-None-Match and, on a 304, skip the download. A tag
+// that moved gets a new ETag and therefore a full response, so the cache
+// never hides a push. Manifests fetched by digest are immutable and are
+// served without a request. The cache also remembers each repository's
+// WWW-Authenticate challenge, which only names the token realm, service and
+// scope, so a run can fetch its token up front instead of being refused
+// first. Tokens and credentials are never written.
+type manifestCache struct {
+	dir string
+}
+
+// cachedManifest is one cached manifest response, keyed by its URL.
+type cachedManifest struct {
+	URL    string        `json:"url"`
+	ETag   string        `json:"etag,omitempty"`
+	Digest digest.Digest `json:"digest"`
+	Data   []byte        `json:"data"`
+}
+
+// cachedChallenge is the auth challenge a repository answered with.
+type cachedChallenge struct {
+	Repository      string `json:"repository"`
+	WWWAuthenticate string `json:"wwwAuthenticate"`
+}
+
+func newManifestCache(dir string) *manifestCache {
+	if dir == "" {
+		return nil
+	}
+	return &manifestCache{dir: dir}
+}
+
+func (m *manifestCache) path(kind, key string) string {
+	return filepath.Join(m.dir, kind, digest.FromString(key).Encoded()+".json")
+}
+
+// manifestURLDigest returns the digest a manifest URL names, or "" when it
+// names a tag.
+func manifestURLDigest(url string) digest.Digest {
+	ref := url[strings.LastIndex(url, "/")+1:]
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return dgst
+}
+
+// load returns the cached response for url. Entries whose data does not
+// match their digest, or the digest the URL names, are ignored.
+func (m *manifestCache) load(url string) *cachedManifest {
+	if m == nil {
+		return nil
+	}
+	var entry cachedManifest
+	if !m.read(m.path("manifests", url), &entry) {
+		return nil
+	}
+	if entry.URL != url || entry.Digest.Validate() != nil || entry.Digest != entry.Digest.Algorithm().FromBytes(entry.Data) {
+		logger.Warn("Ignoring corrupt cached manifest for %s", url)
+		return nil
+	}
+	if want := manifestURLDigest(url); want != "" && want != entry.Digest {
+		return nil
+	}
+	return &entry
+}
+
+// store caches a manifest response. Responses to tag URLs are only kept when
+// they carry an ETag to revalidate with.
+func (m *manifestCache) store(url, etag string, data []byte) {
+	if m == nil || (etag == "" && manifestURLDigest(url) == "") {
+		return
+	}
+	algorithm := digest.Canonical
+	if want := manifestURLDigest(url); want != "" {
+		algorithm = want.Algorithm()
+	}
+	entry := cachedManifest{URL: url, ETag: etag, Digest: algorithm.FromBytes(data), Data: data}
+	m.write(m.path("manifests", url), entry)
+}
+
+// challenge returns the cached WWW-Authenticate challenge of a repository.
+func (m *manifestCache) challenge(registry, repository string) string {
+	if m == nil {
+		return ""
+	}
+	var entry cachedChallenge
+	key := tokenKey(registry, repository)
+	if !m.read(m.path("challenges", key), &entry) || entry.Repository != key {
+		return ""
+	}
+	return entry.WWWAuthenticate
+}
+
+func (m *manifestCache) storeChallenge(registry, repository, wwwAuth string) {
+	if m == nil || wwwAuth == "" {
+		return
+	}
+	key := tokenKey(registry, repository)
+	m.write(m.path("challenges", key), cachedChallenge{Repository: key, WWWAuthenticate: wwwAuth})
+}
+
+func (m *manifestCache) read(path string, v interface{}) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		logger.Warn("Ignoring corrupt cache entry %s: %v", path, err)
+		return false
+	}
+	return true
+}
+
+func (m *manifestCache) write(path string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	if err == nil {
+		// Write then rename so concurrent runs never observe a partial file.
+		tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		logger.Warn("Failed to write cache entry %s: %v", path, err)
+	}
+}
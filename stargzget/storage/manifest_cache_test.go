@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// etagRegistry serves test/app:latest behind bearer auth, answering
+// If-None-Match with 304 and counting what each request cost.
+type etagRegistry struct {
+	mu           sync.Mutex
+	manifest     []byte
+	full         int // 200 manifest responses
+	notModified  int // 304 manifest responses
+	unauthorized int // 401 manifest responses
+}
+
+func (r *etagRegistry) setLayer(layer string) {
+	body, _ := json.Marshal(Manifest{SchemaVersion: 2, Layers: []Layer{{Digest: digest.FromString(layer).String()}}})
+	r.mu.Lock()
+	r.manifest = body
+	r.mu.Unlock()
+}
+
+func (r *etagRegistry) serve(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if req.URL.Path == "/token" {
+			w.Write([]byte(`{"token":"t0ken"}`))
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer t0ken" {
+			r.unauthorized++
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:test/app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		etag := `"` + digest.FromBytes(r.manifest).String() + `"`
+		if req.Header.Get("If-None-Match") == etag {
+			r.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		r.full++
+		w.Header().Set("ETag", etag)
+		w.Write(r.manifest)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGetManifest_ManifestCache(t *testing.T) {
+	registry := &etagRegistry{}
+	registry.setLayer("v1")
+	server := registry.serve(t)
+	ref := strings.TrimPrefix(server.URL, "http://") + "/test/app:latest"
+	dir := t.TempDir()
+
+	// Each fetch uses a fresh client, as a new CLI invocation would.
+	fetch := func() *Manifest {
+		t.Helper()
+		manifest, err := NewRemoteRegistryStorage(false).WithManifestCacheDir(dir).GetManifest(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("GetManifest() error = %v", err)
+		}
+		return manifest
+	}
+
+	first := fetch()
+	if registry.full != 1 || registry.unauthorized != 1 {
+		t.Fatalf("first run: %d full, %d unauthorized; want 1 and 1", registry.full, registry.unauthorized)
+	}
+
+	second := fetch()
+	if second.Digest != first.Digest || registry.notModified != 1 || registry.full != 1 {
+		t.Fatalf("second run: digest %s (want %s), %d not modified, %d full; want a 304", second.Digest, first.Digest, registry.notModified, registry.full)
+	}
+	if registry.unauthorized != 1 {
+		t.Errorf("second run was refused %d times, want the cached challenge to authenticate up front", registry.unauthorized-1)
+	}
+
+	registry.setLayer("v2")
+	moved := fetch()
+	if moved.Digest == first.Digest || moved.Layers[0].Digest != digest.FromString("v2").String() || registry.full != 2 {
+		t.Fatalf("after the tag moved: %+v after %d full responses, want the v2 manifest", moved, registry.full)
+	}
+
+	// Nothing secret is written to the cache.
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if strings.Contains(string(data), "t0ken") {
+			t.Errorf("%s contains the bearer token", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetManifest_ManifestCacheByDigest(t *testing.T) {
+	server, children := newIndexRegistry(t)
+	ref := strings.TrimPrefix(server.URL, "http://") + "/test/app:latest"
+	dir := t.TempDir()
+
+	client := NewRemoteRegistryStorage(false).WithManifestCacheDir(dir)
+	if _, err := client.GetManifest(context.Background(), ref); err != nil {
+		t.Fatalf("GetManifest() error = %v", err)
+	}
+	// The index has no ETag and must be fetched again, but its child is
+	// immutable and comes from the cache even with the registry gone.
+	cached := NewRemoteRegistryStorage(false).WithManifestCacheDir(dir)
+	url := server.URL + "/v2/test/app/manifests/" + children["amd64"].String()
+	server.Close()
+	manifest, err := cached.fetchManifest(context.Background(), "", "", url)
+	if err != nil {
+		t.Fatalf("fetchManifest() by digest error = %v", err)
+	}
+	if manifest.Digest != children["amd64"] {
+		t.Fatalf("Digest = %s, want %s", manifest.Digest, children["amd64"])
+	}
+
+	// A cache entry that does not match the digest in its URL is ignored.
+	entry := newManifestCache(dir).load(url)
+	entry.Data = []byte(`{"schemaVersion":2}`)
+	entry.Digest = digest.FromBytes(entry.Data)
+	newManifestCache(dir).write(newManifestCache(dir).path("manifests", url), entry)
+	if _, err := cached.fetchManifest(context.Background(), "", "", url); err == nil {
+		t.Fatal("fetchManifest() used a cache entry that does not match the URL's digest")
+	}
+}
+
+func TestFetchManifest_SHA512(t *testing.T) {
+	body, _ := json.Marshal(Manifest{SchemaVersion: 2, Layers: []Layer{{Digest: digest.SHA512.FromString("layer").String()}}})
+	want := digest.SHA512.FromBytes(body)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Docker-Content-Digest", want.String())
+		w.Write(body)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	client := NewRemoteRegistryStorage(false).WithManifestCacheDir(dir)
+
+	// By tag, the digest follows the algorithm the registry reports.
+	manifest, err := client.fetchManifest(context.Background(), "", "", server.URL+"/v2/test/app/manifests/latest")
+	if err != nil {
+		t.Fatalf("fetchManifest() by tag error = %v", err)
+	}
+	if manifest.Digest != want {
+		t.Errorf("Digest = %s, want %s", manifest.Digest, want)
+	}
+
+	// By digest, the manifest is verified with the digest's algorithm and
+	// then served from the cache.
+	url := server.URL + "/v2/test/app/manifests/" + want.String()
+	if _, err := client.fetchManifest(context.Background(), "", "", url); err != nil {
+		t.Fatalf("fetchManifest() by digest error = %v", err)
+	}
+	server.Close()
+	cached, err := NewRemoteRegistryStorage(false).WithManifestCacheDir(dir).fetchManifest(context.Background(), "", "", url)
+	if err != nil {
+		t.Fatalf("fetchManifest() from cache error = %v", err)
+	}
+	if cached.Digest != want {
+		t.Errorf("cached Digest = %s, want %s", cached.Digest, want)
+	}
+}
+
+func TestFetchManifest_DigestMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"schemaVersion":2}`))
+	}))
+	defer server.Close()
+
+	client := NewRemoteRegistryStorage(false)
+	for _, requested := range []digest.Digest{digest.SHA512.FromString("other"), digest.FromString("other")} {
+		if _, err := client.fetchManifest(context.Background(), "", "", server.URL+"/v2/test/app/manifests/"+requested.String()); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+			t.Errorf("fetchManifest(%s) error = %v, want a digest mismatch", requested.Algorithm(), err)
+		}
+	}
+}
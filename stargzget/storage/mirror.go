@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+// MirrorStorage passes reads through to another Storage and spools every
+// byte it returns into an OCI image layout directory. Whole blobs land in
+// blobs/ once their digest verifies; ranges of blobs that were only partly
+// read are kept under .partial/ with a record of which spans are present.
+// A LocalStorage opened on the same directory can then replay the session
+// offline.
+//
+// Mirroring is best effort: failures to write the layout are logged and
+// never fail the read they came from.
+type MirrorStorage struct {
+	inner Storage
+	dir   string
+	sizes map[digest.Digest]int64
+
+	mu sync.Mutex // Guards span records and blob promotion
+}
+
+// NewMirrorStorage prepares dir as an OCI layout holding manifest under the
+// name ref and returns a Storage that mirrors reads from inner into it. The
+// manifest is stored as re-encoded JSON, so its digest in the layout can
+// differ from the registry's. The image config is copied right away.
+func NewMirrorStorage(ctx context.Context, inner Storage, dir string, manifest *Manifest, ref string) (*MirrorStorage, error) {
+	m := &MirrorStorage{
+		inner: inner,
+		dir:   dir,
+		sizes: make(map[digest.Digest]int64, len(manifest.Layers)),
+	}
+	for _, layer := range manifest.contentLayers() {
+		if dgst, err := digest.Parse(layer.Digest); err == nil {
+			m.sizes[dgst] = layer.Size
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ociLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return nil, err
+	}
+	if err := m.addManifest(manifest, ref); err != nil {
+		return nil, err
+	}
+	if manifest.Config.Digest != "" {
+		if err := m.copyBlob(ctx, manifest.Config); err != nil {
+			logger.Warn("Failed to mirror image config %s: %v", manifest.Config.Digest, err)
+		}
+	}
+	return m, nil
+}
+
+// addManifest stores manifest as a blob and names it ref in index.json,
+// replacing an earlier manifest of the same name.
+func (m *MirrorStorage) addManifest(manifest *Manifest, ref string) error {
+	data, mediaType, err := manifest.Encode()
+	if err != nil {
+		return err
+	}
+	dgst := digest.FromBytes(data)
+	if err := writeBlob(m.dir, dgst, data); err != nil {
+		return err
+	}
+
+	index := Manifest{SchemaVersion: 2, MediaType: ociIndexMedia}
+	if existing, err := os.ReadFile(filepath.Join(m.dir, ociIndexFile)); err == nil {
+		if err := json.Unmarshal(existing, &index); err != nil {
+			return fmt.Errorf("failed to parse existing %s: %w", ociIndexFile, err)
+		}
+	}
+	entries := index.Manifests[:0]
+	for _, desc := range index.Manifests {
+		if desc.Annotations[ociRefNameAnnotation] != ref {
+			entries = append(entries, desc)
+		}
+	}
+	desc := Descriptor{MediaType: mediaType, Digest: dgst.String(), Size: int64(len(data))}
+	if ref != "" {
+		desc.Annotations = map[string]string{ociRefNameAnnotation: ref}
+	}
+	index.Manifests = append(entries, desc)
+
+	data, err = json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(m.dir, ociIndexFile), data)
+}
+
+// copyBlob fetches a small blob such as the config in full and stores it.
+func (m *MirrorStorage) copyBlob(ctx context.Context, desc Descriptor) error {
+	dgst, err := digest.Parse(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(blobPath(m.dir, dgst)); err == nil {
+		return nil
+	}
+	body, err := m.inner.ReadBlob(ctx, dgst, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if got := dgst.Algorithm().FromBytes(data); got != dgst {
+		return fmt.Errorf("digest mismatch: got %s", got)
+	}
+	return writeBlob(m.dir, dgst, data)
+}
+
+// ListBlobs lists the blobs of the inner storage.
+func (m *MirrorStorage) ListBlobs(ctx context.Context) ([]BlobDescriptor, error) {
+	blobs, err := m.inner.ListBlobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	for _, blob := range blobs {
+		if blob.Size > 0 {
+			m.sizes[blob.Digest] = blob.Size
+		}
+	}
+	m.mu.Unlock()
+	return blobs, nil
+}
+
+// ReadBlob reads from the inner storage, spooling the returned bytes into
+// the layout as they are consumed.
+func (m *MirrorStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	body, err := m.inner.ReadBlob(ctx, dgst, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(blobPath(m.dir, dgst)); err == nil {
+		return body, nil
+	}
+
+	path := partialPath(m.dir, dgst)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		logger.Warn("Failed to mirror blob %s: %v", dgst, err)
+		return body, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		logger.Warn("Failed to mirror blob %s: %v", dgst, err)
+		return body, nil
+	}
+	return &mirrorReader{body: body, file: f, start: offset, off: offset, mirror: m, dgst: dgst}, nil
+}
+
+// BlobSize delegates to the inner storage when it can look up sizes.
+func (m *MirrorStorage) BlobSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	sizer, ok := m.inner.(BlobSizer)
+	if !ok {
+		return 0, fmt.Errorf("unknown size for blob: %s", dgst)
+	}
+	size, err := sizer.BlobSize(ctx, dgst)
+	if err == nil {
+		m.mu.Lock()
+		m.sizes[dgst] = size
+		m.mu.Unlock()
+	}
+	return size, err
+}
+
+// recordSpan notes that [start, end) of dgst is spooled, and promotes the
+// blob into blobs/ once every byte is present and its digest verifies.
+func (m *MirrorStorage) recordSpan(dgst digest.Digest, start, end int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := os.Stat(blobPath(m.dir, dgst)); err == nil {
+		return
+	}
+	spans, err := readSpans(m.dir, dgst)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Discarding span record: %v", err)
+		}
+		spans = &blobSpans{}
+	}
+	if size := m.sizes[dgst]; size > 0 {
+		spans.Size = size
+	}
+	spans.add(start, end)
+
+	if spans.complete() {
+		if err := m.promote(dgst, spans.Size); err != nil {
+			logger.Warn("Failed to complete mirrored blob %s: %v", dgst, err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(spans)
+	if err == nil {
+		err = writeFileAtomic(spansPath(m.dir, dgst), data)
+	}
+	if err != nil {
+		logger.Warn("Failed to record mirrored ranges of %s: %v", dgst, err)
+	}
+}
+
+// promote verifies a fully spooled blob and moves it into blobs/. A blob that
+// fails verification is dropped so it is spooled afresh next time.
+func (m *MirrorStorage) promote(dgst digest.Digest, size int64) error {
+	path := partialPath(m.dir, dgst)
+	defer os.Remove(spansPath(m.dir, dgst))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	verifier := dgst.Verifier()
+	_, err = io.Copy(verifier, io.NewSectionReader(f, 0, size))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		os.Remove(path)
+		return fmt.Errorf("spooled content does not match digest")
+	}
+	if err := os.Truncate(path, size); err != nil {
+		return err
+	}
+
+	final := blobPath(m.dir, dgst)
+	if err := os.MkdirAll(filepath.Dir(final), 0o755); err != nil {
+		return err
+	}
+	logger.Debug("Mirrored complete blob %s", dgst)
+	return os.Rename(path, final)
+}
+
+// mirrorReader copies what is read from body into the partial blob file at
+// the matching offset.
+type mirrorReader struct {
+	body   io.ReadCloser
+	file   *os.File
+	start  int64
+	off    int64
+	failed bool
+	mirror *MirrorStorage
+	dgst   digest.Digest
+}
+
+func (r *mirrorReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && !r.failed {
+		if _, werr := r.file.WriteAt(p[:n], r.off); werr != nil {
+			logger.Warn("Failed to mirror blob %s: %v", r.dgst, werr)
+			r.failed = true
+		}
+	}
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *mirrorReader) Close() error {
+	err := r.body.Close()
+	if cerr := r.file.Close(); cerr != nil && !r.failed {
+		logger.Warn("Failed to mirror blob %s: %v", r.dgst, cerr)
+		r.failed = true
+	}
+	if !r.failed && r.off > r.start {
+		r.mirror.recordSpan(r.dgst, r.start, r.off)
+	}
+	return err
+}
+
+// writeBlob stores data as the blob dgst.
+func writeBlob(dir string, dgst digest.Digest, data []byte) error {
+	path := blobPath(dir, dgst)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place,
+// so readers never observe a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+)
+
+func readAll(t *testing.T, s Storage, desc BlobDescriptor, offset, length int64) []byte {
+	t.Helper()
+	body, err := s.ReadBlob(context.Background(), desc.Digest, offset, length)
+	if err != nil {
+		t.Fatalf("ReadBlob(%d, %d) error = %v", offset, length, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read blob: %v", err)
+	}
+	return data
+}
+
+func TestMirrorStorage_ReplaysOffline(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMockStorage()
+	layerData := bytes.Repeat([]byte("0123456789"), 10)
+	layerDigest := inner.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layerData)
+	configData := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	configDigest := inner.AddBlob("application/vnd.oci.image.config.v1+json", configData)
+
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		Config:        Descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: configDigest.String(), Size: int64(len(configData))},
+		Layers:        []Layer{{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layerDigest.String(), Size: int64(len(layerData))}},
+	}
+	layer := BlobDescriptor{Digest: layerDigest, Size: int64(len(layerData))}
+
+	dir := t.TempDir()
+	mirror, err := NewMirrorStorage(ctx, inner, dir, manifest, "latest")
+	if err != nil {
+		t.Fatalf("NewMirrorStorage() error = %v", err)
+	}
+
+	// A ranged read is replayable on its own, but nothing else is.
+	if got := readAll(t, mirror, layer, 10, 20); !bytes.Equal(got, layerData[10:30]) {
+		t.Fatalf("mirrored read = %q", got)
+	}
+	local, err := NewLocalStorage(dir, "latest")
+	if err != nil {
+		t.Fatalf("NewLocalStorage() error = %v", err)
+	}
+	if got := readAll(t, local, layer, 15, 10); !bytes.Equal(got, layerData[15:25]) {
+		t.Fatalf("offline partial read = %q, want %q", got, layerData[15:25])
+	}
+	if _, err := local.ReadBlob(ctx, layerDigest, 0, 20); err == nil {
+		t.Fatalf("ReadBlob() of bytes never fetched should fail")
+	}
+	if _, err := os.Stat(blobPath(dir, layerDigest)); !os.IsNotExist(err) {
+		t.Fatalf("partial blob must not appear under blobs/, stat err = %v", err)
+	}
+
+	// Fetching the remaining bytes completes the blob.
+	readAll(t, mirror, layer, 0, 10)
+	readAll(t, mirror, layer, 30, 0)
+	if _, err := os.Stat(blobPath(dir, layerDigest)); err != nil {
+		t.Fatalf("complete blob was not promoted: %v", err)
+	}
+	if _, err := os.Stat(partialPath(dir, layerDigest)); !os.IsNotExist(err) {
+		t.Fatalf("partial file left behind, stat err = %v", err)
+	}
+
+	if got := readAll(t, local, layer, 0, 0); !bytes.Equal(got, layerData) {
+		t.Fatalf("offline full read mismatch")
+	}
+	blobs, err := local.ListBlobs(ctx)
+	if err != nil || len(blobs) != 1 || blobs[0].Digest != layerDigest {
+		t.Fatalf("ListBlobs() = %+v, %v", blobs, err)
+	}
+	config, err := ReadImageConfig(ctx, local, local.Manifest().Config)
+	if err != nil {
+		t.Fatalf("ReadImageConfig() from layout error = %v", err)
+	}
+	if config.Architecture != "amd64" {
+		t.Fatalf("config = %+v", config)
+	}
+	if _, err := NewLocalStorage(dir, "other"); err == nil {
+		t.Fatalf("NewLocalStorage() with an unknown ref should fail")
+	}
+}
+
+func TestBlobSpans_Add(t *testing.T) {
+	tests := []struct {
+		name string
+		adds [][2]int64
+		want [][2]int64
+	}{
+		{name: "disjoint", adds: [][2]int64{{20, 30}, {0, 10}}, want: [][2]int64{{0, 10}, {20, 30}}},
+		{name: "adjacent", adds: [][2]int64{{0, 10}, {10, 20}}, want: [][2]int64{{0, 20}}},
+		{name: "overlapping", adds: [][2]int64{{0, 15}, {10, 20}, {5, 8}}, want: [][2]int64{{0, 20}}},
+		{name: "bridging", adds: [][2]int64{{0, 5}, {10, 15}, {4, 11}}, want: [][2]int64{{0, 15}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var spans blobSpans
+			for _, a := range tt.adds {
+				spans.add(a[0], a[1])
+			}
+			if len(spans.Spans) != len(tt.want) {
+				t.Fatalf("spans = %v, want %v", spans.Spans, tt.want)
+			}
+			for i := range tt.want {
+				if spans.Spans[i] != tt.want[i] {
+					t.Fatalf("spans = %v, want %v", spans.Spans, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalStorage_Mmap(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMockStorage()
+	layerData := bytes.Repeat([]byte("0123456789"), 1000)
+	layerDigest := inner.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layerData)
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		Layers:        []Layer{{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layerDigest.String(), Size: int64(len(layerData))}},
+	}
+	layer := BlobDescriptor{Digest: layerDigest, Size: int64(len(layerData))}
+
+	dir := t.TempDir()
+	mirror, err := NewMirrorStorage(ctx, inner, dir, manifest, "latest")
+	if err != nil {
+		t.Fatalf("NewMirrorStorage() error = %v", err)
+	}
+	readAll(t, mirror, layer, 0, 0)
+
+	local, err := NewLocalStorage(dir, "latest")
+	if err != nil {
+		t.Fatalf("NewLocalStorage() error = %v", err)
+	}
+	defer local.Close()
+
+	ranges := []struct{ offset, length int64 }{{0, 0}, {10, 20}, {9990, 100}, {20000, 10}}
+	for _, s := range []*LocalStorage{local, local.WithoutMmap()} {
+		for _, r := range ranges {
+			got := readAll(t, s, layer, r.offset, r.length)
+			end := min(int64(len(layerData)), r.offset+r.length)
+			if r.length == 0 {
+				end = int64(len(layerData))
+			}
+			want := layerData[min(r.offset, end):end]
+			if !bytes.Equal(got, want) {
+				t.Errorf("noMmap=%v: ReadBlob(%d, %d) = %d bytes, want %d", s.noMmap, r.offset, r.length, len(got), len(want))
+			}
+		}
+	}
+	if _, mapped := local.mappedBlob(layerDigest); !mapped && mmapSupported {
+		t.Errorf("complete blob was not mapped")
+	}
+}
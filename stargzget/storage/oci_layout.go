@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	ociLayoutFile    = "oci-layout"
+	ociIndexFile     = "index.json"
+	ociIndexMedia    = "application/vnd.oci.image.index.v1+json"
+	ociManifestMedia = "application/vnd.oci.image.manifest.v1+json"
+
+	// ociRefNameAnnotation names a manifest within an OCI layout's index.
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	// containerdImageNameAnnotation holds the full image name in layouts
+	// exported by containerd and Docker.
+	containerdImageNameAnnotation = "io.containerd.image.name"
+
+	// partialDir holds blobs that were only partly fetched. It sits beside
+	// blobs/ rather than in it, so tools reading the layout never see a blob
+	// whose content does not match its digest.
+	partialDir = ".partial"
+)
+
+// blobPath returns where the complete blob dgst lives in the layout at dir.
+func blobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, filepath.FromSlash(layoutBlobName(dgst)))
+}
+
+// layoutBlobName is the slash-separated path of the blob dgst within an OCI
+// layout.
+func layoutBlobName(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// partialPath returns where the fetched ranges of dgst are spooled. The file
+// is sparse: bytes are stored at their offset in the blob.
+func partialPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, partialDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// blobSpans records which byte ranges of a partial blob are present.
+type blobSpans struct {
+	Size  int64      `json:"size,omitempty"` // Blob size, 0 if unknown
+	Spans [][2]int64 `json:"spans"`          // Sorted, disjoint [start, end) ranges
+}
+
+func spansPath(dir string, dgst digest.Digest) string {
+	return partialPath(dir, dgst) + ".json"
+}
+
+func readSpans(dir string, dgst digest.Digest) (*blobSpans, error) {
+	data, err := os.ReadFile(spansPath(dir, dgst))
+	if err != nil {
+		return nil, err
+	}
+	var spans blobSpans
+	if err := json.Unmarshal(data, &spans); err != nil {
+		return nil, fmt.Errorf("corrupt span record for %s: %w", dgst, err)
+	}
+	return &spans, nil
+}
+
+// add merges [start, end) into the recorded spans.
+func (s *blobSpans) add(start, end int64) {
+	spans := append(s.Spans, [2]int64{start, end})
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+
+	merged := spans[:1]
+	for _, span := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if span[0] <= last[1] {
+			if span[1] > last[1] {
+				last[1] = span[1]
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	s.Spans = merged
+}
+
+// covers reports whether [start, end) is present.
+func (s *blobSpans) covers(start, end int64) bool {
+	for _, span := range s.Spans {
+		if span[0] <= start && end <= span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// complete reports whether the whole blob is present.
+func (s *blobSpans) complete() bool {
+	return s.Size > 0 && s.covers(0, s.Size)
+}
+
+// LocalStorage reads an image from an OCI image layout directory. Besides
+// complete blobs, it serves ranges of blobs that a MirrorStorage spooled only
+// partly, so an earlier session can be replayed offline as long as it touches
+// the same bytes.
+//
+// Complete blobs are memory-mapped on first read and served from the mapping,
+// which spares extractions of whole layers a pread and a copy per chunk. Blob
+// files are never modified once in place, so mappings stay valid; partial
+// blobs, which a mirror may still be writing, and blobs that cannot be
+// mapped are read with regular IO.
+type LocalStorage struct {
+	dir      string
+	manifest *Manifest
+	noMmap   bool
+
+	mu     sync.Mutex
+	mapped map[digest.Digest][]byte // nil for blobs that could not be mapped
+}
+
+// NewLocalStorage opens the layout at dir and loads the manifest named ref
+// in its index. An empty ref selects the only manifest, or the first one if
+// the index holds several.
+func NewLocalStorage(dir, ref string) (*LocalStorage, error) {
+	readFile := func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	}
+	manifest, err := loadLayoutManifest("OCI layout "+dir, readFile, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStorage{dir: dir, manifest: manifest}, nil
+}
+
+// loadLayoutManifest loads the manifest named ref in the index of the OCI
+// layout that readFile reads files from, by slash-separated path within the
+// layout, and checks it against its digest. ref matches the ref name
+// annotation or, as in containerd and Docker exports, the full image name.
+// A manifest that is itself an index, as exports of multi-platform images
+// hold, resolves to its first image child present in the layout. where
+// names the layout in errors.
+func loadLayoutManifest(where string, readFile func(name string) ([]byte, error), ref string) (*Manifest, error) {
+	data, err := readFile(ociIndexFile)
+	if err != nil {
+		return nil, fmt.Errorf("not an OCI layout: %w", err)
+	}
+	var index Manifest
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ociIndexFile, err)
+	}
+
+	var desc *Descriptor
+	for i := range index.Manifests {
+		annotations := index.Manifests[i].Annotations
+		if ref == "" || annotations[ociRefNameAnnotation] == ref || annotations[containerdImageNameAnnotation] == ref {
+			desc = &index.Manifests[i]
+			break
+		}
+	}
+	if desc == nil {
+		if ref == "" {
+			return nil, fmt.Errorf("%s has no manifests", where)
+		}
+		return nil, fmt.Errorf("%s has no manifest named %q", where, ref)
+	}
+
+	manifest, err := readLayoutManifest(readFile, desc.Digest)
+	if err != nil || len(manifest.Manifests) == 0 {
+		return manifest, err
+	}
+	for i := range manifest.Manifests {
+		child := &manifest.Manifests[i]
+		if child.IsAttestation() {
+			continue
+		}
+		if childManifest, err := readLayoutManifest(readFile, child.Digest); err == nil {
+			childManifest.Selected = child
+			childManifest.Index = manifest.Manifests
+			return childManifest, nil
+		}
+	}
+	return nil, fmt.Errorf("%s holds none of the %d manifests of index %s", where, len(manifest.Manifests), manifest.Digest)
+}
+
+// readLayoutManifest reads the manifest blob with digest digestStr from a
+// layout and checks it against the digest.
+func readLayoutManifest(readFile func(name string) ([]byte, error), digestStr string) (*Manifest, error) {
+	dgst, err := digest.Parse(digestStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest digest %q: %w", digestStr, err)
+	}
+	data, err := readFile(layoutBlobName(dgst))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", dgst, err)
+	}
+	if got := dgst.Algorithm().FromBytes(data); got != dgst {
+		return nil, fmt.Errorf("manifest digest mismatch: got %s, want %s", got, dgst)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", dgst, err)
+	}
+	manifest.Digest = dgst
+	flattenBuildCache(&manifest)
+	return &manifest, nil
+}
+
+// WithoutMmap returns a storage for the same layout that reads blobs with
+// regular IO, e.g. on network filesystems where mappings misbehave.
+func (s *LocalStorage) WithoutMmap() *LocalStorage {
+	return &LocalStorage{dir: s.dir, manifest: s.manifest, noMmap: true}
+}
+
+// Close unmaps the blobs mapped so far. Readers returned by ReadBlob must not
+// be used afterwards.
+func (s *LocalStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for dgst, data := range s.mapped {
+		if data != nil {
+			if err := munmap(data); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(s.mapped, dgst)
+	}
+	return firstErr
+}
+
+// mappedBlob returns the mapping of the complete blob dgst, mapping it on
+// first use. ok is false when the blob is missing, empty or cannot be
+// mapped, so the caller falls back to regular IO.
+func (s *LocalStorage) mappedBlob(dgst digest.Digest) ([]byte, bool) {
+	if s.noMmap {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if data, ok := s.mapped[dgst]; ok {
+		return data, data != nil
+	}
+
+	f, err := os.Open(blobPath(s.dir, dgst))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 || info.Size() != int64(int(info.Size())) {
+		return nil, false
+	}
+	data, err := mmapFile(f, info.Size())
+	if err != nil {
+		logger.Debug("Reading blob %s without mmap: %v", dgst, err)
+		data = nil
+	}
+	if s.mapped == nil {
+		s.mapped = make(map[digest.Digest][]byte)
+	}
+	s.mapped[dgst] = data
+	return data, data != nil
+}
+
+// Manifest returns the manifest the storage was opened with.
+func (s *LocalStorage) Manifest() *Manifest {
+	return s.manifest
+}
+
+// ListBlobs lists the layers of the manifest.
+func (s *LocalStorage) ListBlobs(ctx context.Context) ([]BlobDescriptor, error) {
+	layers := s.manifest.contentLayers()
+	blobs := make([]BlobDescriptor, 0, len(layers))
+	for _, layer := range layers {
+		dgst, err := digest.Parse(layer.Digest)
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, BlobDescriptor{
+			Digest:           dgst,
+			Size:             layer.Size,
+			MediaType:        layer.MediaType,
+			UncompressedSize: layer.UncompressedSize(),
+			Annotations:      layer.Annotations,
+		})
+	}
+	return blobs, nil
+}
+
+// ReadBlob reads a range of a blob. A length of 0 or less reads to the end.
+// Ranges of partial blobs must lie entirely within what was spooled.
+func (s *LocalStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must be non-negative")
+	}
+
+	if data, ok := s.mappedBlob(dgst); ok {
+		end := int64(len(data))
+		if length > 0 && offset+length < end {
+			end = offset + length
+		}
+		return io.NopCloser(bytes.NewReader(data[min(offset, end):end])), nil
+	}
+
+	f, err := os.Open(blobPath(s.dir, dgst))
+	if err == nil {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return sectionReadCloser(f, offset, length, info.Size()), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	spans, err := readSpans(s.dir, dgst)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blob %s is not in the OCI layout", dgst)
+		}
+		return nil, err
+	}
+	end := offset + length
+	if length <= 0 {
+		if spans.Size == 0 {
+			return nil, fmt.Errorf("blob %s is only partly in the OCI layout and its size is unknown", dgst)
+		}
+		end = spans.Size
+	}
+	if !spans.covers(offset, end) {
+		return nil, fmt.Errorf("bytes %d-%d of blob %s were not fetched into the OCI layout", offset, end-1, dgst)
+	}
+
+	f, err = os.Open(partialPath(s.dir, dgst))
+	if err != nil {
+		return nil, err
+	}
+	return sectionReadCloser(f, offset, end-offset, end), nil
+}
+
+// BlobSize returns the size of a complete blob, or the recorded size of a
+// partial one.
+func (s *LocalStorage) BlobSize(ctx context.Context, dgst digest.Digest) (int64, error) {
+	if info, err := os.Stat(blobPath(s.dir, dgst)); err == nil {
+		return info.Size(), nil
+	}
+	spans, err := readSpans(s.dir, dgst)
+	if err != nil || spans.Size == 0 {
+		return 0, fmt.Errorf("unknown size for blob %s", dgst)
+	}
+	return spans.Size, nil
+}
+
+// sectionReadCloser reads length bytes of f from offset, clamped to size, and
+// closes f when done.
+func sectionReadCloser(f *os.File, offset, length, size int64) io.ReadCloser {
+	if length <= 0 || offset+length > size {
+		length = size - offset
+	}
+	if length < 0 {
+		length = 0
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"net/url"
+	"sync/atomic"
+)
+
+// OperationHeader is the request header that carries the Operation of a
+// registry request when SetOperationHeader enables it.
+const OperationHeader = "X-Starget-Operation"
+
+// Operation describes what a registry request is made for, so registry
+// logs can be matched to client activity. It travels in the request's
+// context; fields left empty are unknown.
+type Operation struct {
+	Command string // CLI command or other caller-chosen name, e.g. "get"
+	Image   string // Image reference, or registry/repository for blob requests
+	Path    string // File in the image the request is downloading
+}
+
+// String encodes the operation as a URL query, e.g.
+// "command=get&image=ghcr.io%2Fapp%3Av1&path=etc%2Fhosts", which is also
+// the value of OperationHeader.
+func (o Operation) String() string {
+	v := url.Values{}
+	if o.Command != "" {
+		v.Set("command", o.Command)
+	}
+	if o.Image != "" {
+		v.Set("image", o.Image)
+	}
+	if o.Path != "" {
+		v.Set("path", o.Path)
+	}
+	return v.Encode()
+}
+
+type operationKey struct{}
+
+// WithOperation returns a context whose registry requests are tagged with
+// op. Fields op leaves empty keep the values ctx already carries, so a
+// command can set the command name once and a downloader add each file's
+// path below it.
+func WithOperation(ctx context.Context, op Operation) context.Context {
+	if parent, ok := OperationFromContext(ctx); ok {
+		if op.Command == "" {
+			op.Command = parent.Command
+		}
+		if op.Image == "" {
+			op.Image = parent.Image
+		}
+		if op.Path == "" {
+			op.Path = parent.Path
+		}
+	}
+	return context.WithValue(ctx, operationKey{}, op)
+}
+
+// OperationFromContext returns the operation ctx is tagged with.
+func OperationFromContext(ctx context.Context) (Operation, bool) {
+	op, ok := ctx.Value(operationKey{}).(Operation)
+	return op, ok
+}
+
+// withDefaultImage tags ctx with image unless it already names one.
+func withDefaultImage(ctx context.Context, image string) context.Context {
+	if op, ok := OperationFromContext(ctx); ok && op.Image != "" {
+		return ctx
+	}
+	return WithOperation(ctx, Operation{Image: image})
+}
+
+// operationHeader is process-wide, like the host limit.
+var operationHeader atomic.Bool
+
+// SetOperationHeader turns sending OperationHeader on registry requests on
+// or off for the whole process. It is off by default, as the header tells
+// the registry which files are read.
+func SetOperationHeader(enabled bool) {
+	operationHeader.Store(enabled)
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
+	"github.com/opencontainers/go-digest"
+)
+
+// pingRangeLength is how many bytes the blob step of Ping reads from the end
+// of a layer, about what an eStargz footer read costs.
+const pingRangeLength = 64
+
+// maxPingBody caps how much of a response Ping reads, in case a registry
+// ignores the range and sends a whole layer.
+const maxPingBody = 1 << 20
+
+// PingStep is one timed step of Ping.
+type PingStep struct {
+	Name    string        // "ping", "token", "manifest" or "blob range"
+	Latency time.Duration // Time until the step's response was read in full
+	Status  int           // HTTP status of the step's last response; 0 if there was none
+	Detail  string        // What the step found, e.g. the auth scheme or the blob read
+	Err     error
+}
+
+// PingReport describes a registry's health as seen from this host.
+type PingReport struct {
+	Registry   string
+	Repository string // Empty when only the registry was probed
+	Steps      []PingStep
+
+	AuthScheme    string // "bearer", "basic", or "" for anonymous access
+	Protocol      string // HTTP version of the /v2/ response, e.g. "HTTP/2.0"
+	BlobProtocol  string // HTTP version of the blob response, which may come from a CDN
+	RangeRequests string // "yes" (206), "no" (200 with the whole blob) or "" when not probed
+	BlobRedirect  string // Host that served the blob after redirects, if not the registry
+}
+
+// HTTP2 reports whether the registry answered over HTTP/2.
+func (r *PingReport) HTTP2() bool {
+	return strings.HasPrefix(r.Protocol, "HTTP/2")
+}
+
+// Failed returns the first failed step, or nil.
+func (r *PingReport) Failed() *PingStep {
+	for i := range r.Steps {
+		if r.Steps[i].Err != nil {
+			return &r.Steps[i]
+		}
+	}
+	return nil
+}
+
+// Ping times the requests a download is made of, so users can tell a slow
+// registry from a slow network: the /v2/ ping, token acquisition, and, when
+// imageRef names an image rather than just a registry, the manifest fetch
+// and a tiny range read from the end of the first layer. It also reports
+// the auth scheme, HTTP/2, range support and whether blobs are redirected
+// to another host such as a CDN. The manifest cache is bypassed.
+//
+// Steps stop at the first failure; the report so far is returned together
+// with nil error, so callers inspect Failed.
+func (c *RemoteRegistryStorage) Ping(ctx context.Context, imageRef string) (*PingReport, error) {
+	registry, repository, identifier := imageRef, "", ""
+	if strings.Contains(imageRef, "/") {
+		ref, err := refs.Parse(imageRef)
+		if err != nil {
+			return nil, err
+		}
+		registry, repository, identifier = ref.Registry, ref.Repository, ref.Identifier()
+	}
+	c = c.WithManifestCacheDir("")
+	report := &PingReport{Registry: registry, Repository: repository}
+
+	// /v2/ without credentials: the registry says how to authenticate.
+	wwwAuth, ok := c.pingStep(ctx, report, registryURL(registry)+"/v2/")
+	if !ok {
+		return report, nil
+	}
+
+	if repository == "" {
+		if wwwAuth != "" {
+			c.tokenStep(ctx, report, registry, "", wwwAuth)
+		}
+		return report, nil
+	}
+
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", registryURL(registry), repository, identifier)
+	manifest, ok := c.manifestStep(ctx, report, registry, repository, url)
+	if !ok {
+		return report, nil
+	}
+
+	var layer *Layer
+	for _, l := range manifest.contentLayers() {
+		if l.Size > 0 {
+			layer = &l
+			break
+		}
+	}
+	if layer == nil {
+		report.Steps = append(report.Steps, PingStep{Name: "blob range", Detail: "skipped: the manifest lists no sized layers"})
+		return report, nil
+	}
+	c.blobStep(ctx, report, registry, repository, layer)
+	return report, nil
+}
+
+// pingStep requests /v2/ anonymously and returns the auth challenge, if any.
+func (c *RemoteRegistryStorage) pingStep(ctx context.Context, report *PingReport, url string) (string, bool) {
+	step := PingStep{Name: "ping"}
+	start := time.Now()
+	resp, err := c.timedGet(ctx, url, nil)
+	step.Latency = time.Since(start)
+	defer func() { report.Steps = append(report.Steps, step) }()
+	if err != nil {
+		step.Err = err
+		return "", false
+	}
+
+	step.Status = resp.StatusCode
+	report.Protocol = resp.Proto
+	wwwAuth := resp.Header.Get("WWW-Authenticate")
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		step.Detail = "anonymous access"
+	case resp.StatusCode == http.StatusUnauthorized && wwwAuth != "":
+		report.AuthScheme = strings.ToLower(strings.SplitN(wwwAuth, " ", 2)[0])
+		step.Detail = report.AuthScheme + " auth required"
+	default:
+		step.Err = statusError("registry ping", report.Registry, resp, nil)
+		return "", false
+	}
+	return wwwAuth, true
+}
+
+// tokenStep authenticates against wwwAuth, timing the token request.
+func (c *RemoteRegistryStorage) tokenStep(ctx context.Context, report *PingReport, registry, repository, wwwAuth string) bool {
+	step := PingStep{Name: "token"}
+	start := time.Now()
+	err := c.authenticate(ctx, registry, repository, c.tokens.get(registry, repository), wwwAuth)
+	if err == nil && repository == "" {
+		// Nothing else will use the credentials; check them on /v2/.
+		err = c.pingRegistry(ctx, registry, registryURL(registry)+"/v2/")
+	}
+	step.Latency = time.Since(start)
+	step.Err = err
+	if err == nil {
+		step.Detail = "credentials accepted"
+		if c.tokens.get(registry, repository) != "" {
+			step.Detail = "token acquired"
+		}
+	}
+	report.Steps = append(report.Steps, step)
+	return err == nil
+}
+
+// manifestStep fetches the manifest at url, authenticating if asked to, and
+// resolves an index to its first image.
+func (c *RemoteRegistryStorage) manifestStep(ctx context.Context, report *PingReport, registry, repository, url string) (*Manifest, bool) {
+	step := PingStep{Name: "manifest"}
+	start := time.Now()
+	manifest, err := c.fetchManifest(ctx, registry, repository, url)
+	if isAuthError(err) {
+		if !c.tokenStep(ctx, report, registry, repository, extractWWWAuth(err)) {
+			return nil, false
+		}
+		start = time.Now()
+		manifest, err = c.fetchManifest(ctx, registry, repository, url)
+	}
+	if err == nil && len(manifest.Manifests) > 0 {
+		var child *Descriptor
+		if child, err = selectChildManifest(manifest.Manifests, "", nil); err == nil {
+			step.Detail = fmt.Sprintf("index, first image %s", child.Platform)
+			childURL := url[:strings.LastIndex(url, "/")+1] + child.Digest
+			manifest, err = c.fetchManifest(ctx, registry, repository, childURL)
+		}
+	}
+	step.Latency = time.Since(start)
+	step.Err = err
+	if err == nil {
+		step.Status = http.StatusOK
+		if step.Detail == "" {
+			step.Detail = fmt.Sprintf("%d layer(s)", len(manifest.contentLayers()))
+		}
+	}
+	report.Steps = append(report.Steps, step)
+	return manifest, err == nil
+}
+
+// blobStep reads the last bytes of layer and records how they were served.
+func (c *RemoteRegistryStorage) blobStep(ctx context.Context, report *PingReport, registry, repository string, layer *Layer) {
+	step := PingStep{Name: "blob range"}
+	defer func() { report.Steps = append(report.Steps, step) }()
+	if _, err := digest.Parse(layer.Digest); err != nil {
+		step.Err = err
+		return
+	}
+
+	length := min(int64(pingRangeLength), layer.Size)
+	url := fmt.Sprintf("%s/v2/%s/blobs/%s", registryURL(registry), repository, layer.Digest)
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", layer.Size-length, layer.Size-1)}}
+
+	start := time.Now()
+	resp, err := c.timedGet(ctx, url, func(req *http.Request) {
+		req.Header = header
+		c.applyAuth(req, registry, repository)
+	})
+	step.Latency = time.Since(start)
+	if err != nil {
+		step.Err = err
+		return
+	}
+	step.Status = resp.StatusCode
+	report.BlobProtocol = resp.Proto
+	if host := resp.Request.URL.Host; host != registry {
+		report.BlobRedirect = host
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		report.RangeRequests = "yes"
+		step.Detail = fmt.Sprintf("%d bytes of %s", length, layer.Digest)
+	case http.StatusOK:
+		report.RangeRequests = "no"
+		step.Detail = "range ignored, whole blob served"
+	default:
+		step.Err = statusError("range request", registry, resp, nil)
+	}
+}
+
+// timedGet performs a GET and reads the response body (up to maxPingBody)
+// before closing it, so the caller's timing covers the transfer. prepare may
+// set headers.
+func (c *RemoteRegistryStorage) timedGet(ctx context.Context, url string, prepare func(*http.Request)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if prepare != nil {
+		prepare(req)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxPingBody)); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
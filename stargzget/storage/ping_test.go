@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestPing(t *testing.T) {
+	blob := []byte(strings.Repeat("layer data ", 100))
+	blobDigest := digest.FromBytes(blob)
+
+	// The CDN serves blob ranges; the registry redirects to it.
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "blob", time.Time{}, strings.NewReader(string(blob)))
+	}))
+	defer cdn.Close()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"token":"abc"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/test/app/manifests/latest":
+			body, _ := json.Marshal(Manifest{SchemaVersion: 2, Layers: []Layer{{Digest: blobDigest.String(), Size: int64(len(blob))}}})
+			w.Write(body)
+		case "/v2/test/app/blobs/" + blobDigest.String():
+			http.Redirect(w, r, cdn.URL+"/blob", http.StatusTemporaryRedirect)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	client := NewRemoteRegistryStorage(false)
+
+	tests := []struct {
+		name      string
+		ref       string
+		wantSteps []string
+	}{
+		{name: "registry", ref: host, wantSteps: []string{"ping", "token"}},
+		{name: "image", ref: host + "/test/app:latest", wantSteps: []string{"ping", "token", "manifest", "blob range"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := client.Ping(context.Background(), tt.ref)
+			if err != nil {
+				t.Fatalf("Ping() error = %v", err)
+			}
+			if failed := report.Failed(); failed != nil {
+				t.Fatalf("step %s failed: %v", failed.Name, failed.Err)
+			}
+			var names []string
+			for _, step := range report.Steps {
+				names = append(names, step.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantSteps, ",") {
+				t.Fatalf("steps = %v, want %v", names, tt.wantSteps)
+			}
+			if report.AuthScheme != "bearer" || report.Protocol != "HTTP/1.1" {
+				t.Errorf("auth %q over %q, want bearer over HTTP/1.1", report.AuthScheme, report.Protocol)
+			}
+		})
+	}
+
+	report, _ := client.Ping(context.Background(), host+"/test/app:latest")
+	if report.RangeRequests != "yes" || report.BlobRedirect != strings.TrimPrefix(cdn.URL, "http://") {
+		t.Errorf("range %q, redirect %q; want ranges served by %s", report.RangeRequests, report.BlobRedirect, cdn.URL)
+	}
+	if blobStep := report.Steps[len(report.Steps)-1]; blobStep.Status != http.StatusPartialContent {
+		t.Errorf("blob step status = %d, want 206", blobStep.Status)
+	}
+
+	// A missing image fails the manifest step and stops there.
+	report, _ = client.Ping(context.Background(), host+"/test/gone:latest")
+	if failed := report.Failed(); failed == nil || failed.Name != "manifest" {
+		t.Fatalf("Failed() = %+v, want the manifest step", failed)
+	}
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+// Pusher is implemented by storages that can publish to their repository,
+// such as the registry storage NewStorage returns. Pushing needs a token
+// with push scope; it is requested when the registry refuses the pull
+// scope, or up front with WithTokenScope.
+type Pusher interface {
+	// PushBlob uploads the blob desc describes, reading desc.Size bytes of
+	// content. A blob the repository already holds is not uploaded again.
+	PushBlob(ctx context.Context, desc Descriptor, content io.ReaderAt) error
+	// PushManifest stores data, a manifest of mediaType, under reference (a
+	// tag or digest) and returns the manifest's digest.
+	PushManifest(ctx context.Context, reference, mediaType string, data []byte) (digest.Digest, error)
+}
+
+var _ Pusher = (*registryBlobStorage)(nil)
+
+// PushBlob uploads a blob in one request after opening an upload session,
+// the monolithic upload of the distribution spec.
+func (s *registryBlobStorage) PushBlob(ctx context.Context, desc Descriptor, content io.ReaderAt) error {
+	dgst, err := digest.Parse(desc.Digest)
+	if err != nil {
+		return fmt.Errorf("invalid blob digest %q: %w", desc.Digest, err)
+	}
+	ctx = withDefaultImage(ctx, s.registry+"/"+s.repository)
+
+	_, err = s.BlobSize(ctx, dgst)
+	if err == nil {
+		logger.Debug("Blob %s already in %s/%s", dgst, s.registry, s.repository)
+		return nil
+	}
+	var status *stargzerrors.HTTPStatusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	uploadsURL := fmt.Sprintf("%s/v2/%s/blobs/uploads/", registryURL(s.registry), s.repository)
+	var location string
+	err = s.withAuth(ctx, func() (err error) {
+		location, err = s.startUpload(ctx, uploadsURL)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.withAuth(ctx, func() error {
+		return s.putBlob(ctx, location, dgst, io.NewSectionReader(content, 0, desc.Size), desc.Size)
+	})
+}
+
+// startUpload opens an upload session and returns its absolute location.
+func (s *registryBlobStorage) startUpload(ctx context.Context, uploadsURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadsURL, nil)
+	if err != nil {
+		return "", err
+	}
+	s.applyAuth(req)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", &authError{wwwAuth: resp.Header.Get("WWW-Authenticate")}
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(resp.Body)
+		return "", s.denied(statusError("blob upload request", s.registry, resp, body), req, resp)
+	}
+	location, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return "", fmt.Errorf("blob upload response has no usable Location")
+	}
+	return location.String(), nil
+}
+
+// putBlob completes the upload session at location with the whole blob.
+func (s *registryBlobStorage) putBlob(ctx context.Context, location string, dgst digest.Digest, content io.Reader, size int64) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("digest", dgst.String())
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	s.applyAuth(req)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return &authError{wwwAuth: resp.Header.Get("WWW-Authenticate")}
+	}
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return s.denied(statusError("blob upload", s.registry, resp, body), req, resp)
+	}
+	return nil
+}
+
+// PushManifest stores a manifest under reference.
+func (s *registryBlobStorage) PushManifest(ctx context.Context, reference, mediaType string, data []byte) (digest.Digest, error) {
+	ctx = withDefaultImage(ctx, s.registry+"/"+s.repository)
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", registryURL(s.registry), s.repository, reference)
+	var pushed digest.Digest
+	err := s.withAuth(ctx, func() (err error) {
+		pushed, err = s.putManifest(ctx, manifestURL, mediaType, data)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return pushed, nil
+}
+
+func (s *registryBlobStorage) putManifest(ctx context.Context, manifestURL, mediaType string, data []byte) (digest.Digest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, manifestURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	s.applyAuth(req)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", &authError{wwwAuth: resp.Header.Get("WWW-Authenticate")}
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", s.denied(statusError("manifest upload", s.registry, resp, body), req, resp)
+	}
+	want := digest.FromBytes(data)
+	if sent, err := digest.Parse(resp.Header.Get("Docker-Content-Digest")); err == nil && sent.Algorithm() == want.Algorithm() && sent != want {
+		return "", fmt.Errorf("registry stored manifest as %s, want %s", sent, want)
+	}
+	return want, nil
+}
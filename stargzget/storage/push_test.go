@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// newPushRegistry accepts monolithic blob uploads and manifest pushes from
+// clients holding a push-scoped token, and serves what was pushed. It
+// counts the uploads completed.
+func newPushRegistry(t *testing.T) (*httptest.Server, *int) {
+	t.Helper()
+	var mu sync.Mutex
+	blobs := make(map[string][]byte)
+	manifests := make(map[string][]byte)
+	uploads := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/token" {
+			json.NewEncoder(w).Encode(map[string]string{"token": r.URL.Query().Get("scope")})
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.Contains(token, "push") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:test/app:pull,push"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v2/test/app")
+		switch {
+		case r.Method == http.MethodPost && path == "/blobs/uploads/":
+			w.Header().Set("Location", "/v2/test/app/blobs/uploads/session?state=abc")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && path == "/blobs/uploads/session":
+			data, _ := io.ReadAll(r.Body)
+			if r.URL.Query().Get("state") != "abc" || digest.FromBytes(data).String() != r.URL.Query().Get("digest") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			blobs[r.URL.Query().Get("digest")] = data
+			uploads++
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasPrefix(path, "/blobs/"):
+			data, ok := blobs[strings.TrimPrefix(path, "/blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case r.Method == http.MethodPut && strings.HasPrefix(path, "/manifests/"):
+			data, _ := io.ReadAll(r.Body)
+			manifests[strings.TrimPrefix(path, "/manifests/")] = data
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasPrefix(path, "/manifests/"):
+			data, ok := manifests[strings.TrimPrefix(path, "/manifests/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", ociManifestMedia)
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &uploads
+}
+
+func TestPusher(t *testing.T) {
+	ctx := context.Background()
+	server, uploads := newPushRegistry(t)
+	host := strings.TrimPrefix(server.URL, "http://")
+	client := NewRemoteRegistryStorage(false)
+	pusher := client.NewStorage(host, "test/app", nil).(Pusher)
+
+	layer := []byte("layer data")
+	desc := Descriptor{MediaType: ociLayerGzipMedia, Digest: digest.FromBytes(layer).String(), Size: int64(len(layer))}
+	for i := 0; i < 2; i++ {
+		if err := pusher.PushBlob(ctx, desc, bytes.NewReader(layer)); err != nil {
+			t.Fatalf("PushBlob() #%d error = %v", i+1, err)
+		}
+	}
+	if *uploads != 1 {
+		t.Errorf("uploads = %d, want 1: the second push finds the blob", *uploads)
+	}
+
+	manifest := &Manifest{SchemaVersion: 2, MediaType: ociManifestMedia, Layers: []Layer{{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size}}}
+	data, mediaType, err := manifest.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := pusher.PushManifest(ctx, "v1", mediaType, data)
+	if err != nil || pushed != digest.FromBytes(data) {
+		t.Fatalf("PushManifest() = %s, %v; want %s", pushed, err, digest.FromBytes(data))
+	}
+
+	got, err := client.GetManifest(ctx, host+"/test/app:v1")
+	if err != nil || got.Digest != pushed || len(got.Layers) != 1 {
+		t.Fatalf("GetManifest() of the pushed tag = %+v, %v", got, err)
+	}
+	body, err := client.NewStorage(host, "test/app", got).ReadBlob(ctx, digest.FromBytes(layer), 0, 0)
+	if err != nil {
+		t.Fatalf("ReadBlob() of the pushed layer error = %v", err)
+	}
+	defer body.Close()
+	if read, _ := io.ReadAll(body); !bytes.Equal(read, layer) {
+		t.Errorf("pushed layer = %q, want %q", read, layer)
+	}
+}
@@ -0,0 +1,36 @@
+package storage
+
+import "sync"
+
+// requestCounts counts the responses of every registry client in the
+// process, like hostLimits, so a command can report them however many
+// clients it built.
+var requestCounts = &statusCounter{counts: make(map[int]int)}
+
+// RequestCounts returns how many registry requests this process has made,
+// by HTTP status code; requests that got no response (connection errors,
+// timeouts) are counted under 0. Redirects followed count once per hop.
+func RequestCounts() map[int]int {
+	return requestCounts.snapshot()
+}
+
+type statusCounter struct {
+	mu     sync.Mutex
+	counts map[int]int
+}
+
+func (c *statusCounter) record(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[status]++
+}
+
+func (c *statusCounter) snapshot() map[int]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[int]int, len(c.counts))
+	for status, n := range c.counts {
+		counts[status] = n
+	}
+	return counts
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	_ "crypto/sha512" // Registers sha384 and sha512 with go-digest
 	"io"
 
 	"github.com/opencontainers/go-digest"
@@ -9,9 +10,11 @@ import (
 
 // BlobDescriptor describes a blob available from storage.
 type BlobDescriptor struct {
-	Digest    digest.Digest
-	Size      int64
-	MediaType string
+	Digest           digest.Digest
+	Size             int64
+	MediaType        string
+	UncompressedSize int64             // From the layer's UncompressedSizeAnnotation; 0 if unknown
+	Annotations      map[string]string // The layer's annotations, used to tell layer formats apart
 }
 
 // Storage abstracts blob enumeration and ranged reads.
@@ -19,3 +22,10 @@ type Storage interface {
 	ListBlobs(ctx context.Context) ([]BlobDescriptor, error)
 	ReadBlob(ctx context.Context, digest digest.Digest, offset int64, length int64) (io.ReadCloser, error)
 }
+
+// BlobSizer is implemented by storages that can look up a blob's size without
+// reading its content, e.g. via an HTTP HEAD request. It is only consulted for
+// blobs whose size is not already known from ListBlobs.
+type BlobSizer interface {
+	BlobSize(ctx context.Context, digest digest.Digest) (int64, error)
+}
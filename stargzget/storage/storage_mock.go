@@ -15,6 +15,7 @@ type MockStorage struct {
 	mu         sync.RWMutex
 	blobs      map[digest.Digest][]byte
 	mediaTypes map[digest.Digest]string
+	order      []digest.Digest // Digests in the order they were added, like layers in a manifest
 }
 
 // NewMockStorage constructs an empty MockStorage.
@@ -25,16 +26,17 @@ func NewMockStorage() *MockStorage {
 	}
 }
 
-// ListBlobs returns descriptors for all stored blobs.
+// ListBlobs returns descriptors for all stored blobs, in the order they were
+// added.
 func (m *MockStorage) ListBlobs(ctx context.Context) ([]BlobDescriptor, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	descs := make([]BlobDescriptor, 0, len(m.blobs))
-	for dgst, data := range m.blobs {
+	descs := make([]BlobDescriptor, 0, len(m.order))
+	for _, dgst := range m.order {
 		descs = append(descs, BlobDescriptor{
 			Digest:    dgst,
-			Size:      int64(len(data)),
+			Size:      int64(len(m.blobs[dgst])),
 			MediaType: m.mediaTypes[dgst],
 		})
 	}
@@ -65,10 +67,19 @@ func (m *MockStorage) ReadBlob(ctx context.Context, digest digest.Digest, offset
 
 // AddBlob adds blob content to the mock storage.
 func (m *MockStorage) AddBlob(mediaType string, data []byte) digest.Digest {
+	return m.AddBlobWithAlgorithm(mediaType, digest.Canonical, data)
+}
+
+// AddBlobWithAlgorithm is like AddBlob but addresses the blob by a digest
+// computed with algorithm.
+func (m *MockStorage) AddBlobWithAlgorithm(mediaType string, algorithm digest.Algorithm, data []byte) digest.Digest {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	dgst := digest.FromBytes(data)
+	dgst := algorithm.FromBytes(data)
+	if _, ok := m.blobs[dgst]; !ok {
+		m.order = append(m.order, dgst)
+	}
 	m.blobs[dgst] = append([]byte(nil), data...)
 	m.mediaTypes[dgst] = mediaType
 	return dgst
@@ -2,70 +2,431 @@ package storage
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
 	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
 	"github.com/opencontainers/go-digest"
 )
 
 // RemoteRegistryStorage coordinates manifest fetching and blob access against an OCI registry.
+// It and the storages NewStorage returns are safe for concurrent use. They
+// share one token per repository: when it expires, one goroutine fetches
+// the next and the others wait for it.
 type RemoteRegistryStorage struct {
-	httpClient *http.Client
-	username   string
-	password   string
-	authToken  string
+	httpClient  *http.Client
+	insecure    bool
+	credentials CredentialProvider
+	tokens      *tokenStore
+
+	// manifests holds manifests supplied through WithManifest, keyed by
+	// registry/repository:tag. They are returned without a registry request.
+	manifests map[string]*Manifest
+
+	// manifestCache revalidates manifests across runs; nil when disabled.
+	manifestCache *manifestCache
+
+	// tokenActions holds actions added to the repository scope of every
+	// token requested from a registry, keyed by normalized host.
+	tokenActions map[string][]string
+
+	credMu    sync.Mutex
+	credCache map[string]*Credential
 }
 
 // Manifest represents an OCI image manifest.
 type Manifest struct {
 	SchemaVersion int          `json:"schemaVersion"`
 	MediaType     string       `json:"mediaType"`
+	ArtifactType  string       `json:"artifactType,omitempty"` // Set on OCI artifacts such as Helm charts or WASM modules
 	Config        Descriptor   `json:"config,omitempty"`
 	Layers        []Layer      `json:"layers,omitempty"`
+	Blobs         []Layer      `json:"blobs,omitempty"`     // Used instead of layers by the draft OCI artifact manifest
 	Manifests     []Descriptor `json:"manifests,omitempty"` // For OCI index
+	Subject       *Descriptor  `json:"subject,omitempty"`   // Manifest this artifact refers to, e.g. for signatures
+
+	// Selected is the index entry this manifest was resolved from when the
+	// image reference named an index; nil for a plain manifest.
+	Selected *Descriptor `json:"-"`
+
+	// Index holds every entry of the index Selected was chosen from, in
+	// index order, attestations included; nil for a plain manifest.
+	Index []Descriptor `json:"-"`
+
+	// Digest is the digest of the manifest JSON as it was read, which
+	// identifies the image exactly; empty for manifests built in memory.
+	Digest digest.Digest `json:"-"`
+}
+
+// AllDescriptors returns every blob the manifest references: the config
+// followed by the layers and artifact blobs. Any of them can be fetched by
+// digest, whatever its media type.
+func (m *Manifest) AllDescriptors() []Descriptor {
+	var descs []Descriptor
+	if m.Config.Digest != "" {
+		descs = append(descs, m.Config)
+	}
+	for _, layers := range [][]Layer{m.Layers, m.Blobs} {
+		for _, layer := range layers {
+			descs = append(descs, Descriptor{
+				MediaType:   layer.MediaType,
+				Digest:      layer.Digest,
+				Size:        layer.Size,
+				Annotations: layer.Annotations,
+			})
+		}
+	}
+	return descs
+}
+
+// Encode returns the manifest as JSON for storing outside the registry,
+// without the index entries it was selected from, and its media type. The
+// JSON is re-encoded, so its digest can differ from Digest.
+func (m *Manifest) Encode() ([]byte, string, error) {
+	stored := *m
+	stored.Manifests = nil
+	if stored.MediaType == "" {
+		stored.MediaType = ociManifestMedia
+	}
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, stored.MediaType, nil
+}
+
+// contentLayers returns the layers and artifact blobs, the blobs that
+// storages list.
+func (m *Manifest) contentLayers() []Layer {
+	return append(append([]Layer(nil), m.Layers...), m.Blobs...)
 }
 
 // Descriptor is an OCI descriptor.
 type Descriptor struct {
-	MediaType string `json:"mediaType"`
-	Digest    string `json:"digest"`
-	Size      int64  `json:"size"`
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`    // Set on index entries
+	Annotations map[string]string `json:"annotations,omitempty"` // Set on index entries and layers
+}
+
+// IsAttestation reports whether an index entry holds build attestations
+// (provenance, SBOM) rather than a runnable image.
+func (d *Descriptor) IsAttestation() bool {
+	if d.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+		return true
+	}
+	return d.Platform != nil && d.Platform.OS == "unknown" && d.Platform.Architecture == "unknown"
+}
+
+// Platform describes the platform an index entry was built for.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String formats the platform as os/arch[/variant].
+func (p *Platform) String() string {
+	if p == nil {
+		return "unknown platform"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ParsePlatform parses a platform written os/arch[/variant], such as
+// linux/arm64 or linux/arm/v7.
+func ParsePlatform(s string) (*Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, want OS/ARCH[/VARIANT]", s)
+	}
+	p := &Platform{OS: strings.ToLower(parts[0]), Architecture: strings.ToLower(parts[1])}
+	if len(parts) == 3 {
+		p.Variant = strings.ToLower(parts[2])
+	}
+	return p, nil
+}
+
+// HostPlatform returns the platform this program was built for.
+func HostPlatform() *Platform {
+	return &Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// Matches reports whether an image for platform p runs on want: the OS and
+// architecture must be the same, and so must the variant when want names
+// one. arm64 images without a variant are taken to be v8.
+func (p *Platform) Matches(want *Platform) bool {
+	if p == nil || want == nil || p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || platformVariant(p) == platformVariant(want)
+}
+
+func platformVariant(p *Platform) string {
+	if p.Variant == "" && p.Architecture == "arm64" {
+		return "v8"
+	}
+	return p.Variant
 }
 
 // Layer represents a manifest layer.
 type Layer struct {
-	MediaType string `json:"mediaType"`
-	Digest    string `json:"digest"`
-	Size      int64  `json:"size"`
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// TOCDigestAnnotation is the layer annotation in which eStargz builders
+// record the digest of the layer's TOC JSON.
+const TOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+
+// UncompressedSizeAnnotation is the layer annotation in which eStargz
+// builders record the size of the layer's uncompressed tar stream.
+const UncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
+
+// UncompressedSize returns the size recorded in the layer's
+// UncompressedSizeAnnotation, or 0 if it is missing or malformed.
+func (l *Layer) UncompressedSize() int64 {
+	size, err := strconv.ParseInt(l.Annotations[UncompressedSizeAnnotation], 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
 }
 
 // NewRemoteRegistryStorage creates a registry-backed storage helper.
 func NewRemoteRegistryStorage(insecure bool) *RemoteRegistryStorage {
-	client := &http.Client{}
-	if insecure {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	return &RemoteRegistryStorage{
+		httpClient: newHTTPClient(insecure, DialOptions{}),
+		insecure:   insecure,
+		tokens:     newTokenStore(),
+	}
+}
+
+// WithDialOptions returns a new storage instance whose connections are
+// established according to opts. Credentials and tokens are shared with c.
+func (c *RemoteRegistryStorage) WithDialOptions(opts DialOptions) *RemoteRegistryStorage {
+	return &RemoteRegistryStorage{
+		httpClient:    newHTTPClient(c.insecure, opts),
+		insecure:      c.insecure,
+		credentials:   c.credentials,
+		tokens:        c.tokens,
+		manifests:     c.manifests,
+		manifestCache: c.manifestCache,
+		tokenActions:  c.tokenActions,
+	}
+}
+
+// WithManifest returns a new storage instance that answers GetManifest for
+// imageRef with manifest instead of asking the registry. Embedders that
+// already hold manifests (e.g. from a metadata service) use it to skip the
+// manifest round trips. If manifest was chosen from an index, its Selected
+// field should name the child so requests for another child still go to the
+// registry.
+func (c *RemoteRegistryStorage) WithManifest(imageRef string, manifest *Manifest) *RemoteRegistryStorage {
+	manifests := make(map[string]*Manifest, len(c.manifests)+1)
+	for ref, m := range c.manifests {
+		manifests[ref] = m
+	}
+	if key, err := manifestKey(imageRef); err == nil {
+		manifests[key] = manifest
+	}
+	return &RemoteRegistryStorage{
+		httpClient:    c.httpClient,
+		insecure:      c.insecure,
+		credentials:   c.credentials,
+		tokens:        c.tokens,
+		manifests:     manifests,
+		manifestCache: c.manifestCache,
+		tokenActions:  c.tokenActions,
+	}
+}
+
+// WithManifestCacheDir returns a new storage instance that caches manifest
+// responses under dir/manifests and revalidates them with their ETag, so a
+// repeated fetch of an unchanged tag costs a 304 instead of the manifest.
+// Manifests fetched by digest are served from the cache without a request.
+// Each repository's auth challenge is kept under dir/challenges so tokens
+// can be requested before the first manifest request. An empty dir disables
+// the cache.
+func (c *RemoteRegistryStorage) WithManifestCacheDir(dir string) *RemoteRegistryStorage {
+	return &RemoteRegistryStorage{
+		httpClient:    c.httpClient,
+		insecure:      c.insecure,
+		credentials:   c.credentials,
+		tokens:        c.tokens,
+		manifests:     c.manifests,
+		manifestCache: newManifestCache(dir),
+		tokenActions:  c.tokenActions,
+	}
+}
+
+// WithTokenScope returns a new storage instance that asks for actions (e.g.
+// "push") in addition to pull whenever it requests a token from registry.
+// Some registries, such as older Artifactory releases, refuse pull-scoped
+// tokens for blob HEAD requests; configuring the scope up front saves the
+// refused request that would otherwise trigger scope escalation.
+func (c *RemoteRegistryStorage) WithTokenScope(registry string, actions ...string) *RemoteRegistryStorage {
+	tokenActions := make(map[string][]string, len(c.tokenActions)+1)
+	for host, a := range c.tokenActions {
+		tokenActions[host] = a
+	}
+	host := normalizeRegistryHost(registry)
+	tokenActions[host] = append(append([]string(nil), tokenActions[host]...), actions...)
+	return &RemoteRegistryStorage{
+		httpClient:    c.httpClient,
+		insecure:      c.insecure,
+		credentials:   c.credentials,
+		tokens:        c.tokens,
+		manifests:     c.manifests,
+		manifestCache: c.manifestCache,
+		tokenActions:  tokenActions,
+	}
+}
+
+// WithManifestBytes is WithManifest for raw manifest JSON, e.g. a manifest
+// saved from an earlier run or kept in an artifact store. It lets callers
+// work where the manifest endpoint is unreachable but blobs are not. The data
+// must be an image manifest; indexes are rejected because picking a child
+// would need the registry. If imageRef is pinned to a digest, data must
+// have that digest.
+func (c *RemoteRegistryStorage) WithManifestBytes(imageRef string, data []byte) (*RemoteRegistryStorage, error) {
+	ref, err := refs.Parse(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := ParseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Digest != "" {
+		if got := ref.Digest.Algorithm().FromBytes(data); got != ref.Digest {
+			return nil, fmt.Errorf("manifest digest mismatch: %s is pinned to %s, got %s", imageRef, ref.Digest, got)
 		}
+		manifest.Digest = ref.Digest
+	}
+	return c.WithManifest(imageRef, manifest), nil
+}
+
+// ParseManifest decodes image or artifact manifest JSON. It rejects indexes
+// and documents that reference no blobs, which usually means an image config
+// or some other JSON file was supplied by mistake.
+func ParseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	manifest.Digest = digest.FromBytes(data)
+	flattenBuildCache(&manifest)
+	if len(manifest.Manifests) > 0 {
+		return nil, fmt.Errorf("manifest is an image index; supply the manifest of one of its %d entries", len(manifest.Manifests))
+	}
+	if len(manifest.AllDescriptors()) == 0 {
+		return nil, fmt.Errorf("manifest references no blobs")
+	}
+	return &manifest, nil
+}
+
+// manifestKey normalizes imageRef so equivalent references share an entry.
+func manifestKey(imageRef string) (string, error) {
+	ref, err := refs.Parse(imageRef)
+	if err != nil {
+		return "", err
 	}
-	return &RemoteRegistryStorage{httpClient: client}
+	return ref.String(), nil
 }
 
-// WithCredential returns a new storage instance with credentials.
+// prefetchedManifest returns the manifest supplied for imageRef, if it
+// satisfies opts.
+func (c *RemoteRegistryStorage) prefetchedManifest(imageRef string, opts *ManifestOptions) (*Manifest, bool) {
+	key, err := manifestKey(imageRef)
+	if err != nil {
+		return nil, false
+	}
+	manifest, ok := c.manifests[key]
+	if !ok {
+		return nil, false
+	}
+	if opts.ChildDigest != "" && (manifest.Selected == nil || manifest.Selected.Digest != opts.ChildDigest.String()) {
+		return nil, false
+	}
+	if opts.ChildDigest == "" && opts.Platform != nil && manifest.Selected != nil && manifest.Selected.Platform != nil && !manifest.Selected.Platform.Matches(opts.Platform) {
+		return nil, false
+	}
+	return manifest, true
+}
+
+// WithCredential returns a new storage instance that uses the given
+// credentials for every registry.
 func (c *RemoteRegistryStorage) WithCredential(username, password string) *RemoteRegistryStorage {
+	return c.WithCredentialProvider(StaticCredentials(username, password))
+}
+
+// WithCredentialProvider returns a new storage instance that looks up
+// credentials per registry through provider.
+func (c *RemoteRegistryStorage) WithCredentialProvider(provider CredentialProvider) *RemoteRegistryStorage {
+	// Tokens issued for the previous credentials must not leak to the new ones.
 	return &RemoteRegistryStorage{
-		httpClient: c.httpClient,
-		username:   username,
-		password:   password,
-		authToken:  c.authToken,
+		httpClient:    c.httpClient,
+		insecure:      c.insecure,
+		credentials:   provider,
+		tokens:        newTokenStore(),
+		manifests:     c.manifests,
+		manifestCache: c.manifestCache,
+		tokenActions:  c.tokenActions,
 	}
 }
 
+// credential resolves and caches the credential for a registry. A nil result
+// means anonymous access.
+func (c *RemoteRegistryStorage) credential(ctx context.Context, registry string) *Credential {
+	if c.credentials == nil {
+		return nil
+	}
+
+	host := normalizeRegistryHost(registry)
+	c.credMu.Lock()
+	defer c.credMu.Unlock()
+
+	if cred, ok := c.credCache[host]; ok && (cred == nil || cred.ExpiresAt.IsZero() || time.Now().Before(cred.ExpiresAt)) {
+		return cred
+	}
+
+	var result *Credential
+	cred, ok, err := c.credentials.Credential(ctx, host)
+	if err != nil {
+		// Not cached, so a provider that failed for a moment, such as a
+		// token service, is asked again by the next request.
+		logger.Warn("Credential lookup failed for %s: %v", host, err)
+		return nil
+	}
+	if ok {
+		result = &cred
+	}
+
+	if c.credCache == nil {
+		c.credCache = make(map[string]*Credential)
+	}
+	c.credCache[host] = result
+	return result
+}
+
 // NewStorage creates a blob storage instance for a specific repository.
 func (c *RemoteRegistryStorage) NewStorage(registry, repository string, manifest *Manifest) Storage {
 	return &registryBlobStorage{
@@ -74,76 +435,222 @@ func (c *RemoteRegistryStorage) NewStorage(registry, repository string, manifest
 		registry:   registry,
 		repository: repository,
 		manifest:   manifest,
-		username:   c.username,
-		password:   c.password,
-		authToken:  c.authToken,
 	}
 }
 
+// ManifestOptions controls how GetManifestWithOptions resolves an image.
+type ManifestOptions struct {
+	// ChildDigest selects the child manifest of an index by digest instead of
+	// picking the first image entry. It keeps repeated runs on the same
+	// bytes even when the index gains entries such as attestations.
+	ChildDigest digest.Digest
+	// Platform selects the first child manifest built for it, and fails
+	// when the index has none. It is ignored when ChildDigest is set, and
+	// when no entry of the index records its platform.
+	Platform *Platform
+}
+
 // GetManifest fetches the manifest for an image reference.
 func (c *RemoteRegistryStorage) GetManifest(ctx context.Context, imageRef string) (*Manifest, error) {
+	return c.GetManifestWithOptions(ctx, imageRef, nil)
+}
+
+// GetManifestWithOptions fetches the manifest for an image reference. If the
+// reference names an index, a child manifest is selected and fetched; the
+// returned manifest records the choice in Selected. Manifests supplied
+// through WithManifest are returned without contacting the registry.
+func (c *RemoteRegistryStorage) GetManifestWithOptions(ctx context.Context, imageRef string, opts *ManifestOptions) (*Manifest, error) {
+	if opts == nil {
+		opts = &ManifestOptions{}
+	}
+	if manifest, ok := c.prefetchedManifest(imageRef, opts); ok {
+		logger.Debug("Using supplied manifest for image: %s", imageRef)
+		return manifest, nil
+	}
 	logger.Info("Fetching manifest for image: %s", imageRef)
+	ctx = withDefaultImage(ctx, imageRef)
 
-	registry, repository, tag, err := parseImageRef(imageRef)
+	ref, err := refs.Parse(imageRef)
 	if err != nil {
 		return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", imageRef).WithCause(err)
 	}
+	registry, repository := ref.Registry, ref.Repository
 
-	scheme := getScheme(registry)
-	url := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, registry, repository, tag)
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", registryURL(registry), repository, ref.Identifier())
 	logger.Debug("Manifest URL: %s", url)
 
-	// Try anonymous request first - let server tell us auth requirements
-	manifest, err := c.fetchManifest(ctx, url)
-	if err == nil {
-		return manifest, nil
+	// Authenticate up front if an earlier run recorded the repository's
+	// challenge; otherwise try anonymously and let the server tell us.
+	if wwwAuth := c.manifestCache.challenge(registry, repository); wwwAuth != "" && c.tokens.get(registry, repository) == "" {
+		if err := c.authenticate(ctx, registry, repository, "", wwwAuth); err != nil {
+			logger.Debug("Cached auth challenge for %s/%s failed: %v", registry, repository, err)
+		}
 	}
 
-	// Check if it's an auth error
-	if !isAuthError(err) {
-		return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", imageRef).WithCause(err)
+	sent := c.tokens.get(registry, repository)
+	manifest, err := c.fetchManifest(ctx, registry, repository, url)
+	if err != nil {
+		// Check if it's an auth error
+		if !isAuthError(err) {
+			return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", imageRef).WithCause(err)
+		}
+
+		// Extract auth requirements and authenticate
+		wwwAuth := extractWWWAuth(err)
+		c.manifestCache.storeChallenge(registry, repository, wwwAuth)
+		if err := c.authenticate(ctx, registry, repository, sent, wwwAuth); err != nil {
+			return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", imageRef).WithCause(err)
+		}
+
+		// Retry with authentication
+		manifest, err = c.fetchManifest(ctx, registry, repository, url)
+		if err != nil {
+			return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", imageRef).WithCause(err)
+		}
 	}
 
-	// Extract auth requirements and authenticate
-	wwwAuth := extractWWWAuth(err)
-	if err := c.authenticate(ctx, registry, repository, wwwAuth); err != nil {
-		return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", imageRef).WithCause(err)
+	if len(manifest.Manifests) == 0 {
+		if opts.ChildDigest != "" {
+			return nil, stargzerrors.ErrManifestFetch.
+				WithMessage(fmt.Sprintf("%s is not an index, cannot select child manifest %s", imageRef, opts.ChildDigest)).
+				WithDetail("imageRef", imageRef)
+		}
+		return manifest, nil
 	}
 
-	// Retry with authentication
-	manifest, err = c.fetchManifest(ctx, url)
+	// Handle OCI index - fetch the selected platform-specific manifest
+	selected, err := selectChildManifest(manifest.Manifests, opts.ChildDigest, opts.Platform)
+	if err != nil {
+		return nil, stargzerrors.ErrManifestFetch.WithMessage(fmt.Sprintf("%s: %v", imageRef, err)).WithDetail("imageRef", imageRef)
+	}
+	logger.Info("Image is an index; selected manifest %s (%s)", selected.Digest, selected.Platform)
+
+	indexURL := fmt.Sprintf("%s/v2/%s/manifests/%s", registryURL(registry), repository, selected.Digest)
+	index := manifest.Manifests
+	manifest, err = c.fetchManifest(ctx, registry, repository, indexURL)
 	if err != nil {
 		return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", imageRef).WithCause(err)
 	}
+	manifest.Selected = selected
+	manifest.Index = index
 
-	// Handle OCI index - fetch the first platform-specific manifest
-	if len(manifest.Manifests) > 0 {
-		manifestDigest := manifest.Manifests[0].Digest
-		logger.Info("Image is an index; selecting first manifest: %s", manifestDigest)
+	return manifest, nil
+}
 
-		indexURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, registry, repository, manifestDigest)
-		manifest, err = c.fetchManifest(ctx, indexURL)
-		if err != nil {
-			return nil, stargzerrors.ErrManifestFetch.WithDetail("imageRef", imageRef).WithCause(err)
+// selectChildManifest picks a child of an index: the entry with digest
+// childDigest if given, otherwise the first image entry, rather than an
+// attestation, for platform, or for any platform when platform is nil or no
+// entry records one.
+func selectChildManifest(children []Descriptor, childDigest digest.Digest, platform *Platform) (*Descriptor, error) {
+	var images []*Descriptor
+	for i := range children {
+		child := &children[i]
+		if childDigest != "" {
+			if child.Digest == childDigest.String() {
+				return child, nil
+			}
+			continue
+		}
+		if !child.IsAttestation() {
+			images = append(images, child)
+		}
+	}
+	if childDigest != "" {
+		return nil, fmt.Errorf("index has no child manifest %s", childDigest)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("index has no image manifests")
+	}
+
+	var available []string
+	for _, child := range images {
+		if child.Platform != nil {
+			available = append(available, child.Platform.String())
+		}
+	}
+	if platform == nil || len(available) == 0 {
+		return images[0], nil
+	}
+	for _, child := range images {
+		if child.Platform.Matches(platform) {
+			return child, nil
 		}
 	}
+	return nil, fmt.Errorf("index has no manifest for %s; it has %s", platform, strings.Join(available, ", "))
+}
 
-	return manifest, nil
+// CheckAuth verifies that the configured credentials are accepted by the
+// registry's /v2/ endpoint, authenticating first if the registry asks for it.
+func (c *RemoteRegistryStorage) CheckAuth(ctx context.Context, registry string) error {
+	url := registryURL(registry) + "/v2/"
+
+	err := c.pingRegistry(ctx, registry, url)
+	if err == nil {
+		return nil
+	}
+	if !isAuthError(err) {
+		return stargzerrors.ErrAuthFailed.WithDetail("registry", registry).WithCause(err)
+	}
+
+	if err := c.authenticate(ctx, registry, "", c.tokens.get(registry, ""), extractWWWAuth(err)); err != nil {
+		return stargzerrors.ErrAuthFailed.WithDetail("registry", registry).WithCause(err)
+	}
+	if err := c.pingRegistry(ctx, registry, url); err != nil {
+		return stargzerrors.ErrAuthFailed.WithDetail("registry", registry).WithCause(err)
+	}
+	return nil
 }
 
-// fetchManifest performs a single manifest fetch request.
-func (c *RemoteRegistryStorage) fetchManifest(ctx context.Context, url string) (*Manifest, error) {
+// pingRegistry performs a single GET against the /v2/ endpoint.
+func (c *RemoteRegistryStorage) pingRegistry(ctx context.Context, registry, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	c.applyAuth(req, registry, "")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return &authError{wwwAuth: resp.Header.Get("WWW-Authenticate")}
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return statusError("registry ping", registry, resp, body)
+	}
+	return nil
+}
+
+// fetchManifest performs a single manifest fetch request, revalidating a
+// cached copy when the manifest cache is enabled.
+func (c *RemoteRegistryStorage) fetchManifest(ctx context.Context, registry, repository, url string) (*Manifest, error) {
+	want := manifestURLDigest(url)
+	cached := c.manifestCache.load(url)
+	if cached != nil && want != "" {
+		logger.Debug("Using cached manifest: %s", url)
+		return decodeManifest(cached.Data, want.Algorithm())
+	}
+
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
 
 	req.Header.Set("Accept", "application/vnd.oci.image.manifest.v1+json")
 	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
 	req.Header.Add("Accept", "application/vnd.oci.image.index.v1+json")
+	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.list.v2+json")
+	req.Header.Add("Accept", "application/vnd.oci.artifact.manifest.v1+json")
 
 	// Apply auth if we have it
-	c.applyAuth(req)
+	c.applyAuth(req, registry, repository)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -156,39 +663,78 @@ func (c *RemoteRegistryStorage) fetchManifest(ctx context.Context, url string) (
 		return nil, &authError{wwwAuth: wwwAuth}
 	}
 
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		logger.Debug("Manifest not modified, using cached copy: %s", url)
+		return decodeManifest(cached.Data, manifestAlgorithm(want, resp.Header))
+	}
+
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("registry returned %d: %s", resp.StatusCode, string(body))
+		return nil, statusError("manifest request", registry, resp, body)
 	}
 
-	var manifest Manifest
-	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := decodeManifest(data, manifestAlgorithm(want, resp.Header))
+	if err != nil {
 		return nil, err
 	}
+	if want != "" && manifest.Digest != want {
+		return nil, fmt.Errorf("manifest digest mismatch: requested %s, got %s", want, manifest.Digest)
+	}
+	c.manifestCache.store(url, resp.Header.Get("ETag"), data)
+
+	return manifest, nil
+}
 
+// decodeManifest decodes manifest or index JSON as read from a registry,
+// digesting it with algorithm. BuildKit cache indexes are flattened into
+// manifests.
+func decodeManifest(data []byte, algorithm digest.Algorithm) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	manifest.Digest = algorithm.FromBytes(data)
+	flattenBuildCache(&manifest)
 	return &manifest, nil
 }
 
+// manifestAlgorithm picks the algorithm a manifest's digest is computed
+// with: that of the digest it was requested by, else that of the
+// Docker-Content-Digest the registry sent, else sha256.
+func manifestAlgorithm(requested digest.Digest, header http.Header) digest.Algorithm {
+	if requested != "" {
+		return requested.Algorithm()
+	}
+	if sent, err := digest.Parse(header.Get("Docker-Content-Digest")); err == nil {
+		return sent.Algorithm()
+	}
+	return digest.Canonical
+}
+
 // authenticate handles the authentication flow based on WWW-Authenticate header.
-func (c *RemoteRegistryStorage) authenticate(ctx context.Context, registry, repository, wwwAuth string) error {
+func (c *RemoteRegistryStorage) authenticate(ctx context.Context, registry, repository, sent, wwwAuth string) error {
 	if wwwAuth == "" {
 		return fmt.Errorf("no WWW-Authenticate header in 401 response")
 	}
 
 	// Bearer token authentication (Docker/Harbor/GitHub)
 	if strings.HasPrefix(wwwAuth, "Bearer ") {
-		token, err := c.getBearerToken(ctx, wwwAuth)
-		if err != nil {
-			return err
-		}
-		c.authToken = token
-		logger.Debug("Acquired bearer token (length: %d)", len(token))
-		return nil
+		return c.tokens.refresh(ctx, registry, repository, sent, wwwAuth, func() (string, error) {
+			token, err := c.getBearerToken(ctx, registry, wwwAuth)
+			if err == nil {
+				logger.Debug("Acquired bearer token (length: %d)", len(token))
+			}
+			return token, err
+		})
 	}
 
 	// Basic authentication
 	if strings.HasPrefix(wwwAuth, "Basic ") {
-		if c.username == "" || c.password == "" {
+		if c.credential(ctx, registry) == nil {
 			return fmt.Errorf("registry requires basic auth but no credentials provided")
 		}
 		logger.Info("Using Basic authentication")
@@ -198,8 +744,16 @@ func (c *RemoteRegistryStorage) authenticate(ctx context.Context, registry, repo
 	return fmt.Errorf("unsupported auth scheme: %s", wwwAuth)
 }
 
-// getBearerToken requests a bearer token from the auth service.
-func (c *RemoteRegistryStorage) getBearerToken(ctx context.Context, wwwAuth string) (string, error) {
+// getBearerToken requests a bearer token from the auth service for the
+// scope the challenge names, plus any actions configured for registry.
+func (c *RemoteRegistryStorage) getBearerToken(ctx context.Context, registry, wwwAuth string) (string, error) {
+	scope := parseWWWAuth(wwwAuth)["scope"]
+	return c.requestToken(ctx, registry, wwwAuth, addScopeActions(scope, c.tokenActions[normalizeRegistryHost(registry)]))
+}
+
+// requestToken requests a bearer token for scope from the realm of the
+// wwwAuth challenge.
+func (c *RemoteRegistryStorage) requestToken(ctx context.Context, registry, wwwAuth, scope string) (string, error) {
 	params := parseWWWAuth(wwwAuth)
 
 	realm := params["realm"]
@@ -212,7 +766,7 @@ func (c *RemoteRegistryStorage) getBearerToken(ctx context.Context, wwwAuth stri
 	if service := params["service"]; service != "" {
 		tokenURL += "?service=" + service
 	}
-	if scope := params["scope"]; scope != "" {
+	if scope != "" {
 		if strings.Contains(tokenURL, "?") {
 			tokenURL += "&scope=" + scope
 		} else {
@@ -226,8 +780,8 @@ func (c *RemoteRegistryStorage) getBearerToken(ctx context.Context, wwwAuth stri
 	}
 
 	// Use Basic auth for token request if we have credentials
-	if c.username != "" && c.password != "" {
-		req.SetBasicAuth(c.username, c.password)
+	if cred := c.credential(ctx, registry); cred != nil {
+		req.SetBasicAuth(cred.Username, cred.Password)
 	}
 
 	resp, err := c.httpClient.Do(req)
@@ -238,7 +792,7 @@ func (c *RemoteRegistryStorage) getBearerToken(ctx context.Context, wwwAuth stri
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, string(body))
+		return "", statusError("token request", registry, resp, body)
 	}
 
 	var authResp struct {
@@ -261,14 +815,29 @@ func (c *RemoteRegistryStorage) getBearerToken(ctx context.Context, wwwAuth stri
 }
 
 // applyAuth applies authentication to a request.
-func (c *RemoteRegistryStorage) applyAuth(req *http.Request) {
-	if c.authToken != "" {
-		req.Header.Set("Authorization", "Bearer "+c.authToken)
-	} else if c.username != "" && c.password != "" {
-		req.SetBasicAuth(c.username, c.password)
+func (c *RemoteRegistryStorage) applyAuth(req *http.Request, registry, repository string) {
+	if token := c.tokens.get(registry, repository); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if cred := c.credential(req.Context(), registry); cred != nil {
+		req.SetBasicAuth(cred.Username, cred.Password)
 	}
 }
 
+// statusError describes a non-success response to a request made for
+// registry.
+func statusError(op, registry string, resp *http.Response, body []byte) *stargzerrors.HTTPStatusError {
+	err := &stargzerrors.HTTPStatusError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		Registry:   registry,
+	}
+	if resp.Request != nil {
+		err.URL = stargzerrors.RedactURL(resp.Request.URL)
+	}
+	return err
+}
+
 // registryBlobStorage implements Storage for registry blobs.
 type registryBlobStorage struct {
 	client     *RemoteRegistryStorage
@@ -276,9 +845,6 @@ type registryBlobStorage struct {
 	registry   string
 	repository string
 	manifest   *Manifest
-	username   string
-	password   string
-	authToken  string
 }
 
 // ListBlobs lists all blobs in the manifest.
@@ -287,16 +853,19 @@ func (s *registryBlobStorage) ListBlobs(ctx context.Context) ([]BlobDescriptor,
 		return nil, fmt.Errorf("manifest not loaded for registry storage")
 	}
 
-	blobs := make([]BlobDescriptor, 0, len(s.manifest.Layers))
-	for _, layer := range s.manifest.Layers {
+	layers := s.manifest.contentLayers()
+	blobs := make([]BlobDescriptor, 0, len(layers))
+	for _, layer := range layers {
 		dgst, err := digest.Parse(layer.Digest)
 		if err != nil {
 			continue
 		}
 		blobs = append(blobs, BlobDescriptor{
-			Digest:    dgst,
-			Size:      layer.Size,
-			MediaType: layer.MediaType,
+			Digest:           dgst,
+			Size:             layer.Size,
+			MediaType:        layer.MediaType,
+			UncompressedSize: layer.UncompressedSize(),
+			Annotations:      layer.Annotations,
 		})
 	}
 	return blobs, nil
@@ -308,41 +877,183 @@ func (s *registryBlobStorage) ReadBlob(ctx context.Context, blobDigest digest.Di
 		return nil, fmt.Errorf("offset must be non-negative")
 	}
 
-	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", getScheme(s.registry), s.registry, s.repository, blobDigest.String())
+	url := fmt.Sprintf("%s/v2/%s/blobs/%s", registryURL(s.registry), s.repository, blobDigest.String())
+	ctx = withDefaultImage(ctx, s.registry+"/"+s.repository)
 
-	// Try with existing auth (reuse token from manifest fetch)
-	body, err := s.fetchBlobRange(ctx, url, offset, length)
-	if err == nil {
-		return body, nil
+	var body io.ReadCloser
+	err := s.withAuth(ctx, func() (err error) {
+		body, err = s.fetchBlobRange(ctx, url, offset, length)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return body, nil
+}
 
-	// Check if it's an auth error
-	if !isAuthError(err) {
-		return nil, err
+// BlobSize looks up a blob's size with a HEAD request. It is only used for
+// blobs whose manifest descriptor does not carry a size.
+func (s *registryBlobStorage) BlobSize(ctx context.Context, blobDigest digest.Digest) (int64, error) {
+	url := fmt.Sprintf("%s/v2/%s/blobs/%s", registryURL(s.registry), s.repository, blobDigest.String())
+	ctx = withDefaultImage(ctx, s.registry+"/"+s.repository)
+
+	var size int64
+	err := s.withAuth(ctx, func() (err error) {
+		size, err = s.headBlob(ctx, url)
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
+	return size, nil
+}
 
-	// Need to authenticate
-	wwwAuth := extractWWWAuth(err)
-	if err := s.authenticate(ctx, wwwAuth); err != nil {
-		return nil, err
+// withAuth runs request, reusing the token from the manifest fetch. On a
+// 401 it authenticates and runs request again; on a 403 for insufficient
+// scope it escalates the token scope once and runs it again. A signed blob
+// URL refused by the storage it redirected to is requested afresh once.
+// When access that a token had granted stays refused, the failure is
+// reported as ErrTokenExpired.
+func (s *registryBlobStorage) withAuth(ctx context.Context, request func() error) error {
+	sent := s.client.tokens.get(s.registry, s.repository)
+	hadToken := sent != ""
+	err := request()
+	authenticated, escalated, renewedURL := false, false, false
+	for err != nil {
+		switch {
+		case isAuthError(err) && !authenticated:
+			authenticated = true
+			if hadToken {
+				logger.Info("Token for %s/%s was refused, presumably expired; requesting a new one", s.registry, s.repository)
+			}
+			if err := s.authenticate(ctx, sent, extractWWWAuth(err)); err != nil {
+				return err
+			}
+		case isAuthError(err) && hadToken:
+			return stargzerrors.ErrTokenExpired.WithDetail("registry", s.registry).WithCause(err)
+		case isExpiredURLError(err) && !renewedURL:
+			renewedURL = true
+			logger.Info("Signed blob URL for %s/%s was refused, presumably expired; requesting a fresh one", s.registry, s.repository)
+		case isExpiredURLError(err):
+			return stargzerrors.ErrTokenExpired.WithDetail("registry", s.registry).WithCause(err.(*expiredURLError).err)
+		case isScopeError(err) && !escalated:
+			escalated = true
+			if err := s.escalateScope(ctx, err.(*scopeError)); err != nil {
+				return err
+			}
+		default:
+			if denied, ok := err.(*scopeError); ok {
+				return denied.err
+			}
+			return err
+		}
+		sent = s.client.tokens.get(s.registry, s.repository)
+		err = request()
+	}
+	return nil
+}
+
+// headBlob performs a single HEAD request and returns the Content-Length.
+func (s *registryBlobStorage) headBlob(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	s.applyAuth(req)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return 0, &authError{wwwAuth: resp.Header.Get("WWW-Authenticate")}
 	}
 
-	// Retry with authentication
-	return s.fetchBlobRange(ctx, url, offset, length)
+	if resp.StatusCode != http.StatusOK {
+		return 0, s.denied(statusError("blob HEAD request", s.registry, resp, nil), req, resp)
+	}
+
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("blob HEAD response has no Content-Length")
+	}
+
+	return resp.ContentLength, nil
 }
 
 // fetchBlobRange performs a single blob range request.
 func (s *registryBlobStorage) fetchBlobRange(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	// Set range header
+	rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rangeHeader = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	req, resp, err := s.getBlob(ctx, url, rangeHeader)
 	if err != nil {
 		return nil, err
 	}
 
-	// Set range header
-	if length > 0 {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
-	} else {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if err := checkContentRange(resp.Header.Get("Content-Range"), offset); err != nil {
+			resp.Body.Close()
+			// A range that is off cannot be trusted on a retry either;
+			// the whole blob can, at the cost of the bytes before it.
+			logger.Warn("%s: %v; reading the blob from its start instead", s.registry, err)
+			return s.fetchWholeBlob(ctx, url, offset, length)
+		}
+	case http.StatusOK:
+		if offset > 0 || length > 0 {
+			body, err := skipIgnoredRange(resp, s.registry, offset, length)
+			if err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+			return NewContextReadCloser(ctx, body), nil
+		}
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, s.denied(statusError("range request", s.registry, resp, body), req, resp)
+	}
+
+	return NewContextReadCloser(ctx, resp.Body), nil
+}
+
+// fetchWholeBlob serves the range [offset, offset+length) of a blob from a
+// GET without a Range header, for registries that answer range requests
+// with the wrong bytes.
+func (s *registryBlobStorage) fetchWholeBlob(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
+	req, resp, err := s.getBlob(ctx, url, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, s.denied(statusError("blob request", s.registry, resp, body), req, resp)
+	}
+	body, err := skipIgnoredRange(resp, s.registry, offset, length)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return NewContextReadCloser(ctx, body), nil
+}
+
+// getBlob sends a GET for a blob, with rangeHeader as its Range unless it
+// is empty. Refusals that withAuth acts on are returned as errors with the
+// response closed; any other response is left to the caller.
+func (s *registryBlobStorage) getBlob(ctx context.Context, url, rangeHeader string) (*http.Request, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
 	}
 
 	// Apply auth if we have it
@@ -350,44 +1061,95 @@ func (s *registryBlobStorage) fetchBlobRange(ctx context.Context, url string, of
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	// A refusal from the host a blob was redirected to, typically storage
+	// behind a signed URL, is not about the registry token.
+	redirected := resp.Request != nil && resp.Request.URL.Host != req.URL.Host
+	if redirected && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, nil, &expiredURLError{err: statusError("range request", s.registry, resp, body)}
 	}
 
 	if resp.StatusCode == http.StatusUnauthorized {
 		resp.Body.Close()
 		wwwAuth := resp.Header.Get("WWW-Authenticate")
-		return nil, &authError{wwwAuth: wwwAuth}
+		return nil, nil, &authError{wwwAuth: wwwAuth}
 	}
+	return req, resp, nil
+}
 
-	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return nil, fmt.Errorf("range request failed: %d %s", resp.StatusCode, string(body))
+// rangeIgnoringHosts holds the hosts known to answer range requests with
+// the whole blob, so each is warned about once per process.
+var rangeIgnoringHosts sync.Map
+
+// skipIgnoredRange serves the range [offset, offset+length) of a blob from
+// resp, a 200 response to a range request that carries the whole blob, by
+// discarding the bytes before offset. Every range then costs the bytes
+// before it, so the host is warned about, but the download works.
+func skipIgnoredRange(resp *http.Response, registry string, offset, length int64) (io.ReadCloser, error) {
+	host := resp.Request.URL.Host
+	if _, warned := rangeIgnoringHosts.LoadOrStore(host, true); !warned {
+		logger.Warn("%s ignores HTTP range requests; reading blobs from their start instead, which costs extra bandwidth", host)
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, stargzerrors.ErrRangeIgnored.WithDetail("registry", registry).
+			WithCause(fmt.Errorf("skipping to offset %d of a whole-blob response: %w", offset, err))
+	}
+	var body io.Reader = resp.Body
+	if length > 0 {
+		body = io.LimitReader(resp.Body, length)
 	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}, nil
+}
 
-	return resp.Body, nil
+// checkContentRange checks that a 206 response's Content-Range, "bytes
+// FIRST-LAST/SIZE", starts at offset. Responses without one are accepted.
+func checkContentRange(contentRange string, offset int64) error {
+	if contentRange == "" {
+		return nil
+	}
+	var first, last int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &first, &last); err != nil {
+		return fmt.Errorf("malformed Content-Range %q", contentRange)
+	}
+	if first != offset {
+		return fmt.Errorf("asked for bytes from offset %d, got Content-Range %q", offset, contentRange)
+	}
+	return nil
 }
 
-// authenticate handles the authentication flow for blob storage.
-func (s *registryBlobStorage) authenticate(ctx context.Context, wwwAuth string) error {
+// authenticate handles the authentication flow for blob storage, after a
+// request made with the token sent was refused.
+func (s *registryBlobStorage) authenticate(ctx context.Context, sent, wwwAuth string) error {
 	if wwwAuth == "" {
 		return fmt.Errorf("no WWW-Authenticate header in 401 response")
 	}
 
 	// Bearer token authentication
 	if strings.HasPrefix(wwwAuth, "Bearer ") {
-		token, err := s.client.getBearerToken(ctx, wwwAuth)
+		err := s.client.tokens.refresh(ctx, s.registry, s.repository, sent, wwwAuth, func() (string, error) {
+			return s.client.getBearerToken(ctx, s.registry, wwwAuth)
+		})
 		if err != nil {
-			return fmt.Errorf("auth failed: %w", err)
+			return stargzerrors.ErrAuthFailed.WithDetail("registry", s.registry).WithCause(err)
 		}
-		s.authToken = token
 		return nil
 	}
 
 	// Basic authentication
 	if strings.HasPrefix(wwwAuth, "Basic ") {
-		if s.username == "" || s.password == "" {
-			return fmt.Errorf("registry requires basic auth but no credentials provided")
+		if s.client.credential(ctx, s.registry) == nil {
+			return stargzerrors.ErrAuthFailed.WithDetail("registry", s.registry).
+				WithCause(fmt.Errorf("registry requires basic auth but no credentials provided"))
 		}
 		return nil
 	}
@@ -395,32 +1157,78 @@ func (s *registryBlobStorage) authenticate(ctx context.Context, wwwAuth string)
 	return fmt.Errorf("unsupported auth scheme: %s", wwwAuth)
 }
 
+// denied turns err, the status error for resp, into a scopeError when the
+// response refused a bearer token for lack of scope: a 403 whose challenge
+// or body says insufficient_scope, or any 403 to a HEAD request, which
+// carries no body to say why.
+func (s *registryBlobStorage) denied(err *stargzerrors.HTTPStatusError, req *http.Request, resp *http.Response) error {
+	if resp.StatusCode != http.StatusForbidden || !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return err
+	}
+	wwwAuth := resp.Header.Get("WWW-Authenticate")
+	if req.Method == http.MethodHead || strings.Contains(wwwAuth, "insufficient_scope") || strings.Contains(err.Body, "insufficient_scope") {
+		return &scopeError{wwwAuth: wwwAuth, err: err}
+	}
+	return err
+}
+
+// escalateScope replaces the repository's token with one that adds push to
+// its scope, using the challenge of the refused response or, as 403s
+// rarely carry one, the challenge the token was obtained with.
+func (s *registryBlobStorage) escalateScope(ctx context.Context, denied *scopeError) error {
+	challenge := denied.wwwAuth
+	scope := parseWWWAuth(challenge)["scope"]
+	if parseWWWAuth(challenge)["realm"] == "" {
+		challenge = s.client.tokens.challenge(s.registry, s.repository)
+	}
+	if challenge == "" {
+		return denied.err
+	}
+	if scope == "" {
+		scope = "repository:" + s.repository + ":pull"
+	}
+	actions := append([]string{"push"}, s.client.tokenActions[normalizeRegistryHost(s.registry)]...)
+	scope = addScopeActions(scope, actions)
+
+	logger.Info("Token for %s/%s lacks scope, requesting %s", s.registry, s.repository, scope)
+	token, err := s.client.requestToken(ctx, s.registry, challenge, scope)
+	if err != nil {
+		return stargzerrors.ErrAuthFailed.WithDetail("registry", s.registry).WithDetail("scope", scope).WithCause(err)
+	}
+	s.client.tokens.set(s.registry, s.repository, token)
+	return nil
+}
+
 // applyAuth applies authentication to a request.
 func (s *registryBlobStorage) applyAuth(req *http.Request) {
-	if s.authToken != "" {
-		req.Header.Set("Authorization", "Bearer "+s.authToken)
-	} else if s.username != "" && s.password != "" {
-		req.SetBasicAuth(s.username, s.password)
-	}
+	s.client.applyAuth(req, s.registry, s.repository)
 }
 
 // Helper functions
 
-// parseImageRef parses an image reference into registry, repository, and tag.
-func parseImageRef(imageRef string) (string, string, string, error) {
-	parts := strings.SplitN(imageRef, "/", 2)
-	if len(parts) < 2 {
-		return "", "", "", fmt.Errorf("invalid image ref: %s", imageRef)
+// ParseImageRef parses an image reference into registry, repository, and
+// the tag, or the digest for references that have one.
+//
+// Deprecated: use refs.Parse, which also keeps tag and digest apart.
+func ParseImageRef(imageRef string) (string, string, string, error) {
+	ref, err := refs.Parse(imageRef)
+	if err != nil {
+		return "", "", "", err
 	}
+	return ref.Registry, ref.Repository, ref.Identifier(), nil
+}
 
-	registry := parts[0]
-	rest := parts[1]
-	repoParts := strings.Split(rest, ":")
-	if len(repoParts) != 2 {
-		return "", "", "", fmt.Errorf("missing tag in image ref: %s", imageRef)
-	}
+// dockerHubEndpoint is the host serving the registry API of Docker Hub,
+// whose references name docker.io.
+const dockerHubEndpoint = "registry-1.docker.io"
 
-	return registry, repoParts[0], repoParts[1], nil
+// registryURL returns the scheme and host the registry API of registry is
+// served at. Docker Hub and its aliases are served at dockerHubEndpoint.
+func registryURL(registry string) string {
+	if normalizeRegistryHost(registry) == refs.DockerHub {
+		return "https://" + dockerHubEndpoint
+	}
+	return getScheme(registry) + "://" + registry
 }
 
 // getScheme returns http or https based on the registry host.
@@ -442,18 +1250,45 @@ func parseWWWAuth(wwwAuth string) map[string]string {
 	// Remove "Bearer " prefix
 	authStr := strings.TrimPrefix(wwwAuth, "Bearer ")
 
-	// Parse key=value pairs
-	parts := strings.Split(authStr, ",")
-	for _, part := range parts {
-		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
-		if len(kv) == 2 {
-			params[kv[0]] = strings.Trim(kv[1], "\"")
+	// Parse key=value pairs; quoted values such as scopes may hold commas.
+	for authStr != "" {
+		kv := strings.SplitN(strings.TrimLeft(authStr, " ,"), "=", 2)
+		if len(kv) != 2 {
+			break
+		}
+		key, rest := strings.TrimSpace(kv[0]), kv[1]
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value, authStr = rest[1:end+1], rest[min(end+2, len(rest)):]
+		} else {
+			value, authStr, _ = strings.Cut(rest, ",")
 		}
+		params[key] = strings.TrimSpace(value)
 	}
 
 	return params
 }
 
+// addScopeActions adds actions to a "repository:NAME:ACTIONS" scope,
+// leaving scopes of other forms alone.
+func addScopeActions(scope string, actions []string) string {
+	i := strings.LastIndex(scope, ":")
+	if len(actions) == 0 || !strings.HasPrefix(scope, "repository:") || i < len("repository:") {
+		return scope
+	}
+	have := strings.Split(scope[i+1:], ",")
+	for _, action := range actions {
+		if action != "" && !slices.Contains(have, action) {
+			have = append(have, action)
+		}
+	}
+	return scope[:i+1] + strings.Join(have, ",")
+}
+
 // authError represents an authentication error with WWW-Authenticate header.
 type authError struct {
 	wwwAuth string
@@ -463,6 +1298,53 @@ func (e *authError) Error() string {
 	return "authentication required"
 }
 
+// HTTPStatus classifies an authentication failure that survived the
+// re-authentication attempt as permanent.
+func (e *authError) HTTPStatus() int {
+	return http.StatusUnauthorized
+}
+
+// expiredURLError is a 401 or 403 from the host a blob request was
+// redirected to. Those hosts authorize by a signature in the URL, which a
+// new request to the registry renews.
+type expiredURLError struct {
+	err *stargzerrors.HTTPStatusError
+}
+
+func (e *expiredURLError) Error() string {
+	return e.err.Error()
+}
+
+func (e *expiredURLError) Unwrap() error {
+	return e.err
+}
+
+func isExpiredURLError(err error) bool {
+	_, ok := err.(*expiredURLError)
+	return ok
+}
+
+// scopeError is a 403 that refused a bearer token for lack of scope. err is
+// returned as is when escalation is not possible.
+type scopeError struct {
+	wwwAuth string
+	err     *stargzerrors.HTTPStatusError
+}
+
+func (e *scopeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *scopeError) Unwrap() error {
+	return e.err
+}
+
+// isScopeError checks if an error is an insufficient scope error.
+func isScopeError(err error) bool {
+	_, ok := err.(*scopeError)
+	return ok
+}
+
 // isAuthError checks if an error is an authentication error.
 func isAuthError(err error) bool {
 	_, ok := err.(*authError)
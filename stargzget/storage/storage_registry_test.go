@@ -0,0 +1,607 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/opencontainers/go-digest"
+)
+
+// newIndexRegistry serves an anonymous index at test/app:latest whose first
+// entry is an attestation, followed by amd64 and arm64 images.
+func newIndexRegistry(t *testing.T) (*httptest.Server, map[string]digest.Digest) {
+	t.Helper()
+
+	children := map[string]digest.Digest{}
+	bodies := map[string][]byte{}
+	for _, arch := range []string{"attestation", "amd64", "arm64"} {
+		body, _ := json.Marshal(Manifest{
+			SchemaVersion: 2,
+			Layers:        []Layer{{Digest: digest.FromString(arch).String()}},
+		})
+		dgst := digest.FromBytes(body)
+		children[arch] = dgst
+		bodies["/v2/test/app/manifests/"+dgst.String()] = body
+	}
+
+	index, _ := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests: []Descriptor{
+			{
+				Digest:      children["attestation"].String(),
+				Platform:    &Platform{OS: "unknown", Architecture: "unknown"},
+				Annotations: map[string]string{"vnd.docker.reference.type": "attestation-manifest"},
+			},
+			{Digest: children["amd64"].String(), Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+			{Digest: children["arm64"].String(), Platform: &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		},
+	})
+	bodies["/v2/test/app/manifests/latest"] = index
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, children
+}
+
+func TestGetManifestWithOptions_Index(t *testing.T) {
+	server, children := newIndexRegistry(t)
+	ref := strings.TrimPrefix(server.URL, "http://") + "/test/app:latest"
+	client := NewRemoteRegistryStorage(false)
+
+	tests := []struct {
+		name         string
+		opts         *ManifestOptions
+		wantChild    string
+		wantPlatform string
+	}{
+		{name: "default skips attestations", opts: nil, wantChild: "amd64", wantPlatform: "linux/amd64"},
+		{name: "child digest", opts: &ManifestOptions{ChildDigest: children["arm64"]}, wantChild: "arm64", wantPlatform: "linux/arm64/v8"},
+		{name: "platform", opts: &ManifestOptions{Platform: &Platform{OS: "linux", Architecture: "arm64"}}, wantChild: "arm64", wantPlatform: "linux/arm64/v8"},
+		{name: "platform with variant", opts: &ManifestOptions{Platform: &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}}, wantChild: "arm64", wantPlatform: "linux/arm64/v8"},
+		{name: "child digest wins", opts: &ManifestOptions{ChildDigest: children["amd64"], Platform: &Platform{OS: "linux", Architecture: "arm64"}}, wantChild: "amd64", wantPlatform: "linux/amd64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := client.GetManifestWithOptions(context.Background(), ref, tt.opts)
+			if err != nil {
+				t.Fatalf("GetManifestWithOptions() error = %v", err)
+			}
+			if manifest.Selected == nil || manifest.Selected.Digest != children[tt.wantChild].String() {
+				t.Fatalf("Selected = %+v, want %s", manifest.Selected, children[tt.wantChild])
+			}
+			if got := manifest.Selected.Platform.String(); got != tt.wantPlatform {
+				t.Fatalf("Platform = %s, want %s", got, tt.wantPlatform)
+			}
+			if manifest.Layers[0].Digest != digest.FromString(tt.wantChild).String() {
+				t.Fatalf("fetched wrong child manifest: %+v", manifest.Layers)
+			}
+			if len(manifest.Index) != 3 || manifest.Index[0].Digest != children["attestation"].String() {
+				t.Fatalf("Index = %+v, want all three entries", manifest.Index)
+			}
+		})
+	}
+
+	_, err := client.GetManifestWithOptions(context.Background(), ref, &ManifestOptions{ChildDigest: digest.FromString("gone")})
+	if stargzerrors.GetErrorCode(err) != stargzerrors.ErrManifestFetch.Code {
+		t.Fatalf("unknown child digest error = %v, want %s", err, stargzerrors.ErrManifestFetch.Code)
+	}
+
+	// The attestation is not offered as a platform.
+	_, err = client.GetManifestWithOptions(context.Background(), ref, &ManifestOptions{Platform: &Platform{OS: "linux", Architecture: "s390x"}})
+	if stargzerrors.GetErrorCode(err) != stargzerrors.ErrManifestFetch.Code || !strings.Contains(err.Error(), "no manifest for linux/s390x; it has linux/amd64, linux/arm64/v8") {
+		t.Fatalf("missing platform error = %v, want one listing the platforms", err)
+	}
+}
+
+func TestGetManifest_PinnedDigest(t *testing.T) {
+	server, children := newIndexRegistry(t)
+	name := strings.TrimPrefix(server.URL, "http://") + "/test/app"
+	client := NewRemoteRegistryStorage(false)
+
+	// The tag is informational next to a digest; the digest is fetched.
+	for _, ref := range []string{name + "@" + children["arm64"].String(), name + ":latest@" + children["arm64"].String()} {
+		manifest, err := client.GetManifest(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("GetManifest(%s) error = %v", ref, err)
+		}
+		if manifest.Digest != children["arm64"] || manifest.Selected != nil || manifest.Layers[0].Digest != digest.FromString("arm64").String() {
+			t.Fatalf("GetManifest(%s) = %+v, want the arm64 manifest itself", ref, manifest)
+		}
+	}
+
+	_, err := client.GetManifest(context.Background(), name+"@"+digest.FromString("gone").String())
+	if stargzerrors.GetErrorCode(err) != stargzerrors.ErrManifestFetch.Code {
+		t.Fatalf("unknown digest error = %v, want %s", err, stargzerrors.ErrManifestFetch.Code)
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Platform
+		ok   bool
+	}{
+		{"linux/amd64", Platform{OS: "linux", Architecture: "amd64"}, true},
+		{"Linux/ARM/v7", Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{"linux", Platform{}, false},
+		{"linux//v7", Platform{}, false},
+		{"linux/arm/v7/x", Platform{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParsePlatform(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && *got != tt.want) {
+			t.Errorf("ParsePlatform(%q) = %+v, %v; want %+v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+
+	arm64 := &Platform{OS: "linux", Architecture: "arm64"}
+	if !arm64.Matches(&Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}) {
+		t.Error("linux/arm64 does not match linux/arm64/v8, want the default variant to match")
+	}
+	if (&Platform{OS: "linux", Architecture: "arm", Variant: "v6"}).Matches(&Platform{OS: "linux", Architecture: "arm", Variant: "v7"}) {
+		t.Error("linux/arm/v6 matches linux/arm/v7")
+	}
+}
+
+func TestGetManifestWithOptions_BuildCache(t *testing.T) {
+	layers := []string{digest.FromString("step1").String(), digest.FromString("step2").String()}
+	config := digest.FromString("cacheconfig").String()
+	index, _ := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests: []Descriptor{
+			{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layers[0], Size: 10},
+			{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: layers[1], Size: 20, Annotations: map[string]string{"buildkit/createdat": "2024-01-01T00:00:00Z"}},
+			{MediaType: BuildCacheConfigMediaType, Digest: config, Size: 30},
+		},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/test/cache/manifests/buildcache" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(index)
+	}))
+	defer server.Close()
+
+	ref := strings.TrimPrefix(server.URL, "http://") + "/test/cache:buildcache"
+	manifest, err := NewRemoteRegistryStorage(false).GetManifest(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("GetManifest() error = %v", err)
+	}
+	if !manifest.IsBuildCache() || manifest.Selected != nil || len(manifest.Manifests) != 0 {
+		t.Fatalf("manifest = %+v, want a flattened build cache", manifest)
+	}
+	if manifest.Config.Digest != config || len(manifest.Layers) != 2 || manifest.Layers[0].Digest != layers[0] || manifest.Layers[1].Digest != layers[1] {
+		t.Fatalf("config = %+v, layers = %+v; want the cache config and both layers", manifest.Config, manifest.Layers)
+	}
+	if manifest.Digest != digest.FromBytes(index) {
+		t.Errorf("Digest = %s, want the digest of the index", manifest.Digest)
+	}
+}
+
+func TestGetManifestWithOptions_SuppliedManifest(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	supplied := &Manifest{
+		SchemaVersion: 2,
+		Layers:        []Layer{{Digest: digest.FromString("layer").String()}},
+		Selected:      &Descriptor{Digest: digest.FromString("child").String()},
+	}
+	client := NewRemoteRegistryStorage(false).WithManifest(host+"/test/app:latest", supplied)
+
+	tests := []struct {
+		name      string
+		ref       string
+		opts      *ManifestOptions
+		wantFetch bool
+	}{
+		{name: "same ref", ref: host + "/test/app:latest"},
+		{name: "selected child", ref: host + "/test/app:latest", opts: &ManifestOptions{ChildDigest: digest.FromString("child")}},
+		{name: "other child", ref: host + "/test/app:latest", opts: &ManifestOptions{ChildDigest: digest.FromString("other")}, wantFetch: true},
+		{name: "other tag", ref: host + "/test/app:v2", wantFetch: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = 0
+			manifest, err := client.GetManifestWithOptions(context.Background(), tt.ref, tt.opts)
+			if tt.wantFetch {
+				if requests == 0 || err == nil {
+					t.Fatalf("requests = %d, err = %v; want a failing registry request", requests, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetManifestWithOptions() error = %v", err)
+			}
+			if manifest != supplied || requests != 0 {
+				t.Fatalf("manifest = %p after %d requests, want supplied manifest without requests", manifest, requests)
+			}
+		})
+	}
+}
+
+func TestWithManifestBytes(t *testing.T) {
+	layer := digest.FromString("layer").String()
+	tests := []struct {
+		name    string
+		ref     string
+		data    string
+		wantErr bool
+	}{
+		{name: "image manifest", ref: "registry.example/test/app:latest", data: `{"schemaVersion":2,"layers":[{"digest":"` + layer + `","size":3}]}`},
+		{name: "artifact blobs", ref: "registry.example/test/app:latest", data: `{"schemaVersion":2,"artifactType":"application/wasm","blobs":[{"digest":"` + layer + `","size":3}]}`},
+		{name: "index", ref: "registry.example/test/app:latest", data: `{"schemaVersion":2,"manifests":[{"digest":"` + layer + `"}]}`, wantErr: true},
+		{name: "config", ref: "registry.example/test/app:latest", data: `{"rootfs":{"type":"layers","diff_ids":[]}}`, wantErr: true},
+		{name: "not JSON", ref: "registry.example/test/app:latest", data: `layers`, wantErr: true},
+		{name: "bad ref", ref: "app", data: `{"schemaVersion":2,"layers":[{"digest":"` + layer + `","size":3}]}`, wantErr: true},
+		{name: "pinned", ref: "registry.example/test/app:latest@" + digest.FromString(`{"schemaVersion":2,"layers":[{"digest":"`+layer+`","size":3}]}`).String(), data: `{"schemaVersion":2,"layers":[{"digest":"` + layer + `","size":3}]}`},
+		{name: "pinned elsewhere", ref: "registry.example/test/app@" + layer, data: `{"schemaVersion":2,"layers":[{"digest":"` + layer + `","size":3}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewRemoteRegistryStorage(false).WithManifestBytes(tt.ref, []byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("WithManifestBytes() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WithManifestBytes() error = %v", err)
+			}
+			// The registry host does not resolve, so any request would fail.
+			manifest, err := client.GetManifest(context.Background(), tt.ref)
+			if err != nil {
+				t.Fatalf("GetManifest() error = %v", err)
+			}
+			if descs := manifest.AllDescriptors(); len(descs) != 1 || descs[0].Digest != layer {
+				t.Fatalf("blobs = %+v, want %s", descs, layer)
+			}
+			if want := digest.FromString(tt.data); manifest.Digest != want {
+				t.Fatalf("Digest = %s, want %s", manifest.Digest, want)
+			}
+		})
+	}
+}
+
+func TestReadBlob_StatusErrorDiagnostics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/") && r.URL.RawQuery == "" {
+			http.Redirect(w, r, "/storage/blob?X-Signature=secret", http.StatusTemporaryRedirect)
+			return
+		}
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	store := NewRemoteRegistryStorage(false).NewStorage(host, "test/app", &Manifest{})
+
+	_, err := store.ReadBlob(context.Background(), digest.FromString("blob"), 0, 10)
+	var statusErr *stargzerrors.HTTPStatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("ReadBlob() error = %v, want HTTPStatusError", err)
+	}
+	if statusErr.StatusCode != http.StatusForbidden || statusErr.Registry != host {
+		t.Fatalf("status error = %+v", statusErr)
+	}
+	if want := server.URL + "/storage/blob"; statusErr.URL != want {
+		t.Fatalf("URL = %q, want the redirected URL without its query %q", statusErr.URL, want)
+	}
+}
+
+// newScopedRegistry serves a blob whose HEAD and range requests need a token
+// with push scope, answering pull-scoped tokens with 403 like older
+// Artifactory releases. It records the scopes tokens were requested for.
+func newScopedRegistry(t *testing.T, blob []byte) (*httptest.Server, *[]string) {
+	t.Helper()
+	var scopes []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			scope := r.URL.Query().Get("scope")
+			scopes = append(scopes, scope)
+			json.NewEncoder(w).Encode(map[string]string{"token": scope})
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:test/app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.Contains(token, "push") {
+			w.WriteHeader(http.StatusForbidden)
+			if r.Method != http.MethodHead {
+				w.Write([]byte(`{"errors":[{"code":"DENIED","message":"insufficient_scope"}]}`))
+			}
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(blob)
+	}))
+	t.Cleanup(server.Close)
+	return server, &scopes
+}
+
+func TestBlobRequests_ScopeEscalation(t *testing.T) {
+	blob := []byte("layer data")
+	dgst := digest.FromBytes(blob)
+
+	for _, method := range []string{"HEAD", "GET"} {
+		t.Run(method, func(t *testing.T) {
+			server, scopes := newScopedRegistry(t, blob)
+			host := strings.TrimPrefix(server.URL, "http://")
+			store := NewRemoteRegistryStorage(false).NewStorage(host, "test/app", &Manifest{})
+
+			if method == "HEAD" {
+				size, err := store.(BlobSizer).BlobSize(context.Background(), dgst)
+				if err != nil || size != int64(len(blob)) {
+					t.Fatalf("BlobSize() = %d, %v; want %d", size, err, len(blob))
+				}
+			} else {
+				body, err := store.ReadBlob(context.Background(), dgst, 0, 0)
+				if err != nil {
+					t.Fatalf("ReadBlob() error = %v", err)
+				}
+				body.Close()
+			}
+			want := []string{"repository:test/app:pull", "repository:test/app:pull,push"}
+			if strings.Join(*scopes, " ") != strings.Join(want, " ") {
+				t.Errorf("token scopes = %v, want %v", *scopes, want)
+			}
+		})
+	}
+
+	t.Run("configured", func(t *testing.T) {
+		server, scopes := newScopedRegistry(t, blob)
+		host := strings.TrimPrefix(server.URL, "http://")
+		store := NewRemoteRegistryStorage(false).WithTokenScope(host, "push").NewStorage(host, "test/app", &Manifest{})
+		if _, err := store.(BlobSizer).BlobSize(context.Background(), dgst); err != nil {
+			t.Fatalf("BlobSize() error = %v", err)
+		}
+		if len(*scopes) != 1 || (*scopes)[0] != "repository:test/app:pull,push" {
+			t.Errorf("token scopes = %v, want one push-scoped token", *scopes)
+		}
+	})
+}
+
+func TestParseWWWAuth(t *testing.T) {
+	params := parseWWWAuth(`Bearer realm="https://auth.example.com/token",service="registry",scope="repository:a/b:pull,push",error="insufficient_scope"`)
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry",
+		"scope":   "repository:a/b:pull,push",
+		"error":   "insufficient_scope",
+	}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("%s = %q, want %q", key, params[key], value)
+		}
+	}
+	if got := addScopeActions("repository:a/b:pull", []string{"push", "pull"}); got != "repository:a/b:pull,push" {
+		t.Errorf("addScopeActions() = %q", got)
+	}
+}
+
+func TestRegistryURL(t *testing.T) {
+	tests := map[string]string{
+		"docker.io":       "https://registry-1.docker.io",
+		"index.docker.io": "https://registry-1.docker.io",
+		"ghcr.io":         "https://ghcr.io",
+		"localhost:5000":  "http://localhost:5000",
+		"127.0.0.1:5000":  "http://127.0.0.1:5000",
+	}
+	for registry, want := range tests {
+		if got := registryURL(registry); got != want {
+			t.Errorf("registryURL(%q) = %q, want %q", registry, got, want)
+		}
+	}
+}
+
+func TestReadBlob_RangeHandling(t *testing.T) {
+	blob := []byte("0123456789")
+	dgst := digest.FromBytes(blob)
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		want     string
+		wantCode string
+	}{
+		{
+			name: "honored",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+			},
+			want: "3456",
+		},
+		{
+			name:    "ignored",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write(blob) },
+			want:    "3456",
+		},
+		{
+			// A 206 for the wrong bytes is not retried as is: the whole
+			// blob is requested instead and the range skipped to.
+			name: "wrong range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") == "" {
+					w.Write(blob)
+					return
+				}
+				w.Header().Set("Content-Range", "bytes 0-3/10")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(blob[:4])
+			},
+			want: "3456",
+		},
+		{
+			name: "wrong range and short blob",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") == "" {
+					w.Write(blob[:2])
+					return
+				}
+				w.Header().Set("Content-Range", "bytes 0-3/10")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(blob[:4])
+			},
+			wantCode: stargzerrors.ErrRangeIgnored.Code,
+		},
+		{
+			name:     "ignored and short",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.Write(blob[:2]) },
+			wantCode: stargzerrors.ErrRangeIgnored.Code,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			store := NewRemoteRegistryStorage(false).NewStorage(strings.TrimPrefix(server.URL, "http://"), "test/app", &Manifest{})
+
+			body, err := store.ReadBlob(context.Background(), dgst, 3, 4)
+			if tt.wantCode != "" {
+				if code := stargzerrors.GetErrorCode(err); code != tt.wantCode {
+					t.Fatalf("ReadBlob() error = %v, want code %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadBlob() error = %v", err)
+			}
+			defer body.Close()
+			got, err := io.ReadAll(body)
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("ReadBlob() = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadBlob_ExpiredAccess(t *testing.T) {
+	blob := []byte("layer data")
+	dgst := digest.FromBytes(blob)
+
+	t.Run("token", func(t *testing.T) {
+		// Only the latest token is accepted, and none once revoked.
+		var mu sync.Mutex
+		issued, revoked := 0, false
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if r.URL.Path == "/token" {
+				issued++
+				json.NewEncoder(w).Encode(map[string]string{"token": "fakeToken" + strconv.Itoa(issued)})
+				return
+			}
+			if revoked || r.Header.Get("Authorization") != "Bearer fakeToken"+strconv.Itoa(issued) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:test/app:pull"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write(blob)
+		}))
+		defer server.Close()
+		store := NewRemoteRegistryStorage(false).NewStorage(strings.TrimPrefix(server.URL, "http://"), "test/app", &Manifest{})
+		read := func() error {
+			body, err := store.ReadBlob(context.Background(), dgst, 0, 0)
+			if err == nil {
+				body.Close()
+			}
+			return err
+		}
+
+		if err := read(); err != nil {
+			t.Fatalf("first ReadBlob() error = %v", err)
+		}
+		mu.Lock()
+		issued++ // The token handed out expires
+		mu.Unlock()
+		if err := read(); err != nil {
+			t.Fatalf("ReadBlob() after the token expired: %v", err)
+		}
+		mu.Lock()
+		revoked = true
+		mu.Unlock()
+		err := read()
+		if code := stargzerrors.GetErrorCode(err); code != stargzerrors.ErrTokenExpired.Code || !stargzerrors.IsPermanent(err) {
+			t.Fatalf("ReadBlob() with access revoked: error = %v, want permanent %s", err, stargzerrors.ErrTokenExpired.Code)
+		}
+	})
+
+	t.Run("signed URL", func(t *testing.T) {
+		// The storage accepts the signature of every second redirect, or
+		// none once valid is false.
+		var mu sync.Mutex
+		signatures, valid := 0, true
+		storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !valid || r.URL.Query().Get("X-Signature") != strconv.Itoa(signatures) || signatures%2 == 1 {
+				http.Error(w, "Request has expired", http.StatusForbidden)
+				return
+			}
+			w.Write(blob)
+		}))
+		defer storage.Close()
+		registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			signatures++
+			location := storage.URL + "/blob?X-Signature=" + strconv.Itoa(signatures)
+			mu.Unlock()
+			http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+		}))
+		defer registry.Close()
+		store := NewRemoteRegistryStorage(false).NewStorage(strings.TrimPrefix(registry.URL, "http://"), "test/app", &Manifest{})
+
+		body, err := store.ReadBlob(context.Background(), dgst, 0, 0)
+		if err != nil {
+			t.Fatalf("ReadBlob() error = %v", err)
+		}
+		body.Close()
+		if signatures != 2 {
+			t.Fatalf("registry redirected %d times, want 2", signatures)
+		}
+
+		valid = false
+		_, err = store.ReadBlob(context.Background(), dgst, 0, 0)
+		if code := stargzerrors.GetErrorCode(err); code != stargzerrors.ErrTokenExpired.Code {
+			t.Fatalf("ReadBlob() error = %v, want %s", err, stargzerrors.ErrTokenExpired.Code)
+		}
+		var statusErr *stargzerrors.HTTPStatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+			t.Fatalf("ReadBlob() error = %v, want the storage's 403 as its cause", err)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// tokenStore holds bearer tokens per registry and repository. Registries
+// scope tokens to a repository, so a token fetched for one image must not be
+// replayed against another. It is safe for concurrent use, letting many
+// repositories share one RemoteRegistryStorage.
+type tokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+
+	// challenges holds the bearer challenge each token was obtained with,
+	// so its scope can be escalated after a 403 that carries none.
+	challenges map[string]string
+
+	// refreshes holds the token requests in flight, so goroutines refused
+	// at once share one request instead of each fetching a token.
+	refreshes map[string]*tokenRefresh
+}
+
+type tokenRefresh struct {
+	ready chan struct{}
+	err   error
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{
+		tokens:     make(map[string]string),
+		challenges: make(map[string]string),
+		refreshes:  make(map[string]*tokenRefresh),
+	}
+}
+
+func tokenKey(registry, repository string) string {
+	return normalizeRegistryHost(registry) + "/" + repository
+}
+
+func (t *tokenStore) get(registry, repository string) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tokens[tokenKey(registry, repository)]
+}
+
+func (t *tokenStore) set(registry, repository, token string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[tokenKey(registry, repository)] = token
+}
+
+func (t *tokenStore) challenge(registry, repository string) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.challenges[tokenKey(registry, repository)]
+}
+
+func (t *tokenStore) setChallenge(registry, repository, wwwAuth string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.challenges[tokenKey(registry, repository)] = wwwAuth
+}
+
+// refresh replaces the token of registry and repository with one from
+// fetch, obtained with the challenge wwwAuth, after a request made with the
+// token sent was refused. If the token has changed since, another goroutine
+// already replaced it and refresh returns at once; if another goroutine is
+// replacing it, refresh waits for its result instead of fetching again.
+func (t *tokenStore) refresh(ctx context.Context, registry, repository, sent, wwwAuth string, fetch func() (string, error)) error {
+	key := tokenKey(registry, repository)
+	t.mu.Lock()
+	if t.tokens[key] != sent {
+		t.mu.Unlock()
+		return nil
+	}
+	if r, ok := t.refreshes[key]; ok {
+		t.mu.Unlock()
+		select {
+		case <-r.ready:
+			return r.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	r := &tokenRefresh{ready: make(chan struct{})}
+	t.refreshes[key] = r
+	t.mu.Unlock()
+
+	token, err := fetch()
+
+	t.mu.Lock()
+	if err == nil {
+		t.tokens[key] = token
+		t.challenges[key] = wwwAuth
+	}
+	r.err = err
+	delete(t.refreshes, key)
+	t.mu.Unlock()
+	close(r.ready)
+	return err
+}
@@ -0,0 +1,328 @@
+package stargzget
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	"github.com/opencontainers/go-digest"
+)
+
+// SyncStateFile is the file, in the root of a synced directory, that
+// records what the last sync wrote there.
+const SyncStateFile = ".starget-sync.json"
+
+const syncStateVersion = 1
+
+// SyncState records what a sync wrote into a directory, so the next one
+// only touches what changed: files whose content differs from the image,
+// files the image no longer has, and files edited or deleted locally since.
+// Files it does not list are never removed.
+type SyncState struct {
+	Version        int                    `json:"version"`
+	Image          string                 `json:"image"`
+	ManifestDigest digest.Digest          `json:"manifestDigest"`
+	Files          map[string]*SyncedFile `json:"files"` // By path in the image
+}
+
+// SyncedFile is a file or symlink written by a sync.
+type SyncedFile struct {
+	Type     string    `json:"type"`               // reg or symlink; hard links are written as regular files
+	Content  string    `json:"content,omitempty"`  // TOC digest of a regular file, or its layer and path when the TOC has none
+	LinkName string    `json:"linkName,omitempty"` // Symlink target as written
+	Size     int64     `json:"size,omitempty"`     // Size of the written file, to notice local edits
+	ModTime  time.Time `json:"modTime,omitempty"`  // Modification time of the written file, to notice local edits
+}
+
+// ReadSyncState reads the state of a synced directory. A directory that was
+// never synced has an empty state.
+func ReadSyncState(dir string) (*SyncState, error) {
+	data, err := os.ReadFile(filepath.Join(dir, SyncStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return &SyncState{Version: syncStateVersion, Files: make(map[string]*SyncedFile)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state SyncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", SyncStateFile, err)
+	}
+	if state.Version != syncStateVersion {
+		return nil, fmt.Errorf("%s has unsupported version %d", SyncStateFile, state.Version)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*SyncedFile)
+	}
+	return &state, nil
+}
+
+// Write saves the state into dir, replacing the previous one atomically.
+func (s *SyncState) Write(dir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, SyncStateFile)
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Drifted returns the paths, sorted, of files the state lists that are
+// missing from dir or were changed there since they were synced.
+func (s *SyncState) Drifted(dir string) []string {
+	var drifted []string
+	for path, file := range s.Files {
+		if !file.matches(filepath.Join(dir, filepath.FromSlash(path))) {
+			drifted = append(drifted, path)
+		}
+	}
+	sort.Strings(drifted)
+	return drifted
+}
+
+// matches reports whether the file at local is still the one that was
+// synced.
+func (f *SyncedFile) matches(local string) bool {
+	info, err := os.Lstat(local)
+	if err != nil {
+		return false
+	}
+	if f.Type == "symlink" {
+		target, err := os.Readlink(local)
+		return err == nil && info.Mode()&os.ModeSymlink != 0 && target == filepath.FromSlash(f.LinkName)
+	}
+	return info.Mode().IsRegular() && info.Size() == f.Size && info.ModTime().Equal(f.ModTime)
+}
+
+// SyncPlan is what PlanSync found to do to bring a directory up to date.
+// Apply carries it out.
+type SyncPlan struct {
+	Remove    []string       // Paths to delete, deepest first, including files about to be rewritten
+	Deleted   int            // Paths of Remove the image no longer has
+	Download  []*DownloadJob // Regular files, and hard links resolved to their targets, to write
+	Symlinks  []*FileInfo    // Symlinks to create, with absolute targets made relative
+	Unchanged int            // Files left as they are
+
+	dir  string
+	next *SyncState
+	kept map[string]bool
+}
+
+// PlanSync compares the merged view of index with previous, the state of
+// dir, and with the files found in dir. Regular files, hard links and
+// symlinks are synced; directories are created as needed and other entry
+// types are left out. A file is rewritten when its content in the image
+// changed or it was changed locally, and removed when the image no longer
+// has it. Every listed file that is not kept is removed first, so a new
+// file is never written through an old symlink.
+func PlanSync(ctx context.Context, index *ImageIndex, resolver BlobResolver, dir string, previous *SyncState) (*SyncPlan, error) {
+	plan := &SyncPlan{
+		dir:  dir,
+		next: &SyncState{Version: syncStateVersion, ManifestDigest: index.ManifestDigest, Files: make(map[string]*SyncedFile)},
+		kept: make(map[string]bool),
+	}
+	for _, info := range index.FilterFiles(".", "") {
+		if err := syncPath(info.Path); err != nil {
+			return nil, err
+		}
+		if info.Path == SyncStateFile {
+			logger.Warn("Not syncing %s, whose name is taken by the sync state", info.Path)
+			continue
+		}
+		want := &SyncedFile{Type: "reg"}
+		var job *DownloadJob
+		switch {
+		case info.IsSymlink():
+			want.Type = "symlink"
+			want.LinkName = syncLinkTarget(info)
+		case info.IsRegular() || info.IsHardlink():
+			source, err := index.ResolveFile(info, "")
+			if err != nil {
+				return nil, err
+			}
+			meta, err := resolver.FileMetadata(ctx, source.BlobDigest, source.Path)
+			if err != nil {
+				return nil, err
+			}
+			want.Content = meta.Digest
+			if want.Content == "" {
+				want.Content = source.BlobDigest.String() + ":" + source.Path
+			}
+			job = &DownloadJob{
+				Path:       source.Path,
+				BlobDigest: source.BlobDigest,
+				Size:       source.Size,
+				OutputPath: plan.local(info.Path),
+				Mode:       source.Mode,
+				UID:        source.UID,
+				GID:        source.GID,
+				ModTime:    source.ModTime,
+			}
+		default:
+			continue
+		}
+
+		if old, ok := previous.Files[info.Path]; ok && old.Type == want.Type && old.Content == want.Content && old.LinkName == want.LinkName &&
+			old.matches(plan.local(info.Path)) {
+			plan.next.Files[info.Path] = old
+			plan.kept[info.Path] = true
+			plan.Unchanged++
+			continue
+		}
+		plan.next.Files[info.Path] = want
+		if job != nil {
+			plan.Download = append(plan.Download, job)
+		} else {
+			link := *info
+			link.LinkName = want.LinkName
+			plan.Symlinks = append(plan.Symlinks, &link)
+		}
+	}
+
+	for path := range previous.Files {
+		if err := syncPath(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", SyncStateFile, err)
+		}
+		if !plan.kept[path] {
+			plan.Remove = append(plan.Remove, path)
+			if _, ok := plan.next.Files[path]; !ok {
+				plan.Deleted++
+			}
+		}
+	}
+	sort.Slice(plan.Remove, func(i, j int) bool { return plan.Remove[i] > plan.Remove[j] })
+	return plan, nil
+}
+
+// syncLinkTarget is the target a symlink is created with: absolute targets
+// are made relative, so they point into the synced directory rather than
+// the host's root.
+func syncLinkTarget(info *FileInfo) string {
+	target := info.LinkName
+	if pathpkg.IsAbs(target) {
+		if rel, err := filepath.Rel(pathpkg.Dir("/"+info.Path), pathpkg.Clean(target)); err == nil {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return target
+}
+
+// Apply removes, downloads and links what the plan lists, and returns the
+// state of the directory afterwards, recording image as its source. Files
+// that could not be written are left out of the state, so the next sync
+// tries them again; their errors are joined into the returned error, as is
+// a failed download. Directories left empty by removals are removed too.
+func (p *SyncPlan) Apply(ctx context.Context, downloader Downloader, image string, opts *DownloadOptions) (*SyncState, *DownloadStats, error) {
+	var errs []error
+	for _, path := range p.Remove {
+		local := p.local(path)
+		if err := os.Remove(local); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		// Prune parents that are now empty; Remove fails on the others.
+		for dir := filepath.Dir(local); dir != filepath.Clean(p.dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+
+	var stats *DownloadStats
+	failed := make(map[string]bool) // Layer and path of files that failed
+	if len(p.Download) > 0 {
+		var o DownloadOptions
+		if opts != nil {
+			o = *opts
+		}
+		var mu sync.Mutex
+		onWarning := o.OnWarning
+		o.OnWarning = func(w Warning) {
+			if w.Kind == WarningFileFailed {
+				mu.Lock()
+				failed[w.BlobDigest.String()+":"+w.Path] = true
+				mu.Unlock()
+			}
+			if onWarning != nil {
+				onWarning(w)
+			}
+		}
+		var err error
+		if stats, err = downloader.StartDownload(ctx, p.Download, nil, &o); err != nil {
+			errs = append(errs, err)
+		} else if stats.FailedFiles+stats.BlockedFiles > 0 {
+			errs = append(errs, fmt.Errorf("%d file(s) failed to download and %d were blocked", stats.FailedFiles, stats.BlockedFiles))
+		}
+	}
+	for _, job := range p.Download {
+		if failed[job.BlobDigest.String()+":"+job.Path] {
+			os.Remove(job.OutputPath)
+		}
+	}
+
+	for _, link := range p.Symlinks {
+		local := p.local(link.Path)
+		err := os.MkdirAll(filepath.Dir(local), 0o755)
+		if err == nil {
+			err = os.Symlink(filepath.FromSlash(link.LinkName), local)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("symlink %s: %w", link.Path, err))
+		}
+	}
+
+	return p.state(image), stats, errors.Join(errs...)
+}
+
+// state returns the state of the directory after Apply, recording the size
+// and time of each file as written. Files that are missing are left out.
+func (p *SyncPlan) state(image string) *SyncState {
+	p.next.Image = image
+	for path, file := range p.next.Files {
+		if p.kept[path] {
+			continue
+		}
+		local := p.local(path)
+		info, err := os.Lstat(local)
+		if err != nil {
+			delete(p.next.Files, path)
+			continue
+		}
+		if file.Type == "reg" {
+			file.Size, file.ModTime = info.Size(), info.ModTime()
+		}
+		if !file.matches(local) {
+			delete(p.next.Files, path)
+		}
+	}
+	return p.next
+}
+
+// local returns where path, checked by syncPath, lives in the directory.
+func (p *SyncPlan) local(path string) string {
+	return filepath.Join(p.dir, filepath.FromSlash(path))
+}
+
+// syncPath checks that path, from the image or a state file, stays inside
+// the synced directory.
+func syncPath(path string) error {
+	if _, _, err := PathRewriter(nil).Rewrite(path); err != nil {
+		return err
+	}
+	if cleanTOCPath(path) != path {
+		return fmt.Errorf("path %q is not clean", path)
+	}
+	return nil
+}
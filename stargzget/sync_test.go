@@ -0,0 +1,154 @@
+package stargzget
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/registrytest"
+	"github.com/flaneur2020/stargz-get/stargzget/refs"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+// syncImage plans and applies a sync of imageRef into dir and saves the
+// state, as 'starget sync' does.
+func syncImage(t *testing.T, imageRef, dir string) *SyncPlan {
+	t.Helper()
+	ctx := context.Background()
+	client := stor.NewRemoteRegistryStorage(false)
+	ref, err := refs.Parse(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := client.GetManifest(ctx, imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := client.NewStorage(ref.Registry, ref.Repository, manifest)
+	resolver := NewBlobResolver(storage)
+	index, err := NewBlobIndexLoader(storage, resolver).Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.ManifestDigest = manifest.Digest
+
+	previous, err := ReadSyncState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanSync(ctx, index, resolver, dir, previous)
+	if err != nil {
+		t.Fatalf("PlanSync() error = %v", err)
+	}
+	state, _, err := plan.Apply(ctx, NewDownloader(resolver, storage), imageRef, nil)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if err := state.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	return plan
+}
+
+func planned(plan *SyncPlan) (download, symlinks []string) {
+	for _, job := range plan.Download {
+		download = append(download, job.OutputPath)
+	}
+	for _, link := range plan.Symlinks {
+		symlinks = append(symlinks, link.Path)
+	}
+	return download, symlinks
+}
+
+func TestSync(t *testing.T) {
+	registry := registrytest.New()
+	defer registry.Close()
+	v1 := registry.AddImage("test/app", "v1", estargztest.NewBuilder().
+		Dir("etc/").
+		File("etc/config", []byte("v1 config\n")).
+		File("etc/motd", []byte("hello\n")).
+		Dir("old/").
+		File("old/file", []byte("going away\n")).
+		Symlink("etc/current", "/etc/config").
+		MustBuild())
+	v2 := registry.AddImage("test/app", "v2", estargztest.NewBuilder().
+		Dir("etc/").
+		File("etc/config", []byte("v2 config\n")).
+		File("etc/motd", []byte("hello\n")).
+		File("etc/new", []byte("new\n")).
+		Symlink("etc/current", "/etc/config").
+		MustBuild())
+	dir := t.TempDir()
+	local := func(path string) string { return filepath.Join(dir, filepath.FromSlash(path)) }
+
+	plan := syncImage(t, v1, dir)
+	if len(plan.Download) != 3 || len(plan.Symlinks) != 1 || plan.Unchanged != 0 {
+		t.Fatalf("first sync: download %d, symlinks %d, unchanged %d; want 3, 1, 0", len(plan.Download), len(plan.Symlinks), plan.Unchanged)
+	}
+	if target, err := os.Readlink(local("etc/current")); err != nil || target != "config" {
+		t.Fatalf("etc/current -> %q (%v), want config", target, err)
+	}
+
+	plan = syncImage(t, v1, dir)
+	if len(plan.Download)+len(plan.Symlinks)+len(plan.Remove) != 0 || plan.Unchanged != 4 {
+		t.Fatalf("repeated sync changed files: %+v", plan)
+	}
+
+	// Local edits are noticed and undone.
+	if err := os.WriteFile(local("etc/motd"), []byte("edited\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(local("etc/motd"), time.Now(), time.Now().Add(time.Hour))
+	state, err := ReadSyncState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drifted := state.Drifted(dir); !reflect.DeepEqual(drifted, []string{"etc/motd"}) {
+		t.Fatalf("Drifted() = %v, want [etc/motd]", drifted)
+	}
+	plan = syncImage(t, v1, dir)
+	if download, _ := planned(plan); !reflect.DeepEqual(download, []string{local("etc/motd")}) {
+		t.Fatalf("repair downloaded %v, want etc/motd", download)
+	}
+
+	// An untracked file is left alone.
+	if err := os.WriteFile(local("mine"), []byte("keep\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan = syncImage(t, v2, dir)
+	download, symlinks := planned(plan)
+	if !reflect.DeepEqual(download, []string{local("etc/config"), local("etc/new")}) || len(symlinks) != 0 || plan.Unchanged != 2 {
+		t.Fatalf("update downloaded %v and linked %v with %d unchanged, want etc/config and etc/new with 2 unchanged", download, symlinks, plan.Unchanged)
+	}
+	for path, want := range map[string]string{"etc/config": "v2 config\n", "etc/motd": "hello\n", "etc/new": "new\n", "mine": "keep\n"} {
+		if got, err := os.ReadFile(local(path)); err != nil || string(got) != want {
+			t.Errorf("%s = %q (%v), want %q", path, got, err, want)
+		}
+	}
+	if plan.Deleted != 1 {
+		t.Errorf("Deleted = %d, want 1 (old/file)", plan.Deleted)
+	}
+	if _, err := os.Lstat(local("old")); !os.IsNotExist(err) {
+		t.Errorf("old/ still exists after its only file was removed (%v)", err)
+	}
+	state, err = ReadSyncState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Image != v2 || len(state.Files) != 4 {
+		t.Errorf("state records %s with %d files, want %s with 4", state.Image, len(state.Files), v2)
+	}
+}
+
+func TestPlanSync_UnsafeStatePath(t *testing.T) {
+	index := NewImageIndexFromTOCs("", nil)
+	previous := &SyncState{Files: map[string]*SyncedFile{"../outside": {Type: "reg"}}}
+	if _, err := PlanSync(context.Background(), index, nil, t.TempDir(), previous); err == nil {
+		t.Fatal("PlanSync() accepted a state path outside the directory")
+	}
+}
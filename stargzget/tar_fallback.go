@@ -0,0 +1,395 @@
+package stargzget
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// streamableFormat reports the format of a layer that readTOC rejected with
+// ErrUnsupportedLayerFormat, if it is one WithTarFallback can read.
+func streamableFormat(err error) (LayerFormat, bool) {
+	var se *stargzerrors.StargzError
+	if !errors.As(err, &se) || se.Code != stargzerrors.ErrUnsupportedLayerFormat.Code {
+		return "", false
+	}
+	format, _ := se.Details["format"].(string)
+	switch LayerFormat(format) {
+	case LayerFormatGzip, LayerFormatTar:
+		return LayerFormat(format), true
+	}
+	return "", false
+}
+
+// CanTarFallback reports whether err is the failure of a plain gzip or tar
+// layer, which a resolver with WithTarFallback would read instead.
+func CanTarFallback(err error) bool {
+	_, ok := streamableFormat(err)
+	return ok
+}
+
+// openLayerTar opens the whole blob as one tar stream, decompressing it
+// unless format is LayerFormatTar. The returned func releases the stream.
+func openLayerTar(ctx context.Context, storage stor.Storage, blobDigest digest.Digest, format LayerFormat) (*tar.Reader, func(), error) {
+	body, err := storage.ReadBlob(ctx, blobDigest, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if format == LayerFormatTar {
+		return tar.NewReader(body), func() { body.Close() }, nil
+	}
+	gz, err := getGzipReader(body)
+	if err != nil {
+		body.Close()
+		return nil, nil, fmt.Errorf("failed to decompress layer %s: %w", blobDigest, err)
+	}
+	return tar.NewReader(gz), func() {
+		putGzipReader(gz)
+		body.Close()
+	}, nil
+}
+
+// tarEntryTypes maps tar header types to TOC entry types. Other headers,
+// such as PAX global headers, are not entries of the layer.
+var tarEntryTypes = map[byte]string{
+	tar.TypeReg:     "reg",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// scanLayer reads a plain gzip or tar layer from start to end and builds a
+// TOC of its entries, with the digest of every regular file. When the tar
+// holds the same name twice, the later entry wins, as it does when the
+// layer is applied.
+func scanLayer(ctx context.Context, storage stor.Storage, blobDigest digest.Digest, format LayerFormat) (*estargzutil.JTOC, error) {
+	tr, release, err := openLayerTar(ctx, storage, blobDigest, format)
+	if err != nil {
+		return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).WithCause(err)
+	}
+	defer release()
+
+	toc := &estargzutil.JTOC{Version: 1, StreamedFormat: string(format)}
+	seen := make(map[string]int)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).
+				WithMessage("failed to read plain layer").WithCause(err)
+		}
+		entry, ok := tocEntryFromHeader(hdr)
+		if !ok {
+			continue
+		}
+		if entry.Type == "reg" {
+			digester := digest.Canonical.Digester()
+			if _, err := io.Copy(digester.Hash(), tr); err != nil {
+				return nil, stargzerrors.ErrTOCDownload.WithDetail("blobDigest", blobDigest.String()).
+					WithMessage("failed to read plain layer").WithCause(err)
+			}
+			entry.Digest = digester.Digest().String()
+		}
+		if i, ok := seen[entry.Name]; ok {
+			toc.Entries[i] = entry
+			continue
+		}
+		seen[entry.Name] = len(toc.Entries)
+		toc.Entries = append(toc.Entries, entry)
+	}
+	return toc, nil
+}
+
+// tocEntryFromHeader describes hdr the way an eStargz TOC would.
+func tocEntryFromHeader(hdr *tar.Header) (*estargzutil.TOCEntry, bool) {
+	typ, ok := tarEntryTypes[hdr.Typeflag]
+	if !ok {
+		return nil, false
+	}
+	name := cleanEntryName(hdr.Name)
+	if name == "" || name == "." {
+		return nil, false
+	}
+	entry := &estargzutil.TOCEntry{
+		Name:     name,
+		Type:     typ,
+		Mode:     hdr.Mode,
+		UID:      hdr.Uid,
+		GID:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		DevMajor: int(hdr.Devmajor),
+		DevMinor: int(hdr.Devminor),
+		LinkName: hdr.Linkname,
+	}
+	if !hdr.ModTime.IsZero() {
+		entry.ModTime3339 = hdr.ModTime.UTC().Format(time.RFC3339)
+	}
+	switch typ {
+	case "reg":
+		entry.Size = hdr.Size
+	case "hardlink":
+		entry.LinkName = cleanEntryName(hdr.Linkname)
+	}
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+			if entry.Xattrs == nil {
+				entry.Xattrs = make(map[string][]byte)
+			}
+			entry.Xattrs[name] = []byte(value)
+		}
+	}
+	return entry, true
+}
+
+// layerStreams extracts the files of streamed layers for one download
+// session. Files of such layers cannot be fetched one by one, so the first
+// job that needs one reads the whole blob and spools every file the session
+// wants from it; the other jobs of the layer wait for that pass and copy
+// their file from the spool.
+type layerStreams struct {
+	mu     sync.Mutex
+	dir    string                            // Spool directory, created on first use
+	wanted map[digest.Digest]map[string]bool // Paths the session needs, by blob
+	passes map[digest.Digest]*layerPass      // Latest pass over each blob
+}
+
+// layerPass is one read of a streamed layer.
+type layerPass struct {
+	done   chan struct{}
+	wanted map[string]bool   // Paths the pass extracts
+	files  map[string]string // Spooled files by path; set once done is closed
+	err    error             // Set once done is closed
+}
+
+func newLayerStreams() *layerStreams {
+	return &layerStreams{
+		wanted: make(map[digest.Digest]map[string]bool),
+		passes: make(map[digest.Digest]*layerPass),
+	}
+}
+
+// want records that the session needs path from blob, so the pass over the
+// blob extracts it along with the others.
+func (l *layerStreams) want(blob digest.Digest, path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.wantLocked(blob, path)
+}
+
+func (l *layerStreams) wantLocked(blob digest.Digest, path string) {
+	if l.wanted[blob] == nil {
+		l.wanted[blob] = make(map[string]bool)
+	}
+	l.wanted[blob][path] = true
+}
+
+// spooled returns the spool file holding path from blob, reading the blob
+// unless a pass over it already extracted path or is doing so. A failed
+// pass is started again by the next job that asks, so retries work as they
+// do for chunked files.
+func (l *layerStreams) spooled(ctx context.Context, d *downloader, blob digest.Digest, format LayerFormat, path string) (string, error) {
+	for {
+		l.mu.Lock()
+		l.wantLocked(blob, path)
+		p := l.passes[blob]
+		if p == nil || p.stale(path) {
+			p = &layerPass{done: make(chan struct{}), wanted: make(map[string]bool)}
+			for name := range l.wanted[blob] {
+				p.wanted[name] = true
+			}
+			l.passes[blob] = p
+			l.mu.Unlock()
+			p.files, p.err = l.extract(ctx, d, blob, format, p.wanted)
+			close(p.done)
+		} else {
+			l.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-p.done:
+		}
+		if p.err != nil {
+			return "", p.err
+		}
+		if file, ok := p.files[path]; ok {
+			return file, nil
+		}
+		if p.wanted[path] {
+			return "", fmt.Errorf("%s not found in layer %s", path, blob)
+		}
+		// The pass started before path was wanted; read the blob again.
+	}
+}
+
+// stale reports whether p has finished without extracting path, because it
+// failed or did not know path was wanted.
+func (p *layerPass) stale(path string) bool {
+	select {
+	case <-p.done:
+		return p.err != nil || !p.wanted[path]
+	default:
+		return false
+	}
+}
+
+// extract reads blob once and spools the regular files named in wanted.
+func (l *layerStreams) extract(ctx context.Context, d *downloader, blob digest.Digest, format LayerFormat, wanted map[string]bool) (map[string]string, error) {
+	dir, err := l.spoolDir()
+	if err != nil {
+		return nil, err
+	}
+	tr, release, err := openLayerTar(ctx, d.storage, blob, format)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	files := make(map[string]string)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %s: %w", blob, err)
+		}
+		name := cleanEntryName(hdr.Name)
+		if tarEntryTypes[hdr.Typeflag] != "reg" || !wanted[name] {
+			continue
+		}
+		// A later entry of the same name replaces the earlier one.
+		f, err := os.CreateTemp(dir, "file-*")
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s from layer %s: %w", name, blob, err)
+		}
+		if old, ok := files[name]; ok {
+			os.Remove(old)
+		}
+		files[name] = f.Name()
+	}
+}
+
+func (l *layerStreams) spoolDir() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dir == "" {
+		dir, err := os.MkdirTemp("", "starget-layer-*")
+		if err != nil {
+			return "", err
+		}
+		l.dir = dir
+	}
+	return l.dir, nil
+}
+
+// cleanup removes every spooled file.
+func (l *layerStreams) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dir != "" {
+		os.RemoveAll(l.dir)
+		l.dir = ""
+	}
+}
+
+// downloadStreamed writes a file of a streamed layer to outFile from the
+// spool of the session's pass over the layer.
+func (s *downloadSession) downloadStreamed(ctx context.Context, jwo *jobWithOffset, outFile *os.File) error {
+	job := jwo.job
+	spooled, err := s.streams.spooled(ctx, s.d, job.BlobDigest, jwo.metadata.Streamed, job.Path)
+	if err != nil {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+	}
+	in, err := os.Open(spooled)
+	if err != nil {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+	}
+	defer in.Close()
+
+	if s.opts.ContentFilter != nil {
+		head := make([]byte, contentSniffLen)
+		n, err := io.ReadFull(in, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+		}
+		if err := s.checkContent(job, head[:n]); err != nil {
+			return err
+		}
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+		}
+	}
+	written, err := io.Copy(outFile, in)
+	if err != nil {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(err)
+	}
+	if written != jwo.metadata.Size {
+		return stargzerrors.ErrDownloadFailed.WithDetail("path", job.Path).WithCause(io.ErrUnexpectedEOF)
+	}
+
+	if s.progress != nil {
+		s.mu.Lock()
+		s.progress(jwo.baseOffset+written, s.totalSize)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// readStreamedHead returns up to n leading bytes of path, reading the
+// layer only as far as the file.
+func readStreamedHead(ctx context.Context, storage stor.Storage, blobDigest digest.Digest, format LayerFormat, path string, n int64) ([]byte, error) {
+	tr, release, err := openLayerTar(ctx, storage, blobDigest, format)
+	if err != nil {
+		return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+	}
+	defer release()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithMessage("file not found in layer")
+		}
+		if err != nil {
+			return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+		}
+		if tarEntryTypes[hdr.Typeflag] != "reg" || cleanEntryName(hdr.Name) != path {
+			continue
+		}
+		head, err := io.ReadAll(io.LimitReader(tr, n))
+		if err != nil {
+			return nil, stargzerrors.ErrDownloadFailed.WithDetail("path", path).WithCause(err)
+		}
+		return head, nil
+	}
+}
@@ -0,0 +1,125 @@
+package stargzget
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+// plainTar builds an uncompressed tar of name/content pairs, in order.
+func plainTar(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(files); i += 2 {
+		hdr := &tar.Header{Name: files[i], Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(files[i+1]))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBlobResolver_TarFallback(t *testing.T) {
+	storage := stor.NewMockStorage()
+	storage.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", estargztest.NewBuilder().File("bin/sh", []byte("sh")).MustBuild().Blob)
+	gzipped := storage.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip",
+		gzipCompress(t, plainTar(t, "./etc/os-release", "old", "./etc/os-release", "new", "etc/hosts", "hosts")))
+	plain := storage.AddBlob("application/vnd.oci.image.layer.v1.tar", plainTar(t, "usr/bin/tool", "tool"))
+
+	loader := NewBlobIndexLoader(storage, NewBlobResolver(storage))
+	index, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(index.Layers) != 1 || len(loader.Warnings()) != 2 {
+		t.Fatalf("without fallback: layers = %d, warnings = %v; want 1 layer and 2 skipped", len(index.Layers), loader.Warnings())
+	}
+
+	resolver := NewBlobResolver(storage, WithTarFallback())
+	loader = NewBlobIndexLoader(storage, resolver)
+	index, err = loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Load() with fallback error = %v", err)
+	}
+	if len(index.Layers) != 3 || len(loader.Warnings()) != 0 {
+		t.Fatalf("with fallback: layers = %d, warnings = %v; want 3 and none", len(index.Layers), loader.Warnings())
+	}
+	for _, path := range []string{"bin/sh", "etc/os-release", "etc/hosts", "usr/bin/tool"} {
+		if _, err := index.FindFile(path, ""); err != nil {
+			t.Errorf("FindFile(%q) error = %v", path, err)
+		}
+	}
+
+	meta, err := resolver.FileMetadata(context.Background(), gzipped, "etc/os-release")
+	if err != nil {
+		t.Fatalf("FileMetadata() error = %v", err)
+	}
+	// The later of two entries with the same name wins.
+	if meta.Streamed != LayerFormatGzip || meta.Size != 3 || len(meta.Chunks) != 0 || meta.Digest != "sha256:11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437" {
+		t.Errorf("FileMetadata() = %+v, want the later gzip entry without chunks", meta)
+	}
+	if meta, err := resolver.FileMetadata(context.Background(), plain, "usr/bin/tool"); err != nil || meta.Streamed != LayerFormatTar {
+		t.Errorf("FileMetadata() of the tar layer = %+v, %v; want streamed tar", meta, err)
+	}
+
+	// Layers that are not tar archives still fail.
+	broken := storage.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", gzipCompress(t, []byte("not a tar")))
+	if _, err := NewBlobResolver(storage, WithTarFallback()).TOC(context.Background(), broken); stargzerrors.GetErrorCode(err) != stargzerrors.ErrTOCDownload.Code {
+		t.Errorf("TOC() of a gzip blob that is not a tar = %v, want %s", err, stargzerrors.ErrTOCDownload.Code)
+	}
+}
+
+func TestDownloader_TarFallback(t *testing.T) {
+	storage := stor.NewMockStorage()
+	layer := estargztest.NewBuilder().File("bin/sh", []byte("sh")).MustBuild()
+	storage.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	gzipped := storage.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip",
+		gzipCompress(t, plainTar(t, "etc/a", "aaa", "etc/b", "bb", "etc/a", "again", "etc/c", "")))
+	plain := storage.AddBlob("application/vnd.oci.image.layer.v1.tar", plainTar(t, "usr/bin/tool", "tool"))
+
+	resolver := NewBlobResolver(storage, WithTarFallback())
+	dir := t.TempDir()
+	jobs := []*DownloadJob{
+		{Path: "bin/sh", BlobDigest: layer.Digest, Size: 2, OutputPath: filepath.Join(dir, "bin/sh")},
+		{Path: "etc/a", BlobDigest: gzipped, Size: 5, OutputPath: filepath.Join(dir, "etc/a")},
+		{Path: "etc/b", BlobDigest: gzipped, Size: 2, OutputPath: filepath.Join(dir, "etc/b")},
+		{Path: "etc/c", BlobDigest: gzipped, Size: 0, OutputPath: filepath.Join(dir, "etc/c")},
+		{Path: "usr/bin/tool", BlobDigest: plain, Size: 4, OutputPath: filepath.Join(dir, "usr/bin/tool")},
+	}
+	stats, err := NewDownloader(resolver, storage).StartDownload(context.Background(), jobs, nil, nil)
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+	if stats.DownloadedFiles != len(jobs) || stats.FailedFiles != 0 {
+		t.Fatalf("stats = %+v, want all %d files downloaded", stats, len(jobs))
+	}
+	for path, want := range map[string]string{"bin/sh": "sh", "etc/a": "again", "etc/b": "bb", "etc/c": "", "usr/bin/tool": "tool"} {
+		got, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+
+	// ReadFileHead streams the layer only up to the file.
+	head, err := ReadFileHead(context.Background(), resolver, storage, gzipped, "etc/b", 1)
+	if err != nil || string(head) != "b" {
+		t.Errorf("ReadFileHead() = %q, %v; want %q", head, err, "b")
+	}
+}
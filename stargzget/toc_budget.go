@@ -0,0 +1,132 @@
+package stargzget
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultTOCMemoryBudget is the default bound on the memory that TOCs being
+// parsed at once may take, estimated as described at SetTOCMemoryBudget.
+const DefaultTOCMemoryBudget int64 = 256 << 20
+
+// tocMemoryFactor estimates the memory a TOC takes while it is parsed from
+// its compressed length: TOC JSON compresses about eightfold, and the decoded
+// entries take about as much again as the JSON.
+const tocMemoryFactor = 16
+
+// tocBudget is shared by every resolver in the process, so loading the TOCs
+// of many layers or images at once holds a bounded amount of memory however
+// the loads are spread over resolvers.
+var tocBudget = newMemoryBudget(DefaultTOCMemoryBudget)
+
+// SetTOCMemoryBudget sets the process-wide bound, in bytes, on the memory of
+// TOCs being fetched and parsed at once. Each parse reserves an estimate
+// from the TOC's compressed size before reading it and gives it back once
+// the TOC is decoded; parses that do not fit wait for earlier ones, in
+// order. A TOC larger than the whole budget is parsed alone. n <= 0 removes
+// the bound. Parses already running keep their reservations.
+func SetTOCMemoryBudget(n int64) {
+	tocBudget.setLimit(n)
+}
+
+type budgetWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// memoryBudget is a weighted semaphore that grants waiters in arrival order,
+// so a large reservation is not starved by a stream of small ones.
+type memoryBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	peak    int64
+	waiters []*budgetWaiter
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit}
+}
+
+func (b *memoryBudget) setLimit(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = n
+	b.notifyLocked()
+}
+
+// acquire waits until n bytes fit in the budget and returns the function
+// that gives them back.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) (func(), error) {
+	b.mu.Lock()
+	if b.limit <= 0 {
+		b.mu.Unlock()
+		return func() {}, nil
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	w := &budgetWaiter{n: n, ready: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	b.notifyLocked()
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.ready:
+			// Granted while giving up; hand the reservation back.
+			b.used -= w.n
+		default:
+			for i, other := range b.waiters {
+				if other == w {
+					b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+		b.notifyLocked()
+		b.mu.Unlock()
+		return nil, ctx.Err()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.used -= w.n
+			b.notifyLocked()
+			b.mu.Unlock()
+		})
+	}, nil
+}
+
+// notifyLocked grants waiters from the front of the queue while they fit.
+func (b *memoryBudget) notifyLocked() {
+	for len(b.waiters) > 0 {
+		w := b.waiters[0]
+		if b.limit > 0 {
+			if w.n > b.limit {
+				w.n = b.limit
+			}
+			if b.used+w.n > b.limit {
+				return
+			}
+		}
+		b.used += w.n
+		if b.used > b.peak {
+			b.peak = b.used
+		}
+		b.waiters = b.waiters[1:]
+		close(w.ready)
+	}
+}
+
+// peakUse reports the most the budget has had reserved at once.
+func (b *memoryBudget) peakUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
@@ -0,0 +1,131 @@
+package stargzget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// useTOCBudget replaces the process-wide TOC budget for the rest of the test.
+func useTOCBudget(t *testing.T, limit int64) *memoryBudget {
+	t.Helper()
+	saved := tocBudget
+	tocBudget = newMemoryBudget(limit)
+	t.Cleanup(func() { tocBudget = saved })
+	return tocBudget
+}
+
+func TestTOCMemoryBudget_BoundsConcurrentParsing(t *testing.T) {
+	const layers, files = 6, 400
+	storage := stor.NewMockStorage()
+	var digests []digest.Digest
+	var reservation int64
+	for i := 0; i < layers; i++ {
+		b := estargztest.NewBuilder()
+		for j := 0; j < files; j++ {
+			b.File(fmt.Sprintf("layer%d/usr/share/doc/package-%05d/copyright", i, j), []byte("x"))
+		}
+		layer := b.MustBuild()
+		digests = append(digests, storage.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob))
+
+		tocOffset, _, err := estargzutil.ParseFooter(layer.Blob[len(layer.Blob)-estargzutil.FooterSize:])
+		if err != nil {
+			t.Fatalf("ParseFooter() error = %v", err)
+		}
+		reservation = max(reservation, (int64(len(layer.Blob))-tocOffset)*tocMemoryFactor)
+	}
+	// Room for two of the largest TOCs at a time.
+	budget := useTOCBudget(t, 2*reservation)
+
+	var wg sync.WaitGroup
+	for _, dgst := range digests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A resolver per layer, as when many images load at once.
+			toc, err := NewBlobResolver(storage).TOC(context.Background(), dgst)
+			if err != nil {
+				t.Errorf("TOC(%s) error = %v", dgst, err)
+				return
+			}
+			if len(toc.Entries) < files {
+				t.Errorf("TOC(%s) has %d entries, want at least %d", dgst, len(toc.Entries), files)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak := budget.peakUse(); peak > 2*reservation || peak == 0 {
+		t.Fatalf("peak reserved = %d, want within the budget of %d", peak, 2*reservation)
+	}
+	if budget.used != 0 {
+		t.Fatalf("reserved after all loads = %d, want 0", budget.used)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	t.Run("oversized reservation runs alone", func(t *testing.T) {
+		b := newMemoryBudget(10)
+		release, err := b.acquire(context.Background(), 100)
+		if err != nil {
+			t.Fatalf("acquire() error = %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := b.acquire(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("acquire() beside an oversized reservation = %v, want deadline exceeded", err)
+		}
+		release()
+		release() // Releasing twice is harmless.
+		if b.used != 0 || len(b.waiters) != 0 {
+			t.Fatalf("used = %d, waiters = %d after release; want 0 and 0", b.used, len(b.waiters))
+		}
+	})
+
+	t.Run("waiters are granted in order", func(t *testing.T) {
+		b := newMemoryBudget(10)
+		first, _ := b.acquire(context.Background(), 6)
+		large := make(chan func())
+		go func() {
+			release, _ := b.acquire(context.Background(), 8)
+			large <- release
+		}()
+		for {
+			b.mu.Lock()
+			queued := len(b.waiters)
+			b.mu.Unlock()
+			if queued == 1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		// A small reservation that would fit must not overtake the queue.
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if _, err := b.acquire(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("acquire() behind a waiter = %v, want deadline exceeded", err)
+		}
+		first()
+		(<-large)()
+		if b.used != 0 {
+			t.Fatalf("used = %d after all releases, want 0", b.used)
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		b := newMemoryBudget(0)
+		for i := 0; i < 3; i++ {
+			if _, err := b.acquire(context.Background(), 1<<40); err != nil {
+				t.Fatalf("acquire() error = %v", err)
+			}
+		}
+	})
+}
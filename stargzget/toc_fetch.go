@@ -0,0 +1,176 @@
+package stargzget
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+	stor "github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// minTOCSegmentSize is the smallest segment a failing TOC fetch backs
+	// off to.
+	minTOCSegmentSize = 1 << 20
+
+	// tocSegmentAttempts is how many requests in a row may fail without
+	// reading a byte before the TOC fetch fails.
+	tocSegmentAttempts = 4
+)
+
+// tocSegmentSize is the most of a TOC fetched in one range request. Layers
+// with millions of files have TOCs of hundreds of MiB, more than some
+// proxies pass in one response; smaller TOCs still take a single request.
+var tocSegmentSize int64 = 16 << 20
+
+// tocRetryBackoff is the wait before a failed TOC segment is requested
+// again, doubling with each attempt that reads nothing.
+var tocRetryBackoff = 500 * time.Millisecond
+
+// TOCProgressCallback reports how many of the total bytes of blobDigest's
+// TOC section have been fetched; the footer, read beforehand, is not
+// counted. It is called after each segment.
+type TOCProgressCallback func(blobDigest digest.Digest, fetched, total int64)
+
+// WithTOCProgress reports the progress of TOC fetches to progress, so a
+// listing that waits on a huge TOC can say so.
+func WithTOCProgress(progress TOCProgressCallback) BlobResolverOption {
+	return func(r *blobResolver) {
+		r.tocProgress = progress
+	}
+}
+
+// segmentedReader reads the range [offset, end) of a blob as a series of
+// range requests of at most tocSegmentSize bytes. A segment that fails,
+// whether the request or partway through its body, is requested again from
+// the first byte not yet read, each time half as long down to
+// minTOCSegmentSize, so a proxy that cuts long responses short still lets
+// the range through. Only requests that read nothing count towards
+// tocSegmentAttempts; permanent failures such as a 404 are not retried.
+type segmentedReader struct {
+	ctx      context.Context
+	storage  stor.Storage
+	dgst     digest.Digest
+	start    int64
+	offset   int64
+	end      int64
+	segment  int64
+	progress TOCProgressCallback
+
+	body       io.ReadCloser
+	segmentEnd int64
+	attempts   int
+}
+
+func newSegmentedReader(ctx context.Context, storage stor.Storage, dgst digest.Digest, offset, length int64, progress TOCProgressCallback) *segmentedReader {
+	return &segmentedReader{
+		ctx:      ctx,
+		storage:  storage,
+		dgst:     dgst,
+		start:    offset,
+		offset:   offset,
+		end:      offset + length,
+		segment:  tocSegmentSize,
+		progress: progress,
+	}
+}
+
+func (s *segmentedReader) Read(p []byte) (int, error) {
+	for {
+		if s.offset >= s.end {
+			return 0, io.EOF
+		}
+		if s.body == nil {
+			if err := s.open(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if remaining := s.segmentEnd - s.offset; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		n, err := s.body.Read(p)
+		s.offset += int64(n)
+		if n > 0 {
+			s.attempts = 0
+		}
+		if s.offset == s.segmentEnd {
+			s.body.Close()
+			s.body = nil
+			s.report()
+			return n, nil
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			s.body.Close()
+			s.body = nil
+			if retryErr := s.retry(err); retryErr != nil {
+				return n, retryErr
+			}
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// open requests the next segment, backing off through retry while the
+// request fails.
+func (s *segmentedReader) open() error {
+	for {
+		s.segmentEnd = min(s.offset+s.segment, s.end)
+		body, err := s.storage.ReadBlob(s.ctx, s.dgst, s.offset, s.segmentEnd-s.offset)
+		if err == nil {
+			s.body = body
+			return nil
+		}
+		if err := s.retry(err); err != nil {
+			return err
+		}
+	}
+}
+
+// retry records a failed attempt at the current segment, halves the
+// segment size for the next and waits before it, or returns err when it is
+// permanent, once the attempts run out or when the context is done.
+func (s *segmentedReader) retry(err error) error {
+	s.attempts++
+	if stargzerrors.IsPermanent(err) || s.attempts >= tocSegmentAttempts || s.ctx.Err() != nil {
+		return fmt.Errorf("TOC bytes %d-%d: %w", s.offset, s.segmentEnd-1, err)
+	}
+	if s.segment > minTOCSegmentSize {
+		s.segment = max(s.segment/2, minTOCSegmentSize)
+	}
+	delay := tocRetryBackoff << (s.attempts - 1)
+	logger.Warn("Fetching TOC bytes %d-%d of %s failed (%v); retrying in %d byte segments in %s", s.offset, s.segmentEnd-1, s.dgst, err, s.segment, delay)
+	if waitErr := waitRetry(s.ctx, delay); waitErr != nil {
+		return fmt.Errorf("TOC bytes %d-%d: %w", s.offset, s.segmentEnd-1, err)
+	}
+	return nil
+}
+
+func (s *segmentedReader) report() {
+	fetched, total := s.offset-s.start, s.end-s.start
+	if total > tocSegmentSize {
+		logger.Info("Fetched %d of %d bytes of the TOC of %s", fetched, total, s.dgst)
+	}
+	if s.progress != nil {
+		s.progress(s.dgst, fetched, total)
+	}
+}
+
+func (s *segmentedReader) Close() error {
+	if s.body == nil {
+		return nil
+	}
+	err := s.body.Close()
+	s.body = nil
+	return err
+}
@@ -0,0 +1,171 @@
+package stargzget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/opencontainers/go-digest"
+)
+
+// setTOCSegmentSize replaces tocSegmentSize for the duration of the test.
+func setTOCSegmentSize(t *testing.T, size int64) {
+	saved := tocSegmentSize
+	tocSegmentSize = size
+	t.Cleanup(func() { tocSegmentSize = saved })
+}
+
+// setTOCRetryBackoff replaces tocRetryBackoff for the duration of the test.
+func setTOCRetryBackoff(t *testing.T, backoff time.Duration) {
+	saved := tocRetryBackoff
+	tocRetryBackoff = backoff
+	t.Cleanup(func() { tocRetryBackoff = saved })
+}
+
+// cuttingStorage serves data like a proxy that ends every response after
+// limit bytes, and records the ranges requested. With failTOC set, every
+// request after the first, which reads the footer, fails outright with
+// failErr, or a connection reset if it is nil.
+type cuttingStorage struct {
+	stubStorage
+	limit   int64
+	failTOC bool
+	failErr error
+
+	mu     sync.Mutex
+	ranges [][2]int64
+}
+
+func (s *cuttingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, [2]int64{offset, length})
+	footer := len(s.ranges) == 1
+	s.mu.Unlock()
+	if s.failTOC && !footer {
+		if s.failErr != nil {
+			return nil, s.failErr
+		}
+		return nil, errors.New("connection reset")
+	}
+	body, err := s.stubStorage.ReadBlob(ctx, dgst, offset, length)
+	if err != nil || s.limit <= 0 || length <= s.limit {
+		return body, err
+	}
+	return io.NopCloser(io.MultiReader(io.LimitReader(body, s.limit), errReader{io.ErrUnexpectedEOF})), nil
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func manyFilesLayer(t *testing.T, n int) *estargztest.Layer {
+	builder := estargztest.NewBuilder().Dir("files/")
+	for i := 0; i < n; i++ {
+		builder.File(fmt.Sprintf("files/%04d", i), []byte(fmt.Sprintf("file %d\n", i)))
+	}
+	return builder.MustBuild()
+}
+
+func TestBlobResolver_TOCSegments(t *testing.T) {
+	setTOCSegmentSize(t, 512)
+	layer := manyFilesLayer(t, 200)
+	storage := &cuttingStorage{stubStorage: stubStorage{data: layer.Blob}}
+
+	var fetched []int64
+	var total int64
+	resolver := NewBlobResolver(storage,
+		WithBlobSizes(map[digest.Digest]int64{layer.Digest: int64(len(layer.Blob))}),
+		WithTOCProgress(func(dgst digest.Digest, n, of int64) {
+			fetched, total = append(fetched, n), of
+		}))
+
+	toc, err := resolver.TOC(context.Background(), layer.Digest)
+	if err != nil {
+		t.Fatalf("TOC() error = %v", err)
+	}
+	if len(toc.Entries) != len(layer.TOC.Entries) {
+		t.Fatalf("TOC has %d entries, want %d", len(toc.Entries), len(layer.TOC.Entries))
+	}
+
+	tocRequests := storage.ranges[1:] // after the footer
+	if len(tocRequests) < 2 {
+		t.Fatalf("TOC fetched in %d requests, want several", len(tocRequests))
+	}
+	for _, r := range tocRequests {
+		if r[1] > 512 {
+			t.Errorf("request for %d bytes at %d exceeds the segment size", r[1], r[0])
+		}
+	}
+	if len(fetched) != len(tocRequests) || fetched[len(fetched)-1] != total {
+		t.Errorf("progress = %v of %d, want one report per segment ending at the total", fetched, total)
+	}
+}
+
+func TestBlobResolver_TOCSegmentsResumeCutResponses(t *testing.T) {
+	setTOCSegmentSize(t, 512)
+	setTOCRetryBackoff(t, 0)
+	layer := manyFilesLayer(t, 200)
+	storage := &cuttingStorage{stubStorage: stubStorage{data: layer.Blob}, limit: 300}
+	resolver := NewBlobResolver(storage, WithBlobSizes(map[digest.Digest]int64{layer.Digest: int64(len(layer.Blob))}))
+
+	toc, err := resolver.TOC(context.Background(), layer.Digest)
+	if err != nil {
+		t.Fatalf("TOC() error = %v", err)
+	}
+	if len(toc.Entries) != len(layer.TOC.Entries) {
+		t.Fatalf("TOC has %d entries, want %d", len(toc.Entries), len(layer.TOC.Entries))
+	}
+	// Each request picks up where the one before was cut off.
+	tocRequests := storage.ranges[1:]
+	for i := 1; i < len(tocRequests); i++ {
+		prev, cur := tocRequests[i-1], tocRequests[i]
+		if want := prev[0] + min(prev[1], 300); cur[0] != want {
+			t.Fatalf("request %d starts at %d, want %d", i, cur[0], want)
+		}
+	}
+}
+
+func TestBlobResolver_TOCSegmentsGiveUp(t *testing.T) {
+	setTOCRetryBackoff(t, 10*time.Millisecond)
+	layer := manyFilesLayer(t, 10)
+	storage := &cuttingStorage{stubStorage: stubStorage{data: layer.Blob}, failTOC: true}
+	resolver := NewBlobResolver(storage, WithBlobSizes(map[digest.Digest]int64{layer.Digest: int64(len(layer.Blob))}))
+
+	started := time.Now()
+	_, err := resolver.TOC(context.Background(), layer.Digest)
+	if code := stargzerrors.GetErrorCode(err); code != stargzerrors.ErrTOCDownload.Code {
+		t.Fatalf("TOC() error = %v, want code %s", err, stargzerrors.ErrTOCDownload.Code)
+	}
+	if got := len(storage.ranges) - 1; got != tocSegmentAttempts {
+		t.Fatalf("TOC requested %d times, want %d", got, tocSegmentAttempts)
+	}
+	// The waits between attempts double: 10ms, 20ms, 40ms.
+	if elapsed := time.Since(started); elapsed < 70*time.Millisecond {
+		t.Fatalf("TOC gave up after %s, want it to back off between attempts", elapsed)
+	}
+}
+
+func TestBlobResolver_TOCSegmentsPermanentFailure(t *testing.T) {
+	setTOCRetryBackoff(t, time.Hour)
+	layer := manyFilesLayer(t, 10)
+	storage := &cuttingStorage{
+		stubStorage: stubStorage{data: layer.Blob},
+		failTOC:     true,
+		failErr:     stargzerrors.ErrAuthFailed.WithDetail("registry", "registry.example.com"),
+	}
+	resolver := NewBlobResolver(storage, WithBlobSizes(map[digest.Digest]int64{layer.Digest: int64(len(layer.Blob))}))
+
+	_, err := resolver.TOC(context.Background(), layer.Digest)
+	if !stargzerrors.IsPermanent(err) {
+		t.Fatalf("TOC() error = %v, want the permanent failure", err)
+	}
+	if got := len(storage.ranges) - 1; got != 1 {
+		t.Fatalf("TOC requested %d times, want 1", got)
+	}
+}
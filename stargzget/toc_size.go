@@ -0,0 +1,59 @@
+package stargzget
+
+import (
+	"fmt"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+)
+
+const (
+	tarBlockSize = 512
+
+	// tocSizeSlack is how far a layer's uncompressed size may exceed twice
+	// what its TOC accounts for before the TOC is suspected of missing
+	// entries. It keeps small layers, where the TOC's own tar entry and
+	// extended headers weigh most, from being flagged.
+	tocSizeSlack = 1 << 20
+)
+
+// minTarSize returns the fewest bytes a tar stream holding the entries of
+// toc can take: a header per entry, the content of regular files padded to
+// whole blocks, an extra header and name block for names too long for the
+// tar header, and the end-of-archive blocks. Chunk entries continue a file
+// and take no room of their own.
+func minTarSize(toc *estargzutil.JTOC) int64 {
+	size := int64(2 * tarBlockSize)
+	for _, entry := range toc.Entries {
+		if entry == nil || entry.Type == "chunk" {
+			continue
+		}
+		size += tarBlockSize
+		if len(entry.Name) > 100 {
+			size += 2 * tarBlockSize
+		}
+		if entry.Type == "reg" && entry.Size > 0 {
+			size += (entry.Size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+		}
+	}
+	return size
+}
+
+// checkTOCSize compares the tar stream toc describes with uncompressed, the
+// layer's size from its io.containers.estargz.uncompressed-size annotation.
+// A TOC describing more than fits is corrupt; one describing less than half
+// of it, by more than tocSizeSlack, has likely lost entries. Either way the
+// index built from it would be wrong, so the error is worth raising before
+// any file is downloaded. A size of 0 is unknown and passes.
+func checkTOCSize(toc *estargzutil.JTOC, uncompressed int64) error {
+	if uncompressed <= 0 {
+		return nil
+	}
+	described := minTarSize(toc)
+	switch {
+	case described > uncompressed:
+		return fmt.Errorf("TOC describes at least %d bytes of tar, more than the layer's uncompressed size of %d bytes; the TOC may be corrupt", described, uncompressed)
+	case uncompressed-2*described > tocSizeSlack:
+		return fmt.Errorf("TOC describes about %d bytes of tar, less than half the layer's uncompressed size of %d bytes; the TOC may be truncated", described, uncompressed)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package stargzget
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TransactionMarker is the file a committed Transaction leaves in its root.
+const TransactionMarker = ".starget-complete"
+
+// Transaction stages a download's output under a temporary directory and
+// moves it into place only once the whole download succeeded, so readers of
+// the output tree never see some files of a run without the others. Jobs
+// get their OutputPath (and LinkTo) from Path before the download, and the
+// records made during it name the Final paths; Commit then renames each
+// staged file over its final path, which replaces it atomically, and
+// writes TransactionMarker last. Readers that need the whole tree wait for
+// the marker, which Commit removes before the first rename.
+//
+// The staging directory is a hidden sibling of the root, so renames stay
+// on one filesystem and nothing of it shows up under the root.
+type Transaction struct {
+	root    string
+	dir     string // root as given to BeginTransaction
+	staging string
+}
+
+// BeginTransaction creates the staging directory for output under root.
+func BeginTransaction(root string) (*Transaction, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	parent := filepath.Dir(abs)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(parent, "."+filepath.Base(abs)+".starget-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	return &Transaction{root: abs, dir: root, staging: staging}, nil
+}
+
+// Root returns the directory the transaction commits into.
+func (t *Transaction) Root() string {
+	return t.root
+}
+
+// Path returns where output, a path under the root, is staged.
+func (t *Transaction) Path(output string) (string, error) {
+	abs, err := filepath.Abs(output)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(t.root, abs)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("output %s is not under %s", output, t.root)
+	}
+	return filepath.Join(t.staging, rel), nil
+}
+
+// Final returns where staged, a path Path returned, ends up once the
+// transaction commits, relative to the root as it was given to
+// BeginTransaction. Other paths, and every path of a nil Transaction, are
+// returned as they are.
+func (t *Transaction) Final(staged string) string {
+	if t == nil {
+		return staged
+	}
+	rel, err := filepath.Rel(t.staging, staged)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return staged
+	}
+	return filepath.Join(t.dir, rel)
+}
+
+// Commit moves the staged files into place, writes TransactionMarker and
+// removes the staging directory. It returns the number of files moved. A
+// failed rename leaves the files moved so far in place, the others staged,
+// and no marker.
+func (t *Transaction) Commit() (int, error) {
+	marker := filepath.Join(t.root, TransactionMarker)
+	if err := os.MkdirAll(t.root, 0o755); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	moved := 0
+	err := filepath.WalkDir(t.staging, func(staged string, d fs.DirEntry, err error) error {
+		if err != nil || staged == t.staging {
+			return err
+		}
+		rel, err := filepath.Rel(t.staging, staged)
+		if err != nil {
+			return err
+		}
+		final := filepath.Join(t.root, rel)
+		if d.IsDir() {
+			return os.MkdirAll(final, 0o755)
+		}
+		if info, err := os.Lstat(final); err == nil && info.IsDir() {
+			return fmt.Errorf("cannot replace directory %s with a file", final)
+		}
+		if err := os.Rename(staged, final); err != nil {
+			return err
+		}
+		moved++
+		return nil
+	})
+	if err != nil {
+		return moved, fmt.Errorf("failed to commit staged output: %w", err)
+	}
+
+	tmp := marker + ".tmp"
+	content := fmt.Sprintf("%s %d files\n", time.Now().UTC().Format(time.RFC3339), moved)
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		return moved, err
+	}
+	if err := os.Rename(tmp, marker); err != nil {
+		return moved, err
+	}
+	return moved, os.RemoveAll(t.staging)
+}
+
+// Abort removes the staging directory and everything staged in it, leaving
+// the root as it was.
+func (t *Transaction) Abort() error {
+	return os.RemoveAll(t.staging)
+}
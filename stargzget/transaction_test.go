@@ -0,0 +1,155 @@
+package stargzget
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestTransaction_Commit(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "out")
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(root, "etc", "conf"), []byte("old"), 0o644)
+	os.WriteFile(filepath.Join(root, TransactionMarker), []byte("earlier run"), 0o644)
+
+	tx, err := BeginTransaction(root)
+	if err != nil {
+		t.Fatalf("BeginTransaction() error = %v", err)
+	}
+	for name, content := range map[string]string{"etc/conf": "new", "usr/bin/tool": "tool"} {
+		staged, err := tx.Path(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("Path(%s) error = %v", name, err)
+		}
+		os.MkdirAll(filepath.Dir(staged), 0o755)
+		if err := os.WriteFile(staged, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Path(filepath.Join(root, "..", "escape")); err == nil {
+		t.Errorf("Path() of a file outside the root succeeded")
+	}
+
+	// Nothing is visible before the commit.
+	if data, _ := os.ReadFile(filepath.Join(root, "etc", "conf")); string(data) != "old" {
+		t.Errorf("etc/conf before Commit() = %q, want the old content", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, "usr")); !os.IsNotExist(err) {
+		t.Errorf("usr exists before Commit()")
+	}
+
+	moved, err := tx.Commit()
+	if err != nil || moved != 2 {
+		t.Fatalf("Commit() = %d, %v; want 2 files", moved, err)
+	}
+	for name, want := range map[string]string{"etc/conf": "new", "usr/bin/tool": "tool"} {
+		if data, _ := os.ReadFile(filepath.Join(root, name)); string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(root, TransactionMarker)); err != nil || string(data) == "earlier run" {
+		t.Errorf("marker = %q, %v; want a new marker", data, err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(root))
+	if len(entries) != 1 {
+		t.Errorf("parent holds %d entries, want only the root (staging directory removed)", len(entries))
+	}
+}
+
+func TestTransaction_Abort(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "out")
+	tx, err := BeginTransaction(root)
+	if err != nil {
+		t.Fatalf("BeginTransaction() error = %v", err)
+	}
+	staged, _ := tx.Path(filepath.Join(root, "file"))
+	os.WriteFile(staged, []byte("partial"), 0o644)
+
+	if err := tx.Abort(); err != nil {
+		t.Fatalf("Abort() error = %v", err)
+	}
+	entries, _ := os.ReadDir(parent)
+	if len(entries) != 0 {
+		t.Errorf("parent holds %v after Abort(), want nothing", entries)
+	}
+}
+
+func TestTransaction_Final(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "out")
+	tx, err := BeginTransaction(root)
+	if err != nil {
+		t.Fatalf("BeginTransaction() error = %v", err)
+	}
+	defer tx.Abort()
+
+	output := filepath.Join(root, "etc", "conf")
+	staged, _ := tx.Path(output)
+	if got := tx.Final(staged); got != output {
+		t.Errorf("Final(%s) = %s, want %s", staged, got, output)
+	}
+	other := filepath.Join(filepath.Dir(root), "elsewhere")
+	if got := tx.Final(other); got != other {
+		t.Errorf("Final(%s) = %s, want it unchanged", other, got)
+	}
+	var none *Transaction
+	if got := none.Final(staged); got != staged {
+		t.Errorf("Final() of a nil Transaction = %s, want %s", got, staged)
+	}
+}
+
+func TestDownloader_TransactionReportsFinalPaths(t *testing.T) {
+	layer := estargztest.NewBuilder().
+		File("etc/app.conf", []byte("debug = false\n")).
+		File("etc/key", []byte(fakeKey)).
+		File("root/.ssh/id_ed25519", []byte(fakeKey)).
+		MustBuild()
+	store := storage.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+
+	root := filepath.Join(t.TempDir(), "out")
+	tx, err := BeginTransaction(root)
+	if err != nil {
+		t.Fatalf("BeginTransaction() error = %v", err)
+	}
+	defer tx.Abort()
+	var jobs []*DownloadJob
+	for path, size := range map[string]int64{"etc/app.conf": 14, "etc/key": int64(len(fakeKey)), "root/.ssh/id_ed25519": int64(len(fakeKey))} {
+		staged, _ := tx.Path(filepath.Join(root, path))
+		jobs = append(jobs, &DownloadJob{Path: path, BlobDigest: layer.Digest, Size: size, OutputPath: staged})
+	}
+
+	opts := &DownloadOptions{ContentFilter: flagConfigs{NewSecretFilter(FilterBlock)}, Transaction: tx}
+	stats, err := NewDownloader(NewBlobResolver(store), store).StartDownload(context.Background(), jobs, nil, opts)
+	if err != nil {
+		t.Fatalf("StartDownload() error = %v", err)
+	}
+
+	var got []string
+	for _, hit := range stats.Filtered {
+		got = append(got, hit.OutputPath+" "+hit.Action.String())
+	}
+	sort.Strings(got)
+	want := []string{
+		filepath.Join(root, "etc/app.conf") + " flagged",
+		filepath.Join(root, "etc/key") + " blocked",
+		filepath.Join(root, "root/.ssh/id_ed25519") + " blocked",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Filtered = %v, want %v", got, want)
+	}
+	// The file blocked by content is still removed from the staging
+	// directory.
+	staged, _ := tx.Path(filepath.Join(root, "etc/key"))
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Errorf("%s is staged after being blocked (stat err = %v)", staged, err)
+	}
+}
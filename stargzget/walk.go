@@ -0,0 +1,117 @@
+package stargzget
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// WalkFunc receives each regular file of a layer during Walk. r yields the
+// file's content and is only valid until WalkFunc returns. Returning
+// fs.SkipAll stops the walk without an error; any other error stops it and
+// is returned by Walk.
+type WalkFunc func(entry *estargzutil.TOCEntry, r io.Reader) error
+
+// Walk calls fn for every regular file of the layer blobDigest, in the
+// order the files are stored, i.e. by compressed offset. Unlike
+// StartDownload, which fetches each file's chunks with range requests,
+// Walk reads the blob as one sequential stream and decodes it on the fly,
+// which is the cheapest way to look at every file of a layer, e.g. to scan
+// it, without writing anything to disk. The stream is closed once the last
+// regular file the TOC lists was read, so the TOC itself is not fetched
+// again.
+//
+// Files whose TOC entry records a digest are checked: what fn did not read
+// is read after it returns, and a mismatch fails the walk.
+func (d *downloader) Walk(ctx context.Context, blobDigest digest.Digest, fn WalkFunc) error {
+	toc, err := d.resolver.TOC(ctx, blobDigest)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]*estargzutil.TOCEntry)
+	for _, entry := range toc.Entries {
+		if entry != nil && entry.Type == "reg" {
+			entries[cleanEntryName(entry.Name)] = entry
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	format := LayerFormatGzip
+	if toc.StreamedFormat != "" {
+		format = LayerFormat(toc.StreamedFormat)
+	}
+	tr, release, err := openLayerTar(ctx, d.storage, blobDigest, format)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for remaining := len(entries); remaining > 0; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("layer %s ended with %d file(s) of its TOC not found", blobDigest, remaining)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read layer %s: %w", blobDigest, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := cleanEntryName(hdr.Name)
+		entry, ok := entries[name]
+		if !ok {
+			continue
+		}
+		delete(entries, name)
+		remaining--
+
+		if err := walkEntry(entry, tr, fn); err != nil {
+			if errors.Is(err, fs.SkipAll) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// walkEntry hands one file to fn and checks its digest.
+func walkEntry(entry *estargzutil.TOCEntry, r io.Reader, fn WalkFunc) error {
+	var verifier digest.Digester
+	if want, err := digest.Parse(entry.Digest); err == nil && want.Algorithm().Available() {
+		verifier = want.Algorithm().Digester()
+		r = io.TeeReader(r, verifier.Hash())
+	}
+	if err := fn(entry, r); err != nil {
+		return err
+	}
+	if verifier == nil {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("%s: %w", entry.Name, err)
+	}
+	if got := verifier.Digest().String(); got != entry.Digest {
+		return fmt.Errorf("%s: content digest %s does not match TOC digest %s", entry.Name, got, entry.Digest)
+	}
+	return nil
+}
+
+// cleanEntryName normalizes a tar or TOC entry name, which may carry a
+// leading "./" or "/", to a path relative to the layer root.
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
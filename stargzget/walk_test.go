@@ -0,0 +1,76 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flaneur2020/stargz-get/stargzget/estargzutil"
+	"github.com/flaneur2020/stargz-get/stargzget/internal/estargztest"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+)
+
+func TestDownloader_Walk(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	layer := estargztest.NewBuilder(estargztest.WithChunkSize(1024)).
+		File("etc/conf", []byte("conf")).
+		File("usr/bin/big", big).
+		Symlink("usr/bin/link", "big").
+		File("usr/share/empty", nil).
+		File("var/data", []byte("data")).
+		MustBuild()
+	store := storage.NewMockStorage()
+	store.AddBlob("application/vnd.oci.image.layer.v1.tar+gzip", layer.Blob)
+	resolver := NewBlobResolver(store)
+	downloader := NewDownloader(resolver, store)
+
+	var names []string
+	contents := make(map[string][]byte)
+	err := downloader.Walk(context.Background(), layer.Digest, func(entry *estargzutil.TOCEntry, r io.Reader) error {
+		names = append(names, entry.Name)
+		data, err := io.ReadAll(r)
+		contents[entry.Name] = data
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Walk() error = %v", err)
+	}
+	if want := []string{"etc/conf", "usr/bin/big", "usr/share/empty", "var/data"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Walk() visited %v, want %v", names, want)
+	}
+	if !bytes.Equal(contents["usr/bin/big"], big) || string(contents["var/data"]) != "data" {
+		t.Errorf("Walk() returned wrong content")
+	}
+
+	// fs.SkipAll stops early, and files left unread are still fine.
+	visited := 0
+	err = downloader.Walk(context.Background(), layer.Digest, func(entry *estargzutil.TOCEntry, r io.Reader) error {
+		visited++
+		if visited == 2 {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil || visited != 2 {
+		t.Errorf("Walk() with fs.SkipAll = %v after %d files, want nil after 2", err, visited)
+	}
+
+	// Content that does not match the TOC digest fails the walk.
+	toc, err := resolver.TOC(context.Background(), layer.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range toc.Entries {
+		if entry.Name == "var/data" {
+			entry.Digest = layer.Digest.Algorithm().FromString("other").String()
+		}
+	}
+	err = downloader.Walk(context.Background(), layer.Digest, func(*estargzutil.TOCEntry, io.Reader) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "var/data") {
+		t.Errorf("Walk() with a wrong TOC digest = %v, want a mismatch for var/data", err)
+	}
+}
@@ -0,0 +1,55 @@
+package stargzget
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// WarningKind classifies a non-fatal condition reported to library users.
+type WarningKind string
+
+const (
+	WarningLayerSkipped       WarningKind = "layer-skipped"       // A layer's TOC could not be loaded; its files are missing from the index
+	WarningLayerUnauthorized  WarningKind = "layer-unauthorized"  // Like WarningLayerSkipped, but access to the blob was denied (401/403), e.g. because it lives in another repository
+	WarningRetry              WarningKind = "retry"               // A file download failed and is being retried
+	WarningSequentialFallback WarningKind = "sequential-fallback" // A blob switched from parallel range requests to sequential streaming
+	WarningFileFailed         WarningKind = "file-failed"         // A file failed after all retries (counted in DownloadStats.FailedFiles)
+	WarningStalled            WarningKind = "stalled"             // A download made no progress for DownloadOptions.StallTimeout; Err describes the pipeline
+	WarningDigestMismatch     WarningKind = "digest-mismatch"     // A downloaded file does not match the digest in its TOC entry (checked when DownloadOptions.Provenance is set)
+	WarningContentFlagged     WarningKind = "content-flagged"     // DownloadOptions.ContentFilter flagged or blocked a file; Err gives the reason
+	WarningUnknownTOCEntries  WarningKind = "unknown-toc-entries" // A layer's TOC has entries of types this version does not know; they are left out of the index and Err counts them by type
+	WarningTOCSizeMismatch    WarningKind = "toc-size-mismatch"   // A layer's TOC describes more, or far less, than the uncompressed size recorded in the manifest; the TOC is likely corrupt or truncated
+)
+
+// Warning describes a condition that did not abort the operation but that
+// callers may want to surface, e.g. in their own UI. The same conditions are
+// still written to the global logger.
+type Warning struct {
+	Kind       WarningKind
+	BlobDigest digest.Digest // Blob involved, if any
+	Path       string        // File path in the image, if any
+	Attempt    int           // Retry attempt number for WarningRetry
+	Err        error         // Underlying error, if any
+}
+
+func (w Warning) String() string {
+	subject := w.Path
+	if subject == "" {
+		subject = w.BlobDigest.String()
+	}
+	msg := string(w.Kind)
+	if subject != "" {
+		msg += ": " + subject
+	}
+	if w.Attempt > 0 {
+		msg += fmt.Sprintf(" (attempt %d)", w.Attempt)
+	}
+	if w.Err != nil {
+		msg += fmt.Sprintf(": %v", w.Err)
+	}
+	return msg
+}
+
+// WarningCallback receives warnings as they happen. Calls are serialized.
+type WarningCallback func(Warning)
@@ -0,0 +1,120 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/logger"
+)
+
+// PipelineStats is a snapshot of a running download's pipeline. Many queued
+// jobs with few open reads point at slow workers or file I/O; open reads
+// that stop moving point at the registry or the network.
+type PipelineStats struct {
+	QueuedJobs  int           // Jobs waiting for a worker
+	ActiveFiles int           // Files being downloaded
+	OpenReads   int           // Blob bodies opened and not yet closed
+	BytesRead   int64         // Compressed bytes read so far
+	Idle        time.Duration // Time since the last progress; only tracked when DownloadOptions.StallTimeout is set
+}
+
+// minStallCheckInterval bounds how often the watchdog samples progress.
+const minStallCheckInterval = 10 * time.Millisecond
+
+// pipeline returns the current pipeline metrics of the session.
+func (s *downloadSession) pipeline() PipelineStats {
+	s.mu.Lock()
+	active := len(s.activeFiles)
+	s.mu.Unlock()
+
+	p := PipelineStats{
+		QueuedJobs:  int(s.queued.Load()),
+		ActiveFiles: active,
+		OpenReads:   int(s.meter.openReads.Load()),
+		BytesRead:   s.meter.bytesRead.Load(),
+	}
+	if last := s.lastProgress.Load(); last != 0 {
+		p.Idle = time.Since(time.Unix(0, last))
+	}
+	return p
+}
+
+// progressMark changes whenever the download moves forward: bytes arrive,
+// or a file completes, fails or is retried.
+func (s *downloadSession) progressMark() int64 {
+	s.mu.Lock()
+	events := int64(s.stats.DownloadedFiles + s.stats.FailedFiles + s.stats.Retries)
+	s.mu.Unlock()
+	return s.meter.bytesRead.Load() + events
+}
+
+// watchStalls samples progress until stop is closed. When nothing moves
+// for StallTimeout while the download is not paused, it reports the stall
+// once and, with AbortOnStall, cancels the download with an
+// ErrDownloadStalled error describing the pipeline's state.
+func (s *downloadSession) watchStalls(stop <-chan struct{}, abort context.CancelCauseFunc) {
+	timeout := s.opts.StallTimeout
+	interval := timeout / 4
+	if interval < minStallCheckInterval {
+		interval = minStallCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := s.progressMark()
+	lastChange := time.Now()
+	s.lastProgress.Store(lastChange.UnixNano())
+	stalled := false
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			mark := s.progressMark()
+			if mark != last || s.gate.isPaused() {
+				last, lastChange, stalled = mark, now, false
+				s.lastProgress.Store(now.UnixNano())
+				continue
+			}
+			if stalled || now.Sub(lastChange) < timeout {
+				continue
+			}
+			stalled = true
+			s.reportStall(now.Sub(lastChange), abort)
+		}
+	}
+}
+
+// reportStall logs the pipeline state, dumping all goroutines at debug
+// level, and warns or aborts.
+func (s *downloadSession) reportStall(idle time.Duration, abort context.CancelCauseFunc) {
+	p := s.pipeline()
+	s.mu.Lock()
+	s.stats.Stalls++
+	active := append([]string(nil), s.activeFiles...)
+	s.mu.Unlock()
+
+	logger.Warn("Download stalled: no progress for %s (%d active files, %d queued jobs, %d open blob reads)",
+		idle.Round(time.Millisecond), p.ActiveFiles, p.QueuedJobs, p.OpenReads)
+	if logger.GetLogLevel() >= logger.LogLevelDebug {
+		logger.Debug("Stalled files: %s", strings.Join(active, ", "))
+		var buf bytes.Buffer
+		if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err == nil {
+			logger.Debug("Goroutines at stall:\n%s", buf.String())
+		}
+	}
+
+	err := stargzerrors.ErrDownloadStalled.
+		WithDetail("idle", idle.Round(time.Millisecond).String()).
+		WithDetail("activeFiles", active).
+		WithDetail("queuedJobs", p.QueuedJobs).
+		WithDetail("openReads", p.OpenReads)
+	s.warn(Warning{Kind: WarningStalled, Err: err})
+	if s.opts.AbortOnStall {
+		abort(err)
+	}
+}
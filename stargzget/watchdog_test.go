@@ -0,0 +1,131 @@
+package stargzget
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	stargzerrors "github.com/flaneur2020/stargz-get/stargzget/errors"
+	"github.com/flaneur2020/stargz-get/stargzget/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// hangingStorage serves every read with a body that blocks until closed.
+type hangingStorage struct {
+	*storage.MockStorage
+}
+
+func (s *hangingStorage) ReadBlob(ctx context.Context, dgst digest.Digest, offset int64, length int64) (io.ReadCloser, error) {
+	return &stalledBody{closed: make(chan struct{})}, nil
+}
+
+func newHangingDownload(t *testing.T) (*hangingStorage, *mockBlobResolver, []*DownloadJob) {
+	t.Helper()
+	content := bytes.Repeat([]byte("x"), 256)
+	base := storage.NewMockStorage()
+	resolver := newMockBlobResolver()
+	dgst := addFileToStorage(t, base, resolver, "etc/data", content, 256)
+	jobs := []*DownloadJob{{
+		Path:       "etc/data",
+		BlobDigest: dgst,
+		Size:       int64(len(content)),
+		OutputPath: filepath.Join(t.TempDir(), "data"),
+	}}
+	return &hangingStorage{MockStorage: base}, resolver, jobs
+}
+
+func TestDownloader_AbortOnStall(t *testing.T) {
+	store, resolver, jobs := newHangingDownload(t)
+
+	var mu sync.Mutex
+	var warnings []Warning
+	opts := &DownloadOptions{
+		Concurrency:  1,
+		StallTimeout: 50 * time.Millisecond,
+		AbortOnStall: true,
+		OnWarning: func(w Warning) {
+			mu.Lock()
+			warnings = append(warnings, w)
+			mu.Unlock()
+		},
+	}
+
+	done := make(chan struct{})
+	var stats *DownloadStats
+	var err error
+	go func() {
+		defer close(done)
+		stats, err = NewDownloader(resolver, store).StartDownload(context.Background(), jobs, nil, opts)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartDownload() did not return after a stall")
+	}
+
+	if code := stargzerrors.GetErrorCode(err); code != stargzerrors.ErrDownloadStalled.Code {
+		t.Fatalf("StartDownload() error = %v, want code %s", err, stargzerrors.ErrDownloadStalled.Code)
+	}
+	if stats.Stalls != 1 {
+		t.Errorf("Stalls = %d, want 1", stats.Stalls)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var stalled int
+	for _, w := range warnings {
+		if w.Kind == WarningStalled {
+			stalled++
+		}
+	}
+	if stalled != 1 {
+		t.Errorf("stalled warnings = %d, want 1 (all: %v)", stalled, warnings)
+	}
+}
+
+func TestDownloadController_PipelineStats(t *testing.T) {
+	store, resolver, jobs := newHangingDownload(t)
+
+	stalled := make(chan struct{}, 1)
+	opts := &DownloadOptions{
+		Concurrency:  1,
+		StallTimeout: 50 * time.Millisecond,
+		OnWarning: func(w Warning) {
+			if w.Kind == WarningStalled {
+				stalled <- struct{}{}
+			}
+		},
+	}
+	ctrl := NewDownloader(resolver, store).StartDownloadAsync(context.Background(), jobs, nil, opts)
+
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stall reported")
+	}
+
+	// Without AbortOnStall the download keeps waiting.
+	status := ctrl.Status()
+	if status.State != DownloadRunning {
+		t.Fatalf("State = %s, want running", status.State)
+	}
+	p := status.Pipeline
+	if p.ActiveFiles != 1 || p.QueuedJobs != 0 || p.OpenReads != 1 {
+		t.Errorf("Pipeline = %+v, want 1 active file, 0 queued jobs, 1 open read", p)
+	}
+	if p.Idle < 50*time.Millisecond {
+		t.Errorf("Pipeline.Idle = %s, want at least the stall timeout", p.Idle)
+	}
+
+	ctrl.Cancel()
+	stats, err := ctrl.Wait()
+	if err != context.Canceled {
+		t.Fatalf("Wait() error = %v, want context.Canceled", err)
+	}
+	if stats.Stalls != 1 {
+		t.Errorf("Stalls = %d, want 1", stats.Stalls)
+	}
+}